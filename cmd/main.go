@@ -1,23 +1,38 @@
 package main
 
 import (
+	"flag"
 	"io"
 	"os"
 	"strings"
 
-	"github.com/jahrulnr/go-waf/config"
 	"github.com/jahrulnr/go-waf/internal/app"
+	"github.com/jahrulnr/go-waf/pkg/config"
 	"github.com/jahrulnr/go-waf/pkg/logger"
 
 	"github.com/gin-gonic/gin"
 )
 
 func main() {
-	// load config from os or from .env file
-	config := config.Load()
+	// load config from a file, os or .env file
+	file, ok := os.LookupEnv("WAF_CONFIG_FILE")
+	if !ok {
+		file = os.Getenv("CONFIG_FILE")
+	}
+	path := flag.String("config", file, "YAML config file, environment variables override it")
+	flag.Parse()
+	config, err := config.Load(*path)
+	if err != nil {
+		logger.Logger("[Fatal] Invalid config.\n", err.Error()).Fatal()
+	}
 
 	// initialize logger based on config
-	logger.SetLevel(config.LOG_LEVEL)
+	level, err := logger.ParseLevel(config.LOG_LEVEL)
+	if err != nil {
+		logger.Logger("[warn] ", err.Error(), ", using info").Warn()
+	}
+	logger.SetLevel(level)
+	logger.SetFormat(logger.Format(config.LOG_FORMAT))
 	if config.LOG_FILE != "" {
 		logger.SetOutput(loggerOutput(config.LOG_FILE))
 	}
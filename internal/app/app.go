@@ -1,56 +1,150 @@
 package app
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/jahrulnr/go-waf/config"
 	delivery_http "github.com/jahrulnr/go-waf/internal/delivery/http"
+	"github.com/jahrulnr/go-waf/internal/interface/repository"
+	"github.com/jahrulnr/go-waf/internal/interface/service"
 	service_cache "github.com/jahrulnr/go-waf/internal/service/cache"
+	"github.com/jahrulnr/go-waf/pkg/config"
 	"github.com/jahrulnr/go-waf/pkg/httpserver"
+	"github.com/jahrulnr/go-waf/pkg/lifecycle"
 	"github.com/jahrulnr/go-waf/pkg/logger"
+	"github.com/jahrulnr/go-waf/pkg/tracing"
 )
 
 type App struct {
 	config *config.Config
 
-	notify chan os.Signal
+	lifecycle  *lifecycle.Lifecycle
+	notify     chan os.Signal
+	stateStore repository.StateStore
 }
 
 func NewApp(config *config.Config) *App {
 	app := &App{
 		config: config,
 
-		notify: make(chan os.Signal, 1),
+		lifecycle: lifecycle.NewLifecycle(),
+		notify:    make(chan os.Signal, 1),
 	}
 
 	return app
 }
 
-func (a *App) execute() {
+// SetStateStore keeps the bans, counters, nonces and locks in store, e.g.
+// Postgres or DynamoDB, instead of the STATE_DRIVER or the cache driver.
+func (a *App) SetStateStore(store repository.StateStore) {
+	a.stateStore = store
+}
+
+// execute registers every component with the lifecycle, in the order they
+// start, and serves until the server fails or a signal arrives.
+func (a *App) execute() os.Signal {
+	// spans are flushed last, after the server answered its last request
+	if a.config.USE_TRACING {
+		shutdown, err := tracing.NewProvider(context.Background(), a.config.TRACING_SAMPLE_RATIO)
+		if err != nil {
+			logger.Logger("[Fatal] Tracing setup error.", err.Error()).Fatal()
+		}
+		a.lifecycle.Register("tracing", lifecycle.Hook{OnShutdown: shutdown})
+	}
+
 	server := httpserver.NewHttpServer(a.config)
-	cacheHandler := service_cache.NewCacheService(a.config)
-	router := delivery_http.NewHttpRouter(a.config, cacheHandler)
+	cacheDriver := service_cache.NewCacheDriver(a.config)
+	server.SetCache(cacheDriver)
+	if closer, ok := cacheDriver.(io.Closer); ok {
+		a.lifecycle.Register("cache", lifecycle.Closer(closer))
+	}
+	stateStore := a.stateStore
+	if stateStore == nil {
+		if driver := service_cache.NewStateStore(a.config); driver != nil {
+			if closer, ok := driver.(io.Closer); ok {
+				a.lifecycle.Register("state store", lifecycle.Closer(closer))
+			}
+			stateStore = driver
+		}
+	}
+
+	var cacheHandler service.CacheInterface
+	if stateStore != nil {
+		cacheHandler = service_cache.NewCacheServiceWithLocks(a.config, cacheDriver, stateStore)
+	} else {
+		cacheHandler = service_cache.NewCacheService(a.config, cacheDriver)
+	}
+	router := delivery_http.NewHttpRouter(a.config, cacheHandler, cacheDriver)
+	router.SetLifecycle(a.lifecycle)
+	if stateStore != nil {
+		router.SetStateStore(stateStore)
+	}
 
 	server.SetHandler(router.GetHandler())
-	server.Start()
+	server.SetAutoBan(router.AutoBan())
 
-	err := <-server.Notify()
-	if err != nil {
-		logger.Logger(err).Error()
-		a.notify <- os.Kill
+	// rate limits, waf and ban thresholds follow the config file
+	if a.config.CONFIG_FILE != "" {
+		watcher, err := config.NewWatcher(a.config)
+		if err != nil {
+			logger.Logger("[warn] config file is not watched ", err.Error()).Warn()
+		} else {
+			watcher.OnReload(router.Reload)
+			a.lifecycle.Register("config watcher", lifecycle.Closer(watcher))
+		}
 	}
+
+	// the server stops first, draining its requests while the rest still runs
+	a.lifecycle.Register("http server", lifecycle.Hook{
+		OnStart: func(context.Context) error {
+			server.Start()
+			return nil
+		},
+		OnShutdown: server.Shutdown,
+	})
+
+	signal.Notify(a.notify, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(a.notify)
+
+	if err := a.lifecycle.Start(context.Background()); err != nil {
+		logger.Logger("[Fatal] Start error.", err.Error()).Fatal()
+	}
+
+	var cause os.Signal
+	select {
+	case err := <-server.Notify():
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Logger(err).Error()
+		}
+		cause = os.Kill
+	case cause = <-a.notify:
+		logger.Logger("[info] received ", cause.String(), ", shutting down").Info()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(a.config.SHUTDOWN_TIMEOUT)*time.Second)
+	defer cancel()
+	if err := a.lifecycle.Shutdown(ctx); err != nil {
+		logger.Logger("[warn] unclean shutdown ", err.Error()).Warn()
+	}
+
+	return cause
 }
 
 func (a *App) Start() {
 	start := time.Now()
 	logger.Logger(fmt.Sprintf("[Info] HttpServer listen and serve at %s", a.config.ADDR)).Info()
-	a.execute()
+	cause := a.execute()
 
 	logger.Logger(map[string]any{
 		"message":       "App stopped",
 		"stopped_after": time.Since(start),
-		"causer":        <-a.notify,
+		"causer":        cause,
 	}).Info()
 }
@@ -0,0 +1,76 @@
+package http_baseline_handler
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/jahrulnr/go-waf/pkg/baseline"
+	"github.com/jahrulnr/go-waf/pkg/clientip"
+	"github.com/jahrulnr/go-waf/pkg/config"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+type Handler struct {
+	config  *config.Config
+	sampler *baseline.Sampler
+}
+
+func NewHttpHandler(config *config.Config, sampler *baseline.Sampler) *Handler {
+	return &Handler{
+		config:  config,
+		sampler: sampler,
+	}
+}
+
+func (h *Handler) isAuthorized(c *gin.Context) bool {
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok || h.config.BASELINE_TOKEN == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(h.config.BASELINE_TOKEN)) == 1
+}
+
+// Query returns the current baseline of the route given by ?route=, a
+// request path like /users/42 works too. Without it, it lists the routes
+// this instance sampled lately.
+func (h *Handler) Query(c *gin.Context) {
+	if !h.isAuthorized(c) {
+		logger.FromContext(c.Request.Context()).Logger("[warn] IP ", clientip.FromContext(c), " unauthorized baseline query").Warn()
+		c.JSON(http.StatusUnauthorized, map[string]interface{}{
+			"status": "Unauthorized",
+		})
+		return
+	}
+	if c.Request.Method != http.MethodGet {
+		c.JSON(http.StatusMethodNotAllowed, map[string]interface{}{
+			"status": "Method Not Allowed",
+		})
+		return
+	}
+
+	route := c.Query("route")
+	if route == "" {
+		c.JSON(http.StatusOK, map[string]interface{}{
+			"status": "OK",
+			"routes": h.sampler.Routes(),
+		})
+		return
+	}
+
+	current, err := h.sampler.Baseline(c.Request.Context(), route)
+	if err != nil {
+		logger.FromContext(c.Request.Context()).Logger("[error] fail to load baseline ", err.Error()).Error()
+		c.JSON(http.StatusInternalServerError, map[string]interface{}{
+			"status": "Internal Server Error",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"status":   "OK",
+		"baseline": current,
+	})
+}
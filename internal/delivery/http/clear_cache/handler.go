@@ -1,12 +1,14 @@
 package http_clearcache_handler
 
 import (
+	"errors"
 	"net/url"
 	"strings"
 
-	"github.com/jahrulnr/go-waf/config"
 	"github.com/jahrulnr/go-waf/internal/interface/service"
 	service_allow_ip "github.com/jahrulnr/go-waf/internal/service/allow_ip"
+	"github.com/jahrulnr/go-waf/pkg/clientip"
+	"github.com/jahrulnr/go-waf/pkg/config"
 	"github.com/jahrulnr/go-waf/pkg/logger"
 
 	"github.com/gin-gonic/gin"
@@ -30,14 +32,19 @@ func NewHttpHandler(config *config.Config, handler *gin.Engine, cacheDriver serv
 }
 
 func (h *Handler) isAllowed(c *gin.Context) bool {
-	clientIp := c.ClientIP()
+	clientIp := clientip.FromContext(c)
 
 	return h.ipService.Check(clientIp)
 }
 
+func removeWithKey(cacheDriver service.CacheInterface, key string, fullUrl string) error {
+	cacheDriver.SetKey(key)
+	return cacheDriver.Remove(fullUrl)
+}
+
 func (h *Handler) Clear(c *gin.Context) {
 	fullUrl := h.config.HOST_DESTINATION + c.Request.URL.String()
-	logger.Logger("[warn] IP ", c.ClientIP(), " trying to clear ", fullUrl).Warn()
+	logger.FromContext(c.Request.Context()).Logger("[warn] IP ", clientip.FromContext(c), " trying to clear ", fullUrl).Warn()
 	if !h.isAllowed(c) {
 		c.JSON(400, map[string]interface{}{
 			"status": "Bad Request",
@@ -51,18 +58,26 @@ func (h *Handler) Clear(c *gin.Context) {
 	parsedURL.RawQuery = query.Encode()
 	fullUrl = parsedURL.String()
 	isPrefix := strings.ToLower(c.Query("is_prefix"))
+	cacheDriver := h.cacheDriver.WithContext(c.Request.Context())
 	if isPrefix == "true" {
-		h.cacheDriver.RemoveByPrefix(fullUrl)
-		h.cacheDriver.SetKey("mobile")
-		h.cacheDriver.RemoveByPrefix(fullUrl)
-		h.cacheDriver.SetKey("desktop")
-		h.cacheDriver.RemoveByPrefix(fullUrl)
+		cacheDriver.RemoveByPrefix(fullUrl)
+		cacheDriver.SetKey("mobile")
+		cacheDriver.RemoveByPrefix(fullUrl)
+		cacheDriver.SetKey("desktop")
+		cacheDriver.RemoveByPrefix(fullUrl)
 	} else {
-		h.cacheDriver.Remove(fullUrl)
-		h.cacheDriver.SetKey("mobile")
-		h.cacheDriver.Remove(fullUrl)
-		h.cacheDriver.SetKey("desktop")
-		h.cacheDriver.Remove(fullUrl)
+		err := errors.Join(
+			cacheDriver.Remove(fullUrl),
+			removeWithKey(cacheDriver, "mobile", fullUrl),
+			removeWithKey(cacheDriver, "desktop", fullUrl),
+		)
+		if err != nil {
+			logger.FromContext(c.Request.Context()).Logger("[error] fail to clear cache ", fullUrl, err.Error()).Error()
+			c.JSON(500, map[string]interface{}{
+				"status": "Internal Server Error",
+			})
+			return
+		}
 	}
 
 	c.JSON(200, map[string]interface{}{
@@ -0,0 +1,107 @@
+package http_maintenance_handler
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jahrulnr/go-waf/pkg/clientip"
+	"github.com/jahrulnr/go-waf/pkg/config"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+	"github.com/jahrulnr/go-waf/pkg/maintenance"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ToggleRequest turns the shared maintenance flag on or off. Duration is in
+// seconds, MAINTENANCE_DURATION when 0.
+type ToggleRequest struct {
+	Enabled  *bool `json:"enabled"`
+	Duration int   `json:"duration"`
+}
+
+type Handler struct {
+	config      *config.Config
+	maintenance *maintenance.Maintenance
+}
+
+func NewHttpHandler(config *config.Config, maintenance *maintenance.Maintenance) *Handler {
+	return &Handler{
+		config:      config,
+		maintenance: maintenance,
+	}
+}
+
+func (h *Handler) isAuthorized(c *gin.Context) bool {
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok || h.config.MAINTENANCE_TOKEN == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(h.config.MAINTENANCE_TOKEN)) == 1
+}
+
+// Toggle reports the maintenance state on GET, and turns the shared flag on
+// or off on POST, for every instance sharing the cache.
+func (h *Handler) Toggle(c *gin.Context) {
+	if !h.isAuthorized(c) {
+		logger.FromContext(c.Request.Context()).Logger("[warn] IP ", clientip.FromContext(c), " unauthorized maintenance toggle").Warn()
+		c.JSON(http.StatusUnauthorized, map[string]interface{}{
+			"status": "Unauthorized",
+		})
+		return
+	}
+
+	switch c.Request.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var request ToggleRequest
+		if err := c.ShouldBindJSON(&request); err != nil || request.Enabled == nil || request.Duration < 0 {
+			c.JSON(http.StatusBadRequest, map[string]interface{}{
+				"status": "Bad Request",
+			})
+			return
+		}
+
+		if err := h.toggle(c, request); err != nil {
+			logger.FromContext(c.Request.Context()).Logger("[error] fail to toggle maintenance ", err.Error()).Error()
+			c.JSON(http.StatusInternalServerError, map[string]interface{}{
+				"status": "Internal Server Error",
+			})
+			return
+		}
+		state := "off"
+		if *request.Enabled {
+			state = "on"
+		}
+		logger.FromContext(c.Request.Context()).Logger("[info] maintenance turned ", state, " by ", clientip.FromContext(c)).Info()
+	default:
+		c.JSON(http.StatusMethodNotAllowed, map[string]interface{}{
+			"status": "Method Not Allowed",
+		})
+		return
+	}
+
+	response := map[string]interface{}{
+		"status":      "OK",
+		"maintenance": h.maintenance.Enabled(c.Request.Context()),
+	}
+	if until := h.maintenance.Until(c.Request.Context()); !until.IsZero() {
+		response["until"] = until.UTC().Format(time.RFC3339)
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+func (h *Handler) toggle(c *gin.Context, request ToggleRequest) error {
+	if !*request.Enabled {
+		return h.maintenance.Disable(c.Request.Context())
+	}
+
+	duration := time.Duration(request.Duration) * time.Second
+	if duration == 0 {
+		duration = time.Duration(h.config.MAINTENANCE_DURATION) * time.Second
+	}
+
+	return h.maintenance.Enable(c.Request.Context(), duration)
+}
@@ -0,0 +1,171 @@
+package http_purgecache_handler
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/jahrulnr/go-waf/internal/interface/repository"
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+	service_cache "github.com/jahrulnr/go-waf/internal/service/cache"
+	"github.com/jahrulnr/go-waf/pkg/admin"
+	"github.com/jahrulnr/go-waf/pkg/clientip"
+	"github.com/jahrulnr/go-waf/pkg/config"
+	"github.com/jahrulnr/go-waf/pkg/httpcache"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PurgeRequest selects what to purge, exactly one field must be set. A URL
+// ending with "*" purges every URL starting with it.
+type PurgeRequest struct {
+	Key    string `json:"key"`
+	Prefix string `json:"prefix"`
+	URL    string `json:"url"`
+}
+
+type Handler struct {
+	config *config.Config
+
+	cacheHandler service.CacheInterface
+	cacheDriver  repository.CacheInterface
+	httpCache    *httpcache.Cache
+}
+
+func NewHttpHandler(config *config.Config, cacheHandler service.CacheInterface, cacheDriver repository.CacheInterface) *Handler {
+	return &Handler{
+		config:       config,
+		cacheHandler: cacheHandler,
+		cacheDriver:  cacheDriver,
+	}
+}
+
+// HTTPCache makes URL purges remove the entries of cache too.
+func (h *Handler) HTTPCache(cache *httpcache.Cache) {
+	h.httpCache = cache
+}
+
+func (h *Handler) isAuthorized(c *gin.Context) bool {
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok || h.config.CACHE_PURGE_TOKEN == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(h.config.CACHE_PURGE_TOKEN)) == 1
+}
+
+// Purge removes cache entries and responds with the number of keys removed.
+// With the tiered driver the removal is published, so every instance drops
+// its local copies as well.
+func (h *Handler) Purge(c *gin.Context) {
+	if !h.isAuthorized(c) {
+		logger.FromContext(c.Request.Context()).Logger("[warn] IP ", clientip.FromContext(c), " unauthorized cache purge").Warn()
+		c.JSON(http.StatusUnauthorized, map[string]interface{}{
+			"status": "Unauthorized",
+		})
+		return
+	}
+
+	if c.Request.Method != http.MethodPost {
+		c.JSON(http.StatusMethodNotAllowed, map[string]interface{}{
+			"status": "Method Not Allowed",
+		})
+		return
+	}
+
+	var request PurgeRequest
+	if err := c.ShouldBindJSON(&request); err != nil || !request.valid() {
+		c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"status": "Bad Request",
+		})
+		return
+	}
+
+	purged, err := h.purge(c.Request.Context(), c.Request.Host, request)
+	if err != nil {
+		logger.FromContext(c.Request.Context()).Logger("[error] fail to purge cache ", err.Error()).Error()
+		c.JSON(http.StatusInternalServerError, map[string]interface{}{
+			"status": "Internal Server Error",
+			"purged": purged,
+		})
+		return
+	}
+
+	logger.FromContext(c.Request.Context()).Logger("[info] purged ", purged, " cache keys").Info()
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"status": "OK",
+		"purged": purged,
+	})
+}
+
+func (r PurgeRequest) valid() bool {
+	set := 0
+	for _, value := range []string{r.Key, r.Prefix, r.URL} {
+		if value != "" {
+			set++
+		}
+	}
+
+	return set == 1
+}
+
+// PurgeCache purges like Purge, for the admin API. A URL without a host
+// purges the HTTP cache entries of HOST.
+func (h *Handler) PurgeCache(ctx context.Context, request admin.PurgeRequest) (int, error) {
+	return h.purge(ctx, "", PurgeRequest(request))
+}
+
+// purge removes what request selects, host is the one a URL without a host
+// and no HOST configured is purged for.
+func (h *Handler) purge(ctx context.Context, requestHost string, request PurgeRequest) (int, error) {
+	driver := h.cacheDriver.WithContext(ctx)
+	switch {
+	case request.Key != "":
+		return service_cache.Purge(driver, request.Key, false)
+	case request.Prefix != "":
+		return service_cache.Purge(driver, request.Prefix, true)
+	}
+
+	pattern, isPrefix := strings.CutSuffix(request.URL, "*")
+	target, err := url.Parse(pattern)
+	if err != nil {
+		return 0, err
+	}
+
+	// the same variants the BAN method clears
+	var errs []error
+	purged := 0
+	for _, key := range []string{"", "mobile", "desktop"} {
+		cacheHandler := h.cacheHandler.WithContext(ctx)
+		if key != "" {
+			cacheHandler.SetKey(key)
+		}
+		n, err := cacheHandler.Purge(target.RequestURI(), isPrefix)
+		purged += n
+		errs = append(errs, err)
+	}
+
+	if h.httpCache != nil {
+		host := target.Host
+		if host == "" {
+			host = h.config.HOST
+		}
+		if host == "" {
+			host = requestHost
+		}
+
+		prefix := h.httpCache.PrefixFor(host, target.Path)
+		if !isPrefix {
+			prefix = h.httpCache.KeyFor(host, target.RequestURI())
+		}
+		n, err := service_cache.Purge(driver, prefix, true)
+		purged += n
+		errs = append(errs, err)
+	}
+
+	return purged, errors.Join(errs...)
+}
@@ -2,7 +2,6 @@ package http_reverseproxy_handler
 
 import (
 	"bytes"
-	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -15,9 +14,27 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/jahrulnr/go-waf/pkg/logger"
+	"github.com/jahrulnr/go-waf/pkg/proxy"
 )
 
 func (h *Handler) FetchData(c *gin.Context) {
+	h.ServeHTTP(c.Writer, c.Request)
+}
+
+// ServeHTTP forwards r to the upstream, coalesced with the identical
+// requests in flight when PROXY_COALESCE is on. It only needs the request, so
+// it can also be called outside of gin, e.g. to refresh a cached response.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, request *http.Request) {
+	if h.coalesced != nil {
+		h.coalesced.ServeHTTP(w, request)
+		return
+	}
+
+	h.forward(w, request)
+}
+
+// forward sends request to the upstream.
+func (h *Handler) forward(w http.ResponseWriter, request *http.Request) {
 	remote, err := url.Parse(h.config.HOST_DESTINATION)
 	if err != nil {
 		panic(err)
@@ -25,16 +42,16 @@ func (h *Handler) FetchData(c *gin.Context) {
 
 	host := h.config.HOST
 	if host == "" {
-		host = c.Request.Host
+		host = request.Host
 	}
 
 	proxy := httputil.NewSingleHostReverseProxy(remote)
 	proxy.Director = func(req *http.Request) {
-		req.Header = c.Request.Header
+		req.Header = request.Header
 		req.Host = host
 		req.URL.Scheme = remote.Scheme
 		req.URL.Host = remote.Host
-		req.URL.Path = c.Param("path")
+		req.URL.Path = request.URL.Path
 		req.Header.Del("Accept-Encoding")
 	}
 
@@ -42,11 +59,11 @@ func (h *Handler) FetchData(c *gin.Context) {
 		defer r.Body.Close()
 		body, err := io.ReadAll(r.Body)
 		if err != nil {
-			logger.Logger(err).Warn()
+			logger.FromContext(request.Context()).Logger(err).Warn()
 			return err
 		}
 
-		scheme := c.Request.URL.Scheme
+		scheme := request.URL.Scheme
 		if scheme == "" {
 			scheme = "http"
 		}
@@ -55,19 +72,19 @@ func (h *Handler) FetchData(c *gin.Context) {
 		body = bytes.ReplaceAll(
 			body,
 			[]byte(h.config.HOST_DESTINATION),
-			[]byte(fmt.Sprintf("%s://%s", scheme, c.Request.Host)),
+			[]byte(fmt.Sprintf("%s://%s", scheme, request.Host)),
 		)
 
 		// replace //host to local host
 		body = bytes.ReplaceAll(
 			body,
 			[]byte(fmt.Sprintf("\"//%s", h.config.HOST_DESTINATION)),
-			[]byte(fmt.Sprintf("\"%s://%s", scheme, c.Request.Host)),
+			[]byte(fmt.Sprintf("\"%s://%s", scheme, request.Host)),
 		)
 		body = bytes.ReplaceAll(
 			body,
 			[]byte(fmt.Sprintf("'//%s", h.config.HOST_DESTINATION)),
-			[]byte(fmt.Sprintf("'%s://%s", scheme, c.Request.Host)),
+			[]byte(fmt.Sprintf("'%s://%s", scheme, request.Host)),
 		)
 
 		r.Body = io.NopCloser(bytes.NewReader(body))
@@ -86,11 +103,12 @@ func (h *Handler) FetchData(c *gin.Context) {
 		r.Header.Del("X-Varnish")
 
 		if h.config.USE_CACHE && r.StatusCode == 200 &&
-			(c.Request.Method == "GET" || c.Request.Method == "HEAD") &&
+			(request.Method == "GET" || request.Method == "HEAD") &&
 			!strings.Contains(r.Header.Get("Cache-Control"), "max-age=0") &&
 			!strings.Contains(r.Header.Get("Cache-Control"), "no-cache") {
-			if deviceKey := c.GetHeader("X-Device"); deviceKey != "" && h.config.DETECT_DEVICE && h.config.SPLIT_CACHE_BY_DEVICE {
-				h.cacheDriver.SetKey(deviceKey)
+			cacheDriver := h.cacheDriver.WithContext(request.Context())
+			if deviceKey := request.Header.Get("X-Device"); deviceKey != "" && h.config.DETECT_DEVICE && h.config.SPLIT_CACHE_BY_DEVICE {
+				cacheDriver.SetKey(deviceKey)
 			}
 			cacheData := &CacheHandler{
 				CacheURL:     r.Request.URL.String(),
@@ -98,20 +116,25 @@ func (h *Handler) FetchData(c *gin.Context) {
 				CacheData:    body,
 			}
 			data, _ := json.Marshal(cacheData)
-			logger.Logger("[debug]", "Set new cache"+r.Request.URL.String()).Debug()
-			h.cacheDriver.Set(r.Request.URL.String(), data, time.Duration(h.config.CACHE_TTL)*time.Second)
+			logger.FromContext(request.Context()).Logger("[debug]", "Set new cache"+r.Request.URL.String()).Debug()
+			if err := cacheDriver.Set(r.Request.URL.String(), data, time.Duration(h.config.CACHE_TTL)*time.Second); err != nil {
+				logger.FromContext(request.Context()).Logger("[warn] fail to store cache for ", r.Request.URL.String(), err).Warn()
+			}
 			r.Header.Set("X-Cache", "MISS")
 		}
 
 		return nil
 	}
 
-	proxy.Transport = &http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: h.config.IGNORE_SSL_VERIFY,
-			MinVersion:         tls.VersionTLS10,
-		},
-	}
+	proxy.Transport = h.transport
+	proxy.ErrorHandler = h.proxyError
+
+	proxy.ServeHTTP(w, request)
+}
 
-	proxy.ServeHTTP(c.Writer, c.Request)
+// proxyError answers 503 while no upstream can be used (all down or their
+// breakers open) and 502 for any other upstream failure.
+func (h *Handler) proxyError(w http.ResponseWriter, r *http.Request, err error) {
+	logger.FromContext(r.Context()).Logger("[warn] proxy error ", r.Method, " ", r.URL.RequestURI(), " ", err.Error()).Warn()
+	w.WriteHeader(proxy.ErrorStatus(err))
 }
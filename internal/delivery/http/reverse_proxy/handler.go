@@ -1,8 +1,19 @@
 package http_reverseproxy_handler
 
 import (
-	"github.com/jahrulnr/go-waf/config"
+	"crypto/tls"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/jahrulnr/go-waf/internal/interface/service"
+	"github.com/jahrulnr/go-waf/pkg/breaker"
+	"github.com/jahrulnr/go-waf/pkg/config"
+	"github.com/jahrulnr/go-waf/pkg/httpcache"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+	"github.com/jahrulnr/go-waf/pkg/metrics"
+	"github.com/jahrulnr/go-waf/pkg/proxy"
 
 	"github.com/gin-gonic/gin"
 )
@@ -11,6 +22,13 @@ type Handler struct {
 	config *config.Config
 
 	cacheDriver service.CacheInterface
+	balancer    *proxy.Balancer
+	transport   http.RoundTripper
+	websocket   *proxy.WebSocketProxy
+	httpCache   http.Handler
+	coalesced   http.Handler
+	metrics     metrics.ResponseCacheRecorder
+	checker     *proxy.HealthChecker
 }
 
 type CacheHandler struct {
@@ -20,13 +38,155 @@ type CacheHandler struct {
 }
 
 func NewHttpHandler(config *config.Config, handler *gin.Engine, cacheDriver service.CacheInterface) *Handler {
-	return &Handler{
+	// HOST_DESTINATION stays the public origin used for cache keys and link
+	// rewriting, PROXY_UPSTREAMS only decides where requests are sent
+	upstreams := []string{config.HOST_DESTINATION}
+	if config.PROXY_UPSTREAMS != "" {
+		upstreams = strings.Split(config.PROXY_UPSTREAMS, ",")
+	}
+
+	balancer, err := proxy.NewBalancer(upstreams, proxy.Strategy(strings.ToLower(config.PROXY_STRATEGY)))
+	if err != nil {
+		logger.Logger("[Fatal] Invalid proxy upstreams.", err.Error()).Fatal()
+	}
+	if proxy.Strategy(strings.ToLower(config.PROXY_STRATEGY)) == proxy.ConsistentHash {
+		balancer.SetHash(proxy.HashOptions{
+			Key:      config.PROXY_HASH_KEY,
+			Replicas: config.PROXY_HASH_REPLICAS,
+		})
+	}
+
+	if config.PROXY_BREAKER {
+		var recorder metrics.BreakerRecorder
+		if config.ENABLE_METRICS {
+			recorder = metrics.NewPrometheusBreakerRecorder(nil)
+		}
+
+		balancer.SetBreaker(breaker.Options{
+			FailureRatio:     config.PROXY_BREAKER_RATIO,
+			MinRequests:      config.PROXY_BREAKER_MIN_REQUESTS,
+			Window:           time.Duration(config.PROXY_BREAKER_WINDOW) * time.Second,
+			OpenTimeout:      time.Duration(config.PROXY_BREAKER_TIMEOUT) * time.Second,
+			HalfOpenRequests: config.PROXY_BREAKER_HALF_OPEN,
+			Metrics:          recorder,
+		})
+	}
+
+	base := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: config.IGNORE_SSL_VERIFY,
+			MinVersion:         tls.VersionTLS10,
+		},
+	}
+
+	var checker *proxy.HealthChecker
+	if config.PROXY_HEALTH_CHECK {
+		checker = proxy.NewHealthChecker(balancer, proxy.HealthCheckOptions{
+			Path:               config.PROXY_HEALTH_PATH,
+			Interval:           time.Duration(config.PROXY_HEALTH_INTERVAL) * time.Second,
+			Timeout:            time.Duration(config.PROXY_HEALTH_TIMEOUT) * time.Second,
+			UnhealthyThreshold: config.PROXY_HEALTH_FALL,
+			HealthyThreshold:   config.PROXY_HEALTH_RISE,
+			Transport:          base,
+		})
+		checker.Start()
+	}
+
+	transport := proxy.NewTransport(balancer, base)
+	if config.ENABLE_METRICS {
+		transport.SetMetrics(metrics.NewPrometheusRequestRecorder(nil))
+	}
+	if config.PROXY_RETRY_ATTEMPTS > 1 {
+		options := proxy.RetryOptions{
+			MaxAttempts: config.PROXY_RETRY_ATTEMPTS,
+			BaseDelay:   time.Duration(config.PROXY_RETRY_BACKOFF) * time.Millisecond,
+			MaxDelay:    time.Duration(config.PROXY_RETRY_MAX_BACKOFF) * time.Millisecond,
+			MaxBodySize: config.PROXY_RETRY_BODY_LIMIT,
+		}
+		for _, method := range strings.Split(config.PROXY_RETRY_METHODS, ",") {
+			if method = strings.TrimSpace(method); method != "" {
+				options.Methods = append(options.Methods, strings.ToUpper(method))
+			}
+		}
+		for _, status := range strings.Split(config.PROXY_RETRY_STATUSES, ",") {
+			if code, err := strconv.Atoi(strings.TrimSpace(status)); err == nil {
+				options.Statuses = append(options.Statuses, code)
+			}
+		}
+		transport.SetRetry(options)
+	}
+
+	// a copy of the traffic for a backend under test
+	var roundTripper http.RoundTripper = transport
+	if config.PROXY_MIRROR != "" {
+		mirror, err := proxy.NewMirror(transport, config.PROXY_MIRROR, proxy.MirrorOptions{
+			Percent:     config.PROXY_MIRROR_PERCENT,
+			MaxBodySize: config.PROXY_MIRROR_BODY_LIMIT,
+			Timeout:     time.Duration(config.PROXY_MIRROR_TIMEOUT) * time.Second,
+			Concurrency: config.PROXY_MIRROR_CONCURRENCY,
+			Compare:     config.PROXY_MIRROR_COMPARE,
+			Transport:   base,
+		})
+		if err != nil {
+			logger.Logger("[Fatal] Invalid proxy mirror.", err.Error()).Fatal()
+		}
+		roundTripper = mirror
+	}
+
+	var recorder metrics.ResponseCacheRecorder = metrics.NoopRecorder{}
+	if config.ENABLE_METRICS {
+		recorder = metrics.NewPrometheusRequestRecorder(nil)
+	}
+
+	h := &Handler{
 		config:      config,
 		cacheDriver: cacheDriver,
+		balancer:    balancer,
+		transport:   roundTripper,
+		metrics:     recorder,
+		checker:     checker,
+		websocket: proxy.NewWebSocketProxy(balancer, proxy.WebSocketOptions{
+			HandshakeTimeout: time.Duration(config.PROXY_WS_HANDSHAKE_TIMEOUT) * time.Second,
+			IdleTimeout:      time.Duration(config.PROXY_WS_IDLE_TIMEOUT) * time.Second,
+			TLSConfig:        base.TLSClientConfig,
+			PreserveHost:     true,
+		}),
+	}
+	// identical requests in flight share one upstream response
+	if config.PROXY_COALESCE {
+		coalescer := proxy.NewCoalescer(proxy.CoalesceOptions{
+			MaxBodySize: config.PROXY_COALESCE_MAX_BODY,
+		})
+		h.coalesced = coalescer.Handler(http.HandlerFunc(h.forward))
 	}
+
+	return h
+}
+
+// Close stops the upstream health checks.
+func (h *Handler) Close() error {
+	if h.checker != nil {
+		h.checker.Stop()
+	}
+
+	return nil
 }
 
 func (h *Handler) ReverseProxy(c *gin.Context) {
+	// the middlewares (rate limit, waf) already ran for the handshake
+	if proxy.IsWebSocket(c.Request) {
+		if h.config.HOST != "" {
+			c.Request.Host = h.config.HOST
+		}
+		h.websocket.ServeHTTP(c.Writer, c.Request)
+		return
+	}
+
+	if h.httpCache != nil {
+		h.httpCache.ServeHTTP(c.Writer, c.Request)
+		return
+	}
+
 	if h.config.USE_CACHE &&
 		(c.Request.Method == "GET" || c.Request.Method == "HEAD") {
 		h.UseCache(c)
@@ -34,3 +194,21 @@ func (h *Handler) ReverseProxy(c *gin.Context) {
 		h.FetchData(c)
 	}
 }
+
+// Healthy reports whether an upstream passes its health checks, always true
+// without PROXY_HEALTH_CHECK.
+func (h *Handler) Healthy() bool {
+	return len(h.balancer.Healthy()) > 0
+}
+
+// Sticky routes every client to the same upstream, see Balancer.SetSticky.
+// It must be called before the handler serves requests.
+func (h *Handler) Sticky(options proxy.StickyOptions) {
+	h.balancer.SetSticky(options)
+}
+
+// HTTPCache serves the proxied responses through cache, which then takes
+// over from USE_CACHE.
+func (h *Handler) HTTPCache(cache *httpcache.Cache) {
+	h.httpCache = cache.Handler(h)
+}
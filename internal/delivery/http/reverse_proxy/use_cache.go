@@ -9,18 +9,30 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/jahrulnr/go-waf/pkg/logger"
+	"github.com/jahrulnr/go-waf/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 func (h *Handler) UseCache(c *gin.Context) {
 	url := h.config.HOST_DESTINATION + c.Request.URL.String()
 
+	// bind the cache to the request so a slow backend can't outlive the client
+	cacheDriver := h.cacheDriver.WithContext(c.Request.Context())
 	if deviceKey := c.GetHeader("X-Device"); deviceKey != "" && h.config.DETECT_DEVICE && h.config.SPLIT_CACHE_BY_DEVICE {
-		h.cacheDriver.SetKey(deviceKey)
+		cacheDriver.SetKey(deviceKey)
 	}
-	getCache, ok := h.cacheDriver.Get(url)
+	_, span := tracing.Start(c.Request.Context(), "cache.lookup")
+	getCache, ok := cacheDriver.Get(url)
+	if ok {
+		span.SetAttributes(attribute.String("cache.result", "hit"))
+	} else {
+		span.SetAttributes(attribute.String("cache.result", "miss"))
+	}
+	span.End()
 
 	if !ok {
-		logger.Logger("[debug] cache not found", url).Debug()
+		logger.FromContext(c.Request.Context()).Logger("[debug] cache not found", url).Debug()
+		h.metrics.RecordCacheResult("miss")
 		h.FetchData(c)
 		return
 	}
@@ -28,12 +40,12 @@ func (h *Handler) UseCache(c *gin.Context) {
 	var cacheData CacheHandler
 	err := json.Unmarshal(getCache, &cacheData)
 	if err != nil {
-		logger.Logger("[debug] cannot cast cache data to CacheHandler, cache data type is ", reflect.TypeOf(getCache), ". Trying with map[string]interface{}").Debug()
+		logger.FromContext(c.Request.Context()).Logger("[debug] cannot cast cache data to CacheHandler, cache data type is ", reflect.TypeOf(getCache), ". Trying with map[string]interface{}").Debug()
 		cacheData = CacheHandler{}
 		var data map[string]interface{}
 		err = json.Unmarshal(getCache, &data)
 		if err != nil {
-			logger.Logger("[debug] I can't explain this error. err: ", err).Warn()
+			logger.FromContext(c.Request.Context()).Logger("[debug] I can't explain this error. err: ", err).Warn()
 		}
 
 		cacheHeaders, _ := data["headers"].(map[string]interface{})
@@ -47,7 +59,7 @@ func (h *Handler) UseCache(c *gin.Context) {
 			}
 		}
 	} else {
-		logger.Logger("[debug] cast cache data to CacheHandler").Debug()
+		logger.FromContext(c.Request.Context()).Logger("[debug] cast cache data to CacheHandler").Debug()
 		// set header
 		for key, headers := range cacheData.CacheHeaders {
 			if len(headers) > 0 {
@@ -56,10 +68,17 @@ func (h *Handler) UseCache(c *gin.Context) {
 		}
 	}
 
-	ttl, _ := h.cacheDriver.GetTTL(url)
+	ttl, _ := cacheDriver.GetTTL(url)
 	ttl = time.Duration(h.config.CACHE_TTL) - (ttl / time.Second)
+	// jitter may push the remaining ttl a bit above CACHE_TTL
+	maxJitter := time.Duration(h.config.CACHE_TTL * h.config.CACHE_TTL_JITTER / 100)
+	if ttl < -maxJitter {
+		if err := cacheDriver.Remove(url); err != nil {
+			logger.FromContext(c.Request.Context()).Logger("[warn] fail to remove expired cache ", url, err).Warn()
+		}
+	}
 	if ttl < 0 {
-		h.cacheDriver.Remove(url)
+		ttl = 0
 	}
 
 	// remove duplicate header
@@ -73,6 +92,7 @@ func (h *Handler) UseCache(c *gin.Context) {
 	c.Header("Server", "")
 	c.Header("X-Varnish", "")
 	c.Header("X-Cache", "HIT")
+	h.metrics.RecordCacheResult("hit")
 	c.Header("X-Age", fmt.Sprintf("%d", ttl))
 	c.Data(200, c.GetHeader("Content-Type"), cacheData.CacheData)
 }
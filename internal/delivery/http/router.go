@@ -1,16 +1,64 @@
 package delivery_http
 
 import (
+	"html/template"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/jahrulnr/go-waf/config"
+	http_baseline_handler "github.com/jahrulnr/go-waf/internal/delivery/http/baseline"
 	http_clearcache_handler "github.com/jahrulnr/go-waf/internal/delivery/http/clear_cache"
+	http_maintenance_handler "github.com/jahrulnr/go-waf/internal/delivery/http/maintenance"
+	http_purgecache_handler "github.com/jahrulnr/go-waf/internal/delivery/http/purge_cache"
 	http_reverseproxy_handler "github.com/jahrulnr/go-waf/internal/delivery/http/reverse_proxy"
+	"github.com/jahrulnr/go-waf/internal/interface/repository"
 	"github.com/jahrulnr/go-waf/internal/interface/service"
 	"github.com/jahrulnr/go-waf/internal/middleware/device"
+	"github.com/jahrulnr/go-waf/internal/middleware/geoip"
+	"github.com/jahrulnr/go-waf/internal/middleware/honeypot"
+	"github.com/jahrulnr/go-waf/internal/middleware/ipfilter"
 	"github.com/jahrulnr/go-waf/internal/middleware/ratelimit"
+	"github.com/jahrulnr/go-waf/internal/middleware/waf"
+	service_autoban "github.com/jahrulnr/go-waf/internal/service/autoban"
+	"github.com/jahrulnr/go-waf/pkg/admin"
+	"github.com/jahrulnr/go-waf/pkg/audit"
+	"github.com/jahrulnr/go-waf/pkg/auth/apikey"
+	"github.com/jahrulnr/go-waf/pkg/auth/jwt"
+	"github.com/jahrulnr/go-waf/pkg/auth/mtls"
+	"github.com/jahrulnr/go-waf/pkg/baseline"
+	"github.com/jahrulnr/go-waf/pkg/block"
+	"github.com/jahrulnr/go-waf/pkg/bot"
+	"github.com/jahrulnr/go-waf/pkg/chain"
+	"github.com/jahrulnr/go-waf/pkg/challenge"
+	"github.com/jahrulnr/go-waf/pkg/clientip"
+	"github.com/jahrulnr/go-waf/pkg/clientkey"
+	"github.com/jahrulnr/go-waf/pkg/compress"
+	"github.com/jahrulnr/go-waf/pkg/config"
+	"github.com/jahrulnr/go-waf/pkg/cookies"
+	"github.com/jahrulnr/go-waf/pkg/cors"
+	"github.com/jahrulnr/go-waf/pkg/csrf"
+	"github.com/jahrulnr/go-waf/pkg/dryrun"
+	"github.com/jahrulnr/go-waf/pkg/graphql"
+	"github.com/jahrulnr/go-waf/pkg/httpcache"
+	pkg_ipfilter "github.com/jahrulnr/go-waf/pkg/ipfilter"
+	"github.com/jahrulnr/go-waf/pkg/lifecycle"
+	"github.com/jahrulnr/go-waf/pkg/limits"
 	"github.com/jahrulnr/go-waf/pkg/logger"
-	"github.com/nanmu42/gzip"
+	"github.com/jahrulnr/go-waf/pkg/maintenance"
+	"github.com/jahrulnr/go-waf/pkg/metrics"
+	"github.com/jahrulnr/go-waf/pkg/nonce"
+	"github.com/jahrulnr/go-waf/pkg/profile"
+	"github.com/jahrulnr/go-waf/pkg/proxy"
+	"github.com/jahrulnr/go-waf/pkg/requestid"
+	"github.com/jahrulnr/go-waf/pkg/revocation"
+	"github.com/jahrulnr/go-waf/pkg/scan"
+	"github.com/jahrulnr/go-waf/pkg/secheaders"
+	"github.com/jahrulnr/go-waf/pkg/smuggling"
+	"github.com/jahrulnr/go-waf/pkg/tracing"
+	"github.com/jahrulnr/go-waf/pkg/upload"
 
 	"github.com/gin-gonic/gin"
 )
@@ -20,78 +68,813 @@ type Router struct {
 	handler *gin.Engine
 
 	rateLimiter  *ratelimit.RateLimit
+	wafHandler   *waf.WAF
+	autoBan      *service_autoban.AutoBan
+	maintenance  *maintenance.Maintenance
+	baseline     *baseline.Sampler
+	profile      *profile.Profiler
+	warmer       *httpcache.Warmer
+	blockHandler block.Handler
+	chain        *chain.Chain
+	lifecycle    *lifecycle.Lifecycle
 	cacheHandler service.CacheInterface
+	cacheDriver  repository.CacheInterface
+	stateStore   repository.StateStore
+	ownState     bool // stateStore is not the cache driver
 }
 
-func NewHttpRouter(config *config.Config, cacheHandler service.CacheInterface) *Router {
+func NewHttpRouter(config *config.Config, cacheHandler service.CacheInterface, cacheDriver repository.CacheInterface) *Router {
 	return &Router{
 		config: config,
 
 		handler:      gin.Default(),
 		rateLimiter:  ratelimit.NewRateLimit(config),
+		chain:        chain.NewChain(),
 		cacheHandler: cacheHandler,
+		cacheDriver:  cacheDriver,
+		stateStore:   cacheDriver,
+	}
+}
+
+// SetLifecycle registers the watchers and health checks the middlewares and
+// handlers run, so they stop on shutdown.
+func (h *Router) SetLifecycle(lifecycle *lifecycle.Lifecycle) {
+	h.lifecycle = lifecycle
+}
+
+// SetBlockHandler answers every blocked request with handler instead of
+// BLOCK_RESPONSE, see block.Respond.
+func (h *Router) SetBlockHandler(handler block.Handler) {
+	h.blockHandler = handler
+}
+
+// Chain returns the chain the middlewares are assembled in, for custom ones
+// added at its positions before GetHandler, see chain.Chain.
+func (h *Router) Chain() *chain.Chain {
+	return h.chain
+}
+
+// SetStateStore keeps the bans, counters, nonces and locks in store instead
+// of the cache driver, e.g. the STATE_DRIVER one or a database shared by the
+// instances. It is called before GetHandler.
+func (h *Router) SetStateStore(store repository.StateStore) {
+	h.stateStore = store
+	h.ownState = true
+}
+
+func (h *Router) closeOnShutdown(name string, closer io.Closer) {
+	if h.lifecycle != nil {
+		h.lifecycle.Register(name, lifecycle.Closer(closer))
 	}
 }
 
 func (h *Router) setRouter() {
-	var middlewareList []gin.HandlerFunc
+	c := h.chain
+
+	// first, so every log line of the request carries its id
+	if h.config.USE_REQUEST_ID {
+		c.Use(chain.Setup, requestid.Middleware(h.config.REQUEST_ID_HEADER))
+	}
+
+	// how the components after it answer the requests they block
+	if h.blockHandler == nil {
+		h.blockHandler = h.configBlockHandler()
+	}
+	if h.blockHandler != nil {
+		c.Use(chain.Setup, block.Middleware(h.blockHandler))
+	}
+
+	// only these proxies may set the client IP through X-Forwarded-For
+	var proxies []string
+	for _, proxy := range strings.Split(h.config.TRUSTED_PROXIES, ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	trusted, err := clientip.ParseTrusted(proxies)
+	if err != nil {
+		logger.Logger("[Fatal] Invalid trusted proxies.", err.Error()).Fatal()
+	}
+	// keep gin's own ClientIP, used by its request log, in line
+	if err := h.handler.SetTrustedProxies(proxies); err != nil {
+		logger.Logger("[Fatal] Invalid trusted proxies.", err.Error()).Fatal()
+	}
+	c.Use(chain.Setup, clientip.Middleware(trusted, h.config.IPV6_PREFIX))
+
+	// a span per request, the rule engine, cache and proxy add theirs to it
+	if h.config.USE_TRACING {
+		c.Use(chain.Setup, tracing.Middleware())
+	}
+
+	// security headers, on the waf's own pages too
+	if h.config.USE_SECURITY_HEADERS {
+		var policy secheaders.Provider
+		if h.config.SECURITY_HEADERS_FILE != "" {
+			watcher, err := secheaders.NewWatcher(h.config.SECURITY_HEADERS_FILE)
+			if err != nil {
+				logger.Logger("[Fatal] Load security headers error.", err.Error()).Fatal()
+			}
+			h.closeOnShutdown("security headers watcher", watcher)
+			policy = watcher
+		} else {
+			fixed := &secheaders.Policy{
+				Mode: h.config.SECURITY_HEADERS_MODE,
+				Headers: map[string]string{
+					"Strict-Transport-Security": h.config.SECURITY_HEADERS_HSTS,
+					"X-Content-Type-Options":    h.config.SECURITY_HEADERS_CONTENT_TYPE_OPTIONS,
+					"X-Frame-Options":           h.config.SECURITY_HEADERS_FRAME_OPTIONS,
+					"Content-Security-Policy":   h.config.SECURITY_HEADERS_CSP,
+					"Referrer-Policy":           h.config.SECURITY_HEADERS_REFERRER_POLICY,
+				},
+				Remove: list(h.config.SECURITY_HEADERS_REMOVE),
+			}
+			if err := fixed.Prepare(); err != nil {
+				logger.Logger("[Fatal] Invalid security headers.", err.Error()).Fatal()
+			}
+			policy = fixed
+		}
+		c.Use(chain.Setup, secheaders.NewInjector(policy).Middleware())
+	}
 
 	// this will used for clear cache
 	h.handler.HandleMethodNotAllowed = h.config.USE_CACHE
 
+	// blocked requests, whatever blocked them, go to the audit log
+	var auditLog *audit.Logger
+	if h.config.AUDIT_LOG != "" {
+		auditLog = audit.NewLogger(
+			audit.NewSink(h.config.AUDIT_LOG, h.config.AUDIT_LOG_MAX_SIZE, h.config.AUDIT_LOG_MAX_BACKUPS, h.config.AUDIT_LOG_MAX_AGE),
+			audit.Options{
+				RedactHeaders: strings.Split(h.config.AUDIT_REDACT_HEADERS, ","),
+				RedactParams:  strings.Split(h.config.AUDIT_REDACT_PARAMS, ","),
+			},
+		)
+	}
+
+	// dry run, the blocking middlewares only report what they would do
+	var dryRun *dryrun.DryRun
+	if h.config.DRY_RUN {
+		var recorder metrics.DryRunRecorder
+		if h.config.ENABLE_METRICS {
+			recorder = metrics.NewPrometheusRequestRecorder(nil)
+		}
+		dryRun = dryrun.NewDryRun(h.config.DRY_RUN_HEADER, auditLog, recorder)
+		logger.Logger("[warn] dry run mode, no request is blocked").Warn()
+	}
+
+	// repeated waf blocks, honeypot trips and scans ban the client for a while,
+	// the admin api bans by hand
+	var autoBan *service_autoban.AutoBan
+	if h.config.USE_AUTOBAN || h.config.USE_HONEYPOT || h.config.USE_ADMIN || (h.config.USE_SCAN_DETECTION && h.config.SCAN_ACTION == scan.ActionBan) {
+		autoBan = service_autoban.NewAutoBan(h.stateStore, autoBanOptions(h.config))
+		autoBan.SetFailOpen(h.config.AUTOBAN_FAIL_OPEN)
+		h.autoBan = autoBan
+	}
+
+	// the maintenance page, for everyone but the allowed clients
+	maintenanceOptions := maintenance.Options{
+		Status:      h.config.MAINTENANCE_STATUS,
+		Body:        h.config.MAINTENANCE_BODY,
+		ContentType: h.config.MAINTENANCE_CONTENT_TYPE,
+		RetryAfter:  time.Duration(h.config.MAINTENANCE_RETRY_AFTER) * time.Second,
+		Allow:       list(h.config.MAINTENANCE_ALLOW_IP),
+		Exempt:      []string{"/ping"},
+	}
+	if h.config.MAINTENANCE_FILE != "" {
+		page, err := os.ReadFile(h.config.MAINTENANCE_FILE)
+		if err != nil {
+			logger.Logger("[Fatal] Maintenance page error.", err.Error()).Fatal()
+		}
+		maintenanceOptions.Body = string(page)
+	}
+	if h.config.ENABLE_METRICS {
+		maintenanceOptions.Exempt = append(maintenanceOptions.Exempt, h.config.METRICS_PATH)
+	}
+	if h.config.MAINTENANCE_TOKEN != "" {
+		maintenanceOptions.Exempt = append(maintenanceOptions.Exempt, h.config.MAINTENANCE_PATH)
+	}
+	if h.config.CACHE_PURGE_TOKEN != "" {
+		maintenanceOptions.Exempt = append(maintenanceOptions.Exempt, h.config.CACHE_PURGE_PATH)
+	}
+	if h.config.USE_BASELINE && h.config.BASELINE_TOKEN != "" {
+		maintenanceOptions.Exempt = append(maintenanceOptions.Exempt, h.config.BASELINE_PATH)
+	}
+	maintenanceMode, err := maintenance.NewMaintenance(h.stateStore, maintenanceOptions)
+	if err != nil {
+		logger.Logger("[Fatal] Invalid maintenance allow list.", err.Error()).Fatal()
+	}
+	maintenanceMode.SetLocal(h.config.MAINTENANCE)
+	h.maintenance = maintenanceMode
+	c.Use(chain.Request, maintenanceMode.Middleware())
+
+	// ambiguous message boundaries, before any middleware that aborts or
+	// reads the body
+	if h.config.USE_SMUGGLING_GUARD {
+		guard := smuggling.NewGuard(smuggling.Options{MaxBuffer: h.config.SMUGGLING_MAX_BUFFER})
+		guard.SetAudit(auditLog)
+		c.Use(chain.Request, guard.Middleware())
+	}
+
+	// signed cookies, verified before anything reads them and signed on every
+	// response, the waf's own included
+	if h.config.USE_COOKIE_GUARD {
+		guard, err := cookies.NewGuard(cookies.Options{
+			Secret:   []byte(h.config.COOKIE_SECRET),
+			Signed:   list(h.config.COOKIE_SIGNED),
+			Action:   h.config.COOKIE_TAMPERED,
+			Flags:    h.config.COOKIE_FLAGS,
+			SameSite: csrf.ParseSameSite(h.config.COOKIE_SAMESITE),
+			Exempt:   list(h.config.COOKIE_EXEMPT),
+		})
+		if err != nil {
+			logger.Logger("[Fatal] Cookie guard setup error.", err.Error()).Fatal()
+		}
+		guard.SetAudit(auditLog)
+		c.Use(chain.Request, guard.Middleware())
+	}
+
+	// request methods, scanners' TRACE and made up ones end here
+	if h.config.ALLOWED_METHODS != "" || h.config.ALLOWED_METHOD_ROUTES != "" {
+		allowedMethods := limits.NewMethods(strings.Split(h.config.ALLOWED_METHODS, "|")...)
+		for _, route := range strings.Split(h.config.ALLOWED_METHOD_ROUTES, ",") {
+			prefix, methods, found := strings.Cut(strings.TrimSpace(route), "=")
+			if !found {
+				continue
+			}
+			allowedMethods.Route(strings.TrimSpace(prefix), strings.Split(methods, "|")...)
+		}
+		if h.config.USE_CACHE {
+			allowedMethods.Also(h.config.CACHE_REMOVE_METHOD)
+		}
+		c.Use(chain.Request, allowedMethods.Middleware())
+	}
+
+	// query and header caps, before anything iterates over them
+	fieldCaps := limits.Caps{
+		QueryParams: h.config.MAX_QUERY_PARAMS,
+		Headers:     h.config.MAX_HEADERS,
+		HeaderBytes: h.config.MAX_HEADER_BYTES,
+		ValueLength: h.config.MAX_VALUE_LENGTH,
+	}
+	if fieldCaps != (limits.Caps{}) || h.config.FIELD_LIMIT_ROUTES != "" {
+		fields := limits.NewFields(fieldCaps)
+		for _, route := range list(h.config.FIELD_LIMIT_ROUTES) {
+			prefix, value, _ := strings.Cut(route, "=")
+			caps, err := limits.ParseCaps(value, fieldCaps)
+			if err != nil {
+				logger.Logger("[Fatal] Invalid field limits.", route, err.Error()).Fatal()
+			}
+			fields.Route(strings.TrimSpace(prefix), caps)
+		}
+		c.Use(chain.Request, fields.Middleware())
+	}
+
+	// what clients are counted and banned by, a subject is only known after
+	// the jwt middleware, which the rate limiter then follows
+	rateKey, err := clientkey.Parse(h.config.RATELIMIT_KEY)
+	if err != nil {
+		logger.Logger("[Fatal] Invalid rate limit key.", err.Error()).Fatal()
+	}
+	banKey, err := clientkey.Parse(h.config.AUTOBAN_KEY)
+	if err != nil {
+		logger.Logger("[Fatal] Invalid auto ban key.", err.Error()).Fatal()
+	}
+
+	// ip and country filters, before anything spends work on the request
+	var keyBans gin.HandlerFunc
+	if h.config.USE_IPFILTER || autoBan != nil {
+		ipFilter := ipfilter.NewIPFilter(h.config)
+		if autoBan != nil {
+			ipFilter.SetAutoBan(autoBan)
+			if strings.TrimSpace(h.config.AUTOBAN_KEY) != "ip" {
+				keyBans = ipFilter.Bans(banKey.Func)
+			}
+		}
+		ipFilter.SetAudit(auditLog)
+		ipFilter.SetDryRun(dryRun)
+		c.Use(chain.IPFilter, ipFilter.Filter())
+	}
+	if h.config.USE_GEOIP {
+		geoFilter := geoip.NewGeoIP(h.config)
+		geoFilter.SetAudit(auditLog)
+		geoFilter.SetDryRun(dryRun)
+		h.closeOnShutdown("geoip watcher", geoFilter)
+		c.Use(chain.IPFilter, geoFilter.Filter())
+	}
+
+	// bot detection, scores are in the context for the later middlewares
+	if h.config.USE_BOT_DETECTION {
+		var goodBots map[string][]string
+		if h.config.BOT_GOOD_BOTS != "" {
+			goodBots = make(map[string][]string)
+			for _, entry := range list(h.config.BOT_GOOD_BOTS) {
+				name, domains, _ := strings.Cut(entry, "=")
+				goodBots[strings.TrimSpace(name)] = strings.Split(domains, "|")
+			}
+		}
+		detector, err := bot.NewDetector(h.stateStore, bot.Options{
+			UserAgents: list(h.config.BOT_USER_AGENTS),
+			GoodBots:   goodBots,
+			Threshold:  bot.BotScore(h.config.BOT_THRESHOLD),
+			Action:     h.config.BOT_ACTION,
+			RateWindow: time.Duration(h.config.BOT_RATE_WINDOW) * time.Second,
+			RateLimit:  h.config.BOT_RATE_LIMIT,
+			BotLimit:   h.config.BOT_LIMIT,
+		})
+		if err != nil {
+			logger.Logger("[Fatal] Invalid bot user agent pattern.", err.Error()).Fatal()
+		}
+		detector.SetAudit(auditLog)
+		detector.SetDryRun(dryRun)
+		c.Use(chain.IPFilter, detector.Middleware())
+	}
+
+	// fuzzers, counting the 404s of the honeypot too
+	if h.config.USE_SCAN_DETECTION {
+		var statuses []int
+		for _, status := range list(h.config.SCAN_STATUSES) {
+			if code, err := strconv.Atoi(status); err == nil {
+				statuses = append(statuses, code)
+			}
+		}
+		scanDetector := scan.NewDetector(h.stateStore, scan.Options{
+			Window:      time.Duration(h.config.SCAN_WINDOW) * time.Second,
+			Threshold:   h.config.SCAN_THRESHOLD,
+			Ratio:       h.config.SCAN_RATIO,
+			Statuses:    statuses,
+			Action:      h.config.SCAN_ACTION,
+			Limit:       h.config.SCAN_LIMIT,
+			BanDuration: time.Duration(h.config.SCAN_BAN_DURATION) * time.Second,
+		})
+		if autoBan != nil {
+			scanDetector.SetAutoBan(autoBan)
+		}
+		scanDetector.SetAudit(auditLog)
+		scanDetector.SetDryRun(dryRun)
+		c.Use(chain.IPFilter, scanDetector.Middleware())
+	}
+
+	// trap paths, after the bot scores so verified crawlers aren't banned
+	if h.config.USE_HONEYPOT {
+		honeypotHandler := honeypot.NewHoneypot(h.config)
+		honeypotHandler.SetAutoBan(autoBan)
+		honeypotHandler.SetAudit(auditLog)
+		honeypotHandler.SetDryRun(dryRun)
+		h.closeOnShutdown("honeypot watcher", honeypotHandler)
+		c.Use(chain.IPFilter, honeypotHandler.Trap())
+	}
+
+	// proof of work for the suspected bots
+	if h.config.USE_CHALLENGE {
+		jsChallenge := challenge.NewChallenge(h.stateStore, challenge.Options{
+			Difficulty: h.config.CHALLENGE_DIFFICULTY,
+			PassTTL:    time.Duration(h.config.CHALLENGE_PASS_TTL) * time.Second,
+			Threshold:  bot.BotScore(h.config.CHALLENGE_THRESHOLD),
+			Path:       h.config.CHALLENGE_PATH,
+			Secure:     h.config.CHALLENGE_SECURE,
+		})
+		jsChallenge.SetAudit(auditLog)
+		jsChallenge.SetDryRun(dryRun)
+		c.Use(chain.IPFilter, jsChallenge.Middleware())
+	}
+
 	// ratelimiter
 	if h.config.USE_RATELIMIT {
-		if h.config.CACHE_DRIVER == "redis" {
+		// the fixed window counts in the state store when the instances share it
+		shared := h.config.CACHE_DRIVER == "redis" || h.config.CACHE_DRIVER == "tiered"
+		if h.ownState {
+			shared = h.config.STATE_DRIVER != "memory" && h.config.STATE_DRIVER != "file"
+		}
+		if shared {
 			h.rateLimiter.Driver("redis")
 		} else {
 			h.rateLimiter.Driver("memory")
 		}
-		middlewareList = append(middlewareList, h.rateLimiter.RateLimit())
+		h.rateLimiter.Store(h.stateStore)
+		h.rateLimiter.SetKey(rateKey.Func)
+		h.rateLimiter.SetAudit(auditLog)
+		h.rateLimiter.SetDryRun(dryRun)
+		if !rateKey.Subject {
+			c.Use(chain.RateLimit, h.rateLimiter.RateLimit())
+		}
 	}
 
-	// gzip compress
-	if h.config.ENABLE_GZIP {
-		gzipHandler := func(c *gin.Context) {
-			logger.Logger(c.Request.Header.Get("Accept-Encoding")).Debug()
-			if strings.Contains(c.Request.Header.Get("Accept-Encoding"), "gzip") {
-				gzip.NewHandler(gzip.Config{
-					CompressionLevel: h.config.GZIP_COMPRESSION_LEVEL,
-					MinContentLength: h.config.GZIP_MIN_CONTENT_LENGTH,
-					RequestFilter: []gzip.RequestFilter{
-						gzip.NewCommonRequestFilter(),
-						gzip.DefaultExtensionFilter(),
-					},
-					ResponseHeaderFilter: []gzip.ResponseHeaderFilter{
-						gzip.NewSkipCompressedFilter(),
-						gzip.DefaultContentTypeFilter(),
-					},
-				}).Gin(c)
+	// requests in flight, against clients holding slow requests open
+	if h.config.USE_CONCURRENCY_LIMIT {
+		concurrency := limits.NewConcurrency(h.stateStore, h.config.CONCURRENCY_LIMIT, time.Duration(h.config.CONCURRENCY_TTL)*time.Second)
+		for _, entry := range list(h.config.CONCURRENCY_CLIENT_LIMIT) {
+			cidr, limit, _ := strings.Cut(entry, "=")
+			n, _ := strconv.ParseInt(strings.TrimSpace(limit), 10, 64)
+			if err := concurrency.Client(cidr, n); err != nil {
+				logger.Logger("[Fatal] Invalid concurrency client limit.", err.Error()).Fatal()
 			}
 		}
+		concurrency.SetFailOpen(h.config.CONCURRENCY_FAIL_OPEN)
+		concurrency.SetAudit(auditLog)
+		concurrency.SetDryRun(dryRun)
+		c.Use(chain.RateLimit, concurrency.Middleware())
+	}
 
-		middlewareList = append(middlewareList, gzipHandler)
+	// cors, preflights are answered here and never reach the upstream
+	if h.config.USE_CORS {
+		c.Use(chain.Auth, cors.NewCORS(cors.Options{
+			AllowedOrigins:   list(h.config.CORS_ALLOW_ORIGINS),
+			AllowedMethods:   list(h.config.CORS_ALLOW_METHODS),
+			AllowedHeaders:   list(h.config.CORS_ALLOW_HEADERS),
+			ExposedHeaders:   list(h.config.CORS_EXPOSE_HEADERS),
+			AllowCredentials: h.config.CORS_ALLOW_CREDENTIALS,
+			MaxAge:           time.Duration(h.config.CORS_MAX_AGE) * time.Second,
+		}).Middleware())
+	}
+
+	// client certificates, for the internal services behind the waf
+	if h.config.USE_MTLS {
+		cas, err := mtls.LoadCAs(h.config.MTLS_CA_FILE)
+		if err != nil {
+			logger.Logger("[Fatal] Load client CAs error.", err.Error()).Fatal()
+		}
+		options := mtls.Options{
+			CAs:          cas,
+			AllowedNames: list(h.config.MTLS_ALLOWED_NAMES),
+			Paths:        list(h.config.MTLS_PATHS),
+			Header:       h.config.MTLS_HEADER,
+		}
+		if h.config.MTLS_OCSP || h.config.MTLS_CRL || h.config.MTLS_CRL_FILES != "" {
+			checker, err := revocation.NewChecker(revocation.NewFetcher(h.stateStore, nil), revocation.CheckerOptions{
+				OCSP:     h.config.MTLS_OCSP,
+				CRL:      h.config.MTLS_CRL,
+				CRLFiles: list(h.config.MTLS_CRL_FILES),
+				SoftFail: h.config.MTLS_REVOCATION_FAIL == "soft",
+			})
+			if err != nil {
+				logger.Logger("[Fatal] Load client CRLs error.", err.Error()).Fatal()
+			}
+			options.Revocation = checker
+		}
+		c.Use(chain.Auth, mtls.NewVerifier(options).Middleware())
+	}
+
+	// bearer tokens, checked before the body is read
+	if h.config.USE_JWT {
+		if h.config.JWT_SECRET == "" && h.config.JWT_JWKS_URL == "" {
+			logger.Logger("[Fatal] USE_JWT needs JWT_SECRET or JWT_JWKS_URL.").Fatal()
+		}
+		c.Use(chain.Auth, jwt.NewValidator(h.stateStore, jwt.Options{
+			Secret:   []byte(h.config.JWT_SECRET),
+			JWKSURL:  h.config.JWT_JWKS_URL,
+			JWKSTTL:  time.Duration(h.config.JWT_JWKS_TTL) * time.Second,
+			Issuer:   h.config.JWT_ISSUER,
+			Audience: h.config.JWT_AUDIENCE,
+			Leeway:   time.Duration(h.config.JWT_LEEWAY) * time.Second,
+			Claims:   list(h.config.JWT_CLAIMS),
+		}).Middleware())
+	}
+	// limits and bans by the subject the jwt middleware just set
+	if h.config.USE_RATELIMIT && rateKey.Subject {
+		c.Use(chain.Auth, h.rateLimiter.RateLimit())
+	}
+	if keyBans != nil {
+		c.Use(chain.Auth, keyBans)
+	}
+
+	// api keys and their quotas, with the other authentication checks
+	if h.config.USE_APIKEY {
+		var keys apikey.Keys = apikey.NewStoreKeys(h.stateStore)
+		if h.config.APIKEY_FILE != "" {
+			watcher, err := apikey.NewWatcher(h.config.APIKEY_FILE)
+			if err != nil {
+				logger.Logger("[Fatal] Load api keys error.", err.Error()).Fatal()
+			}
+			h.closeOnShutdown("api keys watcher", watcher)
+			keys = watcher
+		}
+		guard := apikey.NewGuard(keys, h.stateStore, apikey.Options{
+			Header:   h.config.APIKEY_HEADER,
+			Paths:    list(h.config.APIKEY_PATHS),
+			IDHeader: h.config.APIKEY_ID_HEADER,
+		})
+		guard.SetFailOpen(h.config.APIKEY_FAIL_OPEN)
+		guard.SetAudit(auditLog)
+		c.Use(chain.Auth, guard.Middleware())
+	}
+
+	// replayed signed requests, with the other authentication checks
+	if h.config.USE_NONCE {
+		store := nonce.NewStore(h.stateStore)
+		store.SetFailOpen(h.config.NONCE_FAIL_OPEN)
+		guard := nonce.NewGuard(store, nonce.Options{
+			NonceHeader:     h.config.NONCE_HEADER,
+			TimestampHeader: h.config.NONCE_TIMESTAMP_HEADER,
+			Skew:            time.Duration(h.config.NONCE_SKEW) * time.Second,
+			MaxLength:       h.config.NONCE_MAX_LENGTH,
+			Paths:           list(h.config.NONCE_PATHS),
+		})
+		guard.SetAudit(auditLog)
+		c.Use(chain.Auth, guard.Middleware())
+	}
+
+	// body size limits, before the waf buffers the body
+	if h.config.MAX_BODY_SIZE > 0 || h.config.MAX_BODY_SIZE_ROUTES != "" {
+		bodyLimits := limits.NewLimits(h.config.MAX_BODY_SIZE)
+		for _, route := range strings.Split(h.config.MAX_BODY_SIZE_ROUTES, ",") {
+			prefix, size, found := strings.Cut(strings.TrimSpace(route), "=")
+			if !found {
+				continue
+			}
+			limit, err := strconv.ParseInt(strings.TrimSpace(size), 10, 64)
+			if err != nil {
+				logger.Logger("[Fatal] Invalid body size limit.", route, err.Error()).Fatal()
+			}
+			bodyLimits.Route(strings.TrimSpace(prefix), limit)
+		}
+		c.Use(chain.Body, bodyLimits.Middleware())
+	}
+
+	// content types, refused before the body is read
+	if h.config.CONTENT_TYPES != "" || h.config.CONTENT_TYPE_ROUTES != "" {
+		contentTypes := limits.NewContentTypes(strings.Split(h.config.CONTENT_TYPES, "|")...)
+		for _, route := range strings.Split(h.config.CONTENT_TYPE_ROUTES, ",") {
+			prefix, types, found := strings.Cut(strings.TrimSpace(route), "=")
+			if !found {
+				continue
+			}
+			contentTypes.Route(strings.TrimSpace(prefix), strings.Split(types, "|")...)
+		}
+		c.Use(chain.Body, contentTypes.Middleware())
+	}
+
+	// upload filtering, after the body limits bound what is spooled, before the
+	// waf inspects the form values it parses
+	if h.config.USE_MULTIPART {
+		inspector := upload.NewInspector(upload.Options{
+			MaxFileSize: h.config.MULTIPART_MAX_FILE_SIZE,
+			MaxFiles:    h.config.MULTIPART_MAX_FILES,
+			Extensions:  list(h.config.MULTIPART_EXTENSIONS),
+			Types:       list(h.config.MULTIPART_TYPES),
+			MaxValues:   h.config.MULTIPART_MAX_VALUES,
+			Memory:      h.config.MULTIPART_MEMORY,
+			TempDir:     h.config.MULTIPART_TEMP_DIR,
+		})
+		inspector.SetAudit(auditLog)
+		inspector.SetDryRun(dryRun)
+		c.Use(chain.Body, inspector.Middleware())
+	}
+
+	// graphql limits, before the waf inspects the arguments it parses
+	if h.config.USE_GRAPHQL {
+		endpoints, err := graphql.ParseEndpoints(h.config.GRAPHQL_ENDPOINTS, graphql.Limits{
+			MaxDepth:      h.config.GRAPHQL_MAX_DEPTH,
+			MaxComplexity: h.config.GRAPHQL_MAX_COMPLEXITY,
+			Introspection: h.config.GRAPHQL_INTROSPECTION,
+		})
+		if err != nil {
+			logger.Logger("[Fatal] Invalid graphql endpoints.", err.Error()).Fatal()
+		}
+		inspector := graphql.NewInspector(graphql.Options{
+			Endpoints: endpoints,
+			MaxBody:   h.config.GRAPHQL_MAX_BODY,
+		})
+		inspector.SetAudit(auditLog)
+		inspector.SetDryRun(dryRun)
+		c.Use(chain.Body, inspector.Middleware())
+	}
+
+	// csrf tokens, after the limits as form bodies are searched for the field
+	if h.config.USE_CSRF {
+		c.Use(chain.Body, csrf.NewCSRF(h.stateStore, csrf.Options{
+			Mode:          csrf.Mode(h.config.CSRF_MODE),
+			Secret:        []byte(h.config.CSRF_SECRET),
+			TTL:           time.Duration(h.config.CSRF_TTL) * time.Second,
+			CookieName:    h.config.CSRF_COOKIE,
+			SessionCookie: h.config.CSRF_SESSION_COOKIE,
+			HeaderName:    h.config.CSRF_HEADER,
+			FieldName:     h.config.CSRF_FIELD,
+			ExemptPaths:   list(h.config.CSRF_EXEMPT_PATHS),
+			SameSite:      csrf.ParseSameSite(h.config.CSRF_SAMESITE),
+			Secure:        h.config.CSRF_SECURE,
+		}).Middleware())
+	}
+
+	// latency and body size baselines, the waf scores bodies far above them
+	if h.config.USE_BASELINE {
+		h.baseline = baseline.NewSampler(h.stateStore, baseline.Options{
+			Window:     time.Duration(h.config.BASELINE_WINDOW) * time.Second,
+			Windows:    h.config.BASELINE_WINDOWS,
+			Flush:      time.Duration(h.config.BASELINE_FLUSH) * time.Second,
+			MaxRoutes:  h.config.BASELINE_MAX_ROUTES,
+			MinSamples: int64(h.config.BASELINE_MIN_SAMPLES),
+			Factor:     h.config.BASELINE_FACTOR,
+		})
+		h.baseline.SetAudit(auditLog)
+		if h.config.ENABLE_METRICS {
+			h.baseline.SetMetrics(metrics.NewPrometheusRequestRecorder(nil))
+		}
+		h.closeOnShutdown("baseline sampler", h.baseline)
+	}
+
+	// learned request profile, before the waf so what it blocks isn't learned
+	if h.config.USE_PROFILE {
+		h.profile = profile.NewProfiler(h.stateStore, profile.Options{
+			Learn:     time.Duration(h.config.PROFILE_LEARN) * time.Second,
+			Refresh:   time.Duration(h.config.PROFILE_REFRESH) * time.Second,
+			Action:    h.config.PROFILE_ACTION,
+			Paths:     list(h.config.PROFILE_PATHS),
+			MaxRoutes: h.config.PROFILE_MAX_ROUTES,
+			MaxParams: h.config.PROFILE_MAX_PARAMS,
+		})
+		h.profile.SetAudit(auditLog)
+		h.profile.SetDryRun(dryRun)
+		c.Use(chain.Rules, h.profile.Middleware())
+		h.closeOnShutdown("request profile", h.profile)
+	}
+
+	// request inspection
+	wafHandler := waf.NewWAF(h.config)
+	h.wafHandler = wafHandler
+	if h.config.USE_AUTOBAN {
+		wafHandler.SetAutoBan(autoBan)
+		wafHandler.SetBanKey(banKey.Func)
+	}
+	wafHandler.SetAudit(auditLog)
+	wafHandler.SetDryRun(dryRun)
+	wafHandler.SetStore(h.stateStore)
+	if h.baseline != nil {
+		wafHandler.SetBaseline(h.baseline)
+	}
+	if h.config.USE_WAF {
+		c.Use(chain.Rules, wafHandler.Inspect())
+		h.closeOnShutdown("waf rules watcher", wafHandler)
+	}
+
+	// response compression, the cache behind it keeps uncompressed bodies
+	if h.config.ENABLE_COMPRESSION || h.config.ENABLE_GZIP {
+		encodings := list(h.config.COMPRESSION_ENCODINGS)
+		if !h.config.ENABLE_COMPRESSION {
+			encodings = []string{compress.Gzip}
+		}
+		c.Use(chain.Response, compress.NewCompressor(compress.Options{
+			Encodings:    encodings,
+			MinLength:    int(h.config.GZIP_MIN_CONTENT_LENGTH),
+			GzipLevel:    h.config.GZIP_COMPRESSION_LEVEL,
+			BrotliLevel:  h.config.BROTLI_COMPRESSION_LEVEL,
+			ContentTypes: list(h.config.COMPRESSION_CONTENT_TYPES),
+		}).Middleware())
+	}
+
+	// response inspection, inside the compression so it sees the uncompressed body
+	if h.config.USE_WAF && (h.config.WAF_RULES_FILE != "" || h.config.WAF_RULE_SETS != "") {
+		c.Use(chain.Response, wafHandler.InspectResponse())
+	}
+
+	// sampled last, only what reaches the upstream counts
+	if h.baseline != nil {
+		c.Use(chain.Response, h.baseline.Middleware())
 	}
 
 	if h.config.DETECT_DEVICE {
 		deviceHandler := device.NewCheckDevice(h.config)
-		middlewareList = append(middlewareList, deviceHandler.SendHeader())
+		c.Use(chain.Response, deviceHandler.SendHeader())
 	}
 
-	if len(middlewareList) > 0 {
-		h.handler.Use(middlewareList...)
+	if handlers := c.Handlers(); len(handlers) > 0 {
+		h.handler.Use(handlers...)
 	}
 
 	// initial handler
 	proxyHandler := http_reverseproxy_handler.NewHttpHandler(h.config, h.handler, h.cacheHandler)
+	h.closeOnShutdown("upstream health checks", proxyHandler)
+	if h.config.PROXY_STICKY {
+		proxyHandler.Sticky(proxy.StickyOptions{
+			Key:     h.config.PROXY_STICKY_KEY,
+			Cookie:  h.config.PROXY_STICKY_COOKIE,
+			TTL:     time.Duration(h.config.PROXY_STICKY_TTL) * time.Second,
+			Secure:  h.config.PROXY_STICKY_SECURE,
+			Trusted: trusted,
+			Cache:   h.cacheDriver,
+		})
+	}
 	clearCacheHandler := http_clearcache_handler.NewHttpHandler(h.config, h.handler, h.cacheHandler)
+	purgeCacheHandler := http_purgecache_handler.NewHttpHandler(h.config, h.cacheHandler, h.cacheDriver)
+	maintenanceHandler := http_maintenance_handler.NewHttpHandler(h.config, h.maintenance)
+	baselineHandler := http_baseline_handler.NewHttpHandler(h.config, h.baseline)
+	if h.config.USE_HTTP_CACHE {
+		negativeStatus := []int{}
+		for _, status := range list(h.config.HTTP_CACHE_NEGATIVE_STATUS) {
+			if code, err := strconv.Atoi(status); err == nil {
+				negativeStatus = append(negativeStatus, code)
+			}
+		}
+		options := httpcache.Options{
+			DefaultTTL:  time.Duration(h.config.HTTP_CACHE_DEFAULT_TTL) * time.Second,
+			MaxBodySize: h.config.HTTP_CACHE_MAX_BODY,
+			Version:     h.config.HTTP_CACHE_VERSION,
+			Query:       list(h.config.HTTP_CACHE_KEY_QUERY),
+
+			NegativeTTL:    time.Duration(h.config.HTTP_CACHE_NEGATIVE_TTL) * time.Second,
+			NegativeStatus: negativeStatus,
+		}
+		if h.config.ENABLE_METRICS {
+			options.Metrics = metrics.NewPrometheusRequestRecorder(nil)
+		}
+		httpCache := httpcache.NewCache(h.cacheDriver, options)
+		proxyHandler.HTTPCache(httpCache)
+		purgeCacheHandler.HTTPCache(httpCache)
+
+		// the hottest responses are fetched again before they expire
+		if urls := list(h.config.HTTP_CACHE_WARM_URLS); len(urls) > 0 {
+			h.warmer = httpcache.NewWarmer(httpCache, proxyHandler, httpcache.WarmOptions{
+				URLs:       urls,
+				Host:       h.config.HOST,
+				Interval:   time.Duration(h.config.HTTP_CACHE_WARM_INTERVAL) * time.Second,
+				Rate:       h.config.HTTP_CACHE_WARM_RATE,
+				Timeout:    time.Duration(h.config.HTTP_CACHE_WARM_TIMEOUT) * time.Second,
+				MaxBackoff: time.Duration(h.config.HTTP_CACHE_WARM_MAX_BACKOFF) * time.Second,
+				Healthy:    proxyHandler.Healthy,
+			})
+			h.closeOnShutdown("cache warmer", h.warmer)
+		}
+	}
+
+	// scrapers are limited to METRICS_ALLOW_IP
+	var metricsHandler gin.HandlerFunc
+	if h.config.ENABLE_METRICS {
+		var allow []string
+		for _, ip := range strings.Split(h.config.METRICS_ALLOW_IP, ",") {
+			if ip = strings.TrimSpace(ip); ip != "" {
+				allow = append(allow, ip)
+			}
+		}
+		scrapers, err := pkg_ipfilter.NewFilter(allow, nil)
+		if err != nil {
+			logger.Logger("[Fatal] Invalid metrics allow list.", err.Error()).Fatal()
+		}
+		metricsHandler = gin.WrapH(metrics.Handler())
+		if len(allow) > 0 {
+			serve := metricsHandler
+			metricsHandler = func(ctx *gin.Context) {
+				if !scrapers.Allowed(clientip.FromContext(ctx)) {
+					ctx.String(403, "403 | Forbidden.")
+					return
+				}
+				serve(ctx)
+			}
+		}
+	}
+
+	// runtime controls, served apart from the proxied traffic
+	if h.config.USE_ADMIN {
+		api, err := admin.NewAPI(admin.Options{
+			Addr:                h.config.ADMIN_ADDR,
+			Token:               h.config.ADMIN_TOKEN,
+			BanDuration:         time.Duration(h.config.AUTOBAN_DURATION) * time.Second,
+			MaintenanceDuration: time.Duration(h.config.MAINTENANCE_DURATION) * time.Second,
+			IPv6Prefix:          h.config.IPV6_PREFIX,
+		})
+		if err != nil {
+			logger.Logger("[Fatal] Admin API setup error.", err.Error()).Fatal()
+		}
+		if h.autoBan != nil {
+			api.SetBans(h.autoBan)
+		}
+		if h.wafHandler != nil {
+			api.SetRules(h.wafHandler)
+		}
+		if h.config.USE_WAF {
+			api.SetExplainer(h.wafHandler)
+		}
+		api.SetRateLimits(h.rateLimiter)
+		api.SetMaintenance(h.maintenance)
+		api.SetPurger(purgeCacheHandler)
+		if health, ok := h.cacheDriver.(repository.HealthInterface); ok {
+			api.SetCacheHealth(health)
+		}
+		if h.profile != nil {
+			api.SetProfile(h.profile)
+		}
+		if h.warmer != nil {
+			api.SetWarmer(h.warmer)
+		}
+		api.SetAudit(auditLog)
+		if h.lifecycle != nil {
+			h.lifecycle.Register("admin api", api)
+		}
+	}
 
 	// set handler
 	h.handler.Any("/*path", func(ctx *gin.Context) {
 		if ctx.Param("path") == "/ping" {
 			ctx.String(200, "PONG")
+		} else if metricsHandler != nil && ctx.Param("path") == h.config.METRICS_PATH {
+			metricsHandler(ctx)
+		} else if h.config.CACHE_PURGE_TOKEN != "" && ctx.Param("path") == h.config.CACHE_PURGE_PATH {
+			purgeCacheHandler.Purge(ctx)
+		} else if h.config.MAINTENANCE_TOKEN != "" && ctx.Param("path") == h.config.MAINTENANCE_PATH {
+			maintenanceHandler.Toggle(ctx)
+		} else if h.baseline != nil && h.config.BASELINE_TOKEN != "" && ctx.Param("path") == h.config.BASELINE_PATH {
+			baselineHandler.Query(ctx)
 		} else if h.config.USE_CACHE &&
 			strings.EqualFold(ctx.Request.Method, h.config.CACHE_REMOVE_METHOD) {
-			logger.Logger("[info] clear cache: ", ctx.Param("path")).Info()
+			logger.FromContext(ctx.Request.Context()).Logger("[info] clear cache: ", ctx.Param("path")).Info()
 			clearCacheHandler.Clear(ctx)
 		} else {
 			proxyHandler.ReverseProxy(ctx)
@@ -101,7 +884,7 @@ func (h *Router) setRouter() {
 	h.handler.NoMethod(func(ctx *gin.Context) {
 		if h.config.USE_CACHE &&
 			strings.EqualFold(ctx.Request.Method, h.config.CACHE_REMOVE_METHOD) {
-			logger.Logger("[info] clear cache: ", ctx.Param("path")).Info()
+			logger.FromContext(ctx.Request.Context()).Logger("[info] clear cache: ", ctx.Param("path")).Info()
 			clearCacheHandler.Clear(ctx)
 		} else {
 			ctx.String(404, "404 page not found")
@@ -109,6 +892,82 @@ func (h *Router) setRouter() {
 	})
 }
 
+// Reload applies the settings of config that can change while serving, the
+// rate limits, the waf threshold and mode, the auto ban thresholds and the
+// maintenance mode.
+func (h *Router) Reload(config *config.Config) {
+	h.rateLimiter.SetLimit(time.Duration(config.RATELIMIT_SECOND)*time.Second, config.RATELIMIT_MAX)
+	if routes, err := ratelimit.ParseRoutes(config.RATELIMIT_ROUTES); err != nil {
+		logger.Logger("[error] keep the rate limit routes: ", err.Error()).Error()
+	} else {
+		h.rateLimiter.SetRoutes(routes)
+	}
+	if h.wafHandler != nil {
+		h.wafHandler.SetThreshold(config.WAF_THRESHOLD)
+		h.wafHandler.SetDetectionOnly(config.WAF_DETECTION_ONLY)
+	}
+	if h.autoBan != nil {
+		h.autoBan.SetOptions(autoBanOptions(config))
+	}
+	if h.maintenance != nil {
+		h.maintenance.SetLocal(config.MAINTENANCE)
+	}
+}
+
+// AutoBan returns the auto ban the middlewares feed, nil when none of them
+// bans. It is set up by GetHandler.
+func (h *Router) AutoBan() service.AutoBanInterface {
+	if h.autoBan == nil {
+		return nil
+	}
+
+	return h.autoBan
+}
+
+func autoBanOptions(config *config.Config) service_autoban.Options {
+	return service_autoban.Options{
+		Threshold:   config.AUTOBAN_THRESHOLD,
+		Window:      time.Duration(config.AUTOBAN_WINDOW) * time.Second,
+		Duration:    time.Duration(config.AUTOBAN_DURATION) * time.Second,
+		MaxDuration: time.Duration(config.AUTOBAN_MAX_DURATION) * time.Second,
+	}
+}
+
+// configBlockHandler returns the handler of BLOCK_RESPONSE, nil for the
+// default answers of the components.
+func (h *Router) configBlockHandler() block.Handler {
+	switch h.config.BLOCK_RESPONSE {
+	case "problem":
+		return block.Problem(h.config.BLOCK_PROBLEM_TYPE)
+	case "redirect":
+		target, err := url.Parse(h.config.BLOCK_REDIRECT_URL)
+		if err != nil {
+			logger.Logger("[Fatal] Invalid block redirect url.", err.Error()).Fatal()
+		}
+		return block.Redirect(target)
+	case "page":
+		page, err := template.ParseFiles(h.config.BLOCK_PAGE_FILE)
+		if err != nil {
+			logger.Logger("[Fatal] Block page error.", err.Error()).Fatal()
+		}
+		return block.Page(page)
+	}
+
+	return nil
+}
+
+// list splits a comma separated config value, dropping empty entries.
+func list(value string) []string {
+	var values []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			values = append(values, entry)
+		}
+	}
+
+	return values
+}
+
 func (h *Router) GetHandler() *gin.Engine {
 	h.setRouter()
 
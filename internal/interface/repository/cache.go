@@ -1,12 +1,78 @@
 package repository
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
+// CacheItem is a value and its TTL, used by batch writes.
+type CacheItem struct {
+	Value []byte
+	TTL   time.Duration
+}
+
+// CacheInterface is a cache, and the StateStore the components keep their
+// state in unless another one is set.
 type CacheInterface interface {
-	Set(string, []byte, time.Duration)
-	Get(string) ([]byte, bool)
+	StateStore
+
 	Pop(string) ([]byte, bool)
-	Remove(string)
 	RemoveByPrefix(string)
-	GetTTL(string) (time.Duration, bool)
+
+	// MSet stores several items in one round-trip.
+	MSet(items map[string]CacheItem) error
+
+	// WithContext returns a cache bound to ctx, so a request deadline or
+	// cancellation reaches the backend calls.
+	WithContext(context.Context) CacheInterface
+}
+
+// InvalidatorInterface is implemented by caches that can tell other instances
+// to drop local copies of a key, or of every key starting with a prefix.
+// Instances don't act on their own invalidations.
+type InvalidatorInterface interface {
+	PublishInvalidation(prefix string) error
+	PublishKeyInvalidation(key string) error
+}
+
+// TTLReaderInterface is implemented by caches that read values along with
+// the TTL they have left in one round-trip, which the tiered cache uses to
+// expire its copies with the originals. TTL is zero for a key without one.
+type TTLReaderInterface interface {
+	GetWithTTL(key string) ([]byte, time.Duration, bool)
+	MGetWithTTL(keys []string) (map[string]CacheItem, error)
+}
+
+// PurgerInterface is implemented by caches that report how many keys a prefix
+// removal deleted. Like RemoveByPrefix it also reaches the other instances
+// when the cache propagates invalidations.
+type PurgerInterface interface {
+	PurgeByPrefix(prefix string) (int, error)
+}
+
+// KeyListerInterface is implemented by caches that can enumerate their keys,
+// which the admin API uses to list bans. Expired keys may still show, read
+// them to tell.
+type KeyListerInterface interface {
+	KeysByPrefix(prefix string) ([]string, error)
+}
+
+// ScriptInterface is implemented by caches that can run a Lua script
+// atomically on the server, which components use for multi-step updates.
+type ScriptInterface interface {
+	Eval(script string, keys []string, args ...interface{}) (interface{}, error)
+}
+
+// CacheHealth is the state of the backend of a cache, as the circuit breaker
+// guarding it sees it.
+type CacheHealth struct {
+	Backend string `json:"backend"`
+	State   string `json:"state"` // closed, half_open or open
+}
+
+// HealthInterface is implemented by caches guarding their backend with a
+// circuit breaker, which the admin API reports. ok is false when the
+// breaker is turned off.
+type HealthInterface interface {
+	Health() (health CacheHealth, ok bool)
 }
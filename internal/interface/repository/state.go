@@ -0,0 +1,47 @@
+package repository
+
+import (
+	"context"
+	"time"
+)
+
+// StateStore keeps the state the components share across instances: TTL
+// keys, counters and locks, e.g. bans, rate limits and nonces. Every cache
+// is one, another backend like a database only needs these to hold them.
+// Optional abilities are the interfaces below, like ScriptInterface and
+// KeyListerInterface, and components fall back without them.
+type StateStore interface {
+	Set(string, []byte, time.Duration) error
+	Get(string) ([]byte, bool)
+	Remove(string) error
+	GetTTL(string) (time.Duration, bool)
+
+	// Exists reports whether key is present without transferring its value.
+	Exists(key string) (bool, error)
+
+	// Touch resets the TTL of key without rewriting its value. It reports
+	// false when the key does not exist.
+	Touch(key string, ttl time.Duration) (bool, error)
+
+	// MGet fetches several keys in one round-trip. Missing keys are omitted
+	// from the result.
+	MGet(keys []string) (map[string][]byte, error)
+
+	// Increment atomically adds delta to the integer stored at key and returns
+	// the new value. The TTL is only applied when the key is created.
+	Increment(key string, delta int64, ttl time.Duration) (int64, error)
+
+	// SetNX stores value only if key does not exist yet and reports whether
+	// it was stored.
+	SetNX(key string, value []byte, ttl time.Duration) (bool, error)
+
+	// CompareAndRemove deletes key only if it currently holds value.
+	CompareAndRemove(key string, value []byte) (bool, error)
+
+	// CompareAndExpire resets the TTL of key only if it currently holds value.
+	CompareAndExpire(key string, value []byte, ttl time.Duration) (bool, error)
+
+	// StateContext returns a store bound to ctx, so a request deadline or
+	// cancellation reaches the backend calls.
+	StateContext(context.Context) StateStore
+}
@@ -0,0 +1,23 @@
+package service
+
+import "time"
+
+type AutoBanInterface interface {
+	// Violation counts an offense of ip and reports whether it got banned.
+	Violation(ip string) (bool, error)
+	Banned(ip string) bool
+	Ban(ip string, duration time.Duration) error
+	Unban(ip string) error
+}
+
+// Ban is an IP banned until a given time.
+type Ban struct {
+	IP    string    `json:"ip"`
+	Until time.Time `json:"until"`
+}
+
+// BanListerInterface is implemented by auto bans that can list the current
+// bans, when their cache can enumerate keys.
+type BanListerInterface interface {
+	Bans() ([]Ban, error)
+}
@@ -1,13 +1,28 @@
 package service
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
 type CacheInterface interface {
 	SetKey(string)
-	Set(string, []byte, time.Duration)
+	Set(string, []byte, time.Duration) error
 	Get(string) ([]byte, bool)
 	Pop(string) ([]byte, bool)
-	Remove(string)
+	Remove(string) error
 	RemoveByPrefix(string)
 	GetTTL(string) (time.Duration, bool)
+
+	// Purge removes the entry of key, or every entry starting with it when
+	// isPrefix is set, and returns how many were removed.
+	Purge(key string, isPrefix bool) (int, error)
+
+	// GetOrSet returns the cached value or, on a miss, calls loader once
+	// across all goroutines and instances and caches its result.
+	GetOrSet(key string, ttl time.Duration, loader func() ([]byte, error)) ([]byte, error)
+
+	// WithContext returns a copy of the service bound to ctx. The copy has its
+	// own key prefix, so SetKey on it does not affect other requests.
+	WithContext(context.Context) CacheInterface
 }
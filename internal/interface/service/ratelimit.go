@@ -0,0 +1,16 @@
+package service
+
+import "time"
+
+// RateLimitResult is the limiter state after taking one request.
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration // until the limit is fully replenished
+	RetryAfter time.Duration // until the next request is allowed, 0 when allowed
+}
+
+type RateLimiterInterface interface {
+	Take(string) RateLimitResult
+}
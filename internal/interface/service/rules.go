@@ -0,0 +1,9 @@
+package service
+
+import "net/http"
+
+// DetectorInterface inspects a request and returns its anomaly score along
+// with the ids of the matched rules.
+type DetectorInterface interface {
+	Inspect(r *http.Request) (int, []string)
+}
@@ -3,7 +3,7 @@ package device
 import (
 	"github.com/gamebtc/devicedetector"
 	"github.com/gin-gonic/gin"
-	"github.com/jahrulnr/go-waf/config"
+	"github.com/jahrulnr/go-waf/pkg/config"
 	"github.com/jahrulnr/go-waf/pkg/logger"
 )
 
@@ -22,7 +22,7 @@ func (m *Device) SendHeader() gin.HandlerFunc {
 
 	return func(c *gin.Context) {
 		if err != nil {
-			logger.Logger("warn", err.Error()).Warn()
+			logger.FromContext(c.Request.Context()).Logger("warn", err.Error()).Warn()
 			c.Next()
 			return
 		}
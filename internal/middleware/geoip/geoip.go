@@ -0,0 +1,147 @@
+package geoip
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/jahrulnr/go-waf/pkg/audit"
+	"github.com/jahrulnr/go-waf/pkg/block"
+	"github.com/jahrulnr/go-waf/pkg/clientip"
+	"github.com/jahrulnr/go-waf/pkg/config"
+	"github.com/jahrulnr/go-waf/pkg/dryrun"
+	"github.com/jahrulnr/go-waf/pkg/geoip"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CountryKey is the gin context key holding the resolved country code.
+const CountryKey = "geoip.country"
+
+type GeoIP struct {
+	config *config.Config
+
+	db     *geoip.DB
+	allow  map[string]bool
+	deny   map[string]bool
+	audit  *audit.Logger
+	dryRun *dryrun.DryRun
+}
+
+func NewGeoIP(config *config.Config) *GeoIP {
+	db, err := geoip.NewDB(config.GEOIP_DB_PATH)
+	if err != nil {
+		logger.Logger("[Fatal] Watch GeoIP database error.", err.Error()).Fatal()
+	}
+
+	return &GeoIP{
+		config: config,
+		db:     db,
+		allow:  countries(config.GEOIP_ALLOW_COUNTRIES),
+		deny:   countries(config.GEOIP_DENY_COUNTRIES),
+	}
+}
+
+// countries parses a comma separated list of country codes.
+func countries(list string) map[string]bool {
+	set := make(map[string]bool)
+	for _, country := range strings.Split(list, ",") {
+		if country = strings.ToUpper(strings.TrimSpace(country)); country != "" {
+			set[country] = true
+		}
+	}
+
+	return set
+}
+
+// DB returns the database, for components that want the country as well.
+func (m *GeoIP) DB() *geoip.DB {
+	return m.db
+}
+
+// Close stops watching the database file.
+func (m *GeoIP) Close() error {
+	return m.db.Close()
+}
+
+// SetAudit writes every blocked request to the audit log.
+func (m *GeoIP) SetAudit(audit *audit.Logger) {
+	m.audit = audit
+}
+
+// SetDryRun forwards the clients from blocked countries, only reporting them.
+func (m *GeoIP) SetDryRun(dryRun *dryrun.DryRun) {
+	m.dryRun = dryRun
+}
+
+// allowed applies the deny list, then the allow list when it is set.
+// Addresses without a country, like private ones, are not filtered.
+func (m *GeoIP) allowed(country string, found bool) bool {
+	if !found {
+		return m.db.Loaded() || m.config.GEOIP_FAIL_OPEN
+	}
+	if m.deny[country] {
+		return false
+	}
+
+	return len(m.allow) == 0 || m.allow[country]
+}
+
+func (m *GeoIP) blockHandler(c *gin.Context, decision block.Decision) {
+	if block.Respond(c, decision) {
+		return
+	}
+
+	file, err := os.OpenFile("views/403.html", os.O_RDONLY, 0600)
+	if err != nil {
+		logger.FromContext(c.Request.Context()).Logger(err).Warn()
+		c.String(http.StatusForbidden, "403 | Forbidden.")
+		return
+	}
+	defer file.Close()
+
+	page, err := io.ReadAll(file)
+	if err != nil {
+		logger.FromContext(c.Request.Context()).Logger(err).Warn()
+		c.String(http.StatusForbidden, "403 | Forbidden.")
+		return
+	}
+
+	c.Data(http.StatusForbidden, "text/html", page)
+}
+
+// Filter blocks clients from denied countries, or from any country outside
+// the allow list.
+func (m *GeoIP) Filter() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		country, found := m.db.Lookup(net.ParseIP(clientip.FromContext(c)))
+		if found {
+			c.Set(CountryKey, country)
+		}
+
+		if !m.allowed(country, found) {
+			record := audit.Record{
+				Source:  "geoip",
+				Country: country,
+				Status:  http.StatusForbidden,
+			}
+			if m.dryRun.Forward(c, record) {
+				c.Next()
+				return
+			}
+
+			logger.FromContext(c.Request.Context()).Logger("[warn] geoip blocked ", clientip.FromContext(c), " country ", country).Warn()
+			m.audit.Log(c.Request, clientip.FromContext(c), record)
+			decision := block.FromRecord(record)
+			decision.Reason = "country " + country + " is not allowed"
+			m.blockHandler(c, decision)
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
@@ -0,0 +1,140 @@
+package honeypot
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+	"github.com/jahrulnr/go-waf/pkg/audit"
+	"github.com/jahrulnr/go-waf/pkg/bot"
+	"github.com/jahrulnr/go-waf/pkg/clientip"
+	"github.com/jahrulnr/go-waf/pkg/config"
+	"github.com/jahrulnr/go-waf/pkg/dryrun"
+	"github.com/jahrulnr/go-waf/pkg/ipfilter"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Honeypot bans the clients requesting a trap path. The trap list comes from
+// HONEYPOT_FILE, reloaded when it changes, or else from HONEYPOT_PATHS.
+type Honeypot struct {
+	config *config.Config
+
+	watcher *Watcher
+	traps   *Traps
+	ignore  *ipfilter.Filter
+	autoBan service.AutoBanInterface
+	audit   *audit.Logger
+	dryRun  *dryrun.DryRun
+}
+
+func NewHoneypot(config *config.Config) *Honeypot {
+	m := &Honeypot{
+		config: config,
+		traps: &Traps{
+			BanDuration: config.HONEYPOT_BAN_DURATION,
+			Paths:       list(config.HONEYPOT_PATHS),
+		},
+	}
+
+	var err error
+	if ips := list(config.HONEYPOT_IGNORE_IP); len(ips) > 0 {
+		m.ignore, err = ipfilter.NewFilter(ips, nil)
+		if err != nil {
+			logger.Logger("[Fatal] Invalid honeypot ignore list.", err.Error()).Fatal()
+		}
+	}
+	if config.HONEYPOT_FILE != "" {
+		m.watcher, err = NewWatcher(config.HONEYPOT_FILE)
+		if err != nil {
+			logger.Logger("[Fatal] Load honeypot traps error.", err.Error()).Fatal()
+		}
+	}
+
+	return m
+}
+
+func list(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// Close stops watching HONEYPOT_FILE.
+func (m *Honeypot) Close() error {
+	if m.watcher != nil {
+		return m.watcher.Close()
+	}
+
+	return nil
+}
+
+// SetAutoBan sets where the tripping clients are banned.
+func (m *Honeypot) SetAutoBan(autoBan service.AutoBanInterface) {
+	m.autoBan = autoBan
+}
+
+// SetAudit writes every trip to the audit log.
+func (m *Honeypot) SetAudit(audit *audit.Logger) {
+	m.audit = audit
+}
+
+// SetDryRun forwards the trap requests without banning, only reporting them.
+func (m *Honeypot) SetDryRun(dryRun *dryrun.DryRun) {
+	m.dryRun = dryRun
+}
+
+func (m *Honeypot) active() *Traps {
+	if m.watcher != nil {
+		return m.watcher.Traps()
+	}
+
+	return m.traps
+}
+
+// Trap answers trap paths with the same 404 as any missing page, so the
+// scanner learns nothing, and bans the client. Clients in HONEYPOT_IGNORE_IP
+// and verified good bots, which may follow a stray link, are never banned.
+func (m *Honeypot) Trap() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		traps := m.active()
+		if !traps.Match(c.Request.URL.Path) {
+			c.Next()
+			return
+		}
+
+		ip := clientip.FromContext(c)
+		_, reason, _ := bot.FromContext(c)
+		if (m.ignore != nil && m.ignore.Allowed(ip)) || strings.HasPrefix(reason, "verified ") {
+			logger.FromContext(c.Request.Context()).Logger("[info] honeypot hit by ignored client ", ip, " ", c.Request.URL.Path).Info()
+		} else if m.dryRun.Forward(c, audit.Record{Source: "honeypot", Action: "ban", Status: http.StatusNotFound}) {
+			c.Next()
+			return
+		} else if m.autoBan != nil {
+			duration := time.Duration(traps.BanDuration) * time.Second
+			if duration <= 0 {
+				duration = time.Duration(m.config.HONEYPOT_BAN_DURATION) * time.Second
+			}
+			if err := m.autoBan.Ban(clientip.KeyFromContext(c), duration); err != nil {
+				logger.FromContext(c.Request.Context()).Logger("[warn] fail to ban honeypot client ", ip, err.Error()).Warn()
+			} else {
+				logger.FromContext(c.Request.Context()).Logger("[warn] honeypot banned ", ip, " for ", duration.String(), " ", c.Request.URL.Path).Warn()
+			}
+			m.audit.Log(c.Request, ip, audit.Record{
+				Source: "honeypot",
+				Action: "ban",
+				Status: http.StatusNotFound,
+			})
+		}
+
+		c.String(http.StatusNotFound, "404 page not found")
+		c.Abort()
+	}
+}
@@ -0,0 +1,121 @@
+package honeypot
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/jahrulnr/go-waf/pkg/filewatch"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Traps is a list of paths no legitimate client requests. A path matches
+// itself and everything below it, /wp-admin traps /wp-admin/setup.php but
+// not /wp-administrator. A trailing * matches any suffix, /admin.php* traps
+// /admin.php.bak as well. Matching ignores case.
+type Traps struct {
+	BanDuration int      `yaml:"ban_duration"` // seconds
+	Paths       []string `yaml:"paths"`
+}
+
+// LoadFromYAML reads a trap list like
+//
+//	ban_duration: 86400
+//	paths:
+//	  - /wp-admin
+//	  - /.env
+func LoadFromYAML(path string) (*Traps, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	traps := &Traps{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(traps); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for _, trap := range traps.Paths {
+		if !strings.HasPrefix(trap, "/") {
+			return nil, fmt.Errorf("load %s: trap %q must start with /", path, trap)
+		}
+	}
+
+	return traps, nil
+}
+
+// Match reports whether requestPath hits a trap.
+func (t *Traps) Match(requestPath string) bool {
+	requestPath = strings.ToLower(path.Clean("/" + requestPath))
+	for _, trap := range t.Paths {
+		trap = strings.ToLower(trap)
+		if prefix, found := strings.CutSuffix(trap, "*"); found {
+			if strings.HasPrefix(requestPath, prefix) {
+				return true
+			}
+			continue
+		}
+
+		trap = strings.TrimSuffix(trap, "/")
+		if requestPath == trap || strings.HasPrefix(requestPath, trap+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Watcher keeps the Traps loaded from a YAML file up to date.
+type Watcher struct {
+	path    string
+	current atomic.Pointer[Traps]
+	watcher *filewatch.Watcher
+}
+
+// NewWatcher loads path and reloads it whenever it changes. The initial load
+// must succeed, later invalid versions are logged and ignored.
+func NewWatcher(path string) (*Watcher, error) {
+	traps, err := LoadFromYAML(path)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Watcher{path: filepath.Clean(path)}
+	w.current.Store(traps)
+
+	w.watcher, err = filewatch.New(path, w.reload)
+	if err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// Traps returns the active trap list.
+func (w *Watcher) Traps() *Traps {
+	return w.current.Load()
+}
+
+func (w *Watcher) Close() error {
+	return w.watcher.Close()
+}
+
+func (w *Watcher) reload() {
+	traps, err := LoadFromYAML(w.path)
+	if err != nil {
+		logger.Logger("[error] keep previous traps, reload failed ", err.Error()).Error()
+		return
+	}
+
+	w.current.Store(traps)
+	logger.Logger("[info] reloaded honeypot traps from ", w.path).Info()
+}
@@ -0,0 +1,141 @@
+package ipfilter
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+	"github.com/jahrulnr/go-waf/pkg/audit"
+	"github.com/jahrulnr/go-waf/pkg/block"
+	"github.com/jahrulnr/go-waf/pkg/clientip"
+	"github.com/jahrulnr/go-waf/pkg/clientkey"
+	"github.com/jahrulnr/go-waf/pkg/config"
+	"github.com/jahrulnr/go-waf/pkg/dryrun"
+	"github.com/jahrulnr/go-waf/pkg/ipfilter"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+type IPFilter struct {
+	config *config.Config
+
+	filter  *ipfilter.Filter
+	autoBan service.AutoBanInterface
+	audit   *audit.Logger
+	dryRun  *dryrun.DryRun
+}
+
+func NewIPFilter(config *config.Config) *IPFilter {
+	filter, err := ipfilter.NewFilter(list(config.IPFILTER_ALLOW), list(config.IPFILTER_DENY))
+	if err != nil {
+		logger.Logger("[Fatal] Invalid ip filter.", err.Error()).Fatal()
+	}
+
+	return &IPFilter{
+		config: config,
+		filter: filter,
+	}
+}
+
+func list(value string) []string {
+	var ranges []string
+	for _, cidr := range strings.Split(value, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr != "" {
+			ranges = append(ranges, cidr)
+		}
+	}
+
+	return ranges
+}
+
+// Rules returns the filter, ranges added to it apply to the next request.
+func (m *IPFilter) Rules() *ipfilter.Filter {
+	return m.filter
+}
+
+// SetAutoBan makes the filter reject banned IPs first.
+func (m *IPFilter) SetAutoBan(autoBan service.AutoBanInterface) {
+	m.autoBan = autoBan
+}
+
+// SetAudit writes every blocked request to the audit log.
+func (m *IPFilter) SetAudit(audit *audit.Logger) {
+	m.audit = audit
+}
+
+// SetDryRun forwards the rejected clients, only reporting them.
+func (m *IPFilter) SetDryRun(dryRun *dryrun.DryRun) {
+	m.dryRun = dryRun
+}
+
+// block answers 403, source tells the audit log whether the filter or a ban
+// rejected the client.
+func (m *IPFilter) block(c *gin.Context, source string) {
+	logger.FromContext(c.Request.Context()).Logger("[warn] ip filter blocked ", clientip.FromContext(c)).Warn()
+	record := audit.Record{
+		Source: source,
+		Status: http.StatusForbidden,
+	}
+	m.audit.Log(c.Request, clientip.FromContext(c), record)
+	if block.Respond(c, block.FromRecord(record)) {
+		return
+	}
+
+	file, err := os.OpenFile("views/403.html", os.O_RDONLY, 0600)
+	if err != nil {
+		logger.FromContext(c.Request.Context()).Logger(err).Warn()
+		c.String(http.StatusForbidden, "403 | Forbidden.")
+		return
+	}
+	defer file.Close()
+
+	page, err := io.ReadAll(file)
+	if err != nil {
+		logger.FromContext(c.Request.Context()).Logger(err).Warn()
+		c.String(http.StatusForbidden, "403 | Forbidden.")
+		return
+	}
+
+	c.Data(http.StatusForbidden, "text/html", page)
+}
+
+// Filter rejects denied client IPs, and anything outside the allow list when
+// one is set.
+func (m *IPFilter) Filter() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ip := clientip.FromContext(c)
+		source := ""
+		if m.autoBan != nil && m.autoBan.Banned(clientip.KeyFromContext(c)) {
+			source = "autoban"
+		} else if !m.filter.Allowed(ip) {
+			source = "ipfilter"
+		}
+
+		if source == "" || m.dryRun.Forward(c, audit.Record{Source: source, Status: http.StatusForbidden}) {
+			c.Next()
+			return
+		}
+
+		m.block(c, source)
+		c.Abort()
+	}
+}
+
+// Bans rejects the clients banned under key, for bans keyed by something
+// Filter can't see yet, like the subject of a token. It must run after the
+// middleware key reads, e.g. the jwt one.
+func (m *IPFilter) Bans(key clientkey.Func) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if m.autoBan == nil || !m.autoBan.Banned(key(c)) ||
+			m.dryRun.Forward(c, audit.Record{Source: "autoban", Status: http.StatusForbidden}) {
+			c.Next()
+			return
+		}
+
+		m.block(c, "autoban")
+		c.Abort()
+	}
+}
@@ -0,0 +1,77 @@
+package ipfilter_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jahrulnr/go-waf/internal/middleware/ipfilter"
+	memory_cache "github.com/jahrulnr/go-waf/internal/repository/memory"
+	service_autoban "github.com/jahrulnr/go-waf/internal/service/autoban"
+	"github.com/jahrulnr/go-waf/pkg/clientip"
+	"github.com/jahrulnr/go-waf/pkg/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// TestBanPrefix bans the client of a first request, as the WAF does on a
+// violation, and checks which clients the ban covers.
+func TestBanPrefix(t *testing.T) {
+	tests := []struct {
+		name    string
+		banned  string
+		other   string
+		blocked bool
+	}{
+		{name: "ipv6 same /64", banned: "[2001:db8:1:2::1]:1000", other: "[2001:db8:1:2:dead:beef::7]:1000", blocked: true},
+		{name: "ipv6 other /64", banned: "[2001:db8:1:2::1]:1000", other: "[2001:db8:1:3::1]:1000", blocked: false},
+		{name: "ipv4 same address", banned: "198.51.100.1:1000", other: "198.51.100.1:2000", blocked: true},
+		{name: "ipv4 neighbours", banned: "198.51.100.1:1000", other: "198.51.100.2:1000", blocked: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			autoBan := service_autoban.NewAutoBan(memory_cache.NewCache(), service_autoban.Options{Threshold: 1, Duration: time.Minute})
+			filter := ipfilter.NewIPFilter(&config.Config{})
+			filter.SetAutoBan(autoBan)
+
+			engine := gin.New()
+			engine.Use(clientip.Middleware(nil, clientip.DefaultPrefix), filter.Filter())
+			engine.GET("/attack", func(c *gin.Context) {
+				if _, err := autoBan.Violation(clientip.KeyFromContext(c)); err != nil {
+					t.Error(err)
+				}
+				c.Status(http.StatusForbidden)
+			})
+			engine.GET("/", func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+
+			request := func(target string, peer string) int {
+				r := httptest.NewRequest(http.MethodGet, target, nil)
+				r.RemoteAddr = peer
+				w := httptest.NewRecorder()
+				engine.ServeHTTP(w, r)
+				return w.Code
+			}
+
+			request("/attack", test.banned)
+			if code := request("/", test.banned); code != http.StatusForbidden {
+				t.Fatalf("banned client: status %d, want 403", code)
+			}
+
+			want := http.StatusOK
+			if test.blocked {
+				want = http.StatusForbidden
+			}
+			if code := request("/", test.other); code != want {
+				t.Errorf("%s: status %d, want %d", test.other, code, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,19 @@
+package ratelimit
+
+import (
+	"strings"
+)
+
+// headerPrefixes returns the configured header name prefixes, for example
+// X-RateLimit and RateLimit for the IETF draft names. It is never nil, an
+// empty setting sends no headers.
+func (s *RateLimit) headerPrefixes() []string {
+	prefixes := []string{}
+	for _, prefix := range strings.Split(s.config.RATELIMIT_HEADERS, ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+
+	return prefixes
+}
@@ -0,0 +1,73 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+	"github.com/jahrulnr/go-waf/pkg/block"
+	"github.com/jahrulnr/go-waf/pkg/clientip"
+	pkg_ratelimit "github.com/jahrulnr/go-waf/pkg/ratelimit"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ginKey holds the gin request of a request in its context, for the key
+// functions and block handlers of the net/http middleware.
+type ginKey struct{}
+
+type ginRequest struct {
+	c      *gin.Context
+	passed bool
+}
+
+// ClientIPKey is the default key function. It uses the key of the client IP
+// resolved by clientip.Middleware, which only honours X-Forwarded-For coming
+// from trusted proxies (TRUSTED_PROXIES), and keys IPv6 clients by network.
+func ClientIPKey(c *gin.Context) string {
+	return clientip.KeyFromContext(c)
+}
+
+// Middleware is the gin adapter of pkg/ratelimit's Middleware, keyed by a
+// gin key function. Blocked requests get the configured block response, or
+// a JSON 429.
+func Middleware(limiter service.RateLimiterInterface, keyFunc func(*gin.Context) string) gin.HandlerFunc {
+	if keyFunc == nil {
+		keyFunc = ClientIPKey
+	}
+
+	return wrap(pkg_ratelimit.MiddlewareWithOptions(limiter, pkg_ratelimit.Options{
+		KeyFunc: func(r *http.Request) string {
+			return keyFunc(ginContext(r))
+		},
+		Block: func(w http.ResponseWriter, r *http.Request, result service.RateLimitResult) bool {
+			if block.Respond(ginContext(r), block.Decision{Component: "ratelimit", Status: http.StatusTooManyRequests}) {
+				return true
+			}
+			return pkg_ratelimit.JSONBlock(w, r, result)
+		},
+	}))
+}
+
+// wrap runs a net/http middleware in the gin chain, continuing it when the
+// middleware calls its next handler and aborting it otherwise.
+func wrap(middleware func(http.Handler) http.Handler) gin.HandlerFunc {
+	handler := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := r.Context().Value(ginKey{}).(*ginRequest)
+		request.passed = true
+		request.c.Next()
+	}))
+
+	return func(c *gin.Context) {
+		request := &ginRequest{c: c}
+		handler.ServeHTTP(c.Writer, c.Request.WithContext(context.WithValue(c.Request.Context(), ginKey{}, request)))
+		if !request.passed {
+			c.Abort()
+		}
+	}
+}
+
+// ginContext returns the gin context of a request passed through wrap.
+func ginContext(r *http.Request) *gin.Context {
+	return r.Context().Value(ginKey{}).(*ginRequest).c
+}
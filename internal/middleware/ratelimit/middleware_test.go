@@ -0,0 +1,135 @@
+package ratelimit_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jahrulnr/go-waf/internal/middleware/ratelimit"
+	memory_cache "github.com/jahrulnr/go-waf/internal/repository/memory"
+	redis_cache "github.com/jahrulnr/go-waf/internal/repository/redis"
+	"github.com/jahrulnr/go-waf/pkg/clientip"
+	"github.com/jahrulnr/go-waf/pkg/config"
+	pkg_ratelimit "github.com/jahrulnr/go-waf/pkg/ratelimit"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// TestClientIPKeyPrefix checks IPv6 clients share the bucket of their
+// network while IPv4 ones keep one per address.
+func TestClientIPKeyPrefix(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix int
+		first  string
+		second string
+		want   int // status of the second request
+	}{
+		{name: "ipv6 same /64", prefix: 64, first: "[2001:db8:1:2::1]:1000", second: "[2001:db8:1:2:ffff:ffff:ffff:ffff]:1000", want: http.StatusTooManyRequests},
+		{name: "ipv6 other /64", prefix: 64, first: "[2001:db8:1:2::1]:1000", second: "[2001:db8:1:3::1]:1000", want: http.StatusOK},
+		{name: "ipv6 same /48", prefix: 48, first: "[2001:db8:1:2::1]:1000", second: "[2001:db8:1:3::1]:1000", want: http.StatusTooManyRequests},
+		{name: "ipv6 by address", prefix: 128, first: "[2001:db8:1:2::1]:1000", second: "[2001:db8:1:2::2]:1000", want: http.StatusOK},
+		{name: "ipv4 same address", prefix: 64, first: "198.51.100.1:1000", second: "198.51.100.1:2000", want: http.StatusTooManyRequests},
+		{name: "ipv4 neighbours", prefix: 64, first: "198.51.100.1:1000", second: "198.51.100.2:1000", want: http.StatusOK},
+		{name: "ipv4 mapped", prefix: 64, first: "[::ffff:198.51.100.1]:1000", second: "198.51.100.1:1000", want: http.StatusTooManyRequests},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiter := pkg_ratelimit.NewSlidingWindow(memory_cache.NewCache(), time.Minute, 1)
+			engine := gin.New()
+			engine.Use(clientip.Middleware(nil, test.prefix), ratelimit.Middleware(limiter, nil))
+			engine.GET("/", func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+
+			for i, peer := range []string{test.first, test.second} {
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				r.RemoteAddr = peer
+				w := httptest.NewRecorder()
+				engine.ServeHTTP(w, r)
+
+				want := http.StatusOK
+				if i == 1 {
+					want = test.want
+				}
+				if w.Code != want {
+					t.Errorf("request %d from %s: status %d, want %d", i+1, peer, w.Code, want)
+				}
+			}
+		})
+	}
+}
+
+// TestFixedWindowCacheStore checks the fixed window of the redis driver
+// counts in the cache's Redis rather than a client of its own.
+func TestFixedWindowCacheStore(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr(), MaxRetries: -1})
+	t.Cleanup(func() { client.Close() })
+
+	limiter := ratelimit.NewRateLimit(&config.Config{RATELIMIT_SECOND: 60, RATELIMIT_MAX: 1, RATELIMIT_ALGORITHM: "fixed_window"})
+	limiter.Driver("redis")
+	limiter.Store(redis_cache.NewCacheWithOptions(context.Background(), client, redis_cache.Options{Timeout: -1}))
+	engine := gin.New()
+	engine.Use(limiter.RateLimit())
+	engine.GET("/", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	for _, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if w.Code != want {
+			t.Errorf("status %d, want %d", w.Code, want)
+		}
+	}
+	if keys := server.Keys(); len(keys) != 1 || !strings.HasPrefix(keys[0], "gowaf-fw-") {
+		t.Errorf("keys %v in the cache's redis, want the fixed window counter", keys)
+	}
+}
+
+// TestFixedWindowMemory checks the memory driver's fixed window limits,
+// sends the configured headers and can be read without counting.
+func TestFixedWindowMemory(t *testing.T) {
+	limiter := ratelimit.NewRateLimit(&config.Config{RATELIMIT_SECOND: 60, RATELIMIT_MAX: 1, RATELIMIT_HEADERS: "RateLimit", RATELIMIT_ALGORITHM: "fixed_window"})
+	limiter.Driver("memory")
+	limiter.Store(memory_cache.NewCache())
+	engine := gin.New()
+	engine.Use(limiter.RateLimit())
+	engine.GET("/", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	for _, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = "198.51.100.1:1000"
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("status %d, want %d", w.Code, want)
+		}
+		if w.Header().Get("RateLimit-Limit") != "1" {
+			t.Errorf("headers %v, want RateLimit-Limit", w.Header())
+		}
+	}
+
+	for range 2 {
+		result, err := limiter.State("198.51.100.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Allowed || result.Remaining != 0 {
+			t.Errorf("state %+v, want a full window", result)
+		}
+	}
+}
@@ -1,57 +1,163 @@
 package ratelimit
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/jahrulnr/go-waf/config"
+	"github.com/jahrulnr/go-waf/internal/interface/repository"
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+	memory_cache "github.com/jahrulnr/go-waf/internal/repository/memory"
+	"github.com/jahrulnr/go-waf/pkg/audit"
+	"github.com/jahrulnr/go-waf/pkg/block"
+	"github.com/jahrulnr/go-waf/pkg/canonical"
+	"github.com/jahrulnr/go-waf/pkg/clientip"
+	"github.com/jahrulnr/go-waf/pkg/clientkey"
+	"github.com/jahrulnr/go-waf/pkg/config"
+	"github.com/jahrulnr/go-waf/pkg/dryrun"
 	"github.com/jahrulnr/go-waf/pkg/logger"
+	"github.com/jahrulnr/go-waf/pkg/metrics"
+	pkg_ratelimit "github.com/jahrulnr/go-waf/pkg/ratelimit"
+	"github.com/jahrulnr/go-waf/pkg/rules"
 
-	ratelimit "github.com/JGLTechnologies/gin-rate-limit"
 	"github.com/gin-gonic/gin"
-	"github.com/redis/go-redis/v9"
 )
 
 type RateLimit struct {
 	config *config.Config
 
-	driver string
-	store  ratelimit.Store
-	prefix string
+	driver  string
+	store   repository.StateStore
+	prefix  string
+	keyFunc clientkey.Func
 
-	rate  time.Duration
-	limit uint
+	mu       sync.Mutex
+	rate     time.Duration
+	limit    uint
+	routes   []Route
+	prefixes []string
+	table    atomic.Pointer[table]
+	local    repository.StateStore // the in memory fixed windows, see localStore
+
+	audit  *audit.Logger
+	dryRun *dryrun.DryRun
+}
+
+// peeker is a limiter whose state can be read without counting a request.
+type peeker interface {
+	Peek(key string) (service.RateLimitResult, error)
 }
 
 func NewRateLimit(config *config.Config) *RateLimit {
 	return &RateLimit{
-		config: config,
+		config:  config,
+		keyFunc: clientkey.IP,
 	}
 }
 
 func (s *RateLimit) initialize() {
 	s.rate = time.Duration(s.config.RATELIMIT_SECOND) * time.Second
 	s.limit = s.config.RATELIMIT_MAX
+	s.prefixes = s.headerPrefixes()
+
+	routes, err := ParseRoutes(s.config.RATELIMIT_ROUTES)
+	if err != nil {
+		logger.Logger("[Fatal] Invalid rate limit routes.", err.Error()).Fatal()
+	}
+	s.routes = routes
 }
 
 func (s *RateLimit) Driver(driver string) {
 	s.driver = strings.ToLower(driver)
 }
 
-func (s *RateLimit) keyFunc(c *gin.Context) string {
-	return fmt.Sprintf("%s_%s", s.prefix, c.ClientIP())
+// Store sets where the token_bucket and sliding_window algorithms keep
+// their counts, and fixed_window with the redis driver.
+func (s *RateLimit) Store(store repository.StateStore) {
+	s.store = store
+}
+
+// localStore returns the memory the fixed windows count in without a redis
+// driver, shared by every limit so a new one doesn't leave a cache behind.
+// Callers hold mu.
+func (s *RateLimit) localStore() repository.StateStore {
+	if s.local == nil {
+		s.local = memory_cache.NewCache()
+	}
+
+	return s.local
+}
+
+// SetKey counts the requests under key instead of the client IP, e.g. the
+// subject of their token. It must be set before RateLimit.
+func (s *RateLimit) SetKey(key clientkey.Func) {
+	s.keyFunc = key
+}
+
+// SetAudit writes every rejected request to the audit log.
+func (s *RateLimit) SetAudit(audit *audit.Logger) {
+	s.audit = audit
 }
 
-func (s *RateLimit) errorHandler(c *gin.Context, info ratelimit.Info) {
+// SetDryRun forwards the requests over the limit, only reporting them.
+func (s *RateLimit) SetDryRun(dryRun *dryrun.DryRun) {
+	s.dryRun = dryRun
+}
+
+// key names the counts of a client under the default limit, or under route
+// when set.
+func (s *RateLimit) key(route string, client string) string {
+	if route == "" {
+		return fmt.Sprintf("%s_%s", s.prefix, client)
+	}
+
+	return fmt.Sprintf("%s_%s_%s", s.prefix, route, client)
+}
+
+// State returns the default rate limit state of a client, its IP unless
+// SetKey keys it otherwise, e.g. sub:alice, without counting a request. It
+// fails with errors.ErrUnsupported before RateLimit ran.
+func (s *RateLimit) State(client string) (service.RateLimitResult, error) {
+	t := s.table.Load()
+	if t == nil {
+		return service.RateLimitResult{}, errors.ErrUnsupported
+	}
+
+	return t.fallback.peeker.Peek(s.key("", client))
+}
+
+// block answers a request over the limit, unless dry run forwards it.
+func (s *RateLimit) block(w http.ResponseWriter, r *http.Request, result service.RateLimitResult) bool {
+	c := ginContext(r)
+	record := audit.Record{
+		Source: "ratelimit",
+		Action: "rate_limit",
+		Status: http.StatusTooManyRequests,
+	}
+	if s.dryRun != nil && s.dryRun.Forward(c, record) {
+		return false
+	}
+
+	if s.config.ENABLE_METRICS {
+		metrics.NewPrometheusRequestRecorder(nil).RecordRateLimited()
+	}
+	s.audit.Log(c.Request, clientip.FromContext(c), record)
+	if block.Respond(c, block.FromRecord(record)) {
+		return true
+	}
+
 	file, err := os.OpenFile("views/429.html", os.O_RDONLY, 0600)
 	if err != nil {
-		logger.Logger(err).Warn()
+		logger.FromContext(r.Context()).Logger(err).Warn()
 		c.String(http.StatusTooManyRequests, "429 | Too many request.")
-		return
+		return true
 	}
 	defer file.Close()
 
@@ -59,34 +165,120 @@ func (s *RateLimit) errorHandler(c *gin.Context, info ratelimit.Info) {
 	logger.Logger(err).Fatal()
 
 	c.Data(http.StatusTooManyRequests, "text/html", page)
+	return true
 }
 
+// RateLimit limits every request by the first route its cleaned path
+// matches, or by the default limit. Every route counts apart, a client
+// spending its login attempts keeps its quota elsewhere.
 func (s *RateLimit) RateLimit() gin.HandlerFunc {
+	s.mu.Lock()
 	s.initialize()
-	switch s.driver {
-	case "redis":
-		s.store = ratelimit.RedisStore(&ratelimit.RedisOptions{
-			Rate:  s.rate,
-			Limit: s.limit,
-			RedisClient: redis.NewClient(&redis.Options{
-				Addr:     s.config.REDIS_ADDR,
-				Username: s.config.REDIS_USER,
-				Password: s.config.REDIS_PASS,
-				DB:       s.config.REDIS_DB, // use default DB
-			}),
-			PanicOnErr: false,
-		})
-	default: // default in memory
-		s.store = ratelimit.InMemoryStore(&ratelimit.InMemoryOptions{
-			Rate:  s.rate,
-			Limit: s.limit,
+	s.table.Store(s.build(nil))
+	s.mu.Unlock()
+
+	return func(c *gin.Context) {
+		requestPath := canonical.ParsePath(c.Request.URL.EscapedPath()).Clean
+		s.table.Load().limiter(requestPath).handler(c)
+	}
+}
+
+// SetLimit allows limit requests every rate from now on, on the paths no
+// route matches. Requests in flight finish with the old limiter, and the
+// counts so far are kept.
+func (s *RateLimit) SetLimit(rate time.Duration, limit uint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rate == rate && s.limit == limit {
+		return
+	}
+	s.rate, s.limit = rate, limit
+	if current := s.table.Load(); current != nil {
+		s.table.Store(&table{
+			routes:   current.routes,
+			fallback: s.limiter(Route{Rate: rate, Limit: limit}, nil),
 		})
 	}
+}
+
+// SetRoutes replaces the routing table from now on. Routes left as they
+// were keep their limiters and counts, the others start like SetLimit does.
+func (s *RateLimit) SetRoutes(routes []Route) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.routes = routes
+	if current := s.table.Load(); current != nil {
+		s.table.Store(s.build(current))
+	}
+}
+
+// build creates the limiters of the routes and the default limit, reusing
+// the unchanged ones of current. Callers hold mu.
+func (s *RateLimit) build(current *table) *table {
+	kept := make(map[Route]*limiter)
+	t := &table{}
+	if current != nil {
+		for _, l := range current.routes {
+			kept[l.route] = l
+		}
+		t.fallback = current.fallback
+	} else {
+		t.fallback = s.limiter(Route{Rate: s.rate, Limit: s.limit}, nil)
+	}
+
+	for _, route := range s.routes {
+		if l, ok := kept[route]; ok {
+			t.routes = append(t.routes, l)
+			continue
+		}
+		// ParseRoutes compiled it already
+		re, _ := rules.CompilePathPattern(route.Pattern)
+		t.routes = append(t.routes, s.limiter(route, re))
+	}
+
+	return t
+}
+
+// limiter creates the store of route and the middleware using it, re is nil
+// for the default limit. Callers hold mu.
+func (s *RateLimit) limiter(route Route, re *regexp.Regexp) *limiter {
+	l := &limiter{route: route, re: re}
+	name := ""
+	if re != nil {
+		name = routeKey(route.Pattern)
+	}
+
+	var lim pkg_ratelimit.Limiter
+	switch {
+	case strings.EqualFold(s.config.RATELIMIT_ALGORITHM, "token_bucket") && s.store != nil:
+		bucket := pkg_ratelimit.NewTokenBucket(s.store, float64(route.Limit)/route.Rate.Seconds(), int(route.Limit))
+		bucket.SetFailOpen(s.config.RATELIMIT_FAIL_OPEN)
+		lim, l.peeker = bucket, bucket
+	case strings.EqualFold(s.config.RATELIMIT_ALGORITHM, "sliding_window") && s.store != nil:
+		window := pkg_ratelimit.NewSlidingWindow(s.store, route.Rate, int(route.Limit))
+		window.SetFailOpen(s.config.RATELIMIT_FAIL_OPEN)
+		lim, l.peeker = window, window
+	default:
+		// the cache's own client on redis, whatever REDIS_MODE, guarded by
+		// its breaker, the memory of this instance otherwise
+		store := s.store
+		if s.driver != "redis" || store == nil {
+			store = s.localStore()
+		}
+		window := pkg_ratelimit.NewFixedWindow(store, route.Rate, int(route.Limit))
+		window.SetFailOpen(s.config.RATELIMIT_FAIL_OPEN)
+		lim, l.peeker = window, window
+	}
 
-	middleware := ratelimit.RateLimiter(s.store, &ratelimit.Options{
-		ErrorHandler: s.errorHandler,
-		KeyFunc:      s.keyFunc,
-	})
+	l.handler = wrap(pkg_ratelimit.MiddlewareWithOptions(lim, pkg_ratelimit.Options{
+		KeyFunc: func(r *http.Request) string {
+			return s.key(name, s.keyFunc(ginContext(r)))
+		},
+		Block:    s.block,
+		Prefixes: s.prefixes,
+	}))
 
-	return middleware
+	return l
 }
@@ -0,0 +1,96 @@
+package ratelimit
+
+import (
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jahrulnr/go-waf/pkg/rules"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Route limits the paths matching Pattern, a glob or a regex: as the rule
+// exclusions take it, see rules.CompilePathPattern.
+type Route struct {
+	Pattern string
+	Rate    time.Duration
+	Limit   uint
+}
+
+// ParseRoutes reads comma separated pattern=limit/seconds routes, e.g.
+// /login=5/60,/static/**=1000/60,regex:^/api/v[0-9]+/search$=20/1.
+func ParseRoutes(value string) ([]Route, error) {
+	var routes []Route
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		// the pattern may hold a = of its own, the limit can't
+		i := strings.LastIndex(entry, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("rate limit route %q must be pattern=limit/seconds", entry)
+		}
+		limit, seconds, found := strings.Cut(entry[i+1:], "/")
+		n, err := strconv.ParseUint(strings.TrimSpace(limit), 10, 32)
+		if !found || err != nil || n == 0 {
+			return nil, fmt.Errorf("rate limit route %q must be pattern=limit/seconds with a limit of at least 1", entry)
+		}
+		s, err := strconv.Atoi(strings.TrimSpace(seconds))
+		if err != nil || s <= 0 {
+			return nil, fmt.Errorf("rate limit route %q must be pattern=limit/seconds with at least 1 second", entry)
+		}
+
+		route := Route{
+			Pattern: strings.TrimSpace(entry[:i]),
+			Rate:    time.Duration(s) * time.Second,
+			Limit:   uint(n),
+		}
+		if _, err := rules.CompilePathPattern(route.Pattern); err != nil {
+			return nil, fmt.Errorf("rate limit route %s: %w", route.Pattern, err)
+		}
+		routes = append(routes, route)
+	}
+
+	return routes, nil
+}
+
+// limiter is the middleware of one limit, with its own store and keys.
+type limiter struct {
+	route   Route
+	re      *regexp.Regexp // nil for the default limit
+	handler gin.HandlerFunc
+	peeker  peeker
+}
+
+// table holds the route limiters in the order listed, the first matching
+// wins, and the default limit for the other paths.
+type table struct {
+	routes   []*limiter
+	fallback *limiter
+}
+
+func (t *table) limiter(requestPath string) *limiter {
+	for _, l := range t.routes {
+		if l.re.MatchString(requestPath) {
+			return l
+		}
+	}
+
+	return t.fallback
+}
+
+// routeKey names the counts of a route apart from the default ones and the
+// other routes'. The pattern is hashed, the file cache can't name a file
+// after a regex.
+func routeKey(pattern string) string {
+	hash := fnv.New64a()
+	hash.Write([]byte(pattern))
+
+	return fmt.Sprintf("route-%x", hash.Sum64())
+}
@@ -0,0 +1,263 @@
+package waf
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jahrulnr/go-waf/pkg/audit"
+	"github.com/jahrulnr/go-waf/pkg/block"
+	"github.com/jahrulnr/go-waf/pkg/clientip"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+	"github.com/jahrulnr/go-waf/pkg/rules"
+
+	"github.com/gin-gonic/gin"
+)
+
+// bufferedWriter holds the response back until it is complete, so response
+// rules can inspect it. Past limit bytes, or on a flush, it gives up and
+// streams everything through unchanged.
+type bufferedWriter struct {
+	gin.ResponseWriter
+
+	limit     int
+	status    int
+	buf       bytes.Buffer
+	written   bool
+	streaming bool
+}
+
+func (w *bufferedWriter) WriteHeader(code int) {
+	if w.streaming {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if code > 0 {
+		w.status = code
+	}
+}
+
+func (w *bufferedWriter) WriteHeaderNow() {
+	if w.streaming {
+		w.ResponseWriter.WriteHeaderNow()
+		return
+	}
+	w.written = true
+}
+
+func (w *bufferedWriter) Write(data []byte) (int, error) {
+	if !w.streaming && w.buf.Len()+len(data) > w.limit {
+		if err := w.stream(); err != nil {
+			return 0, err
+		}
+	}
+	if w.streaming {
+		return w.ResponseWriter.Write(data)
+	}
+
+	w.written = true
+	return w.buf.Write(data)
+}
+
+func (w *bufferedWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *bufferedWriter) Status() int {
+	if w.streaming {
+		return w.ResponseWriter.Status()
+	}
+	return w.status
+}
+
+func (w *bufferedWriter) Size() int {
+	if w.streaming || !w.written {
+		return w.ResponseWriter.Size()
+	}
+	return w.buf.Len()
+}
+
+func (w *bufferedWriter) Written() bool {
+	if w.streaming {
+		return w.ResponseWriter.Written()
+	}
+	return w.written
+}
+
+// Flush means the handler streams, e.g. server sent events.
+func (w *bufferedWriter) Flush() {
+	if err := w.stream(); err != nil {
+		return
+	}
+	w.ResponseWriter.Flush()
+}
+
+func (w *bufferedWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.streaming = true
+	return w.ResponseWriter.Hijack()
+}
+
+// stream switches to pass through, sending what was buffered so far.
+func (w *bufferedWriter) stream() error {
+	if w.streaming {
+		return nil
+	}
+
+	w.streaming = true
+	w.ResponseWriter.WriteHeader(w.status)
+	_, err := w.ResponseWriter.Write(w.buf.Bytes())
+	w.buf.Reset()
+
+	return err
+}
+
+// InspectResponse runs the response phase rules over complete responses up
+// to WAF_RESPONSE_LIMIT bytes. Larger and streamed responses pass untouched.
+func (m *WAF) InspectResponse() gin.HandlerFunc {
+	m.initialize()
+
+	return func(c *gin.Context) {
+		_, set := m.engine.RuleSetFor(c.Request)
+		if set == nil || !set.HasResponseRules() || c.Request.Method == http.MethodHead {
+			c.Next()
+			return
+		}
+
+		writer := &bufferedWriter{
+			ResponseWriter: c.Writer,
+			limit:          m.config.WAF_RESPONSE_LIMIT,
+			status:         http.StatusOK,
+		}
+		c.Writer = writer
+		c.Next()
+		c.Writer = writer.ResponseWriter
+
+		if !writer.streaming {
+			m.finishResponse(c, writer)
+		}
+	}
+}
+
+func (m *WAF) finishResponse(c *gin.Context, writer *bufferedWriter) {
+	body := writer.buf.Bytes()
+	header := c.Writer.Header()
+
+	// only identity and gzip can be inspected, other encodings pass as is
+	encoding := strings.ToLower(header.Get("Content-Encoding"))
+	plain := body
+	switch encoding {
+	case "", "identity":
+	case "gzip":
+		decoded, err := gunzip(body)
+		if err != nil {
+			logger.FromContext(c.Request.Context()).Logger("[warn] waf can't decode response ", c.Request.URL.RequestURI(), err.Error()).Warn()
+			writeResponse(c, writer.status, body)
+			return
+		}
+		plain = decoded
+	default:
+		writeResponse(c, writer.status, body)
+		return
+	}
+
+	matched, decision := m.engine.EvaluateResponse(c.Request, header, plain)
+	if len(matched) == 0 {
+		writeResponse(c, writer.status, body)
+		return
+	}
+
+	if m.engine.DetectionOnly() {
+		ids := make([]string, len(matched))
+		for i, rule := range matched {
+			ids[i] = rule.ID
+		}
+		header.Set("X-WAF-Matched", strings.Join(ids, ","))
+		if decision == rules.DecisionDetect {
+			m.dryRun.Forward(c, audit.Record{
+				Source: "waf_response",
+				Rules:  ids,
+				Status: http.StatusForbidden,
+			})
+		}
+		writeResponse(c, writer.status, body)
+		return
+	}
+
+	if decision == rules.DecisionBlock {
+		ids := make([]string, len(matched))
+		for i, rule := range matched {
+			ids[i] = rule.ID
+		}
+		record := audit.Record{
+			Source: "waf_response",
+			Rules:  ids,
+			Status: http.StatusForbidden,
+		}
+		m.audit.Log(c.Request, clientip.FromContext(c), record)
+		header.Del("Content-Encoding")
+		header.Del("Content-Length")
+		m.blockHandler(c, block.FromRecord(record))
+		return
+	}
+
+	redacted := false
+	for _, rule := range matched {
+		if rule.Action == rules.ActionRedact {
+			plain = rule.Redact(plain)
+			redacted = true
+		}
+	}
+	if !redacted {
+		writeResponse(c, writer.status, body)
+		return
+	}
+
+	if encoding == "gzip" {
+		encoded, err := gzipBytes(plain)
+		if err != nil {
+			// never send the unredacted body
+			logger.FromContext(c.Request.Context()).Logger("[error] waf can't encode response ", c.Request.URL.RequestURI(), err.Error()).Error()
+			header.Del("Content-Encoding")
+			encoded = plain
+		}
+		plain = encoded
+	}
+
+	header.Set("Content-Length", strconv.Itoa(len(plain)))
+	writeResponse(c, writer.status, plain)
+}
+
+func writeResponse(c *gin.Context, status int, body []byte) {
+	c.Writer.WriteHeader(status)
+	if _, err := c.Writer.Write(body); err != nil {
+		logger.FromContext(c.Request.Context()).Logger("[warn] fail to write response ", err.Error()).Warn()
+	}
+}
+
+func gunzip(body []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return io.ReadAll(reader)
+}
+
+func gzipBytes(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(body); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
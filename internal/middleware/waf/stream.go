@@ -0,0 +1,74 @@
+package waf
+
+import (
+	"github.com/jahrulnr/go-waf/pkg/block"
+	"github.com/jahrulnr/go-waf/pkg/clientip"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+	"github.com/jahrulnr/go-waf/pkg/rules"
+
+	"github.com/gin-gonic/gin"
+)
+
+// heldWriter drops what the proxy answers once the body was blocked, the
+// error of the cut upstream request, so the block response can take its
+// place.
+type heldWriter struct {
+	gin.ResponseWriter
+
+	scanner *rules.BodyScanner
+}
+
+func (w *heldWriter) WriteHeader(code int) {
+	if !w.scanner.Blocked() {
+		w.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (w *heldWriter) WriteHeaderNow() {
+	if !w.scanner.Blocked() {
+		w.ResponseWriter.WriteHeaderNow()
+	}
+}
+
+func (w *heldWriter) Write(data []byte) (int, error) {
+	if w.scanner.Blocked() {
+		return len(data), nil
+	}
+
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *heldWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// streamBody forwards the request with its body scanned on the way to the
+// upstream, and answers with the block response when the scan blocked it.
+func (m *WAF) streamBody(c *gin.Context, scanner *rules.BodyScanner) {
+	writer := &heldWriter{ResponseWriter: c.Writer, scanner: scanner}
+	c.Writer = writer
+	c.Next()
+	c.Writer = writer.ResponseWriter
+
+	score, decision, hits := scanner.Result()
+	if decision != rules.DecisionBlock {
+		return
+	}
+
+	record := m.record(score, hits)
+	m.audit.Log(c.Request, clientip.FromContext(c), record)
+	if c.Writer.Written() {
+		// the upstream answered before reading the whole body
+		logger.FromContext(c.Request.Context()).Logger("[warn] waf blocked the body of ", c.Request.Method, " ", c.Request.URL.RequestURI(), " after the response started").Warn()
+		return
+	}
+	m.blockHandler(c, block.FromRecord(record))
+}
+
+// streamOptions reads the streaming settings.
+func (m *WAF) streamOptions() rules.StreamOptions {
+	return rules.StreamOptions{
+		Window:   m.config.WAF_STREAM_WINDOW,
+		MaxBytes: int64(m.config.WAF_STREAM_MAX_BYTES),
+	}
+}
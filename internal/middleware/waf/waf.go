@@ -0,0 +1,348 @@
+package waf
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jahrulnr/go-waf/internal/interface/repository"
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+	"github.com/jahrulnr/go-waf/pkg/audit"
+	"github.com/jahrulnr/go-waf/pkg/baseline"
+	"github.com/jahrulnr/go-waf/pkg/block"
+	"github.com/jahrulnr/go-waf/pkg/clientip"
+	"github.com/jahrulnr/go-waf/pkg/clientkey"
+	"github.com/jahrulnr/go-waf/pkg/config"
+	"github.com/jahrulnr/go-waf/pkg/dryrun"
+	"github.com/jahrulnr/go-waf/pkg/limits"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+	"github.com/jahrulnr/go-waf/pkg/metrics"
+	"github.com/jahrulnr/go-waf/pkg/rules"
+
+	"github.com/gin-gonic/gin"
+)
+
+type WAF struct {
+	config *config.Config
+
+	engine   *rules.Engine
+	rules    *rules.Watcher
+	ruleSets map[string]*rules.Watcher // of WAF_RULE_SETS by name
+	autoBan  service.AutoBanInterface
+	banKey   clientkey.Func
+	audit    *audit.Logger
+	dryRun   *dryrun.DryRun
+	baseline *baseline.Sampler
+	store    repository.StateStore
+}
+
+func NewWAF(config *config.Config) *WAF {
+	return &WAF{
+		config: config,
+		banKey: clientkey.IP,
+	}
+}
+
+// initialize builds the engine once, both the request and the response
+// middleware share it.
+func (m *WAF) initialize() {
+	if m.engine != nil {
+		return
+	}
+
+	var headers []string
+	for _, header := range strings.Split(m.config.WAF_INSPECT_HEADERS, ",") {
+		if header = strings.TrimSpace(header); header != "" {
+			headers = append(headers, header)
+		}
+	}
+
+	headerInjection := rules.NewHeaderInjectionDetector()
+	headerInjection.SetStrip(m.config.WAF_STRIP_HEADER_INJECTION)
+
+	detectors := []service.DetectorInterface{
+		rules.NewSQLiDetector(headers),
+		rules.NewXSSDetector(headers),
+		rules.NewPathTraversalDetector(),
+		headerInjection,
+	}
+	if m.baseline != nil {
+		detectors = append(detectors, rules.NewBaselineDetector(m.baseline))
+	}
+
+	m.engine = rules.NewEngine(m.config.WAF_THRESHOLD, detectors...)
+	m.engine.SetDetectionOnly(m.config.WAF_DETECTION_ONLY || m.dryRun.Enabled())
+	var recorder *metrics.PrometheusRequestRecorder
+	if m.config.ENABLE_METRICS {
+		recorder = metrics.NewPrometheusRequestRecorder(nil)
+		m.engine.SetMetrics(recorder)
+	}
+	if m.store != nil && m.config.WAF_RESULT_CACHE_TTL > 0 {
+		// instances inspecting other headers don't share results
+		scope := strings.Join(headers, ",") + " strip=" + strconv.FormatBool(m.config.WAF_STRIP_HEADER_INJECTION)
+		cache := rules.NewResultCache(m.store, time.Duration(m.config.WAF_RESULT_CACHE_TTL)*time.Second, scope)
+		if recorder != nil {
+			cache.SetMetrics(recorder)
+		}
+		m.engine.SetCache(cache)
+	}
+
+	if m.config.WAF_RULES_FILE != "" {
+		watcher, err := rules.NewWatcher(m.config.WAF_RULES_FILE)
+		if err != nil {
+			logger.Logger("[Fatal] Load WAF rules error.", err.Error()).Fatal()
+		}
+		m.engine.SetRules(watcher)
+		m.rules = watcher
+	}
+	if m.config.WAF_RULE_SETS != "" {
+		m.initializeRuleSets()
+	}
+}
+
+// initializeRuleSets loads the named sets of WAF_RULE_SETS, for example
+// shop:shop.example.com=shop.yaml,api:/api=api.yaml: the name, a host, a
+// path prefix or both, like shop.example.com/admin, and its rules file. The
+// requests no set selects keep WAF_RULES_FILE.
+func (m *WAF) initializeRuleSets() {
+	var sets *rules.RuleSets
+	if m.rules != nil {
+		sets = rules.NewRuleSets(m.rules)
+	} else {
+		sets = rules.NewRuleSets(nil)
+	}
+
+	m.ruleSets = make(map[string]*rules.Watcher)
+	for _, entry := range strings.Split(m.config.WAF_RULE_SETS, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		selector, file, _ := strings.Cut(entry, "=")
+		name, selector, _ := strings.Cut(selector, ":")
+		host, prefix := selector, ""
+		if i := strings.Index(selector, "/"); i >= 0 {
+			host, prefix = selector[:i], selector[i:]
+		}
+
+		watcher, err := rules.NewWatcher(strings.TrimSpace(file))
+		if err != nil {
+			logger.Logger("[Fatal] Load WAF rule set ", name, " error.", err.Error()).Fatal()
+		}
+		sets.Add(name, host, prefix, watcher)
+		m.ruleSets[name] = watcher
+	}
+	m.engine.SetRules(sets)
+}
+
+// Close stops watching the rules files.
+func (m *WAF) Close() error {
+	var errs []error
+	if m.rules != nil {
+		errs = append(errs, m.rules.Close())
+	}
+	for _, watcher := range m.ruleSets {
+		errs = append(errs, watcher.Close())
+	}
+
+	return errors.Join(errs...)
+}
+
+// SetThreshold changes the blocking score of the running engine.
+func (m *WAF) SetThreshold(threshold int) {
+	if m.engine != nil {
+		m.engine.SetThreshold(threshold)
+	}
+}
+
+// SetDetectionOnly turns blocking of the running engine off or back on, in
+// dry run it stays off.
+func (m *WAF) SetDetectionOnly(detectionOnly bool) {
+	if m.engine != nil {
+		m.engine.SetDetectionOnly(detectionOnly || m.dryRun.Enabled())
+	}
+}
+
+// DetectionOnly reports whether the running engine only logs.
+func (m *WAF) DetectionOnly() bool {
+	return m.engine != nil && m.engine.DetectionOnly()
+}
+
+// ReloadRules loads WAF_RULES_FILE and the files of WAF_RULE_SETS again
+// without waiting for the watchers. Each file keeps its current rules when
+// it is invalid.
+func (m *WAF) ReloadRules() error {
+	if m.rules == nil && len(m.ruleSets) == 0 {
+		return errors.New("no WAF_RULES_FILE to reload")
+	}
+
+	var errs []error
+	if m.rules != nil {
+		errs = append(errs, m.rules.Reload())
+	}
+	for name := range m.ruleSets {
+		errs = append(errs, m.ReloadRuleSet(name))
+	}
+
+	return errors.Join(errs...)
+}
+
+// RuleSets returns the names of the sets loaded from a file, default for
+// WAF_RULES_FILE.
+func (m *WAF) RuleSets() []string {
+	var names []string
+	if m.rules != nil {
+		names = append(names, rules.DefaultRuleSetName)
+	}
+	for name := range m.ruleSets {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	return names
+}
+
+// ReloadRuleSet loads the file of one set of RuleSets again.
+func (m *WAF) ReloadRuleSet(name string) error {
+	watcher, ok := m.ruleSets[name]
+	if name == rules.DefaultRuleSetName && m.rules != nil {
+		watcher, ok = m.rules, true
+	}
+	if !ok {
+		return fmt.Errorf("unknown rule set %s", name)
+	}
+	if err := watcher.Reload(); err != nil {
+		return fmt.Errorf("rule set %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// SetDryRun only reports the requests the rules would block, it must be
+// called before the middlewares are built.
+func (m *WAF) SetDryRun(dryRun *dryrun.DryRun) {
+	m.dryRun = dryRun
+}
+
+// SetAutoBan counts every blocked request as a violation of its client.
+func (m *WAF) SetAutoBan(autoBan service.AutoBanInterface) {
+	m.autoBan = autoBan
+}
+
+// SetBanKey counts the violations under key instead of the client IP, e.g.
+// the subject of a token.
+func (m *WAF) SetBanKey(key clientkey.Func) {
+	m.banKey = key
+}
+
+// SetAudit writes every blocked request to the audit log.
+func (m *WAF) SetAudit(audit *audit.Logger) {
+	m.audit = audit
+}
+
+// SetBaseline scores request bodies far larger than their route's baseline,
+// before the engine is built.
+func (m *WAF) SetBaseline(sampler *baseline.Sampler) {
+	m.baseline = sampler
+}
+
+// SetStore keeps the results of identical requests in store for
+// WAF_RESULT_CACHE_TTL, before the engine is built.
+func (m *WAF) SetStore(store repository.StateStore) {
+	m.store = store
+}
+
+// Explain describes how the rules decide on r, a sample request, without
+// forwarding it, a rules.Explanation.
+func (m *WAF) Explain(r *http.Request) interface{} {
+	m.initialize()
+
+	return m.engine.Explain(r)
+}
+
+func (m *WAF) blockHandler(c *gin.Context, decision block.Decision) {
+	if m.autoBan != nil {
+		if _, err := m.autoBan.Violation(m.banKey(c)); err != nil {
+			logger.FromContext(c.Request.Context()).Logger("[warn] fail to count violation ", m.banKey(c), err.Error()).Warn()
+		}
+	}
+	if block.Respond(c, decision) {
+		return
+	}
+
+	file, err := os.OpenFile("views/403.html", os.O_RDONLY, 0600)
+	if err != nil {
+		logger.FromContext(c.Request.Context()).Logger(err).Warn()
+		c.String(http.StatusForbidden, "403 | Forbidden.")
+		return
+	}
+	defer file.Close()
+
+	page, err := io.ReadAll(file)
+	if err != nil {
+		logger.FromContext(c.Request.Context()).Logger(err).Warn()
+		c.String(http.StatusForbidden, "403 | Forbidden.")
+		return
+	}
+
+	c.Data(http.StatusForbidden, "text/html", page)
+}
+
+// Inspect scores every request and aborts the ones the engine blocks.
+func (m *WAF) Inspect() gin.HandlerFunc {
+	m.initialize()
+
+	return func(c *gin.Context) {
+		score, decision, hits := m.engine.EvaluateHits(c.Request)
+		if decision != rules.DecisionAllow {
+			record := m.record(score, hits)
+			if decision == rules.DecisionDetect {
+				m.dryRun.Forward(c, record)
+			} else {
+				m.audit.Log(c.Request, clientip.FromContext(c), record)
+				m.blockHandler(c, block.FromRecord(record))
+				c.Abort()
+				return
+			}
+		}
+		// the inspected body was cut by the body size limit
+		if limits.Exceeded(c) {
+			limits.Reject(c)
+			return
+		}
+
+		if m.config.WAF_STREAM_BODY {
+			if scanner := m.engine.StreamBody(c.Request, hits, m.streamOptions()); scanner != nil {
+				m.streamBody(c, scanner)
+				return
+			}
+		}
+
+		c.Next()
+	}
+}
+
+// record describes a blocked request for the audit log.
+func (m *WAF) record(score int, hits []rules.Hit) audit.Record {
+	ids := make([]string, len(hits))
+	var fields []string
+	for i, hit := range hits {
+		ids[i] = hit.ID
+		if hit.Field != "" && !slices.Contains(fields, hit.Field) {
+			fields = append(fields, hit.Field)
+		}
+	}
+
+	return audit.Record{
+		Source: "waf",
+		Rules:  ids,
+		Fields: fields,
+		Score:  score,
+		Status: http.StatusForbidden,
+	}
+}
@@ -1,10 +1,14 @@
 package file_cache
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -28,8 +32,18 @@ func NewFileCache(cacheDir string) repository.CacheInterface {
 	return &FileCache{cacheDir: cacheDir}
 }
 
+// WithContext returns the cache itself, file operations are local.
+func (c *FileCache) WithContext(ctx context.Context) repository.CacheInterface {
+	return c
+}
+
+// StateContext is WithContext as a repository.StateStore.
+func (c *FileCache) StateContext(ctx context.Context) repository.StateStore {
+	return c.WithContext(ctx)
+}
+
 // Set adds a new item to the file cache with the specified key, value, and TTL.
-func (c *FileCache) Set(key string, value []byte, ttl time.Duration) {
+func (c *FileCache) Set(key string, value []byte, ttl time.Duration) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -39,17 +53,20 @@ func (c *FileCache) Set(key string, value []byte, ttl time.Duration) {
 	})
 	if err != nil {
 		logger.Logger("Error serializing value: ", err).Warn()
-		return
+		return err
 	}
 
 	cacheFilePath := c.getFilePath(key)
 	err = os.WriteFile(cacheFilePath, serializedValue, 0644)
 	if err != nil {
 		logger.Logger("Error writing to cache file: ", err).Warn()
+		return err
 	}
 
 	// Optionally, you can implement a mechanism to clean up expired files
 	go c.scheduleCleanup(key, ttl)
+
+	return nil
 }
 
 // Get retrieves the value associated with the given key from the file cache.
@@ -76,7 +93,9 @@ func (c *FileCache) Get(key string) ([]byte, bool) {
 
 	// Check if the item is expired
 	if time.Now().Unix() > item.Expiration {
-		c.Remove(key) // Optionally remove expired item
+		// The read lock is held here, so remove the file directly instead of
+		// going through Remove.
+		c.removeFile(cacheFilePath)
 		return nil, false
 	}
 
@@ -119,18 +138,32 @@ func (c *FileCache) Pop(key string) ([]byte, bool) {
 }
 
 // Remove removes the item with the specified key from the file cache.
-func (c *FileCache) Remove(key string) {
+// A missing file is not an error, the key is already gone.
+func (c *FileCache) Remove(key string) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	cacheFilePath := c.getFilePath(key)
+	return c.removeFile(c.getFilePath(key))
+}
+
+// removeFile deletes a cache file without taking the lock.
+func (c *FileCache) removeFile(cacheFilePath string) error {
 	err := os.Remove(cacheFilePath)
-	if err != nil {
+	if err != nil && !os.IsNotExist(err) {
 		logger.Logger("Error removing cache file: ", err).Warn()
+		return err
 	}
+
+	return nil
 }
 
 func (c *FileCache) RemoveByPrefix(prefix string) {
+	c.PurgeByPrefix(prefix)
+}
+
+// PurgeByPrefix removes every cache file starting with prefix and returns how
+// many were removed.
+func (c *FileCache) PurgeByPrefix(prefix string) (int, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -139,9 +172,10 @@ func (c *FileCache) RemoveByPrefix(prefix string) {
 	files, err := os.ReadDir(c.cacheDir)
 	if err != nil {
 		logger.Logger("[warn] Error reading cache directory: ", err).Warn()
-		return
+		return 0, err
 	}
 
+	removed := 0
 	prefixN := len(prefix)
 	for _, file := range files {
 		if file.IsDir() {
@@ -151,9 +185,96 @@ func (c *FileCache) RemoveByPrefix(prefix string) {
 			err = os.Remove(c.cacheDir + file.Name())
 			if err != nil {
 				logger.Logger("[warn] Error deleting cache file: ", err).Warn()
+				continue
 			}
+			removed++
+		}
+	}
+
+	return removed, nil
+}
+
+// KeysByPrefix lists the keys of the cache files starting with prefix,
+// expired ones the cleanup didn't reach yet included.
+func (c *FileCache) KeysByPrefix(prefix string) ([]string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	files, err := os.ReadDir(c.cacheDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, file := range files {
+		key, found := strings.CutSuffix(file.Name(), ".cache")
+		if !file.IsDir() && found && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
 		}
 	}
+
+	return keys, nil
+}
+
+// Exists reports whether key is present and not expired.
+func (c *FileCache) Exists(key string) (bool, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	_, found, err := c.readItem(c.getFilePath(key))
+	return found, err
+}
+
+// Touch resets the TTL of key. The file still has to be rewritten since the
+// expiration lives next to the value.
+func (c *FileCache) Touch(key string, ttl time.Duration) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cacheFilePath := c.getFilePath(key)
+	item, found, err := c.readItem(cacheFilePath)
+	if err != nil || !found {
+		return false, err
+	}
+
+	item.Expiration = time.Now().Add(ttl).Unix()
+	if err := c.writeItem(cacheFilePath, item); err != nil {
+		return false, err
+	}
+
+	go c.scheduleCleanup(key, ttl)
+
+	return true, nil
+}
+
+// MSet stores several items, stopping at the first failure.
+func (c *FileCache) MSet(items map[string]repository.CacheItem) error {
+	for key, item := range items {
+		if err := c.Set(key, item.Value, item.TTL); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MGet fetches several keys. Missing keys are omitted.
+func (c *FileCache) MGet(keys []string) (map[string][]byte, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	values := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		item, found, err := c.readItem(c.getFilePath(key))
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			values[key] = item.Value
+		}
+	}
+
+	return values, nil
 }
 
 // GetTTL returns the remaining time before the specified key expires.
@@ -187,13 +308,159 @@ func (c *FileCache) GetTTL(key string) (time.Duration, bool) {
 	return remaining, true
 }
 
+// Increment atomically adds delta to the counter stored at key and returns the
+// new value. An expired or missing key starts from zero with the given TTL.
+func (c *FileCache) Increment(key string, delta int64, ttl time.Duration) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cacheFilePath := c.getFilePath(key)
+	item, found, err := c.readItem(cacheFilePath)
+	if err != nil {
+		return 0, err
+	}
+
+	var current int64
+	if found {
+		current, err = strconv.ParseInt(string(item.Value), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("value of %s is not an integer", key)
+		}
+	} else {
+		item.Expiration = time.Now().Add(ttl).Unix()
+	}
+
+	current += delta
+	item.Value = []byte(strconv.FormatInt(current, 10))
+	if err := c.writeItem(cacheFilePath, item); err != nil {
+		return 0, err
+	}
+
+	if !found {
+		go c.scheduleCleanup(key, ttl)
+	}
+
+	return current, nil
+}
+
+// SetNX stores value only if key does not exist yet or has expired.
+func (c *FileCache) SetNX(key string, value []byte, ttl time.Duration) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cacheFilePath := c.getFilePath(key)
+	if _, found, err := c.readItem(cacheFilePath); err != nil || found {
+		return false, err
+	}
+
+	if err := c.writeItem(cacheFilePath, CacheItem{
+		Value:      value,
+		Expiration: time.Now().Add(ttl).Unix(),
+	}); err != nil {
+		return false, err
+	}
+
+	go c.scheduleCleanup(key, ttl)
+
+	return true, nil
+}
+
+// CompareAndRemove deletes key only if it still holds value.
+func (c *FileCache) CompareAndRemove(key string, value []byte) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cacheFilePath := c.getFilePath(key)
+	item, found, err := c.readItem(cacheFilePath)
+	if err != nil || !found || !bytes.Equal(item.Value, value) {
+		return false, err
+	}
+
+	if err := c.removeFile(cacheFilePath); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// CompareAndExpire resets the TTL of key only if it still holds value.
+func (c *FileCache) CompareAndExpire(key string, value []byte, ttl time.Duration) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cacheFilePath := c.getFilePath(key)
+	item, found, err := c.readItem(cacheFilePath)
+	if err != nil || !found || !bytes.Equal(item.Value, value) {
+		return false, err
+	}
+
+	item.Expiration = time.Now().Add(ttl).Unix()
+	if err := c.writeItem(cacheFilePath, item); err != nil {
+		return false, err
+	}
+
+	go c.scheduleCleanup(key, ttl)
+
+	return true, nil
+}
+
+// readItem loads a live cache item from disk without taking the lock.
+func (c *FileCache) readItem(cacheFilePath string) (CacheItem, bool, error) {
+	var item CacheItem
+
+	data, err := os.ReadFile(cacheFilePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return item, false, nil
+		}
+		logger.Logger("Error reading cache file: ", err).Error()
+		return item, false, err
+	}
+
+	if err := json.Unmarshal(data, &item); err != nil {
+		logger.Logger("Error deserializing value: ", err).Error()
+		return item, false, err
+	}
+
+	if time.Now().Unix() > item.Expiration {
+		return item, false, nil
+	}
+
+	return item, true, nil
+}
+
+// writeItem stores a cache item on disk without taking the lock.
+func (c *FileCache) writeItem(cacheFilePath string, item CacheItem) error {
+	serializedValue, err := json.Marshal(item)
+	if err != nil {
+		logger.Logger("Error serializing value: ", err).Warn()
+		return err
+	}
+
+	err = os.WriteFile(cacheFilePath, serializedValue, 0644)
+	if err != nil {
+		logger.Logger("Error writing to cache file: ", err).Warn()
+	}
+
+	return err
+}
+
 // getFilePath constructs the file path for a given key.
 func (c *FileCache) getFilePath(key string) string {
 	return filepath.Join(c.cacheDir, fmt.Sprintf("%s.cache", key))
 }
 
-// scheduleCleanup removes the file after the TTL expires.
+// scheduleCleanup removes the file after the TTL expires, unless the key was
+// rewritten or its TTL extended in the meantime.
 func (c *FileCache) scheduleCleanup(key string, ttl time.Duration) {
-	time.Sleep(ttl)
-	c.Remove(key)
+	// expiration is stored in whole seconds, so wait out the rounding too
+	time.Sleep(ttl + time.Second)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cacheFilePath := c.getFilePath(key)
+	if _, found, err := c.readItem(cacheFilePath); err == nil && !found {
+		c.removeFile(cacheFilePath)
+	}
 }
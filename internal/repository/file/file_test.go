@@ -0,0 +1,38 @@
+package file_cache_test
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/jahrulnr/go-waf/internal/interface/repository"
+	file_cache "github.com/jahrulnr/go-waf/internal/repository/file"
+)
+
+// TestKeysByPrefix checks the listed keys are the ones the cache was given,
+// so they can be read back.
+func TestKeysByPrefix(t *testing.T) {
+	cache := file_cache.NewFileCache(t.TempDir())
+	for _, key := range []string{"ban-a", "ban-b", "other"} {
+		if err := cache.Set(key, []byte(key), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys, err := cache.(repository.KeyListerInterface).KeysByPrefix("ban-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(keys)
+	if !slices.Equal(keys, []string{"ban-a", "ban-b"}) {
+		t.Fatalf("keys %v, want [ban-a ban-b]", keys)
+	}
+
+	values, err := cache.MGet(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 2 || string(values["ban-a"]) != "ban-a" || string(values["ban-b"]) != "ban-b" {
+		t.Errorf("values %q, want both keys", values)
+	}
+}
@@ -1,6 +1,12 @@
 package memory_cache
 
 import (
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -12,102 +18,247 @@ import (
 
 // item represents a cache item with a value and an expiration time.
 type item[V any] struct {
+	key    string
 	value  V
 	expiry time.Time
 }
 
-// isExpired checks if the cache item has expired.
-func (i item[V]) isExpired() bool {
-	return time.Now().After(i.expiry)
+// isExpired checks if the cache item has expired. A zero expiry never does.
+func (i *item[V]) isExpired() bool {
+	return !i.expiry.IsZero() && time.Now().After(i.expiry)
+}
+
+// expiryAfter returns when an item stored with ttl expires, never for a ttl
+// of zero or less, as Redis keeps a key set without expiry.
+func expiryAfter(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+
+	return time.Now().Add(ttl)
 }
 
 // TTLCache is a generic cache implementation with support for time-to-live
-// (TTL) expiration.
+// (TTL) expiration and an optional LRU entry cap.
 type TTLCache struct {
-	items map[string]item[[]byte] // The map storing cache items.
-	mu    sync.Mutex              // Mutex for controlling concurrent access to the cache.
+	items      map[string]*list.Element // The map storing cache items by key.
+	order      *list.List               // Recency list, most recently used at the front.
+	maxEntries int                      // Maximum number of entries, 0 means unlimited.
+	mu         sync.RWMutex             // Mutex for controlling concurrent access to the cache.
+
+	stop    chan struct{} // closed by Close to end the janitor
+	stopped chan struct{} // closed by the janitor once it returned
+	once    sync.Once
 }
 
-// NewTTL creates a new TTLCache instance and starts a goroutine to periodically
-// remove expired items every 5 seconds.
+// NewCache creates a new unbounded TTLCache instance and starts a goroutine to
+// periodically remove expired items every 5 seconds.
 func NewCache() repository.CacheInterface {
+	return NewCacheWithLimit(0)
+}
+
+// NewCacheWithLimit creates a new TTLCache holding at most maxEntries items.
+// When the cap is reached the least recently used item is evicted. A
+// maxEntries of 0 or less disables the cap.
+func NewCacheWithLimit(maxEntries int) repository.CacheInterface {
+	if maxEntries < 0 {
+		maxEntries = 0
+	}
+
 	c := &TTLCache{
-		items: make(map[string]item[[]byte]),
+		items:      make(map[string]*list.Element),
+		order:      list.New(),
+		maxEntries: maxEntries,
+		stop:       make(chan struct{}),
+		stopped:    make(chan struct{}),
 	}
 
-	go func() {
-		for range time.Tick(5 * time.Second) {
-			c.mu.Lock()
+	go c.janitor(5 * time.Second)
 
-			// Iterate over the cache items and delete expired ones.
-			for key, item := range c.items {
-				if item.isExpired() {
-					delete(c.items, key)
-				}
-			}
+	return c
+}
+
+// Close stops the janitor and waits for it to return. The cache still works,
+// expired items are just no longer swept.
+func (c *TTLCache) Close() error {
+	c.once.Do(func() {
+		close(c.stop)
+	})
+	<-c.stopped
+
+	return nil
+}
+
+// janitor periodically evicts expired entries.
+func (c *TTLCache) janitor(interval time.Duration) {
+	defer close(c.stopped)
 
-			c.mu.Unlock()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+
+		c.mu.Lock()
+
+		// Iterate over the cache items and delete expired ones.
+		for _, element := range c.items {
+			if element.Value.(*item[[]byte]).isExpired() {
+				c.removeElement(element)
+			}
 		}
-	}()
 
+		c.mu.Unlock()
+	}
+}
+
+// removeElement deletes the element from both the map and the recency list.
+// The caller must hold the write lock.
+func (c *TTLCache) removeElement(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.items, element.Value.(*item[[]byte]).key)
+}
+
+// lookup returns the live item for the given key. The caller must hold at
+// least the read lock.
+func (c *TTLCache) lookup(key string) (*item[[]byte], bool) {
+	element, found := c.items[key]
+	if !found {
+		return nil, false
+	}
+
+	entry := element.Value.(*item[[]byte])
+	if entry.isExpired() {
+		return nil, false
+	}
+
+	return entry, true
+}
+
+// WithContext returns the cache itself, memory operations never block.
+func (c *TTLCache) WithContext(ctx context.Context) repository.CacheInterface {
 	return c
 }
 
+// StateContext is WithContext as a repository.StateStore.
+func (c *TTLCache) StateContext(ctx context.Context) repository.StateStore {
+	return c.WithContext(ctx)
+}
+
 // Set adds a new item to the cache with the specified key, value, and
-// time-to-live (TTL).
-func (c *TTLCache) Set(key string, value []byte, ttl time.Duration) {
+// time-to-live (TTL). A TTL of zero or less keeps it until it is removed or
+// evicted.
+func (c *TTLCache) Set(key string, value []byte, ttl time.Duration) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	c.items[key] = item[[]byte]{
+	c.store(&item[[]byte]{
+		key:    key,
 		value:  value,
-		expiry: time.Now().Add(ttl),
+		expiry: expiryAfter(ttl),
+	})
+
+	return nil
+}
+
+// store inserts or replaces an entry and enforces the entry cap. The caller
+// must hold the write lock.
+func (c *TTLCache) store(entry *item[[]byte]) {
+	if element, found := c.items[entry.key]; found {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.items[entry.key] = c.order.PushFront(entry)
+
+	// Evict the least recently used items when the cap is exceeded.
+	for c.maxEntries > 0 && c.order.Len() > c.maxEntries {
+		c.removeElement(c.order.Back())
 	}
 }
 
 // Get retrieves the value associated with the given key from the cache.
 func (c *TTLCache) Get(key string) ([]byte, bool) {
+	if c.maxEntries == 0 {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+
+		entry, found := c.lookup(key)
+		if !found {
+			return nil, false
+		}
+
+		return entry.value, true
+	}
+
+	// With a cap the hit has to be promoted, which needs the write lock.
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	item, found := c.items[key]
+	entry, found := c.lookup(key)
 	if !found {
-		// If the key is not found, return the zero value for V and false.
-		return item.value, false
+		return nil, false
 	}
+	c.order.MoveToFront(c.items[key])
 
-	if item.isExpired() {
-		// If the item has expired, remove it from the cache and return the
-		// value and false.
-		delete(c.items, key)
-		return item.value, false
-	}
-
-	// Otherwise return the value and true.
-	return item.value, true
+	return entry.value, true
 }
 
 // Remove removes the item with the specified key from the cache.
-func (c *TTLCache) Remove(key string) {
+func (c *TTLCache) Remove(key string) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	// Delete the item with the given key from the cache.
-	delete(c.items, key)
+	if element, found := c.items[key]; found {
+		c.removeElement(element)
+	}
+
+	return nil
 }
 
 func (c *TTLCache) RemoveByPrefix(prefix string) {
+	c.PurgeByPrefix(prefix)
+}
+
+// PurgeByPrefix removes every item starting with prefix and returns how many
+// were removed.
+func (c *TTLCache) PurgeByPrefix(prefix string) (int, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	removed := 0
 	prefixN := len(prefix)
-	for key := range c.items {
+	for key, element := range c.items {
 		// matching key with prefix
 		if len(key) >= prefixN && key[:prefixN] == prefix {
 			// Delete the item with the given prefix from the cache.
-			delete(c.items, key)
+			c.removeElement(element)
+			removed++
 		}
 	}
+
+	return removed, nil
+}
+
+// KeysByPrefix lists the live keys starting with prefix.
+func (c *TTLCache) KeysByPrefix(prefix string) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var keys []string
+	for key, element := range c.items {
+		if strings.HasPrefix(key, prefix) && !element.Value.(*item[[]byte]).isExpired() {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
 }
 
 // Pop removes and returns the item with the specified key from the cache.
@@ -115,40 +266,171 @@ func (c *TTLCache) Pop(key string) ([]byte, bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	item, found := c.items[key]
+	element, found := c.items[key]
 	if !found {
-		// If the key is not found, return the zero value for V and false.
-		return item.value, false
+		return nil, false
 	}
 
 	// If the key is found, delete the item from the cache.
-	delete(c.items, key)
+	c.removeElement(element)
 
-	if item.isExpired() {
-		// If the item has expired, return the value and false.
-		return item.value, false
+	entry := element.Value.(*item[[]byte])
+	if entry.isExpired() {
+		// If the item has expired, return false.
+		return nil, false
 	}
 
 	// Otherwise return the value and true.
-	return item.value, true
+	return entry.value, true
 }
 
-// GetTTL returns the remaining time before the specified key expires.
-func (c *TTLCache) GetTTL(key string) (time.Duration, bool) {
+// Exists reports whether key is present and not expired.
+func (c *TTLCache) Exists(key string) (bool, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	_, found := c.lookup(key)
+	return found, nil
+}
+
+// Touch resets the TTL of key without rewriting its value.
+func (c *TTLCache) Touch(key string, ttl time.Duration) (bool, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	item, found := c.items[key]
+	entry, found := c.lookup(key)
+	if !found {
+		return false, nil
+	}
+
+	entry.expiry = time.Now().Add(ttl)
+	return true, nil
+}
+
+// MSet stores several items under a single lock.
+func (c *TTLCache) MSet(items map[string]repository.CacheItem) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, value := range items {
+		c.store(&item[[]byte]{
+			key:    key,
+			value:  value.Value,
+			expiry: expiryAfter(value.TTL),
+		})
+	}
+
+	return nil
+}
+
+// MGet fetches several keys under a single lock. Missing keys are omitted.
+func (c *TTLCache) MGet(keys []string) (map[string][]byte, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	values := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		if entry, found := c.lookup(key); found {
+			values[key] = entry.value
+		}
+	}
+
+	return values, nil
+}
+
+// GetTTL returns the remaining time before the specified key expires, zero
+// when it has no expiry.
+func (c *TTLCache) GetTTL(key string) (time.Duration, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	entry, found := c.lookup(key)
 	if !found {
-		return 0, false // Key does not exist
+		return 0, false // Key does not exist or is expired
 	}
 
-	if item.isExpired() {
-		delete(c.items, key) // Optionally remove expired item
-		return 0, false
+	if entry.expiry.IsZero() {
+		// no expiry
+		return 0, true
 	}
 
 	// Calculate remaining TTL
-	remaining := time.Until(item.expiry)
+	remaining := time.Until(entry.expiry)
 	return remaining, true
 }
+
+// Increment atomically adds delta to the counter stored at key and returns the
+// new value. An expired or missing key starts from zero with the given TTL,
+// or without expiry for a TTL of zero or less.
+func (c *TTLCache) Increment(key string, delta int64, ttl time.Duration) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, found := c.lookup(key)
+	if !found {
+		c.store(&item[[]byte]{
+			key:    key,
+			value:  []byte(strconv.FormatInt(delta, 10)),
+			expiry: expiryAfter(ttl),
+		})
+
+		return delta, nil
+	}
+
+	current, err := strconv.ParseInt(string(entry.value), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("value of %s is not an integer", key)
+	}
+
+	current += delta
+	entry.value = []byte(strconv.FormatInt(current, 10))
+	c.order.MoveToFront(c.items[key])
+
+	return current, nil
+}
+
+// SetNX stores value only if key does not exist yet or has expired.
+func (c *TTLCache) SetNX(key string, value []byte, ttl time.Duration) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, found := c.lookup(key); found {
+		return false, nil
+	}
+
+	c.store(&item[[]byte]{
+		key:    key,
+		value:  value,
+		expiry: expiryAfter(ttl),
+	})
+
+	return true, nil
+}
+
+// CompareAndRemove deletes key only if it still holds value.
+func (c *TTLCache) CompareAndRemove(key string, value []byte) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, found := c.lookup(key)
+	if !found || !bytes.Equal(entry.value, value) {
+		return false, nil
+	}
+
+	c.removeElement(c.items[key])
+	return true, nil
+}
+
+// CompareAndExpire resets the TTL of key only if it still holds value.
+func (c *TTLCache) CompareAndExpire(key string, value []byte, ttl time.Duration) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, found := c.lookup(key)
+	if !found || !bytes.Equal(entry.value, value) {
+		return false, nil
+	}
+
+	entry.expiry = time.Now().Add(ttl)
+	return true, nil
+}
@@ -0,0 +1,51 @@
+package memory_cache_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jahrulnr/go-waf/internal/interface/repository"
+	memory_cache "github.com/jahrulnr/go-waf/internal/repository/memory"
+)
+
+// TestWithoutTTL checks a TTL of zero or less keeps the entry, as Redis does
+// with a key set without expiry.
+func TestWithoutTTL(t *testing.T) {
+	cache := memory_cache.NewCache()
+
+	for _, ttl := range []time.Duration{0, -time.Second} {
+		if err := cache.Set("set", []byte("value"), ttl); err != nil {
+			t.Fatal(err)
+		}
+		if value, found := cache.Get("set"); !found || string(value) != "value" {
+			t.Errorf("set with ttl %s: got %q, %v", ttl, value, found)
+		}
+		if remaining, found := cache.GetTTL("set"); !found || remaining != 0 {
+			t.Errorf("set with ttl %s: ttl %s, %v, want none", ttl, remaining, found)
+		}
+	}
+
+	cache.MSet(map[string]repository.CacheItem{"mset": {Value: []byte("value")}})
+	if _, found := cache.Get("mset"); !found {
+		t.Error("mset without ttl expired")
+	}
+
+	if stored, _ := cache.SetNX("setnx", []byte("value"), 0); !stored {
+		t.Fatal("setnx didn't store")
+	}
+	if stored, _ := cache.SetNX("setnx", []byte("other"), 0); stored {
+		t.Error("setnx without ttl replaced a live key")
+	}
+
+	cache.Increment("counter", 1, 0)
+	if n, _ := cache.Increment("counter", 1, 0); n != 2 {
+		t.Errorf("counter %d, want 2", n)
+	}
+
+	// a positive ttl still expires
+	cache.Set("short", []byte("value"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if _, found := cache.Get("short"); found {
+		t.Error("entry outlived its ttl")
+	}
+}
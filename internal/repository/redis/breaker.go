@@ -0,0 +1,68 @@
+package redis_cache
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jahrulnr/go-waf/pkg/breaker"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// breakerHook fails the commands of a client right away while its breaker is
+// open, so a dead Redis costs no dial or read timeout per request. Replies
+// Redis sent, errors included, are successes, only the connection failing
+// counts against it.
+type breakerHook struct {
+	breaker *breaker.Breaker
+}
+
+// NewBreakerHook guards a client with breaker, add it with AddHook.
+func NewBreakerHook(breaker *breaker.Breaker) redis.Hook {
+	return breakerHook{breaker: breaker}
+}
+
+func (h breakerHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h breakerHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if !h.breaker.Allow() {
+			cmd.SetErr(breaker.ErrCircuitOpen)
+			return breaker.ErrCircuitOpen
+		}
+
+		err := next(ctx, cmd)
+		h.record(ctx, err)
+		return err
+	}
+}
+
+func (h breakerHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		if !h.breaker.Allow() {
+			for _, cmd := range cmds {
+				cmd.SetErr(breaker.ErrCircuitOpen)
+			}
+			return breaker.ErrCircuitOpen
+		}
+
+		err := next(ctx, cmds)
+		h.record(ctx, err)
+		return err
+	}
+}
+
+func (h breakerHook) record(ctx context.Context, err error) {
+	var reply redis.Error
+	switch {
+	case err == nil || errors.As(err, &reply):
+		h.breaker.Record(true)
+	case errors.Is(ctx.Err(), context.Canceled):
+		// the client went away, Redis may be fine
+		h.breaker.Cancel()
+	default:
+		h.breaker.Record(false)
+	}
+}
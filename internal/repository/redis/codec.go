@@ -0,0 +1,132 @@
+package redis_cache
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	CodecRaw     = "raw"
+	CodecJSON    = "json"
+	CodecMsgpack = "msgpack"
+)
+
+// Version bytes written in front of encoded values. Like the compression
+// markers they are invalid UTF-8 lead bytes, which text never starts with.
+// The raw codec leaves values as they are, readable from redis-cli, unless
+// they start with one of these bytes, a compression marker or a double
+// quote, the start of a legacy JSON value (see Options.LegacyJSON): it then
+// escapes them with versionRaw, which the reads strip again.
+const (
+	versionRaw     byte = 0xfa
+	versionMsgpack byte = 0xfb
+	versionJSON    byte = 0xfc
+)
+
+// reserved reports whether a stored value starting with b would be read as
+// compressed or encoded.
+func reserved(b byte) bool {
+	switch b {
+	case versionRaw, versionMsgpack, versionJSON, markerZstd, markerGzip:
+		return true
+	}
+
+	return false
+}
+
+// Codec turns a cache value into its stored form and back. Reads detect the
+// codec from the version byte, so keys written with different codecs can be
+// mixed in one keyspace; the configured codec only affects writes.
+type Codec interface {
+	Encode(value []byte) ([]byte, error)
+	Decode(data []byte) ([]byte, error)
+}
+
+// RawCodec stores values unchanged, but for the ones starting with a
+// reserved byte or a double quote, see versionRaw. It is the default.
+type RawCodec struct{}
+
+func (RawCodec) Encode(value []byte) ([]byte, error) {
+	if len(value) > 0 && (reserved(value[0]) || value[0] == '"') {
+		return append([]byte{versionRaw}, value...), nil
+	}
+
+	return value, nil
+}
+
+func (RawCodec) Decode(data []byte) ([]byte, error) {
+	if len(data) > 0 && data[0] == versionRaw {
+		return data[1:], nil
+	}
+
+	return data, nil
+}
+
+// JSONCodec stores values as a JSON string, the format used by older releases
+// but with a version byte in front.
+type JSONCodec struct{}
+
+func (JSONCodec) Encode(value []byte) ([]byte, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte{versionJSON}, data...), nil
+}
+
+func (JSONCodec) Decode(data []byte) ([]byte, error) {
+	var value []byte
+	err := json.Unmarshal(data[1:], &value)
+	return value, err
+}
+
+// MsgpackCodec stores values as msgpack binary.
+type MsgpackCodec struct{}
+
+func (MsgpackCodec) Encode(value []byte) ([]byte, error) {
+	data, err := msgpack.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte{versionMsgpack}, data...), nil
+}
+
+func (MsgpackCodec) Decode(data []byte) ([]byte, error) {
+	var value []byte
+	err := msgpack.Unmarshal(data[1:], &value)
+	return value, err
+}
+
+// CodecByName returns the codec registered under name.
+func CodecByName(name string) (Codec, error) {
+	switch name {
+	case CodecRaw, "":
+		return RawCodec{}, nil
+	case CodecJSON:
+		return JSONCodec{}, nil
+	case CodecMsgpack:
+		return MsgpackCodec{}, nil
+	default:
+		return nil, fmt.Errorf("unknown cache codec %q", name)
+	}
+}
+
+// decodeCodec picks the codec from the version byte of data.
+func decodeCodec(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return data, nil
+	}
+
+	switch data[0] {
+	case versionJSON:
+		return JSONCodec{}.Decode(data)
+	case versionMsgpack:
+		return MsgpackCodec{}.Decode(data)
+	default:
+		return RawCodec{}.Decode(data)
+	}
+}
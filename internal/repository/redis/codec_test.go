@@ -0,0 +1,93 @@
+package redis_cache
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	values := [][]byte{
+		{},
+		[]byte("hello"),
+		[]byte(`{"status":"ok"}`),
+		[]byte("<html></html>"),
+		[]byte("12345"),
+		{versionRaw, 'a'},
+		{versionMsgpack, 0xc4, 0x01, 'a'},
+		{versionJSON, '"', 'Y', 'Q', '=', '=', '"'},
+		{markerZstd, 0x28, 0xb5, 0x2f, 0xfd},
+		{markerGzip, 0x1f, 0x8b},
+		{markerGzip},
+		{0xff, 0x00},
+		[]byte(`"YQ=="`),
+		[]byte(`"quoted"`),
+		bytes.Repeat([]byte{markerGzip}, 64),
+	}
+	codecs := map[string]Codec{CodecRaw: RawCodec{}, CodecJSON: JSONCodec{}, CodecMsgpack: MsgpackCodec{}}
+
+	for name, codec := range codecs {
+		for _, compression := range []string{"", CompressionGzip, CompressionZstd} {
+			for _, legacy := range []bool{false, true} {
+				t.Run(fmt.Sprintf("%s %s legacy %v", name, compression, legacy), func(t *testing.T) {
+					cache := &TTLCache{options: Options{Codec: codec, Compression: compression}}
+					if compression != "" {
+						cache.options.CompressThreshold = 1
+					}
+
+					for _, value := range values {
+						stored, err := cache.encode(value)
+						if err != nil {
+							t.Fatalf("encode %x: %v", value, err)
+						}
+						decoded, err := decodeValue(string(stored), legacy)
+						if err != nil {
+							t.Fatalf("decode %x stored as %x: %v", value, stored, err)
+						}
+						if !bytes.Equal(decoded, value) {
+							t.Errorf("%x stored as %x read back as %x", value, stored, decoded)
+						}
+					}
+				})
+			}
+		}
+	}
+}
+
+// TestRawCodecReadable checks raw values without a reserved first byte are
+// stored as they are.
+func TestRawCodecReadable(t *testing.T) {
+	for _, value := range []string{"hello", `{"a":1}`, "<p>é</p>", "42"} {
+		stored, _ := RawCodec{}.Encode([]byte(value))
+		if string(stored) != value {
+			t.Errorf("%q stored as %q", value, stored)
+		}
+	}
+}
+
+func TestLegacyJSON(t *testing.T) {
+	tests := []struct {
+		name   string
+		stored string
+		legacy bool
+		want   string
+	}{
+		{name: "legacy value", stored: `"aGVsbG8="`, legacy: true, want: "hello"},
+		{name: "legacy value, option off", stored: `"aGVsbG8="`, legacy: false, want: `"aGVsbG8="`},
+		{name: "quoted text", stored: `"not base64!"`, legacy: true, want: `"not base64!"`},
+		{name: "escaped raw value", stored: "\xfa\"aGVsbG8=\"", legacy: true, want: `"aGVsbG8="`},
+		{name: "plain value", stored: "hello", legacy: true, want: "hello"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := decodeValue(test.stored, test.legacy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != test.want {
+				t.Errorf("read %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package redis_cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// Compressed values are prefixed with a one-byte marker. Both markers are
+// invalid UTF-8 lead bytes, which the HTML, JSON or numeric values stored
+// uncompressed never start with, and RawCodec escapes the binary values that
+// do, so they are not taken for compressed ones.
+const (
+	markerGzip byte = 0xfe
+	markerZstd byte = 0xfd
+)
+
+var zstdEncoder = sync.OnceValues(func() (*zstd.Encoder, error) {
+	return zstd.NewWriter(nil)
+})
+
+var zstdDecoder = sync.OnceValues(func() (*zstd.Decoder, error) {
+	return zstd.NewReader(nil)
+})
+
+// compress encodes value with the given algorithm and prepends its marker.
+func compress(algorithm string, value []byte) ([]byte, error) {
+	switch algorithm {
+	case CompressionZstd:
+		encoder, err := zstdEncoder()
+		if err != nil {
+			return nil, err
+		}
+		return encoder.EncodeAll(value, []byte{markerZstd}), nil
+	case CompressionGzip, "":
+		var buf bytes.Buffer
+		buf.WriteByte(markerGzip)
+
+		writer := gzip.NewWriter(&buf)
+		if _, err := writer.Write(value); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("unknown compression algorithm %q", algorithm)
+	}
+}
+
+// decompress reverses compress. Values without a marker are returned as is,
+// which keeps entries written before compression was enabled readable; an
+// escaped raw value is left for decodeCodec to unwrap.
+func decompress(value []byte) ([]byte, error) {
+	if len(value) == 0 {
+		return value, nil
+	}
+
+	switch value[0] {
+	case markerZstd:
+		decoder, err := zstdDecoder()
+		if err != nil {
+			return nil, err
+		}
+		return decoder.DecodeAll(value[1:], nil)
+	case markerGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(value[1:]))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return io.ReadAll(reader)
+	default:
+		return value, nil
+	}
+}
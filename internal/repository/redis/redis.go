@@ -3,108 +3,776 @@ package redis_cache
 import (
 	"context"
 	"encoding/json"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jahrulnr/go-waf/internal/interface/repository"
+	"github.com/jahrulnr/go-waf/pkg/breaker"
 	"github.com/jahrulnr/go-waf/pkg/logger"
+	"github.com/jahrulnr/go-waf/pkg/metrics"
 
 	"github.com/redis/go-redis/v9"
 )
 
+// incrementScript adds ARGV[1] to KEYS[1] and only sets the expiry (ARGV[2]
+// milliseconds) when the key has none yet, i.e. when it was just created. An
+// expiry of zero or less keeps the key, as SET does, where PEXPIRE deletes it.
+var incrementScript = redis.NewScript(`
+local value = redis.call("INCRBY", KEYS[1], ARGV[1])
+if tonumber(ARGV[2]) > 0 and redis.call("PTTL", KEYS[1]) == -1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return value
+`)
+
+// compareAndRemoveScript deletes KEYS[1] only when it still holds ARGV[1].
+var compareAndRemoveScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// compareAndExpireScript resets the expiry of KEYS[1] to ARGV[2] milliseconds
+// only when it still holds ARGV[1].
+var compareAndExpireScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// scripts keeps one *redis.Script per source so the SHA1 is only computed once.
+var scripts sync.Map
+
+// DefaultScanCount is the default number of keys requested per SCAN call.
+const DefaultScanCount = 100
+
+// DefaultInvalidationChannel is the pub/sub channel used for invalidations.
+const DefaultInvalidationChannel = "gowaf-invalidation"
+
+// Options tunes the behavior of a TTLCache.
+type Options struct {
+	// ScanCount is the COUNT hint passed to SCAN and the size of each UNLINK
+	// batch in RemoveByPrefix. Defaults to DefaultScanCount.
+	ScanCount int64
+
+	// CompressThreshold enables compression of values larger than this many
+	// bytes. Zero disables compression.
+	CompressThreshold int
+	// Compression is the algorithm used above the threshold, CompressionGzip
+	// (default) or CompressionZstd.
+	Compression string
+
+	// JitterPercent randomizes the TTL given to Set by up to ±JitterPercent
+	// percent so entries written in one burst don't expire together. GetTTL
+	// reports the jittered value. Zero disables jitter.
+	JitterPercent int
+
+	// Metrics receives hit, miss and error events. Defaults to a no-op.
+	Metrics metrics.MetricsRecorder
+
+	// InvalidationChannel is the pub/sub channel PublishInvalidation writes
+	// to. Defaults to DefaultInvalidationChannel.
+	InvalidationChannel string
+
+	// Codec serializes values on write. Defaults to RawCodec.
+	Codec Codec
+
+	// LegacyJSON reads the values of releases storing every value through
+	// json.Marshal, a quoted base64 string, while their keys are still
+	// around. Values written since never start with a quote, so turning it
+	// on doesn't misread them, but raw values of other releases may.
+	LegacyJSON bool
+
+	// Breaker guards the client, failing commands right away while Redis is
+	// unreachable, see NewBreakerHook. Nil leaves it unguarded.
+	Breaker *breaker.Breaker
+
+	// Timeout bounds every command, timeouts count against Breaker, see
+	// NewTimeoutHook. It needs a client built with ContextTimeoutEnabled and
+	// is left out on the others. Defaults to DefaultTimeout, negative leaves
+	// commands unbounded.
+	Timeout time.Duration
+}
+
+// hooks are the breaker and timeout of a client, added once, whatever the
+// number of caches sharing it.
+type hooks struct {
+	breaker *breaker.Breaker
+	timeout time.Duration
+}
+
+// hooked holds the hooks of every client a cache was built on.
+var hooked sync.Map
+
 // TTLCache is a Redis-based cache with time-to-live (TTL) expiration.
+//
+// On Redis Cluster every single-key command is routed by go-redis. Multi-key
+// commands are the exception: keys in one command must hash to the same slot,
+// so RemoveByPrefix scans each master separately and unlinks keys one by one
+// in a pipeline instead of a single multi-key UNLINK. Keys that must be
+// deleted together should share a hash tag, e.g. "{gowaf}-...".
 type TTLCache struct {
-	client *redis.Client
+	client redis.UniversalClient
 	ctx    context.Context
+
+	options Options
+	id      string // tells the invalidations of this cache from the others
+
+	unsubscribe context.CancelFunc // stops the invalidation subscriber, if any
+	subscriber  chan struct{}      // closed once the subscriber returned
 }
 
-// NewCache creates a new TTLCache instance connected to a Redis server.
+// NewCache creates a new TTLCache instance connected to a Redis server. Like
+// the other constructors without Options it leaves commands unbounded, as
+// they were before Options.Timeout.
 func NewCache(ctx context.Context, redisClient *redis.Client) repository.CacheInterface {
+	return NewCacheWithOptions(ctx, redisClient, Options{Timeout: -1})
+}
+
+// NewClusterCache creates a new TTLCache instance backed by a Redis Cluster.
+func NewClusterCache(ctx context.Context, clusterClient *redis.ClusterClient) repository.CacheInterface {
+	return NewCacheWithOptions(ctx, clusterClient, Options{Timeout: -1})
+}
+
+// NewFailoverCache creates a new TTLCache instance talking to the primary
+// elected by Redis Sentinel.
+func NewFailoverCache(ctx context.Context, opts *redis.FailoverOptions) repository.CacheInterface {
+	return NewCacheWithOptions(ctx, redis.NewFailoverClient(opts), Options{Timeout: -1})
+}
+
+// NewCacheWithMetrics creates a new TTLCache instance reporting hits, misses
+// and errors to recorder.
+func NewCacheWithMetrics(ctx context.Context, redisClient redis.UniversalClient, recorder metrics.MetricsRecorder) repository.CacheInterface {
+	return NewCacheWithOptions(ctx, redisClient, Options{Metrics: recorder, Timeout: -1})
+}
+
+// NewCacheWithCodec creates a new TTLCache instance writing values with codec.
+func NewCacheWithCodec(ctx context.Context, redisClient redis.UniversalClient, codec Codec) repository.CacheInterface {
+	return NewCacheWithOptions(ctx, redisClient, Options{Codec: codec, Timeout: -1})
+}
+
+// NewCacheWithInvalidation creates a new TTLCache instance and subscribes to
+// its invalidation channel. Every key or prefix published by another
+// instance is removed from local, typically the in-memory L1 in front of this
+// cache; the ones this instance published are skipped, its own writes keep
+// local up to date. The subscriber stops when ctx is done or the cache is
+// closed.
+func NewCacheWithInvalidation(ctx context.Context, redisClient redis.UniversalClient, options Options, local repository.CacheInterface) repository.CacheInterface {
+	cache := NewCacheWithOptions(ctx, redisClient, options).(*TTLCache)
+
+	ctx, cache.unsubscribe = context.WithCancel(ctx)
+	cache.subscriber = make(chan struct{})
+	pubsub := redisClient.Subscribe(ctx, cache.options.InvalidationChannel)
+	messages := pubsub.Channel()
+	go func() {
+		defer close(cache.subscriber)
+		defer pubsub.Close()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case message, ok := <-messages:
+				if !ok {
+					return
+				}
+				sender, kind, value := parseInvalidation(message.Payload)
+				if sender == cache.id {
+					// the write updated local already
+					continue
+				}
+				logger.Logger("[debug] invalidate local cache ", kind, " ", value).Debug()
+				if kind == invalidateKey {
+					local.Remove(value)
+				} else {
+					local.RemoveByPrefix(value)
+				}
+			}
+		}
+	}()
+
+	return cache
+}
+
+// NewCacheWithOptions creates a new TTLCache instance with the given options.
+// Any go-redis client works: standalone, failover or cluster. The breaker and
+// timeout hooks are added to the client by the first cache built on it, the
+// next ones share them.
+func NewCacheWithOptions(ctx context.Context, redisClient redis.UniversalClient, options Options) repository.CacheInterface {
+	if options.ScanCount <= 0 {
+		options.ScanCount = DefaultScanCount
+	}
+	if options.Metrics == nil {
+		options.Metrics = metrics.NoopRecorder{}
+	}
+	if options.Codec == nil {
+		options.Codec = RawCodec{}
+	}
+	if options.InvalidationChannel == "" {
+		options.InvalidationChannel = DefaultInvalidationChannel
+	}
+	if options.Timeout == 0 {
+		options.Timeout = DefaultTimeout
+	}
+	options.Breaker, options.Timeout = addHooks(redisClient, options.Breaker, options.Timeout)
+
 	return &TTLCache{
-		client: redisClient,
-		ctx:    ctx,
+		client:  redisClient,
+		ctx:     ctx,
+		options: options,
+		id:      strconv.FormatUint(rand.Uint64(), 36),
 	}
 }
 
+// addHooks guards client with guard and timeout, unless a cache did
+// already, and returns the ones in place.
+func addHooks(client redis.UniversalClient, guard *breaker.Breaker, timeout time.Duration) (*breaker.Breaker, time.Duration) {
+	if timeout > 0 && !contextTimeouts(client) {
+		logger.Logger("[warn] redis client built without ContextTimeoutEnabled, commands are not bounded to ", timeout.String()).Warn()
+		timeout = 0
+	}
+
+	wanted := &hooks{breaker: guard, timeout: max(timeout, 0)}
+	current, loaded := hooked.LoadOrStore(client, wanted)
+	if loaded {
+		existing := current.(*hooks)
+		if *existing != *wanted {
+			logger.Logger("[warn] redis client shared by caches with different breakers or timeouts, keeping the first ones").Warn()
+		}
+		return existing.breaker, existing.timeout
+	}
+
+	if guard != nil {
+		client.AddHook(NewBreakerHook(guard))
+	}
+	if wanted.timeout > 0 {
+		client.AddHook(NewTimeoutHook(wanted.timeout))
+	}
+
+	return wanted.breaker, wanted.timeout
+}
+
+// contextTimeouts reports whether client honours the deadlines of contexts,
+// assuming it does for the clients it can't tell.
+func contextTimeouts(client redis.UniversalClient) bool {
+	switch client := client.(type) {
+	case *redis.Client:
+		return client.Options().ContextTimeoutEnabled
+	case *redis.ClusterClient:
+		return client.Options().ContextTimeoutEnabled
+	}
+
+	return true
+}
+
+// Close stops the invalidation subscriber, waits for it and closes the
+// client.
+func (c *TTLCache) Close() error {
+	if c.unsubscribe != nil {
+		c.unsubscribe()
+		<-c.subscriber
+	}
+
+	hooked.Delete(c.client)
+	return c.client.Close()
+}
+
+// Health reports the state of the breaker guarding the client.
+func (c *TTLCache) Health() (repository.CacheHealth, bool) {
+	if c.options.Breaker == nil {
+		return repository.CacheHealth{}, false
+	}
+
+	return repository.CacheHealth{
+		Backend: "redis",
+		State:   string(c.options.Breaker.State()),
+	}, true
+}
+
+// WithContext returns a shallow copy of the cache whose Redis calls use ctx.
+// A nil or background context keeps the context given at construction time.
+func (c *TTLCache) WithContext(ctx context.Context) repository.CacheInterface {
+	if ctx == nil || ctx == context.Background() {
+		return c
+	}
+
+	clone := *c
+	clone.ctx = ctx
+	return &clone
+}
+
+// StateContext is WithContext as a repository.StateStore.
+func (c *TTLCache) StateContext(ctx context.Context) repository.StateStore {
+	return c.WithContext(ctx)
+}
+
 // Set adds a new item to the Redis cache with the specified key, value, and TTL.
-func (c *TTLCache) Set(key string, value []byte, ttl time.Duration) {
-	serializedValue, err := json.Marshal(value)
+// The value is stored as raw bytes so it stays readable from redis-cli.
+func (c *TTLCache) Set(key string, value []byte, ttl time.Duration) error {
+	value, err := c.encode(value)
 	if err != nil {
 		logger.Logger("Error serializing value: ", err).Error()
-		return
+		return err
 	}
 
-	err = c.client.Set(c.ctx, key, serializedValue, ttl).Err()
+	err = c.client.Set(c.ctx, key, value, c.jitter(ttl)).Err()
 	if err != nil {
+		c.options.Metrics.RecordError("set")
 		logger.Logger("Error setting value in Redis: ", err).Error()
 	}
+
+	return err
 }
 
 // Get retrieves the value associated with the given key from the Redis cache.
 func (c *TTLCache) Get(key string) ([]byte, bool) {
 	serializedValue, err := c.client.Get(c.ctx, key).Result()
-	if err == redis.Nil {
-		// Key does not exist
-		return nil, false
-	} else if err != nil {
-		// Other Redis error
-		logger.Logger("Error getting value from Redis: ", err).Error()
-		return nil, false
+	return c.result("get", key, serializedValue, err)
+}
+
+// GetWithTTL is Get which also returns the TTL key has left, zero when it
+// has none, in the same round-trip.
+func (c *TTLCache) GetWithTTL(key string) ([]byte, time.Duration, bool) {
+	var (
+		get  *redis.StringCmd
+		pttl *redis.DurationCmd
+	)
+	c.client.Pipelined(c.ctx, func(pipe redis.Pipeliner) error {
+		get = pipe.Get(c.ctx, key)
+		pttl = pipe.PTTL(c.ctx, key)
+		return nil
+	})
+
+	serializedValue, err := get.Result()
+	value, ok := c.result("get", key, serializedValue, err)
+	if !ok {
+		return nil, 0, false
+	}
+	ttl, ok := remaining(pttl)
+	if !ok {
+		return nil, 0, false
 	}
 
-	var value []byte
-	err = json.Unmarshal([]byte(serializedValue), &value)
-	if err != nil {
-		logger.Logger("Error deserializing value: ", err).Error()
-		return nil, false
+	return value, ttl, true
+}
+
+// remaining reads a PTTL reply, ok is false when the key is gone or the
+// command failed.
+func remaining(pttl *redis.DurationCmd) (time.Duration, bool) {
+	ttl, err := pttl.Result()
+	switch {
+	case err != nil:
+		logger.Logger("Error getting TTL from Redis: ", err).Error()
+		return 0, false
+	case ttl == -2:
+		// expired since the GET
+		return 0, false
+	case ttl < 0:
+		// no expiry
+		return 0, true
 	}
 
-	return value, true
+	return ttl, true
 }
 
 // Pop removes and returns the item with the specified key from the Redis cache.
 func (c *TTLCache) Pop(key string) ([]byte, bool) {
 	serializedValue, err := c.client.GetDel(c.ctx, key).Result()
+	return c.result("pop", key, serializedValue, err)
+}
+
+// result decodes a GET-like reply and records the matching metric.
+func (c *TTLCache) result(op string, key string, serializedValue string, err error) ([]byte, bool) {
 	if err == redis.Nil {
 		// Key does not exist
+		c.options.Metrics.RecordMiss(key)
 		return nil, false
 	} else if err != nil {
 		// Other Redis error
+		c.options.Metrics.RecordError(op)
 		logger.Logger("Error getting value from Redis: ", err).Error()
 		return nil, false
 	}
 
-	var value []byte
-	err = json.Unmarshal([]byte(serializedValue), &value)
+	value, err := decodeValue(serializedValue, c.options.LegacyJSON)
 	if err != nil {
+		c.options.Metrics.RecordError(op)
 		logger.Logger("Error deserializing value: ", err).Error()
 		return nil, false
 	}
 
+	c.options.Metrics.RecordHit(key)
 	return value, true
 }
 
 // Remove removes the item with the specified key from the Redis cache.
-func (c *TTLCache) Remove(key string) {
+func (c *TTLCache) Remove(key string) error {
 	err := c.client.Del(c.ctx, key).Err()
 	if err != nil {
+		c.options.Metrics.RecordError("remove")
 		logger.Logger("Error removing key from Redis: ", err).Error()
 	}
+
+	return err
+}
+
+// RemoveByPrefix removes every key starting with prefix. It walks the keyspace
+// with SCAN and deletes matches in UNLINK batches, so Redis is never blocked
+// the way KEYS would block it.
+//
+// On Redis Cluster SCAN only sees the keys of the node it runs on, so every
+// master is scanned in turn.
+func (c *TTLCache) RemoveByPrefix(prefix string) {
+	c.PurgeByPrefix(prefix)
 }
 
-func (s *TTLCache) RemoveByPrefix(prefix string) {
-	// Use Redis KEYS command to find all keys with the specified prefix
-	keys, err := s.client.Keys(context.Background(), prefix+"*").Result()
+// PurgeByPrefix works like RemoveByPrefix and returns how many keys were
+// unlinked.
+func (c *TTLCache) PurgeByPrefix(prefix string) (int, error) {
+	pattern := escapePattern(prefix) + "*"
+
+	cluster, isCluster := c.client.(*redis.ClusterClient)
+	if !isCluster {
+		return c.removeByPattern(c.ctx, c.client, pattern, false)
+	}
+
+	var removed atomic.Int64
+	err := cluster.ForEachMaster(c.ctx, func(ctx context.Context, master *redis.Client) error {
+		n, err := c.removeByPattern(ctx, master, pattern, true)
+		removed.Add(int64(n))
+		return err
+	})
 	if err != nil {
-		logger.Logger("[warn] Error retrieving keys from Redis: ", err).Warn()
-		return
+		c.options.Metrics.RecordError("remove")
+		logger.Logger("[warn] Error scanning cluster masters: ", err).Warn()
 	}
-	// Delete all matching keys
-	if len(keys) > 0 {
-		_, err = s.client.Del(context.Background(), keys...).Result()
+
+	return int(removed.Load()), err
+}
+
+// removeByPattern scans one node and unlinks every key matching pattern.
+func (c *TTLCache) removeByPattern(ctx context.Context, client redis.Cmdable, pattern string, perKey bool) (int, error) {
+	batch := make([]string, 0, c.options.ScanCount)
+	removed := 0
+
+	var cursor uint64
+	for {
+		keys, next, err := client.Scan(ctx, cursor, pattern, c.options.ScanCount).Result()
 		if err != nil {
-			logger.Logger("[warn] Error deleting keys from Redis: ", err).Warn()
+			logger.Logger("[warn] Error scanning keys from Redis: ", err).Warn()
+			return removed, err
+		}
+
+		for _, key := range keys {
+			batch = append(batch, key)
+			if int64(len(batch)) >= c.options.ScanCount {
+				removed += unlink(ctx, client, batch, perKey)
+				batch = batch[:0]
+			}
+		}
+
+		cursor = next
+		if cursor == 0 {
+			break
 		}
 	}
+
+	if len(batch) > 0 {
+		removed += unlink(ctx, client, batch, perKey)
+	}
+
+	return removed, nil
+}
+
+// KeysByPrefix lists the keys starting with prefix with SCAN, on every master
+// of a cluster.
+func (c *TTLCache) KeysByPrefix(prefix string) ([]string, error) {
+	pattern := escapePattern(prefix) + "*"
+
+	cluster, isCluster := c.client.(*redis.ClusterClient)
+	if !isCluster {
+		return c.scan(c.ctx, c.client, pattern)
+	}
+
+	var mu sync.Mutex
+	var keys []string
+	err := cluster.ForEachMaster(c.ctx, func(ctx context.Context, master *redis.Client) error {
+		found, err := c.scan(ctx, master, pattern)
+		mu.Lock()
+		keys = append(keys, found...)
+		mu.Unlock()
+		return err
+	})
+
+	return keys, err
+}
+
+func (c *TTLCache) scan(ctx context.Context, client redis.Cmdable, pattern string) ([]string, error) {
+	var keys []string
+	var cursor uint64
+	for {
+		found, next, err := client.Scan(ctx, cursor, pattern, c.options.ScanCount).Result()
+		if err != nil {
+			return keys, err
+		}
+		keys = append(keys, found...)
+
+		cursor = next
+		if cursor == 0 {
+			return keys, nil
+		}
+	}
+}
+
+// unlink deletes keys asynchronously on the Redis side and returns how many
+// existed. With perKey every key gets its own UNLINK in a pipeline, which
+// keeps cluster nodes from rejecting the batch with CROSSSLOT.
+func unlink(ctx context.Context, client redis.Cmdable, keys []string, perKey bool) int {
+	var removed int64
+	var err error
+	if perKey {
+		var cmds []redis.Cmder
+		cmds, err = client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, key := range keys {
+				pipe.Unlink(ctx, key)
+			}
+			return nil
+		})
+		for _, cmd := range cmds {
+			if count, ok := cmd.(*redis.IntCmd); ok {
+				removed += count.Val()
+			}
+		}
+	} else {
+		removed, err = client.Unlink(ctx, keys...).Result()
+	}
+
+	if err != nil {
+		logger.Logger("[warn] Error deleting keys from Redis: ", err).Warn()
+	}
+
+	return int(removed)
+}
+
+// Increment atomically adds delta to the counter stored at key and returns the
+// new value. The TTL is only set when the key is newly created.
+func (c *TTLCache) Increment(key string, delta int64, ttl time.Duration) (int64, error) {
+	value, err := incrementScript.Run(c.ctx, c.client, []string{key}, delta, ttl.Milliseconds()).Int64()
+	if err != nil {
+		logger.Logger("Error incrementing key in Redis: ", err).Error()
+		return 0, err
+	}
+
+	return value, nil
+}
+
+// SetNX stores value only if key does not exist yet.
+func (c *TTLCache) SetNX(key string, value []byte, ttl time.Duration) (bool, error) {
+	ok, err := c.client.SetNX(c.ctx, key, value, ttl).Result()
+	if err != nil {
+		logger.Logger("Error setting value in Redis: ", err).Error()
+		return false, err
+	}
+
+	return ok, nil
+}
+
+// CompareAndRemove deletes key only if it still holds value.
+func (c *TTLCache) CompareAndRemove(key string, value []byte) (bool, error) {
+	removed, err := compareAndRemoveScript.Run(c.ctx, c.client, []string{key}, value).Int64()
+	if err != nil {
+		logger.Logger("Error removing key from Redis: ", err).Error()
+		return false, err
+	}
+
+	return removed == 1, nil
+}
+
+// CompareAndExpire resets the TTL of key only if it still holds value.
+func (c *TTLCache) CompareAndExpire(key string, value []byte, ttl time.Duration) (bool, error) {
+	updated, err := compareAndExpireScript.Run(c.ctx, c.client, []string{key}, value, ttl.Milliseconds()).Int64()
+	if err != nil {
+		logger.Logger("Error updating TTL in Redis: ", err).Error()
+		return false, err
+	}
+
+	return updated == 1, nil
+}
+
+// Exists reports whether key is present without transferring its value.
+func (c *TTLCache) Exists(key string) (bool, error) {
+	n, err := c.client.Exists(c.ctx, key).Result()
+	if err != nil {
+		logger.Logger("Error checking key in Redis: ", err).Error()
+		return false, err
+	}
+
+	return n > 0, nil
+}
+
+// Touch resets the TTL of key without rewriting its value.
+func (c *TTLCache) Touch(key string, ttl time.Duration) (bool, error) {
+	ok, err := c.client.PExpire(c.ctx, key, ttl).Result()
+	if err != nil {
+		logger.Logger("Error updating TTL in Redis: ", err).Error()
+		return false, err
+	}
+
+	return ok, nil
+}
+
+// MSet stores several items in one pipelined round-trip. Each item keeps its
+// own TTL, which a plain MSET could not do.
+func (c *TTLCache) MSet(items map[string]repository.CacheItem) error {
+	_, err := c.client.Pipelined(c.ctx, func(pipe redis.Pipeliner) error {
+		for key, item := range items {
+			value, err := c.encode(item.Value)
+			if err != nil {
+				return err
+			}
+			pipe.Set(c.ctx, key, value, c.jitter(item.TTL))
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Logger("Error setting values in Redis: ", err).Error()
+	}
+
+	return err
+}
+
+// MGet fetches several keys in one pipelined round-trip. Pipelined GETs are
+// used instead of MGET so it also works across cluster slots.
+func (c *TTLCache) MGet(keys []string) (map[string][]byte, error) {
+	cmds := make([]*redis.StringCmd, len(keys))
+	_, err := c.client.Pipelined(c.ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			cmds[i] = pipe.Get(c.ctx, key)
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		logger.Logger("Error getting values from Redis: ", err).Error()
+		return nil, err
+	}
+
+	values := make(map[string][]byte, len(keys))
+	for i, cmd := range cmds {
+		serializedValue, err := cmd.Result()
+		if err != nil {
+			continue // redis.Nil, key does not exist
+		}
+
+		value, err := decodeValue(serializedValue, c.options.LegacyJSON)
+		if err != nil {
+			logger.Logger("Error deserializing value: ", err).Error()
+			continue
+		}
+		values[keys[i]] = value
+	}
+
+	return values, nil
+}
+
+// MGetWithTTL is MGet which also returns the TTL every key has left, zero
+// for the ones without, in the same round-trip.
+func (c *TTLCache) MGetWithTTL(keys []string) (map[string]repository.CacheItem, error) {
+	gets := make([]*redis.StringCmd, len(keys))
+	pttls := make([]*redis.DurationCmd, len(keys))
+	_, err := c.client.Pipelined(c.ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			gets[i] = pipe.Get(c.ctx, key)
+			pttls[i] = pipe.PTTL(c.ctx, key)
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		logger.Logger("Error getting values from Redis: ", err).Error()
+		return nil, err
+	}
+
+	items := make(map[string]repository.CacheItem, len(keys))
+	for i, cmd := range gets {
+		serializedValue, err := cmd.Result()
+		if err != nil {
+			continue // redis.Nil, key does not exist
+		}
+
+		value, err := decodeValue(serializedValue, c.options.LegacyJSON)
+		if err != nil {
+			logger.Logger("Error deserializing value: ", err).Error()
+			continue
+		}
+		ttl, ok := remaining(pttls[i])
+		if !ok {
+			continue
+		}
+		items[keys[i]] = repository.CacheItem{Value: value, TTL: ttl}
+	}
+
+	return items, nil
+}
+
+// Invalidations are published as the id of the sending cache, the kind and
+// the key or prefix, separated by NUL bytes. A payload without them is a
+// prefix published by an older release.
+const (
+	invalidateKey    = "key"
+	invalidatePrefix = "prefix"
+)
+
+func parseInvalidation(payload string) (sender string, kind string, value string) {
+	sender, rest, ok := strings.Cut(payload, "\x00")
+	if !ok {
+		return "", invalidatePrefix, payload
+	}
+	kind, value, ok = strings.Cut(rest, "\x00")
+	if !ok || (kind != invalidateKey && kind != invalidatePrefix) {
+		return "", invalidatePrefix, payload
+	}
+
+	return sender, kind, value
+}
+
+// PublishInvalidation asks every other subscribed instance to drop local
+// entries starting with prefix.
+func (c *TTLCache) PublishInvalidation(prefix string) error {
+	return c.publish(invalidatePrefix, prefix)
+}
+
+// PublishKeyInvalidation asks every other subscribed instance to drop its
+// local entry of key, and only that one.
+func (c *TTLCache) PublishKeyInvalidation(key string) error {
+	return c.publish(invalidateKey, key)
+}
+
+func (c *TTLCache) publish(kind string, value string) error {
+	err := c.client.Publish(c.ctx, c.options.InvalidationChannel, c.id+"\x00"+kind+"\x00"+value).Err()
+	if err != nil {
+		c.options.Metrics.RecordError("publish")
+		logger.Logger("Error publishing invalidation to Redis: ", err).Error()
+	}
+
+	return err
+}
+
+// Eval runs a Lua script atomically, using EVALSHA once the script is loaded.
+func (c *TTLCache) Eval(script string, keys []string, args ...interface{}) (interface{}, error) {
+	cached, _ := scripts.LoadOrStore(script, redis.NewScript(script))
+
+	result, err := cached.(*redis.Script).Run(c.ctx, c.client, keys, args...).Result()
+	if err != nil && err != redis.Nil {
+		c.options.Metrics.RecordError("eval")
+		logger.Logger("Error running script in Redis: ", err).Error()
+	}
+
+	return result, err
 }
 
 // GetTTL returns the remaining time before the specified key expires.
@@ -121,3 +789,77 @@ func (c *TTLCache) GetTTL(key string) (time.Duration, bool) {
 
 	return ttl, true
 }
+
+// jitter applies the configured random spread to ttl.
+func (c *TTLCache) jitter(ttl time.Duration) time.Duration {
+	if c.options.JitterPercent <= 0 || ttl <= 0 {
+		return ttl
+	}
+
+	spread := int64(ttl) * int64(c.options.JitterPercent) / 100
+	if spread <= 0 {
+		return ttl
+	}
+
+	jittered := ttl + time.Duration(rand.Int64N(2*spread+1)-spread)
+	if jittered <= 0 {
+		return ttl
+	}
+
+	return jittered
+}
+
+// encode serializes value and compresses it when it is larger than the configured threshold.
+// The configured codec runs first, compression wraps its output.
+func (c *TTLCache) encode(value []byte) ([]byte, error) {
+	value, err := c.options.Codec.Encode(value)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.options.CompressThreshold <= 0 || len(value) <= c.options.CompressThreshold {
+		return value, nil
+	}
+
+	return compress(c.options.Compression, value)
+}
+
+// decodeValue returns the stored bytes of a cache entry, transparently
+// decompressing values written with compression enabled and decoding them
+// with the codec named by their version byte.
+//
+// Migration note: older releases stored values through json.Marshal, which
+// turned the []byte into a quoted base64 string. With legacyJSON, see
+// Options.LegacyJSON, a value that is a JSON string holding valid base64 is
+// decoded the old way. Legacy keys expire with their TTL, after which the
+// option can be turned off again.
+func decodeValue(serializedValue string, legacyJSON bool) ([]byte, error) {
+	if n := len(serializedValue); legacyJSON && n >= 2 && serializedValue[0] == '"' && serializedValue[n-1] == '"' {
+		var value []byte
+		if err := json.Unmarshal([]byte(serializedValue), &value); err == nil {
+			return value, nil
+		}
+	}
+
+	data, err := decompress([]byte(serializedValue))
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeCodec(data)
+}
+
+// escapePattern escapes glob characters so a prefix is matched literally by
+// SCAN MATCH.
+func escapePattern(prefix string) string {
+	var pattern strings.Builder
+	for _, r := range prefix {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			pattern.WriteRune('\\')
+		}
+		pattern.WriteRune(r)
+	}
+
+	return pattern.String()
+}
@@ -0,0 +1,144 @@
+package redis_cache
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jahrulnr/go-waf/internal/interface/repository"
+	"github.com/jahrulnr/go-waf/pkg/breaker"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestParseInvalidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		sender  string
+		kind    string
+		value   string
+	}{
+		{name: "key", payload: "abc\x00key\x00gowaf-page-/a", sender: "abc", kind: invalidateKey, value: "gowaf-page-/a"},
+		{name: "prefix", payload: "abc\x00prefix\x00gowaf-page-", sender: "abc", kind: invalidatePrefix, value: "gowaf-page-"},
+		{name: "empty prefix", payload: "abc\x00prefix\x00", sender: "abc", kind: invalidatePrefix, value: ""},
+		{name: "older release", payload: "gowaf-page-", kind: invalidatePrefix, value: "gowaf-page-"},
+		{name: "unknown kind", payload: "abc\x00other\x00x", kind: invalidatePrefix, value: "abc\x00other\x00x"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sender, kind, value := parseInvalidation(test.payload)
+			if sender != test.sender || kind != test.kind || value != test.value {
+				t.Errorf("parseInvalidation = %q %q %q, want %q %q %q", sender, kind, value, test.sender, test.kind, test.value)
+			}
+		})
+	}
+}
+
+// unreachable returns a client failing every command right away.
+func unreachable(t *testing.T, contextTimeouts bool) *redis.Client {
+	client := redis.NewClient(&redis.Options{
+		Addr:                  "127.0.0.1:1",
+		MaxRetries:            -1,
+		ContextTimeoutEnabled: contextTimeouts,
+	})
+	t.Cleanup(func() {
+		hooked.Delete(client)
+		client.Close()
+	})
+
+	return client
+}
+
+func TestHooksOncePerClient(t *testing.T) {
+	client := unreachable(t, true)
+	options := breaker.Options{MinRequests: 1, FailureRatio: 0.5, OpenTimeout: time.Hour}
+	first, second := breaker.NewBreaker("first", options), breaker.NewBreaker("second", options)
+
+	NewCacheWithOptions(context.Background(), client, Options{Breaker: first})
+	cache := NewCacheWithOptions(context.Background(), client, Options{Breaker: second}).(*TTLCache)
+
+	if cache.options.Breaker != first {
+		t.Fatal("the second cache doesn't report the breaker guarding the client")
+	}
+	cache.Get("key")
+	if first.State() != breaker.StateOpen {
+		t.Errorf("first breaker %s, want open", first.State())
+	}
+	if second.State() != breaker.StateClosed {
+		t.Errorf("second breaker %s, want it never added", second.State())
+	}
+}
+
+func TestTimeoutOptIn(t *testing.T) {
+	tests := []struct {
+		name  string
+		build func(client *redis.Client) repository.CacheInterface
+		want  time.Duration
+	}{
+		{
+			name: "options default",
+			build: func(client *redis.Client) repository.CacheInterface {
+				return NewCacheWithOptions(context.Background(), client, Options{})
+			},
+			want: DefaultTimeout,
+		},
+		{
+			name: "options timeout",
+			build: func(client *redis.Client) repository.CacheInterface {
+				return NewCacheWithOptions(context.Background(), client, Options{Timeout: time.Second})
+			},
+			want: time.Second,
+		},
+		{
+			name: "options unbounded",
+			build: func(client *redis.Client) repository.CacheInterface {
+				return NewCacheWithOptions(context.Background(), client, Options{Timeout: -1})
+			},
+			want: 0,
+		},
+		{
+			name: "legacy constructor",
+			build: func(client *redis.Client) repository.CacheInterface {
+				return NewCache(context.Background(), client)
+			},
+			want: 0,
+		},
+	}
+
+	for _, test := range tests {
+		for _, contextTimeouts := range []bool{true, false} {
+			t.Run(fmt.Sprintf("%s context timeouts %v", test.name, contextTimeouts), func(t *testing.T) {
+				want := test.want
+				if !contextTimeouts {
+					want = 0
+				}
+				cache := test.build(unreachable(t, contextTimeouts)).(*TTLCache)
+				if cache.options.Timeout != want {
+					t.Errorf("timeout %s, want %s", cache.options.Timeout, want)
+				}
+			})
+		}
+	}
+}
+
+// TestIncrementWithoutTTL checks a counter created without a TTL is kept, as
+// a key SET without one is.
+func TestIncrementWithoutTTL(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	cache := NewCacheWithOptions(context.Background(), client, Options{Timeout: -1})
+
+	for want := int64(1); want <= 2; want++ {
+		if n, err := cache.Increment("counter", 1, 0); err != nil || n != want {
+			t.Fatalf("increment %d, %v, want %d", n, err, want)
+		}
+	}
+	if !server.Exists("counter") || server.TTL("counter") != 0 {
+		t.Errorf("counter exists %v with ttl %s, want it kept without expiry", server.Exists("counter"), server.TTL("counter"))
+	}
+}
@@ -0,0 +1,51 @@
+package redis_cache
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultTimeout bounds every command of a TTLCache built by
+// NewCacheWithOptions unless Options.Timeout says otherwise.
+const DefaultTimeout = 50 * time.Millisecond
+
+// timeoutHook gives every command and pipeline of a client its own deadline,
+// so a slow Redis holds a request for timeout at most instead of the read
+// timeout of the client, or forever on a context without one. Added after a
+// breakerHook, the timeouts count against the breaker.
+//
+// The client must be built with ContextTimeoutEnabled, go-redis ignores the
+// deadlines of contexts otherwise.
+type timeoutHook struct {
+	timeout time.Duration
+}
+
+// NewTimeoutHook bounds every command of a client to timeout, add it with
+// AddHook after the breaker hook, if any.
+func NewTimeoutHook(timeout time.Duration) redis.Hook {
+	return timeoutHook{timeout: timeout}
+}
+
+func (h timeoutHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h timeoutHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		ctx, cancel := context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+
+		return next(ctx, cmd)
+	}
+}
+
+func (h timeoutHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		ctx, cancel := context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+
+		return next(ctx, cmds)
+	}
+}
@@ -0,0 +1,369 @@
+package tiered_cache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/jahrulnr/go-waf/internal/interface/repository"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+)
+
+// DefaultL1TTL caps how long an entry lives in the L1 cache.
+const DefaultL1TTL = time.Minute
+
+// TieredCache reads from a fast local L1 first and falls back to a shared L2.
+// Writes go to both. When L2 can publish invalidations, every write and
+// removal is broadcast so other instances drop their L1 copies. An L1 copy
+// never outlives its L2 original.
+//
+// Atomic operations (Increment, SetNX, compare-and-*) and Touch only run on
+// L2, since L1 is local to one instance and can't provide cross-instance
+// atomicity. The L1 copies of the keys they change are dropped everywhere.
+type TieredCache struct {
+	l1 repository.CacheInterface
+	l2 repository.CacheInterface
+
+	l1TTL time.Duration
+}
+
+// NewTieredCache creates a TieredCache with DefaultL1TTL.
+func NewTieredCache(l1 repository.CacheInterface, l2 repository.CacheInterface) repository.CacheInterface {
+	return NewTieredCacheWithL1TTL(l1, l2, DefaultL1TTL)
+}
+
+// NewTieredCacheWithL1TTL creates a TieredCache keeping L1 entries at most
+// l1TTL.
+func NewTieredCacheWithL1TTL(l1 repository.CacheInterface, l2 repository.CacheInterface, l1TTL time.Duration) repository.CacheInterface {
+	if l1TTL <= 0 {
+		l1TTL = DefaultL1TTL
+	}
+
+	return &TieredCache{
+		l1:    l1,
+		l2:    l2,
+		l1TTL: l1TTL,
+	}
+}
+
+// Close closes L2, then L1, the tiers that hold resources.
+func (c *TieredCache) Close() error {
+	var errs []error
+	for _, tier := range []repository.CacheInterface{c.l2, c.l1} {
+		if closer, ok := tier.(io.Closer); ok {
+			errs = append(errs, closer.Close())
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Health reports the health of L2, the remote tier.
+func (c *TieredCache) Health() (repository.CacheHealth, bool) {
+	health, ok := c.l2.(repository.HealthInterface)
+	if !ok {
+		return repository.CacheHealth{}, false
+	}
+
+	return health.Health()
+}
+
+// WithContext binds both tiers to ctx.
+func (c *TieredCache) WithContext(ctx context.Context) repository.CacheInterface {
+	return &TieredCache{
+		l1:    c.l1.WithContext(ctx),
+		l2:    c.l2.WithContext(ctx),
+		l1TTL: c.l1TTL,
+	}
+}
+
+// StateContext is WithContext as a repository.StateStore.
+func (c *TieredCache) StateContext(ctx context.Context) repository.StateStore {
+	return c.WithContext(ctx)
+}
+
+// localTTL shortens ttl to the L1 cap.
+func (c *TieredCache) localTTL(ttl time.Duration) time.Duration {
+	if ttl <= 0 || ttl > c.l1TTL {
+		return c.l1TTL
+	}
+
+	return ttl
+}
+
+// invalidate tells other instances to drop their L1 copy of key.
+func (c *TieredCache) invalidate(key string) {
+	invalidator, ok := c.l2.(repository.InvalidatorInterface)
+	if !ok {
+		return
+	}
+
+	if err := invalidator.PublishKeyInvalidation(key); err != nil {
+		logger.Logger("[warn] fail to publish cache invalidation ", key, err).Warn()
+	}
+}
+
+// invalidatePrefix tells other instances to drop their L1 copies of the keys
+// starting with prefix.
+func (c *TieredCache) invalidatePrefix(prefix string) {
+	invalidator, ok := c.l2.(repository.InvalidatorInterface)
+	if !ok {
+		return
+	}
+
+	if err := invalidator.PublishInvalidation(prefix); err != nil {
+		logger.Logger("[warn] fail to publish cache invalidation ", prefix, err).Warn()
+	}
+}
+
+// remote reads key from L2 with the TTL it has left there. known is false
+// when L2 can't tell, the value is then not copied to L1.
+func (c *TieredCache) remote(key string) (value []byte, ttl time.Duration, known bool, ok bool) {
+	if reader, isReader := c.l2.(repository.TTLReaderInterface); isReader {
+		value, ttl, ok = reader.GetWithTTL(key)
+		return value, ttl, ok, ok
+	}
+
+	value, ok = c.l2.Get(key)
+	if !ok {
+		return nil, 0, false, false
+	}
+	ttl, known = c.l2.GetTTL(key)
+
+	return value, ttl, known && ttl > 0, true
+}
+
+// remoteItems is remote for several keys, leaving out of local the ones L2
+// can't tell the TTL of.
+func (c *TieredCache) remoteItems(keys []string) (values map[string][]byte, local map[string]repository.CacheItem, err error) {
+	if reader, isReader := c.l2.(repository.TTLReaderInterface); isReader {
+		items, err := reader.MGetWithTTL(keys)
+		if err != nil {
+			return nil, nil, err
+		}
+		values = make(map[string][]byte, len(items))
+		local = make(map[string]repository.CacheItem, len(items))
+		for key, item := range items {
+			values[key] = item.Value
+			local[key] = repository.CacheItem{Value: item.Value, TTL: c.localTTL(item.TTL)}
+		}
+		return values, local, nil
+	}
+
+	values, err = c.l2.MGet(keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	local = make(map[string]repository.CacheItem, len(values))
+	for key, value := range values {
+		if ttl, ok := c.l2.GetTTL(key); ok && ttl > 0 {
+			local[key] = repository.CacheItem{Value: value, TTL: c.localTTL(ttl)}
+		}
+	}
+
+	return values, local, nil
+}
+
+// Set writes the item to L2, then to L1 with a capped TTL.
+func (c *TieredCache) Set(key string, value []byte, ttl time.Duration) error {
+	if err := c.l2.Set(key, value, ttl); err != nil {
+		return err
+	}
+
+	c.invalidate(key)
+	return c.l1.Set(key, value, c.localTTL(ttl))
+}
+
+// Get reads L1 first and populates it on an L2 hit, for at most the TTL the
+// key has left in L2.
+func (c *TieredCache) Get(key string) ([]byte, bool) {
+	if value, ok := c.l1.Get(key); ok {
+		return value, true
+	}
+
+	value, ttl, known, ok := c.remote(key)
+	if !ok {
+		return nil, false
+	}
+
+	if known {
+		c.l1.Set(key, value, c.localTTL(ttl))
+	}
+	return value, true
+}
+
+// Pop removes the item from both tiers and returns the L2 value.
+func (c *TieredCache) Pop(key string) ([]byte, bool) {
+	c.l1.Remove(key)
+	value, ok := c.l2.Pop(key)
+	c.invalidate(key)
+
+	return value, ok
+}
+
+// Remove removes the item from both tiers.
+func (c *TieredCache) Remove(key string) error {
+	err := errors.Join(c.l2.Remove(key), c.l1.Remove(key))
+	c.invalidate(key)
+
+	return err
+}
+
+// RemoveByPrefix removes matching items from both tiers.
+func (c *TieredCache) RemoveByPrefix(prefix string) {
+	c.l2.RemoveByPrefix(prefix)
+	c.l1.RemoveByPrefix(prefix)
+	c.invalidatePrefix(prefix)
+}
+
+// PurgeByPrefix removes matching items from both tiers and returns how many
+// L2, the source of truth, held.
+func (c *TieredCache) PurgeByPrefix(prefix string) (int, error) {
+	purger, ok := c.l2.(repository.PurgerInterface)
+	if !ok {
+		c.RemoveByPrefix(prefix)
+		return 0, nil
+	}
+
+	removed, err := purger.PurgeByPrefix(prefix)
+	c.l1.RemoveByPrefix(prefix)
+	c.invalidatePrefix(prefix)
+
+	return removed, err
+}
+
+// KeysByPrefix lists the keys of L2, the source of truth.
+func (c *TieredCache) KeysByPrefix(prefix string) ([]string, error) {
+	lister, ok := c.l2.(repository.KeyListerInterface)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+
+	return lister.KeysByPrefix(prefix)
+}
+
+// GetTTL returns the TTL known by L2, the source of truth.
+func (c *TieredCache) GetTTL(key string) (time.Duration, bool) {
+	return c.l2.GetTTL(key)
+}
+
+func (c *TieredCache) Increment(key string, delta int64, ttl time.Duration) (int64, error) {
+	value, err := c.l2.Increment(key, delta, ttl)
+	if err == nil {
+		c.dropped(key)
+	}
+
+	return value, err
+}
+
+func (c *TieredCache) SetNX(key string, value []byte, ttl time.Duration) (bool, error) {
+	stored, err := c.l2.SetNX(key, value, ttl)
+	if stored {
+		c.dropped(key)
+	}
+
+	return stored, err
+}
+
+func (c *TieredCache) CompareAndRemove(key string, value []byte) (bool, error) {
+	removed, err := c.l2.CompareAndRemove(key, value)
+	if removed {
+		c.dropped(key)
+	}
+
+	return removed, err
+}
+
+func (c *TieredCache) CompareAndExpire(key string, value []byte, ttl time.Duration) (bool, error) {
+	updated, err := c.l2.CompareAndExpire(key, value, ttl)
+	if updated {
+		c.dropped(key)
+	}
+
+	return updated, err
+}
+
+// dropped removes the L1 copies of a key an atomic operation changed in L2,
+// here and on the other instances.
+func (c *TieredCache) dropped(key string) {
+	c.l1.Remove(key)
+	c.invalidate(key)
+}
+
+// Exists checks L1 first, then L2.
+func (c *TieredCache) Exists(key string) (bool, error) {
+	if ok, _ := c.l1.Exists(key); ok {
+		return true, nil
+	}
+
+	return c.l2.Exists(key)
+}
+
+func (c *TieredCache) Touch(key string, ttl time.Duration) (bool, error) {
+	touched, err := c.l2.Touch(key, ttl)
+	if touched {
+		c.dropped(key)
+	}
+
+	return touched, err
+}
+
+// MSet writes the items to L2, then to L1 with capped TTLs.
+func (c *TieredCache) MSet(items map[string]repository.CacheItem) error {
+	if err := c.l2.MSet(items); err != nil {
+		return err
+	}
+
+	local := make(map[string]repository.CacheItem, len(items))
+	for key, item := range items {
+		c.invalidate(key)
+		local[key] = repository.CacheItem{
+			Value: item.Value,
+			TTL:   c.localTTL(item.TTL),
+		}
+	}
+
+	return c.l1.MSet(local)
+}
+
+// MGet serves what it can from L1 and fetches the rest from L2, copying them
+// to L1 like Get does.
+func (c *TieredCache) MGet(keys []string) (map[string][]byte, error) {
+	values, err := c.l1.MGet(keys)
+	if err != nil {
+		values = map[string][]byte{}
+	}
+
+	missing := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if _, ok := values[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) == 0 {
+		return values, nil
+	}
+
+	remote, local, err := c.remoteItems(missing)
+	if err != nil {
+		return nil, err
+	}
+
+	for key, value := range remote {
+		values[key] = value
+	}
+	c.l1.MSet(local)
+
+	return values, nil
+}
+
+// Eval runs the script on L2 when it supports scripting.
+func (c *TieredCache) Eval(script string, keys []string, args ...interface{}) (interface{}, error) {
+	scripter, ok := c.l2.(repository.ScriptInterface)
+	if !ok {
+		return nil, errors.New("l2 cache does not support scripts")
+	}
+
+	return scripter.Eval(script, keys, args...)
+}
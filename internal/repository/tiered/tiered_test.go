@@ -0,0 +1,248 @@
+package tiered_cache_test
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/jahrulnr/go-waf/internal/interface/repository"
+	memory_cache "github.com/jahrulnr/go-waf/internal/repository/memory"
+	tiered_cache "github.com/jahrulnr/go-waf/internal/repository/tiered"
+)
+
+// publisher is an L2 recording the invalidations it is asked to publish.
+type publisher struct {
+	repository.CacheInterface
+	keys     []string
+	prefixes []string
+}
+
+func (p *publisher) PublishKeyInvalidation(key string) error {
+	p.keys = append(p.keys, key)
+	return nil
+}
+
+func (p *publisher) PublishInvalidation(prefix string) error {
+	p.prefixes = append(p.prefixes, prefix)
+	return nil
+}
+
+func TestRefillTTL(t *testing.T) {
+	const ttl = 200 * time.Millisecond
+	tests := []struct {
+		name string
+		read func(cache repository.CacheInterface) bool
+	}{
+		{
+			name: "get",
+			read: func(cache repository.CacheInterface) bool {
+				_, ok := cache.Get("key")
+				return ok
+			},
+		},
+		{
+			name: "mget",
+			read: func(cache repository.CacheInterface) bool {
+				values, err := cache.MGet([]string{"key"})
+				_, ok := values["key"]
+				return err == nil && ok
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l1, l2 := memory_cache.NewCache(), memory_cache.NewCache()
+			cache := tiered_cache.NewTieredCacheWithL1TTL(l1, l2, time.Hour)
+			l2.Set("key", []byte("value"), ttl)
+
+			if !test.read(cache) {
+				t.Fatal("miss on an L2 entry")
+			}
+			if local, ok := l1.GetTTL("key"); !ok || local > ttl {
+				t.Fatalf("L1 copy kept for %s, want at most %s", local, ttl)
+			}
+
+			time.Sleep(ttl + 50*time.Millisecond)
+			if test.read(cache) {
+				t.Error("L1 copy outlived the L2 entry")
+			}
+		})
+	}
+}
+
+func TestRefillTTLCap(t *testing.T) {
+	l1, l2 := memory_cache.NewCache(), memory_cache.NewCache()
+	cache := tiered_cache.NewTieredCacheWithL1TTL(l1, l2, time.Second)
+	l2.Set("key", []byte("value"), time.Hour)
+
+	cache.Get("key")
+	if local, ok := l1.GetTTL("key"); !ok || local > time.Second {
+		t.Errorf("L1 copy kept for %s, want at most the L1 TTL", local)
+	}
+}
+
+func TestInvalidation(t *testing.T) {
+	tests := []struct {
+		name     string
+		write    func(cache repository.CacheInterface)
+		keys     []string
+		prefixes []string
+	}{
+		{name: "set", write: func(cache repository.CacheInterface) { cache.Set("a", []byte("2"), time.Minute) }, keys: []string{"a"}},
+		{name: "remove", write: func(cache repository.CacheInterface) { cache.Remove("a") }, keys: []string{"a"}},
+		{name: "pop", write: func(cache repository.CacheInterface) { cache.Pop("a") }, keys: []string{"a"}},
+		{
+			name: "mset",
+			write: func(cache repository.CacheInterface) {
+				cache.MSet(map[string]repository.CacheItem{"a": {Value: []byte("2"), TTL: time.Minute}})
+			},
+			keys: []string{"a"},
+		},
+		{name: "remove by prefix", write: func(cache repository.CacheInterface) { cache.RemoveByPrefix("a") }, prefixes: []string{"a"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l1 := memory_cache.NewCache()
+			l2 := &publisher{CacheInterface: memory_cache.NewCache()}
+			cache := tiered_cache.NewTieredCache(l1, l2)
+			cache.Set("ab", []byte("1"), time.Minute)
+			l2.keys = nil
+
+			test.write(cache)
+			if !slices.Equal(l2.keys, test.keys) || !slices.Equal(l2.prefixes, test.prefixes) {
+				t.Errorf("published keys %v prefixes %v, want keys %v prefixes %v", l2.keys, l2.prefixes, test.keys, test.prefixes)
+			}
+		})
+	}
+}
+
+func TestSetKeepsLocalCopy(t *testing.T) {
+	l1 := memory_cache.NewCache()
+	cache := tiered_cache.NewTieredCache(l1, &publisher{CacheInterface: memory_cache.NewCache()})
+
+	cache.Set("a", []byte("1"), time.Minute)
+	cache.Set("ab", []byte("1"), time.Minute)
+	cache.Set("a", []byte("2"), time.Minute)
+
+	for _, key := range []string{"a", "ab"} {
+		if _, ok := l1.Get(key); !ok {
+			t.Errorf("L1 lost %s", key)
+		}
+	}
+}
+
+// bus is an L2 shared by several instances, delivering the invalidations one
+// publishes to the L1 of the others, as the Redis channel does.
+type bus struct {
+	repository.CacheInterface
+	locals []repository.CacheInterface
+}
+
+// peer is the L2 of one instance on the bus.
+type peer struct {
+	*bus
+	local repository.CacheInterface
+}
+
+func (p *peer) PublishKeyInvalidation(key string) error {
+	for _, local := range p.locals {
+		if local != p.local {
+			local.Remove(key)
+		}
+	}
+	return nil
+}
+
+func (p *peer) PublishInvalidation(prefix string) error {
+	for _, local := range p.locals {
+		if local != p.local {
+			local.RemoveByPrefix(prefix)
+		}
+	}
+	return nil
+}
+
+// instances returns two tiered caches sharing an L2.
+func instances() (repository.CacheInterface, repository.CacheInterface, repository.CacheInterface) {
+	shared := &bus{CacheInterface: memory_cache.NewCache()}
+	var caches []repository.CacheInterface
+	for range 2 {
+		local := memory_cache.NewCache()
+		shared.locals = append(shared.locals, local)
+		caches = append(caches, tiered_cache.NewTieredCache(local, &peer{bus: shared, local: local}))
+	}
+
+	return caches[0], caches[1], shared.CacheInterface
+}
+
+// TestAtomicInvalidation checks an atomic operation on one instance drops
+// the L1 copy another instance read before.
+func TestAtomicInvalidation(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(first repository.CacheInterface, l2 repository.CacheInterface)
+		want  string // the value the second instance reads, none when empty
+	}{
+		{
+			name: "increment",
+			write: func(first repository.CacheInterface, l2 repository.CacheInterface) {
+				first.Increment("key", 1, time.Minute)
+			},
+			want: "2",
+		},
+		{
+			name: "setnx",
+			write: func(first repository.CacheInterface, l2 repository.CacheInterface) {
+				// gone from L2, e.g. removed by an instance without L1
+				l2.Remove("key")
+				first.SetNX("key", []byte("3"), time.Minute)
+			},
+			want: "3",
+		},
+		{
+			name: "compare and remove",
+			write: func(first repository.CacheInterface, l2 repository.CacheInterface) {
+				first.CompareAndRemove("key", []byte("1"))
+			},
+		},
+		{
+			name: "compare and expire",
+			write: func(first repository.CacheInterface, l2 repository.CacheInterface) {
+				first.CompareAndExpire("key", []byte("1"), time.Millisecond)
+				time.Sleep(5 * time.Millisecond)
+			},
+		},
+		{
+			name: "touch",
+			write: func(first repository.CacheInterface, l2 repository.CacheInterface) {
+				first.Touch("key", time.Millisecond)
+				time.Sleep(5 * time.Millisecond)
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			first, second, l2 := instances()
+			first.Set("key", []byte("1"), time.Minute)
+			for _, cache := range []repository.CacheInterface{first, second} {
+				if _, ok := cache.Get("key"); !ok {
+					t.Fatal("miss before the write")
+				}
+			}
+
+			test.write(first, l2)
+			for name, cache := range map[string]repository.CacheInterface{"first": first, "second": second} {
+				value, ok := cache.Get("key")
+				if test.want == "" && ok {
+					t.Errorf("%s instance read %q, want a miss", name, value)
+				}
+				if test.want != "" && string(value) != test.want {
+					t.Errorf("%s instance read %q, want %q", name, value, test.want)
+				}
+			}
+		})
+	}
+}
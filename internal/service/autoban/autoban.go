@@ -0,0 +1,172 @@
+package service_autoban
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jahrulnr/go-waf/internal/interface/repository"
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+)
+
+// Options configures when and for how long an IP is banned.
+type Options struct {
+	Threshold   int           // violations within Window that ban an IP
+	Window      time.Duration // counting window, starting at the first violation
+	Duration    time.Duration // first ban, doubled on every re-offense
+	MaxDuration time.Duration // cap of the escalation, also how long offenses are remembered
+}
+
+// AutoBan bans IPs that keep tripping the WAF. State lives in the state
+// store, the cache by default, so every instance sharing it enforces the
+// same bans.
+type AutoBan struct {
+	cache    repository.StateStore
+	options  atomic.Pointer[Options]
+	prefix   string
+	failOpen bool
+}
+
+func NewAutoBan(cache repository.StateStore, options Options) *AutoBan {
+	b := &AutoBan{
+		cache:    cache,
+		prefix:   "gowaf-autoban-",
+		failOpen: true,
+	}
+	b.SetOptions(options)
+
+	return b
+}
+
+// SetFailOpen chooses whether no one (true, the default) or everyone is
+// banned while the cache is unreachable.
+func (b *AutoBan) SetFailOpen(failOpen bool) {
+	b.failOpen = failOpen
+}
+
+// SetOptions replaces the thresholds and durations, bans already given keep
+// their duration.
+func (b *AutoBan) SetOptions(options Options) {
+	if options.Threshold <= 0 {
+		options.Threshold = 5
+	}
+	if options.Window <= 0 {
+		options.Window = time.Minute
+	}
+	if options.Duration <= 0 {
+		options.Duration = 10 * time.Minute
+	}
+	if options.MaxDuration < options.Duration {
+		options.MaxDuration = options.Duration
+	}
+	b.options.Store(&options)
+}
+
+// key keeps IPv6 addresses usable as file names for the file driver.
+func (b *AutoBan) key(kind string, ip string) string {
+	return b.prefix + kind + "-" + strings.ReplaceAll(ip, ":", "_")
+}
+
+// Violation counts an offense of ip. Crossing the threshold bans it for
+// Duration, doubled for every earlier ban still remembered.
+func (b *AutoBan) Violation(ip string) (bool, error) {
+	options := b.options.Load()
+	count, err := b.cache.Increment(b.key("violations", ip), 1, options.Window)
+	if err != nil {
+		return false, err
+	}
+	if count < int64(options.Threshold) {
+		return false, nil
+	}
+
+	offenses, err := b.cache.Increment(b.key("offenses", ip), 1, options.MaxDuration)
+	if err != nil {
+		return false, err
+	}
+
+	duration := options.Duration
+	for i := int64(1); i < offenses && duration < options.MaxDuration; i++ {
+		duration *= 2
+	}
+	duration = min(duration, options.MaxDuration)
+
+	// a new ban starts counting from zero
+	b.cache.Remove(b.key("violations", ip))
+	if err := b.Ban(ip, duration); err != nil {
+		return false, err
+	}
+
+	logger.Logger("[warn] auto banned ", ip, " for ", duration.String(), " offense ", strconv.FormatInt(offenses, 10)).Warn()
+	return true, nil
+}
+
+// Banned reports whether ip is banned. An unreachable cache bans no one,
+// unless SetFailOpen turned it off.
+func (b *AutoBan) Banned(ip string) bool {
+	banned, err := b.cache.Exists(b.key("ban", ip))
+	if err != nil {
+		logger.Logger("[warn] fail to check ban ", ip, " fail open: ", b.failOpen, " ", err.Error()).Warn()
+		return !b.failOpen
+	}
+
+	return banned
+}
+
+// Ban blocks ip for duration, replacing any current ban.
+func (b *AutoBan) Ban(ip string, duration time.Duration) error {
+	return b.cache.Set(b.key("ban", ip), []byte(strconv.FormatInt(time.Now().Add(duration).Unix(), 10)), duration)
+}
+
+// Unban lifts the ban of ip and forgets its offenses.
+func (b *AutoBan) Unban(ip string) error {
+	return errors.Join(
+		b.cache.Remove(b.key("ban", ip)),
+		b.cache.Remove(b.key("violations", ip)),
+		b.cache.Remove(b.key("offenses", ip)),
+	)
+}
+
+// Bans lists the IPs banned right now, on every instance sharing the store.
+// It fails with errors.ErrUnsupported when the store can't list its keys.
+func (b *AutoBan) Bans() ([]service.Ban, error) {
+	lister, ok := b.cache.(repository.KeyListerInterface)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+
+	prefix := b.key("ban", "")
+	keys, err := lister.KeysByPrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := b.cache.MGet(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	bans := make([]service.Ban, 0, len(values))
+	for _, key := range keys {
+		value, found := values[key]
+		if !found {
+			continue
+		}
+		until, err := strconv.ParseInt(string(value), 10, 64)
+		if err != nil {
+			continue
+		}
+		bans = append(bans, service.Ban{
+			IP:    strings.ReplaceAll(strings.TrimPrefix(key, prefix), "_", ":"),
+			Until: time.Unix(until, 0),
+		})
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].IP < bans[j].IP
+	})
+
+	return bans, nil
+}
@@ -7,38 +7,68 @@ import (
 	"net/url"
 	"os"
 	"regexp"
+	"strings"
 	"time"
 
-	"github.com/jahrulnr/go-waf/config"
 	"github.com/jahrulnr/go-waf/internal/interface/repository"
 	service "github.com/jahrulnr/go-waf/internal/interface/service"
 	file_cache "github.com/jahrulnr/go-waf/internal/repository/file"
 	memory_cache "github.com/jahrulnr/go-waf/internal/repository/memory"
 	redis_cache "github.com/jahrulnr/go-waf/internal/repository/redis"
+	tiered_cache "github.com/jahrulnr/go-waf/internal/repository/tiered"
+	"github.com/jahrulnr/go-waf/pkg/breaker"
+	"github.com/jahrulnr/go-waf/pkg/config"
+	"github.com/jahrulnr/go-waf/pkg/lock"
 	"github.com/jahrulnr/go-waf/pkg/logger"
+	"github.com/jahrulnr/go-waf/pkg/metrics"
 
 	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/singleflight"
 )
 
+// loadLockTTL bounds how long another instance waits for a GetOrSet loader.
+const loadLockTTL = 10 * time.Second
+
 type CacheService struct {
 	config *config.Config
 	driver repository.CacheInterface
+	locks  repository.StateStore
 	key    string
+
+	loads *singleflight.Group
+}
+
+// NewCacheDriver builds the cache backend selected by CACHE_DRIVER. The same
+// driver is shared by the response cache and, unless STATE_DRIVER is set, by
+// components keeping state in the cache (rate limits, locks).
+func NewCacheDriver(config *config.Config) repository.CacheInterface {
+	return newDriver(config, config.CACHE_DRIVER, "cache")
+}
+
+// NewStateStore builds the backend selected by STATE_DRIVER for the bans,
+// counters, nonces and locks, or returns nil when they stay in the cache
+// driver.
+func NewStateStore(config *config.Config) repository.CacheInterface {
+	if config.STATE_DRIVER == "" {
+		return nil
+	}
+
+	return newDriver(config, config.STATE_DRIVER, "state")
 }
 
-func NewCacheService(config *config.Config) service.CacheInterface {
+// newDriver builds a driver by name. The name of the client sets the
+// directory of the file driver and the name of the Redis breaker.
+func newDriver(config *config.Config, name string, client string) repository.CacheInterface {
 	var driver repository.CacheInterface
-	switch config.CACHE_DRIVER {
+	switch name {
 	case "redis":
-		rds := redis.NewClient(&redis.Options{
-			Addr:     config.REDIS_ADDR,
-			Username: config.REDIS_USER,
-			Password: config.REDIS_PASS,
-			DB:       config.REDIS_DB, // use default DB
-		})
-		driver = redis_cache.NewCache(context.Background(), rds)
+		driver = redis_cache.NewCacheWithOptions(context.Background(), newRedisClient(config), redisOptions(config, client))
+	case "tiered":
+		l1 := memory_cache.NewCacheWithLimit(config.CACHE_MEMORY_MAX_SIZE)
+		l2 := redis_cache.NewCacheWithInvalidation(context.Background(), newRedisClient(config), redisOptions(config, client), l1)
+		driver = tiered_cache.NewTieredCacheWithL1TTL(l1, l2, time.Duration(config.CACHE_L1_TTL)*time.Second)
 	case "file":
-		cachePath := "cache/"
+		cachePath := client + "/"
 		_, err := os.Stat(cachePath)
 		if err != nil {
 			logger.Logger("[debug] Cache path does'nt exists. Create cache path...").Debug()
@@ -55,13 +85,120 @@ func NewCacheService(config *config.Config) service.CacheInterface {
 
 		driver = file_cache.NewFileCache(cachePath)
 	default:
-		driver = memory_cache.NewCache()
+		driver = memory_cache.NewCacheWithLimit(config.CACHE_MEMORY_MAX_SIZE)
 	}
 
+	return driver
+}
+
+func NewCacheService(config *config.Config, driver repository.CacheInterface) service.CacheInterface {
+	return NewCacheServiceWithLocks(config, driver, driver)
+}
+
+// NewCacheServiceWithLocks is like NewCacheService but takes the GetOrSet
+// locks in locks, the state store, instead of the cache driver.
+func NewCacheServiceWithLocks(config *config.Config, driver repository.CacheInterface, locks repository.StateStore) service.CacheInterface {
 	return &CacheService{
 		config: config,
 		driver: driver,
+		locks:  locks,
 		key:    "gowaf-",
+		loads:  &singleflight.Group{},
+	}
+}
+
+func redisOptions(config *config.Config, client string) redis_cache.Options {
+	var recorder metrics.MetricsRecorder
+	if config.ENABLE_METRICS {
+		recorder = metrics.NewPrometheusRecorder(nil)
+	}
+
+	codec, err := redis_cache.CodecByName(config.CACHE_CODEC)
+	if err != nil {
+		logger.Logger("[Fatal] Invalid cache codec.", err.Error()).Fatal()
+	}
+
+	return redis_cache.Options{
+		ScanCount:         config.REDIS_SCAN_COUNT,
+		CompressThreshold: config.CACHE_COMPRESS_THRESHOLD,
+		Compression:       config.CACHE_COMPRESS_ALGORITHM,
+		JitterPercent:     config.CACHE_TTL_JITTER,
+		Metrics:           recorder,
+		Codec:             codec,
+		LegacyJSON:        config.CACHE_LEGACY_JSON,
+		Breaker:           newRedisBreaker(config, client),
+		Timeout:           time.Duration(config.REDIS_TIMEOUT) * time.Millisecond,
+	}
+}
+
+// newRedisBreaker returns the circuit breaker of a Redis client, exposed in
+// the metrics as client, or nil when REDIS_BREAKER is off.
+func newRedisBreaker(config *config.Config, client string) *breaker.Breaker {
+	if !config.REDIS_BREAKER {
+		return nil
+	}
+
+	guard := breaker.NewBreaker("redis "+client, breaker.Options{
+		FailureRatio: config.REDIS_BREAKER_RATIO,
+		MinRequests:  config.REDIS_BREAKER_MIN_REQUESTS,
+		Window:       time.Duration(config.REDIS_BREAKER_WINDOW) * time.Second,
+		OpenTimeout:  time.Duration(config.REDIS_BREAKER_TIMEOUT) * time.Second,
+	})
+	if config.ENABLE_METRICS {
+		metrics.RegisterRedisBreaker(nil, client, func() string {
+			return string(guard.State())
+		})
+	}
+
+	return guard
+}
+
+// newRedisClient builds a standalone, sentinel or cluster client based on
+// REDIS_MODE. REDIS_ADDR accepts a comma separated list for the last two.
+func newRedisClient(config *config.Config) redis.UniversalClient {
+	addrs := strings.Split(config.REDIS_ADDR, ",")
+	for i := range addrs {
+		addrs[i] = strings.TrimSpace(addrs[i])
+	}
+
+	switch strings.ToLower(config.REDIS_MODE) {
+	case "cluster":
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:    addrs,
+			Username: config.REDIS_USER,
+			Password: config.REDIS_PASS,
+
+			ContextTimeoutEnabled: true, // for REDIS_TIMEOUT
+		})
+	case "sentinel":
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    config.REDIS_MASTER_NAME,
+			SentinelAddrs: addrs,
+			Username:      config.REDIS_USER,
+			Password:      config.REDIS_PASS,
+			DB:            config.REDIS_DB,
+
+			ContextTimeoutEnabled: true,
+		})
+	default:
+		return redis.NewClient(&redis.Options{
+			Addr:     addrs[0],
+			Username: config.REDIS_USER,
+			Password: config.REDIS_PASS,
+			DB:       config.REDIS_DB, // use default DB
+
+			ContextTimeoutEnabled: true,
+		})
+	}
+}
+
+func (s *CacheService) WithContext(ctx context.Context) service.CacheInterface {
+	return &CacheService{
+		config: s.config,
+		driver: s.driver.WithContext(ctx),
+		locks:  s.locks.StateContext(ctx),
+		key:    s.key,
+		loads:  s.loads,
 	}
 }
 
@@ -92,9 +229,9 @@ func (s *CacheService) generateKey(key string) string {
 	return newKey
 }
 
-func (s *CacheService) Set(key string, value []byte, duration time.Duration) {
+func (s *CacheService) Set(key string, value []byte, duration time.Duration) error {
 	generatedKey := s.generateKey(key)
-	s.driver.Set(generatedKey, value, duration)
+	return s.driver.Set(generatedKey, value, duration)
 }
 
 func (s *CacheService) Get(key string) ([]byte, bool) {
@@ -107,9 +244,9 @@ func (s *CacheService) Pop(key string) ([]byte, bool) {
 	return s.driver.Pop(generatedKey)
 }
 
-func (s *CacheService) Remove(key string) {
+func (s *CacheService) Remove(key string) error {
 	generatedKey := s.generateKey(key)
-	s.driver.Remove(generatedKey)
+	return s.driver.Remove(generatedKey)
 }
 
 func (s *CacheService) RemoveByPrefix(prefix string) {
@@ -121,3 +258,60 @@ func (s *CacheService) GetTTL(key string) (time.Duration, bool) {
 	generatedKey := s.generateKey(key)
 	return s.driver.GetTTL(generatedKey)
 }
+
+// GetOrSet returns the cached value for key. On a miss only one goroutine per
+// process runs loader (singleflight), and a distributed lock keeps other
+// instances waiting for that result instead of hitting the upstream too.
+func (s *CacheService) GetOrSet(key string, ttl time.Duration, loader func() ([]byte, error)) ([]byte, error) {
+	generatedKey := s.generateKey(key)
+	if value, ok := s.driver.Get(generatedKey); ok {
+		return value, nil
+	}
+
+	value, err, _ := s.loads.Do(generatedKey, func() (interface{}, error) {
+		locker := lock.NewLocker(s.locks)
+		token, locked, err := locker.TryAcquire(generatedKey, loadLockTTL)
+		if err != nil {
+			// the cache is unusable, loading directly is the best we can do
+			logger.Logger("[warn] fail to acquire load lock ", generatedKey, err).Warn()
+		} else if locked {
+			defer locker.Release(generatedKey, token)
+		} else if value, ok := s.waitFor(generatedKey, loadLockTTL); ok {
+			return value, nil
+		}
+
+		// the previous holder may have stored the value meanwhile
+		if value, ok := s.driver.Get(generatedKey); ok {
+			return value, nil
+		}
+
+		value, err := loader()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := s.driver.Set(generatedKey, value, ttl); err != nil {
+			logger.Logger("[warn] fail to store loaded value ", generatedKey, err).Warn()
+		}
+
+		return value, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return value.([]byte), nil
+}
+
+// waitFor polls the cache until another instance stores key or timeout passes.
+func (s *CacheService) waitFor(generatedKey string, timeout time.Duration) ([]byte, bool) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if value, ok := s.driver.Get(generatedKey); ok {
+			return value, true
+		}
+		time.Sleep(lock.RetryInterval)
+	}
+
+	return nil, false
+}
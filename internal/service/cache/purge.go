@@ -0,0 +1,40 @@
+package service_cache
+
+import (
+	"github.com/jahrulnr/go-waf/internal/interface/repository"
+)
+
+// Purge removes key, or every key starting with it when isPrefix is set, and
+// returns how many entries were removed. Drivers without
+// repository.PurgerInterface report 0 for a prefix.
+func Purge(driver repository.CacheInterface, key string, isPrefix bool) (int, error) {
+	if isPrefix {
+		purger, ok := driver.(repository.PurgerInterface)
+		if !ok {
+			driver.RemoveByPrefix(key)
+			return 0, nil
+		}
+
+		return purger.PurgeByPrefix(key)
+	}
+
+	exists, err := driver.Exists(key)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, nil
+	}
+
+	if err := driver.Remove(key); err != nil {
+		return 0, err
+	}
+
+	return 1, nil
+}
+
+// Purge removes the cached response of url, or of every url starting with it
+// when isPrefix is set, and returns how many entries were removed.
+func (s *CacheService) Purge(url string, isPrefix bool) (int, error) {
+	return Purge(s.driver, s.generateKey(url), isPrefix)
+}
@@ -0,0 +1,238 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jahrulnr/go-waf/internal/interface/repository"
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+	"github.com/jahrulnr/go-waf/pkg/audit"
+	"github.com/jahrulnr/go-waf/pkg/clientip"
+	"github.com/jahrulnr/go-waf/pkg/httpcache"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+	"github.com/jahrulnr/go-waf/pkg/maintenance"
+	"github.com/jahrulnr/go-waf/pkg/profile"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Options configures the admin API. Zero values take the defaults noted on
+// each field.
+type Options struct {
+	Addr                string        // listen address, default 127.0.0.1:9090
+	Token               string        // bearer token every request must carry, required
+	BanDuration         time.Duration // of a ban given without one, default 1h
+	MaintenanceDuration time.Duration // of a maintenance turned on without one, default 1h
+	IPv6Prefix          int           // IPv6 addresses are banned and read by their network of this prefix, default 64
+}
+
+// RateLimits is the rate limiter whose state the API reads.
+type RateLimits interface {
+	// State returns the limit of key without counting a request.
+	State(key string) (service.RateLimitResult, error)
+}
+
+// Rules is the WAF the API reloads, all at once or one rule set at a time,
+// and switches between blocking and detection only.
+type Rules interface {
+	ReloadRules() error
+	// RuleSets returns the names of the rule sets each loaded from a file.
+	RuleSets() []string
+	ReloadRuleSet(name string) error
+	DetectionOnly() bool
+	SetDetectionOnly(detectionOnly bool)
+}
+
+// PurgeRequest selects the cache entries to purge, exactly one field must be
+// set, like the cache purge API takes.
+type PurgeRequest struct {
+	Key    string `json:"key"`
+	Prefix string `json:"prefix"`
+	URL    string `json:"url"`
+}
+
+// Purger removes cache entries and returns how many.
+type Purger interface {
+	PurgeCache(ctx context.Context, request PurgeRequest) (int, error)
+}
+
+// Profile is the learned request profile the API exports, replaces after a
+// review and switches between learning and enforcing.
+type Profile interface {
+	Profile(ctx context.Context) (*profile.Profile, error)
+	SetRoutes(ctx context.Context, routes []profile.Route) error
+	SetMode(ctx context.Context, mode string, duration time.Duration) error
+}
+
+// Explainer is the WAF the API runs sample requests through. Explain must
+// not forward r and returns the explanation, encoded as JSON.
+type Explainer interface {
+	Explain(r *http.Request) interface{}
+}
+
+// Warmer is the cache warmer whose last run the API reports.
+type Warmer interface {
+	WarmStatus() httpcache.WarmStatus
+}
+
+// API serves the runtime controls of the WAF as JSON on its own address,
+// apart from the proxied traffic: bans, rate limit state, rules reload,
+// detection only and maintenance mode, cache purges and warming, the cache
+// health, the request profile and the explanation of WAF decisions. Every
+// request needs the bearer token, every change goes to the audit log. A
+// control that isn't set answers 501.
+type API struct {
+	options Options
+	engine  *gin.Engine
+	server  *http.Server
+
+	bans        service.AutoBanInterface
+	rateLimits  RateLimits
+	rules       Rules
+	maintenance *maintenance.Maintenance
+	purger      Purger
+	cache       repository.HealthInterface
+	profile     Profile
+	warmer      Warmer
+	explainer   Explainer
+	audit       *audit.Logger
+}
+
+func NewAPI(options Options) (*API, error) {
+	if options.Token == "" {
+		return nil, errors.New("admin api needs a token")
+	}
+	if options.Addr == "" {
+		options.Addr = "127.0.0.1:9090"
+	}
+	if options.BanDuration <= 0 {
+		options.BanDuration = time.Hour
+	}
+	if options.MaintenanceDuration <= 0 {
+		options.MaintenanceDuration = time.Hour
+	}
+	if options.IPv6Prefix <= 0 {
+		options.IPv6Prefix = clientip.DefaultPrefix
+	}
+
+	a := &API{
+		options: options,
+		engine:  gin.Default(),
+	}
+	a.routes()
+	a.server = &http.Server{
+		Addr:              options.Addr,
+		Handler:           a.engine,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	return a, nil
+}
+
+// SetBans enables the ban endpoints, listing bans needs a
+// service.BanListerInterface too.
+func (a *API) SetBans(bans service.AutoBanInterface) {
+	a.bans = bans
+}
+
+// SetRateLimits enables the rate limit endpoint.
+func (a *API) SetRateLimits(rateLimits RateLimits) {
+	a.rateLimits = rateLimits
+}
+
+// SetRules enables the rules reload and detection only endpoints.
+func (a *API) SetRules(rules Rules) {
+	a.rules = rules
+}
+
+// SetMaintenance enables the maintenance endpoint.
+func (a *API) SetMaintenance(maintenance *maintenance.Maintenance) {
+	a.maintenance = maintenance
+}
+
+// SetPurger enables the cache purge endpoint.
+func (a *API) SetPurger(purger Purger) {
+	a.purger = purger
+}
+
+// SetCacheHealth enables the cache health endpoint.
+func (a *API) SetCacheHealth(cache repository.HealthInterface) {
+	a.cache = cache
+}
+
+// SetProfile enables the request profile endpoints.
+func (a *API) SetProfile(profile Profile) {
+	a.profile = profile
+}
+
+// SetWarmer enables the cache warming endpoint.
+func (a *API) SetWarmer(warmer Warmer) {
+	a.warmer = warmer
+}
+
+// SetExplainer enables the rules explain endpoint.
+func (a *API) SetExplainer(explainer Explainer) {
+	a.explainer = explainer
+}
+
+// SetAudit writes every change made through the API to the audit log.
+func (a *API) SetAudit(audit *audit.Logger) {
+	a.audit = audit
+}
+
+// Handler returns the API routes, for serving them elsewhere than Addr.
+func (a *API) Handler() http.Handler {
+	return a.engine
+}
+
+// Start listens on Addr, failing right away when it can't, and serves in the
+// background.
+func (a *API) Start(ctx context.Context) error {
+	listener, err := net.Listen("tcp", a.options.Addr)
+	if err != nil {
+		return err
+	}
+
+	logger.Logger("[info] admin api listen at ", listener.Addr().String()).Info()
+	go func() {
+		if err := a.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Logger("[error] admin api stopped ", err.Error()).Error()
+		}
+	}()
+
+	return nil
+}
+
+// Shutdown stops the API, waiting for the requests in flight.
+func (a *API) Shutdown(ctx context.Context) error {
+	return a.server.Shutdown(ctx)
+}
+
+func (a *API) authorize(c *gin.Context) {
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.options.Token)) != 1 {
+		logger.FromContext(c.Request.Context()).Logger("[warn] IP ", clientip.FromContext(c), " unauthorized admin api").Warn()
+		c.AbortWithStatusJSON(http.StatusUnauthorized, map[string]interface{}{
+			"status": "Unauthorized",
+		})
+		return
+	}
+
+	c.Next()
+}
+
+// record writes a change to the audit log.
+func (a *API) record(c *gin.Context, action string, target string) {
+	a.audit.Log(c.Request, clientip.FromContext(c), audit.Record{
+		Source: "admin",
+		Action: action,
+		Target: target,
+		Status: http.StatusOK,
+	})
+	logger.FromContext(c.Request.Context()).Logger("[info] admin ", action, " ", target, " by ", clientip.FromContext(c)).Info()
+}
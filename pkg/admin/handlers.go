@@ -0,0 +1,551 @@
+package admin
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+	"github.com/jahrulnr/go-waf/pkg/clientip"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+	"github.com/jahrulnr/go-waf/pkg/profile"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BanRequest bans IP, or a key like sub:alice, for Duration seconds,
+// Options.BanDuration when 0.
+type BanRequest struct {
+	IP       string `json:"ip"`
+	Duration int    `json:"duration"`
+}
+
+// ToggleRequest turns detection only or maintenance on or off. Duration is
+// in seconds and only used by maintenance, Options.MaintenanceDuration when
+// 0.
+type ToggleRequest struct {
+	Enabled  *bool `json:"enabled"`
+	Duration int   `json:"duration"`
+}
+
+// ExplainRequest is a sample request to run through the WAF rules. Path is
+// the request URI, the query included. Host defaults to example.com, and a
+// POST with a Body should set its Content-Type in Headers.
+type ExplainRequest struct {
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Host    string            `json:"host"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+}
+
+// ProfileModeRequest switches the request profile to learning for Duration
+// seconds, 0 learns until the mode is changed again, or to enforcing.
+type ProfileModeRequest struct {
+	Mode     string `json:"mode"`
+	Duration int    `json:"duration"`
+}
+
+func (a *API) routes() {
+	a.engine.HandleMethodNotAllowed = true
+	a.engine.NoRoute(func(c *gin.Context) {
+		respond(c, http.StatusNotFound, "Not Found")
+	})
+	a.engine.NoMethod(func(c *gin.Context) {
+		respond(c, http.StatusMethodNotAllowed, "Method Not Allowed")
+	})
+
+	routes := a.engine.Group("/", a.authorize)
+	routes.GET("/bans", a.listBans)
+	routes.POST("/bans", a.ban)
+	routes.GET("/bans/:ip", a.banStatus)
+	routes.DELETE("/bans/:ip", a.unban)
+	routes.GET("/ratelimit/:key", a.rateLimit)
+	routes.POST("/rules/reload", a.reloadRules)
+	routes.POST("/rules/explain", a.explain)
+	routes.GET("/detection-only", a.detectionOnly)
+	routes.POST("/detection-only", a.setDetectionOnly)
+	routes.GET("/maintenance", a.maintenanceStatus)
+	routes.POST("/maintenance", a.toggleMaintenance)
+	routes.POST("/cache/purge", a.purge)
+	routes.GET("/cache/warm", a.warmStatus)
+	routes.GET("/health/cache", a.cacheHealth)
+	routes.GET("/profile", a.exportProfile)
+	routes.PUT("/profile", a.replaceProfile)
+	routes.POST("/profile/mode", a.setProfileMode)
+}
+
+func respond(c *gin.Context, code int, status string) {
+	c.JSON(code, map[string]interface{}{
+		"status": status,
+	})
+}
+
+func notImplemented(c *gin.Context) {
+	respond(c, http.StatusNotImplemented, "Not Implemented")
+}
+
+func internalError(c *gin.Context, action string, err error) {
+	logger.FromContext(c.Request.Context()).Logger("[error] admin fail to ", action, " ", err.Error()).Error()
+	respond(c, http.StatusInternalServerError, "Internal Server Error")
+}
+
+// listBans lists the current bans, when the cache can enumerate them.
+func (a *API) listBans(c *gin.Context) {
+	lister, ok := a.bans.(service.BanListerInterface)
+	if !ok {
+		notImplemented(c)
+		return
+	}
+
+	bans, err := lister.Bans()
+	if errors.Is(err, errors.ErrUnsupported) {
+		notImplemented(c)
+		return
+	}
+	if err != nil {
+		internalError(c, "list bans", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"status": "OK",
+		"bans":   bans,
+	})
+}
+
+func (a *API) banStatus(c *gin.Context) {
+	if a.bans == nil {
+		notImplemented(c)
+		return
+	}
+	ip, ok := a.banKey(c.Param("ip"))
+	if !ok {
+		respond(c, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"status": "OK",
+		"ip":     ip,
+		"banned": a.bans.Banned(ip),
+	})
+}
+
+func (a *API) ban(c *gin.Context) {
+	if a.bans == nil {
+		notImplemented(c)
+		return
+	}
+	var request BanRequest
+	err := c.ShouldBindJSON(&request)
+	ip, ok := a.banKey(request.IP)
+	if err != nil || !ok || request.Duration < 0 {
+		respond(c, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	duration := time.Duration(request.Duration) * time.Second
+	if duration == 0 {
+		duration = a.options.BanDuration
+	}
+	if err := a.bans.Ban(ip, duration); err != nil {
+		internalError(c, "ban", err)
+		return
+	}
+
+	a.record(c, "ban", ip)
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"status": "OK",
+		"ip":     ip,
+		"until":  time.Now().Add(duration).UTC().Format(time.RFC3339),
+	})
+}
+
+func (a *API) unban(c *gin.Context) {
+	if a.bans == nil {
+		notImplemented(c)
+		return
+	}
+	ip, ok := a.banKey(c.Param("ip"))
+	if !ok {
+		respond(c, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	if err := a.bans.Unban(ip); err != nil {
+		internalError(c, "unban", err)
+		return
+	}
+
+	a.record(c, "unban", ip)
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"status": "OK",
+		"ip":     ip,
+	})
+}
+
+// banKey normalizes the IP or the key a client is banned under, the network
+// of an IPv6 address, or sub:<subject> when AUTOBAN_KEY keys bans by the
+// subject of a token.
+func (a *API) banKey(value string) (string, bool) {
+	if key, ok := clientip.ParseKey(value, a.options.IPv6Prefix); ok {
+		return key, true
+	}
+	if subject, ok := strings.CutPrefix(value, "sub:"); ok && subject != "" {
+		return "sub:" + url.PathEscape(subject), true
+	}
+
+	return "", false
+}
+
+// rateLimit reads the limit of a client IP, without counting a request.
+func (a *API) rateLimit(c *gin.Context) {
+	if a.rateLimits == nil {
+		notImplemented(c)
+		return
+	}
+
+	key := c.Param("key")
+	if ip, ok := clientip.ParseKey(key, a.options.IPv6Prefix); ok {
+		key = ip
+	}
+	result, err := a.rateLimits.State(key)
+	if errors.Is(err, errors.ErrUnsupported) {
+		notImplemented(c)
+		return
+	}
+	if err != nil {
+		internalError(c, "read rate limit", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"status":      "OK",
+		"key":         key,
+		"allowed":     result.Allowed,
+		"limit":       result.Limit,
+		"remaining":   result.Remaining,
+		"reset":       seconds(result.Reset),
+		"retry_after": seconds(result.RetryAfter),
+	})
+}
+
+// reloadRules reloads every rules file, or the one of the set query
+// parameter.
+func (a *API) reloadRules(c *gin.Context) {
+	if a.rules == nil {
+		notImplemented(c)
+		return
+	}
+
+	set := c.Query("set")
+	reload := a.rules.ReloadRules
+	if set != "" {
+		if !slices.Contains(a.rules.RuleSets(), set) {
+			respond(c, http.StatusNotFound, "Not Found")
+			return
+		}
+		reload = func() error {
+			return a.rules.ReloadRuleSet(set)
+		}
+	}
+
+	if err := reload(); err != nil {
+		logger.FromContext(c.Request.Context()).Logger("[error] keep previous rules, reload failed ", err.Error()).Error()
+		c.JSON(http.StatusUnprocessableEntity, map[string]interface{}{
+			"status": "Unprocessable Entity",
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	a.record(c, "reload_rules", set)
+	respond(c, http.StatusOK, "OK")
+}
+
+// explain runs a sample request through the WAF rules, as in detection
+// only: it is never forwarded, banned or written to the audit log.
+func (a *API) explain(c *gin.Context) {
+	if a.explainer == nil {
+		notImplemented(c)
+		return
+	}
+	var request ExplainRequest
+	if err := c.ShouldBindJSON(&request); err != nil || !strings.HasPrefix(request.Path, "/") {
+		respond(c, http.StatusBadRequest, "Bad Request")
+		return
+	}
+	if request.Method == "" {
+		request.Method = http.MethodGet
+	}
+	if request.Host == "" {
+		request.Host = "example.com"
+	}
+
+	sample, err := http.NewRequestWithContext(c.Request.Context(), request.Method, "http://"+request.Host+request.Path, strings.NewReader(request.Body))
+	if err != nil {
+		respond(c, http.StatusBadRequest, "Bad Request")
+		return
+	}
+	if request.Body == "" {
+		sample.Body = http.NoBody
+	}
+	sample.RequestURI = request.Path
+	sample.RemoteAddr = c.Request.RemoteAddr
+	for name, value := range request.Headers {
+		sample.Header.Set(name, value)
+	}
+	if host := sample.Header.Get("Host"); host != "" {
+		sample.Host = host
+		sample.Header.Del("Host")
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"status":      "OK",
+		"explanation": a.explainer.Explain(sample),
+	})
+}
+
+func (a *API) detectionOnly(c *gin.Context) {
+	if a.rules == nil {
+		notImplemented(c)
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"status":         "OK",
+		"detection_only": a.rules.DetectionOnly(),
+	})
+}
+
+// setDetectionOnly switches this instance, until the config file changes
+// or the server restarts.
+func (a *API) setDetectionOnly(c *gin.Context) {
+	if a.rules == nil {
+		notImplemented(c)
+		return
+	}
+	var request ToggleRequest
+	if err := c.ShouldBindJSON(&request); err != nil || request.Enabled == nil {
+		respond(c, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	a.rules.SetDetectionOnly(*request.Enabled)
+	a.record(c, "detection_only", state(*request.Enabled))
+	a.detectionOnly(c)
+}
+
+func (a *API) maintenanceStatus(c *gin.Context) {
+	if a.maintenance == nil {
+		notImplemented(c)
+		return
+	}
+
+	response := map[string]interface{}{
+		"status":      "OK",
+		"maintenance": a.maintenance.Enabled(c.Request.Context()),
+	}
+	if until := a.maintenance.Until(c.Request.Context()); !until.IsZero() {
+		response["until"] = until.UTC().Format(time.RFC3339)
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// toggleMaintenance sets the shared flag, for every instance sharing the
+// cache.
+func (a *API) toggleMaintenance(c *gin.Context) {
+	if a.maintenance == nil {
+		notImplemented(c)
+		return
+	}
+	var request ToggleRequest
+	if err := c.ShouldBindJSON(&request); err != nil || request.Enabled == nil || request.Duration < 0 {
+		respond(c, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	var err error
+	if *request.Enabled {
+		duration := time.Duration(request.Duration) * time.Second
+		if duration == 0 {
+			duration = a.options.MaintenanceDuration
+		}
+		err = a.maintenance.Enable(c.Request.Context(), duration)
+	} else {
+		err = a.maintenance.Disable(c.Request.Context())
+	}
+	if err != nil {
+		internalError(c, "toggle maintenance", err)
+		return
+	}
+
+	a.record(c, "maintenance", state(*request.Enabled))
+	a.maintenanceStatus(c)
+}
+
+func (a *API) purge(c *gin.Context) {
+	if a.purger == nil {
+		notImplemented(c)
+		return
+	}
+	var request PurgeRequest
+	if err := c.ShouldBindJSON(&request); err != nil || !request.valid() {
+		respond(c, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	purged, err := a.purger.PurgeCache(c.Request.Context(), request)
+	if err != nil {
+		logger.FromContext(c.Request.Context()).Logger("[error] admin fail to purge cache ", err.Error()).Error()
+		c.JSON(http.StatusInternalServerError, map[string]interface{}{
+			"status": "Internal Server Error",
+			"purged": purged,
+		})
+		return
+	}
+
+	a.record(c, "purge", request.Key+request.Prefix+request.URL)
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"status": "OK",
+		"purged": purged,
+	})
+}
+
+// cacheHealth reports the state of the circuit breaker guarding the cache,
+// while it is open the cache is skipped and every component applies its
+// fail open policy.
+func (a *API) cacheHealth(c *gin.Context) {
+	if a.cache == nil {
+		notImplemented(c)
+		return
+	}
+	health, ok := a.cache.Health()
+	if !ok {
+		notImplemented(c)
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"status":  "OK",
+		"backend": health.Backend,
+		"state":   health.State,
+		"healthy": health.State == "closed",
+	})
+}
+
+// warmStatus reports the last run of the cache warmer.
+func (a *API) warmStatus(c *gin.Context) {
+	if a.warmer == nil {
+		notImplemented(c)
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"status": "OK",
+		"warm":   a.warmer.WarmStatus(),
+	})
+}
+
+func (a *API) exportProfile(c *gin.Context) {
+	if a.profile == nil {
+		notImplemented(c)
+		return
+	}
+	current, err := a.profile.Profile(c.Request.Context())
+	if err != nil {
+		logger.FromContext(c.Request.Context()).Logger("[error] admin fail to read request profile ", err.Error()).Error()
+		respond(c, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	c.JSON(http.StatusOK, current)
+}
+
+// replaceProfile takes the routes of an exported profile, as reviewed, the
+// mode is left as it is.
+func (a *API) replaceProfile(c *gin.Context) {
+	if a.profile == nil {
+		notImplemented(c)
+		return
+	}
+	var request profile.Profile
+	if err := c.ShouldBindJSON(&request); err != nil {
+		respond(c, http.StatusBadRequest, "Bad Request")
+		return
+	}
+	for _, route := range request.Routes {
+		if route.Method == "" || !strings.HasPrefix(route.Route, "/") {
+			respond(c, http.StatusBadRequest, "Bad Request")
+			return
+		}
+	}
+
+	if err := a.profile.SetRoutes(c.Request.Context(), request.Routes); err != nil {
+		logger.FromContext(c.Request.Context()).Logger("[error] admin fail to replace request profile ", err.Error()).Error()
+		respond(c, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	a.record(c, "replace_profile", strconv.Itoa(len(request.Routes))+" routes")
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"status": "OK",
+		"routes": len(request.Routes),
+	})
+}
+
+func (a *API) setProfileMode(c *gin.Context) {
+	if a.profile == nil {
+		notImplemented(c)
+		return
+	}
+	var request ProfileModeRequest
+	if err := c.ShouldBindJSON(&request); err != nil || request.Duration < 0 ||
+		request.Mode != profile.ModeLearning && request.Mode != profile.ModeEnforcing {
+		respond(c, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	duration := time.Duration(request.Duration) * time.Second
+	if err := a.profile.SetMode(c.Request.Context(), request.Mode, duration); err != nil {
+		logger.FromContext(c.Request.Context()).Logger("[error] admin fail to switch request profile ", err.Error()).Error()
+		respond(c, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	a.record(c, "profile_mode", request.Mode)
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"status": "OK",
+		"mode":   request.Mode,
+	})
+}
+
+func (r PurgeRequest) valid() bool {
+	set := 0
+	for _, value := range []string{r.Key, r.Prefix, r.URL} {
+		if value != "" {
+			set++
+		}
+	}
+
+	return set == 1
+}
+
+// seconds rounds d up, like the rate limit headers.
+func seconds(d time.Duration) int64 {
+	return int64(math.Ceil(max(d, 0).Seconds()))
+}
+
+func state(on bool) string {
+	if on {
+		return "on"
+	}
+
+	return "off"
+}
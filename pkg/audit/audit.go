@@ -0,0 +1,152 @@
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jahrulnr/go-waf/pkg/logger"
+	"github.com/jahrulnr/go-waf/pkg/requestid"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Redacted replaces the values of the redacted headers and params.
+const Redacted = "[REDACTED]"
+
+// Record is one blocked request, or one that would have been in dry run mode.
+type Record struct {
+	Timestamp time.Time           `json:"timestamp"`
+	RequestID string              `json:"request_id,omitempty"`
+	ClientIP  string              `json:"client_ip"`
+	Method    string              `json:"method"`
+	Host      string              `json:"host"`
+	Path      string              `json:"path"`
+	Query     map[string][]string `json:"query,omitempty"`
+	Headers   map[string][]string `json:"headers,omitempty"`
+	Source    string              `json:"source"` // waf, waf_response, ipfilter, autoban, honeypot, geoip, bot, challenge, ratelimit, nonce, graphql, upload, baseline, profile or admin
+	Rules     []string            `json:"rules"`
+	Fields    []string            `json:"fields,omitempty"` // where the rules matched, e.g. header:Referer or query:id
+	Score     int                 `json:"score"`
+	Country   string              `json:"country,omitempty"`
+	Action    string              `json:"action"`
+	Target    string              `json:"target,omitempty"` // what an admin action changed, e.g. the banned IP
+	Status    int                 `json:"status"`
+	DryRun    bool                `json:"dry_run,omitempty"` // the request was forwarded anyway
+}
+
+// Options configures the redaction. Names are matched case insensitively.
+type Options struct {
+	RedactHeaders []string
+	RedactParams  []string
+}
+
+// Logger writes one JSON line per record. It doesn't go through the
+// application logger, so LOG_LEVEL never drops a record. A nil *Logger
+// discards everything, which keeps the callers free of checks.
+type Logger struct {
+	mu      sync.Mutex
+	out     io.Writer
+	headers map[string]bool
+	params  map[string]bool
+}
+
+func NewLogger(out io.Writer, options Options) *Logger {
+	l := &Logger{
+		out:     out,
+		headers: make(map[string]bool, len(options.RedactHeaders)),
+		params:  make(map[string]bool, len(options.RedactParams)),
+	}
+	for _, header := range options.RedactHeaders {
+		l.headers[http.CanonicalHeaderKey(strings.TrimSpace(header))] = true
+	}
+	for _, param := range options.RedactParams {
+		l.params[strings.ToLower(strings.TrimSpace(param))] = true
+	}
+
+	return l
+}
+
+// NewSink opens the audit output: "stdout", or a file rotated once it
+// reaches maxSize megabytes. maxBackups and maxAge (days) bound the rotated
+// files kept, 0 keeps them all.
+func NewSink(target string, maxSize int, maxBackups int, maxAge int) io.Writer {
+	if strings.EqualFold(target, "stdout") {
+		return os.Stdout
+	}
+
+	return &lumberjack.Logger{
+		Filename:   target,
+		MaxSize:    maxSize,
+		MaxBackups: maxBackups,
+		MaxAge:     maxAge,
+	}
+}
+
+// Log fills the request fields of record from r and writes it.
+func (l *Logger) Log(r *http.Request, clientIP string, record Record) {
+	if l == nil {
+		return
+	}
+
+	if record.Timestamp.IsZero() {
+		record.Timestamp = time.Now().UTC()
+	}
+	if record.Action == "" {
+		record.Action = "block"
+	}
+	if record.Rules == nil {
+		record.Rules = []string{}
+	}
+	record.RequestID = requestid.FromRequest(r)
+	record.ClientIP = clientIP
+	record.Method = r.Method
+	record.Host = r.Host
+	record.Path = r.URL.Path
+	record.Query = l.redact(r.URL.Query(), func(name string) bool {
+		return l.params[strings.ToLower(name)]
+	})
+	record.Headers = l.redact(r.Header, func(name string) bool {
+		return l.headers[http.CanonicalHeaderKey(name)]
+	})
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		logger.FromContext(r.Context()).Logger("[warn] fail to encode audit record ", err.Error()).Warn()
+		return
+	}
+	line = append(line, '\n')
+
+	// a single write per record keeps lines whole across goroutines
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.out.Write(line); err != nil {
+		logger.FromContext(r.Context()).Logger("[warn] fail to write audit record ", err.Error()).Warn()
+	}
+}
+
+// redact copies values, masking the entries for which sensitive is true.
+func (l *Logger) redact(values map[string][]string, sensitive func(name string) bool) map[string][]string {
+	if len(values) == 0 {
+		return nil
+	}
+
+	copied := make(map[string][]string, len(values))
+	for name, value := range values {
+		if sensitive(name) {
+			masked := make([]string, len(value))
+			for i := range masked {
+				masked[i] = Redacted
+			}
+			copied[name] = masked
+			continue
+		}
+		copied[name] = value
+	}
+
+	return copied
+}
@@ -0,0 +1,222 @@
+package apikey
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jahrulnr/go-waf/internal/interface/repository"
+	"github.com/jahrulnr/go-waf/pkg/audit"
+	"github.com/jahrulnr/go-waf/pkg/block"
+	"github.com/jahrulnr/go-waf/pkg/clientip"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultHeader carries the key unless Options.Header says otherwise.
+const DefaultHeader = "X-API-Key"
+
+// HeaderPrefix starts the quota headers of the responses, e.g.
+// X-Quota-Day-Remaining.
+const HeaderPrefix = "X-Quota"
+
+type keyKey struct{}
+
+// Options configures the guard. Zero values take the defaults noted on each
+// field.
+type Options struct {
+	Header   string   // carrying the key, default DefaultHeader
+	Paths    []string // path prefixes requiring a key, empty for every path
+	IDHeader string   // request header giving the upstream the id of the key, empty for none
+}
+
+// Guard rejects the requests without a known key with 401 and counts the
+// requests of each key against its daily and monthly quotas, which reset at
+// midnight UTC and on the first of the month. A key over a quota is answered
+// 429 until the quota resets. The counters are kept in the state store, so
+// instances sharing it share the quotas.
+type Guard struct {
+	options  Options
+	keys     Keys
+	store    repository.StateStore
+	failOpen bool
+	audit    *audit.Logger
+}
+
+// NewGuard looks the keys up in keys and counts their requests in store.
+func NewGuard(keys Keys, store repository.StateStore, options Options) *Guard {
+	if options.Header == "" {
+		options.Header = DefaultHeader
+	}
+
+	return &Guard{
+		options:  options,
+		keys:     keys,
+		store:    store,
+		failOpen: true,
+	}
+}
+
+// SetFailOpen chooses whether requests are let through (true, the default)
+// or answered 503 while the store can't count them. A key that can't be
+// looked up is always answered 503.
+func (g *Guard) SetFailOpen(failOpen bool) {
+	g.failOpen = failOpen
+}
+
+// SetAudit writes every rejected request to the audit log.
+func (g *Guard) SetAudit(audit *audit.Logger) {
+	g.audit = audit
+}
+
+func (g *Guard) covers(path string) bool {
+	if len(g.options.Paths) == 0 {
+		return true
+	}
+	for _, prefix := range g.options.Paths {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Middleware rejects requests without a valid key with 401 and over their
+// quota with 429, and tells the remaining quotas in the response headers. The
+// key is put in the request context, see FromContext.
+func (g *Guard) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if g.options.IDHeader != "" {
+			c.Request.Header.Del(g.options.IDHeader)
+		}
+		if !g.covers(c.Request.URL.Path) {
+			c.Next()
+			return
+		}
+
+		secret := strings.TrimSpace(c.GetHeader(g.options.Header))
+		if secret == "" {
+			g.reject(c, http.StatusUnauthorized, "apikey-missing", "")
+			return
+		}
+
+		key, ok, err := g.keys.Lookup(c.Request.Context(), secret)
+		if err != nil {
+			logger.FromContext(c.Request.Context()).Logger("[warn] fail to look up api key ", err.Error()).Warn()
+			g.reject(c, http.StatusServiceUnavailable, "apikey-lookup", "")
+			return
+		}
+		if !ok {
+			g.reject(c, http.StatusUnauthorized, "apikey-unknown", "")
+			return
+		}
+		if key.Revoked {
+			g.reject(c, http.StatusUnauthorized, "apikey-revoked", key.ID)
+			return
+		}
+
+		if !g.count(c, Hash(secret), key) {
+			return
+		}
+
+		if g.options.IDHeader != "" {
+			c.Request.Header.Set(g.options.IDHeader, key.ID)
+		}
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), keyKey{}, key))
+		c.Next()
+	}
+}
+
+// quota is a quota of a key in the current period.
+type quota struct {
+	name    string // Day or Month
+	limit   int64
+	counter string
+	reset   time.Time
+}
+
+func quotas(hash string, key Key, now time.Time) []quota {
+	now = now.UTC()
+	var quotas []quota
+	if key.Daily > 0 {
+		quotas = append(quotas, quota{
+			name:    "Day",
+			limit:   key.Daily,
+			counter: "gowaf-apikey-quota-" + hash[:32] + "-d-" + now.Format("20060102"),
+			reset:   time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC),
+		})
+	}
+	if key.Monthly > 0 {
+		quotas = append(quotas, quota{
+			name:    "Month",
+			limit:   key.Monthly,
+			counter: "gowaf-apikey-quota-" + hash[:32] + "-m-" + now.Format("200601"),
+			reset:   time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC),
+		})
+	}
+
+	return quotas
+}
+
+// count counts the request against the quotas of key, the daily one first so
+// a key over it doesn't use its monthly quota up, and reports whether the
+// request goes on.
+func (g *Guard) count(c *gin.Context, hash string, key Key) bool {
+	now := time.Now()
+	store := g.store.StateContext(c.Request.Context())
+	for _, quota := range quotas(hash, key, now) {
+		until := quota.reset.Sub(now)
+		// each period has its own counter, kept a little past its end
+		count, err := store.Increment(quota.counter, 1, until+time.Minute)
+		if err != nil {
+			logger.FromContext(c.Request.Context()).Logger("[warn] fail to count api key requests ", key.ID, " fail open: ", g.failOpen, " ", err.Error()).Warn()
+			if g.failOpen {
+				continue
+			}
+			g.reject(c, http.StatusServiceUnavailable, "apikey-quota-uncounted", key.ID)
+			return false
+		}
+
+		seconds := strconv.FormatInt(int64((until+time.Second-1)/time.Second), 10)
+		header := c.Writer.Header()
+		header.Set(HeaderPrefix+"-"+quota.name+"-Limit", strconv.FormatInt(quota.limit, 10))
+		header.Set(HeaderPrefix+"-"+quota.name+"-Remaining", strconv.FormatInt(max(quota.limit-count, 0), 10))
+		header.Set(HeaderPrefix+"-"+quota.name+"-Reset", seconds)
+		if count > quota.limit {
+			header.Set("Retry-After", seconds)
+			g.reject(c, http.StatusTooManyRequests, "apikey-quota-"+strings.ToLower(quota.name), key.ID)
+			return false
+		}
+	}
+
+	return true
+}
+
+func (g *Guard) reject(c *gin.Context, status int, rule string, id string) {
+	ip := clientip.FromContext(c)
+	logger.FromContext(c.Request.Context()).Logger("[warn] ", rule, " ", id, " ", ip, " ", c.Request.Method, " ", c.Request.URL.RequestURI()).Warn()
+	record := audit.Record{
+		Source: "apikey",
+		Rules:  []string{rule},
+		Status: status,
+	}
+	g.audit.Log(c.Request, ip, record)
+	if block.Respond(c, block.FromRecord(record)) {
+		return
+	}
+	c.JSON(status, map[string]interface{}{
+		"status": http.StatusText(status),
+	})
+	c.Abort()
+}
+
+// FromContext returns the key of a request the middleware let through, ok is
+// false when it didn't go through it.
+func FromContext(ctx context.Context) (Key, bool) {
+	key, ok := ctx.Value(keyKey{}).(Key)
+	return key, ok
+}
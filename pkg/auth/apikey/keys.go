@@ -0,0 +1,210 @@
+package apikey
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/jahrulnr/go-waf/internal/interface/repository"
+	"github.com/jahrulnr/go-waf/pkg/filewatch"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Key is what is known of an API key, its quotas count requests per UTC day
+// and month, 0 is unlimited.
+type Key struct {
+	ID      string `yaml:"id" json:"id"` // names the key in logs and to the upstream
+	Plan    string `yaml:"plan" json:"plan,omitempty"`
+	Daily   int64  `yaml:"daily" json:"daily,omitempty"`
+	Monthly int64  `yaml:"monthly" json:"monthly,omitempty"`
+	Revoked bool   `yaml:"revoked" json:"revoked,omitempty"`
+}
+
+// Keys looks the API keys up.
+type Keys interface {
+	// Lookup returns the key, ok is false for an unknown key.
+	Lookup(ctx context.Context, key string) (Key, bool, error)
+}
+
+// Hash returns how a key is written in a keys file or a store, the keys
+// themselves are never kept.
+func Hash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Plan holds the quotas of the keys on it.
+type Plan struct {
+	Daily   int64 `yaml:"daily"`
+	Monthly int64 `yaml:"monthly"`
+}
+
+// File is a keys file, see LoadFromYAML.
+type File struct {
+	Plans map[string]Plan `yaml:"plans"`
+	Keys  []entry         `yaml:"keys"`
+
+	byHash map[string]Key
+}
+
+type entry struct {
+	Hash string `yaml:"hash"`
+	Key  `yaml:",inline"`
+}
+
+// LoadFromYAML reads keys like
+//
+//	plans:
+//	  free:
+//	    daily: 1000
+//	    monthly: 20000
+//	keys:
+//	  - id: acme
+//	    hash: 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08 # Hash of the key
+//	    plan: free
+//	    daily: 5000 # overrides the plan
+//	  - id: former-partner
+//	    hash: 60303ae22b998861bce3b28f33eec1be758a213c86c93c076dbe9f558c11c752
+//	    revoked: true
+//
+// A quota a key leaves at 0 is its plan's.
+func LoadFromYAML(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file := &File{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(file); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	file.byHash = make(map[string]Key, len(file.Keys))
+	for i, entry := range file.Keys {
+		hash := strings.ToLower(entry.Hash)
+		if len(hash) != sha256.Size*2 {
+			return nil, fmt.Errorf("load %s: key %d needs the sha256 hash of the key", path, i+1)
+		}
+		if _, ok := file.byHash[hash]; ok {
+			return nil, fmt.Errorf("load %s: key %d is listed twice", path, i+1)
+		}
+		key := entry.Key
+		if key.Plan != "" {
+			plan, ok := file.Plans[key.Plan]
+			if !ok {
+				return nil, fmt.Errorf("load %s: key %d has unknown plan %q", path, i+1, key.Plan)
+			}
+			if key.Daily == 0 {
+				key.Daily = plan.Daily
+			}
+			if key.Monthly == 0 {
+				key.Monthly = plan.Monthly
+			}
+		}
+		if key.ID == "" {
+			key.ID = hash[:12]
+		}
+		file.byHash[hash] = key
+	}
+
+	return file, nil
+}
+
+func (f *File) Lookup(ctx context.Context, key string) (Key, bool, error) {
+	found, ok := f.byHash[Hash(key)]
+	return found, ok, nil
+}
+
+// Watcher keeps the keys loaded from a file up to date, a revoked key is
+// refused as soon as the file is saved.
+type Watcher struct {
+	path    string
+	current atomic.Pointer[File]
+	watcher *filewatch.Watcher
+}
+
+// NewWatcher loads path and reloads it whenever it changes. The initial load
+// must succeed, later invalid versions are logged and ignored.
+func NewWatcher(path string) (*Watcher, error) {
+	file, err := LoadFromYAML(path)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Watcher{path: filepath.Clean(path)}
+	w.current.Store(file)
+
+	w.watcher, err = filewatch.New(path, w.reload)
+	if err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *Watcher) Lookup(ctx context.Context, key string) (Key, bool, error) {
+	return w.current.Load().Lookup(ctx, key)
+}
+
+func (w *Watcher) Close() error {
+	return w.watcher.Close()
+}
+
+func (w *Watcher) reload() {
+	file, err := LoadFromYAML(w.path)
+	if err != nil {
+		logger.Logger("[error] keep previous api keys, reload failed ", err.Error()).Error()
+		return
+	}
+
+	w.current.Store(file)
+	logger.Logger("[info] reloaded api keys from ", w.path).Info()
+}
+
+// StoreKeys looks the keys up in a state store, shared by every instance,
+// for keys issued by another system. Each key is a JSON Key under
+// gowaf-apikey-<Hash of the key>, removing it or setting revoked refuses the
+// key right away.
+type StoreKeys struct {
+	store repository.StateStore
+}
+
+func NewStoreKeys(store repository.StateStore) *StoreKeys {
+	return &StoreKeys{store: store}
+}
+
+func (s *StoreKeys) Lookup(ctx context.Context, key string) (Key, bool, error) {
+	hash := Hash(key)
+	stored := s.store.StateContext(ctx)
+	value, ok := stored.Get("gowaf-apikey-" + hash)
+	if !ok {
+		// an unreachable store reads as a missing key, tell them apart
+		if _, err := stored.Exists("gowaf-apikey-" + hash); err != nil {
+			return Key{}, false, err
+		}
+		return Key{}, false, nil
+	}
+
+	var found Key
+	if err := json.Unmarshal(value, &found); err != nil {
+		return Key{}, false, fmt.Errorf("api key %s: %w", hash[:12], err)
+	}
+	if found.ID == "" {
+		found.ID = hash[:12]
+	}
+
+	return found, true, nil
+}
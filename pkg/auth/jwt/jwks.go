@@ -0,0 +1,173 @@
+package jwt
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/jahrulnr/go-waf/pkg/logger"
+)
+
+// maxJWKSSize bounds the key set read from the JWKS endpoint.
+const maxJWKSSize = 1 << 20
+
+// refreshInterval is the least time between two fetches forced by an
+// unknown kid, so tokens with made up kids can't hammer the endpoint.
+const refreshInterval = 30 * time.Second
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// jwksKey is the cache key of the key set, shared by every instance.
+func (v *Validator) jwksKey() string {
+	sum := md5.Sum([]byte(v.options.JWKSURL))
+	return "gowaf-jwks-" + hex.EncodeToString(sum[:])
+}
+
+// publicKey returns the RSA key named kid, an empty kid matches a key set
+// holding a single key. An unknown kid refetches the key set, which is how
+// rotated keys are picked up before the cached set expires.
+func (v *Validator) publicKey(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	keys, err := v.keySet(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	if key, ok := pick(keys, kid); ok {
+		return key, nil
+	}
+
+	keys, err = v.keySet(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	if key, ok := pick(keys, kid); ok {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("unknown key id %q", kid)
+}
+
+func pick(keys map[string]*rsa.PublicKey, kid string) (*rsa.PublicKey, bool) {
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key, true
+		}
+	}
+
+	key, ok := keys[kid]
+	return key, ok
+}
+
+// keySet returns the cached key set, fetching it when it expired or when
+// refresh is set and no other request refreshed it lately.
+func (v *Validator) keySet(ctx context.Context, refresh bool) (map[string]*rsa.PublicKey, error) {
+	cache := v.store.StateContext(ctx)
+	key := v.jwksKey()
+
+	raw, ok := cache.Get(key)
+	if refresh {
+		allowed, err := cache.SetNX(key+"-refresh", []byte("1"), refreshInterval)
+		if err != nil {
+			logger.Logger("[warn] fail to throttle jwks refresh ", err.Error()).Warn()
+		}
+		ok = ok && !allowed
+	}
+
+	if !ok {
+		fetched, err := v.fetch(ctx)
+		if err != nil {
+			if raw == nil {
+				return nil, err
+			}
+			// keep validating with the keys we have
+			logger.Logger("[warn] fail to refresh jwks ", err.Error()).Warn()
+		} else {
+			raw = fetched
+			if err := cache.Set(key, raw, v.options.JWKSTTL); err != nil {
+				logger.Logger("[warn] fail to cache jwks ", err.Error()).Warn()
+			}
+		}
+	}
+
+	return v.parse(raw)
+}
+
+// parse decodes raw, reusing the previous result while the set is unchanged.
+func (v *Validator) parse(raw []byte) (map[string]*rsa.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.keys != nil && bytes.Equal(raw, v.raw) {
+		return v.keys, nil
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(raw, &set); err != nil {
+		return nil, fmt.Errorf("invalid jwks: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(set.Keys))
+	for _, key := range set.Keys {
+		if key.Kty != "RSA" || key.Use == "enc" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(key.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(key.E)
+		if err != nil || len(e) > 4 {
+			continue
+		}
+		keys[key.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	v.raw, v.keys = raw, keys
+	return keys, nil
+}
+
+func (v *Validator) fetch(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.options.JWKSURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := v.options.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("jwks endpoint answered %d", resp.StatusCode)
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxJWKSSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) > maxJWKSSize {
+		return nil, errors.New("jwks too large")
+	}
+
+	return raw, nil
+}
@@ -0,0 +1,168 @@
+package jwt
+
+import (
+	"context"
+	"crypto/rsa"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jahrulnr/go-waf/internal/interface/repository"
+	"github.com/jahrulnr/go-waf/pkg/block"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+	gojwt "github.com/golang-jwt/jwt/v5"
+)
+
+// ClaimsKey is the gin context key holding the selected claims.
+const ClaimsKey = "jwt.claims"
+
+type claimsKey struct{}
+
+type subjectKey struct{}
+
+// Options configures the validation. At least one of Secret and JWKSURL must
+// be set, only the algorithms of the configured keys are accepted.
+type Options struct {
+	Secret   []byte        // HS256 key
+	JWKSURL  string        // RS256 keys, selected by the kid header
+	JWKSTTL  time.Duration // how long a fetched key set is cached, default 1h
+	Issuer   string        // required iss, empty skips the check
+	Audience string        // required aud, empty skips the check
+	Leeway   time.Duration // clock skew allowed on exp and nbf
+	Claims   []string      // claims put in the context for later handlers
+	Client   *http.Client  // fetches the JWKS, default with a 10s timeout
+}
+
+// Validator checks bearer tokens. Fetched key sets are kept in the state
+// store, so instances sharing one share them too.
+type Validator struct {
+	options Options
+	store   repository.StateStore
+	parser  *gojwt.Parser
+
+	mu   sync.Mutex
+	raw  []byte
+	keys map[string]*rsa.PublicKey
+}
+
+func NewValidator(store repository.StateStore, options Options) *Validator {
+	if options.JWKSTTL <= 0 {
+		options.JWKSTTL = time.Hour
+	}
+	if options.Client == nil {
+		options.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	var methods []string
+	if len(options.Secret) > 0 {
+		methods = append(methods, gojwt.SigningMethodHS256.Alg())
+	}
+	if options.JWKSURL != "" {
+		methods = append(methods, gojwt.SigningMethodRS256.Alg())
+	}
+
+	parserOptions := []gojwt.ParserOption{
+		gojwt.WithValidMethods(methods),
+		gojwt.WithExpirationRequired(),
+		gojwt.WithLeeway(options.Leeway),
+	}
+	if options.Issuer != "" {
+		parserOptions = append(parserOptions, gojwt.WithIssuer(options.Issuer))
+	}
+	if options.Audience != "" {
+		parserOptions = append(parserOptions, gojwt.WithAudience(options.Audience))
+	}
+
+	return &Validator{
+		options: options,
+		store:   store,
+		parser:  gojwt.NewParser(parserOptions...),
+	}
+}
+
+// Validate checks the signature, expiry, issuer and audience of token and
+// returns its claims.
+func (v *Validator) Validate(ctx context.Context, token string) (map[string]interface{}, error) {
+	claims := gojwt.MapClaims{}
+	_, err := v.parser.ParseWithClaims(token, claims, func(token *gojwt.Token) (interface{}, error) {
+		switch token.Method.Alg() {
+		case gojwt.SigningMethodHS256.Alg():
+			return v.options.Secret, nil
+		case gojwt.SigningMethodRS256.Alg():
+			kid, _ := token.Header["kid"].(string)
+			return v.publicKey(ctx, kid)
+		default:
+			return nil, gojwt.ErrTokenSignatureInvalid
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// Middleware rejects requests without a valid bearer token with 401. The
+// claims listed in Options.Claims are put in the gin context under ClaimsKey
+// and in the request context, see FromContext, the sub claim always is, see
+// Subject.
+func (v *Validator) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !found || strings.TrimSpace(token) == "" {
+			c.Header("WWW-Authenticate", "Bearer")
+			unauthorized(c)
+			return
+		}
+
+		claims, err := v.Validate(c.Request.Context(), strings.TrimSpace(token))
+		if err != nil {
+			logger.FromContext(c.Request.Context()).Logger("[debug] invalid jwt ", err.Error()).Debug()
+			c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+			unauthorized(c)
+			return
+		}
+
+		selected := make(map[string]interface{}, len(v.options.Claims))
+		for _, name := range v.options.Claims {
+			if value, ok := claims[name]; ok {
+				selected[name] = value
+			}
+		}
+		c.Set(ClaimsKey, selected)
+		ctx := context.WithValue(c.Request.Context(), claimsKey{}, selected)
+		if subject, ok := claims["sub"].(string); ok && subject != "" {
+			ctx = context.WithValue(ctx, subjectKey{}, subject)
+		}
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+	}
+}
+
+// FromContext returns the claims selected by the middleware, nil when the
+// request didn't go through it.
+func FromContext(ctx context.Context) map[string]interface{} {
+	claims, _ := ctx.Value(claimsKey{}).(map[string]interface{})
+	return claims
+}
+
+// Subject returns the sub claim of a valid token, ok is false when the
+// request didn't go through the middleware or its token has none.
+func Subject(ctx context.Context) (string, bool) {
+	subject, ok := ctx.Value(subjectKey{}).(string)
+	return subject, ok
+}
+
+func unauthorized(c *gin.Context) {
+	if block.Respond(c, block.Decision{Component: "jwt", Status: http.StatusUnauthorized}) {
+		return
+	}
+	c.JSON(http.StatusUnauthorized, map[string]interface{}{
+		"status": "Unauthorized",
+	})
+	c.Abort()
+}
@@ -0,0 +1,183 @@
+package mtls
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/jahrulnr/go-waf/pkg/block"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SubjectKey is the gin context key holding the verified certificate subject.
+const SubjectKey = "mtls.subject"
+
+type certificateKey struct{}
+
+// RevocationChecker is asked about every certificate that passed the other
+// checks, e.g. against a CRL or an OCSP responder. chain starts with the
+// client certificate and ends with the CA. An error rejects the request.
+type RevocationChecker interface {
+	Check(ctx context.Context, chain []*x509.Certificate) error
+}
+
+// Options configures the verification. CAs is required.
+type Options struct {
+	CAs          *x509.CertPool    // CAs the client certificates must chain to
+	AllowedNames []string          // accepted CN, DNS, email or URI SAN, empty accepts any certificate of CAs
+	Paths        []string          // path prefixes requiring a certificate, empty requires it everywhere
+	Header       string            // forwards the subject upstream, empty doesn't
+	Revocation   RevocationChecker // optional, see RevocationChecker
+}
+
+// Verifier requires a client certificate signed by one of the CAs. The TLS
+// listener only asks for it, see server.Options.ClientCerts, so a missing or
+// bad certificate gets a 403 rather than a failed handshake.
+type Verifier struct {
+	options Options
+	allowed map[string]bool
+}
+
+func NewVerifier(options Options) *Verifier {
+	allowed := make(map[string]bool, len(options.AllowedNames))
+	for _, name := range options.AllowedNames {
+		if name = strings.TrimSpace(name); name != "" {
+			allowed[strings.ToLower(name)] = true
+		}
+	}
+
+	return &Verifier{
+		options: options,
+		allowed: allowed,
+	}
+}
+
+// LoadCAs reads a PEM file of one or more CA certificates.
+func LoadCAs(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate found in %q", path)
+	}
+
+	return pool, nil
+}
+
+// Verify checks the chain, validity period and key usage of the client
+// certificate of r, then the allowed names and revocation, and returns it.
+func (v *Verifier) Verify(r *http.Request) (*x509.Certificate, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil, errors.New("no client certificate")
+	}
+
+	cert := r.TLS.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, intermediate := range r.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(intermediate)
+	}
+	chains, err := cert.Verify(x509.VerifyOptions{
+		Roots:         v.options.CAs,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(v.allowed) > 0 && !v.allowedName(cert) {
+		return nil, fmt.Errorf("certificate %q is not allowed", cert.Subject.String())
+	}
+
+	if v.options.Revocation != nil {
+		if err := v.options.Revocation.Check(r.Context(), chains[0]); err != nil {
+			return nil, err
+		}
+	}
+
+	return cert, nil
+}
+
+func (v *Verifier) allowedName(cert *x509.Certificate) bool {
+	names := []string{cert.Subject.CommonName}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+
+	for _, name := range names {
+		if v.allowed[strings.ToLower(name)] {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (v *Verifier) required(path string) bool {
+	if len(v.options.Paths) == 0 {
+		return true
+	}
+	for _, prefix := range v.options.Paths {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Middleware rejects requests to the covered paths without a valid client
+// certificate with 403. The subject is put in the gin context under
+// SubjectKey, the certificate in the request context, see FromContext. The
+// Header sent by the client is always dropped, so it can't be forged.
+func (v *Verifier) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if v.options.Header != "" {
+			c.Request.Header.Del(v.options.Header)
+		}
+		if !v.required(c.Request.URL.Path) {
+			c.Next()
+			return
+		}
+
+		cert, err := v.Verify(c.Request)
+		if err != nil {
+			logger.FromContext(c.Request.Context()).Logger("[debug] client certificate rejected ", err.Error()).Debug()
+			if block.Respond(c, block.Decision{Component: "mtls", Status: http.StatusForbidden}) {
+				return
+			}
+			c.JSON(http.StatusForbidden, map[string]interface{}{
+				"status": "Forbidden",
+			})
+			c.Abort()
+			return
+		}
+
+		subject := cert.Subject.String()
+		c.Set(SubjectKey, subject)
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), certificateKey{}, cert))
+		if v.options.Header != "" {
+			c.Request.Header.Set(v.options.Header, subject)
+		}
+
+		c.Next()
+	}
+}
+
+// FromContext returns the client certificate verified by the middleware, nil
+// when the request didn't go through it.
+func FromContext(ctx context.Context) *x509.Certificate {
+	cert, _ := ctx.Value(certificateKey{}).(*x509.Certificate)
+	return cert
+}
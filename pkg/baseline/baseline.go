@@ -0,0 +1,374 @@
+package baseline
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jahrulnr/go-waf/internal/interface/repository"
+	"github.com/jahrulnr/go-waf/pkg/audit"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+	"github.com/jahrulnr/go-waf/pkg/metrics"
+)
+
+// Metrics sampled per route.
+const (
+	MetricLatency      = "latency"       // milliseconds
+	MetricRequestSize  = "request_size"  // bytes
+	MetricResponseSize = "response_size" // bytes
+)
+
+// OtherRoute collects the routes past Options.MaxRoutes.
+const OtherRoute = "*"
+
+var (
+	metricNames = [...]string{MetricLatency, MetricRequestSize, MetricResponseSize}
+	// latencies are counted in microseconds and reported in milliseconds
+	metricScales = [...]float64{1000, 1, 1}
+)
+
+// Options configures the sampler. Zero values take the defaults noted on
+// each field.
+type Options struct {
+	Window     time.Duration // length of a window, default 5m
+	Windows    int           // complete windows a baseline spans, default 12
+	Flush      time.Duration // how often the local counts go to the cache, default 10s
+	MaxRoutes  int           // routes sampled apart, the rest fall under OtherRoute, default 1000
+	MinSamples int64         // samples a baseline needs before it flags outliers, default 100
+	Factor     float64       // how many times its p95 a value takes to be an outlier, default 3
+}
+
+// Sample is what one request to a route took.
+type Sample struct {
+	Latency      time.Duration
+	RequestSize  int64
+	ResponseSize int64
+}
+
+func (s Sample) values() [len(metricNames)]int64 {
+	return [...]int64{s.Latency.Microseconds(), s.RequestSize, s.ResponseSize}
+}
+
+// Baseline is the normal of a route over the last complete windows, every
+// instance sharing the cache included.
+type Baseline struct {
+	Route   string           `json:"route"`
+	From    time.Time        `json:"from"`
+	To      time.Time        `json:"to"`
+	Metrics map[string]Stats `json:"metrics"`
+}
+
+type histograms [len(metricNames)]histogram
+
+// route is what the sampler keeps of a route between flushes.
+type route struct {
+	baseline   *Baseline
+	window     int64 // the baseline was loaded for
+	seen       int64 // window the route was last sampled in
+	refreshing bool
+}
+
+// Sampler keeps rolling statistics of the latency and body sizes per route,
+// to tell when an endpoint suddenly answers far larger or slower than it
+// used to, like a data exfiltration or an error flood. Samples are counted
+// locally in fixed size histograms and added to the cache every Flush, per
+// window, so the baselines cover every instance sharing it. A route's
+// baseline is loaded once per window, in the background.
+type Sampler struct {
+	options Options
+	cache   repository.StateStore
+
+	mu      sync.Mutex
+	pending map[string]*histograms // since the last flush
+	routes  map[string]*route      // at most MaxRoutes and OtherRoute
+	audit   *audit.Logger
+	metrics metrics.BaselineRecorder
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewSampler(cache repository.StateStore, options Options) *Sampler {
+	if options.Window <= 0 {
+		options.Window = 5 * time.Minute
+	}
+	if options.Windows <= 0 {
+		options.Windows = 12
+	}
+	if options.Flush <= 0 {
+		options.Flush = 10 * time.Second
+	}
+	if options.MaxRoutes <= 0 {
+		options.MaxRoutes = 1000
+	}
+	if options.MinSamples <= 0 {
+		options.MinSamples = 100
+	}
+	if options.Factor <= 0 {
+		options.Factor = 3
+	}
+
+	s := &Sampler{
+		options: options,
+		cache:   cache,
+		pending: make(map[string]*histograms),
+		routes:  make(map[string]*route),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go s.run()
+
+	return s
+}
+
+// Close stops the sampler, flushing what is left.
+func (s *Sampler) Close() error {
+	close(s.stop)
+	<-s.done
+
+	return nil
+}
+
+func (s *Sampler) window(t time.Time) int64 {
+	return t.UnixNano() / int64(s.options.Window)
+}
+
+// Record adds a sample of name, see Route, and returns the route it was
+// counted under.
+func (s *Sampler) Record(name string, sample Sample) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name, r := s.route(name)
+	r.seen = s.window(time.Now())
+	pending, ok := s.pending[name]
+	if !ok {
+		pending = &histograms{}
+		s.pending[name] = pending
+	}
+	for i, value := range sample.values() {
+		pending[i].add(value)
+	}
+
+	return name
+}
+
+// route returns the route name is kept under, OtherRoute once MaxRoutes
+// are known. The caller holds mu.
+func (s *Sampler) route(name string) (string, *route) {
+	if r, ok := s.routes[name]; ok {
+		return name, r
+	}
+	if len(s.routes) >= s.options.MaxRoutes {
+		name = OtherRoute
+		if r, ok := s.routes[name]; ok {
+			return name, r
+		}
+	}
+
+	r := &route{}
+	s.routes[name] = r
+
+	return name, r
+}
+
+// Outliers returns the metrics of sample more than Factor times above the
+// p95 of the route's baseline. Routes without enough samples yet, and
+// metrics always 0 like the bodies of GET requests, flag nothing.
+func (s *Sampler) Outliers(name string, sample Sample) []string {
+	s.mu.Lock()
+	r, ok := s.routes[name]
+	if !ok {
+		s.mu.Unlock()
+		return nil
+	}
+	window := s.window(time.Now())
+	if r.window != window && !r.refreshing {
+		r.refreshing = true
+		go s.refresh(name, window)
+	}
+	baseline := r.baseline
+	s.mu.Unlock()
+
+	if baseline == nil {
+		return nil
+	}
+
+	var outliers []string
+	for i, value := range sample.values() {
+		stats := baseline.Metrics[metricNames[i]]
+		if stats.Count < s.options.MinSamples || stats.P95 <= 0 {
+			continue
+		}
+		if float64(value)/metricScales[i] > stats.P95*s.options.Factor {
+			outliers = append(outliers, metricNames[i])
+		}
+	}
+
+	return outliers
+}
+
+// refresh loads the baseline of name for window.
+func (s *Sampler) refresh(name string, window int64) {
+	baseline, err := s.load(context.Background(), name, window)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.routes[name]
+	if !ok {
+		return
+	}
+	r.refreshing = false
+	if err != nil {
+		logger.Logger("[warn] fail to load baseline of ", name, " ", err.Error()).Warn()
+		return
+	}
+	r.baseline = baseline
+	r.window = window
+}
+
+// Baseline loads the current baseline of requestPath, see Route.
+func (s *Sampler) Baseline(ctx context.Context, requestPath string) (*Baseline, error) {
+	name := Route(requestPath)
+	if requestPath == OtherRoute {
+		name = OtherRoute
+	}
+
+	return s.load(ctx, name, s.window(time.Now()))
+}
+
+// Routes lists the routes this instance sampled lately.
+func (s *Sampler) Routes() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := make([]string, 0, len(s.routes))
+	for name := range s.routes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// load adds up the windows before window from the cache.
+func (s *Sampler) load(ctx context.Context, name string, window int64) (*Baseline, error) {
+	var keys []string
+	for w := window - int64(s.options.Windows); w < window; w++ {
+		for _, metric := range metricNames {
+			for bucket := range buckets {
+				keys = append(keys, s.key(name, w, metric, strconv.Itoa(bucket)))
+			}
+			keys = append(keys, s.key(name, w, metric, "sum"))
+		}
+	}
+
+	values, err := s.cache.StateContext(ctx).MGet(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	var merged histograms
+	i := 0
+	for range s.options.Windows {
+		for m := range metricNames {
+			for bucket := range buckets {
+				merged[m].counts[bucket] += parseCount(values[keys[i]])
+				i++
+			}
+			merged[m].sum += parseCount(values[keys[i]])
+			i++
+		}
+	}
+
+	baseline := &Baseline{
+		Route:   name,
+		From:    time.Unix(0, (window-int64(s.options.Windows))*int64(s.options.Window)),
+		To:      time.Unix(0, window*int64(s.options.Window)),
+		Metrics: make(map[string]Stats, len(metricNames)),
+	}
+	for m, metric := range metricNames {
+		baseline.Metrics[metric] = merged[m].stats(metricScales[m])
+	}
+
+	return baseline, nil
+}
+
+func parseCount(value []byte) int64 {
+	if value == nil {
+		return 0
+	}
+	count, _ := strconv.ParseInt(string(value), 10, 64)
+
+	return count
+}
+
+// key is hashed, routes may hold characters the file cache can't name a
+// file after.
+func (s *Sampler) key(name string, window int64, metric string, bucket string) string {
+	hash := fnv.New64a()
+	hash.Write([]byte(name))
+
+	return fmt.Sprintf("gowaf-baseline-%x-%d-%s-%s", hash.Sum64(), window, metric, bucket)
+}
+
+func (s *Sampler) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.options.Flush)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.stop:
+			s.flush()
+			return
+		}
+	}
+}
+
+// flush adds the local counts to the current window in the cache, and
+// forgets the routes not sampled for a whole baseline.
+func (s *Sampler) flush() {
+	now := time.Now()
+	window := s.window(now)
+
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = make(map[string]*histograms)
+	for name, r := range s.routes {
+		if r.seen < window-int64(s.options.Windows) && !r.refreshing {
+			delete(s.routes, name)
+		}
+	}
+	s.mu.Unlock()
+
+	// a window's keys live until the last baseline spanning it is loaded
+	ttl := s.options.Window * time.Duration(s.options.Windows+2)
+	cache := s.cache.StateContext(context.Background())
+	for name, counts := range pending {
+		for m, metric := range metricNames {
+			h := &counts[m]
+			for bucket, count := range h.counts {
+				if count == 0 {
+					continue
+				}
+				if _, err := cache.Increment(s.key(name, window, metric, strconv.Itoa(bucket)), count, ttl); err != nil {
+					logger.Logger("[warn] fail to flush baselines ", err.Error()).Warn()
+					return
+				}
+			}
+			if h.sum > 0 {
+				if _, err := cache.Increment(s.key(name, window, metric, "sum"), h.sum, ttl); err != nil {
+					logger.Logger("[warn] fail to flush baselines ", err.Error()).Warn()
+					return
+				}
+			}
+		}
+	}
+}
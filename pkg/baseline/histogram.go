@@ -0,0 +1,125 @@
+package baseline
+
+import (
+	"math"
+	"math/bits"
+	"path"
+	"strings"
+)
+
+// buckets is the number of power of two buckets of a histogram: bucket 0
+// holds 0, bucket i values from 2^(i-1) up to 2^i, the last one everything
+// above. Latencies are counted in microseconds, so it reaches half an hour.
+const buckets = 32
+
+// histogram is a fixed size distribution of values, small enough to keep
+// one per route and metric and additive, so the instances' counts add up in
+// the cache.
+type histogram struct {
+	counts [buckets]int64
+	sum    int64
+}
+
+func bucketOf(value int64) int {
+	if value <= 0 {
+		return 0
+	}
+
+	return min(bits.Len64(uint64(value)), buckets-1)
+}
+
+func (h *histogram) add(value int64) {
+	h.counts[bucketOf(value)]++
+	h.sum += max(value, 0)
+}
+
+func (h *histogram) count() int64 {
+	var n int64
+	for _, count := range h.counts {
+		n += count
+	}
+
+	return n
+}
+
+// quantile estimates the value below which q of the values fall,
+// interpolating within its bucket.
+func (h *histogram) quantile(q float64) float64 {
+	n := h.count()
+	if n == 0 {
+		return 0
+	}
+
+	rank := math.Ceil(q * float64(n))
+	var below float64
+	for i, count := range h.counts {
+		if count == 0 {
+			continue
+		}
+		if below+float64(count) >= rank {
+			if i == 0 {
+				return 0
+			}
+			lower := math.Ldexp(1, i-1)
+			return lower + lower*(rank-below)/float64(count)
+		}
+		below += float64(count)
+	}
+
+	return math.Ldexp(1, buckets-1)
+}
+
+// Stats summarize a metric of a route over the baseline.
+type Stats struct {
+	Count int64   `json:"count"`
+	Mean  float64 `json:"mean"`
+	P95   float64 `json:"p95"`
+}
+
+func (h *histogram) stats(scale float64) Stats {
+	n := h.count()
+	if n == 0 {
+		return Stats{}
+	}
+
+	return Stats{
+		Count: n,
+		Mean:  float64(h.sum) / float64(n) / scale,
+		P95:   h.quantile(0.95) / scale,
+	}
+}
+
+// Route returns the route a request path is sampled under: the cleaned path
+// with the segments that are ids, numbers, UUIDs and long hex strings,
+// replaced by :id, so /users/42 and /users/43 share a baseline.
+func Route(requestPath string) string {
+	segments := strings.Split(path.Clean("/"+requestPath), "/")
+	for i, segment := range segments {
+		if isID(segment) {
+			segments[i] = ":id"
+		}
+	}
+
+	return strings.Join(segments, "/")
+}
+
+func isID(segment string) bool {
+	if segment == "" {
+		return false
+	}
+
+	digits := true
+	for _, c := range segment {
+		switch {
+		case '0' <= c && c <= '9':
+		case 'a' <= c && c <= 'f', 'A' <= c && c <= 'F':
+			digits = false
+		case c == '-' && len(segment) == 36:
+			digits = false
+		default:
+			return false
+		}
+	}
+
+	return digits || len(segment) >= 16
+}
@@ -0,0 +1,86 @@
+package baseline
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jahrulnr/go-waf/pkg/audit"
+	"github.com/jahrulnr/go-waf/pkg/clientip"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+	"github.com/jahrulnr/go-waf/pkg/metrics"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SetAudit writes every request flagged as an outlier to the audit log.
+func (s *Sampler) SetAudit(audit *audit.Logger) {
+	s.audit = audit
+}
+
+// SetMetrics counts the outliers.
+func (s *Sampler) SetMetrics(recorder metrics.BaselineRecorder) {
+	s.metrics = recorder
+}
+
+// Middleware samples every request and flags the ones far above the
+// baseline of their route. The response is sent by then, an outlier is
+// logged, not stopped. HEAD requests and WebSocket connections would skew
+// the baselines and aren't sampled.
+func (s *Sampler) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method == http.MethodHead || c.GetHeader("Upgrade") != "" {
+			c.Next()
+			return
+		}
+
+		body := &countingBody{ReadCloser: c.Request.Body}
+		if c.Request.Body != nil && c.Request.Body != http.NoBody {
+			c.Request.Body = body
+		}
+		start := time.Now()
+		c.Next()
+
+		sample := Sample{
+			Latency:      time.Since(start),
+			RequestSize:  body.read,
+			ResponseSize: int64(max(c.Writer.Size(), 0)),
+		}
+		name := s.Record(Route(c.Request.URL.Path), sample)
+		outliers := s.Outliers(name, sample)
+		if len(outliers) == 0 {
+			return
+		}
+
+		ip := clientip.FromContext(c)
+		logger.FromContext(c.Request.Context()).Logger("[warn] baseline outlier ", strings.Join(outliers, ","), " ", c.Request.Method, " ", name, " ", ip,
+			" latency ", sample.Latency.String(), " request ", sample.RequestSize, " response ", sample.ResponseSize).Warn()
+		rules := make([]string, len(outliers))
+		for i, metric := range outliers {
+			rules[i] = "baseline-" + strings.ReplaceAll(metric, "_", "-")
+			if s.metrics != nil {
+				s.metrics.RecordBaselineOutlier(metric)
+			}
+		}
+		s.audit.Log(c.Request, ip, audit.Record{
+			Source: "baseline",
+			Rules:  rules,
+			Action: "log",
+			Status: c.Writer.Status(),
+		})
+	}
+}
+
+// countingBody counts the bytes of the request body the handlers read.
+type countingBody struct {
+	io.ReadCloser
+	read int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+
+	return n, err
+}
@@ -0,0 +1,89 @@
+package block
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/jahrulnr/go-waf/pkg/audit"
+	"github.com/jahrulnr/go-waf/pkg/requestid"
+
+	"github.com/gin-gonic/gin"
+)
+
+type decisionKey struct{}
+
+type handlerKey struct{}
+
+// Decision is why a component blocked a request.
+type Decision struct {
+	Component string   `json:"component"`        // what blocked it, named like the audit log sources, e.g. waf, ratelimit or geoip
+	Rules     []string `json:"rules,omitempty"`  // ids of the rules matched
+	Fields    []string `json:"fields,omitempty"` // where the rules matched, e.g. header:Referer or query:id
+	Score     int      `json:"score,omitempty"`  // anomaly score of the waf
+	Status    int      `json:"status"`           // status the component answers with, default 403
+	Reason    string   `json:"reason,omitempty"` // what was wrong, when the component tells
+	RequestID string   `json:"request_id,omitempty"`
+}
+
+// FromRecord returns the decision of the audit record a component logged
+// for the request.
+func FromRecord(record audit.Record) Decision {
+	return Decision{
+		Component: record.Source,
+		Rules:     record.Rules,
+		Fields:    record.Fields,
+		Score:     record.Score,
+		Status:    record.Status,
+	}
+}
+
+// Title is the text of the status, e.g. Forbidden.
+func (d Decision) Title() string {
+	return http.StatusText(d.Status)
+}
+
+// Handler answers a blocked request, in place of the component that blocked
+// it.
+type Handler func(c *gin.Context, decision Decision)
+
+// Middleware hands the decisions of the components after it to handler. It
+// must run first, a nil handler leaves the components answering as they
+// always have.
+func Middleware(handler Handler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if handler != nil {
+			c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), handlerKey{}, handler))
+		}
+
+		c.Next()
+	}
+}
+
+// FromContext returns the decision of a blocked request, ok is false when
+// the request wasn't blocked.
+func FromContext(ctx context.Context) (Decision, bool) {
+	decision, ok := ctx.Value(decisionKey{}).(Decision)
+	return decision, ok
+}
+
+// Respond attaches decision to the request and, when a handler is set,
+// lets it answer and aborts. It returns false when none is, the component
+// answers itself then.
+func Respond(c *gin.Context, decision Decision) bool {
+	if decision.Status == 0 {
+		decision.Status = http.StatusForbidden
+	}
+	if decision.RequestID == "" {
+		decision.RequestID = requestid.FromRequest(c.Request)
+	}
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), decisionKey{}, decision))
+
+	handler, ok := c.Request.Context().Value(handlerKey{}).(Handler)
+	if !ok {
+		return false
+	}
+	handler(c, decision)
+	c.Abort()
+
+	return true
+}
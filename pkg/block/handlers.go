@@ -0,0 +1,85 @@
+package block
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/jahrulnr/go-waf/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Problem answers an RFC 7807 problem document. The type is typeBase with
+// the component appended, e.g. https://example.com/problems/ gives
+// https://example.com/problems/waf, or about:blank when typeBase is empty.
+// The component, rules, score and request id are extension members.
+func Problem(typeBase string) Handler {
+	return func(c *gin.Context, decision Decision) {
+		problemType := "about:blank"
+		if typeBase != "" {
+			problemType = typeBase + decision.Component
+		}
+		problem := map[string]interface{}{
+			"type":      problemType,
+			"title":     decision.Title(),
+			"status":    decision.Status,
+			"instance":  c.Request.URL.Path,
+			"component": decision.Component,
+		}
+		if decision.Reason != "" {
+			problem["detail"] = decision.Reason
+		}
+		if len(decision.Rules) > 0 {
+			problem["rules"] = decision.Rules
+		}
+		if decision.Score > 0 {
+			problem["score"] = decision.Score
+		}
+		if decision.RequestID != "" {
+			problem["request_id"] = decision.RequestID
+		}
+
+		body, err := json.Marshal(problem)
+		if err != nil {
+			logger.FromContext(c.Request.Context()).Logger("[warn] fail to encode problem ", err.Error()).Warn()
+		}
+		c.Data(decision.Status, "application/problem+json", body)
+	}
+}
+
+// Redirect sends blocked clients to target with 303, with the status,
+// component and request id added to its query, e.g. to an error page of
+// the application.
+func Redirect(target *url.URL) Handler {
+	return func(c *gin.Context, decision Decision) {
+		location := *target
+		query := location.Query()
+		query.Set("status", strconv.Itoa(decision.Status))
+		query.Set("component", decision.Component)
+		if decision.RequestID != "" {
+			query.Set("request_id", decision.RequestID)
+		}
+		location.RawQuery = query.Encode()
+
+		c.Redirect(http.StatusSeeOther, location.String())
+	}
+}
+
+// Page renders page with the decision, e.g. {{.Title}} or {{.RequestID}},
+// with the status of the decision.
+func Page(page *template.Template) Handler {
+	return func(c *gin.Context, decision Decision) {
+		var body bytes.Buffer
+		if err := page.Execute(&body, decision); err != nil {
+			logger.FromContext(c.Request.Context()).Logger("[warn] fail to render block page ", err.Error()).Warn()
+			c.String(decision.Status, strconv.Itoa(decision.Status)+" | "+decision.Title()+".")
+			return
+		}
+
+		c.Data(decision.Status, "text/html; charset=utf-8", body.Bytes())
+	}
+}
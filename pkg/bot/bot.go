@@ -0,0 +1,299 @@
+package bot
+
+import (
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jahrulnr/go-waf/internal/interface/repository"
+	"github.com/jahrulnr/go-waf/pkg/audit"
+	"github.com/jahrulnr/go-waf/pkg/block"
+	"github.com/jahrulnr/go-waf/pkg/clientip"
+	"github.com/jahrulnr/go-waf/pkg/dryrun"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BotScore is how likely a request comes from a bot, from 0 (a browser) to
+// 100 (certainly a bot).
+type BotScore int
+
+// MaxScore is the highest score, scores are capped to it.
+const MaxScore BotScore = 100
+
+const (
+	// ScoreKey and ReasonKey are the gin context keys of the classification.
+	ScoreKey  = "bot.score"
+	ReasonKey = "bot.reason"
+
+	// ScoreHeader and ReasonHeader tag the request sent upstream.
+	ScoreHeader  = "X-Bot-Score"
+	ReasonHeader = "X-Bot-Reason"
+)
+
+// Actions taken on requests scoring at least the threshold.
+const (
+	ActionLog       = "log"
+	ActionTag       = "tag"
+	ActionRateLimit = "ratelimit"
+	ActionBlock     = "block"
+)
+
+// DefaultUserAgents match the User-Agent of crawlers, scripts and scanners.
+var DefaultUserAgents = []string{
+	`bot\b`, `crawl`, `spider`, `slurp`, `scrapy`,
+	`^curl/`, `^wget/`, `python-requests`, `python-urllib`, `aiohttp`, `go-http-client`, `^java/`, `libwww-perl`, `okhttp`, `httpclient`,
+	`headlesschrome`, `phantomjs`, `selenium`, `puppeteer`, `playwright`,
+	`nikto`, `sqlmap`, `nmap`, `masscan`, `zgrab`, `nuclei`,
+}
+
+// DefaultGoodBots map a User-Agent token to the domains its crawlers resolve
+// to.
+var DefaultGoodBots = map[string][]string{
+	"googlebot":   {"googlebot.com", "google.com"},
+	"bingbot":     {"search.msn.com"},
+	"duckduckbot": {"duckduckgo.com"},
+	"yandexbot":   {"yandex.ru", "yandex.net", "yandex.com"},
+	"applebot":    {"applebot.apple.com"},
+	"baiduspider": {"baidu.com", "baidu.jp"},
+}
+
+// Options configures the detection. Zero values take the defaults noted on
+// each field.
+type Options struct {
+	UserAgents []string            // case insensitive patterns, default DefaultUserAgents
+	GoodBots   map[string][]string // default DefaultGoodBots
+	Threshold  BotScore            // score the action applies from, default 60
+	Action     string              // log, tag, ratelimit or block, default log
+	RateWindow time.Duration       // default 10s
+	RateLimit  int64               // requests per window scored as a bot, default 100, negative disables
+	BotLimit   int64               // requests per window left to bots by the ratelimit action, default 10
+	Trusted    []net.IPNet         // proxies trusted by Classify to forward the client IP
+	Resolver   *net.Resolver       // checks good bots, default net.DefaultResolver
+}
+
+// Detector scores requests from their User-Agent, the headers browsers always
+// send and the request rate of the client. Counters and reverse DNS results
+// are kept in the cache, so instances sharing it see the same rates.
+type Detector struct {
+	options    Options
+	cache      repository.StateStore
+	userAgents []*regexp.Regexp
+	audit      *audit.Logger
+	dryRun     *dryrun.DryRun
+}
+
+func NewDetector(cache repository.StateStore, options Options) (*Detector, error) {
+	if len(options.UserAgents) == 0 {
+		options.UserAgents = DefaultUserAgents
+	}
+	if options.GoodBots == nil {
+		options.GoodBots = DefaultGoodBots
+	}
+	if options.Threshold <= 0 {
+		options.Threshold = 60
+	}
+	switch options.Action {
+	case ActionTag, ActionRateLimit, ActionBlock:
+	default:
+		options.Action = ActionLog
+	}
+	if options.RateWindow <= 0 {
+		options.RateWindow = 10 * time.Second
+	}
+	if options.RateLimit == 0 {
+		options.RateLimit = 100
+	}
+	if options.BotLimit <= 0 {
+		options.BotLimit = 10
+	}
+	if options.Resolver == nil {
+		options.Resolver = net.DefaultResolver
+	}
+
+	d := &Detector{options: options, cache: cache}
+	for _, pattern := range options.UserAgents {
+		re, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return nil, err
+		}
+		d.userAgents = append(d.userAgents, re)
+	}
+
+	return d, nil
+}
+
+// SetAudit writes every blocked request to the audit log.
+func (d *Detector) SetAudit(audit *audit.Logger) {
+	d.audit = audit
+}
+
+// SetDryRun forwards the bots the action would stop, only reporting them.
+func (d *Detector) SetDryRun(dryRun *dryrun.DryRun) {
+	d.dryRun = dryRun
+}
+
+// Classify scores r and tells why, the reasons are comma separated.
+func (d *Detector) Classify(r *http.Request) (BotScore, string) {
+	var ip string
+	if parsed := clientip.RealIP(r, d.options.Trusted); parsed != nil {
+		ip = parsed.String()
+	}
+	score, reason, _ := d.classify(r, ip)
+
+	return score, reason
+}
+
+// classify also returns the requests counted for ip in the current window.
+func (d *Detector) classify(r *http.Request, ip string) (BotScore, string, int64) {
+	var score BotScore
+	var reasons []string
+	add := func(points BotScore, reason string) {
+		score += points
+		reasons = append(reasons, reason)
+	}
+
+	count := d.count(r, ip)
+	userAgent := r.UserAgent()
+	switch name, verified, known := d.goodBot(r, userAgent, ip); {
+	case known && verified:
+		return 0, "verified " + name, count
+	case known:
+		add(MaxScore, "unverified "+name)
+	case userAgent == "":
+		add(60, "missing user agent")
+	default:
+		for _, re := range d.userAgents {
+			if re.MatchString(userAgent) {
+				add(70, "bot user agent")
+				break
+			}
+		}
+	}
+
+	if r.Header.Get("Accept") == "" {
+		add(20, "missing accept")
+	}
+	if r.Header.Get("Accept-Language") == "" {
+		add(15, "missing accept-language")
+	}
+	if r.Header.Get("Accept-Encoding") == "" {
+		add(15, "missing accept-encoding")
+	}
+	if d.options.RateLimit > 0 && count > d.options.RateLimit {
+		add(40, "request rate")
+	}
+
+	if score > MaxScore {
+		score = MaxScore
+	}
+
+	return score, strings.Join(reasons, ", "), count
+}
+
+// count adds the request to the counter of ip and returns it.
+func (d *Detector) count(r *http.Request, ip string) int64 {
+	if d.cache == nil || ip == "" {
+		return 0
+	}
+
+	count, err := d.cache.StateContext(r.Context()).Increment("gowaf-bot-"+ip, 1, d.options.RateWindow)
+	if err != nil {
+		logger.FromContext(r.Context()).Logger("[warn] fail to count bot requests ", ip, err.Error()).Warn()
+		return 0
+	}
+
+	return count
+}
+
+// Middleware classifies every request, putting the score in the gin context
+// under ScoreKey and ReasonKey, and applies the action from the threshold on.
+// The ratelimit action answers 429 once a bot made more than BotLimit
+// requests in the window, the block action answers 403.
+func (d *Detector) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// the score is ours to set
+		c.Request.Header.Del(ScoreHeader)
+		c.Request.Header.Del(ReasonHeader)
+
+		ip := clientip.FromContext(c)
+		score, reason, count := d.classify(c.Request, ip)
+		c.Set(ScoreKey, score)
+		c.Set(ReasonKey, reason)
+		if d.options.Action == ActionTag {
+			c.Request.Header.Set(ScoreHeader, strconv.Itoa(int(score)))
+			c.Request.Header.Set(ReasonHeader, reason)
+		}
+
+		if score < d.options.Threshold {
+			c.Next()
+			return
+		}
+
+		switch d.options.Action {
+		case ActionLog:
+			logger.FromContext(c.Request.Context()).Logger("[warn] bot detected ", ip, " score ", score, " ", reason).Warn()
+		case ActionRateLimit:
+			if count > d.options.BotLimit {
+				record := audit.Record{
+					Source: "bot",
+					Score:  int(score),
+					Action: "rate_limit",
+					Status: http.StatusTooManyRequests,
+				}
+				if d.dryRun.Forward(c, record) {
+					break
+				}
+
+				logger.FromContext(c.Request.Context()).Logger("[warn] bot rate limited ", ip, " score ", score, " ", reason).Warn()
+				d.audit.Log(c.Request, ip, record)
+				decision := block.FromRecord(record)
+				decision.Reason = reason
+				if block.Respond(c, decision) {
+					return
+				}
+				c.String(http.StatusTooManyRequests, "429 | Too many request.")
+				c.Abort()
+				return
+			}
+		case ActionBlock:
+			record := audit.Record{
+				Source: "bot",
+				Score:  int(score),
+				Status: http.StatusForbidden,
+			}
+			if d.dryRun.Forward(c, record) {
+				break
+			}
+
+			logger.FromContext(c.Request.Context()).Logger("[warn] bot blocked ", ip, " score ", score, " ", reason).Warn()
+			d.audit.Log(c.Request, ip, record)
+			decision := block.FromRecord(record)
+			decision.Reason = reason
+			if block.Respond(c, decision) {
+				return
+			}
+			c.String(http.StatusForbidden, "403 | Forbidden.")
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// FromContext returns the classification made by the middleware, found is
+// false when the request didn't go through it.
+func FromContext(c *gin.Context) (score BotScore, reason string, found bool) {
+	value, found := c.Get(ScoreKey)
+	if !found {
+		return 0, "", false
+	}
+	score, _ = value.(BotScore)
+
+	return score, c.GetString(ReasonKey), true
+}
@@ -0,0 +1,99 @@
+package bot
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jahrulnr/go-waf/pkg/logger"
+)
+
+const (
+	// verifyTTL is how long a reverse DNS result is kept, crawler addresses
+	// rarely change owner.
+	verifyTTL = 24 * time.Hour
+	// lookupTimeout bounds the DNS lookups done for one request.
+	lookupTimeout = 2 * time.Second
+)
+
+// goodBot reports whether userAgent claims to be a good bot, and whether ip
+// really belongs to it: the reverse DNS name of ip must be in one of its
+// domains and resolve back to ip.
+func (d *Detector) goodBot(r *http.Request, userAgent string, ip string) (name string, verified bool, known bool) {
+	userAgent = strings.ToLower(userAgent)
+	var domains []string
+	for token, list := range d.options.GoodBots {
+		if strings.Contains(userAgent, strings.ToLower(token)) {
+			name, domains, known = token, list, true
+			break
+		}
+	}
+	if !known || ip == "" {
+		return name, false, known
+	}
+
+	key := "gowaf-bot-dns-" + name + "-" + ip
+	if d.cache != nil {
+		if result, ok := d.cache.StateContext(r.Context()).Get(key); ok {
+			return name, string(result) == name, true
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), lookupTimeout)
+	defer cancel()
+	verified = d.verify(ctx, ip, domains)
+
+	if d.cache != nil {
+		// a lookup cut short by the client isn't an answer
+		if ctx.Err() == nil {
+			result := ""
+			if verified {
+				result = name
+			}
+			if err := d.cache.StateContext(r.Context()).Set(key, []byte(result), verifyTTL); err != nil {
+				logger.FromContext(r.Context()).Logger("[warn] fail to cache bot verification ", ip, err.Error()).Warn()
+			}
+		}
+	}
+
+	return name, verified, true
+}
+
+func (d *Detector) verify(ctx context.Context, ip string, domains []string) bool {
+	names, err := d.options.Resolver.LookupAddr(ctx, ip)
+	if err != nil {
+		logger.Logger("[debug] bot reverse lookup failed ", ip, err.Error()).Debug()
+		return false
+	}
+
+	for _, host := range names {
+		host = strings.TrimSuffix(strings.ToLower(host), ".")
+		if !inDomains(host, domains) {
+			continue
+		}
+
+		addrs, err := d.options.Resolver.LookupHost(ctx, host)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if net.ParseIP(addr).Equal(net.ParseIP(ip)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func inDomains(host string, domains []string) bool {
+	for _, domain := range domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+
+	return false
+}
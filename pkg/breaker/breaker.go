@@ -0,0 +1,221 @@
+package breaker
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jahrulnr/go-waf/pkg/logger"
+	"github.com/jahrulnr/go-waf/pkg/metrics"
+)
+
+// ErrCircuitOpen is returned for the requests an open breaker refuses.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+type State string
+
+const (
+	StateClosed   State = "closed"
+	StateOpen     State = "open"
+	StateHalfOpen State = "half_open"
+)
+
+// breakerBuckets is the resolution of the rolling window.
+const breakerBuckets = 10
+
+// Options configures a circuit breaker. Zero values take the defaults
+// noted on each field.
+type Options struct {
+	FailureRatio     float64                 // failures/requests tripping the breaker, default 0.5
+	MinRequests      int                     // requests in the window before it may trip, default 10
+	Window           time.Duration           // rolling window, default 10s
+	OpenTimeout      time.Duration           // time open before probing, default 30s
+	HalfOpenRequests int                     // probes that must succeed to close again, default 1
+	Metrics          metrics.BreakerRecorder // optional
+}
+
+func (o *Options) setDefaults() {
+	if o.FailureRatio <= 0 || o.FailureRatio > 1 {
+		o.FailureRatio = 0.5
+	}
+	if o.MinRequests < 1 {
+		o.MinRequests = 10
+	}
+	if o.Window <= 0 {
+		o.Window = 10 * time.Second
+	}
+	if o.OpenTimeout <= 0 {
+		o.OpenTimeout = 30 * time.Second
+	}
+	if o.HalfOpenRequests < 1 {
+		o.HalfOpenRequests = 1
+	}
+}
+
+type bucket struct {
+	start     time.Time
+	successes int
+	failures  int
+}
+
+// Breaker stops sending traffic to a dependency failing too often, an
+// upstream of the proxy or the Redis client of the cache. After
+// OpenTimeout it lets HalfOpenRequests probes through, closing again once
+// they all succeed and reopening on the first failure.
+type Breaker struct {
+	name    string
+	options Options
+
+	mu       sync.Mutex
+	state    State
+	openedAt time.Time
+	buckets  [breakerBuckets]bucket
+	probes   int // half open requests in flight
+	passed   int // half open requests that succeeded
+}
+
+func NewBreaker(name string, options Options) *Breaker {
+	options.setDefaults()
+
+	return &Breaker{
+		name:    name,
+		options: options,
+		state:   StateClosed,
+	}
+}
+
+// State returns the current state.
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state
+}
+
+// Ready reports whether Allow would let a request through, without taking a
+// half open slot.
+func (b *Breaker) Ready() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case StateOpen:
+		return time.Since(b.openedAt) >= b.options.OpenTimeout
+	case StateHalfOpen:
+		return b.probes < b.options.HalfOpenRequests-b.passed
+	default:
+		return true
+	}
+}
+
+// Allow reports whether a request may be sent. Every allowed request must be
+// followed by Record.
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == StateOpen {
+		if time.Since(b.openedAt) < b.options.OpenTimeout {
+			return false
+		}
+		b.transition(StateHalfOpen)
+	}
+
+	if b.state == StateHalfOpen {
+		if b.probes >= b.options.HalfOpenRequests-b.passed {
+			return false
+		}
+		b.probes++
+	}
+
+	return true
+}
+
+// Record reports the outcome of an allowed request.
+func (b *Breaker) Record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case StateHalfOpen:
+		b.probes--
+		if !success {
+			b.transition(StateOpen)
+			return
+		}
+		b.passed++
+		if b.passed >= b.options.HalfOpenRequests {
+			b.transition(StateClosed)
+		}
+	case StateClosed:
+		current := b.bucket(time.Now())
+		if success {
+			current.successes++
+			return
+		}
+		current.failures++
+
+		requests, failures := b.totals(time.Now())
+		if requests >= b.options.MinRequests && float64(failures)/float64(requests) >= b.options.FailureRatio {
+			b.transition(StateOpen)
+		}
+	}
+}
+
+// Cancel releases an allowed request without an outcome, e.g. when the
+// client went away.
+func (b *Breaker) Cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == StateHalfOpen && b.probes > 0 {
+		b.probes--
+	}
+}
+
+// bucket returns the bucket for now, recycling it if it is from an earlier
+// round of the window. The caller must hold the lock.
+func (b *Breaker) bucket(now time.Time) *bucket {
+	width := b.options.Window / breakerBuckets
+	start := now.Truncate(width)
+	current := &b.buckets[(start.UnixNano()/int64(width))%breakerBuckets]
+	if !current.start.Equal(start) {
+		*current = bucket{start: start}
+	}
+
+	return current
+}
+
+// totals sums the buckets inside the window. The caller must hold the lock.
+func (b *Breaker) totals(now time.Time) (int, int) {
+	var requests, failures int
+	for _, bucket := range b.buckets {
+		if now.Sub(bucket.start) < b.options.Window {
+			requests += bucket.successes + bucket.failures
+			failures += bucket.failures
+		}
+	}
+
+	return requests, failures
+}
+
+// transition changes the state. The caller must hold the lock.
+func (b *Breaker) transition(state State) {
+	b.state = state
+	b.probes, b.passed = 0, 0
+
+	switch state {
+	case StateOpen:
+		b.openedAt = time.Now()
+		logger.Logger("[warn] circuit breaker open for ", b.name).Warn()
+	case StateClosed:
+		b.buckets = [breakerBuckets]bucket{}
+		logger.Logger("[info] circuit breaker closed for ", b.name).Info()
+	default:
+		logger.Logger("[info] circuit breaker half open for ", b.name).Info()
+	}
+
+	if b.options.Metrics != nil {
+		b.options.Metrics.RecordBreakerState(b.name, string(state))
+	}
+}
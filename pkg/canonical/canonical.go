@@ -0,0 +1,157 @@
+package canonical
+
+import (
+	"net/url"
+	"path"
+	"strings"
+)
+
+// MaxPasses bounds how many layers of encoding Decode unwraps, enough for
+// the double and triple encodings used to slip past filters without letting
+// a request make it loop.
+const MaxPasses = 3
+
+// overlongReplacer maps the classic invalid UTF-8 encodings of '.', '/' and
+// '\'.
+var overlongReplacer = strings.NewReplacer("\xc0\xae", ".", "\xc0\xaf", "/", "\xc1\x9c", "/")
+
+// Decode undoes percent encoding, nested up to MaxPasses times. Unlike
+// url.PathUnescape it doesn't give up on a malformed escape, which would
+// otherwise hide everything else in the value: %zz is kept as it is and the
+// rest decoded. IIS style %uXXXX escapes are decoded as well.
+func Decode(value string) string {
+	for range MaxPasses {
+		decoded, changed := unescape(value)
+		if !changed {
+			break
+		}
+		value = decoded
+	}
+
+	return value
+}
+
+func unescape(value string) (string, bool) {
+	if !strings.Contains(value, "%") {
+		return value, false
+	}
+
+	var b strings.Builder
+	b.Grow(len(value))
+	changed := false
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c != '%' {
+			b.WriteByte(c)
+			continue
+		}
+
+		if i+2 < len(value) && isHex(value[i+1]) && isHex(value[i+2]) {
+			b.WriteByte(unhex(value[i+1])<<4 | unhex(value[i+2]))
+			i += 2
+			changed = true
+			continue
+		}
+		if i+5 < len(value) && (value[i+1] == 'u' || value[i+1] == 'U') &&
+			isHex(value[i+2]) && isHex(value[i+3]) && isHex(value[i+4]) && isHex(value[i+5]) {
+			r := rune(unhex(value[i+2]))<<12 | rune(unhex(value[i+3]))<<8 | rune(unhex(value[i+4]))<<4 | rune(unhex(value[i+5]))
+			b.WriteRune(r)
+			i += 5
+			changed = true
+			continue
+		}
+		b.WriteByte(c)
+	}
+
+	return b.String(), changed
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c >= 'a':
+		return c - 'a' + 10
+	case c >= 'A':
+		return c - 'A' + 10
+	}
+
+	return c - '0'
+}
+
+// Path is a request path in the forms the rules look at.
+type Path struct {
+	// Decoded is every layer of encoding undone, overlong UTF-8 and
+	// backslashes turned into slashes, and the path parameters dropped, but
+	// with its dot segments, so a traversal still shows.
+	Decoded string
+	// Clean is Decoded with // and /./ collapsed and /../ resolved, never
+	// above the root, and without a trailing slash: the resource the
+	// upstream most likely serves, whatever the spelling.
+	Clean string
+	// Params are the path parameters, /page;name=value, decoded. Servers
+	// like Tomcat ignore them, so they hide /admin;x=y from a rule on
+	// /admin.
+	Params url.Values
+}
+
+// ParsePath takes apart an escaped request path, e.g. url.URL.EscapedPath.
+// Case is kept, paths are case sensitive; the detectors match without
+// regard to case.
+func ParsePath(escaped string) Path {
+	var p Path
+	segments := strings.Split(escaped, "/")
+	for i, segment := range segments {
+		segment, params, found := strings.Cut(segment, ";")
+		if !found {
+			continue
+		}
+		segments[i] = segment
+		for _, param := range strings.Split(params, ";") {
+			if param == "" {
+				continue
+			}
+			if p.Params == nil {
+				p.Params = make(url.Values)
+			}
+			name, value, _ := strings.Cut(param, "=")
+			p.Params.Add(Decode(name), Decode(value))
+		}
+	}
+
+	decoded := overlongReplacer.Replace(Decode(strings.Join(segments, "/")))
+	p.Decoded = strings.ReplaceAll(decoded, `\`, "/")
+	p.Clean = path.Clean("/" + p.Decoded)
+
+	return p
+}
+
+// Query parses a raw query string or form body, decoding names and values
+// with Decode. Pairs with malformed escapes are kept, url.ParseQuery drops
+// them, which an upstream may well not do.
+func Query(raw string) url.Values {
+	values := make(url.Values)
+	for _, pair := range strings.Split(raw, "&") {
+		if pair == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(pair, "=")
+		name = Decode(strings.ReplaceAll(name, "+", " "))
+		values[name] = append(values[name], Decode(strings.ReplaceAll(value, "+", " ")))
+	}
+
+	return values
+}
+
+// URI returns the canonical path of u followed by its decoded query, for
+// rules written against the whole request URI.
+func URI(u *url.URL) string {
+	uri := ParsePath(u.EscapedPath()).Clean
+	if u.RawQuery != "" {
+		uri += "?" + Decode(u.RawQuery)
+	}
+
+	return uri
+}
@@ -0,0 +1,118 @@
+package chain
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The positions of a Chain, in the order requests pass them. Cheap checks
+// come first, so a banned or limited client costs as little as possible,
+// the body is bounded before anything reads it, and the rules run last, so
+// the cache and the proxy behind the chain never see a request they block.
+const (
+	Setup     = "setup"     // request ids, block responses, client IP, tracing, security headers
+	Request   = "request"   // maintenance, smuggling, signed cookies, methods and field caps
+	IPFilter  = "ipfilter"  // ip and country filters, bans, bots, scans, honeypot, challenge
+	RateLimit = "ratelimit" // per client request limits and concurrency
+	Auth      = "auth"      // cors, client certificates, tokens, api keys, nonces
+	Body      = "body"      // body limits, content types, uploads, graphql, csrf
+	Rules     = "rules"     // the request profile and the rule engine
+	Response  = "response"  // compression, response inspection, sampling
+)
+
+// Order lists the positions of a new Chain.
+var Order = []string{Setup, Request, IPFilter, RateLimit, Auth, Body, Rules, Response}
+
+// When returns handler if condition holds, nil otherwise, for middlewares
+// turned on by config.
+func When(condition bool, handler gin.HandlerFunc) gin.HandlerFunc {
+	if !condition {
+		return nil
+	}
+
+	return handler
+}
+
+// Chain orders gin middlewares by position instead of by the order they are
+// added in, so a WAF is assembled like
+//
+//	c := chain.NewChain().
+//		Use(chain.Rules, rules).
+//		Use(chain.IPFilter, ipFilter).
+//		Use(chain.RateLimit, chain.When(config.USE_RATELIMIT, rateLimit))
+//	engine.Use(c.Handlers()...)
+//
+// Custom positions are added with Before and After. Naming a position the
+// chain doesn't have is a programming error and panics, like http.ServeMux
+// does for a bad pattern.
+type Chain struct {
+	positions []string
+	slots     map[string][]gin.HandlerFunc
+}
+
+// NewChain returns an empty chain with the positions of Order.
+func NewChain() *Chain {
+	return &Chain{
+		positions: slices.Clone(Order),
+		slots:     make(map[string][]gin.HandlerFunc),
+	}
+}
+
+// Use appends handlers to position, after the ones already there. Nil
+// handlers are skipped, see When.
+func (c *Chain) Use(position string, handlers ...gin.HandlerFunc) *Chain {
+	c.index(position)
+	for _, handler := range handlers {
+		if handler != nil {
+			c.slots[position] = append(c.slots[position], handler)
+		}
+	}
+
+	return c
+}
+
+// Before adds the position name right before position.
+func (c *Chain) Before(position string, name string) *Chain {
+	return c.insert(c.index(position), name)
+}
+
+// After adds the position name right after position.
+func (c *Chain) After(position string, name string) *Chain {
+	return c.insert(c.index(position)+1, name)
+}
+
+func (c *Chain) insert(at int, name string) *Chain {
+	if slices.Contains(c.positions, name) {
+		panic(fmt.Sprintf("chain: position %q already exists", name))
+	}
+	c.positions = slices.Insert(c.positions, at, name)
+
+	return c
+}
+
+func (c *Chain) index(position string) int {
+	i := slices.Index(c.positions, position)
+	if i < 0 {
+		panic(fmt.Sprintf("chain: unknown position %q", position))
+	}
+
+	return i
+}
+
+// Positions returns the positions in the order requests pass them.
+func (c *Chain) Positions() []string {
+	return slices.Clone(c.positions)
+}
+
+// Handlers returns the middlewares of every position in order, for
+// gin.Engine.Use.
+func (c *Chain) Handlers() []gin.HandlerFunc {
+	var handlers []gin.HandlerFunc
+	for _, position := range c.positions {
+		handlers = append(handlers, c.slots[position]...)
+	}
+
+	return handlers
+}
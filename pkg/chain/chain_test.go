@@ -0,0 +1,106 @@
+package chain_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/jahrulnr/go-waf/pkg/chain"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// run serves a request through the handlers of c and returns the names the
+// middlewares recorded, in the order they ran.
+func run(c *chain.Chain, seen *[]string) []string {
+	*seen = nil
+	engine := gin.New()
+	engine.Use(c.Handlers()...)
+	engine.GET("/", func(ctx *gin.Context) {
+		ctx.Status(http.StatusOK)
+	})
+	engine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	return *seen
+}
+
+func record(seen *[]string, name string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		*seen = append(*seen, name)
+		c.Next()
+	}
+}
+
+func TestOrder(t *testing.T) {
+	var seen []string
+	c := chain.NewChain().
+		Use(chain.Rules, record(&seen, "rules")).
+		Use(chain.RateLimit, record(&seen, "ratelimit")).
+		Use(chain.IPFilter, record(&seen, "ipfilter"), record(&seen, "bans")).
+		Use(chain.Setup, record(&seen, "requestid"))
+
+	want := []string{"requestid", "ipfilter", "bans", "ratelimit", "rules"}
+	if got := run(c, &seen); !slices.Equal(got, want) {
+		t.Errorf("ran %v, want %v", got, want)
+	}
+}
+
+func TestWhen(t *testing.T) {
+	var seen []string
+	c := chain.NewChain().
+		Use(chain.IPFilter, chain.When(false, record(&seen, "ipfilter"))).
+		Use(chain.RateLimit, chain.When(true, record(&seen, "ratelimit")))
+
+	if got := c.Handlers(); len(got) != 1 {
+		t.Fatalf("%d handlers, want the enabled one", len(got))
+	}
+	if got := run(c, &seen); !slices.Equal(got, []string{"ratelimit"}) {
+		t.Errorf("ran %v, want [ratelimit]", got)
+	}
+}
+
+func TestBeforeAfter(t *testing.T) {
+	var seen []string
+	c := chain.NewChain().
+		Before(chain.RateLimit, "early").
+		After(chain.Rules, "late").
+		Use(chain.Rules, record(&seen, "rules")).
+		Use("late", record(&seen, "late")).
+		Use(chain.RateLimit, record(&seen, "ratelimit")).
+		Use("early", record(&seen, "early"))
+
+	want := []string{"early", "ratelimit", "rules", "late"}
+	if got := run(c, &seen); !slices.Equal(got, want) {
+		t.Errorf("ran %v, want %v", got, want)
+	}
+
+	positions := c.Positions()
+	if i := slices.Index(positions, "early"); i < 0 || positions[i+1] != chain.RateLimit {
+		t.Errorf("positions %v, want early right before ratelimit", positions)
+	}
+	if i := slices.Index(positions, "late"); i < 1 || positions[i-1] != chain.Rules {
+		t.Errorf("positions %v, want late right after rules", positions)
+	}
+}
+
+func TestUnknownPosition(t *testing.T) {
+	for name, build := range map[string]func(){
+		"use":       func() { chain.NewChain().Use("missing", nil) },
+		"before":    func() { chain.NewChain().Before("missing", "custom") },
+		"duplicate": func() { chain.NewChain().After(chain.Rules, chain.Setup) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("no panic")
+				}
+			}()
+			build()
+		})
+	}
+}
@@ -0,0 +1,241 @@
+package challenge
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"html/template"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jahrulnr/go-waf/internal/interface/repository"
+	"github.com/jahrulnr/go-waf/pkg/audit"
+	"github.com/jahrulnr/go-waf/pkg/block"
+	"github.com/jahrulnr/go-waf/pkg/bot"
+	"github.com/jahrulnr/go-waf/pkg/clientip"
+	"github.com/jahrulnr/go-waf/pkg/dryrun"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+//go:embed challenge.html
+var page string
+
+var pageTemplate = template.Must(template.New("challenge").Parse(page))
+
+// Options configures the challenge. Zero values take the defaults noted on
+// each field.
+type Options struct {
+	Difficulty   int           // leading zero bits of the proof of work, default 16
+	PassTTL      time.Duration // how long a solved challenge lets the client through, default 30m
+	ChallengeTTL time.Duration // time left to solve it, default 5m
+	Threshold    bot.BotScore  // bot score challenged from, default 30
+	Path         string        // where the page posts the solution, default /__waf/challenge
+	CookieName   string        // pass cookie, default gowaf_pass
+	Secure       bool          // send the pass cookie over https only
+}
+
+// Challenge answers suspected bots with a page that has to find a nonce whose
+// sha256, prefixed with a random challenge id, starts with Difficulty zero
+// bits. The solution buys a pass cookie bound to the client IP. Challenges
+// and passes live in the state store, so any instance sharing it accepts
+// them.
+type Challenge struct {
+	options Options
+	store   repository.StateStore
+	audit   *audit.Logger
+	dryRun  *dryrun.DryRun
+}
+
+func NewChallenge(store repository.StateStore, options Options) *Challenge {
+	if options.Difficulty <= 0 {
+		options.Difficulty = 16
+	}
+	if options.PassTTL <= 0 {
+		options.PassTTL = 30 * time.Minute
+	}
+	if options.ChallengeTTL <= 0 {
+		options.ChallengeTTL = 5 * time.Minute
+	}
+	if options.Threshold <= 0 {
+		options.Threshold = 30
+	}
+	if options.Path == "" {
+		options.Path = "/__waf/challenge"
+	}
+	if options.CookieName == "" {
+		options.CookieName = "gowaf_pass"
+	}
+
+	return &Challenge{
+		options: options,
+		store:   store,
+	}
+}
+
+// SetAudit writes every failed solution to the audit log.
+func (ch *Challenge) SetAudit(audit *audit.Logger) {
+	ch.audit = audit
+}
+
+// SetDryRun forwards the clients that would be challenged, only reporting
+// them.
+func (ch *Challenge) SetDryRun(dryRun *dryrun.DryRun) {
+	ch.dryRun = dryRun
+}
+
+// Middleware challenges the requests scored at least Threshold by the bot
+// middleware, which must run before it. Without bot scores every client is
+// challenged. Clients holding a valid pass go through.
+func (ch *Challenge) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.URL.Path == ch.options.Path && c.Request.Method == http.MethodPost {
+			ch.verify(c)
+			return
+		}
+
+		if score, _, found := bot.FromContext(c); found && score < ch.options.Threshold {
+			c.Next()
+			return
+		}
+		if ch.passed(c) || ch.dryRun.Forward(c, audit.Record{Source: "challenge", Action: "challenge", Status: http.StatusForbidden}) {
+			c.Next()
+			return
+		}
+
+		ch.issue(c)
+	}
+}
+
+func (ch *Challenge) passed(c *gin.Context) bool {
+	token, err := c.Cookie(ch.options.CookieName)
+	if err != nil || token == "" {
+		return false
+	}
+
+	ip, ok := ch.store.StateContext(c.Request.Context()).Get(key("pass", token))
+	return ok && string(ip) == clientip.FromContext(c)
+}
+
+// issue stores a new challenge and answers with the page solving it.
+func (ch *Challenge) issue(c *gin.Context) {
+	id := random()
+	err := ch.store.StateContext(c.Request.Context()).Set(key("challenge", id), []byte(strconv.Itoa(ch.options.Difficulty)), ch.options.ChallengeTTL)
+	if err != nil {
+		logger.FromContext(c.Request.Context()).Logger("[warn] fail to store challenge ", err.Error()).Warn()
+		c.String(http.StatusServiceUnavailable, "503 | Service Unavailable.")
+		c.Abort()
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Status(http.StatusForbidden)
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	err = pageTemplate.Execute(c.Writer, map[string]interface{}{
+		"Path":       ch.options.Path,
+		"ID":         id,
+		"Difficulty": ch.options.Difficulty,
+		"Redirect":   c.Request.URL.RequestURI(),
+	})
+	if err != nil {
+		logger.FromContext(c.Request.Context()).Logger("[warn] fail to render challenge ", err.Error()).Warn()
+	}
+	c.Abort()
+}
+
+// verify checks a posted solution. A challenge can only be tried once.
+func (ch *Challenge) verify(c *gin.Context) {
+	defer c.Abort()
+
+	id, nonce := c.PostForm("id"), c.PostForm("nonce")
+	cache := ch.store.StateContext(c.Request.Context())
+	difficulty, ok := cache.Get(key("challenge", id))
+	if ok {
+		// only the request removing it gets to try
+		ok, _ = cache.CompareAndRemove(key("challenge", id), difficulty)
+	}
+	if id == "" || !ok {
+		ch.fail(c, "unknown challenge")
+		return
+	}
+
+	required, _ := strconv.Atoi(string(difficulty))
+	if len(nonce) > 20 || !Solved(id, nonce, required) {
+		ch.fail(c, "wrong solution")
+		return
+	}
+
+	token := random()
+	if err := cache.Set(key("pass", token), []byte(clientip.FromContext(c)), ch.options.PassTTL); err != nil {
+		logger.FromContext(c.Request.Context()).Logger("[warn] fail to store challenge pass ", err.Error()).Warn()
+		c.String(http.StatusServiceUnavailable, "503 | Service Unavailable.")
+		return
+	}
+
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     ch.options.CookieName,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(ch.options.PassTTL.Seconds()),
+		Secure:   ch.options.Secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	c.Redirect(http.StatusSeeOther, redirect(c.PostForm("redirect")))
+}
+
+func (ch *Challenge) fail(c *gin.Context, reason string) {
+	logger.FromContext(c.Request.Context()).Logger("[warn] challenge failed ", clientip.FromContext(c), " ", reason).Warn()
+	record := audit.Record{
+		Source: "challenge",
+		Action: "challenge",
+		Status: http.StatusForbidden,
+	}
+	ch.audit.Log(c.Request, clientip.FromContext(c), record)
+	decision := block.FromRecord(record)
+	decision.Reason = reason
+	if block.Respond(c, decision) {
+		return
+	}
+	c.String(http.StatusForbidden, "403 | Forbidden.")
+}
+
+// Solved reports whether sha256(id + nonce) starts with difficulty zero bits.
+func Solved(id string, nonce string, difficulty int) bool {
+	sum := sha256.Sum256([]byte(id + nonce))
+	zeros := 0
+	for _, b := range sum {
+		zeros += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+
+	return zeros >= difficulty
+}
+
+// redirect only sends the client back to a path of this site.
+func redirect(target string) string {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") {
+		return "/"
+	}
+
+	return target
+}
+
+// key hashes the client supplied id, which never reaches the cache as is.
+func key(kind string, id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return "gowaf-" + kind + "-" + hex.EncodeToString(sum[:16])
+}
+
+func random() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,191 @@
+package clientip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// contextKey and keyContextKey are the gin context keys Middleware stores
+// the client IP and its key under.
+const (
+	contextKey    = "clientip"
+	keyContextKey = "clientip-key"
+)
+
+// DefaultPrefix is the IPv6 prefix clients are keyed by, a /64 is what a
+// single subscriber usually gets.
+const DefaultPrefix = 64
+
+// Key returns what ip is counted and banned under: an IPv4 address itself,
+// also when mapped into IPv6, and the network address of its first prefix
+// bits for IPv6, e.g. 2001:db8:1:2:: for any address of 2001:db8:1:2::/64.
+// A prefix outside 1-128 takes DefaultPrefix. An IPv6 client controls a
+// whole network, keying each address would let it walk around rate limits
+// and bans.
+func Key(ip net.IP, prefix int) string {
+	if ip == nil {
+		return ""
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4.String()
+	}
+	if prefix < 1 || prefix > 128 {
+		prefix = DefaultPrefix
+	}
+
+	return ip.Mask(net.CIDRMask(prefix, 128)).String()
+}
+
+// ParseKey returns the key of an address in any form, compressed, expanded,
+// bracketed or IPv4 mapped, ok is false when value isn't one.
+func ParseKey(value string, prefix int) (string, bool) {
+	ip := parseIP(value)
+	if ip == nil {
+		return "", false
+	}
+
+	return Key(ip, prefix), true
+}
+
+// ParseTrusted reads a list of proxy addresses or CIDR ranges.
+func ParseTrusted(list []string) ([]net.IPNet, error) {
+	var trusted []net.IPNet
+	for _, entry := range list {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			trusted = append(trusted, net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+		}
+		trusted = append(trusted, *network)
+	}
+
+	return trusted, nil
+}
+
+func isTrusted(ip net.IP, trusted []net.IPNet) bool {
+	for _, network := range trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseIP reads an address as found in headers and RemoteAddr, with or
+// without port, brackets or zone.
+func parseIP(value string) net.IP {
+	value = strings.TrimSpace(value)
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		value = host
+	}
+	value = strings.Trim(value, "[]")
+	if zone := strings.IndexByte(value, '%'); zone >= 0 {
+		value = value[:zone]
+	}
+
+	return net.ParseIP(value)
+}
+
+// RealIP returns the address of the client that sent r. Forwarded headers
+// are only read when the direct peer is trusted. X-Forwarded-For is walked
+// right to left, every hop appended by a trusted proxy is skipped and the
+// first untrusted one is the client, whatever the client forged to its left.
+// Without X-Forwarded-For a trusted peer may set X-Real-IP.
+func RealIP(r *http.Request, trusted []net.IPNet) net.IP {
+	peer := parseIP(r.RemoteAddr)
+	if peer == nil || !isTrusted(peer, trusted) {
+		return peer
+	}
+
+	// a client can send several headers, proxies append to the last one
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	var client net.IP
+	for i := len(hops) - 1; i >= 0; i-- {
+		if strings.TrimSpace(hops[i]) == "" {
+			continue
+		}
+
+		ip := parseIP(hops[i])
+		if ip == nil {
+			// garbage can only come from the untrusted side of the chain
+			break
+		}
+		if !isTrusted(ip, trusted) {
+			return ip
+		}
+		client = ip
+	}
+
+	if client != nil {
+		// the hops left of here are not reliable, or all were our proxies
+		return client
+	}
+	if r.Header.Get("X-Forwarded-For") != "" {
+		return peer
+	}
+
+	if ip := parseIP(r.Header.Get("X-Real-IP")); ip != nil {
+		return ip
+	}
+
+	return peer
+}
+
+// Middleware resolves the client IP once per request for FromContext, and
+// its key by the IPv6 prefix for KeyFromContext.
+func Middleware(trusted []net.IPNet, prefix int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if ip := RealIP(c.Request, trusted); ip != nil {
+			c.Set(contextKey, ip.String())
+			c.Set(keyContextKey, Key(ip, prefix))
+		}
+
+		c.Next()
+	}
+}
+
+// FromContext returns the client IP resolved by Middleware. Without it only
+// the direct peer is known.
+func FromContext(c *gin.Context) string {
+	if ip := c.GetString(contextKey); ip != "" {
+		return ip
+	}
+
+	if ip := RealIP(c.Request, nil); ip != nil {
+		return ip.String()
+	}
+
+	return ""
+}
+
+// KeyFromContext returns the key of the client IP, see Key. Without
+// Middleware the direct peer is keyed by DefaultPrefix.
+func KeyFromContext(c *gin.Context) string {
+	if key := c.GetString(keyContextKey); key != "" {
+		return key
+	}
+
+	return Key(RealIP(c.Request, nil), DefaultPrefix)
+}
@@ -0,0 +1,153 @@
+package clientip_test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jahrulnr/go-waf/pkg/clientip"
+)
+
+func TestRealIP(t *testing.T) {
+	trusted, err := clientip.ParseTrusted([]string{"10.0.0.0/8", "fd00::/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		peer   string
+		xff    []string
+		realIP string
+		want   string
+	}{
+		{name: "untrusted peer ignores the headers", peer: "203.0.113.5:1234", xff: []string{"198.51.100.7"}, realIP: "198.51.100.8", want: "203.0.113.5"},
+		{name: "trusted peer without headers", peer: "10.0.0.1:1234", want: "10.0.0.1"},
+		{name: "single hop", peer: "10.0.0.1:1234", xff: []string{"198.51.100.7"}, want: "198.51.100.7"},
+		{name: "single trusted address", peer: "192.0.2.1:1234", xff: []string{"198.51.100.7"}, want: "198.51.100.7"},
+
+		// the client may send any X-Forwarded-For, proxies append to it
+		{name: "spoofed left-most entry", peer: "10.0.0.1:1234", xff: []string{"6.6.6.6, 198.51.100.7"}, want: "198.51.100.7"},
+		{name: "spoofed entries behind trusted hops", peer: "10.0.0.1:1234", xff: []string{"6.6.6.6, 7.7.7.7, 198.51.100.7, 10.0.0.3, 10.0.0.2"}, want: "198.51.100.7"},
+		{name: "spoofed trusted left-most entry", peer: "10.0.0.1:1234", xff: []string{"10.9.9.9, 198.51.100.7"}, want: "198.51.100.7"},
+		{name: "spoofed header before the proxy one", peer: "10.0.0.1:1234", xff: []string{"6.6.6.6", "198.51.100.7"}, want: "198.51.100.7"},
+
+		// a chain of our own proxies, the left-most one is the client
+		{name: "all trusted", peer: "10.0.0.1:1234", xff: []string{"10.0.0.3, 10.0.0.2"}, want: "10.0.0.3"},
+		{name: "all trusted single hop", peer: "10.0.0.1:1234", xff: []string{"10.0.0.2"}, want: "10.0.0.2"},
+
+		{name: "malformed left of the client", peer: "10.0.0.1:1234", xff: []string{"not-an-ip, 198.51.100.7"}, want: "198.51.100.7"},
+		{name: "malformed right-most entry", peer: "10.0.0.1:1234", xff: []string{"198.51.100.7, garbage"}, want: "10.0.0.1"},
+		{name: "malformed behind a trusted hop", peer: "10.0.0.1:1234", xff: []string{"garbage, 10.0.0.2"}, want: "10.0.0.2"},
+		{name: "only malformed", peer: "10.0.0.1:1234", xff: []string{"unknown"}, want: "10.0.0.1"},
+		{name: "empty entries", peer: "10.0.0.1:1234", xff: []string{" , 198.51.100.7,, "}, want: "198.51.100.7"},
+		{name: "entry with port", peer: "10.0.0.1:1234", xff: []string{"198.51.100.7:5555"}, want: "198.51.100.7"},
+
+		{name: "ipv6 peer untrusted", peer: "[2001:db8::1]:443", xff: []string{"198.51.100.7"}, want: "2001:db8::1"},
+		{name: "ipv6 hops", peer: "[fd00::1]:443", xff: []string{"2001:db8::2, fd00::2"}, want: "2001:db8::2"},
+		{name: "ipv6 spoofed left-most", peer: "[fd00::1]:443", xff: []string{"2001:db8::666, 2001:db8::2"}, want: "2001:db8::2"},
+		{name: "ipv6 bracketed with port", peer: "[fd00::1]:443", xff: []string{"[2001:db8::9]:1234"}, want: "2001:db8::9"},
+		{name: "ipv6 with zone", peer: "[fd00::1]:443", xff: []string{"fe80::1%eth0"}, want: "fe80::1"},
+		{name: "ipv6 all trusted", peer: "[fd00::1]:443", xff: []string{"fd00::3, fd00::2"}, want: "fd00::3"},
+		{name: "ipv4 mapped peer", peer: "[::ffff:10.0.0.1]:80", xff: []string{"198.51.100.7"}, want: "198.51.100.7"},
+
+		{name: "x-real-ip from a trusted peer", peer: "10.0.0.1:1234", realIP: "198.51.100.9", want: "198.51.100.9"},
+		{name: "x-forwarded-for wins over x-real-ip", peer: "10.0.0.1:1234", xff: []string{"198.51.100.7"}, realIP: "198.51.100.9", want: "198.51.100.7"},
+		{name: "malformed x-real-ip", peer: "10.0.0.1:1234", realIP: "nope", want: "10.0.0.1"},
+		{name: "bad peer", peer: "pipe", want: "<nil>"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = test.peer
+			for _, value := range test.xff {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			if test.realIP != "" {
+				r.Header.Set("X-Real-IP", test.realIP)
+			}
+
+			if got := clientip.RealIP(r, trusted).String(); got != test.want {
+				t.Errorf("RealIP = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseTrusted(t *testing.T) {
+	tests := []struct {
+		name    string
+		list    []string
+		size    int
+		wantErr bool
+	}{
+		{name: "addresses and ranges", list: []string{"10.0.0.0/8", " 192.0.2.1 ", "2001:db8::1", "fd00::/8"}, size: 4},
+		{name: "empty entries", list: []string{"", " "}, size: 0},
+		{name: "bad address", list: []string{"10.0.0.300"}, wantErr: true},
+		{name: "bad range", list: []string{"10.0.0.0/33"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			trusted, err := clientip.ParseTrusted(test.list)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error %v, want error %v", err, test.wantErr)
+			}
+			if len(trusted) != test.size {
+				t.Errorf("%d networks, want %d", len(trusted), test.size)
+			}
+		})
+	}
+}
+
+func TestKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		ip     string
+		prefix int
+		want   string
+	}{
+		{name: "ipv4", ip: "198.51.100.7", prefix: 64, want: "198.51.100.7"},
+		{name: "ipv4 ignores the prefix", ip: "198.51.100.7", prefix: 8, want: "198.51.100.7"},
+		{name: "ipv4 mapped", ip: "::ffff:198.51.100.7", prefix: 64, want: "198.51.100.7"},
+		{name: "ipv6 by its /64", ip: "2001:db8:1:2:aaaa:bbbb:cccc:dddd", prefix: 64, want: "2001:db8:1:2::"},
+		{name: "ipv6 by its /48", ip: "2001:db8:1:2::1", prefix: 48, want: "2001:db8:1::"},
+		{name: "ipv6 by its address", ip: "2001:db8:1:2::1", prefix: 128, want: "2001:db8:1:2::1"},
+		{name: "prefix out of range", ip: "2001:db8:1:2::1", prefix: 129, want: "2001:db8:1:2::"},
+		{name: "no prefix", ip: "2001:db8:1:2::1", prefix: 0, want: "2001:db8:1:2::"},
+		{name: "no address", ip: "", prefix: 64, want: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := clientip.Key(net.ParseIP(test.ip), test.prefix); got != test.want {
+				t.Errorf("Key(%s, %d) = %q, want %q", test.ip, test.prefix, got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	tests := []struct {
+		value  string
+		want   string
+		wantOk bool
+	}{
+		{value: "2001:db8:1:2::1", want: "2001:db8:1:2::", wantOk: true},
+		{value: "2001:0db8:0001:0002:0000:0000:0000:0009", want: "2001:db8:1:2::", wantOk: true},
+		{value: "[2001:db8:1:2::1]", want: "2001:db8:1:2::", wantOk: true},
+		{value: "198.51.100.7", want: "198.51.100.7", wantOk: true},
+		{value: "not-an-ip", wantOk: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			got, ok := clientip.ParseKey(test.value, clientip.DefaultPrefix)
+			if got != test.want || ok != test.wantOk {
+				t.Errorf("ParseKey(%s) = %q %v, want %q %v", test.value, got, ok, test.want, test.wantOk)
+			}
+		})
+	}
+}
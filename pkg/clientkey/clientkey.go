@@ -0,0 +1,129 @@
+package clientkey
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/jahrulnr/go-waf/pkg/auth/jwt"
+	"github.com/jahrulnr/go-waf/pkg/clientip"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Func returns the key a request is counted and banned under, empty when
+// the request has none of the kind.
+type Func func(c *gin.Context) string
+
+// IP keys a request by the client IP of clientip.Middleware, an IPv6 client
+// by its network, see clientip.Key.
+func IP(c *gin.Context) string {
+	return clientip.KeyFromContext(c)
+}
+
+// Subject keys a request by the sub claim of its token. The jwt middleware
+// must have run before, see jwt.Subject. The subject is escaped, the file
+// cache names files after the keys.
+func Subject(c *gin.Context) string {
+	subject, ok := jwt.Subject(c.Request.Context())
+	if !ok {
+		return ""
+	}
+
+	return "sub:" + url.PathEscape(subject)
+}
+
+// Header keys a request by the value of header, e.g. an API key. The value
+// is hashed, so keys never end up in cache key names or logs.
+func Header(header string) Func {
+	header = http.CanonicalHeaderKey(header)
+	return func(c *gin.Context) string {
+		value := c.GetHeader(header)
+		if value == "" {
+			return ""
+		}
+		sum := sha256.Sum256([]byte(value))
+
+		return "header:" + header + ":" + hex.EncodeToString(sum[:16])
+	}
+}
+
+// All keys a request by every part, joined, e.g. a subject per IP. It is
+// empty when a part is.
+func All(parts ...Func) Func {
+	return func(c *gin.Context) string {
+		keys := make([]string, len(parts))
+		for i, part := range parts {
+			if keys[i] = part(c); keys[i] == "" {
+				return ""
+			}
+		}
+
+		return strings.Join(keys, "|")
+	}
+}
+
+// First keys a request by the first key it has, falling back to IP when it
+// has none, e.g. First(Subject) keys anonymous requests by IP.
+func First(keys ...Func) Func {
+	return func(c *gin.Context) string {
+		for _, key := range keys {
+			if value := key(c); value != "" {
+				return value
+			}
+		}
+
+		return IP(c)
+	}
+}
+
+// Spec is a parsed key setting.
+type Spec struct {
+	Func    Func
+	Subject bool // the subject is taken, the jwt middleware must run first
+}
+
+// Parse reads comma separated keys, tried in order with the IP as the last
+// resort. A key is ip, subject or header:<name>, or several joined by +,
+// e.g. subject,header:X-API-Key+ip.
+func Parse(value string) (Spec, error) {
+	var spec Spec
+	var keys []Func
+	for _, alternative := range strings.Split(value, ",") {
+		alternative = strings.TrimSpace(alternative)
+		if alternative == "" {
+			continue
+		}
+
+		var parts []Func
+		for _, part := range strings.Split(alternative, "+") {
+			part = strings.TrimSpace(part)
+			name, header, _ := strings.Cut(part, ":")
+			switch strings.ToLower(name) {
+			case "ip":
+				parts = append(parts, IP)
+			case "subject":
+				parts = append(parts, Subject)
+				spec.Subject = true
+			case "header":
+				if strings.TrimSpace(header) == "" {
+					return Spec{}, fmt.Errorf("key %q must name its header, e.g. header:X-API-Key", part)
+				}
+				parts = append(parts, Header(strings.TrimSpace(header)))
+			default:
+				return Spec{}, fmt.Errorf("unknown key %q, want ip, subject or header:<name>", part)
+			}
+		}
+		if len(parts) == 1 {
+			keys = append(keys, parts[0])
+		} else {
+			keys = append(keys, All(parts...))
+		}
+	}
+	spec.Func = First(keys...)
+
+	return spec, nil
+}
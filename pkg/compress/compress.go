@@ -0,0 +1,336 @@
+package compress
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	Brotli = "br"
+	Gzip   = "gzip"
+)
+
+// DefaultContentTypes are the media types compressed when Options.ContentTypes
+// is empty. Images, archives and media are compressed already.
+var DefaultContentTypes = []string{
+	"text/html", "text/plain", "text/css", "text/javascript", "text/csv", "text/xml", "text/markdown",
+	"application/json", "application/javascript", "application/xml", "application/wasm",
+	"image/svg+xml", "*+json", "*+xml",
+}
+
+// Options configures the compression. Zero values take the defaults noted on
+// each field.
+type Options struct {
+	Encodings    []string // preferred first, default br then gzip
+	MinLength    int      // smaller bodies are sent as is, default 1024
+	GzipLevel    int      // 1 to 9, default 6
+	BrotliLevel  int      // 0 to 11, default 4
+	ContentTypes []string // text/html, text/*, or *+json for a suffix, default DefaultContentTypes
+}
+
+// Compressor encodes response bodies with the best encoding the client
+// accepts. Bodies are encoded on the way out only, so a response cache behind
+// it stores and serves the uncompressed form to every client.
+type Compressor struct {
+	options Options
+	pools   map[string]*sync.Pool
+}
+
+// encoder is implemented by both gzip.Writer and brotli.Writer.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+func NewCompressor(options Options) *Compressor {
+	if len(options.Encodings) == 0 {
+		options.Encodings = []string{Brotli, Gzip}
+	}
+	if options.MinLength <= 0 {
+		options.MinLength = 1024
+	}
+	if options.GzipLevel < gzip.BestSpeed || options.GzipLevel > gzip.BestCompression {
+		options.GzipLevel = 6
+	}
+	if options.BrotliLevel <= 0 || options.BrotliLevel > brotli.BestCompression {
+		options.BrotliLevel = 4
+	}
+	if len(options.ContentTypes) == 0 {
+		options.ContentTypes = DefaultContentTypes
+	}
+
+	c := &Compressor{options: options, pools: make(map[string]*sync.Pool)}
+	var encodings []string
+	for _, encoding := range options.Encodings {
+		switch encoding = strings.ToLower(strings.TrimSpace(encoding)); encoding {
+		case Brotli:
+			c.pools[encoding] = &sync.Pool{New: func() interface{} {
+				return brotli.NewWriterLevel(io.Discard, options.BrotliLevel)
+			}}
+		case Gzip:
+			c.pools[encoding] = &sync.Pool{New: func() interface{} {
+				w, _ := gzip.NewWriterLevel(io.Discard, options.GzipLevel)
+				return w
+			}}
+		default:
+			continue
+		}
+		encodings = append(encodings, encoding)
+	}
+	c.options.Encodings = encodings
+
+	return c
+}
+
+// Negotiate picks the encoding of acceptEncoding with the highest q value,
+// ties going to the one listed first in supported. It returns "" when none
+// is acceptable.
+func Negotiate(acceptEncoding string, supported []string) string {
+	quality := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		if value, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				q = parsed
+			}
+		}
+		quality[name] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, encoding := range supported {
+		q, ok := quality[encoding]
+		if !ok {
+			q, ok = quality["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+
+	return best
+}
+
+// Compressible reports whether a body of contentType is worth compressing.
+func (c *Compressor) Compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range c.options.ContentTypes {
+		switch {
+		case pattern == mediaType:
+			return true
+		case strings.HasPrefix(pattern, "*+"):
+			if strings.HasSuffix(mediaType, pattern[1:]) {
+				return true
+			}
+		case strings.HasSuffix(pattern, "/*"):
+			if strings.HasPrefix(mediaType, pattern[:len(pattern)-1]) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Middleware compresses the responses. Bodies are held back until MinLength
+// bytes were written or the handler returns, the headers are decided then.
+// Responses carrying a Content-Encoding already are passed on untouched.
+func (c *Compressor) Middleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		// an upgraded connection isn't an http body to compress
+		if ctx.Request.Method == http.MethodHead || ctx.GetHeader("Upgrade") != "" || ctx.GetHeader("Range") != "" {
+			ctx.Next()
+			return
+		}
+
+		writer := &compressWriter{
+			ResponseWriter: ctx.Writer,
+			compressor:     c,
+			encoding:       Negotiate(ctx.GetHeader("Accept-Encoding"), c.options.Encodings),
+		}
+		ctx.Writer = writer
+		defer func() {
+			writer.finish()
+			// gin writes the 404 and 405 pages after the chain returned
+			ctx.Writer = writer.ResponseWriter
+		}()
+
+		ctx.Next()
+	}
+}
+
+// compressWriter buffers the start of the body to decide whether it gets
+// compressed, then writes through the encoder or straight on.
+type compressWriter struct {
+	gin.ResponseWriter
+	compressor *Compressor
+	encoding   string // negotiated, "" when the client accepts none
+
+	buf      []byte
+	decided  bool
+	encoder  encoder
+	flushed  bool
+	finished bool
+}
+
+// decide sets the headers of the response, done once before the first byte
+// reaches the client.
+func (w *compressWriter) decide(final bool) {
+	if w.decided {
+		return
+	}
+	w.decided = true
+
+	header := w.ResponseWriter.Header()
+	if !w.eligible(header) {
+		return
+	}
+	addVary(header, "Accept-Encoding")
+	if w.encoding == "" || (final && len(w.buf) < w.compressor.options.MinLength) {
+		return
+	}
+
+	enc := w.compressor.pools[w.encoding].Get().(encoder)
+	enc.Reset(w.ResponseWriter)
+	w.encoder = enc
+
+	header.Set("Content-Encoding", w.encoding)
+	header.Del("Content-Length")
+	// the compressed body is a different representation
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+}
+
+func (w *compressWriter) eligible(header http.Header) bool {
+	switch status := w.ResponseWriter.Status(); {
+	case status < http.StatusOK, status == http.StatusNoContent, status == http.StatusNotModified:
+		return false
+	}
+	if encoding := header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return false
+	}
+	if header.Get("Content-Range") != "" || strings.Contains(header.Get("Cache-Control"), "no-transform") {
+		return false
+	}
+	if length, err := strconv.Atoi(header.Get("Content-Length")); err == nil && length < w.compressor.options.MinLength {
+		return false
+	}
+
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(w.buf)
+	}
+
+	return w.compressor.Compressible(contentType)
+}
+
+func (w *compressWriter) Write(data []byte) (int, error) {
+	if !w.decided {
+		w.buf = append(w.buf, data...)
+		if len(w.buf) < w.compressor.options.MinLength {
+			return len(data), nil
+		}
+		if err := w.flushBuffer(false); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	}
+
+	if w.encoder != nil {
+		return w.encoder.Write(data)
+	}
+
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *compressWriter) WriteString(data string) (int, error) {
+	return w.Write([]byte(data))
+}
+
+// flushBuffer decides and writes what was held back.
+func (w *compressWriter) flushBuffer(final bool) error {
+	w.decide(final)
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	if w.encoder != nil {
+		_, err := w.encoder.Write(buf)
+		return err
+	}
+	_, err := w.ResponseWriter.Write(buf)
+
+	return err
+}
+
+// WriteHeaderNow is held back with the body, the headers aren't final yet.
+func (w *compressWriter) WriteHeaderNow() {
+	w.flushed = true
+}
+
+func (w *compressWriter) Written() bool {
+	return w.flushed || len(w.buf) > 0 || w.ResponseWriter.Written()
+}
+
+// Flush sends what was written so far, a streamed response is compressed
+// whatever its length.
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		w.flushBuffer(false)
+	}
+	if w.encoder != nil {
+		w.encoder.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+func (w *compressWriter) finish() {
+	if w.finished {
+		return
+	}
+	w.finished = true
+
+	if !w.decided && (len(w.buf) > 0 || w.flushed) {
+		w.flushBuffer(true)
+	}
+	if w.encoder != nil {
+		w.encoder.Close()
+		w.encoder.Reset(io.Discard)
+		w.compressor.pools[w.encoding].Put(w.encoder)
+		w.encoder = nil
+	}
+	if w.flushed {
+		w.ResponseWriter.WriteHeaderNow()
+	}
+}
+
+// addVary adds name to Vary unless it is listed already.
+func addVary(header http.Header, name string) {
+	for _, value := range header.Values("Vary") {
+		for _, listed := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(listed), name) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", name)
+}
@@ -0,0 +1,432 @@
+package config
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/ilyakaznacheev/cleanenv"
+)
+
+// env is read when Load is given no path.
+const env = ".env"
+
+type Config struct {
+	CONFIG_FILE string `env:"WAF_CONFIG_FILE,CONFIG_FILE"` // YAML file the settings come from, reloaded when it changes
+
+	ADDR             string `env:"WAF_ADDR,ADDR" env-default:":8080"`
+	SHUTDOWN_TIMEOUT int    `env:"WAF_SHUTDOWN_TIMEOUT,SHUTDOWN_TIMEOUT" env-default:"30"` // seconds to drain requests and stop background work on SIGTERM
+
+	READ_HEADER_TIMEOUT int   `env:"WAF_READ_HEADER_TIMEOUT,READ_HEADER_TIMEOUT" env-default:"10"`    // seconds to read a request header
+	READ_BODY_TIMEOUT   int   `env:"WAF_READ_BODY_TIMEOUT,READ_BODY_TIMEOUT" env-default:"60"`        // seconds to read a request body, 0 unlimited
+	IDLE_TIMEOUT        int   `env:"WAF_IDLE_TIMEOUT,IDLE_TIMEOUT" env-default:"120"`                 // seconds keep-alive connections stay open without a request
+	MIN_DATA_RATE       int64 `env:"WAF_MIN_DATA_RATE,MIN_DATA_RATE" env-default:"240"`               // bytes per second a request body has to come in at, 0 turns it off
+	MIN_DATA_RATE_GRACE int   `env:"WAF_MIN_DATA_RATE_GRACE,MIN_DATA_RATE_GRACE" env-default:"5"`     // seconds before MIN_DATA_RATE applies
+	SLOW_CLIENT_AUTOBAN bool  `env:"WAF_SLOW_CLIENT_AUTOBAN,SLOW_CLIENT_AUTOBAN" env-default:"false"` // count cut slow clients as violations, requires USE_AUTOBAN
+
+	HOST              string `env:"WAF_HOST,HOST"`
+	HOST_DESTINATION  string `env:"WAF_HOST_DESTINATION,HOST_DESTINATION" env-default:"https://www.google.com"`
+	IGNORE_SSL_VERIFY bool   `env:"WAF_IGNORE_SSL_VERIFY,IGNORE_SSL_VERIFY" env-default:"false"`
+
+	PROXY_UPSTREAMS string `env:"WAF_PROXY_UPSTREAMS,PROXY_UPSTREAMS"`                         // comma separated upstream urls with optional |weight, default HOST_DESTINATION
+	PROXY_STRATEGY  string `env:"WAF_PROXY_STRATEGY,PROXY_STRATEGY" env-default:"round_robin"` // round_robin, random, least_connections or consistent_hash
+
+	PROXY_HASH_KEY      string `env:"WAF_PROXY_HASH_KEY,PROXY_HASH_KEY" env-default:"path"`          // consistent_hash key: path, header:<name> or query:<name>
+	PROXY_HASH_REPLICAS int    `env:"WAF_PROXY_HASH_REPLICAS,PROXY_HASH_REPLICAS" env-default:"160"` // virtual nodes per unit of upstream weight
+
+	PROXY_HEALTH_CHECK    bool   `env:"WAF_PROXY_HEALTH_CHECK,PROXY_HEALTH_CHECK" env-default:"false"`
+	PROXY_HEALTH_PATH     string `env:"WAF_PROXY_HEALTH_PATH,PROXY_HEALTH_PATH" env-default:"/"`
+	PROXY_HEALTH_INTERVAL int    `env:"WAF_PROXY_HEALTH_INTERVAL,PROXY_HEALTH_INTERVAL" env-default:"10"` // seconds between probes
+	PROXY_HEALTH_TIMEOUT  int    `env:"WAF_PROXY_HEALTH_TIMEOUT,PROXY_HEALTH_TIMEOUT" env-default:"2"`    // seconds per probe
+	PROXY_HEALTH_FALL     int    `env:"WAF_PROXY_HEALTH_FALL,PROXY_HEALTH_FALL" env-default:"3"`          // consecutive failures marking an upstream down
+	PROXY_HEALTH_RISE     int    `env:"WAF_PROXY_HEALTH_RISE,PROXY_HEALTH_RISE" env-default:"2"`          // consecutive passes marking it up again
+
+	PROXY_BREAKER              bool    `env:"WAF_PROXY_BREAKER,PROXY_BREAKER" env-default:"false"`
+	PROXY_BREAKER_RATIO        float64 `env:"WAF_PROXY_BREAKER_RATIO,PROXY_BREAKER_RATIO" env-default:"0.5"`              // failure ratio opening the breaker
+	PROXY_BREAKER_MIN_REQUESTS int     `env:"WAF_PROXY_BREAKER_MIN_REQUESTS,PROXY_BREAKER_MIN_REQUESTS" env-default:"10"` // requests in the window before it may open
+	PROXY_BREAKER_WINDOW       int     `env:"WAF_PROXY_BREAKER_WINDOW,PROXY_BREAKER_WINDOW" env-default:"10"`             // rolling window in seconds
+	PROXY_BREAKER_TIMEOUT      int     `env:"WAF_PROXY_BREAKER_TIMEOUT,PROXY_BREAKER_TIMEOUT" env-default:"30"`           // seconds open before probing again
+	PROXY_BREAKER_HALF_OPEN    int     `env:"WAF_PROXY_BREAKER_HALF_OPEN,PROXY_BREAKER_HALF_OPEN" env-default:"1"`        // probes that must pass to close
+
+	PROXY_RETRY_ATTEMPTS    int    `env:"WAF_PROXY_RETRY_ATTEMPTS,PROXY_RETRY_ATTEMPTS" env-default:"1"`          // attempts per request, 1 disables retries
+	PROXY_RETRY_BACKOFF     int    `env:"WAF_PROXY_RETRY_BACKOFF,PROXY_RETRY_BACKOFF" env-default:"50"`           // first backoff in milliseconds, doubled per retry
+	PROXY_RETRY_MAX_BACKOFF int    `env:"WAF_PROXY_RETRY_MAX_BACKOFF,PROXY_RETRY_MAX_BACKOFF" env-default:"1000"` // backoff cap in milliseconds
+	PROXY_RETRY_METHODS     string `env:"WAF_PROXY_RETRY_METHODS,PROXY_RETRY_METHODS" env-default:"GET,HEAD,OPTIONS,TRACE,PUT,DELETE"`
+	PROXY_RETRY_STATUSES    string `env:"WAF_PROXY_RETRY_STATUSES,PROXY_RETRY_STATUSES" env-default:"502,503,504"`
+	PROXY_RETRY_BODY_LIMIT  int64  `env:"WAF_PROXY_RETRY_BODY_LIMIT,PROXY_RETRY_BODY_LIMIT" env-default:"65536"` // larger request bodies are never retried
+
+	PROXY_STICKY        bool   `env:"WAF_PROXY_STICKY,PROXY_STICKY" env-default:"false"`                        // route every client to the same upstream
+	PROXY_STICKY_KEY    string `env:"WAF_PROXY_STICKY_KEY,PROXY_STICKY_KEY" env-default:"cookie"`               // cookie or ip
+	PROXY_STICKY_COOKIE string `env:"WAF_PROXY_STICKY_COOKIE,PROXY_STICKY_COOKIE" env-default:"gowaf_upstream"` // set by the proxy for the cookie key
+	PROXY_STICKY_TTL    int    `env:"WAF_PROXY_STICKY_TTL,PROXY_STICKY_TTL" env-default:"3600"`                 // seconds the cookie and the mapping in the cache last
+	PROXY_STICKY_SECURE bool   `env:"WAF_PROXY_STICKY_SECURE,PROXY_STICKY_SECURE" env-default:"false"`          // https only cookie
+
+	PROXY_MIRROR             string  `env:"WAF_PROXY_MIRROR,PROXY_MIRROR"`                                           // upstream url receiving a copy of the requests, its responses are discarded
+	PROXY_MIRROR_PERCENT     float64 `env:"WAF_PROXY_MIRROR_PERCENT,PROXY_MIRROR_PERCENT" env-default:"100"`         // share of requests mirrored, from 0 to 100
+	PROXY_MIRROR_BODY_LIMIT  int64   `env:"WAF_PROXY_MIRROR_BODY_LIMIT,PROXY_MIRROR_BODY_LIMIT" env-default:"65536"` // requests with larger bodies are not mirrored
+	PROXY_MIRROR_TIMEOUT     int     `env:"WAF_PROXY_MIRROR_TIMEOUT,PROXY_MIRROR_TIMEOUT" env-default:"5"`           // seconds per mirrored request
+	PROXY_MIRROR_CONCURRENCY int     `env:"WAF_PROXY_MIRROR_CONCURRENCY,PROXY_MIRROR_CONCURRENCY" env-default:"100"` // mirrored requests in flight, more are not mirrored
+	PROXY_MIRROR_COMPARE     bool    `env:"WAF_PROXY_MIRROR_COMPARE,PROXY_MIRROR_COMPARE" env-default:"false"`       // log status and size differences
+
+	PROXY_COALESCE          bool `env:"WAF_PROXY_COALESCE,PROXY_COALESCE" env-default:"false"`                     // identical GET and HEAD requests in flight share one upstream response
+	PROXY_COALESCE_MAX_BODY int  `env:"WAF_PROXY_COALESCE_MAX_BODY,PROXY_COALESCE_MAX_BODY" env-default:"1048576"` // larger responses are not shared
+
+	PROXY_WS_HANDSHAKE_TIMEOUT int `env:"WAF_PROXY_WS_HANDSHAKE_TIMEOUT,PROXY_WS_HANDSHAKE_TIMEOUT" env-default:"10"` // seconds to dial and upgrade a websocket
+	PROXY_WS_IDLE_TIMEOUT      int `env:"WAF_PROXY_WS_IDLE_TIMEOUT,PROXY_WS_IDLE_TIMEOUT" env-default:"300"`          // seconds a websocket may stay silent
+
+	USE_SSL  bool   `env:"WAF_USE_SSL,USE_SSL" env-default:"false"`
+	SSL_CERT string `env:"WAF_SSL_CERT,SSL_CERT"`
+	SSL_KEY  string `env:"WAF_SSL_KEY,SSL_KEY"`
+
+	ACME_HOSTS        string `env:"WAF_ACME_HOSTS,ACME_HOSTS"`                                   // comma separated hosts to get Let's Encrypt certificates for, instead of SSL_CERT and SSL_KEY
+	ACME_EMAIL        string `env:"WAF_ACME_EMAIL,ACME_EMAIL"`                                   // contact for expiry notices
+	ACME_DIRECTORY    string `env:"WAF_ACME_DIRECTORY,ACME_DIRECTORY"`                           // ACME directory URL, empty is Let's Encrypt production
+	ACME_HTTP_ADDR    string `env:"WAF_ACME_HTTP_ADDR,ACME_HTTP_ADDR" env-default:":80"`         // answers HTTP-01 challenges and redirects to https, "-" turns it off
+	TLS_MIN_VERSION   string `env:"WAF_TLS_MIN_VERSION,TLS_MIN_VERSION" env-default:"1.2"`       // 1.2 or 1.3
+	TLS_CIPHER_SUITES string `env:"WAF_TLS_CIPHER_SUITES,TLS_CIPHER_SUITES"`                     // comma separated TLS 1.2 suites, empty takes forward secret AEAD ones
+	TLS_OCSP_STAPLING bool   `env:"WAF_TLS_OCSP_STAPLING,TLS_OCSP_STAPLING" env-default:"false"` // staple the OCSP responses of the server certificates
+
+	USE_SMUGGLING_GUARD  bool  `env:"WAF_USE_SMUGGLING_GUARD,USE_SMUGGLING_GUARD" env-default:"false"`     // reject requests with ambiguous message boundaries
+	SMUGGLING_MAX_BUFFER int64 `env:"WAF_SMUGGLING_MAX_BUFFER,SMUGGLING_MAX_BUFFER" env-default:"1048576"` // chunked bodies up to this many bytes are forwarded with a Content-Length
+
+	MAINTENANCE              bool   `env:"WAF_MAINTENANCE,MAINTENANCE" env-default:"false"`                                              // serve the maintenance page, reloaded from CONFIG_FILE
+	MAINTENANCE_STATUS       int    `env:"WAF_MAINTENANCE_STATUS,MAINTENANCE_STATUS" env-default:"503"`                                  // status of the maintenance page
+	MAINTENANCE_BODY         string `env:"WAF_MAINTENANCE_BODY,MAINTENANCE_BODY"`                                                        // page served, empty takes a built in one
+	MAINTENANCE_FILE         string `env:"WAF_MAINTENANCE_FILE,MAINTENANCE_FILE"`                                                        // file the page is read from, replaces MAINTENANCE_BODY
+	MAINTENANCE_CONTENT_TYPE string `env:"WAF_MAINTENANCE_CONTENT_TYPE,MAINTENANCE_CONTENT_TYPE" env-default:"text/html; charset=utf-8"` // of the page
+	MAINTENANCE_RETRY_AFTER  int    `env:"WAF_MAINTENANCE_RETRY_AFTER,MAINTENANCE_RETRY_AFTER" env-default:"300"`                        // seconds sent in Retry-After, 0 sends none
+	MAINTENANCE_ALLOW_IP     string `env:"WAF_MAINTENANCE_ALLOW_IP,MAINTENANCE_ALLOW_IP"`                                                // comma separated IPs or CIDRs let through to the upstream
+	MAINTENANCE_PATH         string `env:"WAF_MAINTENANCE_PATH,MAINTENANCE_PATH" env-default:"/__waf/maintenance"`                       // path of the maintenance API
+	MAINTENANCE_TOKEN        string `env:"WAF_MAINTENANCE_TOKEN,MAINTENANCE_TOKEN"`                                                      // bearer token of the maintenance API, empty disables it
+	MAINTENANCE_DURATION     int    `env:"WAF_MAINTENANCE_DURATION,MAINTENANCE_DURATION" env-default:"3600"`                             // seconds the API turns it on for when the request names none
+
+	USE_ADMIN   bool   `env:"WAF_USE_ADMIN,USE_ADMIN" env-default:"false"`            // serve the admin API on its own address
+	ADMIN_ADDR  string `env:"WAF_ADMIN_ADDR,ADMIN_ADDR" env-default:"127.0.0.1:9090"` // keep it off the public interface
+	ADMIN_TOKEN string `env:"WAF_ADMIN_TOKEN,ADMIN_TOKEN"`                            // bearer token every admin request must carry
+
+	TRUSTED_PROXIES string `env:"WAF_TRUSTED_PROXIES,TRUSTED_PROXIES"`          // comma separated IPs or CIDRs allowed to set X-Forwarded-For, empty trusts none
+	IPV6_PREFIX     int    `env:"WAF_IPV6_PREFIX,IPV6_PREFIX" env-default:"64"` // IPv6 clients are rate limited and banned per network of this prefix, IPv4 per address
+
+	USE_REQUEST_ID    bool   `env:"WAF_USE_REQUEST_ID,USE_REQUEST_ID" env-default:"false"`              // tag every request with an id in the logs, upstream request and response
+	REQUEST_ID_HEADER string `env:"WAF_REQUEST_ID_HEADER,REQUEST_ID_HEADER" env-default:"X-Request-ID"` // header the id is read from, forwarded and echoed in
+
+	BLOCK_RESPONSE     string `env:"WAF_BLOCK_RESPONSE,BLOCK_RESPONSE" env-default:"default"` // default, problem, redirect or page: how blocked requests are answered
+	BLOCK_PROBLEM_TYPE string `env:"WAF_BLOCK_PROBLEM_TYPE,BLOCK_PROBLEM_TYPE"`               // URI the component is appended to as the problem type, empty is about:blank
+	BLOCK_REDIRECT_URL string `env:"WAF_BLOCK_REDIRECT_URL,BLOCK_REDIRECT_URL"`               // where redirect sends blocked clients
+	BLOCK_PAGE_FILE    string `env:"WAF_BLOCK_PAGE_FILE,BLOCK_PAGE_FILE"`                     // html/template page rendered with the decision
+
+	USE_RATELIMIT    bool `env:"WAF_USE_RATELIMIT,USE_RATELIMIT" env-default:"false"`
+	RATELIMIT_SECOND int  `env:"WAF_RATELIMIT_SECOND,RATELIMIT_SECOND" env-default:"1"`
+	RATELIMIT_MAX    uint `env:"WAF_RATELIMIT_MAX,RATELIMIT_MAX" env-default:"5"`
+
+	RATELIMIT_ALGORITHM string `env:"WAF_RATELIMIT_ALGORITHM,RATELIMIT_ALGORITHM" env-default:"fixed_window"` // fixed_window, token_bucket or sliding_window
+	RATELIMIT_FAIL_OPEN bool   `env:"WAF_RATELIMIT_FAIL_OPEN,RATELIMIT_FAIL_OPEN" env-default:"true"`         // allow requests when the cache is unreachable
+	RATELIMIT_HEADERS   string `env:"WAF_RATELIMIT_HEADERS,RATELIMIT_HEADERS" env-default:"X-RateLimit"`      // comma separated header prefixes, e.g. X-RateLimit,RateLimit
+	RATELIMIT_ROUTES    string `env:"WAF_RATELIMIT_ROUTES,RATELIMIT_ROUTES"`                                  // per path pattern limits, the first match wins, e.g. /login=5/60,/static/**=1000/60,regex:^/api/v[0-9]+/search$=20/1
+	RATELIMIT_KEY       string `env:"WAF_RATELIMIT_KEY,RATELIMIT_KEY" env-default:"ip"`                       // what a client is counted by: ip, subject or header:<name>, + joins, comma separated fallbacks, e.g. subject,ip
+
+	USE_CONCURRENCY_LIMIT    bool   `env:"WAF_USE_CONCURRENCY_LIMIT,USE_CONCURRENCY_LIMIT" env-default:"false"`
+	CONCURRENCY_LIMIT        int64  `env:"WAF_CONCURRENCY_LIMIT,CONCURRENCY_LIMIT" env-default:"10"`           // requests a client may have in flight at once
+	CONCURRENCY_CLIENT_LIMIT string `env:"WAF_CONCURRENCY_CLIENT_LIMIT,CONCURRENCY_CLIENT_LIMIT"`              // comma separated ip or cidr=limit overrides, e.g. 10.0.0.0/8=100, 0 is unlimited
+	CONCURRENCY_TTL          int    `env:"WAF_CONCURRENCY_TTL,CONCURRENCY_TTL" env-default:"300"`              // seconds a count outlives a crashed instance, longer than the slowest request
+	CONCURRENCY_FAIL_OPEN    bool   `env:"WAF_CONCURRENCY_FAIL_OPEN,CONCURRENCY_FAIL_OPEN" env-default:"true"` // allow requests when the cache is unreachable
+
+	USE_IPFILTER   bool   `env:"WAF_USE_IPFILTER,USE_IPFILTER" env-default:"false"`
+	IPFILTER_ALLOW string `env:"WAF_IPFILTER_ALLOW,IPFILTER_ALLOW"` // comma separated ips or cidr ranges, empty allows all
+	IPFILTER_DENY  string `env:"WAF_IPFILTER_DENY,IPFILTER_DENY"`   // comma separated ips or cidr ranges
+
+	USE_AUTOBAN          bool   `env:"WAF_USE_AUTOBAN,USE_AUTOBAN" env-default:"false"`
+	AUTOBAN_THRESHOLD    int    `env:"WAF_AUTOBAN_THRESHOLD,AUTOBAN_THRESHOLD" env-default:"5"`           // blocked requests within the window that ban an ip
+	AUTOBAN_WINDOW       int    `env:"WAF_AUTOBAN_WINDOW,AUTOBAN_WINDOW" env-default:"60"`                // seconds
+	AUTOBAN_DURATION     int    `env:"WAF_AUTOBAN_DURATION,AUTOBAN_DURATION" env-default:"600"`           // seconds of the first ban, doubled on every re-offense
+	AUTOBAN_MAX_DURATION int    `env:"WAF_AUTOBAN_MAX_DURATION,AUTOBAN_MAX_DURATION" env-default:"86400"` // seconds
+	AUTOBAN_FAIL_OPEN    bool   `env:"WAF_AUTOBAN_FAIL_OPEN,AUTOBAN_FAIL_OPEN" env-default:"true"`        // ban no one when the cache is unreachable, false bans everyone
+	AUTOBAN_KEY          string `env:"WAF_AUTOBAN_KEY,AUTOBAN_KEY" env-default:"ip"`                      // what the waf bans, like RATELIMIT_KEY
+
+	USE_HONEYPOT          bool   `env:"WAF_USE_HONEYPOT,USE_HONEYPOT" env-default:"false"`
+	HONEYPOT_PATHS        string `env:"WAF_HONEYPOT_PATHS,HONEYPOT_PATHS" env-default:"/wp-admin,/wp-login.php,/.env,/.git,/admin.php,/phpmyadmin"` // comma separated, a trailing * matches any suffix
+	HONEYPOT_FILE         string `env:"WAF_HONEYPOT_FILE,HONEYPOT_FILE"`                                                                            // YAML with paths and ban_duration, reloaded on change, replaces HONEYPOT_PATHS
+	HONEYPOT_BAN_DURATION int    `env:"WAF_HONEYPOT_BAN_DURATION,HONEYPOT_BAN_DURATION" env-default:"86400"`                                        // seconds
+	HONEYPOT_IGNORE_IP    string `env:"WAF_HONEYPOT_IGNORE_IP,HONEYPOT_IGNORE_IP"`                                                                  // comma separated IPs or CIDRs never banned, e.g. monitoring
+
+	USE_GEOIP             bool   `env:"WAF_USE_GEOIP,USE_GEOIP" env-default:"false"`
+	GEOIP_DB_PATH         string `env:"WAF_GEOIP_DB_PATH,GEOIP_DB_PATH" env-default:"GeoLite2-Country.mmdb"` // MaxMind MMDB file, reloaded on change
+	GEOIP_ALLOW_COUNTRIES string `env:"WAF_GEOIP_ALLOW_COUNTRIES,GEOIP_ALLOW_COUNTRIES"`                     // comma separated ISO codes, empty allows all
+	GEOIP_DENY_COUNTRIES  string `env:"WAF_GEOIP_DENY_COUNTRIES,GEOIP_DENY_COUNTRIES"`                       // comma separated ISO codes
+	GEOIP_FAIL_OPEN       bool   `env:"WAF_GEOIP_FAIL_OPEN,GEOIP_FAIL_OPEN" env-default:"true"`              // allow requests while the database is missing
+
+	USE_BOT_DETECTION bool   `env:"WAF_USE_BOT_DETECTION,USE_BOT_DETECTION" env-default:"false"`
+	BOT_ACTION        string `env:"WAF_BOT_ACTION,BOT_ACTION" env-default:"log"`          // log, tag, ratelimit or block
+	BOT_THRESHOLD     int    `env:"WAF_BOT_THRESHOLD,BOT_THRESHOLD" env-default:"60"`     // score from 0 to 100 the action applies from
+	BOT_USER_AGENTS   string `env:"WAF_BOT_USER_AGENTS,BOT_USER_AGENTS"`                  // comma separated case insensitive regexps, empty uses the built-in list
+	BOT_GOOD_BOTS     string `env:"WAF_BOT_GOOD_BOTS,BOT_GOOD_BOTS"`                      // verified by reverse DNS, e.g. googlebot=googlebot.com|google.com, empty uses the built-in list
+	BOT_RATE_WINDOW   int    `env:"WAF_BOT_RATE_WINDOW,BOT_RATE_WINDOW" env-default:"10"` // seconds
+	BOT_RATE_LIMIT    int64  `env:"WAF_BOT_RATE_LIMIT,BOT_RATE_LIMIT" env-default:"100"`  // requests per window scored as a bot
+	BOT_LIMIT         int64  `env:"WAF_BOT_LIMIT,BOT_LIMIT" env-default:"10"`             // requests per window left to bots by the ratelimit action
+
+	USE_SCAN_DETECTION bool    `env:"WAF_USE_SCAN_DETECTION,USE_SCAN_DETECTION" env-default:"false"`
+	SCAN_WINDOW        int     `env:"WAF_SCAN_WINDOW,SCAN_WINDOW" env-default:"60"`               // seconds
+	SCAN_THRESHOLD     int64   `env:"WAF_SCAN_THRESHOLD,SCAN_THRESHOLD" env-default:"20"`         // error responses per window a scan takes at least
+	SCAN_RATIO         float64 `env:"WAF_SCAN_RATIO,SCAN_RATIO" env-default:"0.5"`                // share of error responses from 0 to 1 a scan takes at least
+	SCAN_STATUSES      string  `env:"WAF_SCAN_STATUSES,SCAN_STATUSES" env-default:"403,404"`      // comma separated response statuses counted as errors
+	SCAN_ACTION        string  `env:"WAF_SCAN_ACTION,SCAN_ACTION" env-default:"log"`              // log, ratelimit, challenge or ban
+	SCAN_LIMIT         int64   `env:"WAF_SCAN_LIMIT,SCAN_LIMIT" env-default:"10"`                 // requests per window left to scanners by the ratelimit action
+	SCAN_BAN_DURATION  int     `env:"WAF_SCAN_BAN_DURATION,SCAN_BAN_DURATION" env-default:"3600"` // seconds
+
+	USE_CHALLENGE        bool   `env:"WAF_USE_CHALLENGE,USE_CHALLENGE" env-default:"false"`
+	CHALLENGE_THRESHOLD  int    `env:"WAF_CHALLENGE_THRESHOLD,CHALLENGE_THRESHOLD" env-default:"30"`   // bot score challenged from, every client without USE_BOT_DETECTION
+	CHALLENGE_DIFFICULTY int    `env:"WAF_CHALLENGE_DIFFICULTY,CHALLENGE_DIFFICULTY" env-default:"16"` // leading zero bits of the proof of work
+	CHALLENGE_PASS_TTL   int    `env:"WAF_CHALLENGE_PASS_TTL,CHALLENGE_PASS_TTL" env-default:"1800"`   // seconds a solved challenge lets the client through
+	CHALLENGE_PATH       string `env:"WAF_CHALLENGE_PATH,CHALLENGE_PATH" env-default:"/__waf/challenge"`
+	CHALLENGE_SECURE     bool   `env:"WAF_CHALLENGE_SECURE,CHALLENGE_SECURE" env-default:"false"` // https only pass cookie
+
+	USE_CORS               bool   `env:"WAF_USE_CORS,USE_CORS" env-default:"false"`
+	CORS_ALLOW_ORIGINS     string `env:"WAF_CORS_ALLOW_ORIGINS,CORS_ALLOW_ORIGINS"` // comma separated, https://*.example.com allows the subdomains, * any origin
+	CORS_ALLOW_METHODS     string `env:"WAF_CORS_ALLOW_METHODS,CORS_ALLOW_METHODS" env-default:"GET,HEAD,POST,PUT,PATCH,DELETE"`
+	CORS_ALLOW_HEADERS     string `env:"WAF_CORS_ALLOW_HEADERS,CORS_ALLOW_HEADERS" env-default:"Content-Type,Authorization"`
+	CORS_EXPOSE_HEADERS    string `env:"WAF_CORS_EXPOSE_HEADERS,CORS_EXPOSE_HEADERS"`
+	CORS_ALLOW_CREDENTIALS bool   `env:"WAF_CORS_ALLOW_CREDENTIALS,CORS_ALLOW_CREDENTIALS" env-default:"false"`
+	CORS_MAX_AGE           int    `env:"WAF_CORS_MAX_AGE,CORS_MAX_AGE" env-default:"600"` // seconds browsers cache a preflight
+
+	USE_BASELINE         bool    `env:"WAF_USE_BASELINE,USE_BASELINE" env-default:"false"`               // per route latency and body size statistics, shared through the cache
+	BASELINE_WINDOW      int     `env:"WAF_BASELINE_WINDOW,BASELINE_WINDOW" env-default:"300"`           // seconds per window
+	BASELINE_WINDOWS     int     `env:"WAF_BASELINE_WINDOWS,BASELINE_WINDOWS" env-default:"12"`          // complete windows a baseline spans
+	BASELINE_FLUSH       int     `env:"WAF_BASELINE_FLUSH,BASELINE_FLUSH" env-default:"10"`              // seconds between writes of the local counts to the cache
+	BASELINE_MAX_ROUTES  int     `env:"WAF_BASELINE_MAX_ROUTES,BASELINE_MAX_ROUTES" env-default:"1000"`  // routes sampled apart, the rest share one baseline
+	BASELINE_MIN_SAMPLES int     `env:"WAF_BASELINE_MIN_SAMPLES,BASELINE_MIN_SAMPLES" env-default:"100"` // samples a baseline needs before it flags outliers
+	BASELINE_FACTOR      float64 `env:"WAF_BASELINE_FACTOR,BASELINE_FACTOR" env-default:"3"`             // times the p95 a value takes to be an outlier
+	BASELINE_PATH        string  `env:"WAF_BASELINE_PATH,BASELINE_PATH" env-default:"/__waf/baseline"`
+	BASELINE_TOKEN       string  `env:"WAF_BASELINE_TOKEN,BASELINE_TOKEN"` // bearer token of the baseline API, empty disables it
+
+	USE_PROFILE        bool   `env:"WAF_USE_PROFILE,USE_PROFILE" env-default:"false"`              // learn the request shapes, then refuse the others
+	PROFILE_LEARN      int    `env:"WAF_PROFILE_LEARN,PROFILE_LEARN" env-default:"86400"`          // seconds of learning from the first start, 0 learns until the admin API enforces
+	PROFILE_ACTION     string `env:"WAF_PROFILE_ACTION,PROFILE_ACTION" env-default:"block"`        // block or log the requests outside the profile
+	PROFILE_PATHS      string `env:"WAF_PROFILE_PATHS,PROFILE_PATHS"`                              // comma separated path prefixes profiled, empty profiles every path
+	PROFILE_REFRESH    int    `env:"WAF_PROFILE_REFRESH,PROFILE_REFRESH" env-default:"10"`         // seconds between merges of the learned shapes into the cache
+	PROFILE_MAX_ROUTES int    `env:"WAF_PROFILE_MAX_ROUTES,PROFILE_MAX_ROUTES" env-default:"1000"` // routes learned
+	PROFILE_MAX_PARAMS int    `env:"WAF_PROFILE_MAX_PARAMS,PROFILE_MAX_PARAMS" env-default:"100"`  // query parameters learned per route
+
+	USE_SECURITY_HEADERS                  bool   `env:"WAF_USE_SECURITY_HEADERS,USE_SECURITY_HEADERS" env-default:"false"`
+	SECURITY_HEADERS_MODE                 string `env:"WAF_SECURITY_HEADERS_MODE,SECURITY_HEADERS_MODE" env-default:"override"`                            // override or add, add keeps the values the upstream sent
+	SECURITY_HEADERS_HSTS                 string `env:"WAF_SECURITY_HEADERS_HSTS,SECURITY_HEADERS_HSTS" env-default:"max-age=31536000; includeSubDomains"` // Strict-Transport-Security, empty sends none
+	SECURITY_HEADERS_CONTENT_TYPE_OPTIONS string `env:"WAF_SECURITY_HEADERS_CONTENT_TYPE_OPTIONS,SECURITY_HEADERS_CONTENT_TYPE_OPTIONS" env-default:"nosniff"`
+	SECURITY_HEADERS_FRAME_OPTIONS        string `env:"WAF_SECURITY_HEADERS_FRAME_OPTIONS,SECURITY_HEADERS_FRAME_OPTIONS" env-default:"SAMEORIGIN"`
+	SECURITY_HEADERS_CSP                  string `env:"WAF_SECURITY_HEADERS_CSP,SECURITY_HEADERS_CSP"` // Content-Security-Policy
+	SECURITY_HEADERS_REFERRER_POLICY      string `env:"WAF_SECURITY_HEADERS_REFERRER_POLICY,SECURITY_HEADERS_REFERRER_POLICY" env-default:"strict-origin-when-cross-origin"`
+	SECURITY_HEADERS_REMOVE               string `env:"WAF_SECURITY_HEADERS_REMOVE,SECURITY_HEADERS_REMOVE" env-default:"Server,X-Powered-By"` // comma separated response headers dropped
+	SECURITY_HEADERS_FILE                 string `env:"WAF_SECURITY_HEADERS_FILE,SECURITY_HEADERS_FILE"`                                       // YAML policy with per route overrides, reloaded on change, replaces the settings above
+
+	USE_MTLS             bool   `env:"WAF_USE_MTLS,USE_MTLS" env-default:"false"`                        // require client certificates, needs USE_SSL
+	MTLS_CA_FILE         string `env:"WAF_MTLS_CA_FILE,MTLS_CA_FILE"`                                    // PEM file of the CAs client certificates must chain to
+	MTLS_ALLOWED_NAMES   string `env:"WAF_MTLS_ALLOWED_NAMES,MTLS_ALLOWED_NAMES"`                        // comma separated CNs or SANs accepted, empty accepts any certificate of the CAs
+	MTLS_PATHS           string `env:"WAF_MTLS_PATHS,MTLS_PATHS"`                                        // comma separated path prefixes requiring a certificate, empty requires it everywhere
+	MTLS_HEADER          string `env:"WAF_MTLS_HEADER,MTLS_HEADER"`                                      // forwards the certificate subject upstream, e.g. X-Client-Subject
+	MTLS_OCSP            bool   `env:"WAF_MTLS_OCSP,MTLS_OCSP" env-default:"false"`                      // ask the OCSP responders of the client certificates
+	MTLS_CRL             bool   `env:"WAF_MTLS_CRL,MTLS_CRL" env-default:"false"`                        // fetch the CRLs of their distribution points
+	MTLS_CRL_FILES       string `env:"WAF_MTLS_CRL_FILES,MTLS_CRL_FILES"`                                // comma separated local CRLs, read again when they change
+	MTLS_REVOCATION_FAIL string `env:"WAF_MTLS_REVOCATION_FAIL,MTLS_REVOCATION_FAIL" env-default:"hard"` // hard rejects certificates whose revocation can't be checked, soft lets them through
+
+	USE_JWT      bool   `env:"WAF_USE_JWT,USE_JWT" env-default:"false"`
+	JWT_SECRET   string `env:"WAF_JWT_SECRET,JWT_SECRET"`                        // HS256 key
+	JWT_JWKS_URL string `env:"WAF_JWT_JWKS_URL,JWT_JWKS_URL"`                    // RS256 keys, picked by kid
+	JWT_JWKS_TTL int    `env:"WAF_JWT_JWKS_TTL,JWT_JWKS_TTL" env-default:"3600"` // seconds the fetched key set is cached
+	JWT_ISSUER   string `env:"WAF_JWT_ISSUER,JWT_ISSUER"`                        // required iss, empty skips the check
+	JWT_AUDIENCE string `env:"WAF_JWT_AUDIENCE,JWT_AUDIENCE"`                    // required aud, empty skips the check
+	JWT_LEEWAY   int    `env:"WAF_JWT_LEEWAY,JWT_LEEWAY" env-default:"0"`        // seconds of clock skew allowed
+	JWT_CLAIMS   string `env:"WAF_JWT_CLAIMS,JWT_CLAIMS" env-default:"sub"`      // comma separated claims put in the request context
+
+	USE_APIKEY       bool   `env:"WAF_USE_APIKEY,USE_APIKEY" env-default:"false"`
+	APIKEY_HEADER    string `env:"WAF_APIKEY_HEADER,APIKEY_HEADER" env-default:"X-API-Key"`  // header carrying the key
+	APIKEY_FILE      string `env:"WAF_APIKEY_FILE,APIKEY_FILE"`                              // yaml plans and keys, reloaded on change, empty looks the keys up in the state store
+	APIKEY_PATHS     string `env:"WAF_APIKEY_PATHS,APIKEY_PATHS"`                            // comma separated path prefixes requiring a key, empty requires it everywhere
+	APIKEY_ID_HEADER string `env:"WAF_APIKEY_ID_HEADER,APIKEY_ID_HEADER"`                    // forwards the id of the key upstream, e.g. X-API-Key-ID
+	APIKEY_FAIL_OPEN bool   `env:"WAF_APIKEY_FAIL_OPEN,APIKEY_FAIL_OPEN" env-default:"true"` // let requests through when the quotas can't be counted
+
+	USE_NONCE              bool   `env:"WAF_USE_NONCE,USE_NONCE" env-default:"false"`                                 // reject replayed signed requests
+	NONCE_HEADER           string `env:"WAF_NONCE_HEADER,NONCE_HEADER" env-default:"X-Nonce"`                         // header carrying the nonce
+	NONCE_TIMESTAMP_HEADER string `env:"WAF_NONCE_TIMESTAMP_HEADER,NONCE_TIMESTAMP_HEADER" env-default:"X-Timestamp"` // header carrying the unix time the request was signed
+	NONCE_SKEW             int    `env:"WAF_NONCE_SKEW,NONCE_SKEW" env-default:"300"`                                 // seconds the timestamp may be off either way, nonces are kept twice as long at most
+	NONCE_MAX_LENGTH       int    `env:"WAF_NONCE_MAX_LENGTH,NONCE_MAX_LENGTH" env-default:"128"`
+	NONCE_PATHS            string `env:"WAF_NONCE_PATHS,NONCE_PATHS"`                             // comma separated path prefixes checked, empty checks every path
+	NONCE_FAIL_OPEN        bool   `env:"WAF_NONCE_FAIL_OPEN,NONCE_FAIL_OPEN" env-default:"false"` // take every nonce as fresh when the cache is unreachable
+
+	USE_CSRF            bool   `env:"WAF_USE_CSRF,USE_CSRF" env-default:"false"`
+	CSRF_MODE           string `env:"WAF_CSRF_MODE,CSRF_MODE" env-default:"double_submit"` // double_submit or synchronizer
+	CSRF_SECRET         string `env:"WAF_CSRF_SECRET,CSRF_SECRET"`                         // signs the double submit cookie, shared by every instance
+	CSRF_TTL            int    `env:"WAF_CSRF_TTL,CSRF_TTL" env-default:"43200"`           // seconds a token is valid
+	CSRF_COOKIE         string `env:"WAF_CSRF_COOKIE,CSRF_COOKIE" env-default:"csrf_token"`
+	CSRF_SESSION_COOKIE string `env:"WAF_CSRF_SESSION_COOKIE,CSRF_SESSION_COOKIE" env-default:"gowaf_session"` // synchronizer mode only
+	CSRF_HEADER         string `env:"WAF_CSRF_HEADER,CSRF_HEADER" env-default:"X-CSRF-Token"`
+	CSRF_FIELD          string `env:"WAF_CSRF_FIELD,CSRF_FIELD" env-default:"csrf_token"`
+	CSRF_EXEMPT_PATHS   string `env:"WAF_CSRF_EXEMPT_PATHS,CSRF_EXEMPT_PATHS"`           // comma separated path prefixes
+	CSRF_SAMESITE       string `env:"WAF_CSRF_SAMESITE,CSRF_SAMESITE" env-default:"lax"` // lax, strict or none
+	CSRF_SECURE         bool   `env:"WAF_CSRF_SECURE,CSRF_SECURE" env-default:"false"`   // https only cookies
+
+	USE_COOKIE_GUARD bool   `env:"WAF_USE_COOKIE_GUARD,USE_COOKIE_GUARD" env-default:"false"`
+	COOKIE_SECRET    string `env:"WAF_COOKIE_SECRET,COOKIE_SECRET"`                         // signs the COOKIE_SIGNED cookies, shared by every instance
+	COOKIE_SIGNED    string `env:"WAF_COOKIE_SIGNED,COOKIE_SIGNED"`                         // comma separated names of the cookies signed, a trailing * matches a prefix
+	COOKIE_TAMPERED  string `env:"WAF_COOKIE_TAMPERED,COOKIE_TAMPERED" env-default:"strip"` // strip or reject a tampered cookie
+	COOKIE_FLAGS     string `env:"WAF_COOKIE_FLAGS,COOKIE_FLAGS" env-default:"log"`         // log, fix or off on cookies set without Secure, HttpOnly or SameSite
+	COOKIE_SAMESITE  string `env:"WAF_COOKIE_SAMESITE,COOKIE_SAMESITE" env-default:"lax"`   // lax, strict or none, added by COOKIE_FLAGS=fix
+	COOKIE_EXEMPT    string `env:"WAF_COOKIE_EXEMPT,COOKIE_EXEMPT"`                         // comma separated names COOKIE_FLAGS leaves alone, e.g. csrf_token
+
+	MAX_BODY_SIZE        int64  `env:"WAF_MAX_BODY_SIZE,MAX_BODY_SIZE" env-default:"0"` // request body limit in bytes, 0 is unlimited
+	MAX_BODY_SIZE_ROUTES string `env:"WAF_MAX_BODY_SIZE_ROUTES,MAX_BODY_SIZE_ROUTES"`   // per path prefix limits, e.g. /upload=10485760,/api=65536
+
+	MAX_QUERY_PARAMS   int    `env:"WAF_MAX_QUERY_PARAMS,MAX_QUERY_PARAMS" env-default:"1000"`  // query parameters of a request, 0 is unlimited
+	MAX_HEADERS        int    `env:"WAF_MAX_HEADERS,MAX_HEADERS" env-default:"100"`             // header lines of a request, 0 is unlimited
+	MAX_HEADER_BYTES   int    `env:"WAF_MAX_HEADER_BYTES,MAX_HEADER_BYTES" env-default:"32768"` // of every header name and value, 0 is unlimited
+	MAX_VALUE_LENGTH   int    `env:"WAF_MAX_VALUE_LENGTH,MAX_VALUE_LENGTH" env-default:"8192"`  // bytes of a query parameter or a header value, 0 is unlimited
+	FIELD_LIMIT_ROUTES string `env:"WAF_FIELD_LIMIT_ROUTES,FIELD_LIMIT_ROUTES"`                 // per path prefix caps, e.g. /search=query:5000|value:16384,/api=headers:50
+
+	ALLOWED_METHODS       string `env:"WAF_ALLOWED_METHODS,ALLOWED_METHODS"`             // request methods, | separated, empty allows any
+	ALLOWED_METHOD_ROUTES string `env:"WAF_ALLOWED_METHOD_ROUTES,ALLOWED_METHOD_ROUTES"` // per path prefix methods, e.g. /api=GET|POST|PUT|DELETE,/static=GET
+
+	CONTENT_TYPES       string `env:"WAF_CONTENT_TYPES,CONTENT_TYPES"`             // media types of request bodies, | separated, empty allows any
+	CONTENT_TYPE_ROUTES string `env:"WAF_CONTENT_TYPE_ROUTES,CONTENT_TYPE_ROUTES"` // per path prefix types, e.g. /api=application/json,/upload=multipart/form-data|text/*
+
+	USE_MULTIPART           bool   `env:"WAF_USE_MULTIPART,USE_MULTIPART" env-default:"false"`                        // parse multipart bodies, filtering the uploads and inspecting the form values
+	MULTIPART_MAX_FILE_SIZE int64  `env:"WAF_MULTIPART_MAX_FILE_SIZE,MULTIPART_MAX_FILE_SIZE" env-default:"10485760"` // bytes of an uploaded file, 0 is unlimited
+	MULTIPART_MAX_FILES     int    `env:"WAF_MULTIPART_MAX_FILES,MULTIPART_MAX_FILES" env-default:"10"`               // files per request, 0 is unlimited
+	MULTIPART_EXTENSIONS    string `env:"WAF_MULTIPART_EXTENSIONS,MULTIPART_EXTENSIONS"`                              // comma separated file name extensions allowed, e.g. .jpg,.png,.pdf, empty allows any
+	MULTIPART_TYPES         string `env:"WAF_MULTIPART_TYPES,MULTIPART_TYPES"`                                        // comma separated media types allowed, detected from the content, e.g. image/*,application/pdf, empty allows any
+	MULTIPART_MAX_VALUES    int64  `env:"WAF_MULTIPART_MAX_VALUES,MULTIPART_MAX_VALUES" env-default:"65536"`          // bytes of form values inspected by the rules
+	MULTIPART_MEMORY        int64  `env:"WAF_MULTIPART_MEMORY,MULTIPART_MEMORY" env-default:"1048576"`                // bytes of a body kept in memory, the rest is spooled to a temporary file
+	MULTIPART_TEMP_DIR      string `env:"WAF_MULTIPART_TEMP_DIR,MULTIPART_TEMP_DIR"`                                  // of the spooled bodies, empty is the system one
+
+	USE_GRAPHQL            bool   `env:"WAF_USE_GRAPHQL,USE_GRAPHQL" env-default:"false"`                      // parse the queries of the GraphQL endpoints, limiting them and inspecting their arguments
+	GRAPHQL_ENDPOINTS      string `env:"WAF_GRAPHQL_ENDPOINTS,GRAPHQL_ENDPOINTS" env-default:"/graphql"`       // comma separated paths, each with optional limits, e.g. /graphql,/internal/graphql=depth:15|complexity:5000|introspection:on
+	GRAPHQL_MAX_DEPTH      int    `env:"WAF_GRAPHQL_MAX_DEPTH,GRAPHQL_MAX_DEPTH" env-default:"10"`             // nesting of fields, 0 is unlimited
+	GRAPHQL_MAX_COMPLEXITY int    `env:"WAF_GRAPHQL_MAX_COMPLEXITY,GRAPHQL_MAX_COMPLEXITY" env-default:"1000"` // fields selected, multiplied by the first, last or limit of the lists around them, 0 is unlimited
+	GRAPHQL_INTROSPECTION  bool   `env:"WAF_GRAPHQL_INTROSPECTION,GRAPHQL_INTROSPECTION" env-default:"false"`  // allow __schema and __type queries
+	GRAPHQL_MAX_BODY       int64  `env:"WAF_GRAPHQL_MAX_BODY,GRAPHQL_MAX_BODY" env-default:"262144"`           // bytes of a query body, larger ones are refused
+
+	DRY_RUN        bool   `env:"WAF_DRY_RUN,DRY_RUN" env-default:"false"`                       // forward every request, only logging what would have been blocked
+	DRY_RUN_HEADER string `env:"WAF_DRY_RUN_HEADER,DRY_RUN_HEADER" env-default:"X-WAF-Dry-Run"` // response header listing the would-be actions
+
+	USE_WAF                    bool   `env:"WAF_USE_WAF,USE_WAF" env-default:"false"`
+	WAF_THRESHOLD              int    `env:"WAF_THRESHOLD" env-default:"5"`                        // anomaly score blocking a request
+	WAF_DETECTION_ONLY         bool   `env:"WAF_DETECTION_ONLY" env-default:"false"`               // log the score instead of blocking
+	WAF_INSPECT_HEADERS        string `env:"WAF_INSPECT_HEADERS" env-default:"User-Agent,Referer"` // headers inspected besides query and body
+	WAF_STRIP_HEADER_INJECTION bool   `env:"WAF_STRIP_HEADER_INJECTION" env-default:"false"`       // drop header values with line breaks or control characters instead of scoring them
+	WAF_RULES_FILE             string `env:"WAF_RULES_FILE"`                                       // custom YAML rules, reloaded on change
+	WAF_RULE_SETS              string `env:"WAF_RULE_SETS"`                                        // comma separated named rules files by host or path prefix, e.g. shop:shop.example.com=shop.yaml,api:/api=api.yaml
+	WAF_RESPONSE_LIMIT         int    `env:"WAF_RESPONSE_LIMIT" env-default:"1048576"`             // max response bytes buffered for response rules
+	WAF_RESULT_CACHE_TTL       int    `env:"WAF_RESULT_CACHE_TTL" env-default:"0"`                 // seconds the matched rules of a bodyless request are reused for identical ones, 0 disables
+	WAF_STREAM_BODY            bool   `env:"WAF_STREAM_BODY" env-default:"false"`                  // scan bodies too large to buffer while they are forwarded, cutting them off once blocked
+	WAF_STREAM_WINDOW          int    `env:"WAF_STREAM_WINDOW" env-default:"4096"`                 // bytes scanned again with the next read, matches up to this long span reads
+	WAF_STREAM_MAX_BYTES       int    `env:"WAF_STREAM_MAX_BYTES" env-default:"10485760"`          // bytes of a streamed body scanned at most, the rest is forwarded unread
+
+	USE_CACHE             bool   `env:"WAF_USE_CACHE,USE_CACHE" env-default:"false"`
+	CACHE_TTL             int    `env:"WAF_CACHE_TTL,CACHE_TTL" env-default:"1209600"`                   // default 2 week
+	CACHE_TTL_JITTER      int    `env:"WAF_CACHE_TTL_JITTER,CACHE_TTL_JITTER" env-default:"0"`           // randomize redis ttl by ±percent
+	CACHE_DRIVER          string `env:"WAF_CACHE_DRIVER,CACHE_DRIVER" env-default:"memory"`              // memory, file, redis or tiered (memory in front of redis)
+	STATE_DRIVER          string `env:"WAF_STATE_DRIVER,STATE_DRIVER"`                                   // memory, file, redis or tiered for the bans, counters, nonces and locks, the cache driver when empty
+	CACHE_L1_TTL          int    `env:"WAF_CACHE_L1_TTL,CACHE_L1_TTL" env-default:"60"`                  // max seconds an entry stays in the tiered memory layer
+	CACHE_MEMORY_MAX_SIZE int    `env:"WAF_CACHE_MEMORY_MAX_SIZE,CACHE_MEMORY_MAX_SIZE" env-default:"0"` // max entries for memory driver, 0 is unlimited
+	CACHE_REMOVE_METHOD   string `env:"WAF_CACHE_REMOVE_METHOD,CACHE_REMOVE_METHOD" env-default:"ban"`   // example: curl -X BAN http://localhost:8080/blogs/?is_prefix=true
+	CACHE_REMOVE_ALLOW_IP string `env:"WAF_CACHE_REMOVE_ALLOW_IP,CACHE_REMOVE_ALLOW_IP" env-default:"127.0.0.0/24"`
+	CACHE_PURGE_PATH      string `env:"WAF_CACHE_PURGE_PATH,CACHE_PURGE_PATH" env-default:"/__waf/cache/purge"`
+	CACHE_PURGE_TOKEN     string `env:"WAF_CACHE_PURGE_TOKEN,CACHE_PURGE_TOKEN"` // bearer token of the purge API, empty disables it
+
+	USE_HTTP_CACHE             bool   `env:"WAF_USE_HTTP_CACHE,USE_HTTP_CACHE" env-default:"false"`                                       // Cache-Control aware cache, replaces USE_CACHE
+	HTTP_CACHE_DEFAULT_TTL     int    `env:"WAF_HTTP_CACHE_DEFAULT_TTL,HTTP_CACHE_DEFAULT_TTL" env-default:"0"`                           // seconds for responses without freshness info, 0 doesn't store them
+	HTTP_CACHE_MAX_BODY        int    `env:"WAF_HTTP_CACHE_MAX_BODY,HTTP_CACHE_MAX_BODY" env-default:"1048576"`                           // larger responses are not stored
+	HTTP_CACHE_VERSION         string `env:"WAF_HTTP_CACHE_VERSION,HTTP_CACHE_VERSION"`                                                   // part of every key, change it to invalidate everything cached
+	HTTP_CACHE_KEY_QUERY       string `env:"WAF_HTTP_CACHE_KEY_QUERY,HTTP_CACHE_KEY_QUERY"`                                               // comma separated query parameters responses are keyed by, empty keys by all
+	HTTP_CACHE_NEGATIVE_TTL    int    `env:"WAF_HTTP_CACHE_NEGATIVE_TTL,HTTP_CACHE_NEGATIVE_TTL" env-default:"0"`                         // max seconds the HTTP_CACHE_NEGATIVE_STATUS responses are cached, 0 caches them like any other
+	HTTP_CACHE_NEGATIVE_STATUS string `env:"WAF_HTTP_CACHE_NEGATIVE_STATUS,HTTP_CACHE_NEGATIVE_STATUS" env-default:"404,410,502,503,504"` // comma separated error statuses cached as negative entries
+
+	HTTP_CACHE_WARM_URLS        string  `env:"WAF_HTTP_CACHE_WARM_URLS,HTTP_CACHE_WARM_URLS"`                                 // comma separated URLs or paths on HOST kept in the cache, empty warms none
+	HTTP_CACHE_WARM_INTERVAL    int     `env:"WAF_HTTP_CACHE_WARM_INTERVAL,HTTP_CACHE_WARM_INTERVAL" env-default:"60"`        // seconds between runs, entries expiring before the next one are fetched
+	HTTP_CACHE_WARM_RATE        float64 `env:"WAF_HTTP_CACHE_WARM_RATE,HTTP_CACHE_WARM_RATE" env-default:"1"`                 // fetches per second at most
+	HTTP_CACHE_WARM_TIMEOUT     int     `env:"WAF_HTTP_CACHE_WARM_TIMEOUT,HTTP_CACHE_WARM_TIMEOUT" env-default:"30"`          // seconds a fetch may take
+	HTTP_CACHE_WARM_MAX_BACKOFF int     `env:"WAF_HTTP_CACHE_WARM_MAX_BACKOFF,HTTP_CACHE_WARM_MAX_BACKOFF" env-default:"600"` // longest pause in seconds after the upstream failed
+
+	DETECT_DEVICE         bool `env:"WAF_DETECT_DEVICE,DETECT_DEVICE" env-default:"true"`
+	SPLIT_CACHE_BY_DEVICE bool `env:"WAF_SPLIT_CACHE_BY_DEVICE,SPLIT_CACHE_BY_DEVICE" env-default:"true"`
+
+	REDIS_MODE        string `env:"WAF_REDIS_MODE,REDIS_MODE" env-default:"standalone"`     // standalone, sentinel or cluster
+	REDIS_ADDR        string `env:"WAF_REDIS_ADDR,REDIS_ADDR" env-default:"localhost:6379"` // comma separated for sentinel and cluster
+	REDIS_MASTER_NAME string `env:"WAF_REDIS_MASTER_NAME,REDIS_MASTER_NAME"`                // sentinel only
+	REDIS_SSL         bool   `env:"WAF_REDIS_SSL,REDIS_SSL" env-default:"false"`
+	REDIS_USER        string `env:"WAF_REDIS_USER,REDIS_USER"`
+	REDIS_PASS        string `env:"WAF_REDIS_PASS,REDIS_PASS"`
+	REDIS_DB          int    `env:"WAF_REDIS_DB,REDIS_DB" env-default:"0"`
+
+	REDIS_SCAN_COUNT int64 `env:"WAF_REDIS_SCAN_COUNT,REDIS_SCAN_COUNT" env-default:"100"` // batch size when removing cache by prefix
+	REDIS_TIMEOUT    int   `env:"WAF_REDIS_TIMEOUT,REDIS_TIMEOUT" env-default:"50"`        // milliseconds a redis command may take
+
+	REDIS_BREAKER              bool    `env:"WAF_REDIS_BREAKER,REDIS_BREAKER" env-default:"true"`                         // fail redis commands right away while redis is unreachable
+	REDIS_BREAKER_RATIO        float64 `env:"WAF_REDIS_BREAKER_RATIO,REDIS_BREAKER_RATIO" env-default:"0.5"`              // failure ratio opening the breaker
+	REDIS_BREAKER_MIN_REQUESTS int     `env:"WAF_REDIS_BREAKER_MIN_REQUESTS,REDIS_BREAKER_MIN_REQUESTS" env-default:"10"` // commands in the window before it may open
+	REDIS_BREAKER_WINDOW       int     `env:"WAF_REDIS_BREAKER_WINDOW,REDIS_BREAKER_WINDOW" env-default:"10"`             // rolling window in seconds
+	REDIS_BREAKER_TIMEOUT      int     `env:"WAF_REDIS_BREAKER_TIMEOUT,REDIS_BREAKER_TIMEOUT" env-default:"5"`            // seconds open before probing again
+
+	CACHE_COMPRESS_THRESHOLD int    `env:"WAF_CACHE_COMPRESS_THRESHOLD,CACHE_COMPRESS_THRESHOLD" env-default:"0"`    // compress redis values bigger than this (bytes), 0 is disabled
+	CACHE_COMPRESS_ALGORITHM string `env:"WAF_CACHE_COMPRESS_ALGORITHM,CACHE_COMPRESS_ALGORITHM" env-default:"gzip"` // gzip or zstd
+	CACHE_CODEC              string `env:"WAF_CACHE_CODEC,CACHE_CODEC" env-default:"raw"`                            // raw, json or msgpack
+	CACHE_LEGACY_JSON        bool   `env:"WAF_CACHE_LEGACY_JSON,CACHE_LEGACY_JSON" env-default:"false"`              // read the json encoded values of older releases, while migrating
+
+	ENABLE_GZIP               bool   `env:"WAF_ENABLE_GZIP,ENABLE_GZIP" env-default:"false"`                       // gzip only, see ENABLE_COMPRESSION
+	ENABLE_COMPRESSION        bool   `env:"WAF_ENABLE_COMPRESSION,ENABLE_COMPRESSION" env-default:"false"`         // every encoding of COMPRESSION_ENCODINGS
+	COMPRESSION_ENCODINGS     string `env:"WAF_COMPRESSION_ENCODINGS,COMPRESSION_ENCODINGS" env-default:"br,gzip"` // preferred first
+	COMPRESSION_CONTENT_TYPES string `env:"WAF_COMPRESSION_CONTENT_TYPES,COMPRESSION_CONTENT_TYPES"`               // comma separated, empty uses the common text types
+	GZIP_COMPRESSION_LEVEL    int    `env:"WAF_GZIP_COMPRESSION_LEVEL,GZIP_COMPRESSION_LEVEL" env-default:"6"`
+	BROTLI_COMPRESSION_LEVEL  int    `env:"WAF_BROTLI_COMPRESSION_LEVEL,BROTLI_COMPRESSION_LEVEL" env-default:"4"`
+	GZIP_MIN_CONTENT_LENGTH   int64  `env:"WAF_GZIP_MIN_CONTENT_LENGTH,GZIP_MIN_CONTENT_LENGTH" env-default:"1024"` // smaller bodies are never compressed, whatever the encoding
+
+	ENABLE_METRICS   bool   `env:"WAF_ENABLE_METRICS,ENABLE_METRICS" env-default:"false"`
+	METRICS_PATH     string `env:"WAF_METRICS_PATH,METRICS_PATH" env-default:"/metrics"`
+	METRICS_ALLOW_IP string `env:"WAF_METRICS_ALLOW_IP,METRICS_ALLOW_IP" env-default:"127.0.0.1,::1"` // comma separated IPs or CIDR ranges allowed to scrape
+
+	AUDIT_LOG             string `env:"WAF_AUDIT_LOG,AUDIT_LOG"`                                         // blocked requests as JSON lines, stdout or a file path, empty is disabled
+	AUDIT_LOG_MAX_SIZE    int    `env:"WAF_AUDIT_LOG_MAX_SIZE,AUDIT_LOG_MAX_SIZE" env-default:"100"`     // megabytes before the file is rotated
+	AUDIT_LOG_MAX_BACKUPS int    `env:"WAF_AUDIT_LOG_MAX_BACKUPS,AUDIT_LOG_MAX_BACKUPS" env-default:"5"` // rotated files kept, 0 keeps all
+	AUDIT_LOG_MAX_AGE     int    `env:"WAF_AUDIT_LOG_MAX_AGE,AUDIT_LOG_MAX_AGE" env-default:"30"`        // days rotated files are kept, 0 keeps all
+	AUDIT_REDACT_HEADERS  string `env:"WAF_AUDIT_REDACT_HEADERS,AUDIT_REDACT_HEADERS" env-default:"Authorization,Cookie,Proxy-Authorization,X-Api-Key"`
+	AUDIT_REDACT_PARAMS   string `env:"WAF_AUDIT_REDACT_PARAMS,AUDIT_REDACT_PARAMS" env-default:"password,token,access_token,api_key"`
+
+	USE_TRACING          bool    `env:"WAF_USE_TRACING,USE_TRACING" env-default:"false"`               // export spans over OTLP/HTTP, see OTEL_EXPORTER_OTLP_ENDPOINT
+	TRACING_SAMPLE_RATIO float64 `env:"WAF_TRACING_SAMPLE_RATIO,TRACING_SAMPLE_RATIO" env-default:"1"` // share of new traces kept, 0 to 1
+
+	// debug
+	GIN_MODE   string `env:"WAF_GIN_MODE,GIN_MODE" env-default:"debug"`
+	LOG_LEVEL  string `env:"WAF_LOG_LEVEL,LOG_LEVEL" env-default:"info"` // debug, info, warn or error
+	LOG_FILE   string `env:"WAF_LOG_FILE,LOG_FILE"`
+	LOG_FORMAT string `env:"WAF_LOG_FORMAT,LOG_FORMAT" env-default:"text"` // text or json lines
+}
+
+// Load reads the configuration from the environment and, when path is set,
+// from that file: YAML keyed by the lower case setting names (redis_addr:
+// localhost:6379), or .env, JSON or TOML by its extension. Environment
+// variables override the file, each setting read from its name prefixed
+// with WAF_ (WAF_REDIS_ADDR) or, when that isn't set, from its bare name
+// (REDIS_ADDR). Without a path a .env file in the working
+// directory is read when present. The result is validated, see Validate.
+func Load(path string) (*Config, error) {
+	conf := Config{}
+
+	if path != "" {
+		if err := cleanenv.ReadConfig(path, &conf); err != nil {
+			return nil, fmt.Errorf("read %s: %w", path, err)
+		}
+		conf.CONFIG_FILE = path
+	} else {
+		if err := cleanenv.ReadEnv(&conf); err != nil {
+			log.Println("[Warn] config: ", err)
+		}
+
+		if _, err := os.Stat(env); err == nil {
+			if err := cleanenv.ReadConfig(env, &conf); err != nil {
+				log.Println("[Warn] config: ", err)
+			}
+		}
+	}
+
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &conf, nil
+}
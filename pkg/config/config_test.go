@@ -0,0 +1,87 @@
+package config_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jahrulnr/go-waf/pkg/config"
+)
+
+func writeFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	path := writeFile(t, "redis_addr: \"file:6379\"\nratelimit_max: 20\nlog_level: \"warn\"\n")
+
+	tests := []struct {
+		name string
+		env  map[string]string
+		want string
+	}{
+		{name: "from the file", want: "file:6379"},
+		{name: "bare name overrides the file", env: map[string]string{"REDIS_ADDR": "bare:6379"}, want: "bare:6379"},
+		{name: "prefixed name overrides the file", env: map[string]string{"WAF_REDIS_ADDR": "prefixed:6379"}, want: "prefixed:6379"},
+		{name: "prefixed name wins over the bare one", env: map[string]string{"REDIS_ADDR": "bare:6379", "WAF_REDIS_ADDR": "prefixed:6379"}, want: "prefixed:6379"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+
+			conf, err := config.Load(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if conf.REDIS_ADDR != test.want {
+				t.Errorf("REDIS_ADDR = %q, want %q", conf.REDIS_ADDR, test.want)
+			}
+			if conf.RATELIMIT_MAX != 20 || conf.LOG_LEVEL != "warn" || conf.CONFIG_FILE != path {
+				t.Errorf("file settings not read: %d %q %q", conf.RATELIMIT_MAX, conf.LOG_LEVEL, conf.CONFIG_FILE)
+			}
+		})
+	}
+}
+
+func TestLoadPrefixedSettings(t *testing.T) {
+	// settings named WAF_ already have a single name
+	t.Setenv("WAF_THRESHOLD", "7")
+	t.Setenv("WAF_RATELIMIT_MAX", "3")
+
+	conf, err := config.Load(writeFile(t, "addr: \":9090\"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.WAF_THRESHOLD != 7 || conf.RATELIMIT_MAX != 3 || conf.ADDR != ":9090" {
+		t.Errorf("WAF_THRESHOLD %d, RATELIMIT_MAX %d, ADDR %q", conf.WAF_THRESHOLD, conf.RATELIMIT_MAX, conf.ADDR)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	t.Setenv("WAF_LOG_LEVEL", "loud")
+
+	_, err := config.Load(writeFile(t, "use_ratelimit: true\nratelimit_second: -1\n"))
+	if err == nil {
+		t.Fatal("invalid settings loaded")
+	}
+	for _, name := range []string{"LOG_LEVEL", "RATELIMIT_SECOND"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("error %q doesn't name %s", err, name)
+		}
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	if _, err := config.Load(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Fatal("missing file loaded")
+	}
+}
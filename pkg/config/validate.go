@@ -0,0 +1,426 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jahrulnr/go-waf/pkg/clientkey"
+	"github.com/jahrulnr/go-waf/pkg/graphql"
+	"github.com/jahrulnr/go-waf/pkg/limits"
+	"github.com/jahrulnr/go-waf/pkg/proxy"
+	"github.com/jahrulnr/go-waf/pkg/server"
+)
+
+// Validate checks the values the components can't work with, and reports
+// every problem at once, each naming the setting and what it accepts.
+func (c *Config) Validate() error {
+	v := &validator{}
+
+	v.check(c.ADDR != "", "ADDR", "must not be empty, e.g. :8080")
+	v.positive("SHUTDOWN_TIMEOUT", c.SHUTDOWN_TIMEOUT)
+	v.positive("READ_HEADER_TIMEOUT", c.READ_HEADER_TIMEOUT)
+	v.check(c.READ_BODY_TIMEOUT >= 0, "READ_BODY_TIMEOUT", "must not be negative, 0 is unlimited")
+	v.positive("IDLE_TIMEOUT", c.IDLE_TIMEOUT)
+	v.check(c.MIN_DATA_RATE >= 0, "MIN_DATA_RATE", "must not be negative, 0 turns it off")
+	if c.MIN_DATA_RATE > 0 {
+		v.positive("MIN_DATA_RATE_GRACE", c.MIN_DATA_RATE_GRACE)
+	}
+	v.check(!c.SLOW_CLIENT_AUTOBAN || c.USE_AUTOBAN, "SLOW_CLIENT_AUTOBAN", "needs USE_AUTOBAN")
+	v.upstream("HOST_DESTINATION", c.HOST_DESTINATION)
+	for _, upstream := range split(c.PROXY_UPSTREAMS) {
+		address, weight, found := strings.Cut(upstream, "|")
+		if found {
+			n, err := strconv.Atoi(strings.TrimSpace(weight))
+			v.check(err == nil && n >= 1, "PROXY_UPSTREAMS", fmt.Sprintf("weight of %q must be a whole number of at least 1", upstream))
+		}
+		v.upstream("PROXY_UPSTREAMS", strings.TrimSpace(address))
+	}
+	v.oneOf("PROXY_STRATEGY", strings.ToLower(c.PROXY_STRATEGY), "round_robin", "random", "least_connections", "consistent_hash")
+	if strings.ToLower(c.PROXY_STRATEGY) == "consistent_hash" {
+		if err := proxy.ParseHashKey(c.PROXY_HASH_KEY); err != nil {
+			v.check(false, "PROXY_HASH_KEY", err.Error())
+		}
+		v.positive("PROXY_HASH_REPLICAS", c.PROXY_HASH_REPLICAS)
+	}
+	if c.PROXY_BREAKER {
+		v.check(c.PROXY_BREAKER_RATIO > 0 && c.PROXY_BREAKER_RATIO <= 1, "PROXY_BREAKER_RATIO", "must be above 0 and at most 1")
+		v.positive("PROXY_BREAKER_WINDOW", c.PROXY_BREAKER_WINDOW)
+		v.positive("PROXY_BREAKER_TIMEOUT", c.PROXY_BREAKER_TIMEOUT)
+	}
+	if c.PROXY_HEALTH_CHECK {
+		v.positive("PROXY_HEALTH_INTERVAL", c.PROXY_HEALTH_INTERVAL)
+		v.positive("PROXY_HEALTH_TIMEOUT", c.PROXY_HEALTH_TIMEOUT)
+	}
+	if c.PROXY_STICKY {
+		v.oneOf("PROXY_STICKY_KEY", c.PROXY_STICKY_KEY, "cookie", "ip")
+		v.check(c.PROXY_STICKY_COOKIE != "", "PROXY_STICKY_COOKIE", "must not be empty")
+		v.positive("PROXY_STICKY_TTL", c.PROXY_STICKY_TTL)
+	}
+	if c.PROXY_MIRROR != "" {
+		v.upstream("PROXY_MIRROR", c.PROXY_MIRROR)
+		v.check(c.PROXY_MIRROR_PERCENT > 0 && c.PROXY_MIRROR_PERCENT <= 100, "PROXY_MIRROR_PERCENT", "must be above 0 and at most 100")
+		v.positive("PROXY_MIRROR_TIMEOUT", c.PROXY_MIRROR_TIMEOUT)
+		v.positive("PROXY_MIRROR_CONCURRENCY", c.PROXY_MIRROR_CONCURRENCY)
+	}
+	if c.PROXY_COALESCE {
+		v.positive("PROXY_COALESCE_MAX_BODY", c.PROXY_COALESCE_MAX_BODY)
+	}
+	v.check(c.PROXY_RETRY_ATTEMPTS >= 1, "PROXY_RETRY_ATTEMPTS", "must be at least 1, 1 disables retries")
+
+	if c.USE_SSL {
+		if len(split(c.ACME_HOSTS)) > 0 {
+			v.check(c.SSL_CERT == "" && c.SSL_KEY == "", "ACME_HOSTS", "can't be used with SSL_CERT and SSL_KEY")
+			if c.ACME_DIRECTORY != "" {
+				v.upstream("ACME_DIRECTORY", c.ACME_DIRECTORY)
+			}
+		} else {
+			v.file("SSL_CERT", c.SSL_CERT, true)
+			v.file("SSL_KEY", c.SSL_KEY, true)
+		}
+		v.oneOf("TLS_MIN_VERSION", c.TLS_MIN_VERSION, "1.2", "1.3")
+		_, err := server.ParseCipherSuites(split(c.TLS_CIPHER_SUITES))
+		v.check(err == nil, "TLS_CIPHER_SUITES", fmt.Sprint(err))
+	}
+
+	if c.USE_SMUGGLING_GUARD {
+		v.check(c.SMUGGLING_MAX_BUFFER > 0, "SMUGGLING_MAX_BUFFER", "must be at least 1")
+	}
+
+	if c.USE_HTTP_CACHE {
+		v.check(c.HTTP_CACHE_NEGATIVE_TTL >= 0, "HTTP_CACHE_NEGATIVE_TTL", "must not be negative, 0 turns it off")
+		for _, status := range split(c.HTTP_CACHE_NEGATIVE_STATUS) {
+			code, err := strconv.Atoi(status)
+			v.check(err == nil && code >= 400 && code <= 599, "HTTP_CACHE_NEGATIVE_STATUS", fmt.Sprintf("%q is not an error status", status))
+		}
+		if warm := split(c.HTTP_CACHE_WARM_URLS); len(warm) > 0 {
+			for _, raw := range warm {
+				if strings.HasPrefix(raw, "/") {
+					v.check(c.HOST != "", "HTTP_CACHE_WARM_URLS", fmt.Sprintf("path %q needs HOST, or give the full url", raw))
+					continue
+				}
+				v.upstream("HTTP_CACHE_WARM_URLS", raw)
+			}
+			v.positive("HTTP_CACHE_WARM_INTERVAL", c.HTTP_CACHE_WARM_INTERVAL)
+			v.check(c.HTTP_CACHE_WARM_RATE > 0, "HTTP_CACHE_WARM_RATE", fmt.Sprintf("must be above 0, got %g", c.HTTP_CACHE_WARM_RATE))
+			v.positive("HTTP_CACHE_WARM_TIMEOUT", c.HTTP_CACHE_WARM_TIMEOUT)
+			v.positive("HTTP_CACHE_WARM_MAX_BACKOFF", c.HTTP_CACHE_WARM_MAX_BACKOFF)
+		}
+	}
+
+	v.check(c.MAINTENANCE_STATUS >= 200 && c.MAINTENANCE_STATUS <= 599, "MAINTENANCE_STATUS", "must be an HTTP status from 200 to 599")
+	v.file("MAINTENANCE_FILE", c.MAINTENANCE_FILE, false)
+	v.check(c.MAINTENANCE_RETRY_AFTER >= 0, "MAINTENANCE_RETRY_AFTER", "must not be negative, 0 sends none")
+	v.ranges("MAINTENANCE_ALLOW_IP", c.MAINTENANCE_ALLOW_IP)
+	if c.MAINTENANCE_TOKEN != "" {
+		v.check(strings.HasPrefix(c.MAINTENANCE_PATH, "/"), "MAINTENANCE_PATH", "must start with /")
+		v.positive("MAINTENANCE_DURATION", c.MAINTENANCE_DURATION)
+	}
+
+	v.oneOf("BLOCK_RESPONSE", c.BLOCK_RESPONSE, "default", "problem", "redirect", "page")
+	switch c.BLOCK_RESPONSE {
+	case "redirect":
+		target, err := url.Parse(c.BLOCK_REDIRECT_URL)
+		v.check(err == nil && (target.IsAbs() || strings.HasPrefix(target.Path, "/")), "BLOCK_REDIRECT_URL", "must be an absolute URL or path")
+	case "page":
+		v.file("BLOCK_PAGE_FILE", c.BLOCK_PAGE_FILE, true)
+	}
+
+	if c.USE_ADMIN {
+		v.check(c.ADMIN_TOKEN != "", "ADMIN_TOKEN", "is required with USE_ADMIN")
+		_, _, err := net.SplitHostPort(c.ADMIN_ADDR)
+		v.check(err == nil, "ADMIN_ADDR", "must be a host:port")
+		v.check(c.ADMIN_ADDR != c.ADDR, "ADMIN_ADDR", "must differ from ADDR")
+	}
+
+	v.ranges("TRUSTED_PROXIES", c.TRUSTED_PROXIES)
+	v.check(c.IPV6_PREFIX >= 1 && c.IPV6_PREFIX <= 128, "IPV6_PREFIX", fmt.Sprintf("must be between 1 and 128, got %d", c.IPV6_PREFIX))
+	v.ranges("IPFILTER_ALLOW", c.IPFILTER_ALLOW)
+	v.ranges("IPFILTER_DENY", c.IPFILTER_DENY)
+	v.ranges("METRICS_ALLOW_IP", c.METRICS_ALLOW_IP)
+	v.ranges("HONEYPOT_IGNORE_IP", c.HONEYPOT_IGNORE_IP)
+	v.ranges("CACHE_REMOVE_ALLOW_IP", c.CACHE_REMOVE_ALLOW_IP)
+
+	if c.USE_RATELIMIT {
+		v.positive("RATELIMIT_SECOND", c.RATELIMIT_SECOND)
+		v.check(c.RATELIMIT_MAX > 0, "RATELIMIT_MAX", "must be at least 1")
+		v.oneOf("RATELIMIT_ALGORITHM", strings.ToLower(c.RATELIMIT_ALGORITHM), "fixed_window", "token_bucket", "sliding_window")
+		for _, route := range split(c.RATELIMIT_ROUTES) {
+			i := strings.LastIndex(route, "=")
+			limit, seconds, found := strings.Cut(route[i+1:], "/")
+			n, err := strconv.ParseUint(strings.TrimSpace(limit), 10, 32)
+			s, serr := strconv.Atoi(strings.TrimSpace(seconds))
+			v.check(i > 0 && found && err == nil && n > 0 && serr == nil && s > 0,
+				"RATELIMIT_ROUTES", fmt.Sprintf("%q must be pattern=limit/seconds, e.g. /login=5/60", route))
+			if expr, ok := strings.CutPrefix(route[:max(i, 0)], "regex:"); ok {
+				_, err := regexp.Compile(strings.TrimSpace(expr))
+				v.check(err == nil, "RATELIMIT_ROUTES", fmt.Sprintf("%q has an invalid regex: %v", route, err))
+			}
+		}
+	}
+	v.clientKey("RATELIMIT_KEY", c.RATELIMIT_KEY, c.USE_JWT)
+	v.clientKey("AUTOBAN_KEY", c.AUTOBAN_KEY, c.USE_JWT)
+	if c.USE_CONCURRENCY_LIMIT {
+		v.check(c.CONCURRENCY_LIMIT >= 0, "CONCURRENCY_LIMIT", "must not be negative, 0 is unlimited")
+		for _, entry := range split(c.CONCURRENCY_CLIENT_LIMIT) {
+			cidr, limit, found := strings.Cut(entry, "=")
+			n, err := strconv.ParseInt(strings.TrimSpace(limit), 10, 64)
+			v.check(found && err == nil && n >= 0, "CONCURRENCY_CLIENT_LIMIT", fmt.Sprintf("%q must be ip or cidr=limit", entry))
+			v.ranges("CONCURRENCY_CLIENT_LIMIT", cidr)
+		}
+		v.positive("CONCURRENCY_TTL", c.CONCURRENCY_TTL)
+	}
+	if c.USE_AUTOBAN {
+		v.positive("AUTOBAN_THRESHOLD", c.AUTOBAN_THRESHOLD)
+		v.positive("AUTOBAN_WINDOW", c.AUTOBAN_WINDOW)
+		v.positive("AUTOBAN_DURATION", c.AUTOBAN_DURATION)
+	}
+	if c.USE_HONEYPOT {
+		v.file("HONEYPOT_FILE", c.HONEYPOT_FILE, false)
+		v.positive("HONEYPOT_BAN_DURATION", c.HONEYPOT_BAN_DURATION)
+	}
+	if c.USE_BASELINE {
+		v.positive("BASELINE_WINDOW", c.BASELINE_WINDOW)
+		v.positive("BASELINE_WINDOWS", c.BASELINE_WINDOWS)
+		v.positive("BASELINE_FLUSH", c.BASELINE_FLUSH)
+		v.positive("BASELINE_MAX_ROUTES", c.BASELINE_MAX_ROUTES)
+		v.positive("BASELINE_MIN_SAMPLES", c.BASELINE_MIN_SAMPLES)
+		v.check(c.BASELINE_FACTOR > 1, "BASELINE_FACTOR", "must be above 1")
+		v.check(c.BASELINE_FLUSH < c.BASELINE_WINDOW, "BASELINE_FLUSH", "must be less than BASELINE_WINDOW")
+		v.check(strings.HasPrefix(c.BASELINE_PATH, "/"), "BASELINE_PATH", "must start with /")
+	}
+	if c.USE_PROFILE {
+		v.check(c.PROFILE_LEARN >= 0, "PROFILE_LEARN", "must not be negative")
+		v.oneOf("PROFILE_ACTION", c.PROFILE_ACTION, "block", "log")
+		v.positive("PROFILE_REFRESH", c.PROFILE_REFRESH)
+		v.positive("PROFILE_MAX_ROUTES", c.PROFILE_MAX_ROUTES)
+		v.positive("PROFILE_MAX_PARAMS", c.PROFILE_MAX_PARAMS)
+		for _, prefix := range split(c.PROFILE_PATHS) {
+			v.check(strings.HasPrefix(prefix, "/"), "PROFILE_PATHS", fmt.Sprintf("%q must start with /", prefix))
+		}
+	}
+	if c.USE_SECURITY_HEADERS {
+		v.oneOf("SECURITY_HEADERS_MODE", c.SECURITY_HEADERS_MODE, "override", "add")
+		v.file("SECURITY_HEADERS_FILE", c.SECURITY_HEADERS_FILE, false)
+	}
+	if c.USE_BOT_DETECTION {
+		v.oneOf("BOT_ACTION", c.BOT_ACTION, "log", "tag", "ratelimit", "block")
+		v.check(c.BOT_THRESHOLD >= 1 && c.BOT_THRESHOLD <= 100, "BOT_THRESHOLD", "must be between 1 and 100")
+	}
+	if c.USE_SCAN_DETECTION {
+		v.positive("SCAN_WINDOW", c.SCAN_WINDOW)
+		v.check(c.SCAN_THRESHOLD > 0, "SCAN_THRESHOLD", "must be at least 1")
+		v.check(c.SCAN_RATIO > 0 && c.SCAN_RATIO <= 1, "SCAN_RATIO", "must be above 0 and at most 1")
+		for _, status := range split(c.SCAN_STATUSES) {
+			code, err := strconv.Atoi(status)
+			v.check(err == nil && code >= 100 && code <= 599, "SCAN_STATUSES", fmt.Sprintf("%q is not a response status", status))
+		}
+		v.oneOf("SCAN_ACTION", c.SCAN_ACTION, "log", "ratelimit", "challenge", "ban")
+		v.check(c.SCAN_ACTION != "challenge" || c.USE_CHALLENGE, "SCAN_ACTION", "challenge needs USE_CHALLENGE")
+		v.check(c.SCAN_LIMIT > 0, "SCAN_LIMIT", "must be at least 1")
+		v.positive("SCAN_BAN_DURATION", c.SCAN_BAN_DURATION)
+	}
+	if c.USE_CHALLENGE {
+		v.check(c.CHALLENGE_DIFFICULTY >= 1 && c.CHALLENGE_DIFFICULTY <= 32, "CHALLENGE_DIFFICULTY", "must be between 1 and 32 bits, each one doubles the work")
+		v.check(strings.HasPrefix(c.CHALLENGE_PATH, "/"), "CHALLENGE_PATH", "must start with /")
+	}
+	if c.USE_MTLS {
+		v.check(c.USE_SSL, "USE_MTLS", "needs USE_SSL, client certificates are only sent over TLS")
+		v.file("MTLS_CA_FILE", c.MTLS_CA_FILE, true)
+		for _, path := range split(c.MTLS_CRL_FILES) {
+			v.file("MTLS_CRL_FILES", path, true)
+		}
+		v.oneOf("MTLS_REVOCATION_FAIL", c.MTLS_REVOCATION_FAIL, "hard", "soft")
+	}
+	if c.USE_JWT {
+		v.check(c.JWT_SECRET != "" || c.JWT_JWKS_URL != "", "USE_JWT", "needs JWT_SECRET or JWT_JWKS_URL")
+	}
+	if c.USE_APIKEY {
+		v.check(c.APIKEY_HEADER != "", "APIKEY_HEADER", "must be set")
+		v.file("APIKEY_FILE", c.APIKEY_FILE, false)
+	}
+	if c.USE_NONCE {
+		v.check(c.NONCE_HEADER != "", "NONCE_HEADER", "must be set")
+		v.check(c.NONCE_TIMESTAMP_HEADER != "", "NONCE_TIMESTAMP_HEADER", "must be set")
+		v.positive("NONCE_SKEW", c.NONCE_SKEW)
+		v.positive("NONCE_MAX_LENGTH", c.NONCE_MAX_LENGTH)
+	}
+	if c.USE_CSRF {
+		v.oneOf("CSRF_MODE", c.CSRF_MODE, "double_submit", "synchronizer")
+		v.oneOf("CSRF_SAMESITE", strings.ToLower(c.CSRF_SAMESITE), "lax", "strict", "none")
+	}
+	if c.USE_COOKIE_GUARD {
+		v.check(c.COOKIE_SIGNED == "" || c.COOKIE_SECRET != "", "COOKIE_SECRET", "is required with COOKIE_SIGNED")
+		v.oneOf("COOKIE_TAMPERED", c.COOKIE_TAMPERED, "strip", "reject")
+		v.oneOf("COOKIE_FLAGS", c.COOKIE_FLAGS, "log", "fix", "off")
+		v.oneOf("COOKIE_SAMESITE", strings.ToLower(c.COOKIE_SAMESITE), "lax", "strict", "none")
+	}
+
+	v.check(c.MAX_QUERY_PARAMS >= 0, "MAX_QUERY_PARAMS", "must not be negative, 0 is unlimited")
+	v.check(c.MAX_HEADERS >= 0, "MAX_HEADERS", "must not be negative, 0 is unlimited")
+	v.check(c.MAX_HEADER_BYTES >= 0, "MAX_HEADER_BYTES", "must not be negative, 0 is unlimited")
+	v.check(c.MAX_VALUE_LENGTH >= 0, "MAX_VALUE_LENGTH", "must not be negative, 0 is unlimited")
+	for _, route := range split(c.FIELD_LIMIT_ROUTES) {
+		_, caps, found := strings.Cut(route, "=")
+		_, err := limits.ParseCaps(caps, limits.Caps{})
+		v.check(found, "FIELD_LIMIT_ROUTES", fmt.Sprintf("%q must be prefix=caps, e.g. /search=query:5000|value:16384", route))
+		v.check(!found || err == nil, "FIELD_LIMIT_ROUTES", fmt.Sprintf("%q: %v", route, err))
+	}
+
+	for _, route := range split(c.MAX_BODY_SIZE_ROUTES) {
+		_, size, found := strings.Cut(route, "=")
+		_, err := strconv.ParseInt(strings.TrimSpace(size), 10, 64)
+		v.check(found && err == nil, "MAX_BODY_SIZE_ROUTES", fmt.Sprintf("%q must be prefix=bytes, e.g. /upload=10485760", route))
+	}
+
+	if c.USE_MULTIPART {
+		v.check(c.MULTIPART_MAX_FILE_SIZE >= 0, "MULTIPART_MAX_FILE_SIZE", "must not be negative, 0 is unlimited")
+		v.check(c.MULTIPART_MAX_FILES >= 0, "MULTIPART_MAX_FILES", "must not be negative, 0 is unlimited")
+		v.check(c.MULTIPART_MAX_VALUES > 0, "MULTIPART_MAX_VALUES", fmt.Sprintf("must be above 0, got %d", c.MULTIPART_MAX_VALUES))
+		v.check(c.MULTIPART_MEMORY > 0, "MULTIPART_MEMORY", fmt.Sprintf("must be above 0, got %d", c.MULTIPART_MEMORY))
+		if c.MULTIPART_TEMP_DIR != "" {
+			info, err := os.Stat(c.MULTIPART_TEMP_DIR)
+			v.check(err == nil && info.IsDir(), "MULTIPART_TEMP_DIR", fmt.Sprintf("%q must be a directory", c.MULTIPART_TEMP_DIR))
+		}
+	}
+	if c.USE_GRAPHQL {
+		endpoints, err := graphql.ParseEndpoints(c.GRAPHQL_ENDPOINTS, graphql.Limits{})
+		v.check(err == nil, "GRAPHQL_ENDPOINTS", fmt.Sprint(err))
+		v.check(err != nil || len(endpoints) > 0, "GRAPHQL_ENDPOINTS", "must list at least one path")
+		v.check(c.GRAPHQL_MAX_DEPTH >= 0, "GRAPHQL_MAX_DEPTH", "must not be negative, 0 is unlimited")
+		v.check(c.GRAPHQL_MAX_COMPLEXITY >= 0, "GRAPHQL_MAX_COMPLEXITY", "must not be negative, 0 is unlimited")
+		v.check(c.GRAPHQL_MAX_BODY > 0, "GRAPHQL_MAX_BODY", fmt.Sprintf("must be above 0, got %d", c.GRAPHQL_MAX_BODY))
+	}
+
+	if c.USE_WAF {
+		v.positive("WAF_THRESHOLD", c.WAF_THRESHOLD)
+		v.file("WAF_RULES_FILE", c.WAF_RULES_FILE, false)
+		names := make(map[string]bool)
+		for _, entry := range split(c.WAF_RULE_SETS) {
+			selector, file, found := strings.Cut(entry, "=")
+			name, selector, named := strings.Cut(selector, ":")
+			v.check(found && named && name != "" && selector != "", "WAF_RULE_SETS", fmt.Sprintf("%q must be name:selector=file, e.g. shop:shop.example.com=shop.yaml or api:/api=api.yaml", entry))
+			v.check(name != "default" && !names[name], "WAF_RULE_SETS", fmt.Sprintf("%q must have a unique name other than default", entry))
+			names[name] = true
+			if found {
+				v.file("WAF_RULE_SETS", strings.TrimSpace(file), true)
+			}
+		}
+		v.check(c.WAF_RESULT_CACHE_TTL >= 0, "WAF_RESULT_CACHE_TTL", "must not be negative, 0 disables it")
+		if c.WAF_STREAM_BODY {
+			v.positive("WAF_STREAM_WINDOW", c.WAF_STREAM_WINDOW)
+			v.positive("WAF_STREAM_MAX_BYTES", c.WAF_STREAM_MAX_BYTES)
+		}
+	}
+
+	v.oneOf("CACHE_DRIVER", c.CACHE_DRIVER, "memory", "file", "redis", "tiered")
+	if c.STATE_DRIVER != "" {
+		v.oneOf("STATE_DRIVER", c.STATE_DRIVER, "memory", "file", "redis", "tiered")
+	}
+	v.check(c.CACHE_TTL_JITTER >= 0 && c.CACHE_TTL_JITTER <= 100, "CACHE_TTL_JITTER", "must be a percentage between 0 and 100")
+	if c.CACHE_DRIVER == "redis" || c.CACHE_DRIVER == "tiered" || c.STATE_DRIVER == "redis" || c.STATE_DRIVER == "tiered" {
+		v.oneOf("REDIS_MODE", strings.ToLower(c.REDIS_MODE), "standalone", "sentinel", "cluster")
+		v.check(len(split(c.REDIS_ADDR)) > 0, "REDIS_ADDR", "must list at least one host:port")
+		for _, addr := range split(c.REDIS_ADDR) {
+			_, _, err := net.SplitHostPort(addr)
+			v.check(err == nil, "REDIS_ADDR", fmt.Sprintf("%q must be host:port", addr))
+		}
+		if strings.EqualFold(c.REDIS_MODE, "sentinel") {
+			v.check(c.REDIS_MASTER_NAME != "", "REDIS_MASTER_NAME", "is required with REDIS_MODE=sentinel")
+		}
+		v.positive("REDIS_TIMEOUT", c.REDIS_TIMEOUT)
+		v.oneOf("CACHE_COMPRESS_ALGORITHM", c.CACHE_COMPRESS_ALGORITHM, "gzip", "zstd")
+		v.oneOf("CACHE_CODEC", c.CACHE_CODEC, "raw", "json", "msgpack")
+		if c.REDIS_BREAKER {
+			v.check(c.REDIS_BREAKER_RATIO > 0 && c.REDIS_BREAKER_RATIO <= 1, "REDIS_BREAKER_RATIO", "must be above 0 and at most 1")
+			v.positive("REDIS_BREAKER_WINDOW", c.REDIS_BREAKER_WINDOW)
+			v.positive("REDIS_BREAKER_TIMEOUT", c.REDIS_BREAKER_TIMEOUT)
+		}
+	}
+
+	if c.ENABLE_GZIP || c.ENABLE_COMPRESSION {
+		v.check(c.GZIP_COMPRESSION_LEVEL >= 1 && c.GZIP_COMPRESSION_LEVEL <= 9, "GZIP_COMPRESSION_LEVEL", "must be between 1 and 9")
+		v.check(c.BROTLI_COMPRESSION_LEVEL >= 0 && c.BROTLI_COMPRESSION_LEVEL <= 11, "BROTLI_COMPRESSION_LEVEL", "must be between 0 and 11")
+		for _, encoding := range split(c.COMPRESSION_ENCODINGS) {
+			v.oneOf("COMPRESSION_ENCODINGS", encoding, "br", "gzip")
+		}
+	}
+
+	v.check(c.TRACING_SAMPLE_RATIO >= 0 && c.TRACING_SAMPLE_RATIO <= 1, "TRACING_SAMPLE_RATIO", "must be between 0 and 1")
+	v.oneOf("GIN_MODE", strings.ToLower(c.GIN_MODE), "debug", "release", "test")
+	v.oneOf("LOG_LEVEL", strings.ToLower(c.LOG_LEVEL), "debug", "info", "warn", "warning", "error")
+	v.oneOf("LOG_FORMAT", strings.ToLower(c.LOG_FORMAT), "text", "json")
+
+	return errors.Join(v.errs...)
+}
+
+type validator struct {
+	errs []error
+}
+
+func (v *validator) check(ok bool, name string, problem string) {
+	if !ok {
+		v.errs = append(v.errs, fmt.Errorf("%s: %s", name, problem))
+	}
+}
+
+func (v *validator) positive(name string, value int) {
+	v.check(value > 0, name, fmt.Sprintf("must be above 0, got %d", value))
+}
+
+func (v *validator) oneOf(name string, value string, allowed ...string) {
+	for _, option := range allowed {
+		if value == option {
+			return
+		}
+	}
+	v.check(false, name, fmt.Sprintf("%q is not one of %s", value, strings.Join(allowed, ", ")))
+}
+
+func (v *validator) upstream(name string, raw string) {
+	target, err := url.Parse(raw)
+	v.check(err == nil && (target.Scheme == "http" || target.Scheme == "https") && target.Host != "",
+		name, fmt.Sprintf("%q must be an absolute http(s) url, e.g. http://10.0.0.1:8080", raw))
+}
+
+// file checks that path can be read, an empty path is only fine when optional.
+func (v *validator) file(name string, path string, required bool) {
+	if path == "" {
+		v.check(!required, name, "must be set")
+		return
+	}
+	_, err := os.Stat(path)
+	v.check(err == nil, name, fmt.Sprintf("cannot read %q: %v", path, err))
+}
+
+// clientKey checks a key of clientkey.Parse, a subject needs the jwt
+// middleware.
+func (v *validator) clientKey(name string, value string, jwt bool) {
+	key, err := clientkey.Parse(value)
+	v.check(err == nil, name, fmt.Sprint(err))
+	v.check(!key.Subject || jwt, name, "subject needs USE_JWT")
+}
+
+// ranges checks a comma separated list of IPs and CIDR ranges.
+func (v *validator) ranges(name string, value string) {
+	for _, item := range split(value) {
+		_, _, err := net.ParseCIDR(item)
+		v.check(err == nil || net.ParseIP(item) != nil, name, fmt.Sprintf("%q is neither an IP nor a CIDR range", item))
+	}
+}
+
+func split(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
@@ -0,0 +1,123 @@
+package config
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jahrulnr/go-waf/pkg/filewatch"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+)
+
+// live lists the settings the running components take over on a reload,
+// every other change needs a restart.
+var live = map[string]bool{
+	"RATELIMIT_SECOND":     true,
+	"RATELIMIT_MAX":        true,
+	"RATELIMIT_ROUTES":     true,
+	"WAF_THRESHOLD":        true,
+	"WAF_DETECTION_ONLY":   true,
+	"AUTOBAN_THRESHOLD":    true,
+	"AUTOBAN_WINDOW":       true,
+	"AUTOBAN_DURATION":     true,
+	"AUTOBAN_MAX_DURATION": true,
+	"MAINTENANCE":          true,
+}
+
+// Watcher reloads the config file whenever it changes. A new version only
+// replaces the current one once it validates, and the reload functions then
+// apply it to the running components.
+type Watcher struct {
+	path    string
+	current atomic.Pointer[Config]
+	watcher *filewatch.Watcher
+
+	mu       sync.Mutex
+	running  Config // the settings in effect, the started ones plus the live changes
+	handlers []func(*Config)
+}
+
+// NewWatcher watches the file conf was loaded from.
+func NewWatcher(conf *Config) (*Watcher, error) {
+	w := &Watcher{
+		path:    filepath.Clean(conf.CONFIG_FILE),
+		running: *conf,
+	}
+	w.current.Store(conf)
+
+	var err error
+	w.watcher, err = filewatch.New(conf.CONFIG_FILE, w.reload)
+	if err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// OnReload calls fn with every new config. fn must only take over the
+// settings listed as live, the others are reported as needing a restart.
+func (w *Watcher) OnReload(fn func(*Config)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.handlers = append(w.handlers, fn)
+}
+
+// Config returns the last valid config.
+func (w *Watcher) Config() *Config {
+	return w.current.Load()
+}
+
+func (w *Watcher) Close() error {
+	return w.watcher.Close()
+}
+
+func (w *Watcher) reload() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	conf, err := Load(w.path)
+	if err != nil {
+		logger.Logger("[error] keep previous config, reload failed ", err.Error()).Error()
+		return
+	}
+
+	// compared with what runs, a pending restart is reported on every reload
+	var applied, restart []string
+	running := reflect.ValueOf(&w.running).Elem()
+	for _, name := range Changed(&w.running, conf) {
+		if live[name] {
+			running.FieldByName(name).Set(reflect.ValueOf(conf).Elem().FieldByName(name))
+			applied = append(applied, name)
+		} else {
+			restart = append(restart, name)
+		}
+	}
+	if len(restart) > 0 {
+		logger.Logger("[warn] config changes need a restart to apply: ", strings.Join(restart, ", ")).Warn()
+	}
+
+	w.current.Store(conf)
+	if len(applied) == 0 {
+		return
+	}
+	for _, fn := range w.handlers {
+		fn(conf)
+	}
+	logger.Logger("[info] reloaded config from ", w.path, ", applied: ", strings.Join(applied, ", ")).Info()
+}
+
+// Changed returns the names of the settings differing between old and new.
+func Changed(old *Config, new *Config) []string {
+	var names []string
+	before, after := reflect.ValueOf(old).Elem(), reflect.ValueOf(new).Elem()
+	for i := 0; i < before.NumField(); i++ {
+		if before.Field(i).Interface() != after.Field(i).Interface() {
+			names = append(names, before.Type().Field(i).Name)
+		}
+	}
+
+	return names
+}
@@ -0,0 +1,277 @@
+package cookies
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/jahrulnr/go-waf/pkg/audit"
+	"github.com/jahrulnr/go-waf/pkg/block"
+	"github.com/jahrulnr/go-waf/pkg/clientip"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// What is done with a tampered cookie.
+const (
+	ActionStrip  = "strip"  // the cookie is removed, the request goes on without it
+	ActionReject = "reject" // the request is answered with 403
+)
+
+// What is done with a cookie set without Secure, HttpOnly or SameSite.
+const (
+	FlagsOff = "off"
+	FlagsLog = "log" // the missing attributes are logged
+	FlagsFix = "fix" // the missing attributes are added
+)
+
+// Options configures the guard. Zero values take the defaults noted on each
+// field.
+type Options struct {
+	Secret   []byte        // signs the cookies of Signed, required with them
+	Signed   []string      // names of the cookies signed, a trailing * matches a prefix
+	Action   string        // on a tampered cookie, ActionStrip (default) or ActionReject
+	Flags    string        // on cookies set without the attributes, FlagsLog (default), FlagsFix or FlagsOff
+	SameSite http.SameSite // added by FlagsFix, default Lax
+	Exempt   []string      // names of the cookies Flags leaves alone, like the ones scripts read, a trailing * matches a prefix
+}
+
+// Guard protects the integrity of the cookies an app sets. The values of the
+// Signed cookies get an HMAC of their name and value on the way out, and on
+// the way in a cookie whose signature doesn't match, or that has none, is
+// tampered: it is stripped from the request or the request is rejected. The
+// upstream sees the values without the signature, it needn't know about it.
+//
+// The cookies set by responses are also checked for Secure, over HTTPS
+// only, as browsers drop Secure cookies set over plain HTTP, HttpOnly and
+// SameSite, and the missing ones are logged or added.
+type Guard struct {
+	options Options
+	audit   *audit.Logger
+}
+
+func NewGuard(options Options) (*Guard, error) {
+	if len(options.Signed) > 0 && len(options.Secret) == 0 {
+		return nil, errors.New("signed cookies need a secret")
+	}
+	if options.Action != ActionReject {
+		options.Action = ActionStrip
+	}
+	if options.Flags != FlagsOff && options.Flags != FlagsFix {
+		options.Flags = FlagsLog
+	}
+	if options.SameSite == 0 {
+		options.SameSite = http.SameSiteLaxMode
+	}
+
+	return &Guard{options: options}, nil
+}
+
+// SetAudit writes every rejected request to the audit log.
+func (g *Guard) SetAudit(audit *audit.Logger) {
+	g.audit = audit
+}
+
+// Middleware verifies the signed cookies of the request and signs and checks
+// the cookies of the response, whoever sets them, the WAF included.
+func (g *Guard) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if tampered := g.verify(c.Request); len(tampered) > 0 {
+			ip := clientip.FromContext(c)
+			logger.FromContext(c.Request.Context()).Logger("[warn] tampered cookies ", tampered, " ", ip, " ", c.Request.Method, " ", c.Request.URL.RequestURI(), " ", g.options.Action).Warn()
+			if g.options.Action == ActionReject {
+				fields := make([]string, len(tampered))
+				for i, name := range tampered {
+					fields[i] = "cookie:" + name
+				}
+				record := audit.Record{
+					Source: "cookie",
+					Rules:  []string{"cookie-tampered"},
+					Fields: fields,
+					Status: http.StatusForbidden,
+				}
+				g.audit.Log(c.Request, ip, record)
+				if block.Respond(c, block.FromRecord(record)) {
+					return
+				}
+				c.String(http.StatusForbidden, "403 | Forbidden.")
+				c.Abort()
+				return
+			}
+		}
+
+		if len(g.options.Signed) > 0 || g.options.Flags != FlagsOff {
+			c.Writer = &cookieWriter{ResponseWriter: c.Writer, guard: g, request: c.Request}
+		}
+		c.Next()
+	}
+}
+
+// verify replaces the signed cookies of r by their values and strips the
+// tampered ones, whose names it returns.
+func (g *Guard) verify(r *http.Request) []string {
+	if len(g.options.Signed) == 0 || r.Header.Get("Cookie") == "" {
+		return nil
+	}
+
+	var (
+		kept     []string
+		tampered []string
+		changed  bool
+	)
+	for _, cookie := range r.Cookies() {
+		if !match(g.options.Signed, cookie.Name) {
+			kept = append(kept, cookie.String())
+			continue
+		}
+		changed = true
+		value, ok := g.unsign(cookie.Name, cookie.Value)
+		if !ok {
+			tampered = append(tampered, cookie.Name)
+			continue
+		}
+		cookie.Value = value
+		kept = append(kept, cookie.String())
+	}
+	if changed {
+		r.Header.Del("Cookie")
+		if len(kept) > 0 {
+			r.Header.Set("Cookie", strings.Join(kept, "; "))
+		}
+	}
+
+	return tampered
+}
+
+// response signs and checks the cookies set by header.
+func (g *Guard) response(r *http.Request, header http.Header) {
+	values := header.Values("Set-Cookie")
+	if len(values) == 0 {
+		return
+	}
+
+	secure := r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+	rewritten := make([]string, 0, len(values))
+	rewrite := false
+	for _, value := range values {
+		cookie, err := http.ParseSetCookie(value)
+		if err != nil {
+			rewritten = append(rewritten, value)
+			continue
+		}
+
+		changed := false
+		if match(g.options.Signed, cookie.Name) && cookie.Value != "" && cookie.MaxAge >= 0 {
+			cookie.Value = g.sign(cookie.Name, cookie.Value)
+			changed = true
+		}
+		if g.options.Flags != FlagsOff && !match(g.options.Exempt, cookie.Name) {
+			if missing := g.missing(cookie, secure); len(missing) > 0 {
+				logger.FromContext(r.Context()).Logger("[warn] cookie ", cookie.Name, " set without ", missing, " ", r.Method, " ", r.URL.RequestURI()).Warn()
+				if g.options.Flags == FlagsFix {
+					cookie.Secure = cookie.Secure || secure
+					cookie.HttpOnly = true
+					if cookie.SameSite == 0 {
+						cookie.SameSite = g.options.SameSite
+					}
+					changed = true
+				}
+			}
+		}
+
+		if !changed {
+			rewritten = append(rewritten, value)
+			continue
+		}
+		rewrite = true
+		rewritten = append(rewritten, cookie.String())
+	}
+	if rewrite {
+		header["Set-Cookie"] = rewritten
+	}
+}
+
+// missing returns the attributes cookie is set without, Secure only when
+// the request came over HTTPS.
+func (g *Guard) missing(cookie *http.Cookie, secure bool) []string {
+	var missing []string
+	if secure && !cookie.Secure {
+		missing = append(missing, "Secure")
+	}
+	if !cookie.HttpOnly {
+		missing = append(missing, "HttpOnly")
+	}
+	if cookie.SameSite == 0 {
+		missing = append(missing, "SameSite")
+	}
+
+	return missing
+}
+
+// sign appends the HMAC of name and value to value, so a signed value can't
+// be moved to another cookie.
+func (g *Guard) sign(name string, value string) string {
+	mac := hmac.New(sha256.New, g.options.Secret)
+	mac.Write([]byte(name + "=" + value))
+	return value + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (g *Guard) unsign(name string, signed string) (string, bool) {
+	i := strings.LastIndexByte(signed, '.')
+	if i < 0 {
+		return "", false
+	}
+	value := signed[:i]
+
+	return value, hmac.Equal([]byte(g.sign(name, value)), []byte(signed))
+}
+
+func match(names []string, name string) bool {
+	for _, pattern := range names {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok && strings.HasPrefix(name, prefix) || pattern == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// cookieWriter signs and checks the cookies right before the headers are
+// written.
+type cookieWriter struct {
+	gin.ResponseWriter
+	guard   *Guard
+	request *http.Request
+	applied bool
+}
+
+func (w *cookieWriter) before() {
+	if !w.applied {
+		w.applied = true
+		w.guard.response(w.request, w.ResponseWriter.Header())
+	}
+}
+
+func (w *cookieWriter) WriteHeader(status int) {
+	w.before()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *cookieWriter) WriteHeaderNow() {
+	w.before()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *cookieWriter) Write(data []byte) (int, error) {
+	w.before()
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *cookieWriter) WriteString(data string) (int, error) {
+	w.before()
+	return w.ResponseWriter.WriteString(data)
+}
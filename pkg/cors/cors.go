@@ -0,0 +1,243 @@
+package cors
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Options configures the allowed cross origin requests. Names are matched
+// case insensitively.
+type Options struct {
+	AllowedOrigins   []string // https://app.example.com, https://*.example.com for any subdomain, or *
+	AllowedMethods   []string // default GET, HEAD and POST
+	AllowedHeaders   []string // request headers a preflight may ask for
+	ExposedHeaders   []string // response headers scripts may read
+	AllowCredentials bool
+	MaxAge           time.Duration // how long browsers may cache a preflight, 0 leaves it to them
+}
+
+// CORS answers preflight requests itself and sets the Access-Control headers
+// of the other responses. The WAF owns the policy: Access-Control headers
+// sent by the upstream are dropped.
+type CORS struct {
+	options Options
+
+	anyOrigin bool
+	origins   map[string]bool
+	wildcards []wildcard
+	methods   map[string]bool
+	headers   map[string]bool
+}
+
+// wildcard is an origin pattern like https://*.example.com.
+type wildcard struct {
+	scheme string
+	suffix string // .example.com
+}
+
+func NewCORS(options Options) *CORS {
+	if len(options.AllowedMethods) == 0 {
+		options.AllowedMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+	}
+
+	c := &CORS{
+		options: options,
+		origins: make(map[string]bool),
+		methods: make(map[string]bool),
+		headers: make(map[string]bool),
+	}
+	for _, origin := range options.AllowedOrigins {
+		origin = strings.ToLower(strings.TrimSpace(origin))
+		scheme, host, found := strings.Cut(origin, "://*.")
+		switch {
+		case origin == "*":
+			c.anyOrigin = true
+		case found:
+			c.wildcards = append(c.wildcards, wildcard{scheme: scheme, suffix: "." + host})
+		case origin != "":
+			c.origins[origin] = true
+		}
+	}
+	for _, method := range options.AllowedMethods {
+		c.methods[strings.ToUpper(strings.TrimSpace(method))] = true
+	}
+	for _, header := range options.AllowedHeaders {
+		c.headers[http.CanonicalHeaderKey(strings.TrimSpace(header))] = true
+	}
+
+	return c
+}
+
+// Allowed reports whether origin matches the allow list.
+func (c *CORS) Allowed(origin string) bool {
+	if c.anyOrigin {
+		return true
+	}
+
+	origin = strings.ToLower(origin)
+	if c.origins[origin] {
+		return true
+	}
+
+	parsed, err := url.Parse(origin)
+	if err != nil || parsed.Host == "" {
+		return false
+	}
+	for _, pattern := range c.wildcards {
+		if parsed.Scheme == pattern.scheme &&
+			strings.HasSuffix(parsed.Host, pattern.suffix) && len(parsed.Host) > len(pattern.suffix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Middleware applies the policy. A preflight that isn't allowed gets 403 and
+// never reaches the upstream, responses to other requests only get the
+// Access-Control headers when their Origin is allowed.
+func (c *CORS) Middleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		origin := ctx.GetHeader("Origin")
+		allowed := origin != "" && c.Allowed(origin)
+		if origin != "" && ctx.Request.Method == http.MethodOptions && ctx.GetHeader("Access-Control-Request-Method") != "" {
+			c.preflight(ctx, origin, allowed)
+			return
+		}
+
+		ctx.Writer = &corsWriter{ResponseWriter: ctx.Writer, apply: func(header http.Header) {
+			removeCORSHeaders(header)
+			addVary(header, "Origin")
+			if !allowed {
+				return
+			}
+			c.setOrigin(header, origin)
+			if len(c.options.ExposedHeaders) > 0 {
+				header.Set("Access-Control-Expose-Headers", strings.Join(c.options.ExposedHeaders, ", "))
+			}
+		}}
+		ctx.Next()
+	}
+}
+
+func (c *CORS) preflight(ctx *gin.Context, origin string, allowed bool) {
+	header := ctx.Writer.Header()
+	addVary(header, "Origin")
+	addVary(header, "Access-Control-Request-Method")
+	addVary(header, "Access-Control-Request-Headers")
+
+	method := strings.ToUpper(ctx.GetHeader("Access-Control-Request-Method"))
+	requested := requestedHeaders(ctx.GetHeader("Access-Control-Request-Headers"))
+	if !allowed || !c.methods[method] || !c.headersAllowed(requested) {
+		ctx.String(http.StatusForbidden, "403 | Forbidden.")
+		ctx.Abort()
+		return
+	}
+
+	c.setOrigin(header, origin)
+	header.Set("Access-Control-Allow-Methods", strings.Join(c.options.AllowedMethods, ", "))
+	if len(requested) > 0 {
+		header.Set("Access-Control-Allow-Headers", strings.Join(requested, ", "))
+	}
+	if c.options.MaxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(int(c.options.MaxAge.Seconds())))
+	}
+
+	ctx.AbortWithStatus(http.StatusNoContent)
+}
+
+// setOrigin reflects origin, a plain * is only sent without credentials as
+// browsers refuse it otherwise.
+func (c *CORS) setOrigin(header http.Header, origin string) {
+	if c.anyOrigin && !c.options.AllowCredentials {
+		header.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		header.Set("Access-Control-Allow-Origin", origin)
+	}
+	if c.options.AllowCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+func (c *CORS) headersAllowed(requested []string) bool {
+	for _, name := range requested {
+		if !c.headers[name] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// requestedHeaders parses Access-Control-Request-Headers.
+func requestedHeaders(value string) []string {
+	var headers []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			headers = append(headers, http.CanonicalHeaderKey(name))
+		}
+	}
+
+	return headers
+}
+
+// addVary adds name to Vary unless it is listed already, e.g. by a cached
+// response.
+func addVary(header http.Header, name string) {
+	for _, value := range header.Values("Vary") {
+		for _, listed := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(listed), name) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", name)
+}
+
+func removeCORSHeaders(header http.Header) {
+	for name := range header {
+		if strings.HasPrefix(name, "Access-Control-") {
+			header.Del(name)
+		}
+	}
+}
+
+// corsWriter applies the CORS headers once the response headers are final,
+// after the upstream headers were copied.
+type corsWriter struct {
+	gin.ResponseWriter
+	apply   func(http.Header)
+	applied bool
+}
+
+func (w *corsWriter) before() {
+	if !w.applied {
+		w.applied = true
+		w.apply(w.ResponseWriter.Header())
+	}
+}
+
+func (w *corsWriter) WriteHeader(status int) {
+	w.before()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *corsWriter) WriteHeaderNow() {
+	w.before()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *corsWriter) Write(data []byte) (int, error) {
+	w.before()
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *corsWriter) WriteString(data string) (int, error) {
+	w.before()
+	return w.ResponseWriter.WriteString(data)
+}
@@ -0,0 +1,303 @@
+package csrf
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jahrulnr/go-waf/internal/interface/repository"
+	"github.com/jahrulnr/go-waf/pkg/block"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TokenKey is the gin context key holding the token of the request.
+const TokenKey = "csrf.token"
+
+type Mode string
+
+const (
+	// DoubleSubmit issues a signed cookie which state-changing requests must
+	// echo in the header or form field. Nothing is stored server side.
+	DoubleSubmit Mode = "double_submit"
+	// Synchronizer keeps the token in the state store, keyed by a session
+	// cookie, so every instance sharing the store accepts it.
+	Synchronizer Mode = "synchronizer"
+)
+
+// Options configures the protection. Zero values take the defaults noted on
+// each field.
+type Options struct {
+	Mode          Mode
+	Secret        []byte        // signs the double submit cookie, random per process when empty
+	TTL           time.Duration // token lifetime, default 12h
+	CookieName    string        // cookie carrying the token to scripts, default csrf_token
+	SessionCookie string        // synchronizer session cookie, default gowaf_session
+	HeaderName    string        // default X-CSRF-Token
+	FieldName     string        // form field, default csrf_token
+	ExemptPaths   []string      // path prefixes never checked
+	SameSite      http.SameSite // default Lax
+	Secure        bool          // send the cookies over https only
+	MaxFormSize   int64         // form bytes searched for the field, default 64KB
+}
+
+type CSRF struct {
+	options Options
+	store   repository.StateStore
+}
+
+func NewCSRF(store repository.StateStore, options Options) *CSRF {
+	if options.Mode != Synchronizer {
+		options.Mode = DoubleSubmit
+	}
+	if len(options.Secret) == 0 {
+		options.Secret = make([]byte, 32)
+		rand.Read(options.Secret)
+		if options.Mode == DoubleSubmit {
+			logger.Logger("[warn] csrf secret is not set, tokens are only valid on this instance").Warn()
+		}
+	}
+	if options.TTL <= 0 {
+		options.TTL = 12 * time.Hour
+	}
+	if options.CookieName == "" {
+		options.CookieName = "csrf_token"
+	}
+	if options.SessionCookie == "" {
+		options.SessionCookie = "gowaf_session"
+	}
+	if options.HeaderName == "" {
+		options.HeaderName = "X-CSRF-Token"
+	}
+	if options.FieldName == "" {
+		options.FieldName = "csrf_token"
+	}
+	if options.SameSite == 0 {
+		options.SameSite = http.SameSiteLaxMode
+	}
+	if options.MaxFormSize <= 0 {
+		options.MaxFormSize = 64 << 10
+	}
+
+	return &CSRF{
+		options: options,
+		store:   store,
+	}
+}
+
+// ParseSameSite reads lax, strict or none, anything else is Lax.
+func ParseSameSite(value string) http.SameSite {
+	switch strings.ToLower(value) {
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	default:
+		return http.SameSiteLaxMode
+	}
+}
+
+// Middleware issues a token on safe requests and rejects state-changing
+// requests whose header or form field doesn't carry a valid one with 403.
+// The token is sent in a cookie readable by scripts and in the header named
+// HeaderName, and put in the gin context under TokenKey.
+func (p *CSRF) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if safe(c.Request.Method) {
+			token, err := p.issue(c)
+			if err != nil {
+				// the page still works, only its forms will be refused
+				logger.FromContext(c.Request.Context()).Logger("[warn] fail to issue csrf token ", err.Error()).Warn()
+			} else {
+				c.Set(TokenKey, token)
+				c.Header(p.options.HeaderName, token)
+			}
+			c.Next()
+			return
+		}
+
+		if p.exempt(c.Request.URL.Path) {
+			c.Next()
+			return
+		}
+
+		if !p.valid(c, p.submitted(c.Request)) {
+			logger.FromContext(c.Request.Context()).Logger("[warn] csrf token mismatch ", c.Request.Method, " ", c.Request.URL.RequestURI()).Warn()
+			if block.Respond(c, block.Decision{Component: "csrf", Status: http.StatusForbidden}) {
+				return
+			}
+			c.String(http.StatusForbidden, "403 | Forbidden.")
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+func safe(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead ||
+		method == http.MethodOptions || method == http.MethodTrace
+}
+
+func (p *CSRF) exempt(path string) bool {
+	for _, prefix := range p.options.ExemptPaths {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// issue returns the current token of the client, creating one when needed.
+func (p *CSRF) issue(c *gin.Context) (string, error) {
+	if p.options.Mode == DoubleSubmit {
+		if cookie, err := c.Cookie(p.options.CookieName); err == nil && p.signed(cookie) {
+			return cookie, nil
+		}
+		token := p.sign(randomToken())
+		p.setCookie(c, p.options.CookieName, token, false)
+		return token, nil
+	}
+
+	session, err := c.Cookie(p.options.SessionCookie)
+	if err != nil || session == "" {
+		session = randomToken()
+		p.setCookie(c, p.options.SessionCookie, session, true)
+	}
+
+	cache := p.store.StateContext(c.Request.Context())
+	key := p.key(session)
+	if token, ok := cache.Get(key); ok {
+		return string(token), nil
+	}
+
+	token := randomToken()
+	if err := cache.Set(key, []byte(token), p.options.TTL); err != nil {
+		return "", err
+	}
+	p.setCookie(c, p.options.CookieName, token, false)
+
+	return token, nil
+}
+
+// valid checks submitted against the cookie or the cached token.
+func (p *CSRF) valid(c *gin.Context, submitted string) bool {
+	if submitted == "" {
+		return false
+	}
+
+	var expected string
+	if p.options.Mode == DoubleSubmit {
+		cookie, err := c.Cookie(p.options.CookieName)
+		if err != nil || !p.signed(cookie) {
+			return false
+		}
+		expected = cookie
+	} else {
+		session, err := c.Cookie(p.options.SessionCookie)
+		if err != nil || session == "" {
+			return false
+		}
+		token, ok := p.store.StateContext(c.Request.Context()).Get(p.key(session))
+		if !ok {
+			return false
+		}
+		expected = string(token)
+	}
+
+	return subtle.ConstantTimeCompare([]byte(submitted), []byte(expected)) == 1
+}
+
+// key hashes the session id, the raw id never reaches the cache.
+func (p *CSRF) key(session string) string {
+	sum := sha256.Sum256([]byte(session))
+	return "gowaf-csrf-" + hex.EncodeToString(sum[:16])
+}
+
+func (p *CSRF) sign(value string) string {
+	mac := hmac.New(sha256.New, p.options.Secret)
+	mac.Write([]byte(value))
+	return value + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (p *CSRF) signed(token string) bool {
+	value, _, found := strings.Cut(token, ".")
+	return found && hmac.Equal([]byte(p.sign(value)), []byte(token))
+}
+
+func (p *CSRF) setCookie(c *gin.Context, name string, value string, httpOnly bool) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(p.options.TTL.Seconds()),
+		Secure:   p.options.Secure,
+		HttpOnly: httpOnly,
+		SameSite: p.options.SameSite,
+	})
+}
+
+// submitted returns the token from the header, or else from the form field.
+// The body is put back for the upstream.
+func (p *CSRF) submitted(r *http.Request) string {
+	if token := r.Header.Get(p.options.HeaderName); token != "" {
+		return token
+	}
+	if r.Body == nil || r.Body == http.NoBody {
+		return ""
+	}
+
+	mediaType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/x-www-form-urlencoded" && mediaType != "multipart/form-data" {
+		return ""
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(r.Body, p.options.MaxFormSize))
+	r.Body = &replayBody{Reader: io.MultiReader(bytes.NewReader(body), r.Body), closer: r.Body}
+
+	if mediaType == "application/x-www-form-urlencoded" {
+		values, _ := url.ParseQuery(string(body))
+		return values.Get(p.options.FieldName)
+	}
+
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			return ""
+		}
+		if part.FormName() == p.options.FieldName && part.FileName() == "" {
+			value, _ := io.ReadAll(io.LimitReader(part, 1<<10))
+			return string(value)
+		}
+	}
+}
+
+func randomToken() string {
+	buf := make([]byte, 32)
+	rand.Read(buf)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+type replayBody struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (b *replayBody) Close() error {
+	return b.closer.Close()
+}
@@ -0,0 +1,68 @@
+package dryrun
+
+import (
+	"github.com/jahrulnr/go-waf/pkg/audit"
+	"github.com/jahrulnr/go-waf/pkg/clientip"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+	"github.com/jahrulnr/go-waf/pkg/metrics"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultHeader carries the would-be actions in the response.
+const DefaultHeader = "X-WAF-Dry-Run"
+
+// DryRun makes the blocking middlewares forward the requests they would stop,
+// so a new rule set or threshold can be watched in production first. Every
+// would-be action is logged, counted, written to the audit log and added to
+// the response header as source=action, e.g. ratelimit=rate_limit. A nil
+// *DryRun is off, the middlewares carry one without checks.
+type DryRun struct {
+	header  string
+	audit   *audit.Logger
+	metrics metrics.DryRunRecorder
+}
+
+// NewDryRun turns dry run on. An empty header takes DefaultHeader, a nil
+// recorder counts nothing.
+func NewDryRun(header string, audit *audit.Logger, recorder metrics.DryRunRecorder) *DryRun {
+	if header == "" {
+		header = DefaultHeader
+	}
+	if recorder == nil {
+		recorder = metrics.NoopRecorder{}
+	}
+
+	return &DryRun{
+		header:  header,
+		audit:   audit,
+		metrics: recorder,
+	}
+}
+
+// Enabled reports whether dry run is on.
+func (d *DryRun) Enabled() bool {
+	return d != nil
+}
+
+// Forward reports whether the request record would stop goes on anyway.
+// When it does the action is recorded, and the caller calls c.Next instead
+// of answering.
+func (d *DryRun) Forward(c *gin.Context, record audit.Record) bool {
+	if d == nil {
+		return false
+	}
+
+	if record.Action == "" {
+		record.Action = "block"
+	}
+	record.DryRun = true
+
+	ip := clientip.FromContext(c)
+	logger.FromContext(c.Request.Context()).Logger("[warn] dry run, ", record.Source, " would ", record.Action, " ", ip, " ", c.Request.Method, " ", c.Request.URL.RequestURI()).Warn()
+	d.metrics.RecordDryRun(record.Source, record.Action)
+	d.audit.Log(c.Request, ip, record)
+	c.Writer.Header().Add(d.header, record.Source+"="+record.Action)
+
+	return true
+}
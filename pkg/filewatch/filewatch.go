@@ -0,0 +1,141 @@
+package filewatch
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jahrulnr/go-waf/pkg/logger"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Delay groups the burst of events editors produce for a single save.
+const Delay = 100 * time.Millisecond
+
+// Watcher calls a load function whenever a file changes, once per burst of
+// events. It watches the directory of the file, as editors replace the file
+// rather than write it, and resolves its symlinks on every event, as a
+// Kubernetes ConfigMap is updated by swapping the ..data link the file
+// points through without touching the file itself.
+type Watcher struct {
+	path    string
+	delay   time.Duration
+	target  string // what path resolved to at the last load
+	load    func()
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+
+	mu     sync.Mutex
+	timer  *time.Timer
+	closed bool
+}
+
+// New watches path and calls load once Delay passed after it changed. The
+// caller does the initial load, load handles and logs its own errors.
+func New(path string, load func()) (*Watcher, error) {
+	return NewWithDelay(path, Delay, load)
+}
+
+// NewWithDelay is New waiting delay for the events to settle, e.g. for large
+// files copied in several writes.
+func NewWithDelay(path string, delay time.Duration, load func()) (*Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	path = filepath.Clean(path)
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	w := &Watcher{
+		path:    path,
+		delay:   delay,
+		load:    load,
+		watcher: watcher,
+		done:    make(chan struct{}),
+	}
+	w.target, _ = filepath.EvalSymlinks(path)
+
+	go w.watch()
+
+	return w, nil
+}
+
+// Close stops watching. A pending load is dropped, and one running is
+// waited for, load is never called once Close returned.
+func (w *Watcher) Close() error {
+	err := w.watcher.Close()
+	<-w.done
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.closed = true
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+
+	return err
+}
+
+func (w *Watcher) watch() {
+	defer close(w.done)
+
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if w.changed(event) {
+				w.schedule()
+			}
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			logger.Logger("[warn] file watcher error ", w.path, " ", err.Error()).Warn()
+		}
+	}
+}
+
+// changed reports whether event changed the file, itself or what its
+// symlinks lead to.
+func (w *Watcher) changed(event fsnotify.Event) bool {
+	target, err := filepath.EvalSymlinks(w.path)
+	if filepath.Clean(event.Name) == w.path {
+		w.target = target
+		return event.Op != fsnotify.Chmod
+	}
+
+	if err != nil || target == w.target {
+		return false
+	}
+	w.target = target
+
+	return true
+}
+
+// schedule loads the file once the delay passed without another event.
+func (w *Watcher) schedule() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	w.timer = time.AfterFunc(w.delay, w.fire)
+}
+
+func (w *Watcher) fire() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.closed {
+		w.load()
+	}
+}
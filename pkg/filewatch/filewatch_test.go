@@ -0,0 +1,106 @@
+package filewatch_test
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jahrulnr/go-waf/pkg/filewatch"
+)
+
+// wait polls until loads reached want or a second passed.
+func wait(t *testing.T, loads *atomic.Int64, want int64) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for loads.Load() < want && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := loads.Load(); got != want {
+		t.Fatalf("%d loads, want %d", got, want)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	os.WriteFile(path, []byte("a"), 0600)
+
+	var loads atomic.Int64
+	w, err := filewatch.New(path, func() { loads.Add(1) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// a burst of writes loads once
+	for _, content := range []string{"b", "c", "d"} {
+		os.WriteFile(path, []byte(content), 0600)
+	}
+	wait(t, &loads, 1)
+
+	// another file of the directory is no change
+	os.WriteFile(filepath.Join(filepath.Dir(path), "other.yaml"), []byte("a"), 0600)
+	time.Sleep(filewatch.Delay * 2)
+	if got := loads.Load(); got != 1 {
+		t.Errorf("%d loads after writing another file, want 1", got)
+	}
+}
+
+// TestConfigMap updates the file the way the kubelet updates a mounted
+// ConfigMap: the file links to ..data/rules.yaml, and ..data is swapped to a
+// new directory.
+func TestConfigMap(t *testing.T) {
+	dir := t.TempDir()
+	version := func(name string, content string) {
+		os.Mkdir(filepath.Join(dir, name), 0700)
+		os.WriteFile(filepath.Join(dir, name, "rules.yaml"), []byte(content), 0600)
+	}
+	version("..v1", "a")
+	if err := os.Symlink("..v1", filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "rules.yaml")
+	os.Symlink(filepath.Join("..data", "rules.yaml"), path)
+
+	var loads atomic.Int64
+	w, err := filewatch.New(path, func() { loads.Add(1) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	version("..v2", "b")
+	os.Symlink("..v2", filepath.Join(dir, "..data_tmp"))
+	if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	os.RemoveAll(filepath.Join(dir, "..v1"))
+	wait(t, &loads, 1)
+
+	content, _ := os.ReadFile(path)
+	if string(content) != "b" {
+		t.Errorf("file reads %q, want the new version", content)
+	}
+}
+
+func TestClosePending(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	os.WriteFile(path, []byte("a"), 0600)
+
+	var loads atomic.Int64
+	w, err := filewatch.New(path, func() { loads.Add(1) })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.WriteFile(path, []byte("b"), 0600)
+	// let the event arrive, the load waits for Delay
+	time.Sleep(filewatch.Delay / 2)
+	w.Close()
+
+	time.Sleep(filewatch.Delay * 2)
+	if got := loads.Load(); got != 0 {
+		t.Errorf("%d loads after Close, want none", got)
+	}
+}
@@ -0,0 +1,105 @@
+package geoip
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/jahrulnr/go-waf/pkg/filewatch"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// reloadDelay groups the events of a single copy or replace of the file.
+const reloadDelay = 500 * time.Millisecond
+
+// record is the part of a GeoIP2/GeoLite2 country or city record we need.
+type record struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+// DB resolves IP addresses to ISO 3166 country codes from a MaxMind MMDB
+// file, reloading it when the file changes. The file is read into memory, so
+// replacing it never affects lookups in flight.
+type DB struct {
+	path    string
+	reader  atomic.Pointer[maxminddb.Reader]
+	watcher *filewatch.Watcher
+}
+
+// NewDB watches path and loads it. A missing or invalid file is logged and
+// picked up once it is written, Loaded reports whether one was read.
+func NewDB(path string) (*DB, error) {
+	db := &DB{path: filepath.Clean(path)}
+	db.reload()
+
+	var err error
+	db.watcher, err = filewatch.NewWithDelay(path, reloadDelay, db.reload)
+	if err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// Loaded reports whether a database is available.
+func (db *DB) Loaded() bool {
+	return db.reader.Load() != nil
+}
+
+// Lookup returns the country code of ip, e.g. "US". ok is false when the
+// database is not loaded or has no country for ip, like private addresses.
+func (db *DB) Lookup(ip net.IP) (country string, ok bool) {
+	reader := db.reader.Load()
+	if reader == nil || ip == nil {
+		return "", false
+	}
+
+	var result record
+	if err := reader.Lookup(ip, &result); err != nil {
+		return "", false
+	}
+
+	country = result.Country.ISOCode
+	if country == "" {
+		country = result.RegisteredCountry.ISOCode
+	}
+
+	return country, country != ""
+}
+
+func (db *DB) Close() error {
+	return db.watcher.Close()
+}
+
+func (db *DB) reload() {
+	reader, err := load(db.path)
+	if err != nil {
+		if db.Loaded() {
+			logger.Logger("[error] keep previous geoip database, reload failed ", err.Error()).Error()
+		} else {
+			logger.Logger("[warn] geoip database not loaded ", err.Error()).Warn()
+		}
+		return
+	}
+
+	db.reader.Store(reader)
+	logger.Logger("[info] loaded geoip database ", db.path, " built ", time.Unix(int64(reader.Metadata.BuildEpoch), 0).UTC().Format(time.DateOnly)).Info()
+}
+
+func load(path string) (*maxminddb.Reader, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return maxminddb.FromBytes(data)
+}
@@ -0,0 +1,237 @@
+package graphql
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// listArguments bound how many items a field returns, the cost of its
+// selections is multiplied by them.
+var listArguments = []string{"first", "last", "limit"}
+
+// Stats measures the operation a request runs, its fragments expanded.
+type Stats struct {
+	Depth         int  // of the deepest field
+	Complexity    int  // fields selected, those under a list counted once per item
+	Introspection bool // __schema or __type is selected, __typename alone isn't
+}
+
+type measure struct {
+	depth int
+	cost  int
+}
+
+type analyzer struct {
+	doc           *Document
+	operation     *Operation
+	variables     map[string]interface{}
+	fragments     map[string]measure
+	visiting      map[string]bool
+	introspection bool
+}
+
+// Analyze measures the operation named operationName, or the only one of doc
+// when empty. A document of several operations without a name is measured by
+// its largest, the server refuses it anyway. variables resolve the list sizes
+// passed as variables.
+func Analyze(doc *Document, operationName string, variables map[string]interface{}) (Stats, error) {
+	operations := doc.Operations
+	if operationName != "" {
+		operations = nil
+		for _, operation := range doc.Operations {
+			if operation.Name == operationName {
+				operations = append(operations, operation)
+			}
+		}
+		if len(operations) == 0 {
+			return Stats{}, fmt.Errorf("unknown operation %s", operationName)
+		}
+	}
+
+	var stats Stats
+	for _, operation := range operations {
+		a := &analyzer{
+			doc:       doc,
+			operation: operation,
+			variables: variables,
+			fragments: make(map[string]measure),
+			visiting:  make(map[string]bool),
+		}
+		m, err := a.measure(operation.Selections)
+		if err != nil {
+			return Stats{}, err
+		}
+		stats.Depth = max(stats.Depth, m.depth)
+		stats.Complexity = max(stats.Complexity, m.cost)
+		stats.Introspection = stats.Introspection || a.introspection
+	}
+
+	return stats, nil
+}
+
+func (a *analyzer) measure(selections []*Selection) (measure, error) {
+	var total measure
+	for _, selection := range selections {
+		var m measure
+		var err error
+		switch {
+		case selection.Spread:
+			m, err = a.fragment(selection.Name)
+		case selection.Inline:
+			m, err = a.measure(selection.Selections)
+		default:
+			if selection.Name == "__schema" || selection.Name == "__type" {
+				a.introspection = true
+			}
+			m, err = a.measure(selection.Selections)
+			m.depth++
+			m.cost = add(1, multiply(a.size(selection), m.cost))
+		}
+		if err != nil {
+			return measure{}, err
+		}
+		total.depth = max(total.depth, m.depth)
+		total.cost = add(total.cost, m.cost)
+	}
+
+	return total, nil
+}
+
+// fragment measures a fragment once, however often it is spread.
+func (a *analyzer) fragment(name string) (measure, error) {
+	if m, ok := a.fragments[name]; ok {
+		return m, nil
+	}
+	fragment, ok := a.doc.Fragments[name]
+	if !ok {
+		return measure{}, fmt.Errorf("unknown fragment %s", name)
+	}
+	if a.visiting[name] {
+		return measure{}, fmt.Errorf("fragment %s spreads itself", name)
+	}
+
+	a.visiting[name] = true
+	m, err := a.measure(fragment.Selections)
+	delete(a.visiting, name)
+	if err != nil {
+		return measure{}, err
+	}
+	a.fragments[name] = m
+
+	return m, nil
+}
+
+// size returns how many items field asks for, 1 without a list argument.
+func (a *analyzer) size(field *Selection) int {
+	size := 1
+	for _, argument := range field.Arguments {
+		for _, list := range listArguments {
+			if argument.Name != field.Name+"."+list {
+				continue
+			}
+			value := argument.Value
+			if argument.Variable {
+				value = a.variable(argument.Value)
+			}
+			if n, err := strconv.ParseFloat(value, 64); err == nil && n > float64(size) {
+				size = int(min(n, math.MaxInt32))
+			}
+		}
+	}
+
+	return size
+}
+
+// variable returns the value of a scalar variable, its default when the
+// request doesn't pass it.
+func (a *analyzer) variable(name string) string {
+	if value, ok := a.variables[name]; ok {
+		if n, ok := value.(float64); ok {
+			return strconv.FormatFloat(n, 'f', -1, 64)
+		}
+		return ""
+	}
+	for _, argument := range a.operation.Arguments {
+		if argument.Name == "$"+name && !argument.Variable {
+			return argument.Value
+		}
+	}
+
+	return ""
+}
+
+// add and multiply saturate, a query can ask for more items than an int
+// holds.
+func add(x int, y int) int {
+	return int(min(int64(x)+int64(y), math.MaxInt32))
+}
+
+func multiply(x int, y int) int {
+	return int(min(int64(x)*int64(y), math.MaxInt32))
+}
+
+// Arguments returns the argument values of every operation and fragment of
+// doc, the variables passed for them left out.
+func (d *Document) Arguments() []Argument {
+	var arguments []Argument
+	var walk func(selections []*Selection)
+	walk = func(selections []*Selection) {
+		for _, selection := range selections {
+			arguments = appendLiterals(arguments, selection.Arguments)
+			walk(selection.Selections)
+		}
+	}
+	for _, operation := range d.Operations {
+		arguments = appendLiterals(arguments, operation.Arguments)
+		walk(operation.Selections)
+	}
+	for _, fragment := range d.Fragments {
+		arguments = appendLiterals(arguments, fragment.Arguments)
+		walk(fragment.Selections)
+	}
+
+	return arguments
+}
+
+func appendLiterals(arguments []Argument, values []Argument) []Argument {
+	for _, value := range values {
+		if !value.Variable {
+			arguments = append(arguments, value)
+		}
+	}
+
+	return arguments
+}
+
+// Variables flattens the JSON variables of a request into arguments named
+// $variable and the object fields leading to the value, e.g. $filter.name.
+func Variables(variables map[string]interface{}) []Argument {
+	var arguments []Argument
+	for name, value := range variables {
+		arguments = flatten(arguments, "$"+name, value)
+	}
+
+	return arguments
+}
+
+func flatten(arguments []Argument, name string, value interface{}) []Argument {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for field, v := range value {
+			arguments = flatten(arguments, name+"."+field, v)
+		}
+	case []interface{}:
+		for _, v := range value {
+			arguments = flatten(arguments, name, v)
+		}
+	case string:
+		arguments = append(arguments, Argument{Name: name, Value: value})
+	case float64:
+		arguments = append(arguments, Argument{Name: name, Value: strconv.FormatFloat(value, 'f', -1, 64)})
+	case bool:
+		arguments = append(arguments, Argument{Name: name, Value: strconv.FormatBool(value)})
+	}
+
+	return arguments
+}
@@ -0,0 +1,358 @@
+package graphql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/jahrulnr/go-waf/pkg/audit"
+	"github.com/jahrulnr/go-waf/pkg/block"
+	"github.com/jahrulnr/go-waf/pkg/clientip"
+	"github.com/jahrulnr/go-waf/pkg/dryrun"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+type argumentsKey struct{}
+
+// Limits bounds the queries of an endpoint. A limit of 0 or less is off.
+type Limits struct {
+	MaxDepth      int
+	MaxComplexity int
+	Introspection bool // allow __schema and __type
+}
+
+// Endpoint is a GraphQL path and its limits.
+type Endpoint struct {
+	Path   string
+	Limits Limits
+}
+
+// ParseEndpoints reads comma separated paths, each optionally followed by
+// the limits it takes instead of defaults, e.g.
+// /graphql,/internal/graphql=depth:15|complexity:5000|introspection:on.
+func ParseEndpoints(value string, defaults Limits) ([]Endpoint, error) {
+	var endpoints []Endpoint
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		endpointPath, settings, _ := strings.Cut(entry, "=")
+		endpoint := Endpoint{Path: path.Clean(strings.TrimSpace(endpointPath)), Limits: defaults}
+		if !strings.HasPrefix(endpoint.Path, "/") {
+			return nil, fmt.Errorf("graphql endpoint %q must start with /", endpointPath)
+		}
+		for _, setting := range strings.Split(settings, "|") {
+			setting = strings.TrimSpace(setting)
+			if setting == "" {
+				continue
+			}
+			if err := endpoint.Limits.set(setting); err != nil {
+				return nil, fmt.Errorf("graphql endpoint %s: %w", endpoint.Path, err)
+			}
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+
+	return endpoints, nil
+}
+
+// set applies one name:value limit.
+func (l *Limits) set(setting string) error {
+	name, value, _ := strings.Cut(setting, ":")
+	name = strings.TrimSpace(name)
+	switch name {
+	case "depth", "complexity":
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("invalid %s %q", name, value)
+		}
+		if name == "depth" {
+			l.MaxDepth = n
+		} else {
+			l.MaxComplexity = n
+		}
+	case "introspection":
+		switch strings.TrimSpace(value) {
+		case "on":
+			l.Introspection = true
+		case "off":
+			l.Introspection = false
+		default:
+			return fmt.Errorf("introspection must be on or off, not %q", value)
+		}
+	default:
+		return fmt.Errorf("unknown limit %q, expected depth, complexity or introspection", name)
+	}
+
+	return nil
+}
+
+// Options configures the inspector. Zero values take the defaults noted on
+// each field.
+type Options struct {
+	Endpoints []Endpoint
+	MaxBody   int64 // bytes of a query body read, larger ones are refused, default 256KiB
+}
+
+// Request is one GraphQL request, a batch holds several.
+type Request struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// Inspector parses the queries sent to the GraphQL endpoints and refuses the
+// ones nesting deeper, costing more or introspecting more than the endpoint
+// allows, with a GraphQL error saying which limit they broke. The argument
+// values of the accepted queries and their variables are kept in the request
+// context, so the rule engine inspects them one by one instead of the JSON
+// around them, see FromContext.
+//
+// Queries come as a JSON body, a single request or a batch whose costs add
+// up, as an application/graphql body or in the query string of a GET.
+// Requests without a query, like persisted query hashes, are refused as
+// their cost can't be known.
+type Inspector struct {
+	options   Options
+	endpoints map[string]Limits
+	audit     *audit.Logger
+	dryRun    *dryrun.DryRun
+}
+
+func NewInspector(options Options) *Inspector {
+	if options.MaxBody <= 0 {
+		options.MaxBody = 256 << 10
+	}
+
+	endpoints := make(map[string]Limits, len(options.Endpoints))
+	for _, endpoint := range options.Endpoints {
+		endpoints[endpoint.Path] = endpoint.Limits
+	}
+
+	return &Inspector{
+		options:   options,
+		endpoints: endpoints,
+	}
+}
+
+// SetAudit writes every refused query to the audit log.
+func (i *Inspector) SetAudit(audit *audit.Logger) {
+	i.audit = audit
+}
+
+// SetDryRun forwards the queries over the limits, only reporting them.
+func (i *Inspector) SetDryRun(dryRun *dryrun.DryRun) {
+	i.dryRun = dryRun
+}
+
+// FromContext returns the GraphQL argument values of the request, ok is
+// false when it isn't a GraphQL request the inspector parsed.
+func FromContext(ctx context.Context) ([]Argument, bool) {
+	arguments, ok := ctx.Value(argumentsKey{}).([]Argument)
+	return arguments, ok
+}
+
+// Middleware inspects the requests to the endpoints. It must run before the
+// rule engine, which reads the arguments it leaves.
+func (i *Inspector) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limits, ok := i.endpoints[path.Clean(c.Request.URL.Path)]
+		if !ok {
+			c.Next()
+			return
+		}
+
+		requests, status, err := i.read(c.Request)
+		if err != nil {
+			if i.reject(c, status, "graphql-parse", err.Error()) {
+				c.Next()
+			}
+			return
+		}
+		if requests == nil {
+			// a GET without a query, like the page of a GraphQL IDE
+			c.Next()
+			return
+		}
+
+		var stats Stats
+		var arguments []Argument
+		for _, request := range requests {
+			doc, err := Parse(request.Query)
+			if err != nil {
+				if i.reject(c, http.StatusBadRequest, "graphql-parse", err.Error()) {
+					c.Next()
+				}
+				return
+			}
+			s, err := Analyze(doc, request.OperationName, request.Variables)
+			if err != nil {
+				if i.reject(c, http.StatusBadRequest, "graphql-parse", err.Error()) {
+					c.Next()
+				}
+				return
+			}
+			stats.Depth = max(stats.Depth, s.Depth)
+			stats.Complexity = add(stats.Complexity, s.Complexity)
+			stats.Introspection = stats.Introspection || s.Introspection
+			arguments = append(arguments, doc.Arguments()...)
+			arguments = append(arguments, Variables(request.Variables)...)
+		}
+
+		if rule, message := check(stats, limits); rule != "" {
+			if !i.reject(c, http.StatusBadRequest, rule, message) {
+				return
+			}
+		}
+
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), argumentsKey{}, arguments))
+		c.Next()
+	}
+}
+
+// check returns the rule stats breaks and why, empty when within limits.
+func check(stats Stats, limits Limits) (string, string) {
+	if limits.MaxDepth > 0 && stats.Depth > limits.MaxDepth {
+		return "graphql-depth", fmt.Sprintf("depth %d exceeds max %d", stats.Depth, limits.MaxDepth)
+	}
+	if limits.MaxComplexity > 0 && stats.Complexity > limits.MaxComplexity {
+		return "graphql-complexity", fmt.Sprintf("complexity %d exceeds max %d", stats.Complexity, limits.MaxComplexity)
+	}
+	if stats.Introspection && !limits.Introspection {
+		return "graphql-introspection", "introspection is disabled"
+	}
+
+	return "", ""
+}
+
+// reject answers with a GraphQL error, unless dry run forwards the request
+// and reject returns true.
+func (i *Inspector) reject(c *gin.Context, status int, rule string, message string) bool {
+	record := audit.Record{
+		Source: "graphql",
+		Rules:  []string{rule},
+		Status: status,
+	}
+	if i.dryRun.Forward(c, record) {
+		return true
+	}
+
+	ip := clientip.FromContext(c)
+	logger.FromContext(c.Request.Context()).Logger("[warn] ", rule, " ", ip, " ", c.Request.Method, " ", c.Request.URL.RequestURI(), " ", message).Warn()
+	i.audit.Log(c.Request, ip, record)
+	decision := block.FromRecord(record)
+	decision.Reason = message
+	if block.Respond(c, decision) {
+		return false
+	}
+	c.JSON(status, map[string]interface{}{
+		"status": http.StatusText(status),
+		"errors": []map[string]string{{"message": message}},
+	})
+	c.Abort()
+
+	return false
+}
+
+// read returns the requests r carries and, on error, the status to answer.
+// A GET without a query returns none.
+func (i *Inspector) read(r *http.Request) ([]Request, int, error) {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		values := r.URL.Query()
+		if values.Get("query") == "" {
+			return nil, 0, nil
+		}
+		request := Request{Query: values.Get("query"), OperationName: values.Get("operationName")}
+		if variables := values.Get("variables"); variables != "" {
+			if err := json.Unmarshal([]byte(variables), &request.Variables); err != nil {
+				return nil, http.StatusBadRequest, fmt.Errorf("invalid variables: %s", err.Error())
+			}
+		}
+		return []Request{request}, 0, nil
+	}
+
+	body, err := i.peekBody(r)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) || errors.Is(err, errBodyTooLarge) {
+			return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("query body exceeds %d bytes", i.options.MaxBody)
+		}
+		return nil, http.StatusBadRequest, fmt.Errorf("unreadable body")
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/graphql":
+		return []Request{{Query: string(body)}}, 0, nil
+	case "application/json", "":
+	default:
+		return nil, http.StatusUnsupportedMediaType, fmt.Errorf("unsupported content type %s, expected application/json or application/graphql", mediaType)
+	}
+
+	var requests []Request
+	body = bytes.TrimSpace(body)
+	if bytes.HasPrefix(body, []byte("[")) {
+		err = json.Unmarshal(body, &requests)
+	} else {
+		requests = make([]Request, 1)
+		err = json.Unmarshal(body, &requests[0])
+	}
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid JSON body: %s", err.Error())
+	}
+	if len(requests) == 0 {
+		return nil, http.StatusBadRequest, fmt.Errorf("empty batch")
+	}
+	for _, request := range requests {
+		if request.Query == "" {
+			return nil, http.StatusBadRequest, fmt.Errorf("no query in the request")
+		}
+	}
+
+	return requests, 0, nil
+}
+
+var errBodyTooLarge = errors.New("body too large")
+
+// peekBody reads the whole body, up to MaxBody, and puts it back for the
+// rule engine and the upstream.
+func (i *Inspector) peekBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, i.options.MaxBody+1))
+	r.Body = &replayBody{
+		Reader: io.MultiReader(bytes.NewReader(body), r.Body),
+		closer: r.Body,
+	}
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > i.options.MaxBody {
+		return nil, errBodyTooLarge
+	}
+
+	return body, nil
+}
+
+type replayBody struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (b *replayBody) Close() error {
+	return b.closer.Close()
+}
@@ -0,0 +1,669 @@
+package graphql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxNesting bounds the selection sets and values a document may nest, so a
+// request can't exhaust the stack before the depth is even measured.
+const maxNesting = 256
+
+// Document is a parsed executable GraphQL document, the operations and
+// fragments of a query. Type system definitions are refused.
+type Document struct {
+	Operations []*Operation
+	Fragments  map[string]*Selection
+}
+
+// Operation is a query, mutation or subscription.
+type Operation struct {
+	Type       string // query, mutation or subscription
+	Name       string
+	Selections []*Selection
+	Arguments  []Argument // of the directives and variable defaults
+}
+
+// Selection is a field, a fragment spread or an inline fragment. Fragment
+// definitions are kept as inline fragments named after the fragment.
+type Selection struct {
+	Name       string // of the field or of the spread fragment
+	Spread     bool
+	Inline     bool
+	Arguments  []Argument // of the field and its directives
+	Selections []*Selection
+}
+
+// Argument is a literal argument value or the variable passed instead, named
+// after its field, the argument and the object fields leading to it, e.g.
+// users.filter.name. Lists repeat the name.
+type Argument struct {
+	Name     string
+	Value    string
+	Variable bool // Value names a variable, whose value comes with the request
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenPunctuator
+	tokenName
+	tokenInt
+	tokenFloat
+	tokenString
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+	pos   int
+}
+
+type parser struct {
+	src     string
+	pos     int
+	token   token
+	nesting int
+}
+
+// Parse reads a GraphQL document.
+func Parse(query string) (*Document, error) {
+	p := &parser{src: strings.TrimPrefix(query, "\ufeff")}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	doc := &Document{Fragments: make(map[string]*Selection)}
+	for p.token.kind != tokenEOF {
+		switch {
+		case p.peek(tokenPunctuator, "{"):
+			selections, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.Operations = append(doc.Operations, &Operation{Type: "query", Selections: selections})
+		case p.peek(tokenName, "query"), p.peek(tokenName, "mutation"), p.peek(tokenName, "subscription"):
+			operation, err := p.operation()
+			if err != nil {
+				return nil, err
+			}
+			doc.Operations = append(doc.Operations, operation)
+		case p.peek(tokenName, "fragment"):
+			name, fragment, err := p.fragment()
+			if err != nil {
+				return nil, err
+			}
+			if _, found := doc.Fragments[name]; found {
+				return nil, fmt.Errorf("fragment %s is defined twice", name)
+			}
+			doc.Fragments[name] = fragment
+		default:
+			return nil, p.unexpected("an operation or fragment")
+		}
+	}
+	if len(doc.Operations) == 0 {
+		return nil, fmt.Errorf("no operation in the query")
+	}
+
+	return doc, nil
+}
+
+func (p *parser) operation() (*Operation, error) {
+	operation := &Operation{Type: p.token.value}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	if p.token.kind == tokenName {
+		operation.Name = p.token.value
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.peek(tokenPunctuator, "(") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		for !p.peek(tokenPunctuator, ")") {
+			arguments, err := p.variableDefinition()
+			if err != nil {
+				return nil, err
+			}
+			operation.Arguments = append(operation.Arguments, arguments...)
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+
+	arguments, err := p.directives()
+	if err != nil {
+		return nil, err
+	}
+	operation.Arguments = append(operation.Arguments, arguments...)
+
+	operation.Selections, err = p.selectionSet()
+	if err != nil {
+		return nil, err
+	}
+
+	return operation, nil
+}
+
+// variableDefinition reads $name: Type = default @directives, returning the
+// literal default and directive arguments.
+func (p *parser) variableDefinition() ([]Argument, error) {
+	if err := p.expect(tokenPunctuator, "$"); err != nil {
+		return nil, err
+	}
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(tokenPunctuator, ":"); err != nil {
+		return nil, err
+	}
+	if err := p.typeReference(); err != nil {
+		return nil, err
+	}
+
+	var arguments []Argument
+	if p.peek(tokenPunctuator, "=") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if arguments, err = p.value("$"+name, arguments); err != nil {
+			return nil, err
+		}
+	}
+	directives, err := p.directives()
+	if err != nil {
+		return nil, err
+	}
+
+	return append(arguments, directives...), nil
+}
+
+func (p *parser) typeReference() error {
+	if p.peek(tokenPunctuator, "[") {
+		if err := p.enter(); err != nil {
+			return err
+		}
+		if err := p.next(); err != nil {
+			return err
+		}
+		if err := p.typeReference(); err != nil {
+			return err
+		}
+		if err := p.expect(tokenPunctuator, "]"); err != nil {
+			return err
+		}
+		p.nesting--
+	} else if _, err := p.name(); err != nil {
+		return err
+	}
+
+	if p.peek(tokenPunctuator, "!") {
+		return p.next()
+	}
+
+	return nil
+}
+
+func (p *parser) fragment() (string, *Selection, error) {
+	if err := p.next(); err != nil {
+		return "", nil, err
+	}
+	name, err := p.name()
+	if err != nil {
+		return "", nil, err
+	}
+	if name == "on" {
+		return "", nil, fmt.Errorf("a fragment can't be named on")
+	}
+	if err := p.expect(tokenName, "on"); err != nil {
+		return "", nil, err
+	}
+	if _, err := p.name(); err != nil {
+		return "", nil, err
+	}
+
+	fragment := &Selection{Name: name, Inline: true}
+	if fragment.Arguments, err = p.directives(); err != nil {
+		return "", nil, err
+	}
+	if fragment.Selections, err = p.selectionSet(); err != nil {
+		return "", nil, err
+	}
+
+	return name, fragment, nil
+}
+
+func (p *parser) selectionSet() ([]*Selection, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer func() { p.nesting-- }()
+
+	if err := p.expect(tokenPunctuator, "{"); err != nil {
+		return nil, err
+	}
+
+	var selections []*Selection
+	for !p.peek(tokenPunctuator, "}") {
+		selection, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		selections = append(selections, selection)
+	}
+	if len(selections) == 0 {
+		return nil, fmt.Errorf("empty selection set at %d", p.token.pos)
+	}
+
+	return selections, p.next()
+}
+
+func (p *parser) selection() (*Selection, error) {
+	if p.peek(tokenPunctuator, "...") {
+		return p.fragmentSelection()
+	}
+
+	// alias: name
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek(tokenPunctuator, ":") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+
+	field := &Selection{Name: name}
+	if p.peek(tokenPunctuator, "(") {
+		if field.Arguments, err = p.arguments(name + "."); err != nil {
+			return nil, err
+		}
+	}
+	directives, err := p.directives()
+	if err != nil {
+		return nil, err
+	}
+	field.Arguments = append(field.Arguments, directives...)
+
+	if p.peek(tokenPunctuator, "{") {
+		if field.Selections, err = p.selectionSet(); err != nil {
+			return nil, err
+		}
+	}
+
+	return field, nil
+}
+
+// fragmentSelection reads ...Name or ... on Type { }.
+func (p *parser) fragmentSelection() (*Selection, error) {
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	if p.token.kind == tokenName && p.token.value != "on" {
+		spread := &Selection{Name: p.token.value, Spread: true}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		var err error
+		if spread.Arguments, err = p.directives(); err != nil {
+			return nil, err
+		}
+		return spread, nil
+	}
+
+	if p.peek(tokenName, "on") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if _, err := p.name(); err != nil {
+			return nil, err
+		}
+	}
+
+	inline := &Selection{Inline: true}
+	var err error
+	if inline.Arguments, err = p.directives(); err != nil {
+		return nil, err
+	}
+	if inline.Selections, err = p.selectionSet(); err != nil {
+		return nil, err
+	}
+
+	return inline, nil
+}
+
+func (p *parser) directives() ([]Argument, error) {
+	var arguments []Argument
+	for p.peek(tokenPunctuator, "@") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek(tokenPunctuator, "(") {
+			directive, err := p.arguments("@" + name + ".")
+			if err != nil {
+				return nil, err
+			}
+			arguments = append(arguments, directive...)
+		}
+	}
+
+	return arguments, nil
+}
+
+// arguments reads (name: value ...), naming the values prefix + name.
+func (p *parser) arguments(prefix string) ([]Argument, error) {
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	var arguments []Argument
+	count := 0
+	for !p.peek(tokenPunctuator, ")") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokenPunctuator, ":"); err != nil {
+			return nil, err
+		}
+		if arguments, err = p.value(prefix+name, arguments); err != nil {
+			return nil, err
+		}
+		count++
+	}
+	if count == 0 {
+		return nil, fmt.Errorf("empty arguments at %d", p.token.pos)
+	}
+
+	return arguments, p.next()
+}
+
+// value reads a value and appends its scalars and variables to arguments.
+func (p *parser) value(name string, arguments []Argument) ([]Argument, error) {
+	switch p.token.kind {
+	case tokenInt, tokenFloat, tokenString:
+		arguments = append(arguments, Argument{Name: name, Value: p.token.value})
+		return arguments, p.next()
+	case tokenName:
+		// true, false, null and enum values
+		arguments = append(arguments, Argument{Name: name, Value: p.token.value})
+		return arguments, p.next()
+	}
+
+	switch {
+	case p.peek(tokenPunctuator, "$"):
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		variable, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		return append(arguments, Argument{Name: name, Value: variable, Variable: true}), nil
+	case p.peek(tokenPunctuator, "["):
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		for !p.peek(tokenPunctuator, "]") {
+			var err error
+			if arguments, err = p.value(name, arguments); err != nil {
+				return nil, err
+			}
+		}
+		p.nesting--
+		return arguments, p.next()
+	case p.peek(tokenPunctuator, "{"):
+		if err := p.enter(); err != nil {
+			return nil, err
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		for !p.peek(tokenPunctuator, "}") {
+			field, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(tokenPunctuator, ":"); err != nil {
+				return nil, err
+			}
+			if arguments, err = p.value(name+"."+field, arguments); err != nil {
+				return nil, err
+			}
+		}
+		p.nesting--
+		return arguments, p.next()
+	}
+
+	return nil, p.unexpected("a value")
+}
+
+func (p *parser) enter() error {
+	p.nesting++
+	if p.nesting > maxNesting {
+		return fmt.Errorf("query nests deeper than %d", maxNesting)
+	}
+
+	return nil
+}
+
+func (p *parser) peek(kind tokenKind, value string) bool {
+	return p.token.kind == kind && p.token.value == value
+}
+
+func (p *parser) expect(kind tokenKind, value string) error {
+	if !p.peek(kind, value) {
+		return p.unexpected(fmt.Sprintf("%q", value))
+	}
+
+	return p.next()
+}
+
+func (p *parser) name() (string, error) {
+	if p.token.kind != tokenName {
+		return "", p.unexpected("a name")
+	}
+	name := p.token.value
+
+	return name, p.next()
+}
+
+func (p *parser) unexpected(expected string) error {
+	if p.token.kind == tokenEOF {
+		return fmt.Errorf("unexpected end of query, expected %s", expected)
+	}
+
+	return fmt.Errorf("unexpected %q at %d, expected %s", p.token.value, p.token.pos, expected)
+}
+
+// next reads the following token, skipping whitespace, commas and comments.
+func (p *parser) next() error {
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',' {
+			p.pos++
+			continue
+		}
+		if c == '#' {
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' && p.src[p.pos] != '\r' {
+				p.pos++
+			}
+			continue
+		}
+		break
+	}
+
+	start := p.pos
+	if p.pos >= len(p.src) {
+		p.token = token{kind: tokenEOF, pos: start}
+		return nil
+	}
+
+	c := p.src[p.pos]
+	switch {
+	case strings.HasPrefix(p.src[p.pos:], "..."):
+		p.pos += 3
+		p.token = token{kind: tokenPunctuator, value: "...", pos: start}
+	case strings.IndexByte("!$&():=@[]{|}", c) >= 0:
+		p.pos++
+		p.token = token{kind: tokenPunctuator, value: string(c), pos: start}
+	case c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z':
+		for p.pos < len(p.src) && isNameChar(p.src[p.pos]) {
+			p.pos++
+		}
+		p.token = token{kind: tokenName, value: p.src[start:p.pos], pos: start}
+	case c == '-' || '0' <= c && c <= '9':
+		return p.number()
+	case c == '"':
+		return p.string()
+	default:
+		r, _ := utf8.DecodeRuneInString(p.src[p.pos:])
+		return fmt.Errorf("unexpected character %q at %d", r, start)
+	}
+
+	return nil
+}
+
+func isNameChar(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+func (p *parser) number() error {
+	start := p.pos
+	if p.src[p.pos] == '-' {
+		p.pos++
+	}
+	digits := func() int {
+		n := 0
+		for p.pos < len(p.src) && '0' <= p.src[p.pos] && p.src[p.pos] <= '9' {
+			p.pos++
+			n++
+		}
+		return n
+	}
+	if digits() == 0 {
+		return fmt.Errorf("invalid number at %d", start)
+	}
+
+	kind := tokenInt
+	if p.pos < len(p.src) && p.src[p.pos] == '.' {
+		p.pos++
+		if digits() == 0 {
+			return fmt.Errorf("invalid number at %d", start)
+		}
+		kind = tokenFloat
+	}
+	if p.pos < len(p.src) && (p.src[p.pos] == 'e' || p.src[p.pos] == 'E') {
+		p.pos++
+		if p.pos < len(p.src) && (p.src[p.pos] == '+' || p.src[p.pos] == '-') {
+			p.pos++
+		}
+		if digits() == 0 {
+			return fmt.Errorf("invalid number at %d", start)
+		}
+		kind = tokenFloat
+	}
+	if p.pos < len(p.src) && (isNameChar(p.src[p.pos]) || p.src[p.pos] == '.') {
+		return fmt.Errorf("invalid number at %d", start)
+	}
+
+	p.token = token{kind: kind, value: p.src[start:p.pos], pos: start}
+	return nil
+}
+
+// string reads a "string" or a """block string""". Escapes are decoded, so
+// the rules see the value the server will.
+func (p *parser) string() error {
+	start := p.pos
+	if strings.HasPrefix(p.src[p.pos:], `"""`) {
+		var b strings.Builder
+		for i := p.pos + 3; i < len(p.src); i++ {
+			if strings.HasPrefix(p.src[i:], `\"""`) {
+				b.WriteString(`"""`)
+				i += 3
+				continue
+			}
+			if strings.HasPrefix(p.src[i:], `"""`) {
+				p.pos = i + 3
+				p.token = token{kind: tokenString, value: b.String(), pos: start}
+				return nil
+			}
+			b.WriteByte(p.src[i])
+		}
+		return fmt.Errorf("unterminated string at %d", start)
+	}
+
+	var b strings.Builder
+	p.pos++
+	for {
+		if p.pos >= len(p.src) || p.src[p.pos] == '\n' || p.src[p.pos] == '\r' {
+			return fmt.Errorf("unterminated string at %d", start)
+		}
+		c := p.src[p.pos]
+		if c == '"' {
+			p.pos++
+			break
+		}
+		if c != '\\' {
+			b.WriteByte(c)
+			p.pos++
+			continue
+		}
+
+		if p.pos+1 >= len(p.src) {
+			return fmt.Errorf("unterminated string at %d", start)
+		}
+		escape := p.src[p.pos+1]
+		p.pos += 2
+		switch escape {
+		case '"', '\\', '/':
+			b.WriteByte(escape)
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'u':
+			if p.pos+4 > len(p.src) {
+				return fmt.Errorf("invalid escape at %d", p.pos-2)
+			}
+			r, err := strconv.ParseUint(p.src[p.pos:p.pos+4], 16, 32)
+			if err != nil {
+				return fmt.Errorf("invalid escape at %d", p.pos-2)
+			}
+			b.WriteRune(rune(r))
+			p.pos += 4
+		default:
+			return fmt.Errorf("invalid escape at %d", p.pos-2)
+		}
+	}
+
+	p.token = token{kind: tokenString, value: b.String(), pos: start}
+	return nil
+}
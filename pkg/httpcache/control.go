@@ -0,0 +1,117 @@
+package httpcache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cacheControl holds the Cache-Control directives, lowercased, with their
+// optional values.
+type cacheControl map[string]string
+
+func parseCacheControl(header http.Header) cacheControl {
+	directives := make(cacheControl)
+	for _, value := range header.Values("Cache-Control") {
+		for _, part := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(part), "=")
+			if name != "" {
+				directives[strings.ToLower(name)] = strings.Trim(arg, `"`)
+			}
+		}
+	}
+
+	return directives
+}
+
+func (c cacheControl) has(name string) bool {
+	_, ok := c[name]
+	return ok
+}
+
+// seconds returns a delta-seconds directive.
+func (c cacheControl) seconds(name string) (time.Duration, bool) {
+	value, ok := c[name]
+	if !ok {
+		return 0, false
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+
+	return time.Duration(n) * time.Second, true
+}
+
+// cacheableStatus are the statuses cacheable by default (RFC 9110, 15.1).
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// freshness returns how long a response stays fresh and how long it may
+// then be served stale while it is refreshed. ok is false when the response
+// must not be stored by a shared cache.
+func freshness(req *http.Request, status int, header http.Header, defaultTTL time.Duration) (ttl time.Duration, stale time.Duration, ok bool) {
+	if !cacheableStatus[status] {
+		return 0, 0, false
+	}
+
+	return lifetime(req, header, defaultTTL)
+}
+
+// negativeFreshness returns how long an error response is kept as a
+// negative entry: the freshness it came with, at most negativeTTL, and never
+// served stale. ok is false when the response must not be stored.
+func negativeFreshness(req *http.Request, header http.Header, negativeTTL time.Duration) (time.Duration, bool) {
+	ttl, _, ok := lifetime(req, header, negativeTTL)
+	return min(ttl, negativeTTL), ok
+}
+
+// lifetime is the freshness of a response whatever its status.
+func lifetime(req *http.Request, header http.Header, defaultTTL time.Duration) (ttl time.Duration, stale time.Duration, ok bool) {
+	if header.Get("Set-Cookie") != "" || header.Get("Vary") == "*" {
+		return 0, 0, false
+	}
+
+	directives := parseCacheControl(header)
+	if directives.has("no-store") || directives.has("private") || directives.has("no-cache") {
+		return 0, 0, false
+	}
+
+	// authorized responses are personal unless marked shareable
+	if req.Header.Get("Authorization") != "" &&
+		!directives.has("public") && !directives.has("s-maxage") && !directives.has("must-revalidate") {
+		return 0, 0, false
+	}
+
+	var found bool
+	if ttl, found = directives.seconds("s-maxage"); !found {
+		ttl, found = directives.seconds("max-age")
+	}
+	if !found {
+		if expires, err := http.ParseTime(header.Get("Expires")); err == nil {
+			ttl, found = time.Until(expires), true
+		}
+	}
+	if !found {
+		ttl = defaultTTL
+	}
+	if ttl <= 0 {
+		return 0, 0, false
+	}
+
+	stale, _ = directives.seconds("stale-while-revalidate")
+	return ttl, stale, true
+}
@@ -0,0 +1,334 @@
+package httpcache
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jahrulnr/go-waf/internal/interface/repository"
+	"github.com/jahrulnr/go-waf/pkg/lock"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+	"github.com/jahrulnr/go-waf/pkg/metrics"
+	"github.com/jahrulnr/go-waf/pkg/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// DefaultPrefix starts every key written by the cache.
+const DefaultPrefix = "httpcache-"
+
+// DefaultNegativeStatus are the error statuses cached as negative entries
+// unless Options.NegativeStatus sets others.
+var DefaultNegativeStatus = []int{
+	http.StatusNotFound,
+	http.StatusGone,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// refreshLockTTL bounds a background refresh.
+const refreshLockTTL = 30 * time.Second
+
+// Options configures the cache. Zero values take the defaults noted on each
+// field.
+type Options struct {
+	DefaultTTL  time.Duration // freshness of responses without max-age or Expires, 0 doesn't store them
+	MaxBodySize int           // larger responses are passed through, default 1MB
+	Prefix      string        // key prefix, default DefaultPrefix
+	Version     string        // key version, bumping it invalidates every response stored before
+	Query       []string      // query parameters the responses are keyed by, empty keys by all
+
+	NegativeTTL    time.Duration // how long the responses of NegativeStatus are kept at most, 0 doesn't keep them apart
+	NegativeStatus []int         // error statuses cached as negative entries, default DefaultNegativeStatus
+
+	Metrics metrics.ResponseCacheRecorder // optional, receives hit, stale and miss
+}
+
+// entry is a stored response.
+type entry struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+	Stored time.Time   `json:"stored"`
+	TTL    int64       `json:"ttl"`   // milliseconds
+	Stale  int64       `json:"stale"` // milliseconds
+
+	Negative bool `json:"negative,omitempty"` // an error response, kept for Options.NegativeTTL
+}
+
+// Cache is a shared HTTP cache in front of a handler, keeping responses in
+// any repository.CacheInterface driver.
+type Cache struct {
+	cache   repository.CacheInterface
+	options Options
+	keys    KeyBuilder
+	locker  *lock.Locker
+}
+
+func NewCache(cache repository.CacheInterface, options Options) *Cache {
+	if options.MaxBodySize <= 0 {
+		options.MaxBodySize = 1 << 20
+	}
+	if options.Prefix == "" {
+		options.Prefix = DefaultPrefix
+	}
+	if options.Metrics == nil {
+		options.Metrics = metrics.NoopRecorder{}
+	}
+	if options.NegativeStatus == nil {
+		options.NegativeStatus = DefaultNegativeStatus
+	}
+
+	return &Cache{
+		cache:   cache,
+		options: options,
+		keys:    KeyBuilder{Namespace: options.Prefix, Version: options.Version, Query: options.Query},
+		locker:  lock.NewLocker(cache),
+	}
+}
+
+// Handler serves GET and HEAD requests from the cache, storing the
+// cacheable responses of next. An expired entry still inside its
+// stale-while-revalidate window is served at once while one instance
+// refreshes it in the background. With a NegativeTTL the error responses of
+// NegativeStatus are kept that long, so a missing page or a failing upstream
+// isn't asked again on every request.
+func (c *Cache) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead ||
+			parseCacheControl(r.Header).has("no-store") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cache := c.cache.WithContext(r.Context())
+		base := c.keys.Build(r)
+		if !parseCacheControl(r.Header).has("no-cache") {
+			_, span := tracing.Start(r.Context(), "cache.lookup", attribute.String("cache.key", base.String()))
+			stored, key, ok := c.lookup(cache, base, r)
+			if ok {
+				age := time.Since(stored.Stored)
+				fresh := age < time.Duration(stored.TTL)*time.Millisecond
+				span.SetAttributes(attribute.String("cache.result", result(stored, fresh)))
+				span.End()
+				if !fresh {
+					c.revalidate(base, key, r, next)
+				}
+				c.serve(w, r, stored, age, fresh)
+				return
+			}
+			span.SetAttributes(attribute.String("cache.result", "miss"))
+			span.End()
+		}
+
+		c.options.Metrics.RecordCacheResult("miss")
+		before := w.Header().Clone()
+		w.Header().Set("X-Cache", "MISS")
+		recorder := &recorder{ResponseWriter: w, status: http.StatusOK, limit: c.options.MaxBodySize}
+		next.ServeHTTP(recorder, r)
+		if r.Method == http.MethodGet && !recorder.overflow {
+			c.store(cache, base, r, recorder.status, added(before, w.Header()), recorder.body.Bytes())
+		}
+	})
+}
+
+// PrefixFor returns the key prefix of every response cached for host and
+// paths starting with pathPrefix. Prefixes of very long paths, which are
+// shortened with a hash, can't be matched.
+func (c *Cache) PrefixFor(host string, pathPrefix string) string {
+	return c.keys.Prefix(host, pathPrefix)
+}
+
+// KeyFor returns the key prefix shared by every variant cached for host and
+// requestURI, the path with its query.
+func (c *Cache) KeyFor(host string, requestURI string) string {
+	return c.keys.ForURI(host, requestURI).String()
+}
+
+// Key returns the key r is cached under, the variant of its Vary headers
+// when a response is stored. Its components tell what went into it.
+func (c *Cache) Key(r *http.Request) Key {
+	base := c.keys.Build(r)
+	index, ok := c.cache.WithContext(r.Context()).Get(base.String() + "~vary")
+	if !ok {
+		return base
+	}
+
+	return base.Vary(splitHeaderList(string(index)), r.Header)
+}
+
+// expiring reports whether the entry of r is missing or stops being fresh
+// within d.
+func (c *Cache) expiring(r *http.Request, d time.Duration) bool {
+	stored, _, ok := c.lookup(c.cache.WithContext(r.Context()), c.keys.Build(r), r)
+	if !ok {
+		return true
+	}
+
+	return time.Until(stored.Stored.Add(time.Duration(stored.TTL)*time.Millisecond)) < d
+}
+
+// lookup finds the entry matching r, following the Vary index of base.
+func (c *Cache) lookup(cache repository.CacheInterface, base Key, r *http.Request) (*entry, string, bool) {
+	index, ok := cache.Get(base.String() + "~vary")
+	if !ok {
+		return nil, "", false
+	}
+
+	key := base.Vary(splitHeaderList(string(index)), r.Header).String()
+	data, ok := cache.Get(key)
+	if !ok {
+		return nil, "", false
+	}
+
+	var stored entry
+	if err := json.Unmarshal(data, &stored); err != nil {
+		logger.FromContext(r.Context()).Logger("[warn] invalid http cache entry ", key, err.Error()).Warn()
+		return nil, "", false
+	}
+
+	return &stored, key, true
+}
+
+func (c *Cache) store(cache repository.CacheInterface, base Key, r *http.Request, status int, header http.Header, body []byte) {
+	ttl, stale, ok := freshness(r, status, header, c.options.DefaultTTL)
+	negative := c.options.NegativeTTL > 0 && slices.Contains(c.options.NegativeStatus, status)
+	if negative {
+		ttl, ok = negativeFreshness(r, header, c.options.NegativeTTL)
+		stale = 0
+	}
+	if !ok {
+		return
+	}
+
+	vary := splitHeaderList(strings.Join(header.Values("Vary"), ","))
+	data, err := json.Marshal(&entry{
+		Status: status,
+		Header: header.Clone(),
+		Body:   body,
+		Stored: time.Now(),
+		TTL:    ttl.Milliseconds(),
+		Stale:  stale.Milliseconds(),
+
+		Negative: negative,
+	})
+	if err != nil {
+		return
+	}
+
+	err = cache.MSet(map[string]repository.CacheItem{
+		base.String() + "~vary":            {Value: []byte(strings.Join(vary, ",")), TTL: ttl + stale},
+		base.Vary(vary, r.Header).String(): {Value: data, TTL: ttl + stale},
+	})
+	if err != nil {
+		logger.FromContext(r.Context()).Logger("[warn] fail to store http cache ", base.String(), err.Error()).Warn()
+	}
+}
+
+func (c *Cache) serve(w http.ResponseWriter, r *http.Request, stored *entry, age time.Duration, fresh bool) {
+	header := w.Header()
+	for key, values := range stored.Header {
+		header[key] = values
+	}
+	header.Set("Age", strconv.Itoa(int(age.Seconds())))
+	c.options.Metrics.RecordCacheResult(result(stored, fresh))
+	header.Set("X-Cache", strings.ToUpper(result(stored, fresh)))
+
+	w.WriteHeader(stored.Status)
+	if r.Method != http.MethodHead {
+		w.Write(stored.Body)
+	}
+}
+
+// result names a cache hit for metrics, spans and X-Cache. Negative entries
+// are never served stale.
+func result(stored *entry, fresh bool) string {
+	if stored.Negative {
+		return "negative_hit"
+	}
+	if fresh {
+		return "hit"
+	}
+
+	return "stale"
+}
+
+// revalidate refreshes key in the background. The lock makes sure a single
+// request per cluster goes to the upstream.
+func (c *Cache) revalidate(base Key, key string, r *http.Request, next http.Handler) {
+	token, locked, err := c.locker.TryAcquire(key, refreshLockTTL)
+	if err != nil || !locked {
+		return
+	}
+
+	// the client request is over once the stale copy is served
+	req := r.Clone(context.WithoutCancel(r.Context()))
+	req.Method = http.MethodGet
+	req.Header.Del("If-None-Match")
+	req.Header.Del("If-Modified-Since")
+
+	go func() {
+		defer c.locker.Release(key, token)
+
+		ctx, cancel := context.WithTimeout(req.Context(), refreshLockTTL)
+		defer cancel()
+		req = req.WithContext(ctx)
+
+		recorder := &recorder{ResponseWriter: newDiscardWriter(), status: http.StatusOK, limit: c.options.MaxBodySize}
+		next.ServeHTTP(recorder, req)
+		if !recorder.overflow {
+			c.store(c.cache.WithContext(ctx), base, req, recorder.status, recorder.Header(), recorder.body.Bytes())
+		}
+	}()
+}
+
+// added returns the headers of after that were not already set in before,
+// leaving out the ones written by earlier middleware for this request only.
+func added(before http.Header, after http.Header) http.Header {
+	header := make(http.Header, len(after))
+	for key, values := range after {
+		if key == "X-Cache" || key == "Age" {
+			continue
+		}
+		if previous, ok := before[key]; ok && slices.Equal(previous, values) {
+			continue
+		}
+		header[key] = values
+	}
+
+	return header
+}
+
+func splitHeaderList(value string) []string {
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, http.CanonicalHeaderKey(name))
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+var illegalKeyChars = regexp.MustCompile(`[\/\\\?\*\:\<\>\|\"\s\&]`)
+
+// sanitize makes key safe for every driver, the file driver uses keys as
+// file names.
+func sanitize(key string) string {
+	safe := illegalKeyChars.ReplaceAllString(key, "_")
+	if len(safe) > 100 {
+		safe = safe[:100] + "---md5hash---" + fmt.Sprintf("%x", md5.Sum([]byte(key[100:])))
+	}
+
+	return safe
+}
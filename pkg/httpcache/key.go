@@ -0,0 +1,155 @@
+package httpcache
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// KeyBuilder composes the cache keys of requests from a namespace, a version
+// and the normalized request: method, host, path, the query parameters kept
+// and the values of the headers the response varies on. A key starts with a
+// readable namespace, version, host and path, so a host or a path prefix can
+// be purged, and ends with a hash of the rest, so keys sharing it never
+// collide.
+type KeyBuilder struct {
+	Namespace string   // starts every key, default DefaultPrefix
+	Version   string   // bumping it leaves every key built before behind, they expire unread
+	Query     []string // query parameters in the key, empty keeps them all
+}
+
+// Component is one part of a key.
+type Component struct {
+	Name  string `json:"name"` // method, host, path, query or vary:<header>
+	Value string `json:"value"`
+}
+
+// Key is a cache key and the components that went into it.
+type Key struct {
+	prefix     string
+	components []Component
+}
+
+// Build returns the key of r regardless of Vary. HEAD shares the key of GET,
+// the host is lowercased and the query parameters are sorted, so the same
+// resource always lands on one key.
+func (b *KeyBuilder) Build(r *http.Request) Key {
+	method := r.Method
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+
+	return b.build(method, r.Host, r.URL.EscapedPath(), r.URL.RawQuery)
+}
+
+// ForURI returns the key of a GET of requestURI, the path with its query, on
+// host.
+func (b *KeyBuilder) ForURI(host string, requestURI string) Key {
+	path, query, _ := strings.Cut(requestURI, "?")
+	return b.build(http.MethodGet, host, path, query)
+}
+
+// Prefix returns the start of every key of host and the paths starting with
+// pathPrefix. Prefixes of very long paths, which are shortened with a hash,
+// can't be matched.
+func (b *KeyBuilder) Prefix(host string, pathPrefix string) string {
+	return b.namespace() + sanitize(strings.ToLower(host)+pathPrefix)
+}
+
+func (b *KeyBuilder) namespace() string {
+	namespace := b.Namespace
+	if namespace == "" {
+		namespace = DefaultPrefix
+	}
+	if b.Version != "" {
+		namespace += sanitize(b.Version) + "-"
+	}
+
+	return namespace
+}
+
+func (b *KeyBuilder) build(method string, host string, path string, rawQuery string) Key {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if path == "" {
+		path = "/"
+	}
+
+	return Key{
+		prefix: b.Prefix(host, path),
+		components: []Component{
+			{Name: "method", Value: method},
+			{Name: "host", Value: host},
+			{Name: "path", Value: path},
+			{Name: "query", Value: b.query(rawQuery)},
+		},
+	}
+}
+
+// query keeps the parameters of Query, sorted by name. A query that doesn't
+// parse is kept as is.
+func (b *KeyBuilder) query(rawQuery string) string {
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return rawQuery
+	}
+	if len(b.Query) > 0 {
+		for name := range values {
+			if !slices.Contains(b.Query, name) {
+				delete(values, name)
+			}
+		}
+	}
+
+	return values.Encode()
+}
+
+// Vary returns the key of the variant for the values header holds for the
+// names of a Vary header.
+func (k Key) Vary(names []string, header http.Header) Key {
+	if len(names) == 0 {
+		return k
+	}
+
+	varied := Key{prefix: k.prefix, components: slices.Clone(k.components)}
+	for _, name := range names {
+		varied.components = append(varied.components, Component{
+			Name:  "vary:" + name,
+			Value: strings.Join(header.Values(name), ","),
+		})
+	}
+
+	return varied
+}
+
+// Components returns what went into the key, for debugging.
+func (k Key) Components() []Component {
+	return slices.Clone(k.components)
+}
+
+// String returns the key. The variants of a resource start with the key of
+// the resource, so purging it purges them too.
+func (k Key) String() string {
+	var resource, variant strings.Builder
+	for _, component := range k.components {
+		part := &resource
+		if strings.HasPrefix(component.Name, "vary:") {
+			part = &variant
+		}
+		part.WriteString(component.Name + "=" + component.Value + "\n")
+	}
+
+	key := k.prefix + "~" + digest(resource.String())
+	if variant.Len() > 0 {
+		key += "~" + digest(variant.String())
+	}
+
+	return key
+}
+
+func digest(value string) string {
+	sum := sha1.Sum([]byte(value))
+	return hex.EncodeToString(sum[:8])
+}
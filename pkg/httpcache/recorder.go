@@ -0,0 +1,72 @@
+package httpcache
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// recorder passes a response through while keeping a copy of its body, up
+// to limit bytes.
+type recorder struct {
+	http.ResponseWriter
+
+	status   int
+	body     bytes.Buffer
+	limit    int
+	overflow bool
+	wrote    bool
+}
+
+func (r *recorder) WriteHeader(status int) {
+	if !r.wrote {
+		r.status = status
+		r.wrote = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(data []byte) (int, error) {
+	r.wrote = true
+	if !r.overflow {
+		if r.body.Len()+len(data) > r.limit {
+			r.overflow = true
+			r.body.Reset()
+		} else {
+			r.body.Write(data)
+		}
+	}
+
+	return r.ResponseWriter.Write(data)
+}
+
+// Flush keeps streaming handlers working, a flushed response is not stored.
+func (r *recorder) Flush() {
+	r.overflow = true
+	r.body.Reset()
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *recorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// discardWriter is the client of a background refresh.
+type discardWriter struct {
+	header http.Header
+}
+
+func newDiscardWriter() *discardWriter {
+	return &discardWriter{header: make(http.Header)}
+}
+
+func (w *discardWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardWriter) Write(data []byte) (int, error) {
+	return len(data), nil
+}
+
+func (w *discardWriter) WriteHeader(int) {}
@@ -0,0 +1,287 @@
+package httpcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jahrulnr/go-waf/pkg/logger"
+)
+
+// WarmOptions configures a Warmer. Zero values take the defaults noted on
+// each field.
+type WarmOptions struct {
+	URLs       []string                                    // absolute URLs, or paths on Host
+	Provider   func(ctx context.Context) ([]string, error) // optional, lists the URLs on every run in place of URLs
+	Host       string                                      // host of the paths, the cache keys are built with it
+	Header     http.Header                                 // sent with every fetch, e.g. the Accept-Encoding most clients send, as the variant warmed depends on it
+	Interval   time.Duration                               // how often the URLs are checked, default 1m, entries expiring before the next run are fetched
+	Rate       float64                                     // fetches per second at most, default 1
+	Timeout    time.Duration                               // of a fetch, default 30s
+	MaxBackoff time.Duration                               // longest pause after the upstream failed, default 10m
+	Healthy    func() bool                                 // optional, reports whether the upstream can be asked, runs are put off while it can't
+}
+
+// WarmStatus is the outcome of the last run of a Warmer.
+type WarmStatus struct {
+	LastRun      time.Time `json:"last_run"`
+	Duration     float64   `json:"duration"` // seconds
+	Warmed       int       `json:"warmed"`
+	Fresh        int       `json:"fresh"`  // still fresh after the next run
+	Locked       int       `json:"locked"` // being warmed by another instance
+	Failed       int       `json:"failed"`
+	BackoffUntil time.Time `json:"backoff_until"` // zero unless the upstream failed
+	Error        string    `json:"error,omitempty"`
+	URLs         []WarmURL `json:"urls"`
+}
+
+// WarmURL is the outcome of a URL in the last run.
+type WarmURL struct {
+	URL    string `json:"url"`
+	Result string `json:"result"`           // warmed, fresh, locked, failed or skipped
+	Status int    `json:"status,omitempty"` // of the fetch
+	Error  string `json:"error,omitempty"`
+}
+
+// Warmer keeps the hottest responses in the cache: every Interval it
+// fetches the URLs whose entries are missing or expire before the next run
+// through the cache, so clients never meet a cold entry. A key is locked
+// while it is fetched, so one instance warms it however many share the
+// cache, the others find it fresh. Fetches are spaced by Rate, and a run stops at the first
+// 429 or 5xx and backs off, doubling up to MaxBackoff or for as long as the
+// upstream asks with Retry-After.
+type Warmer struct {
+	cache   *Cache
+	handler http.Handler
+	options WarmOptions
+
+	mu       sync.Mutex
+	status   WarmStatus
+	failures int
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewWarmer warms cache with the responses of next, the handler the cache
+// stands in front of, and starts right away.
+func NewWarmer(cache *Cache, next http.Handler, options WarmOptions) *Warmer {
+	if options.Interval <= 0 {
+		options.Interval = time.Minute
+	}
+	if options.Rate <= 0 {
+		options.Rate = 1
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = 30 * time.Second
+	}
+	if options.MaxBackoff <= 0 {
+		options.MaxBackoff = 10 * time.Minute
+	}
+
+	w := &Warmer{
+		cache:   cache,
+		handler: cache.Handler(next),
+		options: options,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go w.run()
+
+	return w
+}
+
+// Close stops the warmer, waiting for the fetch in flight.
+func (w *Warmer) Close() error {
+	close(w.stop)
+	<-w.done
+
+	return nil
+}
+
+// WarmStatus returns the outcome of the last run.
+func (w *Warmer) WarmStatus() WarmStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.status
+}
+
+func (w *Warmer) run() {
+	defer close(w.done)
+
+	w.warm()
+	ticker := time.NewTicker(w.options.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.warm()
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// warm runs once, unless backing off or the upstream is unhealthy.
+func (w *Warmer) warm() {
+	w.mu.Lock()
+	backoff := w.status.BackoffUntil
+	w.mu.Unlock()
+	if time.Now().Before(backoff) {
+		return
+	}
+
+	started := time.Now()
+	status := WarmStatus{LastRun: started}
+	if w.options.Healthy != nil && !w.options.Healthy() {
+		w.finish(status, 0, errors.New("no healthy upstream"))
+		return
+	}
+
+	urls := w.options.URLs
+	if w.options.Provider != nil {
+		var err error
+		if urls, err = w.options.Provider(context.Background()); err != nil {
+			w.finish(status, 0, fmt.Errorf("list urls: %w", err))
+			return
+		}
+	}
+
+	var retryAfter time.Duration
+	var failed error
+	delay := time.Duration(float64(time.Second) / w.options.Rate)
+	for i, raw := range urls {
+		if failed != nil {
+			status.URLs = append(status.URLs, WarmURL{URL: raw, Result: "skipped"})
+			continue
+		}
+		if i > 0 {
+			select {
+			case <-time.After(delay):
+			case <-w.stop:
+				return
+			}
+		}
+
+		result := w.fetch(raw)
+		switch result.Result {
+		case "warmed":
+			status.Warmed++
+		case "fresh":
+			status.Fresh++
+		case "locked":
+			status.Locked++
+		default:
+			status.Failed++
+		}
+		if result.Status == http.StatusTooManyRequests || result.Status >= http.StatusInternalServerError {
+			failed = fmt.Errorf("%s answered %d", raw, result.Status)
+			retryAfter = result.retryAfter
+		}
+		status.URLs = append(status.URLs, result.WarmURL)
+	}
+	status.Duration = time.Since(started).Seconds()
+
+	w.finish(status, retryAfter, failed)
+}
+
+// finish records a run, backing off when it failed.
+func (w *Warmer) finish(status WarmStatus, retryAfter time.Duration, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err == nil {
+		w.failures = 0
+		w.status = status
+		return
+	}
+
+	w.failures++
+	backoff := w.options.Interval << min(w.failures-1, 16)
+	backoff = max(min(backoff, w.options.MaxBackoff), retryAfter)
+	status.BackoffUntil = time.Now().Add(backoff)
+	status.Error = err.Error()
+	w.status = status
+	logger.Logger("[warn] cache warming paused for ", backoff.String(), " ", err.Error()).Warn()
+}
+
+type fetchResult struct {
+	WarmURL
+	retryAfter time.Duration
+}
+
+// fetch warms one URL when its entry is missing or about to expire.
+func (w *Warmer) fetch(raw string) fetchResult {
+	result := fetchResult{WarmURL: WarmURL{URL: raw}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), w.options.Timeout)
+	defer cancel()
+	req, err := w.request(ctx, raw)
+	if err != nil {
+		result.Result, result.Error = "failed", err.Error()
+		return result
+	}
+
+	if !w.cache.expiring(req, w.options.Interval) {
+		result.Result = "fresh"
+		return result
+	}
+	name := "httpcache-warm-" + w.cache.keys.Build(req).String()
+	token, locked, err := w.cache.locker.TryAcquire(name, w.options.Timeout)
+	if err != nil {
+		result.Result, result.Error = "failed", err.Error()
+		return result
+	}
+	if !locked {
+		result.Result = "locked"
+		return result
+	}
+	defer w.cache.locker.Release(name, token)
+
+	// skips the lookup, the response replaces the entry
+	req.Header.Set("Cache-Control", "no-cache")
+	recorder := &recorder{ResponseWriter: newDiscardWriter(), status: http.StatusOK}
+	w.handler.ServeHTTP(recorder, req)
+
+	result.Status = recorder.status
+	result.Result = "warmed"
+	if recorder.status == http.StatusTooManyRequests || recorder.status >= http.StatusInternalServerError {
+		result.Result = "failed"
+		if seconds, err := strconv.Atoi(recorder.Header().Get("Retry-After")); err == nil && seconds > 0 {
+			result.retryAfter = time.Duration(seconds) * time.Second
+		}
+	}
+
+	return result
+}
+
+// request builds the GET of raw, a path is on Host.
+func (w *Warmer) request(ctx context.Context, raw string) (*http.Request, error) {
+	target, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if target.Host == "" {
+		if w.options.Host == "" {
+			return nil, fmt.Errorf("%q has no host", raw)
+		}
+		target.Scheme, target.Host = "http", w.options.Host
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.RemoteAddr = "127.0.0.1:0"
+	for name, values := range w.options.Header {
+		req.Header[name] = values
+	}
+
+	return req, nil
+}
@@ -1,17 +1,29 @@
 package httpserver
 
 import (
-	"net/http"
+	"context"
+	"strings"
+	"time"
 
-	"github.com/jahrulnr/go-waf/config"
+	"github.com/jahrulnr/go-waf/internal/interface/repository"
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+	"github.com/jahrulnr/go-waf/pkg/clientip"
+	"github.com/jahrulnr/go-waf/pkg/config"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+	"github.com/jahrulnr/go-waf/pkg/metrics"
+	"github.com/jahrulnr/go-waf/pkg/revocation"
+	"github.com/jahrulnr/go-waf/pkg/server"
 
 	"github.com/gin-gonic/gin"
 )
 
 type HttpServer struct {
 	config  *config.Config
-	server  *http.Server
+	server  *server.Server
 	handler *gin.Engine
+	cache   repository.CacheInterface
+	autoBan service.AutoBanInterface
+	metrics metrics.SlowClientRecorder
 
 	notify chan error
 }
@@ -19,10 +31,7 @@ type HttpServer struct {
 func NewHttpServer(conf *config.Config) *HttpServer {
 	httpserver := &HttpServer{
 		config: conf,
-		server: &http.Server{
-			Addr: conf.ADDR,
-		},
-		notify: make(chan error),
+		notify: make(chan error, 1),
 	}
 
 	return httpserver
@@ -32,20 +41,107 @@ func (h *HttpServer) SetHandler(handler *gin.Engine) {
 	h.handler = handler
 }
 
-func (h *HttpServer) execute() {
-	h.server.Handler = h.handler
+// SetCache keeps the ACME certificates and the OCSP staples in cache, shared
+// by the instances using the same redis.
+func (h *HttpServer) SetCache(cache repository.CacheInterface) {
+	h.cache = cache
+}
+
+// SetAutoBan counts the slow clients cut as violations, with
+// SLOW_CLIENT_AUTOBAN.
+func (h *HttpServer) SetAutoBan(autoBan service.AutoBanInterface) {
+	h.autoBan = autoBan
+}
+
+// slowClient reports a client cut for sending its request too slowly.
+func (h *HttpServer) slowClient(ip string, phase string) {
+	logger.Logger("[warn] slow client cut reading the request ", phase, " ", ip).Warn()
+	if h.metrics != nil {
+		h.metrics.RecordSlowClient(phase)
+	}
+	if h.autoBan == nil || ip == "" || !h.config.SLOW_CLIENT_AUTOBAN {
+		return
+	}
+	if _, err := h.autoBan.Violation(ip); err != nil {
+		logger.Logger("[warn] fail to count slow client violation ", ip, err.Error()).Warn()
+	}
+}
+
+func (h *HttpServer) options() (server.Options, error) {
+	options := server.Options{
+		Addr:              h.config.ADDR,
+		Smuggling:         h.config.USE_SMUGGLING_GUARD,
+		ReadHeaderTimeout: time.Duration(h.config.READ_HEADER_TIMEOUT) * time.Second,
+		ReadBodyTimeout:   time.Duration(h.config.READ_BODY_TIMEOUT) * time.Second,
+		IdleTimeout:       time.Duration(h.config.IDLE_TIMEOUT) * time.Second,
+		MinDataRate:       h.config.MIN_DATA_RATE,
+		MinDataRateGrace:  time.Duration(h.config.MIN_DATA_RATE_GRACE) * time.Second,
+		OnSlowClient:      h.slowClient,
+	}
+	if h.config.ENABLE_METRICS {
+		h.metrics = metrics.NewPrometheusRequestRecorder(nil)
+	}
+
+	var proxies []string
+	for _, proxy := range strings.Split(h.config.TRUSTED_PROXIES, ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	trusted, err := clientip.ParseTrusted(proxies)
+	if err != nil {
+		return options, err
+	}
+	options.Trusted = trusted
+
+	if !h.config.USE_SSL {
+		return options, nil
+	}
 
-	var err error
-	if h.config.USE_SSL {
-		err = h.server.ListenAndServeTLS(h.config.SSL_CERT, h.config.SSL_KEY)
+	for _, host := range strings.Split(h.config.ACME_HOSTS, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			options.ACMEHosts = append(options.ACMEHosts, host)
+		}
+	}
+	if len(options.ACMEHosts) > 0 {
+		options.ACMEEmail = h.config.ACME_EMAIL
+		options.ACMEDirectory = h.config.ACME_DIRECTORY
+		options.ACMEHTTPAddr = h.config.ACME_HTTP_ADDR
+		options.ACMECache = h.cache
 	} else {
-		err = h.server.ListenAndServe()
+		options.CertFile = h.config.SSL_CERT
+		options.KeyFile = h.config.SSL_KEY
+	}
+
+	version, err := server.ParseVersion(h.config.TLS_MIN_VERSION)
+	if err != nil {
+		return options, err
 	}
+	options.MinVersion = version
+	options.ClientCerts = h.config.USE_MTLS
+	if h.config.TLS_OCSP_STAPLING {
+		options.Stapler = revocation.NewStapler(revocation.NewFetcher(h.cache, nil))
+	}
+	options.CipherSuites, err = server.ParseCipherSuites(strings.Split(h.config.TLS_CIPHER_SUITES, ","))
+
+	return options, err
+}
 
-	h.notify <- err
+func (h *HttpServer) execute() {
+	h.notify <- h.server.ListenAndServe()
 }
 
+// Start listens in the background, a setup or listen error arrives on Notify.
 func (h *HttpServer) Start() {
+	options, err := h.options()
+	if err == nil {
+		h.server, err = server.NewServer(h.handler, options)
+	}
+	if err != nil {
+		h.notify <- err
+		return
+	}
+
 	go h.execute()
 }
 
@@ -54,5 +150,17 @@ func (h *HttpServer) Notify() <-chan error {
 }
 
 func (h *HttpServer) Stop() {
-	h.notify <- h.server.Close()
+	if h.server != nil {
+		h.notify <- h.server.Close()
+	}
+}
+
+// Shutdown stops accepting connections and waits for the requests in flight,
+// at most until ctx is done.
+func (h *HttpServer) Shutdown(ctx context.Context) error {
+	if h.server == nil {
+		return nil
+	}
+
+	return h.server.Shutdown(ctx)
 }
@@ -0,0 +1,143 @@
+package ipfilter
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"github.com/jahrulnr/go-waf/pkg/clientip"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Filter decides on client addresses from CIDR allow and deny lists. The deny
+// list wins, and a non-empty allow list rejects everything outside it. The
+// lists can change at runtime, e.g. for bans.
+type Filter struct {
+	mu    sync.RWMutex
+	allow trie
+	deny  trie
+}
+
+// NewFilter parses both lists. Entries are CIDR ranges or single IPv4 or
+// IPv6 addresses.
+func NewFilter(allow []string, deny []string) (*Filter, error) {
+	f := &Filter{}
+	for _, cidr := range allow {
+		if err := f.AddAllow(cidr); err != nil {
+			return nil, err
+		}
+	}
+	for _, cidr := range deny {
+		if err := f.Add(cidr); err != nil {
+			return nil, err
+		}
+	}
+
+	return f, nil
+}
+
+// ParsePrefix reads a CIDR range or a single address. IPv4-mapped IPv6
+// addresses are stored as IPv4, so both notations match the same clients.
+func ParsePrefix(cidr string) (netip.Prefix, error) {
+	cidr = strings.TrimSpace(cidr)
+	if !strings.Contains(cidr, "/") {
+		addr, err := netip.ParseAddr(cidr)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid ip %q: %w", cidr, err)
+		}
+		addr = addr.Unmap().WithZone("")
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid cidr %q: %w", cidr, err)
+	}
+	if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+
+	return prefix.Masked(), nil
+}
+
+// Add denies cidr.
+func (f *Filter) Add(cidr string) error {
+	return f.update(&f.deny, cidr, true)
+}
+
+// Remove lifts an earlier Add of exactly cidr.
+func (f *Filter) Remove(cidr string) error {
+	return f.update(&f.deny, cidr, false)
+}
+
+// AddAllow adds cidr to the allow list.
+func (f *Filter) AddAllow(cidr string) error {
+	return f.update(&f.allow, cidr, true)
+}
+
+// RemoveAllow takes exactly cidr off the allow list.
+func (f *Filter) RemoveAllow(cidr string) error {
+	return f.update(&f.allow, cidr, false)
+}
+
+func (f *Filter) update(list *trie, cidr string, add bool) error {
+	prefix, err := ParsePrefix(cidr)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if add {
+		list.insert(prefix)
+	} else {
+		list.remove(prefix)
+	}
+
+	return nil
+}
+
+// Allowed reports whether ip passes the filter. Invalid addresses only pass
+// when there is no allow list.
+func (f *Filter) Allowed(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if err != nil {
+		return f.allow.empty()
+	}
+
+	addr = addr.Unmap()
+	if f.deny.contains(addr) {
+		return false
+	}
+
+	return f.allow.empty() || f.allow.contains(addr)
+}
+
+// Middleware aborts requests from rejected client IPs with block, or with a
+// plain 403 when block is nil. The client IP comes from clientip.FromContext,
+// so only trusted proxies can set it through X-Forwarded-For.
+func (f *Filter) Middleware(block gin.HandlerFunc) gin.HandlerFunc {
+	if block == nil {
+		block = func(c *gin.Context) {
+			c.String(http.StatusForbidden, "403 | Forbidden.")
+		}
+	}
+
+	return func(c *gin.Context) {
+		if !f.Allowed(clientip.FromContext(c)) {
+			block(c)
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
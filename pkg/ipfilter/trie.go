@@ -0,0 +1,110 @@
+package ipfilter
+
+import (
+	"net/netip"
+)
+
+// node is a binary trie node, each level is one bit of the address.
+type node struct {
+	child [2]*node
+	leaf  bool // a range ends here, everything below is covered
+}
+
+// trie holds CIDR ranges, with separate roots as IPv4 and IPv6 addresses
+// have different lengths.
+type trie struct {
+	v4 node
+	v6 node
+}
+
+func (t *trie) root(addr netip.Addr) *node {
+	if addr.Is4() {
+		return &t.v4
+	}
+
+	return &t.v6
+}
+
+func bit(addr netip.Addr, i int) int {
+	var b []byte
+	if addr.Is4() {
+		b4 := addr.As4()
+		b = b4[:]
+	} else {
+		b16 := addr.As16()
+		b = b16[:]
+	}
+
+	return int(b[i/8]>>(7-i%8)) & 1
+}
+
+// insert adds prefix and reports whether it was new.
+func (t *trie) insert(prefix netip.Prefix) bool {
+	n := t.root(prefix.Addr())
+	for i := 0; i < prefix.Bits(); i++ {
+		b := bit(prefix.Addr(), i)
+		if n.child[b] == nil {
+			n.child[b] = &node{}
+		}
+		n = n.child[b]
+	}
+
+	added := !n.leaf
+	n.leaf = true
+	return added
+}
+
+// remove deletes exactly prefix, ranges inside or around it stay, and reports
+// whether it was present. Branches left empty are pruned.
+func (t *trie) remove(prefix netip.Prefix) bool {
+	path := []*node{t.root(prefix.Addr())}
+	for i := 0; i < prefix.Bits(); i++ {
+		next := path[i].child[bit(prefix.Addr(), i)]
+		if next == nil {
+			return false
+		}
+		path = append(path, next)
+	}
+
+	n := path[len(path)-1]
+	if !n.leaf {
+		return false
+	}
+	n.leaf = false
+
+	for i := len(path) - 1; i > 0; i-- {
+		if n := path[i]; n.leaf || n.child[0] != nil || n.child[1] != nil {
+			break
+		}
+		path[i-1].child[bit(prefix.Addr(), i-1)] = nil
+	}
+
+	return true
+}
+
+// contains reports whether any range covers addr.
+func (t *trie) contains(addr netip.Addr) bool {
+	n := t.root(addr)
+	for i := 0; ; i++ {
+		if n.leaf {
+			return true
+		}
+		if i == addr.BitLen() {
+			return false
+		}
+		if n = n.child[bit(addr, i)]; n == nil {
+			return false
+		}
+	}
+}
+
+// empty reports whether no range was added.
+func (t *trie) empty() bool {
+	for _, root := range []*node{&t.v4, &t.v6} {
+		if root.leaf || root.child[0] != nil || root.child[1] != nil {
+			return false
+		}
+	}
+
+	return true
+}
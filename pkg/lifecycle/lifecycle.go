@@ -0,0 +1,131 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/jahrulnr/go-waf/pkg/logger"
+)
+
+// Component is a part of the app running in the background, like a cache
+// janitor, a file watcher or the http server.
+type Component interface {
+	Start(ctx context.Context) error
+	// Shutdown stops the component and waits for its goroutines, at most
+	// until ctx is done.
+	Shutdown(ctx context.Context) error
+}
+
+// Hook makes a Component of two functions, either may be nil.
+type Hook struct {
+	OnStart    func(ctx context.Context) error
+	OnShutdown func(ctx context.Context) error
+}
+
+func (h Hook) Start(ctx context.Context) error {
+	if h.OnStart == nil {
+		return nil
+	}
+
+	return h.OnStart(ctx)
+}
+
+func (h Hook) Shutdown(ctx context.Context) error {
+	if h.OnShutdown == nil {
+		return nil
+	}
+
+	return h.OnShutdown(ctx)
+}
+
+// Closer makes a Component of something already running that only needs
+// closing, like a watcher.
+func Closer(closer io.Closer) Component {
+	return Hook{
+		OnShutdown: func(context.Context) error {
+			return closer.Close()
+		},
+	}
+}
+
+type component struct {
+	name string
+	Component
+}
+
+// Lifecycle starts the registered components in order and shuts them down in
+// reverse, so the http server, registered last, drains its requests before
+// the caches and watchers they use go away.
+type Lifecycle struct {
+	mu         sync.Mutex
+	components []component
+	started    int
+}
+
+func NewLifecycle() *Lifecycle {
+	return &Lifecycle{}
+}
+
+// Register adds a component, started by the next Start.
+func (l *Lifecycle) Register(name string, c Component) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.components = append(l.components, component{name: name, Component: c})
+}
+
+// Start starts the components not started yet. When one fails the ones
+// already started are shut down again.
+func (l *Lifecycle) Start(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for ; l.started < len(l.components); l.started++ {
+		c := l.components[l.started]
+		if err := c.Start(ctx); err != nil {
+			err = fmt.Errorf("start %s: %w", c.name, err)
+			return errors.Join(err, l.shutdown(ctx))
+		}
+	}
+
+	return nil
+}
+
+// Shutdown stops the started components in reverse order, each cancelling
+// its work and waiting for its goroutines. Once ctx is done it stops
+// waiting, the components left are reported as not stopped in time.
+func (l *Lifecycle) Shutdown(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.shutdown(ctx)
+}
+
+func (l *Lifecycle) shutdown(ctx context.Context) error {
+	var errs []error
+	for ; l.started > 0; l.started-- {
+		c := l.components[l.started-1]
+		logger.Logger("[debug] shutting down ", c.name).Debug()
+
+		// a component ignoring ctx must not hold up the exit
+		done := make(chan error, 1)
+		go func() {
+			done <- c.Shutdown(ctx)
+		}()
+
+		var err error
+		select {
+		case err = <-done:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("shutdown %s: %w", c.name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
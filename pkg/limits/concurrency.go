@@ -0,0 +1,173 @@
+package limits
+
+import (
+	"context"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jahrulnr/go-waf/internal/interface/repository"
+	"github.com/jahrulnr/go-waf/pkg/audit"
+	"github.com/jahrulnr/go-waf/pkg/block"
+	"github.com/jahrulnr/go-waf/pkg/clientip"
+	"github.com/jahrulnr/go-waf/pkg/dryrun"
+	"github.com/jahrulnr/go-waf/pkg/ipfilter"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Concurrency caps the requests a client has in flight at once, against
+// clients holding many slow requests open to tie up the upstream. The counts
+// are kept in the cache, so instances sharing it enforce one cap. A count is
+// taken on entry and given back when the request ends, panics included, and
+// expires ttl after the client's first request in flight, in case the
+// instance holding it died. WebSocket connections are long lived by design
+// and not counted.
+type Concurrency struct {
+	cache    repository.StateStore
+	limit    int64
+	ttl      time.Duration
+	clients  []clientLimit // longest prefix first
+	failOpen bool
+	audit    *audit.Logger
+	dryRun   *dryrun.DryRun
+}
+
+type clientLimit struct {
+	prefix netip.Prefix
+	limit  int64
+}
+
+// NewConcurrency allows limit requests in flight per client, 0 or less is
+// unlimited. A ttl of 0 or less takes 5 minutes, it should outlast the
+// slowest request.
+func NewConcurrency(cache repository.StateStore, limit int64, ttl time.Duration) *Concurrency {
+	if ttl <= 0 {
+		ttl = 5 * time.Minute
+	}
+
+	return &Concurrency{cache: cache, limit: limit, ttl: ttl, failOpen: true}
+}
+
+// SetFailOpen chooses whether requests are let through (true, the default)
+// or answered 429 while the cache can't count them.
+func (l *Concurrency) SetFailOpen(failOpen bool) {
+	l.failOpen = failOpen
+}
+
+// Client allows the clients in cidr, a range or a single address, limit
+// requests in flight instead, 0 or less is unlimited. The longest matching
+// prefix wins.
+func (l *Concurrency) Client(cidr string, limit int64) error {
+	prefix, err := ipfilter.ParsePrefix(cidr)
+	if err != nil {
+		return err
+	}
+
+	l.clients = append(l.clients, clientLimit{prefix: prefix, limit: limit})
+	sort.SliceStable(l.clients, func(i, j int) bool {
+		return l.clients[i].prefix.Bits() > l.clients[j].prefix.Bits()
+	})
+
+	return nil
+}
+
+// SetAudit writes every rejected request to the audit log.
+func (l *Concurrency) SetAudit(audit *audit.Logger) {
+	l.audit = audit
+}
+
+// SetDryRun forwards the requests over the cap, only reporting them.
+func (l *Concurrency) SetDryRun(dryRun *dryrun.DryRun) {
+	l.dryRun = dryRun
+}
+
+// Limit returns the cap of ip.
+func (l *Concurrency) Limit(ip string) int64 {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return l.limit
+	}
+	addr = addr.Unmap().WithZone("")
+	for _, client := range l.clients {
+		if client.prefix.Contains(addr) {
+			return client.limit
+		}
+	}
+
+	return l.limit
+}
+
+// Middleware answers 429 to the requests of a client already at its cap. A
+// cache error lets the request through, unless SetFailOpen turned it off.
+func (l *Concurrency) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ip := clientip.FromContext(c)
+		limit := l.Limit(ip)
+		if limit <= 0 || ip == "" || c.GetHeader("Upgrade") != "" {
+			c.Next()
+			return
+		}
+
+		key := "gowaf-inflight-" + ip
+		count, err := l.cache.StateContext(c.Request.Context()).Increment(key, 1, l.ttl)
+		if err != nil {
+			logger.FromContext(c.Request.Context()).Logger("[warn] fail to count requests in flight ", ip, " fail open: ", l.failOpen, " ", err.Error()).Warn()
+			if l.failOpen || l.reject(c, ip, "requests in flight can't be counted") {
+				c.Next()
+			}
+			return
+		}
+		// the client may hang up or the handler panic, the count goes back anyway
+		defer l.release(context.WithoutCancel(c.Request.Context()), key)
+
+		if count > limit && !l.reject(c, ip, "too many requests in flight "+strconv.FormatInt(count, 10)+" of "+strconv.FormatInt(limit, 10)) {
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// reject answers 429, unless dry run forwards the request and reject returns
+// true.
+func (l *Concurrency) reject(c *gin.Context, ip string, reason string) bool {
+	record := audit.Record{
+		Source: "concurrency",
+		Action: "rate_limit",
+		Status: http.StatusTooManyRequests,
+	}
+	if l.dryRun.Forward(c, record) {
+		return true
+	}
+
+	logger.FromContext(c.Request.Context()).Logger("[warn] ", reason, " ", ip).Warn()
+	l.audit.Log(c.Request, ip, record)
+	if block.Respond(c, block.FromRecord(record)) {
+		return false
+	}
+	c.String(http.StatusTooManyRequests, "429 | Too many request.")
+	c.Abort()
+
+	return false
+}
+
+// release gives a count back, removing the key once the client has nothing
+// in flight so its ttl starts over with the next request.
+func (l *Concurrency) release(ctx context.Context, key string) {
+	cache := l.cache.StateContext(ctx)
+	count, err := cache.Increment(key, -1, l.ttl)
+	if err != nil {
+		logger.Logger("[warn] fail to release request in flight ", key, err.Error()).Warn()
+		return
+	}
+	if count <= 0 {
+		// unless a request came in meanwhile
+		if _, err := cache.CompareAndRemove(key, []byte(strconv.FormatInt(count, 10))); err != nil {
+			logger.Logger("[warn] fail to release request in flight ", key, err.Error()).Warn()
+		}
+	}
+}
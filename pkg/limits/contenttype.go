@@ -0,0 +1,106 @@
+package limits
+
+import (
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/jahrulnr/go-waf/pkg/block"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ContentTypes restricts the media types of request bodies, with a different
+// allow list per route prefix. Parameters like charset are ignored, and a
+// request without a body needs no Content-Type.
+type ContentTypes struct {
+	allowed []string
+	routes  []typeRoute // longest prefix first
+}
+
+type typeRoute struct {
+	prefix  string
+	allowed []string
+}
+
+// NewContentTypes allows the listed media types, e.g. application/json or
+// text/*. An empty list or * allows anything.
+func NewContentTypes(allowed ...string) *ContentTypes {
+	return &ContentTypes{allowed: normalize(allowed)}
+}
+
+// Route allows the listed media types on the paths starting with prefix
+// instead. The longest matching prefix wins.
+func (t *ContentTypes) Route(prefix string, allowed ...string) *ContentTypes {
+	t.routes = append(t.routes, typeRoute{prefix: prefix, allowed: normalize(allowed)})
+	sort.SliceStable(t.routes, func(i, j int) bool {
+		return len(t.routes[i].prefix) > len(t.routes[j].prefix)
+	})
+
+	return t
+}
+
+// Allowed reports whether a body of contentType may be sent to path.
+func (t *ContentTypes) Allowed(path string, contentType string) bool {
+	allowed := t.allowed
+	for _, route := range t.routes {
+		if strings.HasPrefix(path, route.prefix) {
+			allowed = route.allowed
+			break
+		}
+	}
+	if len(allowed) == 0 {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range allowed {
+		if pattern == "*" || pattern == mediaType {
+			return true
+		}
+		if prefix, found := strings.CutSuffix(pattern, "/*"); found && strings.HasPrefix(mediaType, prefix+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Middleware refuses bodies of other media types with 415.
+func (t *ContentTypes) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !hasBody(c.Request) || t.Allowed(c.Request.URL.Path, c.GetHeader("Content-Type")) {
+			c.Next()
+			return
+		}
+
+		if block.Respond(c, block.Decision{Component: "limits", Status: http.StatusUnsupportedMediaType, Reason: "content type is not allowed"}) {
+			return
+		}
+		c.String(http.StatusUnsupportedMediaType, "415 | Unsupported Media Type.")
+		c.Abort()
+	}
+}
+
+func hasBody(r *http.Request) bool {
+	if r.Body == nil || r.Body == http.NoBody {
+		return false
+	}
+
+	return r.ContentLength != 0 || len(r.TransferEncoding) > 0
+}
+
+func normalize(types []string) []string {
+	var normalized []string
+	for _, name := range types {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			normalized = append(normalized, name)
+		}
+	}
+
+	return normalized
+}
@@ -0,0 +1,156 @@
+package limits
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jahrulnr/go-waf/pkg/block"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Caps bounds the query parameters and headers of a request, 0 is unlimited.
+type Caps struct {
+	QueryParams int // query parameters
+	Headers     int // header lines
+	HeaderBytes int // of every header name and value
+	ValueLength int // of a query parameter, name and value as sent, or of a header value
+}
+
+// ParseCaps reads | separated name:value caps over defaults, e.g.
+// query:1000|value:16384. The names are query, headers, header_bytes and
+// value.
+func ParseCaps(value string, defaults Caps) (Caps, error) {
+	caps := defaults
+	for _, entry := range strings.Split(value, "|") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, number, found := strings.Cut(entry, ":")
+		n, err := strconv.Atoi(strings.TrimSpace(number))
+		if !found || err != nil || n < 0 {
+			return defaults, fmt.Errorf("cap %q must be name:count, e.g. query:1000", entry)
+		}
+
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "query":
+			caps.QueryParams = n
+		case "headers":
+			caps.Headers = n
+		case "header_bytes":
+			caps.HeaderBytes = n
+		case "value":
+			caps.ValueLength = n
+		default:
+			return defaults, fmt.Errorf("unknown cap %q, want query, headers, header_bytes or value", name)
+		}
+	}
+
+	return caps, nil
+}
+
+// Fields caps the query parameters and headers of requests, with other caps
+// per route prefix, against parsers spending their time on thousands of
+// parameters or an enormous header block. The query is walked once without
+// being parsed, and the walk stops at the first cap broken.
+type Fields struct {
+	caps   Caps
+	routes []capsRoute // longest prefix first
+}
+
+type capsRoute struct {
+	prefix string
+	caps   Caps
+}
+
+func NewFields(caps Caps) *Fields {
+	return &Fields{caps: caps}
+}
+
+// Route caps the paths starting with prefix instead. The longest matching
+// prefix wins.
+func (f *Fields) Route(prefix string, caps Caps) *Fields {
+	f.routes = append(f.routes, capsRoute{prefix: prefix, caps: caps})
+	sort.SliceStable(f.routes, func(i, j int) bool {
+		return len(f.routes[i].prefix) > len(f.routes[j].prefix)
+	})
+
+	return f
+}
+
+// Caps returns the caps of path.
+func (f *Fields) Caps(path string) Caps {
+	for _, route := range f.routes {
+		if strings.HasPrefix(path, route.prefix) {
+			return route.caps
+		}
+	}
+
+	return f.caps
+}
+
+// Middleware refuses too many or too large headers with 431 and too many or
+// too long query parameters with 400. It must run before anything iterates
+// over them.
+func (f *Fields) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		caps := f.Caps(c.Request.URL.Path)
+		if !caps.headers(c.Request.Header) {
+			if block.Respond(c, block.Decision{Component: "limits", Status: http.StatusRequestHeaderFieldsTooLarge, Reason: "too many or too large headers"}) {
+				return
+			}
+			c.String(http.StatusRequestHeaderFieldsTooLarge, "431 | Request Header Fields Too Large.")
+			c.Abort()
+			return
+		}
+		if !caps.query(c.Request.URL.RawQuery) {
+			if block.Respond(c, block.Decision{Component: "limits", Status: http.StatusBadRequest, Reason: "too many or too long query parameters"}) {
+				return
+			}
+			c.String(http.StatusBadRequest, "400 | Bad Request.")
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+func (caps Caps) headers(header http.Header) bool {
+	var lines, size int
+	for name, values := range header {
+		for _, value := range values {
+			lines++
+			size += len(name) + len(value)
+			if caps.Headers > 0 && lines > caps.Headers ||
+				caps.HeaderBytes > 0 && size > caps.HeaderBytes ||
+				caps.ValueLength > 0 && len(value) > caps.ValueLength {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func (caps Caps) query(rawQuery string) bool {
+	var params int
+	for rawQuery != "" {
+		var param string
+		param, rawQuery, _ = strings.Cut(rawQuery, "&")
+		if param == "" {
+			continue
+		}
+		params++
+		if caps.QueryParams > 0 && params > caps.QueryParams ||
+			caps.ValueLength > 0 && len(param) > caps.ValueLength {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,133 @@
+package limits
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/jahrulnr/go-waf/pkg/block"
+
+	"github.com/gin-gonic/gin"
+)
+
+// exceededKey is the gin context key of the capped body.
+const exceededKey = "limits.body"
+
+// Limits caps request bodies, with a different limit per route prefix.
+//
+// Requests announcing a bigger Content-Length are refused with 413 before
+// anything is read. A chunked request (Transfer-Encoding: chunked) has no
+// length up front, so its body is wrapped in an http.MaxBytesReader and the
+// limit is only noticed once that much has been read: by the rule engine
+// while it inspects the body, which then answers 413 through Exceeded, or
+// while the body is streamed to the upstream, which may have received the
+// first n bytes by then. In both cases the connection is closed after the
+// response.
+type Limits struct {
+	limit  int64
+	routes []route // longest prefix first
+}
+
+type route struct {
+	prefix string
+	limit  int64
+}
+
+// NewLimits limits bodies to n bytes, 0 or less is unlimited.
+func NewLimits(n int64) *Limits {
+	return &Limits{limit: n}
+}
+
+// Route limits the paths starting with prefix to n bytes instead, 0 or less
+// is unlimited. The longest matching prefix wins.
+func (l *Limits) Route(prefix string, n int64) *Limits {
+	l.routes = append(l.routes, route{prefix: prefix, limit: n})
+	sort.SliceStable(l.routes, func(i, j int) bool {
+		return len(l.routes[i].prefix) > len(l.routes[j].prefix)
+	})
+
+	return l
+}
+
+// Limit returns the limit of path.
+func (l *Limits) Limit(path string) int64 {
+	for _, route := range l.routes {
+		if strings.HasPrefix(path, route.prefix) {
+			return route.limit
+		}
+	}
+
+	return l.limit
+}
+
+// MaxBodySize limits every request body to n bytes.
+func MaxBodySize(n int64) gin.HandlerFunc {
+	return NewLimits(n).Middleware()
+}
+
+// Middleware applies the limits. It must run before anything reads the body.
+func (l *Limits) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit := l.Limit(c.Request.URL.Path)
+		if limit <= 0 || c.Request.Body == nil || c.Request.Body == http.NoBody {
+			c.Next()
+			return
+		}
+
+		if c.Request.ContentLength > limit {
+			Reject(c)
+			return
+		}
+
+		body := &cappedBody{ReadCloser: http.MaxBytesReader(c.Writer, c.Request.Body, limit)}
+		c.Request.Body = body
+		c.Set(exceededKey, body)
+		c.Next()
+	}
+}
+
+// Exceeded reports whether reading the body of the request in c went over
+// the limit. A component inspecting the body calls it after reading to answer
+// 413 instead of passing a truncated body on.
+func Exceeded(c *gin.Context) bool {
+	value, ok := c.Get(exceededKey)
+	if !ok {
+		return false
+	}
+	body, ok := value.(*cappedBody)
+
+	return ok && body.exceeded
+}
+
+// IsTooLarge reports whether err comes from reading a capped body.
+func IsTooLarge(err error) bool {
+	var tooLarge *http.MaxBytesError
+	return errors.As(err, &tooLarge)
+}
+
+// Reject answers 413 and stops the chain.
+func Reject(c *gin.Context) {
+	if block.Respond(c, block.Decision{Component: "limits", Status: http.StatusRequestEntityTooLarge, Reason: "body too large"}) {
+		return
+	}
+	c.String(http.StatusRequestEntityTooLarge, "413 | Request Entity Too Large.")
+	c.Abort()
+}
+
+// cappedBody remembers that the limit was hit, the readers put in front of it
+// by the rule engine or the retry buffer hide the error from later checks.
+type cappedBody struct {
+	io.ReadCloser
+	exceeded bool
+}
+
+func (b *cappedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && IsTooLarge(err) {
+		b.exceeded = true
+	}
+
+	return n, err
+}
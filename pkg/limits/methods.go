@@ -0,0 +1,116 @@
+package limits
+
+import (
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/jahrulnr/go-waf/pkg/block"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Methods restricts the request methods, with a different allow list per
+// route prefix. HEAD is allowed wherever GET is, and a CORS preflight is
+// judged by the method it asks for, so it reaches the CORS middleware.
+type Methods struct {
+	allowed []string
+	routes  []methodRoute // longest prefix first
+}
+
+type methodRoute struct {
+	prefix  string
+	allowed []string
+}
+
+// NewMethods allows the listed methods. An empty list or * allows any.
+func NewMethods(allowed ...string) *Methods {
+	return &Methods{allowed: methods(allowed)}
+}
+
+// Route allows the listed methods on the paths starting with prefix
+// instead. The longest matching prefix wins.
+func (m *Methods) Route(prefix string, allowed ...string) *Methods {
+	m.routes = append(m.routes, methodRoute{prefix: prefix, allowed: methods(allowed)})
+	sort.SliceStable(m.routes, func(i, j int) bool {
+		return len(m.routes[i].prefix) > len(m.routes[j].prefix)
+	})
+
+	return m
+}
+
+// Also allows method on every route, e.g. the method removing cached pages.
+func (m *Methods) Also(method string) *Methods {
+	method = strings.ToUpper(strings.TrimSpace(method))
+	if len(m.allowed) > 0 && !slices.Contains(m.allowed, method) {
+		m.allowed = append(m.allowed, method)
+	}
+	for i, route := range m.routes {
+		if len(route.allowed) > 0 && !slices.Contains(route.allowed, method) {
+			m.routes[i].allowed = append(route.allowed, method)
+		}
+	}
+
+	return m
+}
+
+// Allow returns the methods allowed on path, nil when any is.
+func (m *Methods) Allow(path string) []string {
+	for _, route := range m.routes {
+		if strings.HasPrefix(path, route.prefix) {
+			return route.allowed
+		}
+	}
+
+	return m.allowed
+}
+
+// Allowed reports whether method may be sent to path.
+func (m *Methods) Allowed(path string, method string) bool {
+	allowed := m.Allow(path)
+
+	return len(allowed) == 0 || slices.Contains(allowed, method)
+}
+
+// Middleware refuses other methods with 405 and an Allow header listing the
+// allowed ones.
+func (m *Methods) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		method := c.Request.Method
+		if requested := c.GetHeader("Access-Control-Request-Method"); method == http.MethodOptions &&
+			requested != "" && c.GetHeader("Origin") != "" {
+			method = requested
+		}
+		if m.Allowed(c.Request.URL.Path, method) {
+			c.Next()
+			return
+		}
+
+		c.Header("Allow", strings.Join(m.Allow(c.Request.URL.Path), ", "))
+		if block.Respond(c, block.Decision{Component: "limits", Status: http.StatusMethodNotAllowed, Reason: "method " + method + " is not allowed"}) {
+			return
+		}
+		c.String(http.StatusMethodNotAllowed, "405 | Method Not Allowed.")
+		c.Abort()
+	}
+}
+
+// methods normalizes a method list, adding HEAD for GET. * allows any.
+func methods(list []string) []string {
+	var allowed []string
+	for _, method := range list {
+		method = strings.ToUpper(strings.TrimSpace(method))
+		if method == "*" {
+			return nil
+		}
+		if method != "" && !slices.Contains(allowed, method) {
+			allowed = append(allowed, method)
+		}
+	}
+	if slices.Contains(allowed, http.MethodGet) && !slices.Contains(allowed, http.MethodHead) {
+		allowed = append(allowed, http.MethodHead)
+	}
+
+	return allowed
+}
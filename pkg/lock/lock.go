@@ -0,0 +1,117 @@
+package lock
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/jahrulnr/go-waf/internal/interface/repository"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+)
+
+// ErrNotHeld is returned when releasing a lock that expired or is owned by
+// someone else.
+var ErrNotHeld = errors.New("lock is not held")
+
+// RetryInterval is how long Acquire waits between attempts.
+var RetryInterval = 50 * time.Millisecond
+
+// Locker provides mutual exclusion across WAF instances sharing a state
+// store, e.g. the cache.
+type Locker struct {
+	cache  repository.StateStore
+	prefix string
+}
+
+func NewLocker(cache repository.StateStore) *Locker {
+	return &Locker{
+		cache:  cache,
+		prefix: "gowaf-lock-",
+	}
+}
+
+// TryAcquire attempts to take the lock once. It returns the owner token when
+// the lock was taken.
+func (l *Locker) TryAcquire(name string, ttl time.Duration) (string, bool, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", false, err
+	}
+
+	ok, err := l.cache.SetNX(l.prefix+name, []byte(token), ttl)
+	if err != nil || !ok {
+		return "", false, err
+	}
+
+	return token, true, nil
+}
+
+// Acquire blocks until the lock is taken or ctx is done. The returned token
+// must be passed to Release.
+func (l *Locker) Acquire(ctx context.Context, name string, ttl time.Duration) (string, error) {
+	for {
+		token, ok, err := l.TryAcquire(name, ttl)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return token, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(RetryInterval):
+		}
+	}
+}
+
+// Release frees the lock, but only if it is still owned by token.
+func (l *Locker) Release(name string, token string) error {
+	ok, err := l.cache.CompareAndRemove(l.prefix+name, []byte(token))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNotHeld
+	}
+
+	return nil
+}
+
+// AutoRenew keeps extending the lock in the background until ctx is done or
+// the lock is lost. Cancel ctx before calling Release.
+func (l *Locker) AutoRenew(ctx context.Context, name string, token string, ttl time.Duration) {
+	if ttl < 3*time.Millisecond {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				ok, err := l.cache.CompareAndExpire(l.prefix+name, []byte(token), ttl)
+				if err != nil || !ok {
+					logger.Logger("[warn] lost lock ", name, err).Warn()
+					return
+				}
+			}
+		}
+	}()
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
@@ -1,10 +1,12 @@
 package logger
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"maps"
 	"runtime"
 	"strings"
 
@@ -20,101 +22,249 @@ const (
 	FATAL = "fatal"
 )
 
+// Level is the minimum severity written, entries below it are dropped
+// before they are rendered.
+type Level uint32
+
+const (
+	ErrorLevel = Level(logrus.ErrorLevel)
+	WarnLevel  = Level(logrus.WarnLevel)
+	InfoLevel  = Level(logrus.InfoLevel)
+	DebugLevel = Level(logrus.DebugLevel)
+)
+
+// Format selects how entries are written.
+type Format string
+
+const (
+	// TEXT writes logrus text lines, the message being the caller and the
+	// logged values as JSON.
+	TEXT Format = "text"
+	// JSON writes one JSON object per line with timestamp, level, message,
+	// caller and the fields given to With.
+	JSON Format = "json"
+)
+
+// logDriver is one log entry. Logger and With return a new one per call, so
+// entries built concurrently never mix.
 type logDriver struct {
 	driver *logrus.Logger
 
-	message interface{}
+	caller string
+	logs   []interface{}
+	fields map[string]interface{}
 }
 
 var logger = &logDriver{
 	driver: logrus.New(),
 }
 
-func SetLevel(level string) {
-	level = strings.ToLower(level)
+var format = TEXT
 
-	switch level {
+// ParseLevel reads a level name, unknown names give InfoLevel and an error.
+func ParseLevel(level string) (Level, error) {
+	switch strings.ToLower(level) {
 	case DEBUG:
-		logger.driver.Level = logrus.DebugLevel
+		return DebugLevel, nil
 	case INFO:
-		logger.driver.Level = logrus.InfoLevel
-	case WARN:
-		logger.driver.Level = logrus.WarnLevel
+		return InfoLevel, nil
+	case WARN, "warning":
+		return WarnLevel, nil
 	case ERROR:
-		logger.driver.Level = logrus.ErrorLevel
-	case PANIC:
-		logger.driver.Level = logrus.PanicLevel
-	case FATAL:
-		logger.driver.Level = logrus.FatalLevel
+		return ErrorLevel, nil
 	default:
-		logger.driver.Level = logrus.GetLevel()
+		return InfoLevel, fmt.Errorf("unknown log level %q", level)
 	}
 }
 
+// SetLevel drops entries less severe than level. The default is InfoLevel.
+func SetLevel(level Level) {
+	logger.driver.SetLevel(logrus.Level(level))
+}
+
 func SetOutput(output io.Writer) {
 	log.Println("[info] logger output is changed")
 	logger.driver.SetOutput(output)
 }
 
+// SetFormat switches the output format, unknown formats fall back to TEXT.
+func SetFormat(f Format) {
+	switch Format(strings.ToLower(string(f))) {
+	case JSON:
+		format = JSON
+		logger.driver.SetFormatter(&logrus.JSONFormatter{
+			FieldMap: logrus.FieldMap{
+				logrus.FieldKeyTime: "timestamp",
+				logrus.FieldKeyMsg:  "message",
+			},
+		})
+	default:
+		format = TEXT
+		logger.driver.SetFormatter(&logrus.TextFormatter{})
+	}
+}
+
 func Logger(logs ...interface{}) *logDriver {
 	if len(logs) == 0 || logs[0] == nil {
 		return logger
 	}
 
 	_, filename, line, _ := runtime.Caller(1)
-	logger.message = map[string]interface{}{
-		"caller": fmt.Sprintf("%s:%d", filename, line),
-		"log":    logs,
+	return &logDriver{
+		driver: logger.driver,
+		caller: fmt.Sprintf("%s:%d", filename, line),
+		logs:   logs,
+	}
+}
+
+// With starts an entry carrying fields, e.g.
+//
+//	logger.With(map[string]any{"ip": ip}).Logger("[warn] blocked").Warn()
+func With(fields map[string]interface{}) *logDriver {
+	return logger.With(fields)
+}
+
+// With returns a copy of the entry with fields added.
+func (l *logDriver) With(fields map[string]interface{}) *logDriver {
+	entry := *l
+	entry.fields = make(map[string]interface{}, len(l.fields)+len(fields))
+	maps.Copy(entry.fields, l.fields)
+	maps.Copy(entry.fields, fields)
+
+	return &entry
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying fields, e.g. the request id set by
+// the request id middleware, for FromContext. They are added to the fields
+// ctx already carries.
+func NewContext(ctx context.Context, fields map[string]interface{}) context.Context {
+	return context.WithValue(ctx, contextKey{}, FromContext(ctx).With(fields).fields)
+}
+
+// FromContext starts an entry carrying the fields of ctx, e.g.
+//
+//	logger.FromContext(c.Request.Context()).Logger("[warn] blocked").Warn()
+//
+// Goroutines started for a request log with its id as long as they are given
+// its context, or one derived from it.
+func FromContext(ctx context.Context) *logDriver {
+	if ctx == nil {
+		return logger
+	}
+	if fields, ok := ctx.Value(contextKey{}).(map[string]interface{}); ok {
+		return logger.With(fields)
 	}
-	logger.jsonize()
 
 	return logger
 }
 
-func (l *logDriver) jsonize() {
-	if logger.message == nil {
-		return
+// Logger sets the message of an entry started with With.
+func (l *logDriver) Logger(logs ...interface{}) *logDriver {
+	if len(logs) == 0 || logs[0] == nil {
+		return l
+	}
+
+	_, filename, line, _ := runtime.Caller(1)
+	entry := *l
+	entry.caller = fmt.Sprintf("%s:%d", filename, line)
+	entry.logs = logs
+
+	return &entry
+}
+
+// entry renders the message for the current format, ok is false when there
+// is nothing to log.
+func (l *logDriver) entry() (*logrus.Entry, string, bool) {
+	if l.logs == nil && l.fields == nil {
+		return nil, "", false
+	}
+
+	entry := logrus.NewEntry(l.driver)
+	if format != JSON {
+		if l.fields != nil {
+			entry = entry.WithFields(l.fields)
+		}
+		if l.logs == nil {
+			return entry, "", true
+		}
+
+		message, err := json.Marshal(map[string]interface{}{
+			"caller": l.caller,
+			"log":    l.logs,
+		})
+		if err != nil {
+			log.Panicln("[panic] logger error. Causer: ", err)
+		}
+		return entry, string(message), true
+	}
+
+	fields := logrus.Fields{}
+	if l.caller != "" {
+		fields["caller"] = l.caller
 	}
+	maps.Copy(fields, l.fields)
 
-	message, err := json.Marshal(logger.message)
-	if err != nil {
-		log.Panicln("[panic] logger error. Causer: ", err)
+	// a single map is logged as fields, its "message" becoming the message
+	var message string
+	if len(l.logs) == 1 {
+		if values, ok := l.logs[0].(map[string]interface{}); ok {
+			for key, value := range values {
+				if key == "message" {
+					message = fmt.Sprint(value)
+					continue
+				}
+				fields[key] = value
+			}
+			return entry.WithFields(fields), message, true
+		}
+	}
+	if l.logs != nil {
+		message = fmt.Sprint(l.logs...)
 	}
 
-	logger.message = string(message)
+	return entry.WithFields(fields), message, true
 }
 
 func (l *logDriver) Debug() {
-	if logger.message != nil {
-		l.driver.Debug(l.message)
-		l.message = nil
+	if !l.driver.IsLevelEnabled(logrus.DebugLevel) {
+		return
+	}
+	if entry, message, ok := l.entry(); ok {
+		entry.Debug(message)
 	}
 }
 
 func (l *logDriver) Info() {
-	if logger.message != nil {
-		l.driver.Info(l.message)
-		l.message = nil
+	if !l.driver.IsLevelEnabled(logrus.InfoLevel) {
+		return
+	}
+	if entry, message, ok := l.entry(); ok {
+		entry.Info(message)
 	}
 }
 
 func (l *logDriver) Warn() {
-	if logger.message != nil {
-		l.driver.Warn(l.message)
-		l.message = nil
+	if !l.driver.IsLevelEnabled(logrus.WarnLevel) {
+		return
+	}
+	if entry, message, ok := l.entry(); ok {
+		entry.Warn(message)
 	}
 }
 
 func (l *logDriver) Error() {
-	if logger.message != nil {
-		l.driver.Error(l.message)
-		l.message = nil
+	if !l.driver.IsLevelEnabled(logrus.ErrorLevel) {
+		return
+	}
+	if entry, message, ok := l.entry(); ok {
+		entry.Error(message)
 	}
 }
 
 func (l *logDriver) Fatal() {
-	if logger.message != nil {
-		l.driver.Fatal(l.message)
-		l.message = nil
+	if entry, message, ok := l.entry(); ok {
+		entry.Fatal(message)
 	}
 }
@@ -0,0 +1,172 @@
+package maintenance
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jahrulnr/go-waf/internal/interface/repository"
+	"github.com/jahrulnr/go-waf/pkg/clientip"
+	"github.com/jahrulnr/go-waf/pkg/ipfilter"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Key is the cache key of the flag shared by the instances.
+const Key = "gowaf-maintenance"
+
+// DefaultBody is the page served without Options.Body.
+const DefaultBody = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Maintenance</title></head>
+<body><h1>Down for maintenance</h1><p>We'll be back shortly.</p></body>
+</html>
+`
+
+// Options configures the maintenance page. Zero values take the defaults
+// noted on each field.
+type Options struct {
+	Status      int           // default 503
+	Body        string        // default DefaultBody
+	ContentType string        // default text/html; charset=utf-8
+	RetryAfter  time.Duration // Retry-After of the page, 0 sends none
+	Allow       []string      // IPs or CIDRs let through to the upstream
+	Exempt      []string      // paths always served, e.g. health checks
+	Refresh     time.Duration // how long the shared flag is trusted before it is read again, default 1s
+}
+
+// Maintenance answers every request with a maintenance page while it is on,
+// except for the allowed clients, e.g. the team checking a deployment. It is
+// on while turned on locally, by the config, or while the flag in the state
+// store is set, which turns it on for every instance sharing the store. The
+// flag is read at most every Refresh, not on every request.
+type Maintenance struct {
+	options Options
+	state   repository.StateStore
+	allow   *ipfilter.Filter
+	local   atomic.Bool
+	shared  atomic.Bool
+	checked atomic.Int64 // unix nanoseconds the shared flag was read at
+	reading sync.Mutex
+}
+
+func NewMaintenance(store repository.StateStore, options Options) (*Maintenance, error) {
+	if options.Status == 0 {
+		options.Status = http.StatusServiceUnavailable
+	}
+	if options.Body == "" {
+		options.Body = DefaultBody
+	}
+	if options.ContentType == "" {
+		options.ContentType = "text/html; charset=utf-8"
+	}
+	if options.Refresh <= 0 {
+		options.Refresh = time.Second
+	}
+
+	allow, err := ipfilter.NewFilter(options.Allow, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Maintenance{options: options, state: store, allow: allow}, nil
+}
+
+// SetLocal turns maintenance on or off for this instance alone, the shared
+// flag keeps it on either way.
+func (m *Maintenance) SetLocal(on bool) {
+	m.local.Store(on)
+}
+
+// Enable sets the shared flag for duration, so a forgotten maintenance ends
+// on its own.
+func (m *Maintenance) Enable(ctx context.Context, duration time.Duration) error {
+	if err := m.state.StateContext(ctx).Set(Key, []byte(strconv.FormatInt(time.Now().Add(duration).Unix(), 10)), duration); err != nil {
+		return err
+	}
+	m.store(true)
+
+	return nil
+}
+
+// Disable clears the shared flag. An instance turned on locally stays on.
+func (m *Maintenance) Disable(ctx context.Context) error {
+	if err := m.state.StateContext(ctx).Remove(Key); err != nil {
+		return err
+	}
+	m.store(false)
+
+	return nil
+}
+
+// Enabled reports whether maintenance is on, locally or through the shared
+// flag.
+func (m *Maintenance) Enabled(ctx context.Context) bool {
+	return m.local.Load() || m.sharedOn(ctx)
+}
+
+// Until returns when the shared flag ends, zero when it isn't set.
+func (m *Maintenance) Until(ctx context.Context) time.Time {
+	value, found := m.state.StateContext(ctx).Get(Key)
+	if !found {
+		return time.Time{}
+	}
+	unix, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return time.Unix(unix, 0)
+}
+
+// sharedOn returns the shared flag, read again once Refresh passed. The
+// other requests meanwhile go on with the last value. A cache that can't be
+// reached reads as off.
+func (m *Maintenance) sharedOn(ctx context.Context) bool {
+	if time.Since(time.Unix(0, m.checked.Load())) < m.options.Refresh || !m.reading.TryLock() {
+		return m.shared.Load()
+	}
+	defer m.reading.Unlock()
+
+	// a client hanging up mustn't turn it off for everyone else
+	_, found := m.state.StateContext(context.WithoutCancel(ctx)).Get(Key)
+	m.store(found)
+
+	return found
+}
+
+// store takes over the shared flag as read or just changed.
+func (m *Maintenance) store(on bool) {
+	m.shared.Store(on)
+	m.checked.Store(time.Now().UnixNano())
+}
+
+// Middleware serves the maintenance page while maintenance is on. The
+// allowed clients and the exempt paths go on to the upstream.
+func (m *Maintenance) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !m.Enabled(c.Request.Context()) || slices.Contains(m.options.Exempt, c.Request.URL.Path) {
+			c.Next()
+			return
+		}
+
+		ip := clientip.FromContext(c)
+		if len(m.options.Allow) > 0 && m.allow.Allowed(ip) {
+			c.Next()
+			return
+		}
+
+		logger.FromContext(c.Request.Context()).Logger("[debug] maintenance page served to ", ip).Debug()
+		if m.options.RetryAfter > 0 {
+			c.Header("Retry-After", strconv.Itoa(int(m.options.RetryAfter.Seconds())))
+		}
+		c.Header("Cache-Control", "no-store")
+		c.Data(m.options.Status, m.options.ContentType, []byte(m.options.Body))
+		c.Abort()
+	}
+}
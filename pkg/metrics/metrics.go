@@ -0,0 +1,318 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// MetricsRecorder receives cache events. Keys are passed for recorders that
+// want them, the Prometheus recorder does not label by key to keep the
+// cardinality bounded.
+type MetricsRecorder interface {
+	RecordHit(key string)
+	RecordMiss(key string)
+	RecordError(op string)
+}
+
+// NoopRecorder discards every event.
+type NoopRecorder struct{}
+
+func (NoopRecorder) RecordHit(string)   {}
+func (NoopRecorder) RecordMiss(string)  {}
+func (NoopRecorder) RecordError(string) {}
+
+func (NoopRecorder) RecordDecision(string)                        {}
+func (NoopRecorder) RecordRuleHit(string)                         {}
+func (NoopRecorder) RecordRuleCache(string)                       {}
+func (NoopRecorder) RecordRateLimited()                           {}
+func (NoopRecorder) RecordDryRun(string, string)                  {}
+func (NoopRecorder) RecordCacheResult(string)                     {}
+func (NoopRecorder) RecordUpstream(string, int, time.Duration)    {}
+func (NoopRecorder) RecordBreakerState(name string, state string) {}
+func (NoopRecorder) RecordSlowClient(string)                      {}
+func (NoopRecorder) RecordBaselineOutlier(string)                 {}
+
+// PrometheusRecorder counts cache events with Prometheus counters.
+type PrometheusRecorder struct {
+	hits   prometheus.Counter
+	misses prometheus.Counter
+	errors *prometheus.CounterVec
+}
+
+// NewPrometheusRecorder registers the cache counters on registerer, or on the
+// default registry when registerer is nil. Calling it twice reuses the
+// already registered counters.
+func NewPrometheusRecorder(registerer prometheus.Registerer) MetricsRecorder {
+	if registerer == nil {
+		registerer = prometheus.DefaultRegisterer
+	}
+
+	return &PrometheusRecorder{
+		hits: register(registerer, prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gowaf_cache_hits_total",
+			Help: "Number of cache lookups that found a value.",
+		})),
+		misses: register(registerer, prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gowaf_cache_misses_total",
+			Help: "Number of cache lookups that found nothing.",
+		})),
+		errors: register(registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gowaf_cache_errors_total",
+			Help: "Number of failed cache operations.",
+		}, []string{"op"})),
+	}
+}
+
+func (r *PrometheusRecorder) RecordHit(string) {
+	r.hits.Inc()
+}
+
+func (r *PrometheusRecorder) RecordMiss(string) {
+	r.misses.Inc()
+}
+
+func (r *PrometheusRecorder) RecordError(op string) {
+	r.errors.WithLabelValues(op).Inc()
+}
+
+// BreakerRecorder receives circuit breaker state changes.
+type BreakerRecorder interface {
+	RecordBreakerState(name string, state string)
+}
+
+// breakerStates maps the state names to the gauge values.
+var breakerStates = map[string]float64{
+	"closed":    0,
+	"half_open": 1,
+	"open":      2,
+}
+
+// PrometheusBreakerRecorder exposes the current breaker state per upstream
+// and counts the transitions.
+type PrometheusBreakerRecorder struct {
+	state       *prometheus.GaugeVec
+	transitions *prometheus.CounterVec
+}
+
+// NewPrometheusBreakerRecorder registers the breaker metrics on registerer,
+// or on the default registry when registerer is nil.
+func NewPrometheusBreakerRecorder(registerer prometheus.Registerer) BreakerRecorder {
+	if registerer == nil {
+		registerer = prometheus.DefaultRegisterer
+	}
+
+	return &PrometheusBreakerRecorder{
+		state: register(registerer, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gowaf_proxy_breaker_state",
+			Help: "Circuit breaker state per upstream, 0 closed, 1 half open, 2 open.",
+		}, []string{"upstream"})),
+		transitions: register(registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gowaf_proxy_breaker_transitions_total",
+			Help: "Number of circuit breaker state changes.",
+		}, []string{"upstream", "state"})),
+	}
+}
+
+func (r *PrometheusBreakerRecorder) RecordBreakerState(name string, state string) {
+	r.state.WithLabelValues(name).Set(breakerStates[state])
+	r.transitions.WithLabelValues(name, state).Inc()
+}
+
+// RegisterRedisBreaker exposes the state of the circuit breaker guarding a
+// Redis client, read on every scrape, on registerer or on the default
+// registry when registerer is nil. client tells the clients apart.
+func RegisterRedisBreaker(registerer prometheus.Registerer, client string, state func() string) {
+	if registerer == nil {
+		registerer = prometheus.DefaultRegisterer
+	}
+
+	register(registerer, prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "gowaf_redis_breaker_state",
+		Help:        "Circuit breaker state of the Redis clients, 0 closed, 1 half open, 2 open.",
+		ConstLabels: prometheus.Labels{"client": client},
+	}, func() float64 {
+		return breakerStates[state()]
+	}))
+}
+
+// RuleRecorder receives the rule engine decisions and the ids of the matched
+// rules. Rule ids come from the detectors and the rules file, so their number
+// is bounded.
+type RuleRecorder interface {
+	RecordDecision(decision string)
+	RecordRuleHit(rule string)
+}
+
+// RuleCacheRecorder receives the outcome of the rule result cache lookups,
+// "hit" or "miss".
+type RuleCacheRecorder interface {
+	RecordRuleCache(result string)
+}
+
+// RateLimitRecorder counts requests rejected by the rate limiter.
+type RateLimitRecorder interface {
+	RecordRateLimited()
+}
+
+// DryRunRecorder counts the actions the blocking components would have taken
+// in dry run mode.
+type DryRunRecorder interface {
+	RecordDryRun(source string, action string)
+}
+
+// ResponseCacheRecorder receives the outcome of response cache lookups, e.g.
+// "hit", "stale", "negative_hit" or "miss".
+type ResponseCacheRecorder interface {
+	RecordCacheResult(result string)
+}
+
+// UpstreamRecorder receives the status, 0 for a failed request, and the time
+// to the response headers of every upstream request.
+type UpstreamRecorder interface {
+	RecordUpstream(upstream string, status int, duration time.Duration)
+}
+
+// SlowClientRecorder counts the requests cut for coming in too slowly, per
+// phase, header or body.
+type SlowClientRecorder interface {
+	RecordSlowClient(phase string)
+}
+
+// BaselineRecorder counts the responses flagged as outliers of their
+// route's baseline, per metric, latency, request_size or response_size.
+type BaselineRecorder interface {
+	RecordBaselineOutlier(metric string)
+}
+
+// PrometheusRequestRecorder implements the request level recorders. Nothing
+// is labelled by client, path or other unbounded values.
+type PrometheusRequestRecorder struct {
+	decisions   *prometheus.CounterVec
+	rules       *prometheus.CounterVec
+	ruleCache   *prometheus.CounterVec
+	rateLimited prometheus.Counter
+	dryRun      *prometheus.CounterVec
+	cache       *prometheus.CounterVec
+	upstream    *prometheus.HistogramVec
+	slowClients *prometheus.CounterVec
+	outliers    *prometheus.CounterVec
+}
+
+// NewPrometheusRequestRecorder registers the request metrics on registerer,
+// or on the default registry when registerer is nil.
+func NewPrometheusRequestRecorder(registerer prometheus.Registerer) *PrometheusRequestRecorder {
+	if registerer == nil {
+		registerer = prometheus.DefaultRegisterer
+	}
+
+	return &PrometheusRequestRecorder{
+		decisions: register(registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gowaf_waf_requests_total",
+			Help: "Number of requests inspected by the rule engine per decision.",
+		}, []string{"decision"})),
+		rules: register(registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gowaf_waf_rule_hits_total",
+			Help: "Number of times a rule matched.",
+		}, []string{"rule"})),
+		ruleCache: register(registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gowaf_waf_result_cache_total",
+			Help: "Number of rule result cache lookups per result.",
+		}, []string{"result"})),
+		rateLimited: register(registerer, prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gowaf_ratelimit_rejected_total",
+			Help: "Number of requests rejected by the rate limiter.",
+		})),
+		dryRun: register(registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gowaf_dry_run_total",
+			Help: "Number of requests forwarded in dry run mode that a component would have stopped, per component and action.",
+		}, []string{"source", "action"})),
+		cache: register(registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gowaf_response_cache_requests_total",
+			Help: "Number of response cache lookups per result.",
+		}, []string{"result"})),
+		upstream: register(registerer, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "gowaf_proxy_upstream_duration_seconds",
+			Help:    "Time until the upstream response headers per upstream and status class.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"upstream", "status"})),
+		slowClients: register(registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gowaf_slow_clients_total",
+			Help: "Number of requests cut for sending their header or body too slowly, per phase.",
+		}, []string{"phase"})),
+		outliers: register(registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gowaf_baseline_outliers_total",
+			Help: "Number of requests far above the baseline of their route, per metric.",
+		}, []string{"metric"})),
+	}
+}
+
+func (r *PrometheusRequestRecorder) RecordDecision(decision string) {
+	r.decisions.WithLabelValues(decision).Inc()
+}
+
+func (r *PrometheusRequestRecorder) RecordRuleHit(rule string) {
+	r.rules.WithLabelValues(rule).Inc()
+}
+
+func (r *PrometheusRequestRecorder) RecordRuleCache(result string) {
+	r.ruleCache.WithLabelValues(result).Inc()
+}
+
+func (r *PrometheusRequestRecorder) RecordRateLimited() {
+	r.rateLimited.Inc()
+}
+
+func (r *PrometheusRequestRecorder) RecordDryRun(source string, action string) {
+	r.dryRun.WithLabelValues(source, action).Inc()
+}
+
+func (r *PrometheusRequestRecorder) RecordCacheResult(result string) {
+	r.cache.WithLabelValues(result).Inc()
+}
+
+func (r *PrometheusRequestRecorder) RecordUpstream(upstream string, status int, duration time.Duration) {
+	r.upstream.WithLabelValues(upstream, statusClass(status)).Observe(duration.Seconds())
+}
+
+func (r *PrometheusRequestRecorder) RecordSlowClient(phase string) {
+	r.slowClients.WithLabelValues(phase).Inc()
+}
+
+func (r *PrometheusRequestRecorder) RecordBaselineOutlier(metric string) {
+	r.outliers.WithLabelValues(metric).Inc()
+}
+
+// statusClass keeps the status label to a handful of values.
+func statusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "error"
+	}
+
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// Handler serves the metrics of the default registry.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{})
+}
+
+// register adds collector to registerer, returning the existing collector if
+// an identical one was registered before.
+func register[C prometheus.Collector](registerer prometheus.Registerer, collector C) C {
+	if err := registerer.Register(collector); err != nil {
+		var registered prometheus.AlreadyRegisteredError
+		if errors.As(err, &registered) {
+			if existing, ok := registered.ExistingCollector.(C); ok {
+				return existing
+			}
+		}
+		panic(err)
+	}
+
+	return collector
+}
@@ -0,0 +1,181 @@
+package nonce
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jahrulnr/go-waf/internal/interface/repository"
+	"github.com/jahrulnr/go-waf/pkg/audit"
+	"github.com/jahrulnr/go-waf/pkg/block"
+	"github.com/jahrulnr/go-waf/pkg/clientip"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Store remembers the nonces seen, in the cache, so a nonce used on one
+// instance is a replay on every other sharing it.
+type Store struct {
+	cache    repository.StateStore
+	prefix   string
+	failOpen bool
+}
+
+func NewStore(cache repository.StateStore) *Store {
+	return &Store{
+		cache:  cache,
+		prefix: "gowaf-nonce-",
+	}
+}
+
+// SetFailOpen chooses whether every nonce is fresh (true) or a replay
+// (false, the default) while the cache is unreachable.
+func (s *Store) SetFailOpen(failOpen bool) {
+	s.failOpen = failOpen
+}
+
+// CheckAndStore records nonce for ttl and reports whether this is its first
+// use. The record is made with SetNX, so of two requests racing with the
+// same nonce only one is fresh. An unreachable cache makes every nonce a
+// replay unless SetFailOpen says otherwise, rejecting a request is safer
+// than letting a replay through.
+func (s *Store) CheckAndStore(nonce string, ttl time.Duration) bool {
+	fresh, err := s.cache.SetNX(s.key(nonce), []byte("1"), ttl)
+	if err != nil {
+		logger.Logger("[warn] fail to store nonce, fail open: ", s.failOpen, " ", err.Error()).Warn()
+		return s.failOpen
+	}
+
+	return fresh
+}
+
+// key is hashed, nonces are chosen by clients and may hold characters the
+// file cache can't name a file after.
+func (s *Store) key(nonce string) string {
+	sum := sha256.Sum256([]byte(nonce))
+	return s.prefix + hex.EncodeToString(sum[:])
+}
+
+// Options configures the replay protection. Zero values take the defaults
+// noted on each field.
+type Options struct {
+	NonceHeader     string        // default X-Nonce
+	TimestampHeader string        // unix seconds, default X-Timestamp
+	Skew            time.Duration // how far the timestamp may be from now either way, default 5m
+	MaxLength       int           // of a nonce, default 128
+	Paths           []string      // path prefixes checked, empty checks every path
+}
+
+// Guard rejects replayed requests: every request must carry a nonce never
+// seen before and a timestamp within Skew of now. A nonce is remembered
+// until its timestamp leaves the window, after which the timestamp alone
+// rejects a replay, so the store holds at most the nonces of 2*Skew.
+//
+// The guard doesn't check signatures, the upstream still has to verify that
+// the nonce and the timestamp are covered by the request signature.
+type Guard struct {
+	options Options
+	store   *Store
+	audit   *audit.Logger
+}
+
+func NewGuard(store *Store, options Options) *Guard {
+	if options.NonceHeader == "" {
+		options.NonceHeader = "X-Nonce"
+	}
+	if options.TimestampHeader == "" {
+		options.TimestampHeader = "X-Timestamp"
+	}
+	if options.Skew <= 0 {
+		options.Skew = 5 * time.Minute
+	}
+	if options.MaxLength <= 0 {
+		options.MaxLength = 128
+	}
+
+	return &Guard{
+		options: options,
+		store:   store,
+	}
+}
+
+// SetAudit writes every rejected request to the audit log.
+func (g *Guard) SetAudit(audit *audit.Logger) {
+	g.audit = audit
+}
+
+func (g *Guard) covers(path string) bool {
+	if len(g.options.Paths) == 0 {
+		return true
+	}
+	for _, prefix := range g.options.Paths {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Middleware rejects requests without a nonce and timestamp, stale or from
+// the future, and replayed ones with 401.
+func (g *Guard) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !g.covers(c.Request.URL.Path) {
+			c.Next()
+			return
+		}
+
+		if rule := g.check(c.Request); rule != "" {
+			ip := clientip.FromContext(c)
+			logger.FromContext(c.Request.Context()).Logger("[warn] ", rule, " ", ip, " ", c.Request.Method, " ", c.Request.URL.RequestURI()).Warn()
+			record := audit.Record{
+				Source: "nonce",
+				Rules:  []string{rule},
+				Status: http.StatusUnauthorized,
+			}
+			g.audit.Log(c.Request, ip, record)
+			if block.Respond(c, block.FromRecord(record)) {
+				return
+			}
+			c.JSON(http.StatusUnauthorized, map[string]interface{}{
+				"status": "Unauthorized",
+			})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// check returns the rule r breaks, empty when it is fresh.
+func (g *Guard) check(r *http.Request) string {
+	nonce := r.Header.Get(g.options.NonceHeader)
+	timestamp := r.Header.Get(g.options.TimestampHeader)
+	if nonce == "" || timestamp == "" || len(nonce) > g.options.MaxLength {
+		return "nonce-missing"
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "nonce-missing"
+	}
+	now := time.Now()
+	sent := time.Unix(seconds, 0)
+	if sent.Before(now.Add(-g.options.Skew)) || sent.After(now.Add(g.options.Skew)) {
+		return "nonce-stale"
+	}
+
+	// until the timestamp leaves the window, and a second for the one
+	// timestamps are rounded to
+	if !g.store.CheckAndStore(nonce, sent.Add(g.options.Skew).Sub(now)+time.Second) {
+		return "nonce-replay"
+	}
+
+	return ""
+}
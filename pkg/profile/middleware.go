@@ -0,0 +1,85 @@
+package profile
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/jahrulnr/go-waf/pkg/audit"
+	"github.com/jahrulnr/go-waf/pkg/baseline"
+	"github.com/jahrulnr/go-waf/pkg/block"
+	"github.com/jahrulnr/go-waf/pkg/clientip"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Middleware learns the shapes of the profiled requests or, once enforcing,
+// refuses the ones outside the profile. Only the requests answered below
+// 400 and not aborted are learned, so what the waf or the upstream refused
+// doesn't become normal: it must run before the waf.
+func (p *Profiler) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		current := p.snapshot.Load()
+		if current == nil || !p.covered(c.Request.URL.Path) {
+			c.Next()
+			return
+		}
+
+		method := c.Request.Method
+		if method == http.MethodHead {
+			method = http.MethodGet
+		}
+		route := baseline.Route(c.Request.URL.Path)
+		params := paramNames(c.Request.URL.RawQuery)
+
+		if current.current(time.Now()) == ModeEnforcing {
+			if violation := current.check(method, route, params); violation != nil && !p.reject(c, violation) {
+				return
+			}
+			c.Next()
+			return
+		}
+
+		c.Next()
+		if !c.IsAborted() && c.Writer.Status() < http.StatusBadRequest {
+			p.learn(current, method, route, params)
+		}
+	}
+}
+
+// reject answers a request outside the profile, with 403 when blocking.
+// Unless blocking, or when dry run forwards it, reject returns true.
+func (p *Profiler) reject(c *gin.Context, violation *Violation) bool {
+	record := audit.Record{
+		Source: "profile",
+		Rules:  []string{violation.Rule},
+		Action: p.options.Action,
+		Status: http.StatusForbidden,
+	}
+	if p.options.Action == ActionLog {
+		record.Status = 0
+	}
+	if p.options.Action == ActionBlock && p.dryRun.Forward(c, record) {
+		return true
+	}
+
+	ip := clientip.FromContext(c)
+	logger.FromContext(c.Request.Context()).Logger("[warn] ", violation.Rule, " ", ip, " ", c.Request.Method, " ", c.Request.URL.RequestURI(), " ", violation.Message).Warn()
+	p.audit.Log(c.Request, ip, record)
+	if p.options.Action == ActionLog {
+		return true
+	}
+
+	decision := block.FromRecord(record)
+	decision.Reason = violation.Message
+	if block.Respond(c, decision) {
+		return false
+	}
+	c.JSON(http.StatusForbidden, map[string]interface{}{
+		"status": http.StatusText(http.StatusForbidden),
+		"error":  violation.Message,
+	})
+	c.Abort()
+
+	return false
+}
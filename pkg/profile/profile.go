@@ -0,0 +1,462 @@
+package profile
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jahrulnr/go-waf/internal/interface/repository"
+	"github.com/jahrulnr/go-waf/pkg/audit"
+	"github.com/jahrulnr/go-waf/pkg/baseline"
+	"github.com/jahrulnr/go-waf/pkg/dryrun"
+	"github.com/jahrulnr/go-waf/pkg/lock"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+)
+
+// Modes of a profile.
+const (
+	ModeLearning  = "learning"
+	ModeEnforcing = "enforcing"
+)
+
+// Actions taken on a request outside the profile.
+const (
+	ActionBlock = "block"
+	ActionLog   = "log"
+)
+
+const (
+	// profileTTL is how long the profile outlives the last instance
+	// refreshing it.
+	profileTTL = 30 * 24 * time.Hour
+	// lockTTL bounds a merge into the profile.
+	lockTTL = 10 * time.Second
+)
+
+// Options configures the profiler. Zero values take the defaults noted on
+// each field.
+type Options struct {
+	Learn     time.Duration // learning from the first start, 0 learns until the mode is changed
+	Refresh   time.Duration // how often the learned shapes go to the cache and the profile is read back, default 10s
+	Action    string        // ActionBlock (default) or ActionLog
+	Paths     []string      // path prefixes profiled, empty profiles every path
+	MaxRoutes int           // routes learned, default 1000
+	MaxParams int           // query parameters learned per route, default 100
+}
+
+// Route is a request shape of the profile: a method, a route as baseline
+// samples it, /users/42 is /users/:id, and the query parameter names seen
+// on it.
+type Route struct {
+	Method string   `json:"method"`
+	Route  string   `json:"route"`
+	Params []string `json:"params"`
+}
+
+// Profile is the request shapes learned by every instance sharing the cache.
+// While learning, new shapes are added, once enforcing, requests of any
+// other shape are refused.
+type Profile struct {
+	Mode   string    `json:"mode"`
+	Until  time.Time `json:"until"` // end of the learning, zero learns until the mode is changed
+	Routes []Route   `json:"routes"`
+}
+
+// current returns the mode in effect at now.
+func (p *Profile) current(now time.Time) string {
+	if p.Mode == ModeLearning && !p.Until.IsZero() && !now.Before(p.Until) {
+		return ModeEnforcing
+	}
+
+	return p.Mode
+}
+
+// shapes is a profile indexed by method and route.
+type shapes map[string]map[string]struct{}
+
+func shapeKey(method string, route string) string {
+	return method + " " + route
+}
+
+func (s shapes) add(key string, params []string) {
+	known, ok := s[key]
+	if !ok {
+		known = make(map[string]struct{}, len(params))
+		s[key] = known
+	}
+	for _, param := range params {
+		known[param] = struct{}{}
+	}
+}
+
+// snapshot is the profile an instance enforces, as last read from the
+// cache.
+type snapshot struct {
+	mode   string
+	until  time.Time
+	shapes shapes
+}
+
+func (s *snapshot) current(now time.Time) string {
+	return (&Profile{Mode: s.mode, Until: s.until}).current(now)
+}
+
+// Violation is a request shape outside the profile.
+type Violation struct {
+	Rule    string // profile-route or profile-param
+	Message string
+}
+
+func (s *snapshot) check(method string, route string, params []string) *Violation {
+	known, ok := s.shapes[shapeKey(method, route)]
+	if !ok {
+		return &Violation{Rule: "profile-route", Message: fmt.Sprintf("unknown route %s %s", method, route)}
+	}
+	for _, param := range params {
+		if _, ok := known[param]; !ok {
+			return &Violation{Rule: "profile-param", Message: fmt.Sprintf("unknown parameter %s of %s %s", param, method, route)}
+		}
+	}
+
+	return nil
+}
+
+// Profiler learns the normal request shapes of an application, the paths,
+// methods and query parameter names of the requests it answers without an
+// error, then refuses the shapes it never saw. The profile is one cache
+// entry shared by every instance: each one keeps what it learned locally
+// and merges it in every Refresh, under a lock, then reads the profile back.
+// Learning starts with the first instance, so restarts don't extend it, and
+// the profile can be reviewed and edited before it is enforced, see Profile,
+// SetRoutes and SetMode.
+type Profiler struct {
+	options Options
+	cache   repository.StateStore
+	locker  *lock.Locker
+	key     string
+
+	snapshot atomic.Pointer[snapshot] // nil until read once
+
+	mu      sync.Mutex
+	pending shapes // learned since the last merge
+	full    bool   // MaxRoutes was reported
+
+	audit  *audit.Logger
+	dryRun *dryrun.DryRun
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewProfiler(cache repository.StateStore, options Options) *Profiler {
+	if options.Refresh <= 0 {
+		options.Refresh = 10 * time.Second
+	}
+	if options.Action == "" {
+		options.Action = ActionBlock
+	}
+	if options.MaxRoutes <= 0 {
+		options.MaxRoutes = 1000
+	}
+	if options.MaxParams <= 0 {
+		options.MaxParams = 100
+	}
+
+	p := &Profiler{
+		options: options,
+		cache:   cache,
+		locker:  lock.NewLocker(cache),
+		key:     "gowaf-profile",
+		pending: make(shapes),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	p.refresh()
+	go p.run()
+
+	return p
+}
+
+// SetAudit writes every request outside the profile to the audit log.
+func (p *Profiler) SetAudit(audit *audit.Logger) {
+	p.audit = audit
+}
+
+// SetDryRun forwards the requests outside the profile, only reporting them.
+func (p *Profiler) SetDryRun(dryRun *dryrun.DryRun) {
+	p.dryRun = dryRun
+}
+
+// Close stops the profiler, merging what is left.
+func (p *Profiler) Close() error {
+	close(p.stop)
+	<-p.done
+
+	return nil
+}
+
+// Profile reads the profile from the cache, with the mode in effect now.
+func (p *Profiler) Profile(ctx context.Context) (*Profile, error) {
+	profile, err := p.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	profile.Mode = profile.current(time.Now())
+	if profile.Mode == ModeEnforcing {
+		profile.Until = time.Time{}
+	}
+
+	return profile, nil
+}
+
+// SetRoutes replaces the routes of the profile, e.g. after a review. The
+// methods are upper cased and the routes folded like the requests are.
+func (p *Profiler) SetRoutes(ctx context.Context, routes []Route) error {
+	edited := make(shapes)
+	for _, route := range routes {
+		edited.add(shapeKey(strings.ToUpper(strings.TrimSpace(route.Method)), baseline.Route(route.Route)), route.Params)
+	}
+
+	p.mu.Lock()
+	// what this instance learned before the edit is dropped with the rest
+	p.pending = make(shapes)
+	p.mu.Unlock()
+
+	return p.update(ctx, func(profile *Profile) {
+		profile.Routes = edited.routes()
+	})
+}
+
+// SetMode switches the profile to learning for duration, 0 learns until the
+// mode is changed again, or to enforcing.
+func (p *Profiler) SetMode(ctx context.Context, mode string, duration time.Duration) error {
+	if mode != ModeLearning && mode != ModeEnforcing {
+		return fmt.Errorf("unknown mode %q, want %s or %s", mode, ModeLearning, ModeEnforcing)
+	}
+
+	return p.update(ctx, func(profile *Profile) {
+		profile.Mode = mode
+		profile.Until = time.Time{}
+		if mode == ModeLearning && duration > 0 {
+			profile.Until = time.Now().Add(duration)
+		}
+	})
+}
+
+// covered reports whether requestPath is profiled.
+func (p *Profiler) covered(requestPath string) bool {
+	if len(p.options.Paths) == 0 {
+		return true
+	}
+
+	return slices.ContainsFunc(p.options.Paths, func(prefix string) bool {
+		return strings.HasPrefix(requestPath, prefix)
+	})
+}
+
+// learn keeps a shape the snapshot doesn't know yet, until the next merge.
+func (p *Profiler) learn(current *snapshot, method string, route string, params []string) {
+	key := shapeKey(method, route)
+	known, ok := current.shapes[key]
+	if ok && !slices.ContainsFunc(params, func(param string) bool {
+		_, ok := known[param]
+		return !ok
+	}) {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, learned := p.pending[key]; !ok && !learned && len(current.shapes)+len(p.pending) >= p.options.MaxRoutes {
+		if !p.full {
+			p.full = true
+			logger.Logger("[warn] request profile holds ", p.options.MaxRoutes, " routes, new ones are not learned").Warn()
+		}
+		return
+	}
+	if len(known)+len(p.pending[key])+len(params) > p.options.MaxParams {
+		params = params[:max(p.options.MaxParams-len(known)-len(p.pending[key]), 0)]
+	}
+	p.pending.add(key, params)
+}
+
+func (p *Profiler) run() {
+	defer close(p.done)
+
+	ticker := time.NewTicker(p.options.Refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.refresh()
+		case <-p.stop:
+			p.merge()
+			return
+		}
+	}
+}
+
+// refresh merges what was learned and reads the profile back.
+func (p *Profiler) refresh() {
+	p.merge()
+
+	ctx := context.Background()
+	profile, err := p.load(ctx)
+	if err != nil {
+		logger.Logger("[warn] fail to read request profile ", err.Error()).Warn()
+		return
+	}
+	if _, err := p.cache.StateContext(ctx).Touch(p.key, profileTTL); err != nil {
+		logger.Logger("[warn] fail to renew request profile ", err.Error()).Warn()
+	}
+
+	current := &snapshot{mode: profile.Mode, until: profile.Until, shapes: make(shapes)}
+	for _, route := range profile.Routes {
+		current.shapes.add(shapeKey(route.Method, route.Route), route.Params)
+	}
+	p.snapshot.Store(current)
+}
+
+// merge adds the pending shapes to the profile, they are kept for the next
+// merge when it fails.
+func (p *Profiler) merge() {
+	p.mu.Lock()
+	pending := p.pending
+	p.pending = make(shapes)
+	p.mu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	err := p.update(context.Background(), func(profile *Profile) {
+		merged := make(shapes)
+		for _, route := range profile.Routes {
+			merged.add(shapeKey(route.Method, route.Route), route.Params)
+		}
+		for key, params := range pending {
+			merged.add(key, keys(params))
+		}
+		profile.Routes = merged.routes()
+	})
+	if err != nil {
+		logger.Logger("[warn] fail to merge request profile ", err.Error()).Warn()
+		p.mu.Lock()
+		for key, params := range pending {
+			p.pending.add(key, keys(params))
+		}
+		p.mu.Unlock()
+	}
+}
+
+// update changes the profile under the lock shared by the instances, then
+// reloads the snapshot of this one.
+func (p *Profiler) update(ctx context.Context, change func(*Profile)) error {
+	token, err := p.locker.Acquire(ctx, p.key, lockTTL)
+	if err != nil {
+		return err
+	}
+	defer p.locker.Release(p.key, token)
+
+	profile, err := p.load(ctx)
+	if err != nil {
+		return err
+	}
+	change(profile)
+	value, err := json.Marshal(profile)
+	if err != nil {
+		return err
+	}
+	if err := p.cache.StateContext(ctx).Set(p.key, value, profileTTL); err != nil {
+		return err
+	}
+
+	current := &snapshot{mode: profile.Mode, until: profile.Until, shapes: make(shapes)}
+	for _, route := range profile.Routes {
+		current.shapes.add(shapeKey(route.Method, route.Route), route.Params)
+	}
+	p.snapshot.Store(current)
+
+	return nil
+}
+
+// load reads the profile, creating it on the first start. Of instances
+// starting together only one creates it, so learning ends at one time.
+func (p *Profiler) load(ctx context.Context) (*Profile, error) {
+	cache := p.cache.StateContext(ctx)
+	value, ok := cache.Get(p.key)
+	if !ok {
+		profile := &Profile{Mode: ModeLearning}
+		if p.options.Learn > 0 {
+			profile.Until = time.Now().Add(p.options.Learn)
+		}
+		created, err := json.Marshal(profile)
+		if err != nil {
+			return nil, err
+		}
+		stored, err := cache.SetNX(p.key, created, profileTTL)
+		if err != nil {
+			return nil, err
+		}
+		if stored {
+			return profile, nil
+		}
+		if value, ok = cache.Get(p.key); !ok {
+			return nil, errors.New("request profile vanished")
+		}
+	}
+
+	var profile Profile
+	if err := json.Unmarshal(value, &profile); err != nil {
+		return nil, err
+	}
+
+	return &profile, nil
+}
+
+// routes lists the shapes sorted by route and method.
+func (s shapes) routes() []Route {
+	routes := make([]Route, 0, len(s))
+	for key, params := range s {
+		method, route, _ := strings.Cut(key, " ")
+		routes = append(routes, Route{Method: method, Route: route, Params: keys(params)})
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Route != routes[j].Route {
+			return routes[i].Route < routes[j].Route
+		}
+		return routes[i].Method < routes[j].Method
+	})
+
+	return routes
+}
+
+func keys(set map[string]struct{}) []string {
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// paramNames returns the names of the query parameters, each once.
+func paramNames(rawQuery string) []string {
+	values, _ := url.ParseQuery(rawQuery)
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
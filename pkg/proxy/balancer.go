@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"errors"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jahrulnr/go-waf/pkg/breaker"
+)
+
+type Strategy string
+
+const (
+	RoundRobin       Strategy = "round_robin"
+	Random           Strategy = "random"
+	LeastConnections Strategy = "least_connections"
+	ConsistentHash   Strategy = "consistent_hash"
+)
+
+// ErrNoUpstream is returned when no upstream can take the request.
+var ErrNoUpstream = errors.New("no upstream available")
+
+// Balancer picks the upstream for each request. Weights apply to every
+// strategy. Consistent hash sends the requests with the same key, see
+// SetHash, to the same upstream, the ones without a key are round robin.
+type Balancer struct {
+	upstreams []*Upstream
+	strategy  Strategy
+	sticky    *StickyOptions // nil without sticky sessions
+	hash      *HashOptions   // set with the consistent hash strategy
+	ring      *Ring
+
+	mu     sync.Mutex    // guards the round robin state
+	offset atomic.Uint64 // spreads least connections ties
+}
+
+func NewBalancer(upstreams []string, strategy Strategy) (*Balancer, error) {
+	if len(upstreams) == 0 {
+		return nil, errors.New("no upstream configured")
+	}
+
+	switch strategy {
+	case "":
+		strategy = RoundRobin
+	case RoundRobin, Random, LeastConnections, ConsistentHash:
+	default:
+		return nil, errors.New("unknown balancing strategy " + string(strategy))
+	}
+
+	b := &Balancer{strategy: strategy}
+	for _, raw := range upstreams {
+		upstream, err := ParseUpstream(raw)
+		if err != nil {
+			return nil, err
+		}
+		b.upstreams = append(b.upstreams, upstream)
+	}
+	if strategy == ConsistentHash {
+		b.SetHash(HashOptions{})
+	}
+
+	return b, nil
+}
+
+// SetBreaker gives every upstream its own circuit breaker. It must be called
+// before the balancer is used.
+func (b *Balancer) SetBreaker(options breaker.Options) {
+	for _, upstream := range b.upstreams {
+		upstream.breaker = breaker.NewBreaker(upstream.String(), options)
+	}
+}
+
+// Upstreams returns every configured upstream.
+func (b *Balancer) Upstreams() []*Upstream {
+	return b.upstreams
+}
+
+// InFlight returns the current number of requests per upstream.
+func (b *Balancer) InFlight() map[string]int64 {
+	counts := make(map[string]int64, len(b.upstreams))
+	for _, upstream := range b.upstreams {
+		counts[upstream.String()] = upstream.InFlight()
+	}
+
+	return counts
+}
+
+// Healthy returns the upstreams passing their health checks.
+func (b *Balancer) Healthy() []string {
+	var healthy []string
+	for _, upstream := range b.upstreams {
+		if upstream.Healthy() {
+			healthy = append(healthy, upstream.String())
+		}
+	}
+
+	return healthy
+}
+
+// Next returns the upstream for the next request.
+func (b *Balancer) Next() (*Upstream, error) {
+	return b.next(nil)
+}
+
+// next picks an upstream, skipping the ones in exclude, used by retries.
+func (b *Balancer) next(exclude map[*Upstream]bool) (*Upstream, error) {
+	candidates := make([]*Upstream, 0, len(b.upstreams))
+	for _, upstream := range b.upstreams {
+		if upstream.available() && !exclude[upstream] {
+			candidates = append(candidates, upstream)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, ErrNoUpstream
+	}
+
+	switch b.strategy {
+	case Random:
+		return b.random(candidates), nil
+	case LeastConnections:
+		return b.leastConnections(candidates), nil
+	default:
+		return b.roundRobin(candidates), nil
+	}
+}
+
+// roundRobin is nginx's smooth weighted round robin, spreading heavier
+// upstreams evenly instead of in bursts.
+func (b *Balancer) roundRobin(candidates []*Upstream) *Upstream {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var (
+		best  *Upstream
+		total int
+	)
+	for _, upstream := range candidates {
+		upstream.current += upstream.Weight
+		total += upstream.Weight
+		if best == nil || upstream.current > best.current {
+			best = upstream
+		}
+	}
+	best.current -= total
+
+	return best
+}
+
+func (b *Balancer) random(candidates []*Upstream) *Upstream {
+	var total int
+	for _, upstream := range candidates {
+		total += upstream.Weight
+	}
+
+	n := rand.IntN(total)
+	for _, upstream := range candidates {
+		if n < upstream.Weight {
+			return upstream
+		}
+		n -= upstream.Weight
+	}
+
+	return candidates[len(candidates)-1]
+}
+
+// leastConnections picks the lowest in flight count relative to the weight.
+func (b *Balancer) leastConnections(candidates []*Upstream) *Upstream {
+	start := int(b.offset.Add(1) % uint64(len(candidates)))
+
+	var best *Upstream
+	for i := range candidates {
+		upstream := candidates[(start+i)%len(candidates)]
+		if best == nil || upstream.InFlight()*int64(best.Weight) < best.InFlight()*int64(upstream.Weight) {
+			best = upstream
+		}
+	}
+
+	return best
+}
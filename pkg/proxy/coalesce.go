@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"slices"
+	"strings"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// DefaultCoalesceHeaders are the request headers identical requests must
+// share, so no client gets a response meant for other credentials or another
+// representation.
+var DefaultCoalesceHeaders = []string{"Authorization", "Cookie", "Accept", "Accept-Encoding", "Accept-Language"}
+
+// CoalesceOptions configures request coalescing. Zero values take the
+// defaults noted on each field.
+type CoalesceOptions struct {
+	MaxBodySize int      // larger responses are not shared, the waiting requests are sent on their own, default 1MB
+	Headers     []string // request headers part of the identity of a request, default DefaultCoalesceHeaders
+}
+
+// Coalescer sends identical GET and HEAD requests arriving while one is in
+// flight upstream once: the first is forwarded and the others wait and get
+// a copy of its response. Responses that can't be shared, too large,
+// streamed, setting cookies or cut short by the first client going away, are
+// not copied, the waiting requests are then forwarded each on their own.
+// Unlike a cache nothing is kept once the response is written.
+type Coalescer struct {
+	options CoalesceOptions
+	group   singleflight.Group
+}
+
+func NewCoalescer(options CoalesceOptions) *Coalescer {
+	if options.MaxBodySize <= 0 {
+		options.MaxBodySize = 1 << 20
+	}
+	if options.Headers == nil {
+		options.Headers = DefaultCoalesceHeaders
+	}
+
+	return &Coalescer{options: options}
+}
+
+// coalescedResponse is the response the waiting requests are answered with,
+// nil when it can't be shared.
+type coalescedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// Handler coalesces the requests to next.
+func (c *Coalescer) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead ||
+			r.ContentLength > 0 || len(r.TransferEncoding) > 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		first := false
+		value, _, _ := c.group.Do(c.key(r), func() (interface{}, error) {
+			first = true
+			before := w.Header().Clone()
+			recorder := &coalesceRecorder{ResponseWriter: w, status: http.StatusOK, limit: c.options.MaxBodySize}
+			next.ServeHTTP(recorder, r)
+			if recorder.overflow || r.Context().Err() != nil || recorder.Header().Get("Set-Cookie") != "" {
+				return (*coalescedResponse)(nil), nil
+			}
+
+			return &coalescedResponse{
+				status: recorder.status,
+				header: added(before, recorder.Header()),
+				body:   recorder.body.Bytes(),
+			}, nil
+		})
+		if first {
+			return
+		}
+
+		response := value.(*coalescedResponse)
+		if response == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		header := w.Header()
+		for key, values := range response.header {
+			header[key] = values
+		}
+		w.WriteHeader(response.status)
+		if r.Method != http.MethodHead {
+			w.Write(response.body)
+		}
+	})
+}
+
+// added returns the headers of after that were not already set in before,
+// leaving out the ones the middlewares set for the first request only, e.g.
+// its request id.
+func added(before http.Header, after http.Header) http.Header {
+	header := make(http.Header, len(after))
+	for key, values := range after {
+		if previous, ok := before[key]; ok && slices.Equal(previous, values) {
+			continue
+		}
+		header[key] = slices.Clone(values)
+	}
+
+	return header
+}
+
+// key identifies identical requests.
+func (c *Coalescer) key(r *http.Request) string {
+	var key strings.Builder
+	key.WriteString(r.Method + " " + r.Host + r.URL.RequestURI())
+	for _, name := range c.options.Headers {
+		key.WriteString("\n" + name + ":" + strings.Join(r.Header.Values(name), ","))
+	}
+
+	return key.String()
+}
+
+// coalesceRecorder passes the response of the first request to its client
+// while keeping a copy of its body, up to limit bytes.
+type coalesceRecorder struct {
+	http.ResponseWriter
+
+	status   int
+	body     bytes.Buffer
+	limit    int
+	overflow bool
+	wrote    bool
+}
+
+func (r *coalesceRecorder) WriteHeader(status int) {
+	if !r.wrote {
+		r.status = status
+		r.wrote = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *coalesceRecorder) Write(data []byte) (int, error) {
+	r.wrote = true
+	if !r.overflow {
+		if r.body.Len()+len(data) > r.limit {
+			r.overflow = true
+			r.body.Reset()
+		} else {
+			r.body.Write(data)
+		}
+	}
+
+	return r.ResponseWriter.Write(data)
+}
+
+// Flush keeps streaming responses streaming, they are not shared.
+func (r *coalesceRecorder) Flush() {
+	r.overflow = true
+	r.body.Reset()
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *coalesceRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
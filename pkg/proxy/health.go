@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jahrulnr/go-waf/pkg/logger"
+)
+
+// HealthCheckOptions configures active health checks. Zero values take the
+// defaults noted on each field.
+type HealthCheckOptions struct {
+	Path               string            // probed path, default /
+	Interval           time.Duration     // default 10s
+	Timeout            time.Duration     // per probe, default 2s
+	UnhealthyThreshold int               // consecutive failures taking an upstream out, default 3
+	HealthyThreshold   int               // consecutive successes bringing it back, default 2
+	Transport          http.RoundTripper // default http.DefaultTransport
+}
+
+func (o *HealthCheckOptions) setDefaults() {
+	if o.Path == "" {
+		o.Path = "/"
+	}
+	if o.Interval <= 0 {
+		o.Interval = 10 * time.Second
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = 2 * time.Second
+	}
+	if o.UnhealthyThreshold < 1 {
+		o.UnhealthyThreshold = 3
+	}
+	if o.HealthyThreshold < 1 {
+		o.HealthyThreshold = 2
+	}
+	if o.Transport == nil {
+		o.Transport = http.DefaultTransport
+	}
+}
+
+// HealthChecker probes every upstream of a balancer and takes failing ones
+// out of the rotation. Any 2xx or 3xx answer counts as healthy.
+type HealthChecker struct {
+	balancer *Balancer
+	options  HealthCheckOptions
+	client   *http.Client
+
+	// consecutive results, only touched by the checker goroutine
+	failures  map[*Upstream]int
+	successes map[*Upstream]int
+
+	stop    chan struct{}
+	stopped chan struct{} // closed once the checker goroutine returned
+	started atomic.Bool
+	once    sync.Once
+}
+
+func NewHealthChecker(balancer *Balancer, options HealthCheckOptions) *HealthChecker {
+	options.setDefaults()
+
+	return &HealthChecker{
+		balancer: balancer,
+		options:  options,
+		client: &http.Client{
+			Transport: options.Transport,
+			// a redirect already proves the upstream is up
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		failures:  make(map[*Upstream]int),
+		successes: make(map[*Upstream]int),
+		stop:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+}
+
+// Start probes in the background until Stop is called.
+func (h *HealthChecker) Start() {
+	h.started.Store(true)
+	go func() {
+		defer close(h.stopped)
+
+		ticker := time.NewTicker(h.options.Interval)
+		defer ticker.Stop()
+
+		for {
+			h.checkAll()
+
+			select {
+			case <-h.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop ends the checks and waits for the probes running to finish.
+func (h *HealthChecker) Stop() {
+	h.once.Do(func() {
+		close(h.stop)
+	})
+	if h.started.Load() {
+		<-h.stopped
+	}
+}
+
+// Healthy returns the upstreams currently in the rotation.
+func (h *HealthChecker) Healthy() []string {
+	return h.balancer.Healthy()
+}
+
+func (h *HealthChecker) checkAll() {
+	upstreams := h.balancer.Upstreams()
+	results := make([]bool, len(upstreams))
+
+	var wg sync.WaitGroup
+	for i, upstream := range upstreams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = h.probe(upstream)
+		}()
+	}
+	wg.Wait()
+
+	for i, upstream := range upstreams {
+		h.record(upstream, results[i])
+	}
+}
+
+func (h *HealthChecker) probe(upstream *Upstream) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), h.options.Timeout)
+	defer cancel()
+
+	target := *upstream.URL
+	target.Path = strings.TrimSuffix(target.Path, "/") + "/" + strings.TrimPrefix(h.options.Path, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return false
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode >= 200 && resp.StatusCode < 400
+}
+
+func (h *HealthChecker) record(upstream *Upstream, ok bool) {
+	if ok {
+		h.failures[upstream] = 0
+		h.successes[upstream]++
+		if !upstream.healthy.Load() && h.successes[upstream] >= h.options.HealthyThreshold {
+			upstream.healthy.Store(true)
+			logger.Logger("[info] upstream healthy again ", upstream.String()).Info()
+		}
+		return
+	}
+
+	h.successes[upstream] = 0
+	h.failures[upstream]++
+	if upstream.healthy.Load() && h.failures[upstream] >= h.options.UnhealthyThreshold {
+		upstream.healthy.Store(false)
+		logger.Logger("[warn] upstream unhealthy, removed from rotation ", upstream.String()).Warn()
+	}
+}
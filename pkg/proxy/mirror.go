@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jahrulnr/go-waf/pkg/logger"
+)
+
+// MirrorOptions configures traffic mirroring. Zero values take the defaults
+// noted on each field.
+type MirrorOptions struct {
+	Percent     float64           // share of requests mirrored, from 0 to 100, default 100
+	MaxBodySize int64             // requests with larger bodies are not mirrored, default 64KB
+	Timeout     time.Duration     // per mirrored request, default 5s
+	Concurrency int               // mirrored requests in flight, more are dropped, default 100
+	Compare     bool              // log status and size differences with the primary response
+	Transport   http.RoundTripper // default http.DefaultTransport
+}
+
+func (o *MirrorOptions) setDefaults() {
+	if o.Percent <= 0 || o.Percent > 100 {
+		o.Percent = 100
+	}
+	if o.MaxBodySize <= 0 {
+		o.MaxBodySize = 64 << 10
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = 5 * time.Second
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = 100
+	}
+	if o.Transport == nil {
+		o.Transport = http.DefaultTransport
+	}
+}
+
+// Mirror is a http.RoundTripper sending each request to next and a copy of a
+// share of them to a second upstream, e.g. a new backend to compare with the
+// old one before switching. The copy is sent in the background with its own
+// timeout, its response is discarded and its errors are only logged, so the
+// client never waits for it or sees it fail.
+type Mirror struct {
+	next    http.RoundTripper
+	target  *url.URL
+	options MirrorOptions
+	slots   chan struct{}
+}
+
+// NewMirror mirrors the requests sent through next to target.
+func NewMirror(next http.RoundTripper, target string, options MirrorOptions) (*Mirror, error) {
+	upstream, err := ParseUpstream(target)
+	if err != nil {
+		return nil, err
+	}
+	options.setDefaults()
+
+	return &Mirror{
+		next:    next,
+		target:  upstream.URL,
+		options: options,
+		slots:   make(chan struct{}, options.Concurrency),
+	}, nil
+}
+
+// mirrorResult is what a response looked like, status 0 for an error.
+type mirrorResult struct {
+	status int
+	size   int64
+}
+
+func (m *Mirror) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Upgrade") != "" || rand.Float64()*100 >= m.options.Percent {
+		return m.next.RoundTrip(req)
+	}
+
+	body, ok := m.bufferBody(req)
+	if !ok {
+		return m.next.RoundTrip(req)
+	}
+
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		logger.FromContext(req.Context()).Logger("[debug] mirror busy, not mirrored ", req.Method, " ", req.URL.RequestURI()).Debug()
+		return m.next.RoundTrip(req)
+	}
+
+	var primary chan mirrorResult
+	if m.options.Compare {
+		primary = make(chan mirrorResult, 1)
+	}
+	out, cancel := m.request(req, body)
+	go m.send(out, cancel, primary)
+
+	resp, err := m.next.RoundTrip(req)
+	if primary == nil {
+		return resp, err
+	}
+	if err != nil {
+		primary <- mirrorResult{}
+		return resp, err
+	}
+	resp.Body = &countingBody{ReadCloser: resp.Body, done: func(size int64) {
+		primary <- mirrorResult{status: resp.StatusCode, size: size}
+	}}
+
+	return resp, nil
+}
+
+// bufferBody reads the request body so it can be sent twice. It reports
+// false when it is too large to mirror, leaving it as it was.
+func (m *Mirror) bufferBody(req *http.Request) ([]byte, bool) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, m.options.MaxBodySize+1))
+	if err != nil || int64(len(body)) > m.options.MaxBodySize {
+		req.Body = &replayBody{Reader: io.MultiReader(bytes.NewReader(body), req.Body), closer: req.Body}
+		return nil, false
+	}
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	return body, true
+}
+
+// request copies req for the mirror. It outlives the client request, only
+// keeping its values, e.g. the trace.
+func (m *Mirror) request(req *http.Request, body []byte) (*http.Request, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(req.Context()), m.options.Timeout)
+	out := req.Clone(ctx)
+	out.URL.Scheme = m.target.Scheme
+	out.URL.Host = m.target.Host
+	if m.target.Path != "" && m.target.Path != "/" {
+		out.URL.Path = strings.TrimSuffix(m.target.Path, "/") + "/" + strings.TrimPrefix(out.URL.Path, "/")
+		out.URL.RawPath = ""
+	}
+	out.Body = http.NoBody
+	if body != nil {
+		out.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	return out, cancel
+}
+
+// send forwards req to the mirror and, when primary isn't nil, compares the
+// outcome with the primary response.
+func (m *Mirror) send(req *http.Request, cancel context.CancelFunc, primary chan mirrorResult) {
+	defer func() { <-m.slots }()
+	defer cancel()
+
+	var mirrored mirrorResult
+	resp, err := m.options.Transport.RoundTrip(req)
+	if err != nil {
+		logger.FromContext(req.Context()).Logger("[warn] mirror error ", req.Method, " ", req.URL.RequestURI(), " ", err.Error()).Warn()
+	} else {
+		mirrored.status = resp.StatusCode
+		mirrored.size, err = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			logger.FromContext(req.Context()).Logger("[warn] mirror error ", req.Method, " ", req.URL.RequestURI(), " ", err.Error()).Warn()
+		}
+	}
+	if primary == nil {
+		return
+	}
+
+	var original mirrorResult
+	select {
+	case original = <-primary:
+	case <-req.Context().Done():
+		return
+	}
+	if original.status == 0 || mirrored.status == 0 {
+		return
+	}
+	if original.status != mirrored.status || original.size != mirrored.size {
+		logger.FromContext(req.Context()).Logger("[warn] mirror differs ", req.Method, " ", req.URL.RequestURI(),
+			" status ", original.status, "/", mirrored.status, " size ", original.size, "/", mirrored.size).Warn()
+	}
+}
+
+// countingBody reports the bytes read once the body is closed.
+type countingBody struct {
+	io.ReadCloser
+	size int64
+	done func(size int64)
+	once bool
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.size += int64(n)
+	return n, err
+}
+
+func (b *countingBody) Close() error {
+	if !b.once {
+		b.once = true
+		b.done(b.size)
+	}
+
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httputil"
+
+	"github.com/jahrulnr/go-waf/pkg/breaker"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+	"github.com/jahrulnr/go-waf/pkg/metrics"
+)
+
+// Proxy is a load balancing reverse proxy. Hop-by-hop headers are stripped
+// and X-Forwarded-For, X-Forwarded-Host and X-Forwarded-Proto are set.
+type Proxy struct {
+	balancer  *Balancer
+	transport *Transport
+	proxy     *httputil.ReverseProxy
+	checker   *HealthChecker
+	websocket *WebSocketProxy
+}
+
+func NewProxy(upstreams []string, strategy Strategy) (*Proxy, error) {
+	balancer, err := NewBalancer(upstreams, strategy)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Proxy{
+		balancer:  balancer,
+		transport: NewTransport(balancer, nil),
+		websocket: NewWebSocketProxy(balancer, WebSocketOptions{}),
+	}
+	p.proxy = &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			// keep the chain of proxies in front of us
+			r.Out.Header["X-Forwarded-For"] = r.In.Header["X-Forwarded-For"]
+			r.SetXForwarded()
+			// the transport picks the host, the upstream receives its own name
+			r.Out.Host = ""
+		},
+		Transport:    p.transport,
+		ErrorHandler: p.errorHandler,
+	}
+
+	return p, nil
+}
+
+// Balancer returns the balancer, e.g. for its in flight counts.
+func (p *Proxy) Balancer() *Balancer {
+	return p.balancer
+}
+
+// SetBreaker puts a circuit breaker in front of every upstream. It must be
+// called before the proxy serves requests.
+func (p *Proxy) SetBreaker(options breaker.Options) {
+	p.balancer.SetBreaker(options)
+}
+
+// SetRetry retries failed idempotent requests, see Transport.SetRetry.
+func (p *Proxy) SetRetry(options RetryOptions) {
+	p.transport.SetRetry(options)
+}
+
+// SetMetrics records every upstream request, see Transport.SetMetrics.
+func (p *Proxy) SetMetrics(recorder metrics.UpstreamRecorder) {
+	p.transport.SetMetrics(recorder)
+}
+
+// SetWebSocket replaces the WebSocket timeouts. It must be called before the
+// proxy serves requests.
+func (p *Proxy) SetWebSocket(options WebSocketOptions) {
+	p.websocket = NewWebSocketProxy(p.balancer, options)
+}
+
+// SetHealthCheck starts active health checks, replacing running ones.
+func (p *Proxy) SetHealthCheck(options HealthCheckOptions) {
+	if p.checker != nil {
+		p.checker.Stop()
+	}
+
+	p.checker = NewHealthChecker(p.balancer, options)
+	p.checker.Start()
+}
+
+// Healthy returns the upstreams currently in the rotation.
+func (p *Proxy) Healthy() []string {
+	return p.balancer.Healthy()
+}
+
+// Close stops the health checks.
+func (p *Proxy) Close() {
+	if p.checker != nil {
+		p.checker.Stop()
+	}
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if IsWebSocket(r) {
+		p.websocket.ServeHTTP(w, r)
+		return
+	}
+
+	p.proxy.ServeHTTP(w, r)
+}
+
+func (p *Proxy) errorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	logger.FromContext(r.Context()).Logger("[warn] proxy error ", r.Method, " ", r.URL.RequestURI(), " ", err.Error()).Warn()
+
+	w.WriteHeader(ErrorStatus(err))
+}
+
+// ErrorStatus returns the status answering a failed upstream request: 503
+// when no upstream could be tried, 413 when the request body went over its
+// limit while being sent, 502 otherwise.
+func ErrorStatus(err error) int {
+	if errors.Is(err, ErrNoUpstream) || errors.Is(err, breaker.ErrCircuitOpen) {
+		return http.StatusServiceUnavailable
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+
+	return http.StatusBadGateway
+}
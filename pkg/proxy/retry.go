@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// RetryOptions configures retries of failed upstream requests. Zero values
+// take the defaults noted on each field.
+type RetryOptions struct {
+	MaxAttempts int           // attempts including the first one, 1 disables retries
+	BaseDelay   time.Duration // first backoff, doubled on each retry, default 50ms
+	MaxDelay    time.Duration // backoff cap, default 1s
+	Methods     []string      // retried methods, default the idempotent ones
+	Statuses    []int         // retried statuses, default 502, 503 and 504
+	MaxBodySize int64         // request bodies up to this size are buffered for a retry, default 64KB
+}
+
+func (o *RetryOptions) setDefaults() {
+	if o.MaxAttempts < 1 {
+		o.MaxAttempts = 1
+	}
+	if o.BaseDelay <= 0 {
+		o.BaseDelay = 50 * time.Millisecond
+	}
+	if o.MaxDelay <= 0 {
+		o.MaxDelay = time.Second
+	}
+	if len(o.Methods) == 0 {
+		o.Methods = []string{http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete}
+	}
+	if len(o.Statuses) == 0 {
+		o.Statuses = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	}
+	if o.MaxBodySize <= 0 {
+		o.MaxBodySize = 64 << 10
+	}
+}
+
+// SetRetry enables retries. A retry goes to another upstream when there is
+// one, and stops once the request context is done or its deadline would pass
+// during the backoff.
+func (t *Transport) SetRetry(options RetryOptions) {
+	options.setDefaults()
+	t.retry = &options
+}
+
+func (t *Transport) roundTripWithRetry(req *http.Request, key string) (*http.Response, error) {
+	body, replayable := t.bufferBody(req)
+	if !replayable {
+		return t.roundTripOnce(req, key)
+	}
+
+	tried := make(map[*Upstream]bool)
+	for attempt := 1; ; attempt++ {
+		upstream, err := t.balancer.nextFor(req, key, tried)
+		if errors.Is(err, ErrNoUpstream) && len(tried) > 0 {
+			// every upstream was tried once, go around again
+			clear(tried)
+			upstream, err = t.balancer.nextFor(req, key, nil)
+		}
+		if err != nil {
+			return nil, err
+		}
+		tried[upstream] = true
+
+		if body != nil {
+			req.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		resp, err := t.send(upstream, req)
+		if attempt >= t.retry.MaxAttempts || !t.retryable(resp, err) || req.Context().Err() != nil {
+			return resp, err
+		}
+
+		delay := t.backoff(attempt)
+		if deadline, ok := req.Context().Deadline(); ok && time.Until(deadline) < delay {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+			resp.Body.Close()
+		}
+
+		if err := sleep(req.Context(), delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// bufferBody reads a small request body into memory so it can be sent more
+// than once. It reports false when the request must not be retried.
+func (t *Transport) bufferBody(req *http.Request) ([]byte, bool) {
+	if !slices.Contains(t.retry.Methods, req.Method) {
+		return nil, false
+	}
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, t.retry.MaxBodySize+1))
+	if err != nil || int64(len(body)) > t.retry.MaxBodySize {
+		// too big to keep around, send it once as it is
+		req.Body = &replayBody{Reader: io.MultiReader(bytes.NewReader(body), req.Body), closer: req.Body}
+		return nil, false
+	}
+	req.Body.Close()
+
+	return body, true
+}
+
+func (t *Transport) retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+
+	return slices.Contains(t.retry.Statuses, resp.StatusCode)
+}
+
+// backoff is exponential with full jitter.
+func (t *Transport) backoff(attempt int) time.Duration {
+	delay := t.retry.BaseDelay << (attempt - 1)
+	if delay <= 0 || delay > t.retry.MaxDelay {
+		delay = t.retry.MaxDelay
+	}
+
+	return rand.N(delay) + 1
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+type replayBody struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (b *replayBody) Close() error {
+	return b.closer.Close()
+}
@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"errors"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// HashOptions configures the consistent hash strategy. Zero values take the
+// defaults noted on each field.
+type HashOptions struct {
+	Key      string // path, header:<name> or query:<name>, default path
+	Replicas int    // virtual nodes per unit of weight, default 160
+}
+
+func (o *HashOptions) setDefaults() {
+	if o.Key == "" {
+		o.Key = "path"
+	}
+	if o.Replicas <= 0 {
+		o.Replicas = 160
+	}
+}
+
+// ParseHashKey checks a HashOptions.Key.
+func ParseHashKey(key string) error {
+	source, name, _ := strings.Cut(key, ":")
+	switch source {
+	case "path":
+		if name == "" {
+			return nil
+		}
+	case "header", "query":
+		if name != "" {
+			return nil
+		}
+	}
+
+	return errors.New("hash key " + strconv.Quote(key) + " must be path, header:<name> or query:<name>")
+}
+
+// hashKey reads the attribute of req named by key, empty when it is missing.
+func hashKey(req *http.Request, key string) string {
+	source, name, _ := strings.Cut(key, ":")
+	switch source {
+	case "header":
+		return req.Header.Get(name)
+	case "query":
+		return req.URL.Query().Get(name)
+	default:
+		return req.URL.Path
+	}
+}
+
+// Ring is a consistent hash ring. Every upstream owns Replicas virtual nodes
+// per unit of weight, placed by hashing its URL, so the keys spread evenly
+// and adding or removing an upstream only moves the keys it gains or loses.
+type Ring struct {
+	points []ringPoint // sorted by hash
+}
+
+type ringPoint struct {
+	hash     uint64
+	upstream *Upstream
+}
+
+// NewRing places replicas virtual nodes per unit of weight of each upstream.
+func NewRing(upstreams []*Upstream, replicas int) *Ring {
+	if replicas <= 0 {
+		replicas = 160
+	}
+
+	r := &Ring{}
+	for _, upstream := range upstreams {
+		for i := 0; i < replicas*upstream.Weight; i++ {
+			r.points = append(r.points, ringPoint{
+				hash:     ringHash(upstream.String() + "#" + strconv.Itoa(i)),
+				upstream: upstream,
+			})
+		}
+	}
+	slices.SortFunc(r.points, func(a, b ringPoint) int {
+		switch {
+		case a.hash < b.hash:
+			return -1
+		case a.hash > b.hash:
+			return 1
+		}
+		return strings.Compare(a.upstream.String(), b.upstream.String())
+	})
+
+	return r
+}
+
+// Lookup returns the upstream owning key, whether it is available or not.
+func (r *Ring) Lookup(key string) *Upstream {
+	if len(r.points) == 0 {
+		return nil
+	}
+
+	return r.points[r.search(ringHash(key))].upstream
+}
+
+// Shares returns the fraction of the ring, and so of the keys, each upstream
+// owns.
+func (r *Ring) Shares() map[string]float64 {
+	shares := make(map[string]float64)
+	for i, point := range r.points {
+		// a point owns the arc from the previous point up to it
+		previous := r.points[(i+len(r.points)-1)%len(r.points)].hash
+		shares[point.upstream.String()] += float64(point.hash-previous) / math.MaxUint64
+	}
+	if len(r.points) == 1 {
+		shares[r.points[0].upstream.String()] = 1
+	}
+
+	return shares
+}
+
+// next returns the owner of key, or walking clockwise the first upstream
+// after it that is available and not in exclude.
+func (r *Ring) next(key string, exclude map[*Upstream]bool) (*Upstream, error) {
+	if len(r.points) == 0 {
+		return nil, ErrNoUpstream
+	}
+
+	start := r.search(ringHash(key))
+	seen := make(map[*Upstream]bool)
+	for i := range r.points {
+		upstream := r.points[(start+i)%len(r.points)].upstream
+		if seen[upstream] {
+			continue
+		}
+		if upstream.available() && !exclude[upstream] {
+			return upstream, nil
+		}
+		seen[upstream] = true
+	}
+
+	return nil, ErrNoUpstream
+}
+
+// search returns the index of the first point at or after hash.
+func (r *Ring) search(hash uint64) int {
+	i, _ := slices.BinarySearchFunc(r.points, hash, func(point ringPoint, hash uint64) int {
+		switch {
+		case point.hash < hash:
+			return -1
+		case point.hash > hash:
+			return 1
+		}
+		return 0
+	})
+	if i == len(r.points) {
+		return 0
+	}
+
+	return i
+}
+
+func ringHash(value string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(value))
+
+	return mix(hash.Sum64())
+}
+
+// SetHash configures the consistent hash strategy, it must be called before
+// the balancer is used.
+func (b *Balancer) SetHash(options HashOptions) {
+	options.setDefaults()
+	b.hash = &options
+	b.ring = NewRing(b.upstreams, options.Replicas)
+}
+
+// Ring returns the hash ring of the consistent hash strategy, nil for the
+// other strategies.
+func (b *Balancer) Ring() *Ring {
+	return b.ring
+}
@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"hash/fnv"
+	"math"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/jahrulnr/go-waf/internal/interface/repository"
+	"github.com/jahrulnr/go-waf/pkg/clientip"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+)
+
+// Affinity keys of sticky sessions.
+const (
+	AffinityCookie = "cookie"
+	AffinityIP     = "ip"
+)
+
+// StickyOptions configures sticky sessions. Zero values take the defaults
+// noted on each field.
+type StickyOptions struct {
+	Key     string                    // cookie or ip, default cookie
+	Cookie  string                    // default gowaf_upstream
+	TTL     time.Duration             // lifetime of the cookie and the stored mapping, default 1h
+	Secure  bool                      // https only cookie
+	Trusted []net.IPNet               // proxies trusted to forward the client IP, for the ip key
+	Cache   repository.CacheInterface // keeps the mappings, nil relies on hashing alone
+}
+
+func (o *StickyOptions) setDefaults() {
+	if o.Key != AffinityIP {
+		o.Key = AffinityCookie
+	}
+	if o.Cookie == "" {
+		o.Cookie = "gowaf_upstream"
+	}
+	if o.TTL <= 0 {
+		o.TTL = time.Hour
+	}
+}
+
+// SetSticky routes every client to the same upstream. The client is known by
+// a cookie the proxy sets, or by its IP, and mapped to an upstream by
+// weighted rendezvous hashing, so while the upstreams stay up every instance
+// agrees without sharing anything, and when one goes down only its clients
+// move. With a cache the mapping is kept for TTL, a moved client then stays
+// where it went instead of returning once its upstream recovers. It must be
+// called before the balancer is used.
+func (b *Balancer) SetSticky(options StickyOptions) {
+	options.setDefaults()
+	b.sticky = &options
+}
+
+// affinity returns the affinity key of req, empty without sticky sessions.
+// A new cookie is returned for clients that don't have one yet, to be set on
+// the response.
+func (b *Balancer) affinity(req *http.Request) (string, *http.Cookie) {
+	if b.sticky == nil {
+		return "", nil
+	}
+
+	if b.sticky.Key == AffinityIP {
+		if ip := clientip.RealIP(req, b.sticky.Trusted); ip != nil {
+			return ip.String(), nil
+		}
+		return "", nil
+	}
+
+	if cookie, err := req.Cookie(b.sticky.Cookie); err == nil && validAffinity(cookie.Value) {
+		return cookie.Value, nil
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil
+	}
+	key := hex.EncodeToString(id)
+
+	return key, &http.Cookie{
+		Name:     b.sticky.Cookie,
+		Value:    key,
+		Path:     "/",
+		MaxAge:   int(b.sticky.TTL.Seconds()),
+		Secure:   b.sticky.Secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// validAffinity accepts the cookies the proxy issues, 32 hex characters.
+func validAffinity(value string) bool {
+	if len(value) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(value)
+
+	return err == nil
+}
+
+// nextFor picks the upstream of req with the affinity key, skipping the ones
+// in exclude. Without a key req is balanced by the strategy.
+func (b *Balancer) nextFor(req *http.Request, key string, exclude map[*Upstream]bool) (*Upstream, error) {
+	if key == "" {
+		if b.strategy == ConsistentHash {
+			if hash := hashKey(req, b.hash.Key); hash != "" {
+				return b.ring.next(hash, exclude)
+			}
+		}
+		return b.next(exclude)
+	}
+
+	candidates := make([]*Upstream, 0, len(b.upstreams))
+	for _, upstream := range b.upstreams {
+		if upstream.available() && !exclude[upstream] {
+			candidates = append(candidates, upstream)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, ErrNoUpstream
+	}
+
+	var cache repository.CacheInterface
+	if b.sticky.Cache != nil {
+		cache = b.sticky.Cache.WithContext(req.Context())
+		if mapped, found := cache.Get("gowaf-sticky-" + key); found {
+			for _, upstream := range candidates {
+				if upstream.String() == string(mapped) {
+					return upstream, nil
+				}
+			}
+		}
+	}
+
+	upstream := rendezvous(key, candidates)
+	if cache != nil {
+		if err := cache.Set("gowaf-sticky-"+key, []byte(upstream.String()), b.sticky.TTL); err != nil {
+			logger.FromContext(req.Context()).Logger("[warn] fail to store sticky session ", upstream.String(), err.Error()).Warn()
+		}
+	}
+
+	return upstream, nil
+}
+
+// rendezvous returns the candidate with the highest weighted score for key.
+func rendezvous(key string, candidates []*Upstream) *Upstream {
+	var (
+		best      *Upstream
+		bestScore float64
+	)
+	for _, upstream := range candidates {
+		hash := fnv.New64a()
+		hash.Write([]byte(key))
+		hash.Write([]byte{0})
+		hash.Write([]byte(upstream.String()))
+		// a uniform value in (0, 1), weighted as in logarithmic HRW
+		uniform := (float64(mix(hash.Sum64())>>11) + 0.5) / (1 << 53)
+		score := -float64(upstream.Weight) / math.Log(uniform)
+		if best == nil || score > bestScore {
+			best, bestScore = upstream, score
+		}
+	}
+
+	return best
+}
+
+// mix is the splitmix64 finalizer, fnv alone barely changes the high bits
+// for upstreams differing in their last bytes.
+func mix(h uint64) uint64 {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+
+	return h
+}
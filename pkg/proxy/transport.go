@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jahrulnr/go-waf/pkg/breaker"
+	"github.com/jahrulnr/go-waf/pkg/metrics"
+	"github.com/jahrulnr/go-waf/pkg/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Transport is a http.RoundTripper sending each request to the upstream
+// chosen by the balancer. The request URL only needs the path and query, its
+// scheme and host are replaced.
+type Transport struct {
+	balancer *Balancer
+	base     http.RoundTripper
+	retry    *RetryOptions // nil when retries are off
+	metrics  metrics.UpstreamRecorder
+}
+
+// NewTransport balances over base, http.DefaultTransport when nil.
+func NewTransport(balancer *Balancer, base http.RoundTripper) *Transport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	return &Transport{
+		balancer: balancer,
+		base:     base,
+		metrics:  metrics.NoopRecorder{},
+	}
+}
+
+// SetMetrics records the status and latency of every upstream request,
+// retries included.
+func (t *Transport) SetMetrics(recorder metrics.UpstreamRecorder) {
+	t.metrics = recorder
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key, cookie := t.balancer.affinity(req)
+
+	var (
+		resp *http.Response
+		err  error
+	)
+	if t.retry != nil && t.retry.MaxAttempts > 1 {
+		resp, err = t.roundTripWithRetry(req, key)
+	} else {
+		resp, err = t.roundTripOnce(req, key)
+	}
+	if err == nil && cookie != nil {
+		resp.Header.Add("Set-Cookie", cookie.String())
+	}
+
+	return resp, err
+}
+
+// roundTripOnce sends req to a single upstream, the one of the affinity key
+// when it isn't empty.
+func (t *Transport) roundTripOnce(req *http.Request, key string) (*http.Response, error) {
+	upstream, err := t.balancer.nextFor(req, key, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.send(upstream, req)
+}
+
+// send forwards req to upstream. The request counts as in flight until the
+// response body is closed.
+func (t *Transport) send(upstream *Upstream, req *http.Request) (*http.Response, error) {
+	out := req.Clone(req.Context())
+	out.URL.Scheme = upstream.URL.Scheme
+	out.URL.Host = upstream.URL.Host
+	if upstream.URL.Path != "" && upstream.URL.Path != "/" {
+		out.URL.Path = strings.TrimSuffix(upstream.URL.Path, "/") + "/" + strings.TrimPrefix(out.URL.Path, "/")
+		out.URL.RawPath = ""
+	}
+
+	if upstream.breaker != nil && !upstream.breaker.Allow() {
+		return nil, breaker.ErrCircuitOpen
+	}
+
+	ctx, span := tracing.Tracer().Start(req.Context(), "proxy.upstream",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("proxy.upstream", upstream.String())),
+	)
+	defer span.End()
+	out = out.WithContext(ctx)
+	tracing.Inject(ctx, out.Header)
+
+	upstream.inflight.Add(1)
+	start := time.Now()
+	resp, err := t.base.RoundTrip(out)
+	if err != nil {
+		t.metrics.RecordUpstream(upstream.String(), 0, time.Since(start))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else {
+		t.metrics.RecordUpstream(upstream.String(), resp.StatusCode, time.Since(start))
+		span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	}
+	if upstream.breaker != nil {
+		// a client hanging up says nothing about the upstream
+		if req.Context().Err() != nil {
+			upstream.breaker.Cancel()
+		} else {
+			upstream.breaker.Record(err == nil && resp.StatusCode < http.StatusInternalServerError)
+		}
+	}
+	if err != nil {
+		upstream.inflight.Add(-1)
+		return nil, err
+	}
+
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: func() {
+		upstream.inflight.Add(-1)
+	}}
+
+	return resp, nil
+}
+
+type releaseBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (b *releaseBody) Close() error {
+	b.once.Do(b.release)
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/jahrulnr/go-waf/pkg/breaker"
+)
+
+// Upstream is one backend the proxy forwards to.
+type Upstream struct {
+	URL    *url.URL
+	Weight int
+
+	inflight atomic.Int64
+	healthy  atomic.Bool
+	breaker  *breaker.Breaker // nil when the balancer has no breakers
+	current  int              // smooth weighted round robin state, guarded by the balancer
+}
+
+// ParseUpstream parses "scheme://host[:port][/path]" with an optional
+// "|weight" suffix, weight defaults to 1.
+func ParseUpstream(raw string) (*Upstream, error) {
+	raw = strings.TrimSpace(raw)
+	weight := 1
+	if address, w, ok := strings.Cut(raw, "|"); ok {
+		n, err := strconv.Atoi(strings.TrimSpace(w))
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid weight for upstream %q", raw)
+		}
+		raw, weight = strings.TrimSpace(address), n
+	}
+
+	target, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if target.Scheme != "http" && target.Scheme != "https" || target.Host == "" {
+		return nil, fmt.Errorf("upstream %q must be an absolute http(s) url", raw)
+	}
+
+	upstream := &Upstream{URL: target, Weight: weight}
+	upstream.healthy.Store(true)
+
+	return upstream, nil
+}
+
+// InFlight returns the number of requests currently sent to the upstream.
+func (u *Upstream) InFlight() int64 {
+	return u.inflight.Load()
+}
+
+// Healthy reports whether the last health checks passed. Upstreams start
+// healthy.
+func (u *Upstream) Healthy() bool {
+	return u.healthy.Load()
+}
+
+func (u *Upstream) String() string {
+	return u.URL.String()
+}
+
+// available reports whether the upstream may receive traffic.
+func (u *Upstream) available() bool {
+	return u.Healthy() && (u.breaker == nil || u.breaker.Ready())
+}
+
+// Breaker returns the circuit breaker of the upstream, nil if there is none.
+func (u *Upstream) Breaker() *breaker.Breaker {
+	return u.breaker
+}
@@ -0,0 +1,280 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jahrulnr/go-waf/pkg/breaker"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+)
+
+// WebSocketOptions configures WebSocket proxying. Zero values take the
+// defaults noted on each field.
+type WebSocketOptions struct {
+	HandshakeTimeout time.Duration // dial and upgrade, default 10s
+	IdleTimeout      time.Duration // closes a connection without traffic, default 5m
+	TLSConfig        *tls.Config   // for wss upstreams
+	PreserveHost     bool          // send the client's Host instead of the upstream's
+}
+
+func (o *WebSocketOptions) setDefaults() {
+	if o.HandshakeTimeout <= 0 {
+		o.HandshakeTimeout = 10 * time.Second
+	}
+	if o.IdleTimeout <= 0 {
+		o.IdleTimeout = 5 * time.Minute
+	}
+}
+
+// IsWebSocket reports whether r asks for a WebSocket upgrade.
+func IsWebSocket(r *http.Request) bool {
+	return headerHasToken(r.Header, "Connection", "upgrade") &&
+		strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// WebSocketProxy hijacks upgrade requests, completes the handshake with an
+// upstream and then copies frames both ways until one side closes.
+type WebSocketProxy struct {
+	balancer *Balancer
+	options  WebSocketOptions
+}
+
+func NewWebSocketProxy(balancer *Balancer, options WebSocketOptions) *WebSocketProxy {
+	options.setDefaults()
+
+	return &WebSocketProxy{
+		balancer: balancer,
+		options:  options,
+	}
+}
+
+func (p *WebSocketProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// the handshake response can't set a cookie, new clients are balanced
+	key, cookie := p.balancer.affinity(r)
+	if cookie != nil {
+		key = ""
+	}
+	upstream, err := p.balancer.nextFor(r, key, nil)
+	if err == nil && upstream.breaker != nil && !upstream.breaker.Allow() {
+		err = breaker.ErrCircuitOpen
+	}
+	if err != nil {
+		p.fail(w, r, err)
+		return
+	}
+
+	upstreamConn, resp, err := p.handshake(r, upstream)
+	if upstream.breaker != nil {
+		upstream.breaker.Record(err == nil && resp.StatusCode < http.StatusInternalServerError)
+	}
+	if err != nil {
+		p.fail(w, r, err)
+		return
+	}
+	defer upstreamConn.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// the upstream refused the upgrade, pass its answer on
+		defer resp.Body.Close()
+		copyHeader(w.Header(), resp.Header)
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		p.fail(w, r, fmt.Errorf("response writer can't be hijacked"))
+		return
+	}
+	clientConn, clientBuf, err := hijacker.Hijack()
+	if err != nil {
+		logger.FromContext(r.Context()).Logger("[warn] websocket hijack failed ", err.Error()).Warn()
+		return
+	}
+	defer clientConn.Close()
+
+	if _, err := fmt.Fprintf(clientBuf, "HTTP/1.1 101 %s\r\n", http.StatusText(http.StatusSwitchingProtocols)); err != nil {
+		return
+	}
+	if err := resp.Header.Write(clientBuf); err != nil {
+		return
+	}
+	if _, err := clientBuf.WriteString("\r\n"); err != nil {
+		return
+	}
+	if err := clientBuf.Flush(); err != nil {
+		return
+	}
+
+	upstream.inflight.Add(1)
+	defer upstream.inflight.Add(-1)
+
+	p.pipe(clientConn, clientBuf.Reader, upstreamConn)
+}
+
+// handshake dials upstream and sends the upgrade request. The returned
+// connection keeps the bytes read past the response.
+func (p *WebSocketProxy) handshake(r *http.Request, upstream *Upstream) (*bufferedConn, *http.Response, error) {
+	ctx, cancel := context.WithTimeout(r.Context(), p.options.HandshakeTimeout)
+	defer cancel()
+
+	conn, err := p.dial(ctx, upstream)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	out := r.Clone(ctx)
+	out.URL.Scheme = upstream.URL.Scheme
+	out.URL.Host = upstream.URL.Host
+	if upstream.URL.Path != "" && upstream.URL.Path != "/" {
+		out.URL.Path = strings.TrimSuffix(upstream.URL.Path, "/") + "/" + strings.TrimPrefix(out.URL.Path, "/")
+		out.URL.RawPath = ""
+	}
+	if !p.options.PreserveHost {
+		out.Host = upstream.URL.Host
+	}
+	removeHopHeaders(out.Header)
+	out.Header.Set("Connection", "Upgrade")
+	out.Header.Set("Upgrade", r.Header.Get("Upgrade"))
+	if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := r.Header.Get("X-Forwarded-For"); prior != "" {
+			clientIP = prior + ", " + clientIP
+		}
+		out.Header.Set("X-Forwarded-For", clientIP)
+	}
+
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	if err := out.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, out)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return &bufferedConn{Conn: conn, reader: reader}, resp, nil
+}
+
+func (p *WebSocketProxy) dial(ctx context.Context, upstream *Upstream) (net.Conn, error) {
+	address := upstream.URL.Host
+	if upstream.URL.Port() == "" {
+		if upstream.URL.Scheme == "https" {
+			address += ":443"
+		} else {
+			address += ":80"
+		}
+	}
+
+	if upstream.URL.Scheme == "https" {
+		config := p.options.TLSConfig.Clone()
+		if config == nil {
+			config = &tls.Config{}
+		}
+		if config.ServerName == "" {
+			config.ServerName = upstream.URL.Hostname()
+		}
+		// websockets need http/1.1, never negotiate h2
+		config.NextProtos = []string{"http/1.1"}
+
+		dialer := &tls.Dialer{Config: config}
+		return dialer.DialContext(ctx, "tcp", address)
+	}
+
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", address)
+}
+
+// pipe copies both ways until either side closes or stays idle too long.
+func (p *WebSocketProxy) pipe(client net.Conn, clientReader io.Reader, upstream *bufferedConn) {
+	done := make(chan struct{}, 2)
+	copyConn := func(dst net.Conn, src net.Conn, reader io.Reader) {
+		defer func() { done <- struct{}{} }()
+
+		buf := make([]byte, 32<<10)
+		for {
+			src.SetReadDeadline(time.Now().Add(p.options.IdleTimeout))
+			n, err := reader.Read(buf)
+			if n > 0 {
+				dst.SetWriteDeadline(time.Now().Add(p.options.IdleTimeout))
+				if _, werr := dst.Write(buf[:n]); werr != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	go copyConn(upstream, client, clientReader)
+	go copyConn(client, upstream.Conn, upstream.reader)
+
+	// one side is gone, closing both stops the other copy
+	<-done
+	client.Close()
+	upstream.Close()
+	<-done
+}
+
+func (p *WebSocketProxy) fail(w http.ResponseWriter, r *http.Request, err error) {
+	logger.FromContext(r.Context()).Logger("[warn] websocket proxy error ", r.URL.RequestURI(), " ", err.Error()).Warn()
+	w.WriteHeader(ErrorStatus(err))
+}
+
+// bufferedConn is an upstream connection whose first bytes may already sit in
+// the reader used for the handshake response.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// hopHeaders are the hop-by-hop headers of RFC 7230, section 6.1.
+var hopHeaders = []string{
+	"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate",
+	"Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+func removeHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			header.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+func headerHasToken(header http.Header, name string, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func copyHeader(dst, src http.Header) {
+	for key, values := range src {
+		for _, value := range values {
+			dst.Add(key, value)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package ratelimit
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jahrulnr/go-waf/internal/interface/repository"
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+)
+
+// fixedWindowScript counts the request if the window has room, starting the
+// window with the first one. The reply is {allowed, count, milliseconds
+// until the window resets}.
+const fixedWindowScript = `
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+
+local count = tonumber(redis.call("GET", KEYS[1]) or "0") or 0
+local allowed = 0
+if count < limit then
+	count = redis.call("INCR", KEYS[1])
+	allowed = 1
+end
+
+local ttl = redis.call("PTTL", KEYS[1])
+if ttl < 0 then
+	redis.call("PEXPIRE", KEYS[1], window)
+	ttl = window
+end
+
+return {allowed, count, ttl}
+`
+
+// fixedWindowPeekScript reads the count and the time left without counting a
+// request. The reply is {count, milliseconds until the window resets}.
+const fixedWindowPeekScript = `
+local count = tonumber(redis.call("GET", KEYS[1]) or "0") or 0
+return {count, math.max(redis.call("PTTL", KEYS[1]), 0)}
+`
+
+type FixedWindow struct {
+	cache  repository.StateStore
+	prefix string
+
+	window   time.Duration
+	limit    int
+	failOpen bool
+
+	mu sync.Mutex // guards the non-scripted fallback
+}
+
+// NewFixedWindow creates a limiter allowing limit requests per window, the
+// window starting with the first request of a key. It is the cheapest of the
+// limiters, one counter per key, but a client can spend two quotas around
+// the end of a window, see NewSlidingWindow.
+func NewFixedWindow(cache repository.StateStore, window time.Duration, limit int) *FixedWindow {
+	if limit < 1 {
+		limit = 1
+	}
+
+	return &FixedWindow{
+		cache:    cache,
+		prefix:   "gowaf-fw-",
+		window:   window,
+		limit:    limit,
+		failOpen: true,
+	}
+}
+
+// SetFailOpen chooses whether requests are allowed (true, the default) or
+// denied when the cache can't be reached.
+func (w *FixedWindow) SetFailOpen(failOpen bool) {
+	w.failOpen = failOpen
+}
+
+// Allow counts a request for key and reports whether it is permitted, along
+// with the number of requests counted in the current window.
+func (w *FixedWindow) Allow(key string) (bool, int) {
+	allowed, count, _, err := w.take(w.prefix + key)
+	if err != nil {
+		logger.Logger("[warn] fixed window unavailable, fail open: ", w.failOpen, err.Error()).Warn()
+		return w.failOpen, 0
+	}
+
+	return allowed, count
+}
+
+func (w *FixedWindow) Take(key string) service.RateLimitResult {
+	allowed, count, reset, err := w.take(w.prefix + key)
+	if err != nil {
+		logger.Logger("[warn] fixed window unavailable, fail open: ", w.failOpen, err.Error()).Warn()
+		return service.RateLimitResult{
+			Allowed: w.failOpen,
+			Limit:   w.limit,
+		}
+	}
+
+	return w.result(allowed, count, reset)
+}
+
+// Peek returns the state of key's window without counting a request,
+// Allowed telling whether the next request would be.
+func (w *FixedWindow) Peek(key string) (service.RateLimitResult, error) {
+	count, reset, err := w.peek(w.prefix + key)
+	if err != nil {
+		return service.RateLimitResult{}, err
+	}
+
+	return w.result(count < w.limit, count, reset), nil
+}
+
+func (w *FixedWindow) result(allowed bool, count int, reset time.Duration) service.RateLimitResult {
+	result := service.RateLimitResult{
+		Allowed:   allowed,
+		Limit:     w.limit,
+		Remaining: max(w.limit-count, 0),
+		Reset:     reset,
+	}
+	if !allowed {
+		result.RetryAfter = reset
+	}
+
+	return result
+}
+
+func (w *FixedWindow) take(key string) (bool, int, time.Duration, error) {
+	if scripter, ok := w.cache.(repository.ScriptInterface); ok {
+		reply, err := scripter.Eval(fixedWindowScript, []string{key}, w.limit, w.window.Milliseconds())
+		if err != nil {
+			return false, 0, 0, err
+		}
+
+		values, ok := reply.([]interface{})
+		if !ok || len(values) != 3 {
+			return false, 0, 0, fmt.Errorf("unexpected fixed window reply %v", reply)
+		}
+		allowed, _ := values[0].(int64)
+		count, _ := values[1].(int64)
+		ttl, _ := values[2].(int64)
+
+		return allowed == 1, int(count), time.Duration(ttl) * time.Millisecond, nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	count, reset := w.count(key)
+	if count >= w.limit {
+		return false, count, reset, nil
+	}
+
+	// the ttl only applies to a new counter, which starts the window
+	n, err := w.cache.Increment(key, 1, w.window)
+	if err != nil {
+		return false, 0, 0, err
+	}
+	if n == 1 {
+		reset = w.window
+	}
+
+	return true, int(n), reset, nil
+}
+
+// peek returns the number of requests in key's window and the time until it
+// resets.
+func (w *FixedWindow) peek(key string) (int, time.Duration, error) {
+	if scripter, ok := w.cache.(repository.ScriptInterface); ok {
+		reply, err := scripter.Eval(fixedWindowPeekScript, []string{key})
+		if err != nil {
+			return 0, 0, err
+		}
+
+		values, ok := reply.([]interface{})
+		if !ok || len(values) != 2 {
+			return 0, 0, fmt.Errorf("unexpected fixed window reply %v", reply)
+		}
+		count, _ := values[0].(int64)
+		ttl, _ := values[1].(int64)
+
+		return int(count), time.Duration(ttl) * time.Millisecond, nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	count, reset := w.count(key)
+	return count, reset, nil
+}
+
+// count reads the counter of key and the time left of its window. The caller
+// holds mu.
+func (w *FixedWindow) count(key string) (int, time.Duration) {
+	value, found := w.cache.Get(key)
+	if !found {
+		return 0, 0
+	}
+	count, _ := strconv.Atoi(string(value))
+	reset, _ := w.cache.GetTTL(key)
+
+	return count, max(reset, 0)
+}
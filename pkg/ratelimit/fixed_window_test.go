@@ -0,0 +1,44 @@
+package ratelimit_test
+
+import (
+	"testing"
+	"time"
+
+	memory_cache "github.com/jahrulnr/go-waf/internal/repository/memory"
+	"github.com/jahrulnr/go-waf/pkg/ratelimit"
+)
+
+func TestFixedWindowLimit(t *testing.T) {
+	w := ratelimit.NewFixedWindow(memory_cache.NewCache(), time.Minute, 3)
+	for i, want := range []bool{true, true, true, false, false} {
+		if allowed, count := w.Allow("client"); allowed != want {
+			t.Fatalf("call %d: allowed %v with count %d, want %v", i+1, allowed, count, want)
+		}
+	}
+	if allowed, _ := w.Allow("other"); !allowed {
+		t.Fatal("first request of another key denied")
+	}
+
+	result, err := w.Peek("client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Allowed || result.Remaining != 0 || result.RetryAfter <= 0 {
+		t.Errorf("peek %+v, want a full window", result)
+	}
+}
+
+func TestFixedWindowReset(t *testing.T) {
+	const window = 100 * time.Millisecond
+	w := ratelimit.NewFixedWindow(memory_cache.NewCache(), window, 1)
+
+	w.Allow("client")
+	if allowed, _ := w.Allow("client"); allowed {
+		t.Fatal("second request allowed in a full window")
+	}
+
+	time.Sleep(window + 20*time.Millisecond)
+	if allowed, count := w.Allow("client"); !allowed || count != 1 {
+		t.Errorf("next window: allowed %v with count %d", allowed, count)
+	}
+}
@@ -0,0 +1,109 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+	"github.com/jahrulnr/go-waf/pkg/clientip"
+)
+
+// DefaultHeaderPrefix is used when no header prefix is configured.
+const DefaultHeaderPrefix = "X-RateLimit"
+
+// Limiter is any of the limiters of this package, or one of their own.
+type Limiter interface {
+	Take(key string) service.RateLimitResult
+}
+
+// BlockHandler writes the response for a rate limited request, the limit
+// headers are already set when it runs. It returns false to forward the
+// request anyway, e.g. in dry run.
+type BlockHandler func(w http.ResponseWriter, r *http.Request, result service.RateLimitResult) bool
+
+type Options struct {
+	// KeyFunc names the client of a request, ClientIPKey when nil.
+	KeyFunc func(r *http.Request) string
+	// Block answers the requests over the limit, JSONBlock when nil.
+	Block BlockHandler
+	// Prefixes are the names the limit headers are sent under, for example
+	// X-RateLimit and RateLimit for the IETF draft ones. Nil sends
+	// DefaultHeaderPrefix, an empty list none.
+	Prefixes []string
+}
+
+// ClientIPKey is the default key function. It keys the direct peer, IPv6
+// ones by network, see clientip.Key. Behind a proxy pass a key function
+// resolving the client with clientip.RealIP and the trusted proxies.
+func ClientIPKey(r *http.Request) string {
+	return clientip.Key(clientip.RealIP(r, nil), clientip.DefaultPrefix)
+}
+
+// Middleware rate limits requests with any limiter, answering blocked ones
+// with a JSON 429. A nil keyFunc takes ClientIPKey.
+func Middleware(limiter Limiter, keyFunc func(*http.Request) string) func(http.Handler) http.Handler {
+	return MiddlewareWithOptions(limiter, Options{KeyFunc: keyFunc})
+}
+
+// MiddlewareWithOptions is like Middleware but lets the caller render the
+// blocked requests and name the headers.
+func MiddlewareWithOptions(limiter Limiter, options Options) func(http.Handler) http.Handler {
+	if options.KeyFunc == nil {
+		options.KeyFunc = ClientIPKey
+	}
+	if options.Block == nil {
+		options.Block = JSONBlock
+	}
+	if options.Prefixes == nil {
+		options.Prefixes = []string{DefaultHeaderPrefix}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			result := limiter.Take(options.KeyFunc(r))
+			SetHeaders(w.Header(), options.Prefixes, result)
+
+			if !result.Allowed && options.Block(w, r, result) {
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// JSONBlock answers a 429 with the seconds to wait.
+func JSONBlock(w http.ResponseWriter, r *http.Request, result service.RateLimitResult) bool {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":      "Too Many Requests",
+		"retry_after": seconds(result.RetryAfter),
+	})
+
+	return true
+}
+
+// SetHeaders writes the limit headers for every prefix, and Retry-After on a
+// block. Reset is sent as seconds from now, as both Retry-After and the draft
+// standard do.
+func SetHeaders(header http.Header, prefixes []string, result service.RateLimitResult) {
+	reset := strconv.FormatInt(seconds(result.Reset), 10)
+	for _, prefix := range prefixes {
+		header.Set(prefix+"-Limit", strconv.Itoa(result.Limit))
+		header.Set(prefix+"-Remaining", strconv.Itoa(max(result.Remaining, 0)))
+		header.Set(prefix+"-Reset", reset)
+	}
+
+	if !result.Allowed {
+		header.Set("Retry-After", strconv.FormatInt(seconds(result.RetryAfter), 10))
+	}
+}
+
+// seconds rounds d up, so clients never retry before the limiter allows it.
+func seconds(d time.Duration) int64 {
+	return int64(math.Ceil(max(d, 0).Seconds()))
+}
@@ -0,0 +1,111 @@
+package ratelimit_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+	memory_cache "github.com/jahrulnr/go-waf/internal/repository/memory"
+	"github.com/jahrulnr/go-waf/pkg/ratelimit"
+)
+
+var ok = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+})
+
+func TestMiddleware(t *testing.T) {
+	limiter := ratelimit.NewFixedWindow(memory_cache.NewCache(), time.Minute, 1)
+	handler := ratelimit.Middleware(limiter, nil)(ok)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("first request: status %d", w.Code)
+	}
+	if w.Header().Get("X-RateLimit-Limit") != "1" || w.Header().Get("X-RateLimit-Remaining") != "0" {
+		t.Errorf("limit headers %v", w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("second request: status %d, want 429", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("no Retry-After on a block")
+	}
+	var body struct {
+		Status     string `json:"status"`
+		RetryAfter int    `json:"retry_after"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Status != "Too Many Requests" || body.RetryAfter <= 0 || body.RetryAfter > 60 {
+		t.Errorf("body %+v", body)
+	}
+
+	// another peer has a quota of its own
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "198.51.100.1:1000"
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("request of another client: status %d", w.Code)
+	}
+}
+
+func TestMiddlewareOptions(t *testing.T) {
+	limiter := ratelimit.NewFixedWindow(memory_cache.NewCache(), time.Minute, 1)
+	forward := false
+	handler := ratelimit.MiddlewareWithOptions(limiter, ratelimit.Options{
+		KeyFunc: func(r *http.Request) string {
+			return r.Header.Get("X-API-Key")
+		},
+		Block: func(w http.ResponseWriter, r *http.Request, result service.RateLimitResult) bool {
+			if forward {
+				return false
+			}
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return true
+		},
+		Prefixes: []string{"RateLimit"},
+	})(ok)
+
+	request := func(key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-API-Key", key)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := request("a"); w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "1" || w.Header().Get("X-RateLimit-Limit") != "" {
+		t.Fatalf("first request: status %d, headers %v", w.Code, w.Header())
+	}
+	if w := request("a"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("blocked request: status %d, want the block handler's", w.Code)
+	}
+	if w := request("b"); w.Code != http.StatusOK {
+		t.Errorf("request of another key: status %d", w.Code)
+	}
+
+	forward = true
+	if w := request("a"); w.Code != http.StatusOK || w.Header().Get("Retry-After") == "" {
+		t.Errorf("forwarded request: status %d, headers %v", w.Code, w.Header())
+	}
+}
+
+func TestMiddlewareNoHeaders(t *testing.T) {
+	limiter := ratelimit.NewFixedWindow(memory_cache.NewCache(), time.Minute, 1)
+	handler := ratelimit.MiddlewareWithOptions(limiter, ratelimit.Options{Prefixes: []string{}})(ok)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if len(w.Header()) != 0 {
+		t.Errorf("headers %v, want none", w.Header())
+	}
+}
@@ -0,0 +1,264 @@
+package ratelimit_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jahrulnr/go-waf/internal/interface/repository"
+	redis_cache "github.com/jahrulnr/go-waf/internal/repository/redis"
+	"github.com/jahrulnr/go-waf/pkg/ratelimit"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// newRedis returns a Redis cache on a fresh miniredis, so the limiters run
+// their scripts as they do in production.
+func newRedis(t *testing.T) (*miniredis.Miniredis, repository.StateStore) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr(), MaxRetries: -1})
+	t.Cleanup(func() { client.Close() })
+
+	store := redis_cache.NewCacheWithOptions(context.Background(), client, redis_cache.Options{Timeout: -1})
+	if _, ok := store.(repository.ScriptInterface); !ok {
+		t.Fatal("the redis cache runs no scripts")
+	}
+
+	return server, store
+}
+
+func TestTokenBucketRedis(t *testing.T) {
+	server, store := newRedis(t)
+	bucket := ratelimit.NewTokenBucket(store, 20, 2)
+
+	for i := range 2 {
+		if allowed, _ := bucket.Allow("client"); !allowed {
+			t.Fatalf("request %d denied within the burst", i+1)
+		}
+	}
+	allowed, retryAfter := bucket.Allow("client")
+	if allowed {
+		t.Fatal("request allowed with the bucket empty")
+	}
+	if retryAfter <= 0 || retryAfter > 50*time.Millisecond {
+		t.Errorf("retry after %s, want up to a token at 20 per second", retryAfter)
+	}
+
+	if !server.Exists("gowaf-tb-client") {
+		t.Fatal("no bucket in redis")
+	}
+	if ttl := server.TTL("gowaf-tb-client"); ttl <= 0 {
+		t.Errorf("bucket ttl %s, want it to expire", ttl)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if allowed, _ := bucket.Allow("client"); !allowed {
+		t.Error("request denied after a token was refilled")
+	}
+}
+
+// TestTokenBucketRedisShared checks two instances, each with their own
+// limiter, take from the same bucket.
+func TestTokenBucketRedisShared(t *testing.T) {
+	_, store := newRedis(t)
+	first := ratelimit.NewTokenBucket(store, 0.1, 3)
+	second := ratelimit.NewTokenBucket(store, 0.1, 3)
+
+	first.Allow("client")
+	second.Allow("client")
+	first.Allow("client")
+	if allowed, _ := second.Allow("client"); allowed {
+		t.Fatal("fourth request allowed across instances sharing a burst of 3")
+	}
+	if allowed, _ := second.Allow("other"); !allowed {
+		t.Fatal("first request of another client denied")
+	}
+}
+
+func TestTokenBucketRedisPeek(t *testing.T) {
+	_, store := newRedis(t)
+	bucket := ratelimit.NewTokenBucket(store, 0.1, 2)
+
+	bucket.Allow("client")
+	for range 3 {
+		result, err := bucket.Peek("client")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.Allowed || result.Remaining != 1 {
+			t.Fatalf("peek allowed %v with %d remaining, want true with 1", result.Allowed, result.Remaining)
+		}
+	}
+
+	bucket.Allow("client")
+	if result, _ := bucket.Peek("client"); result.Allowed || result.RetryAfter <= 0 {
+		t.Errorf("peek allowed %v retry after %s on an empty bucket", result.Allowed, result.RetryAfter)
+	}
+}
+
+func TestTokenBucketRedisFailOpen(t *testing.T) {
+	for _, failOpen := range []bool{true, false} {
+		server, store := newRedis(t)
+		bucket := ratelimit.NewTokenBucket(store, 1, 1)
+		bucket.SetFailOpen(failOpen)
+
+		server.Close()
+		if allowed, _ := bucket.Allow("client"); allowed != failOpen {
+			t.Errorf("allowed %v with redis down, want %v", allowed, failOpen)
+		}
+	}
+}
+
+func TestSlidingWindowRedis(t *testing.T) {
+	server, store := newRedis(t)
+	w := ratelimit.NewSlidingWindow(store, time.Minute, 3)
+
+	for i := range 3 {
+		if allowed, count := w.Allow("client"); !allowed || count != i+1 {
+			t.Fatalf("request %d: allowed %v with count %d", i+1, allowed, count)
+		}
+	}
+	if allowed, count := w.Allow("client"); allowed || count != 3 {
+		t.Fatalf("request over the limit: allowed %v with count %d", allowed, count)
+	}
+
+	// denied requests are not recorded
+	members, err := server.ZMembers("gowaf-sw-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 3 {
+		t.Errorf("%d requests in the sorted set, want 3", len(members))
+	}
+	if ttl := server.TTL("gowaf-sw-client"); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("window ttl %s, want at most the window", ttl)
+	}
+
+	result, err := w.Peek("client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Allowed || result.Remaining != 0 || result.RetryAfter <= 0 {
+		t.Errorf("peek %+v, want a full window", result)
+	}
+}
+
+// TestSlidingWindowRedisBoundary checks a client filling the window right
+// before a fixed window would have reset gets nothing right after it.
+func TestSlidingWindowRedisBoundary(t *testing.T) {
+	const window = 300 * time.Millisecond
+	_, store := newRedis(t)
+	w := ratelimit.NewSlidingWindow(store, window, 2)
+
+	w.Allow("client")
+	time.Sleep(window * 2 / 3)
+	w.Allow("client")
+
+	// past where a fixed window started at the first request resets
+	time.Sleep(window/3 + 20*time.Millisecond)
+	if allowed, _ := w.Allow("client"); !allowed {
+		t.Fatal("request denied once the first one left the window")
+	}
+	if allowed, _ := w.Allow("client"); allowed {
+		t.Fatal("burst allowed across the window boundary")
+	}
+}
+
+func TestSlidingWindowRedisConcurrent(t *testing.T) {
+	const (
+		limit   = 10
+		callers = 50
+	)
+	_, store := newRedis(t)
+	w := ratelimit.NewSlidingWindow(store, time.Minute, limit)
+
+	var (
+		allowed atomic.Int64
+		wg      sync.WaitGroup
+	)
+	start := make(chan struct{})
+	for range callers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if ok, _ := w.Allow("client"); ok {
+				allowed.Add(1)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if got := allowed.Load(); got != limit {
+		t.Errorf("%d concurrent requests allowed, want %d", got, limit)
+	}
+}
+
+func TestSlidingWindowRedisFailOpen(t *testing.T) {
+	for _, failOpen := range []bool{true, false} {
+		server, store := newRedis(t)
+		w := ratelimit.NewSlidingWindow(store, time.Minute, 1)
+		w.SetFailOpen(failOpen)
+
+		server.Close()
+		if allowed, _ := w.Allow("client"); allowed != failOpen {
+			t.Errorf("allowed %v with redis down, want %v", allowed, failOpen)
+		}
+	}
+}
+
+func TestFixedWindowRedis(t *testing.T) {
+	server, store := newRedis(t)
+	w := ratelimit.NewFixedWindow(store, time.Minute, 2)
+
+	for i := range 2 {
+		if allowed, count := w.Allow("client"); !allowed || count != i+1 {
+			t.Fatalf("request %d: allowed %v with count %d", i+1, allowed, count)
+		}
+	}
+	result := w.Take("client")
+	if result.Allowed || result.Remaining != 0 {
+		t.Fatalf("request over the limit: %+v", result)
+	}
+	if result.RetryAfter <= 0 || result.RetryAfter > time.Minute {
+		t.Errorf("retry after %s, want the rest of the window", result.RetryAfter)
+	}
+
+	// denied requests are not counted
+	if value, _ := server.Get("gowaf-fw-client"); value != "2" {
+		t.Errorf("counter %q, want 2", value)
+	}
+	if ttl := server.TTL("gowaf-fw-client"); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("window ttl %s, want at most the window", ttl)
+	}
+
+	peek, err := w.Peek("client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peek.Allowed || peek.Remaining != 0 {
+		t.Errorf("peek %+v, want a full window", peek)
+	}
+
+	server.FastForward(time.Minute)
+	if allowed, count := w.Allow("client"); !allowed || count != 1 {
+		t.Errorf("first request of the next window: allowed %v with count %d", allowed, count)
+	}
+}
+
+func TestFixedWindowRedisFailOpen(t *testing.T) {
+	for _, failOpen := range []bool{true, false} {
+		server, store := newRedis(t)
+		w := ratelimit.NewFixedWindow(store, time.Minute, 1)
+		w.SetFailOpen(failOpen)
+
+		server.Close()
+		if allowed, _ := w.Allow("client"); allowed != failOpen {
+			t.Errorf("allowed %v with redis down, want %v", allowed, failOpen)
+		}
+	}
+}
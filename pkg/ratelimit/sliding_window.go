@@ -0,0 +1,239 @@
+package ratelimit
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jahrulnr/go-waf/internal/interface/repository"
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+)
+
+// slidingWindowScript trims timestamps older than the window, counts what is
+// left and records the request if it fits, all in one atomic step. The reply
+// is {allowed, count, oldest timestamp}.
+const slidingWindowScript = `
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now - window)
+
+local count = redis.call("ZCARD", KEYS[1])
+local allowed = 0
+if count < limit then
+	redis.call("ZADD", KEYS[1], now, ARGV[4])
+	count = count + 1
+	allowed = 1
+end
+redis.call("PEXPIRE", KEYS[1], window)
+
+local oldest = redis.call("ZRANGE", KEYS[1], 0, 0, "WITHSCORES")
+return {allowed, count, tonumber(oldest[2]) or now}
+`
+
+// slidingWindowPeekScript counts the requests in the window without recording
+// one. The reply is {count, oldest timestamp}.
+const slidingWindowPeekScript = `
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+
+local live = redis.call("ZRANGEBYSCORE", KEYS[1], "(" .. (now - window), "+inf", "WITHSCORES")
+return {math.floor(#live / 2), tonumber(live[2]) or now}
+`
+
+type SlidingWindow struct {
+	cache  repository.StateStore
+	prefix string
+
+	window   time.Duration
+	limit    int
+	failOpen bool
+
+	mu sync.Mutex // guards the non-scripted fallback
+}
+
+// NewSlidingWindow creates a limiter allowing limit requests in any window
+// long period. Unlike fixed windows no burst of twice the limit is possible
+// around a window boundary, because every request is weighed against the
+// exact timestamps of the previous ones.
+func NewSlidingWindow(cache repository.StateStore, window time.Duration, limit int) *SlidingWindow {
+	if limit < 1 {
+		limit = 1
+	}
+
+	return &SlidingWindow{
+		cache:    cache,
+		prefix:   "gowaf-sw-",
+		window:   window,
+		limit:    limit,
+		failOpen: true,
+	}
+}
+
+// SetFailOpen chooses whether requests are allowed (true, the default) or
+// denied when the cache can't be reached.
+func (w *SlidingWindow) SetFailOpen(failOpen bool) {
+	w.failOpen = failOpen
+}
+
+// Allow records a request for key and reports whether it is permitted, along
+// with the number of requests counted in the current window.
+func (w *SlidingWindow) Allow(key string) (bool, int) {
+	allowed, count, _, err := w.take(w.prefix + key)
+	if err != nil {
+		logger.Logger("[warn] sliding window unavailable, fail open: ", w.failOpen, err.Error()).Warn()
+		return w.failOpen, 0
+	}
+
+	return allowed, count
+}
+
+func (w *SlidingWindow) Take(key string) service.RateLimitResult {
+	allowed, count, oldest, err := w.take(w.prefix + key)
+	if err != nil {
+		logger.Logger("[warn] sliding window unavailable, fail open: ", w.failOpen, err.Error()).Warn()
+		return service.RateLimitResult{
+			Allowed: w.failOpen,
+			Limit:   w.limit,
+		}
+	}
+
+	return w.result(allowed, count, oldest)
+}
+
+// Peek returns the state of key's window without recording a request,
+// Allowed telling whether the next request would be.
+func (w *SlidingWindow) Peek(key string) (service.RateLimitResult, error) {
+	count, oldest, err := w.peek(w.prefix + key)
+	if err != nil {
+		return service.RateLimitResult{}, err
+	}
+
+	return w.result(count < w.limit, count, oldest), nil
+}
+
+func (w *SlidingWindow) result(allowed bool, count int, oldest int64) service.RateLimitResult {
+	// the oldest request leaving the window frees the next slot
+	reset := max(time.Until(time.UnixMilli(oldest).Add(w.window)), 0)
+	result := service.RateLimitResult{
+		Allowed:   allowed,
+		Limit:     w.limit,
+		Remaining: max(w.limit-count, 0),
+		Reset:     reset,
+	}
+	if !allowed {
+		result.RetryAfter = reset
+	}
+
+	return result
+}
+
+func (w *SlidingWindow) take(key string) (bool, int, int64, error) {
+	now := time.Now().UnixMilli()
+
+	if scripter, ok := w.cache.(repository.ScriptInterface); ok {
+		member, err := newMember(now)
+		if err != nil {
+			return false, 0, 0, err
+		}
+
+		reply, err := scripter.Eval(slidingWindowScript, []string{key}, now, w.window.Milliseconds(), w.limit, member)
+		if err != nil {
+			return false, 0, 0, err
+		}
+
+		values, ok := reply.([]interface{})
+		if !ok || len(values) != 3 {
+			return false, 0, 0, fmt.Errorf("unexpected sliding window reply %v", reply)
+		}
+		allowed, _ := values[0].(int64)
+		count, _ := values[1].(int64)
+		oldest, _ := values[2].(int64)
+
+		return allowed == 1, int(count), oldest, nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	timestamps := w.timestamps(key, now)
+
+	allowed := len(timestamps) < w.limit
+	if allowed {
+		timestamps = append(timestamps, now)
+	}
+
+	fields := make([]string, len(timestamps))
+	for i, ts := range timestamps {
+		fields[i] = strconv.FormatInt(ts, 10)
+	}
+	if err := w.cache.Set(key, []byte(strings.Join(fields, " ")), w.window); err != nil {
+		return false, 0, 0, err
+	}
+
+	return allowed, len(timestamps), timestamps[0], nil
+}
+
+// peek returns the number of requests in key's window and the oldest of them.
+func (w *SlidingWindow) peek(key string) (int, int64, error) {
+	now := time.Now().UnixMilli()
+
+	if scripter, ok := w.cache.(repository.ScriptInterface); ok {
+		reply, err := scripter.Eval(slidingWindowPeekScript, []string{key}, now, w.window.Milliseconds())
+		if err != nil {
+			return 0, 0, err
+		}
+
+		values, ok := reply.([]interface{})
+		if !ok || len(values) != 2 {
+			return 0, 0, fmt.Errorf("unexpected sliding window reply %v", reply)
+		}
+		count, _ := values[0].(int64)
+		oldest, _ := values[1].(int64)
+
+		return int(count), oldest, nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	timestamps := w.timestamps(key, now)
+	if len(timestamps) == 0 {
+		return 0, now, nil
+	}
+
+	return len(timestamps), timestamps[0], nil
+}
+
+// timestamps reads the requests of key still in the window, at most limit,
+// oldest first. The caller holds mu.
+func (w *SlidingWindow) timestamps(key string, now int64) []int64 {
+	var timestamps []int64
+	if state, found := w.cache.Get(key); found {
+		for _, field := range strings.Fields(string(state)) {
+			ts, err := strconv.ParseInt(field, 10, 64)
+			if err == nil && ts > now-w.window.Milliseconds() {
+				timestamps = append(timestamps, ts)
+			}
+		}
+	}
+
+	return timestamps
+}
+
+// newMember makes the sorted set member unique when two requests share the
+// same millisecond.
+func newMember(now int64) (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return strconv.FormatInt(now, 10) + "-" + hex.EncodeToString(b), nil
+}
@@ -0,0 +1,126 @@
+package ratelimit_test
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	memory_cache "github.com/jahrulnr/go-waf/internal/repository/memory"
+	"github.com/jahrulnr/go-waf/pkg/ratelimit"
+)
+
+func TestSlidingWindowLimit(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit int
+		calls int
+		want  []bool
+	}{
+		{name: "below the limit", limit: 3, calls: 2, want: []bool{true, true}},
+		{name: "exactly the limit", limit: 3, calls: 3, want: []bool{true, true, true}},
+		{name: "one over the limit", limit: 3, calls: 4, want: []bool{true, true, true, false}},
+		{name: "limit of one", limit: 1, calls: 3, want: []bool{true, false, false}},
+		{name: "limit below one counts as one", limit: 0, calls: 2, want: []bool{true, false}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := ratelimit.NewSlidingWindow(memory_cache.NewCache(), time.Minute, test.limit)
+			for i := 0; i < test.calls; i++ {
+				allowed, count := w.Allow("client")
+				if allowed != test.want[i] {
+					t.Fatalf("call %d: allowed %v with count %d, want %v", i+1, allowed, count, test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSlidingWindowRollover(t *testing.T) {
+	const window = 200 * time.Millisecond
+	tests := []struct {
+		name  string
+		wait  time.Duration // after filling the window
+		allow bool
+	}{
+		{name: "inside the window", wait: window / 4, allow: false},
+		{name: "past the window", wait: window + 50*time.Millisecond, allow: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := ratelimit.NewSlidingWindow(memory_cache.NewCache(), window, 2)
+			w.Allow("client")
+			w.Allow("client")
+			if allowed, _ := w.Allow("client"); allowed {
+				t.Fatal("third request allowed in a full window")
+			}
+
+			time.Sleep(test.wait)
+			if allowed, count := w.Allow("client"); allowed != test.allow {
+				t.Errorf("allowed %v with count %d, want %v", allowed, count, test.allow)
+			}
+		})
+	}
+}
+
+// TestSlidingWindowSlides checks the window follows each request: a request
+// leaves it a window after it was made, not at a fixed boundary.
+func TestSlidingWindowSlides(t *testing.T) {
+	const window = 300 * time.Millisecond
+	w := ratelimit.NewSlidingWindow(memory_cache.NewCache(), window, 2)
+
+	w.Allow("client")
+	time.Sleep(window / 2)
+	w.Allow("client")
+
+	// the first request has left, the second one hasn't
+	time.Sleep(window/2 + 50*time.Millisecond)
+	if allowed, _ := w.Allow("client"); !allowed {
+		t.Fatal("request denied once the first one left the window")
+	}
+	if allowed, _ := w.Allow("client"); allowed {
+		t.Fatal("request allowed with the window full again")
+	}
+}
+
+func TestSlidingWindowKeys(t *testing.T) {
+	w := ratelimit.NewSlidingWindow(memory_cache.NewCache(), time.Minute, 1)
+	if allowed, _ := w.Allow("a"); !allowed {
+		t.Fatal("first request of a denied")
+	}
+	if allowed, _ := w.Allow("b"); !allowed {
+		t.Fatal("first request of b denied, keys share a window")
+	}
+}
+
+func TestSlidingWindowConcurrent(t *testing.T) {
+	const (
+		limit   = 10
+		callers = 50
+	)
+	w := ratelimit.NewSlidingWindow(memory_cache.NewCache(), time.Minute, limit)
+
+	var (
+		allowed atomic.Int64
+		wg      sync.WaitGroup
+	)
+	start := make(chan struct{})
+	for range callers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if ok, _ := w.Allow("client"); ok {
+				allowed.Add(1)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if got := allowed.Load(); got != limit {
+		t.Errorf("%d concurrent requests allowed, want %d", got, limit)
+	}
+}
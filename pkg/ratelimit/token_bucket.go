@@ -0,0 +1,211 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jahrulnr/go-waf/internal/interface/repository"
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+)
+
+// tokenBucketScript refills and takes one token atomically. State is a hash
+// of the remaining tokens and the last refill time in milliseconds.
+const tokenBucketScript = `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local state = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(state[1]) or burst
+local ts = tonumber(state[2]) or now
+
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate / 1000)
+
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "ts", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst * 1000 / rate) + 1000)
+
+return {allowed, tostring(tokens)}
+`
+
+// tokenBucketPeekScript reads the bucket state without changing it.
+const tokenBucketPeekScript = `
+local state = redis.call("HMGET", KEYS[1], "tokens", "ts")
+return {tostring(state[1] or ""), tostring(state[2] or "")}
+`
+
+type TokenBucket struct {
+	cache  repository.StateStore
+	prefix string
+
+	rate     float64 // tokens per second
+	burst    int
+	failOpen bool
+
+	mu sync.Mutex // guards the non-scripted fallback
+}
+
+// NewTokenBucket creates a limiter allowing rate requests per second with
+// bursts of up to burst requests. When the cache supports scripts the bucket
+// is updated atomically on the server, so all instances share it. Otherwise a
+// process-local lock is used, which is fine for the memory and file drivers.
+func NewTokenBucket(cache repository.StateStore, rate float64, burst int) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &TokenBucket{
+		cache:    cache,
+		prefix:   "gowaf-tb-",
+		rate:     rate,
+		burst:    burst,
+		failOpen: true,
+	}
+}
+
+// SetFailOpen chooses whether requests are allowed (true, the default) or
+// denied when the cache can't be reached.
+func (b *TokenBucket) SetFailOpen(failOpen bool) {
+	b.failOpen = failOpen
+}
+
+// Allow takes a token for key. When denied, the second value is how long the
+// client should wait before retrying.
+func (b *TokenBucket) Allow(key string) (bool, time.Duration) {
+	result := b.Take(key)
+	return result.Allowed, result.RetryAfter
+}
+
+func (b *TokenBucket) Take(key string) service.RateLimitResult {
+	tokens, allowed, err := b.take(b.prefix + key)
+	if err != nil {
+		logger.Logger("[warn] token bucket unavailable, fail open: ", b.failOpen, err.Error()).Warn()
+		return service.RateLimitResult{
+			Allowed:   b.failOpen,
+			Limit:     b.burst,
+			Remaining: 0,
+		}
+	}
+
+	return b.result(tokens, allowed)
+}
+
+// Peek returns the state of key's bucket without taking a token, Allowed
+// telling whether the next request would be.
+func (b *TokenBucket) Peek(key string) (service.RateLimitResult, error) {
+	tokens, err := b.peek(b.prefix + key)
+	if err != nil {
+		return service.RateLimitResult{}, err
+	}
+
+	return b.result(tokens, tokens >= 1), nil
+}
+
+func (b *TokenBucket) result(tokens float64, allowed bool) service.RateLimitResult {
+	result := service.RateLimitResult{
+		Allowed:   allowed,
+		Limit:     b.burst,
+		Remaining: int(math.Floor(tokens)),
+		Reset:     b.duration(float64(b.burst) - tokens),
+	}
+	if !allowed {
+		result.RetryAfter = b.duration(1 - tokens)
+	}
+
+	return result
+}
+
+// duration converts a token count into the time needed to refill it.
+func (b *TokenBucket) duration(tokens float64) time.Duration {
+	if tokens <= 0 || b.rate <= 0 {
+		return 0
+	}
+
+	return time.Duration(math.Ceil(tokens / b.rate * float64(time.Second)))
+}
+
+func (b *TokenBucket) take(key string) (float64, bool, error) {
+	now := time.Now().UnixMilli()
+
+	if scripter, ok := b.cache.(repository.ScriptInterface); ok {
+		reply, err := scripter.Eval(tokenBucketScript, []string{key}, b.rate, b.burst, now)
+		if err != nil {
+			return 0, false, err
+		}
+
+		values, ok := reply.([]interface{})
+		if !ok || len(values) != 2 {
+			return 0, false, fmt.Errorf("unexpected token bucket reply %v", reply)
+		}
+		allowed, _ := values[0].(int64)
+		tokens, err := strconv.ParseFloat(fmt.Sprint(values[1]), 64)
+		if err != nil {
+			return 0, false, err
+		}
+
+		return tokens, allowed == 1, nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	tokens, ts := float64(b.burst), now
+	if state, found := b.cache.Get(key); found {
+		fmt.Sscanf(string(state), "%g %d", &tokens, &ts)
+	}
+
+	tokens = math.Min(float64(b.burst), tokens+float64(max(0, now-ts))*b.rate/1000)
+	allowed := tokens >= 1
+	if allowed {
+		tokens--
+	}
+
+	ttl := b.duration(float64(b.burst)) + time.Second
+	if err := b.cache.Set(key, []byte(fmt.Sprintf("%g %d", tokens, now)), ttl); err != nil {
+		return 0, false, err
+	}
+
+	return tokens, allowed, nil
+}
+
+// peek returns the tokens of key, refilled up to now.
+func (b *TokenBucket) peek(key string) (float64, error) {
+	now := time.Now().UnixMilli()
+	tokens, ts := float64(b.burst), now
+
+	if scripter, ok := b.cache.(repository.ScriptInterface); ok {
+		reply, err := scripter.Eval(tokenBucketPeekScript, []string{key})
+		if err != nil {
+			return 0, err
+		}
+
+		values, ok := reply.([]interface{})
+		if !ok || len(values) != 2 {
+			return 0, fmt.Errorf("unexpected token bucket reply %v", reply)
+		}
+		if value, err := strconv.ParseFloat(fmt.Sprint(values[0]), 64); err == nil {
+			tokens = value
+		}
+		if value, err := strconv.ParseInt(fmt.Sprint(values[1]), 10, 64); err == nil {
+			ts = value
+		}
+	} else {
+		b.mu.Lock()
+		state, found := b.cache.Get(key)
+		b.mu.Unlock()
+		if found {
+			fmt.Sscanf(string(state), "%g %d", &tokens, &ts)
+		}
+	}
+
+	return math.Min(float64(b.burst), tokens+float64(max(0, now-ts))*b.rate/1000), nil
+}
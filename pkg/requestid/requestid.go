@@ -0,0 +1,82 @@
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+
+	"github.com/jahrulnr/go-waf/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultHeader carries the request id to the upstream and back to the client.
+const DefaultHeader = "X-Request-ID"
+
+// maxLength bounds the incoming ids that are kept, longer ones are replaced.
+const maxLength = 128
+
+type contextKey struct{}
+
+// New returns a random version 4 UUID.
+func New() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		logger.Logger("[warn] fail to generate request id ", err.Error()).Warn()
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// Valid reports whether an incoming id is kept: up to 128 letters, digits
+// and "-_.:", which covers UUIDs, ULIDs and the ids of common proxies while
+// keeping anything that could break a log line or header out.
+func Valid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-', r == '_', r == '.', r == ':':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// Middleware keeps the id in header when it is valid, from a load balancer
+// in front, and generates one otherwise. The id is stored in the request
+// context, forwarded to the upstream, echoed to the client and added as
+// request_id to the log lines of logger.FromContext with the request context.
+func Middleware(header string) gin.HandlerFunc {
+	if header == "" {
+		header = DefaultHeader
+	}
+
+	return func(c *gin.Context) {
+		id := c.GetHeader(header)
+		if !Valid(id) {
+			id = New()
+		}
+
+		ctx := context.WithValue(c.Request.Context(), contextKey{}, id)
+		c.Request = c.Request.WithContext(logger.NewContext(ctx, map[string]interface{}{"request_id": id}))
+		c.Request.Header.Set(header, id)
+		c.Writer.Header().Set(header, id)
+
+		c.Next()
+	}
+}
+
+// FromRequest returns the id Middleware gave r, empty without it.
+func FromRequest(r *http.Request) string {
+	id, _ := r.Context().Value(contextKey{}).(string)
+
+	return id
+}
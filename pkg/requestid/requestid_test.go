@@ -0,0 +1,57 @@
+package requestid_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/jahrulnr/go-waf/pkg/logger"
+	"github.com/jahrulnr/go-waf/pkg/requestid"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestLogContext checks the id reaches the log lines of a goroutine the
+// request starts, as mirrored requests and cache revalidation do.
+func TestLogContext(t *testing.T) {
+	var output bytes.Buffer
+	logger.SetOutput(&output)
+	logger.SetFormat(logger.JSON)
+	t.Cleanup(func() {
+		logger.SetOutput(os.Stderr)
+		logger.SetFormat(logger.TEXT)
+	})
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(requestid.Middleware(""))
+	router.GET("/", func(c *gin.Context) {
+		done := make(chan struct{})
+		go func(r *http.Request) {
+			defer close(done)
+			logger.FromContext(r.Context()).Logger("[warn] in the background").Warn()
+		}(c.Request)
+		<-done
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(requestid.DefaultHeader, "abc-123")
+	router.ServeHTTP(httptest.NewRecorder(), r)
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(output.Bytes(), &line); err != nil {
+		t.Fatalf("log %q: %v", output.String(), err)
+	}
+	if line["request_id"] != "abc-123" || line["message"] != "[warn] in the background" {
+		t.Errorf("log line %v, want the request id", line)
+	}
+
+	output.Reset()
+	logger.Logger("[warn] outside a request").Warn()
+	if bytes.Contains(output.Bytes(), []byte("request_id")) {
+		t.Errorf("log line %q carries a request id", output.String())
+	}
+}
@@ -0,0 +1,167 @@
+package revocation
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jahrulnr/go-waf/pkg/logger"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// ErrRevoked is wrapped by the errors of Check for a revoked certificate.
+var ErrRevoked = errors.New("certificate revoked")
+
+// CheckerOptions configures the checks, at least one should be on.
+type CheckerOptions struct {
+	OCSP     bool     // ask the OCSP responders the certificates list
+	CRL      bool     // fetch the CRLs of the distribution points the certificates list
+	CRLFiles []string // local CRLs, DER or PEM, read again when they change
+	SoftFail bool     // let a certificate whose status can't be told through, it is rejected otherwise
+}
+
+// Checker tells whether the certificates of a chain are revoked, an
+// mtls.RevocationChecker. A local CRL of the issuer is authoritative, then
+// OCSP is asked, then the CRLs of the distribution points. A certificate
+// none of them can tell about, e.g. with the responder down, is rejected,
+// or only logged with SoftFail.
+type Checker struct {
+	fetcher *Fetcher
+	options CheckerOptions
+	files   []*crlFile
+}
+
+type crlFile struct {
+	path string
+
+	mu       sync.Mutex
+	modified time.Time
+	crl      *x509.RevocationList
+}
+
+// NewChecker reads the CRLFiles, which must parse.
+func NewChecker(fetcher *Fetcher, options CheckerOptions) (*Checker, error) {
+	c := &Checker{
+		fetcher: fetcher,
+		options: options,
+	}
+	for _, path := range options.CRLFiles {
+		file := &crlFile{path: path}
+		if _, err := file.load(); err != nil {
+			return nil, err
+		}
+		c.files = append(c.files, file)
+	}
+
+	return c, nil
+}
+
+// Check returns an error wrapping ErrRevoked when a certificate of chain is
+// revoked, the CA closing it isn't checked. Without SoftFail a certificate
+// whose status can't be told is an error too.
+func (c *Checker) Check(ctx context.Context, chain []*x509.Certificate) error {
+	for i := 0; i < len(chain)-1; i++ {
+		err := c.check(ctx, chain[i], chain[i+1])
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, ErrRevoked) || !c.options.SoftFail {
+			return fmt.Errorf("certificate %q: %w", chain[i].Subject.String(), err)
+		}
+		logger.Logger("[warn] revocation unknown, soft fail ", chain[i].Subject.String(), " ", err.Error()).Warn()
+	}
+
+	return nil
+}
+
+func (c *Checker) check(ctx context.Context, cert *x509.Certificate, issuer *x509.Certificate) error {
+	for _, file := range c.files {
+		crl, err := file.load()
+		if err != nil {
+			logger.Logger("[warn] keep previous crl, reload failed ", err.Error()).Warn()
+		}
+		if crl == nil || !bytes.Equal(crl.RawIssuer, cert.RawIssuer) || crl.CheckSignatureFrom(issuer) != nil {
+			continue
+		}
+		return listed(crl, cert)
+	}
+
+	var errs []error
+	if c.options.OCSP && len(cert.OCSPServer) > 0 {
+		response, _, err := c.fetcher.OCSP(ctx, cert, issuer)
+		switch {
+		case err != nil:
+			errs = append(errs, err)
+		case response.Status == ocsp.Good:
+			return nil
+		case response.Status == ocsp.Revoked:
+			return ErrRevoked
+		default:
+			errs = append(errs, errors.New("ocsp status unknown"))
+		}
+	}
+	if c.options.CRL {
+		for _, url := range cert.CRLDistributionPoints {
+			if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+				continue
+			}
+			crl, err := c.fetcher.CRL(ctx, url, issuer)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			return listed(crl, cert)
+		}
+	}
+	if len(errs) == 0 {
+		return errors.New("no way to check revocation")
+	}
+
+	return errors.Join(errs...)
+}
+
+func listed(crl *x509.RevocationList, cert *x509.Certificate) error {
+	for _, entry := range crl.RevokedCertificateEntries {
+		if entry.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+			return ErrRevoked
+		}
+	}
+
+	return nil
+}
+
+// load returns the CRL, read again when the file changed. A failed read
+// keeps the previous CRL.
+func (f *crlFile) load() (*x509.RevocationList, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return f.crl, err
+	}
+	if f.crl != nil && info.ModTime().Equal(f.modified) {
+		return f.crl, nil
+	}
+
+	raw, err := os.ReadFile(f.path)
+	if err != nil {
+		return f.crl, err
+	}
+	// the signature is checked against the issuer of each certificate
+	crl, err := ParseCRL(raw, nil)
+	if err != nil {
+		return f.crl, fmt.Errorf("parse %s: %w", f.path, err)
+	}
+	f.crl = crl
+	f.modified = info.ModTime()
+
+	return crl, nil
+}
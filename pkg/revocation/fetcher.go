@@ -0,0 +1,228 @@
+package revocation
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jahrulnr/go-waf/internal/interface/repository"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// Bounds on what a responder or a distribution point may send.
+const (
+	maxOCSPSize = 1 << 20
+	maxCRLSize  = 32 << 20
+)
+
+// A response without a next update says newer information is always
+// available, it is kept this long still so every request doesn't ask.
+const noNextUpdate = 5 * time.Minute
+
+// Fetcher gets OCSP responses and CRLs over HTTP and keeps them in a state
+// store, so instances sharing one ask the responders once. The
+// signatures are always checked against the issuer. An OCSP response is kept
+// until the middle of its validity, so it is renewed well before it expires,
+// and a CRL until its next update.
+type Fetcher struct {
+	store  repository.StateStore
+	client *http.Client
+
+	mu   sync.Mutex
+	crls map[string]parsedCRL // by url
+}
+
+type parsedCRL struct {
+	crl   *x509.RevocationList
+	until time.Time
+}
+
+// NewFetcher keeps the responses in store, client defaults to one with a 5s
+// timeout.
+func NewFetcher(store repository.StateStore, client *http.Client) *Fetcher {
+	if client == nil {
+		client = &http.Client{Timeout: 5 * time.Second}
+	}
+
+	return &Fetcher{
+		store:  store,
+		client: client,
+		crls:   make(map[string]parsedCRL),
+	}
+}
+
+// OCSP returns the status of cert, issued by issuer, from the responders its
+// certificate lists, and the raw response as stapled.
+func (f *Fetcher) OCSP(ctx context.Context, cert *x509.Certificate, issuer *x509.Certificate) (*ocsp.Response, []byte, error) {
+	if len(cert.OCSPServer) == 0 {
+		return nil, nil, errors.New("no ocsp responder")
+	}
+
+	key := "gowaf-ocsp-" + issuerHash(issuer) + "-" + cert.SerialNumber.Text(16)
+	cache := f.store.StateContext(ctx)
+	if raw, ok := cache.Get(key); ok {
+		if response, err := ocsp.ParseResponseForCert(raw, cert, issuer); err == nil && fresh(response.NextUpdate) {
+			return response, raw, nil
+		}
+	}
+
+	request, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var errs []error
+	for _, server := range cert.OCSPServer {
+		raw, err := f.post(ctx, server, request)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		response, err := ocsp.ParseResponseForCert(raw, cert, issuer)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("ocsp %s: %w", server, err))
+			continue
+		}
+
+		ttl := noNextUpdate
+		if !response.NextUpdate.IsZero() {
+			ttl = max(time.Until(response.ThisUpdate.Add(response.NextUpdate.Sub(response.ThisUpdate)/2)), time.Minute)
+		}
+		// a cache error only costs another request later
+		_ = cache.Set(key, raw, ttl)
+
+		return response, raw, nil
+	}
+
+	return nil, nil, errors.Join(errs...)
+}
+
+func (f *Fetcher) post(ctx context.Context, server string, request []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, server, bytes.NewReader(request))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	req.Header.Set("Accept", "application/ocsp-response")
+
+	return f.do(req, maxOCSPSize)
+}
+
+// CRL returns the CRL at url, issued by issuer.
+func (f *Fetcher) CRL(ctx context.Context, url string, issuer *x509.Certificate) (*x509.RevocationList, error) {
+	f.mu.Lock()
+	parsed, ok := f.crls[url]
+	f.mu.Unlock()
+	if ok && time.Now().Before(parsed.until) {
+		return parsed.crl, nil
+	}
+
+	key := "gowaf-crl-" + hash([]byte(url))
+	cache := f.store.StateContext(ctx)
+	if raw, ok := cache.Get(key); ok {
+		if crl, err := ParseCRL(raw, issuer); err == nil && fresh(crl.NextUpdate) {
+			f.keep(url, crl, crlTTL(crl))
+			return crl, nil
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := f.do(req, maxCRLSize)
+	if err != nil {
+		return nil, err
+	}
+	crl, err := ParseCRL(raw, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("crl %s: %w", url, err)
+	}
+
+	ttl := crlTTL(crl)
+	_ = cache.Set(key, raw, ttl)
+	f.keep(url, crl, ttl)
+
+	return crl, nil
+}
+
+func crlTTL(crl *x509.RevocationList) time.Duration {
+	if crl.NextUpdate.IsZero() {
+		return noNextUpdate
+	}
+
+	return max(time.Until(crl.NextUpdate), time.Minute)
+}
+
+func (f *Fetcher) keep(url string, crl *x509.RevocationList, ttl time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.crls[url] = parsedCRL{crl: crl, until: time.Now().Add(ttl)}
+}
+
+func (f *Fetcher) do(req *http.Request, limit int64) ([]byte, error) {
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: status %d", req.Method, req.URL, resp.StatusCode)
+	}
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(raw)) > limit {
+		return nil, fmt.Errorf("%s %s: response over %d bytes", req.Method, req.URL, limit)
+	}
+
+	return raw, nil
+}
+
+// ParseCRL reads a DER or PEM CRL and checks it is signed by issuer, nil
+// skips the check.
+func ParseCRL(raw []byte, issuer *x509.Certificate) (*x509.RevocationList, error) {
+	if block, _ := pem.Decode(raw); block != nil && block.Type == "X509 CRL" {
+		raw = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(raw)
+	if err != nil {
+		return nil, err
+	}
+	if issuer != nil {
+		if err := crl.CheckSignatureFrom(issuer); err != nil {
+			return nil, err
+		}
+	}
+
+	return crl, nil
+}
+
+// fresh reports whether information with the next update at next is still
+// current. Without a next update it is, the cache only keeps it for
+// noNextUpdate.
+func fresh(next time.Time) bool {
+	return next.IsZero() || time.Now().Before(next)
+}
+
+func issuerHash(issuer *x509.Certificate) string {
+	return hash(issuer.RawSubjectPublicKeyInfo)[:32]
+}
+
+func hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
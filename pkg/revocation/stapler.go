@@ -0,0 +1,138 @@
+package revocation
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"sync"
+	"time"
+
+	"github.com/jahrulnr/go-waf/pkg/logger"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// A failed fetch is tried again after retryStaple.
+const retryStaple = 5 * time.Minute
+
+// Stapler staples OCSP responses to the server certificates, so clients
+// needn't ask the responder of the CA themselves. Responses are fetched in
+// the background, a handshake never waits for one: until the first one
+// arrives, or once the last one expired, certificates are served without.
+type Stapler struct {
+	fetcher *Fetcher
+
+	mu      sync.Mutex
+	staples map[string]*staple // by issuer and serial
+}
+
+type staple struct {
+	raw      []byte
+	expires  time.Time
+	refresh  time.Time
+	fetching bool
+}
+
+func NewStapler(fetcher *Fetcher) *Stapler {
+	return &Stapler{
+		fetcher: fetcher,
+		staples: make(map[string]*staple),
+	}
+}
+
+// GetCertificate wraps the GetCertificate of a tls.Config, stapling the
+// certificates next returns. Certificates without their issuer in the chain
+// or without a responder are served as they are.
+func (s *Stapler) GetCertificate(next func(*tls.ClientHelloInfo) (*tls.Certificate, error)) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert, err := next(hello)
+		if err != nil || cert == nil || len(cert.Certificate) < 2 {
+			return cert, err
+		}
+
+		raw := s.staple(cert)
+		if raw == nil {
+			return cert, nil
+		}
+		stapled := *cert
+		stapled.OCSPStaple = raw
+
+		return &stapled, nil
+	}
+}
+
+// staple returns the current response for cert, starting a fetch when it is
+// due.
+func (s *Stapler) staple(cert *tls.Certificate) []byte {
+	leaf := cert.Leaf
+	if leaf == nil {
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil
+		}
+		leaf = parsed
+	}
+	if len(leaf.OCSPServer) == 0 {
+		return nil
+	}
+
+	key := string(leaf.RawIssuer) + leaf.SerialNumber.String()
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, ok := s.staples[key]
+	if !ok {
+		current = &staple{}
+		s.staples[key] = current
+	}
+	if !current.fetching && !now.Before(current.refresh) {
+		current.fetching = true
+		go s.fetch(current, leaf, cert.Certificate[1])
+	}
+	if now.Before(current.expires) {
+		return current.raw
+	}
+
+	return nil
+}
+
+func (s *Stapler) fetch(current *staple, leaf *x509.Certificate, der []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var (
+		response *ocsp.Response
+		raw      []byte
+	)
+	issuer, err := x509.ParseCertificate(der)
+	if err == nil {
+		response, raw, err = s.fetcher.OCSP(ctx, leaf, issuer)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current.fetching = false
+	now := time.Now()
+	if err != nil {
+		logger.Logger("[warn] fail to fetch ocsp staple ", leaf.Subject.String(), " ", err.Error()).Warn()
+		current.refresh = now.Add(retryStaple)
+		return
+	}
+	if response.Status == ocsp.Revoked {
+		logger.Logger("[error] server certificate revoked ", leaf.Subject.String()).Error()
+	}
+
+	current.raw = raw
+	current.expires = response.NextUpdate
+	current.refresh = response.ThisUpdate.Add(response.NextUpdate.Sub(response.ThisUpdate) / 2)
+	if response.NextUpdate.IsZero() {
+		current.expires = now.Add(noNextUpdate)
+		current.refresh = current.expires
+	}
+	if current.refresh.Before(now.Add(time.Minute)) {
+		current.refresh = now.Add(time.Minute)
+	}
+}
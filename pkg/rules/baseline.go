@@ -0,0 +1,36 @@
+package rules
+
+import (
+	"net/http"
+
+	"github.com/jahrulnr/go-waf/pkg/baseline"
+)
+
+// BaselineDetector flags request bodies far larger than the baseline of
+// their route, see pkg/baseline, going by Content-Length. It only scores a
+// notice, an unusual upload alone is no attack, but it tips the balance
+// when something else matches too.
+type BaselineDetector struct {
+	sampler *baseline.Sampler
+}
+
+func NewBaselineDetector(sampler *baseline.Sampler) *BaselineDetector {
+	return &BaselineDetector{sampler: sampler}
+}
+
+func (d *BaselineDetector) Inspect(r *http.Request) (int, []string) {
+	return sum(d.hits(r))
+}
+
+func (d *BaselineDetector) hits(r *http.Request) []Hit {
+	if r.ContentLength <= 0 {
+		return nil
+	}
+
+	outliers := d.sampler.Outliers(baseline.Route(r.URL.Path), baseline.Sample{RequestSize: r.ContentLength})
+	if len(outliers) == 0 {
+		return nil
+	}
+
+	return []Hit{{ID: "baseline-request-size", Score: ScoreNotice, Field: "body"}}
+}
@@ -0,0 +1,298 @@
+package rules
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+	"github.com/jahrulnr/go-waf/pkg/canonical"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+	"github.com/jahrulnr/go-waf/pkg/metrics"
+	"github.com/jahrulnr/go-waf/pkg/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// DefaultThreshold blocks on a single critical match, as the OWASP CRS
+// paranoia level 1 does.
+const DefaultThreshold = ScoreCritical
+
+type Decision int
+
+const (
+	DecisionAllow  Decision = iota
+	DecisionDetect          // the request would be blocked, but detection only mode is on
+	DecisionBlock
+)
+
+func (d Decision) String() string {
+	switch d {
+	case DecisionBlock:
+		return "block"
+	case DecisionDetect:
+		return "detect"
+	default:
+		return "allow"
+	}
+}
+
+// RuleSetProvider returns the custom rules to evaluate, either a fixed
+// *RuleSet or a *Watcher.
+type RuleSetProvider interface {
+	RuleSet() *RuleSet
+}
+
+// Engine sums the scores of every detector and custom rule matching a request
+// and blocks once the total reaches the threshold. The threshold and the
+// detection only mode can be changed while requests are evaluated.
+type Engine struct {
+	detectors     []service.DetectorInterface
+	rules         RuleSetProvider
+	threshold     atomic.Int64
+	detectionOnly atomic.Bool
+	metrics       metrics.RuleRecorder
+	cache         *ResultCache
+}
+
+func NewEngine(threshold int, detectors ...service.DetectorInterface) *Engine {
+	e := &Engine{
+		detectors: detectors,
+		metrics:   metrics.NoopRecorder{},
+	}
+	e.SetThreshold(threshold)
+
+	return e
+}
+
+// SetThreshold sets the total score blocking a request, below 1 it is
+// DefaultThreshold.
+func (e *Engine) SetThreshold(threshold int) {
+	if threshold < 1 {
+		threshold = DefaultThreshold
+	}
+	e.threshold.Store(int64(threshold))
+}
+
+// SetRules adds custom rules, a *RuleSets picks them per request. Rules
+// with action block block on their own, whatever the total.
+func (e *Engine) SetRules(rules RuleSetProvider) {
+	e.rules = rules
+}
+
+// SetDetectionOnly logs the requests that would be blocked instead of
+// blocking them.
+func (e *Engine) SetDetectionOnly(detectionOnly bool) {
+	e.detectionOnly.Store(detectionOnly)
+}
+
+// SetMetrics reports every decision and matched rule to recorder.
+func (e *Engine) SetMetrics(recorder metrics.RuleRecorder) {
+	e.metrics = recorder
+}
+
+// SetCache skips the evaluation of requests identical to one evaluated
+// shortly before, see ResultCache. The detectors must only read the request.
+func (e *Engine) SetCache(cache *ResultCache) {
+	e.cache = cache
+}
+
+func (e *Engine) Evaluate(r *http.Request) (int, Decision) {
+	total, decision, _ := e.EvaluateHits(r)
+	return total, decision
+}
+
+// EvaluateHits is Evaluate which also returns the matched rules.
+func (e *Engine) EvaluateHits(r *http.Request) (int, Decision, []Hit) {
+	_, span := tracing.Start(r.Context(), "waf.evaluate")
+	defer span.End()
+
+	_, set := e.RuleSetFor(r)
+
+	all, excluded := e.excluded(set, r)
+	if all {
+		e.metrics.RecordDecision(DecisionAllow.String())
+		span.SetAttributes(attribute.String("waf.decision", DecisionAllow.String()))
+		return 0, DecisionAllow, nil
+	}
+
+	hits, blocked := e.evaluate(r, set, excluded)
+
+	total, ids := sum(hits)
+	decision := DecisionAllow
+	if blocked || int64(total) >= e.threshold.Load() {
+		decision = DecisionBlock
+		if e.detectionOnly.Load() {
+			decision = DecisionDetect
+		}
+	}
+
+	if total > 0 {
+		logger.FromContext(r.Context()).Logger("[warn] waf ", decision.String(), " score ", total, " ", r.Method, " ", r.URL.RequestURI(), " ", ids).Warn()
+	}
+
+	e.metrics.RecordDecision(decision.String())
+	for _, id := range ids {
+		e.metrics.RecordRuleHit(id)
+	}
+	span.SetAttributes(
+		attribute.String("waf.decision", decision.String()),
+		attribute.Int("waf.score", total),
+		attribute.StringSlice("waf.rule_ids", ids),
+	)
+
+	return total, decision, hits
+}
+
+// evaluate returns the hits of r, from the cache when an identical request
+// was evaluated shortly before.
+func (e *Engine) evaluate(r *http.Request, set *RuleSet, excluded map[string]bool) ([]Hit, bool) {
+	if e.cache == nil {
+		return e.match(r, set, excluded)
+	}
+	key, ok := e.cache.key(r, set)
+	if !ok {
+		return e.match(r, set, excluded)
+	}
+	if cached, ok := e.cache.get(r, key); ok {
+		return cached.Hits, cached.Blocked
+	}
+
+	hits, blocked := e.match(r, set, excluded)
+	// stripped headers make it another request
+	if after, _ := e.cache.key(r, set); after == key {
+		e.cache.set(r, key, result{Hits: hits, Blocked: blocked})
+	}
+
+	return hits, blocked
+}
+
+// match runs the detectors and the custom rules over r, leaving out the
+// excluded ones. blocked is true when a custom rule with action block
+// matched.
+func (e *Engine) match(r *http.Request, set *RuleSet, excluded map[string]bool) ([]Hit, bool) {
+	var hits []Hit
+	for _, detector := range e.detectors {
+		if d, ok := detector.(hitter); ok {
+			hits = append(hits, d.hits(r)...)
+			continue
+		}
+
+		score, ids := detector.Inspect(r)
+		for i, id := range ids {
+			// foreign detectors only report a total, book it on the first id
+			hit := Hit{ID: id}
+			if i == 0 {
+				hit.Score = score
+			}
+			hits = append(hits, hit)
+		}
+	}
+
+	blocked := false
+	if set != nil {
+		for _, rule := range set.Match(r) {
+			if excluded[rule.ID] {
+				continue
+			}
+			hits = append(hits, Hit{ID: rule.ID, Score: rule.Score})
+			blocked = blocked || rule.Action == ActionBlock
+		}
+	}
+
+	kept := hits[:0]
+	for _, hit := range hits {
+		if !excluded[hit.ID] {
+			kept = append(kept, hit)
+		}
+	}
+	hits = kept
+
+	return hits, blocked
+}
+
+// RuleSet returns the active custom rules, the default ones of a
+// *RuleSets, nil when there are none.
+func (e *Engine) RuleSet() *RuleSet {
+	if e.rules == nil {
+		return nil
+	}
+
+	return e.rules.RuleSet()
+}
+
+// RuleSetFor returns the name and the custom rules evaluating r, nil when
+// there are none.
+func (e *Engine) RuleSetFor(r *http.Request) (string, *RuleSet) {
+	if selector, ok := e.rules.(ruleSelector); ok {
+		return selector.Select(r)
+	}
+
+	return DefaultRuleSetName, e.RuleSet()
+}
+
+// EvaluateResponse runs the response phase rules. The decision is block when
+// a matched rule has action block, the caller applies the redactions.
+func (e *Engine) EvaluateResponse(r *http.Request, header http.Header, body []byte) ([]*Rule, Decision) {
+	_, set := e.RuleSetFor(r)
+	if set == nil {
+		return nil, DecisionAllow
+	}
+
+	_, span := tracing.Start(r.Context(), "waf.evaluate_response")
+	defer span.End()
+
+	all, excluded := e.excluded(set, r)
+	if all {
+		return nil, DecisionAllow
+	}
+
+	var (
+		matched []*Rule
+		ids     []string
+		blocked bool
+	)
+	for _, rule := range set.MatchResponse(r, header, body) {
+		if excluded[rule.ID] {
+			continue
+		}
+		matched = append(matched, rule)
+		ids = append(ids, rule.ID)
+		blocked = blocked || rule.Action == ActionBlock
+	}
+
+	decision := DecisionAllow
+	if blocked {
+		decision = DecisionBlock
+		if e.detectionOnly.Load() {
+			decision = DecisionDetect
+		}
+	}
+
+	if len(matched) > 0 {
+		logger.FromContext(r.Context()).Logger("[warn] waf response ", decision.String(), " ", r.Method, " ", r.URL.RequestURI(), " ", ids).Warn()
+	}
+	for _, id := range ids {
+		e.metrics.RecordRuleHit(id)
+	}
+	span.SetAttributes(
+		attribute.String("waf.decision", decision.String()),
+		attribute.StringSlice("waf.rule_ids", ids),
+	)
+
+	return matched, decision
+}
+
+// excluded returns the rules turned off for r. Exclusions match the cleaned
+// path, so /admin/../api isn't excluded like /admin is.
+func (e *Engine) excluded(set *RuleSet, r *http.Request) (bool, map[string]bool) {
+	if set == nil {
+		return false, nil
+	}
+
+	return set.excluded(canonical.ParsePath(r.URL.EscapedPath()).Clean)
+}
+
+// DetectionOnly reports whether blocking is turned off.
+func (e *Engine) DetectionOnly() bool {
+	return e.detectionOnly.Load()
+}
@@ -0,0 +1,95 @@
+package rules
+
+import (
+	"net/http"
+	"slices"
+)
+
+// Explanation describes how the engine decides on a request, for debugging
+// false positives, see Engine.Explain.
+type Explanation struct {
+	RuleSet       string           `json:"rule_set"` // name of the custom rules evaluating the request
+	Decision      string           `json:"decision"`
+	Score         int              `json:"score"`
+	Threshold     int              `json:"threshold"`
+	DetectionOnly bool             `json:"detection_only"`
+	Hits          []Hit            `json:"hits"`
+	Blocked       bool             `json:"blocked"`            // a custom rule with action block matched, whatever the score
+	Excluded      []string         `json:"excluded,omitempty"` // rules the exclusions turn off for the path
+	ExcludedAll   bool             `json:"excluded_all"`       // an exclusion turns every rule off for the path
+	Path          string           `json:"path"`               // normalized as the path traversal rules see it
+	Fields        []ExplainedField `json:"fields"`
+}
+
+// ExplainedField is one inspected request value.
+type ExplainedField struct {
+	Name       string `json:"name"`
+	Value      string `json:"value"`      // decoded by pkg/canonical, as the SQLi and custom rules see it
+	Normalized string `json:"normalized"` // as the XSS rules see it
+}
+
+// fielder is implemented by the detectors collecting request fields.
+type fielder interface {
+	fields(r *http.Request) []field
+}
+
+// Explain evaluates r like EvaluateHits and describes the decision: the
+// fields inspected and their normalization, the matched rules and their
+// scores. Nothing is logged, cached or counted in the metrics, r is meant to
+// be a sample never forwarded. Detectors may change r, like the header
+// injection detector stripping headers.
+func (e *Engine) Explain(r *http.Request) Explanation {
+	name, set := e.RuleSetFor(r)
+	explanation := Explanation{
+		RuleSet:       name,
+		Threshold:     int(e.threshold.Load()),
+		DetectionOnly: e.detectionOnly.Load(),
+		Hits:          []Hit{},
+		Path:          normalizePath(r.URL.EscapedPath()),
+		Fields:        []ExplainedField{},
+	}
+
+	seen := make(map[field]bool)
+	for _, detector := range e.detectors {
+		d, ok := detector.(fielder)
+		if !ok {
+			continue
+		}
+		for _, f := range d.fields(r) {
+			if seen[f] {
+				continue
+			}
+			seen[f] = true
+			explanation.Fields = append(explanation.Fields, ExplainedField{
+				Name:       f.name,
+				Value:      f.value,
+				Normalized: normalize(f.value),
+			})
+		}
+	}
+
+	all, excluded := e.excluded(set, r)
+	explanation.ExcludedAll = all
+	for id := range excluded {
+		explanation.Excluded = append(explanation.Excluded, id)
+	}
+	slices.Sort(explanation.Excluded)
+
+	decision := DecisionAllow
+	if !all {
+		hits, blocked := e.match(r, set, excluded)
+		total, _ := sum(hits)
+		if blocked || int64(total) >= e.threshold.Load() {
+			decision = DecisionBlock
+			if explanation.DetectionOnly {
+				decision = DecisionDetect
+			}
+		}
+		explanation.Hits = append(explanation.Hits, hits...)
+		explanation.Score = total
+		explanation.Blocked = blocked
+	}
+	explanation.Decision = decision.String()
+
+	return explanation
+}
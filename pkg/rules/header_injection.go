@@ -0,0 +1,162 @@
+package rules
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/jahrulnr/go-waf/pkg/canonical"
+)
+
+// headerSplitPattern is a line break followed by a response header or status
+// line, what a value reflected into a header needs to split the response.
+var headerSplitPattern = regexp.MustCompile(`(?i)[\r\n]\s*(set-cookie|location|content-(type|length|security-policy)|transfer-encoding|refresh|access-control-allow-[a-z-]+|x-xss-protection|http/\d)\s*[:/]`)
+
+// lineBreakReplacer turns the other spellings of CR and LF into the real
+// ones: escape sequences some apps unescape, and U+560D/U+560A, whose low
+// bytes are CR and LF to servers truncating runes to bytes.
+var lineBreakReplacer = strings.NewReplacer(`\r`, "\r", `\n`, "\n", "嘍", "\r", "嘊", "\n")
+
+// HeaderInjectionDetector looks for CRLF injection in the request headers,
+// and in the query and form values an app might reflect into a response
+// header, and for the header combinations request smuggling relies on.
+//
+// net/http already refuses raw line breaks in headers and most ambiguous
+// framing, the raw checks matter for requests that reach the engine some
+// other way.
+type HeaderInjectionDetector struct {
+	inspector
+	strip bool
+}
+
+func NewHeaderInjectionDetector() *HeaderInjectionDetector {
+	return &HeaderInjectionDetector{
+		inspector: inspector{maxBody: DefaultMaxBodySize},
+	}
+}
+
+// SetStrip removes header values with line breaks or control characters from
+// the request instead of flagging them. Smuggling indicators and reflected
+// parameters are always flagged.
+func (d *HeaderInjectionDetector) SetStrip(strip bool) {
+	d.strip = strip
+}
+
+func (d *HeaderInjectionDetector) Inspect(r *http.Request) (int, []string) {
+	return sum(d.hits(r))
+}
+
+func (d *HeaderInjectionDetector) hits(r *http.Request) []Hit {
+	var hits []Hit
+	add := func(id string, score int, field string) {
+		for _, hit := range hits {
+			if hit.ID == id {
+				return
+			}
+		}
+		hits = append(hits, Hit{ID: id, Score: score, Field: field})
+	}
+
+	for name, values := range r.Header {
+		kept := values[:0:0]
+		for _, value := range values {
+			id, score := headerHit(name, value)
+			if id == "" {
+				kept = append(kept, value)
+				continue
+			}
+			if !d.strip {
+				add(id, score, "header:"+name)
+			}
+		}
+		if d.strip && len(kept) < len(values) {
+			if len(kept) == 0 {
+				r.Header.Del(name)
+			} else {
+				r.Header[name] = kept
+			}
+		}
+	}
+
+	for _, f := range d.fields(r) {
+		if f.name == "body" {
+			continue
+		}
+		if headerSplitPattern.MatchString(decodeLineBreaks(f.value)) {
+			add("crlf-header-split", ScoreCritical, f.name)
+		}
+	}
+
+	for _, hit := range smugglingHits(r) {
+		add(hit.ID, hit.Score, hit.Field)
+	}
+
+	return hits
+}
+
+// headerHit checks one header value, returning the rule it breaks.
+func headerHit(name string, value string) (string, int) {
+	if hasControl(name) || hasControl(value) {
+		return "header-control-char", ScoreCritical
+	}
+
+	decoded := decodeLineBreaks(value)
+	if headerSplitPattern.MatchString(decoded) {
+		return "crlf-header-split", ScoreCritical
+	}
+	if strings.ContainsAny(decoded, "\r\n") {
+		return "crlf-header-encoded", ScoreError
+	}
+
+	return "", 0
+}
+
+// hasControl reports raw control characters, tab aside, which no header
+// value carries legitimately.
+func hasControl(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if c := value[i]; (c < 0x20 && c != '\t') || c == 0x7f {
+			return true
+		}
+	}
+
+	return false
+}
+
+// decodeLineBreaks percent decodes value, possibly nested, and unifies the
+// spellings of CR and LF.
+func decodeLineBreaks(value string) string {
+	return lineBreakReplacer.Replace(canonical.Decode(value))
+}
+
+// smugglingHits flags framing that front and back servers may read
+// differently: Content-Length next to Transfer-Encoding, several or
+// malformed lengths, and transfer codings other than plain chunked.
+func smugglingHits(r *http.Request) []Hit {
+	var hits []Hit
+	lengths := r.Header.Values("Content-Length")
+	codings := r.Header.Values("Transfer-Encoding")
+	if len(codings) == 0 {
+		codings = r.TransferEncoding
+	}
+
+	if len(lengths) > 0 && len(codings) > 0 {
+		hits = append(hits, Hit{ID: "smuggling-cl-te", Score: ScoreCritical, Field: "header:Transfer-Encoding"})
+	}
+
+	for _, length := range lengths {
+		if len(lengths) > 1 || length == "" || strings.Trim(length, "0123456789") != "" {
+			hits = append(hits, Hit{ID: "smuggling-content-length", Score: ScoreCritical, Field: "header:Content-Length"})
+			break
+		}
+	}
+
+	for _, coding := range codings {
+		if coding != "chunked" {
+			hits = append(hits, Hit{ID: "smuggling-transfer-encoding", Score: ScoreCritical, Field: "header:Transfer-Encoding"})
+			break
+		}
+	}
+
+	return hits
+}
@@ -0,0 +1,25 @@
+package rules
+
+import (
+	"html"
+	"strings"
+
+	"github.com/jahrulnr/go-waf/pkg/canonical"
+)
+
+// normalize undoes URL and HTML entity encoding, possibly nested, lowercases
+// the result and drops the control characters browsers ignore inside
+// keywords (java\tscript:).
+func normalize(value string) string {
+	for range canonical.MaxPasses {
+		decoded := canonical.Decode(strings.ReplaceAll(html.UnescapeString(value), "+", " "))
+		if decoded == value {
+			break
+		}
+		value = decoded
+	}
+
+	return controlReplacer.Replace(strings.ToLower(value))
+}
+
+var controlReplacer = strings.NewReplacer("\t", "", "\n", "", "\r", "", "\x00", "")
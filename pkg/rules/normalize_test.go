@@ -0,0 +1,121 @@
+package rules
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{name: "plain", value: "hello", want: "hello"},
+		{name: "url encoded", value: "%3Cscript%3E", want: "<script>"},
+		{name: "double url encoded", value: "%253Cscript%253E", want: "<script>"},
+		{name: "triple url encoded", value: "%25253Cscript%25253E", want: "<script>"},
+		{name: "html entities", value: "&lt;script&gt;", want: "<script>"},
+		{name: "entity inside url encoding", value: "%26lt%3Bscript%26gt%3B", want: "<script>"},
+		{name: "iis unicode escape", value: "%u003Cscript%u003E", want: "<script>"},
+		{name: "malformed escape keeps the rest", value: "%zz%3Cscript%3E", want: "%zz<script>"},
+		{name: "mixed case", value: "JaVaScRiPt:AlErT(1)", want: "javascript:alert(1)"},
+		{name: "null byte", value: "java\x00script:", want: "javascript:"},
+		{name: "encoded null byte", value: "java%00script:", want: "javascript:"},
+		{name: "tab and newlines", value: "java\tscr\r\nipt:", want: "javascript:"},
+		{name: "plus is a space", value: "a+b", want: "a b"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := normalize(test.value); got != test.want {
+				t.Errorf("normalize(%q) = %q, want %q", test.value, got, test.want)
+			}
+		})
+	}
+}
+
+func TestNormalizePath(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{name: "plain", value: "/static/app.js", want: "/static/app.js"},
+		{name: "encoded dots", value: "/%2e%2e/%2E%2E/etc/passwd", want: "/../../etc/passwd"},
+		{name: "double encoded slash", value: "/static/..%252f..%252fetc/passwd", want: "/static/../../etc/passwd"},
+		{name: "backslashes", value: `/static/..\..\windows\win.ini`, want: "/static/../../windows/win.ini"},
+		{name: "encoded backslash", value: "/static/..%5c..%5cwin.ini", want: "/static/../../win.ini"},
+		{name: "overlong utf-8", value: "/static/%c0%ae%c0%ae%c0%afetc", want: "/static/../etc"},
+		{name: "path parameter", value: "/static/..;/..;/etc/passwd", want: "/static/../../etc/passwd"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := normalizePath(test.value); got != test.want {
+				t.Errorf("normalizePath(%q) = %q, want %q", test.value, got, test.want)
+			}
+		})
+	}
+}
+
+// TestNormalizedMatch checks the detectors and the custom rules see through
+// the encodings: every target is one a rule only matches once normalized.
+func TestNormalizedMatch(t *testing.T) {
+	set := &RuleSet{
+		Rules: []*Rule{
+			{ID: "admin", Target: TargetURI, Regex: `^/admin(/|\?|$)`, Score: ScoreCritical, Action: ActionBlock},
+		},
+		maxBody: DefaultMaxBodySize,
+	}
+	if err := set.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		detector interface{ hits(*http.Request) []Hit }
+		target   string
+		want     string // the rule id, empty for no match
+	}{
+		{name: "xss double encoded", detector: NewXSSDetector(nil), target: "/?q=%253CScRiPt%253Ealert(1)", want: "xss-script-tag"},
+		{name: "xss entity encoded", detector: NewXSSDetector(nil), target: "/?q=%26lt%3Bscript%26gt%3B", want: "xss-script-tag"},
+		{name: "xss mixed case uri", detector: NewXSSDetector(nil), target: "/?next=JaVaScRiPt:x", want: "xss-script-uri"},
+		{name: "xss null byte", detector: NewXSSDetector(nil), target: "/?next=java%00script:x", want: "xss-script-uri"},
+		{name: "xss benign", detector: NewXSSDetector(nil), target: "/?q=%253Cb%253E", want: ""},
+
+		{name: "traversal double encoded", detector: NewPathTraversalDetector(), target: "/static/..%252f..%252fetc/passwd", want: "lfi-traversal"},
+		{name: "traversal encoded dots", detector: NewPathTraversalDetector(), target: "/static/%2E%2e/%2e%2E/etc/hosts", want: "lfi-traversal"},
+		{name: "traversal in a parameter", detector: NewPathTraversalDetector(), target: "/?file=..%255c..%255cwin.ini", want: "lfi-traversal"},
+		{name: "null byte in a parameter", detector: NewPathTraversalDetector(), target: "/download?file=report.pdf%2500.php", want: "lfi-null-byte"},
+		{name: "traversal benign", detector: NewPathTraversalDetector(), target: "/static/app..min.js", want: ""},
+
+		{name: "rule on the plain path", detector: set, target: "/admin", want: "admin"},
+		{name: "rule after collapsing dot segments", detector: set, target: "/public/../admin", want: "admin"},
+		{name: "rule after collapsing encoded dot segments", detector: set, target: "/public/%2e%2e/admin/users", want: "admin"},
+		{name: "rule after double decoding", detector: set, target: "/public/..%252fadmin", want: "admin"},
+		{name: "rule after collapsing slashes", detector: set, target: "//admin/./", want: "admin"},
+		{name: "rule after dropping path parameters", detector: set, target: "/admin;jsessionid=1", want: "admin"},
+		{name: "rule after decoding letters", detector: set, target: "/%61dmin?x=1", want: "admin"},
+		{name: "rule benign", detector: set, target: "/public/admin", want: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://example.com"+test.target, nil)
+
+			var ids []string
+			for _, hit := range test.detector.hits(r) {
+				ids = append(ids, hit.ID)
+			}
+			if test.want == "" && len(ids) > 0 {
+				t.Errorf("matched %v, want no match", ids)
+			}
+			if test.want != "" && !slices.Contains(ids, test.want) {
+				t.Errorf("matched %v, want %s", ids, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package rules
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/jahrulnr/go-waf/pkg/canonical"
+)
+
+// DefaultSuspiciousSchemes are the stream wrappers used for file inclusion.
+var DefaultSuspiciousSchemes = []string{"php", "file", "zip", "phar", "data", "expect", "glob", "jar", "zlib", "compress.zlib"}
+
+var (
+	traversalPattern = regexp.MustCompile(`(^|/)\.\.(/|$)`)
+	sensitivePattern = regexp.MustCompile(`(?i)(^|/)(etc/(passwd|shadow|group|hosts|issue)|proc/(self|\d+)/|(windows|winnt)/(win\.ini|system32)|boot\.ini|\.ssh/|\.htpasswd|web\.config)`)
+	absolutePattern  = regexp.MustCompile(`(?i)^(/|[a-z]:/|//)`)
+)
+
+// fileParams are parameter names which usually carry a file name.
+var fileParams = map[string]bool{
+	"file": true, "filename": true, "path": true, "filepath": true, "page": true,
+	"include": true, "inc": true, "template": true, "tpl": true, "doc": true,
+	"document": true, "dir": true, "folder": true, "load": true, "view": true,
+	"lang": true, "module": true, "src": true,
+}
+
+// PathTraversalDetector looks for directory traversal and local file
+// inclusion in the request path and file name parameters.
+type PathTraversalDetector struct {
+	inspector
+	wrapper *regexp.Regexp
+}
+
+func NewPathTraversalDetector() *PathTraversalDetector {
+	d := &PathTraversalDetector{
+		inspector: inspector{maxBody: DefaultMaxBodySize},
+	}
+	d.SetSchemes(DefaultSuspiciousSchemes)
+
+	return d
+}
+
+// SetSchemes replaces the list of inclusion wrappers to flag, e.g. php for
+// php://filter.
+func (d *PathTraversalDetector) SetSchemes(schemes []string) {
+	quoted := make([]string, len(schemes))
+	for i, scheme := range schemes {
+		quoted[i] = regexp.QuoteMeta(strings.ToLower(scheme))
+	}
+	d.wrapper = regexp.MustCompile(`(^|[^a-z0-9.+-])(` + strings.Join(quoted, "|") + `)://`)
+}
+
+func (d *PathTraversalDetector) Inspect(r *http.Request) (int, []string) {
+	score, matched, _ := d.InspectPath(r)
+	return score, matched
+}
+
+func (d *PathTraversalDetector) hits(r *http.Request) []Hit {
+	hits, _ := d.inspectPath(r)
+	return hits
+}
+
+// InspectPath is Inspect which also returns the normalized request path the
+// verdict was based on, for logging.
+func (d *PathTraversalDetector) InspectPath(r *http.Request) (int, []string, string) {
+	hits, normalized := d.inspectPath(r)
+	score, matched := sum(hits)
+
+	return score, matched, normalized
+}
+
+func (d *PathTraversalDetector) inspectPath(r *http.Request) ([]Hit, string) {
+	normalized := normalizePath(r.URL.EscapedPath())
+	values := []field{{name: "path", value: normalized}}
+	for _, f := range d.fields(r) {
+		if f.name == "path" {
+			// resolved, the traversal no longer shows
+			continue
+		}
+		_, name, _ := strings.Cut(f.name, ":")
+		values = append(values, field{name: name, value: normalizePath(f.value)})
+	}
+
+	var hits []Hit
+	add := func(id string, score int) {
+		for _, hit := range hits {
+			if hit.ID == id {
+				return
+			}
+		}
+		hits = append(hits, Hit{ID: id, Score: score})
+	}
+
+	for _, f := range values {
+		if strings.Contains(f.value, "\x00") {
+			add("lfi-null-byte", ScoreCritical)
+		}
+		if traversalPattern.MatchString(f.value) {
+			add("lfi-traversal", ScoreCritical)
+		}
+		if sensitivePattern.MatchString(f.value) {
+			add("lfi-sensitive-file", ScoreCritical)
+		}
+		if d.wrapper.MatchString(strings.ToLower(f.value)) {
+			add("lfi-wrapper", ScoreCritical)
+		}
+		if f.name != "path" && fileParams[strings.ToLower(f.name)] && absolutePattern.MatchString(f.value) {
+			add("lfi-absolute-path", ScoreWarning)
+		}
+	}
+
+	return hits, normalized
+}
+
+// normalizePath repeatedly percent decodes value, undoes overlong UTF-8,
+// turns backslashes into slashes and drops path parameters, so every
+// spelling of ../, ..;/ included, looks the same.
+func normalizePath(value string) string {
+	return canonical.ParsePath(value).Decoded
+}
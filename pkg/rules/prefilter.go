@@ -0,0 +1,299 @@
+package rules
+
+import (
+	"regexp"
+	"regexp/syntax"
+	"slices"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// maxPrefilterStates bounds the automaton, at most 1KB per state.
+	// Expressions whose literals don't fit any more run on every value.
+	maxPrefilterStates = 4096
+
+	// maxLiterals is how many alternatives an expression may be reduced to,
+	// past it the expression runs on every value.
+	maxLiterals = 32
+)
+
+// prefilter picks the regular expressions worth running on a value. Every
+// expression is reduced at load to literals one of which each of its
+// matches contains, and a single Aho-Corasick scan of the value finds the
+// literals it holds. Only the expressions whose literals were found, and
+// the ones without any, are run, so a value the rules can't match costs one
+// pass instead of a regular expression per rule. Matching is case
+// insensitive for ASCII only, so the literals of (?i) expressions are cut at
+// the letters folding to other runes, like k to the Kelvin sign.
+//
+// A prefilter is built once and never changed, goroutines share it.
+type prefilter struct {
+	always bitset     // expressions without literals
+	width  int32      // transitions per state, one per byte class
+	class  [256]int32 // byte, ASCII lowercased, to its class, 0 for bytes in no literal
+	delta  []int32    // next state by state*width + class
+	output [][]int    // expressions whose literal ends at each state
+}
+
+// bitset holds one bit per expression, a nil bitset holds every expression.
+type bitset []uint64
+
+func newBitset(size int) bitset {
+	return make(bitset, (size+63)/64)
+}
+
+func (b bitset) set(i int) {
+	b[i/64] |= 1 << (i % 64)
+}
+
+func (b bitset) has(i int) bool {
+	return b == nil || b[i/64]&(1<<(i%64)) != 0
+}
+
+func newPrefilter(expressions []*regexp.Regexp) *prefilter {
+	p := &prefilter{always: newBitset(len(expressions))}
+
+	type entry struct {
+		literal     string
+		expressions []int
+	}
+	var entries []entry
+	index := make(map[string]int)
+	for i, re := range expressions {
+		literals := requiredLiterals(re.String())
+		if literals == nil {
+			p.always.set(i)
+			continue
+		}
+		for _, literal := range literals {
+			at, ok := index[literal]
+			if !ok {
+				at = len(entries)
+				index[literal] = at
+				entries = append(entries, entry{literal: literal})
+			}
+			entries[at].expressions = append(entries[at].expressions, i)
+		}
+	}
+
+	// one class per byte in the literals, the rest share class 0
+	for _, e := range entries {
+		for i := 0; i < len(e.literal); i++ {
+			b := e.literal[i]
+			if p.class[b] == 0 {
+				p.width++
+				p.class[b] = p.width
+			}
+		}
+	}
+	p.width++
+	for b := 'A'; b <= 'Z'; b++ {
+		p.class[b] = p.class[b+'a'-'A']
+	}
+
+	// the trie, with -1 for missing transitions
+	p.delta = slices.Repeat([]int32{-1}, int(p.width))
+	p.output = [][]int{nil}
+	for _, e := range entries {
+		state := int32(0)
+		for i := 0; i < len(e.literal); i++ {
+			at := state*p.width + p.class[e.literal[i]]
+			if p.delta[at] < 0 {
+				if len(p.output) == maxPrefilterStates {
+					// out of room, the expressions left behind always run
+					for _, expression := range e.expressions {
+						p.always.set(expression)
+					}
+					state = -1
+					break
+				}
+				p.delta[at] = int32(len(p.output))
+				p.delta = append(p.delta, slices.Repeat([]int32{-1}, int(p.width))...)
+				p.output = append(p.output, nil)
+			}
+			state = p.delta[at]
+		}
+		if state >= 0 {
+			p.output[state] = append(p.output[state], e.expressions...)
+		}
+	}
+
+	// breadth first, turning the trie into a DFA along the failure links
+	fail := make([]int32, len(p.output))
+	queue := make([]int32, 0, len(p.output))
+	for c := int32(0); c < p.width; c++ {
+		if next := p.delta[c]; next > 0 {
+			queue = append(queue, next)
+		} else {
+			p.delta[c] = 0
+		}
+	}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		p.output[state] = append(p.output[state], p.output[fail[state]]...)
+		for c := int32(0); c < p.width; c++ {
+			at := state*p.width + c
+			if next := p.delta[at]; next >= 0 {
+				fail[next] = p.delta[fail[state]*p.width+c]
+				queue = append(queue, next)
+			} else {
+				p.delta[at] = p.delta[fail[state]*p.width+c]
+			}
+		}
+	}
+	for state, expressions := range p.output {
+		slices.Sort(expressions)
+		p.output[state] = slices.Compact(expressions)
+	}
+
+	return p
+}
+
+// candidates returns the expressions that may match value, every one for a
+// nil prefilter.
+func (p *prefilter) candidates(value string) bitset {
+	if p == nil {
+		return nil
+	}
+
+	found := slices.Clone(p.always)
+	state := int32(0)
+	for i := 0; i < len(value); i++ {
+		state = p.delta[state*p.width+p.class[value[i]]]
+		for _, expression := range p.output[state] {
+			found.set(expression)
+		}
+	}
+
+	return found
+}
+
+// requiredLiterals returns ASCII lowercased literals one of which every
+// match of expr contains, nil when it has none worth scanning for.
+func requiredLiterals(expr string) []string {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return nil
+	}
+
+	return required(re.Simplify())
+}
+
+func required(re *syntax.Regexp) []string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if literal := longestSegment(re.Rune, re.Flags&syntax.FoldCase != 0); literal != "" {
+			return []string{literal}
+		}
+	case syntax.OpCharClass:
+		return classLiterals(re.Rune)
+	case syntax.OpCapture, syntax.OpPlus:
+		return required(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Min > 0 {
+			return required(re.Sub[0])
+		}
+	case syntax.OpConcat:
+		// the part with the longest literals picks the fewest values
+		var best []string
+		for _, sub := range re.Sub {
+			if literals := required(sub); literals != nil && (best == nil || shortest(literals) > shortest(best)) {
+				best = literals
+			}
+		}
+		return best
+	case syntax.OpAlternate:
+		var all []string
+		for _, sub := range re.Sub {
+			literals := required(sub)
+			if literals == nil {
+				return nil
+			}
+			for _, literal := range literals {
+				if !slices.Contains(all, literal) {
+					all = append(all, literal)
+				}
+			}
+			if len(all) > maxLiterals {
+				return nil
+			}
+		}
+		return all
+	}
+
+	return nil
+}
+
+// longestSegment returns the longest run of runes of a literal that ASCII
+// lowercasing matches safely, cutting a case folded literal at the runes
+// folding to something else than their ASCII case pair.
+func longestSegment(runes []rune, fold bool) string {
+	var longest, current []byte
+	for _, r := range runes {
+		if fold && !asciiFold(r) {
+			current = current[:0]
+			continue
+		}
+		current = utf8.AppendRune(current, lowerASCII(r))
+		if len(current) > len(longest) {
+			longest = slices.Clone(current)
+		}
+	}
+
+	return string(longest)
+}
+
+// asciiFold reports whether every rune r folds to is ASCII, or r folds to
+// nothing else.
+func asciiFold(r rune) bool {
+	if unicode.SimpleFold(r) == r {
+		return true
+	}
+	for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+		if f >= utf8.RuneSelf {
+			return false
+		}
+	}
+
+	return r < utf8.RuneSelf
+}
+
+// classLiterals returns the runes of a small character class.
+func classLiterals(ranges []rune) []string {
+	var literals []string
+	for i := 0; i+1 < len(ranges); i += 2 {
+		if ranges[i+1]-ranges[i] >= maxLiterals {
+			return nil
+		}
+		for r := ranges[i]; r <= ranges[i+1]; r++ {
+			literal := string(lowerASCII(r))
+			if !slices.Contains(literals, literal) {
+				literals = append(literals, literal)
+			}
+			if len(literals) > 4 {
+				return nil
+			}
+		}
+	}
+
+	return literals
+}
+
+func lowerASCII(r rune) rune {
+	if 'A' <= r && r <= 'Z' {
+		return r + 'a' - 'A'
+	}
+
+	return r
+}
+
+func shortest(literals []string) int {
+	length := len(literals[0])
+	for _, literal := range literals[1:] {
+		length = min(length, len(literal))
+	}
+
+	return length
+}
@@ -0,0 +1,246 @@
+package rules
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// prefilterRules exercise what requiredLiterals reduces: case folding, runes
+// folding outside ASCII (the Kelvin sign to k, the long s to s), classes,
+// alternations, repeats and expressions without any literal.
+var prefilterRules = []string{
+	`(?i)<script`,
+	`(?i)\bunion\s+(all\s+)?select\b`,
+	`(?i)(sleep|benchmark)\s*\(`,
+	`(?i)/etc/(passwd|shadow|hosts)`,
+	`(?i)\.\./`,
+	`(?i)kelvin`,
+	`(?i)class\b`,
+	`(?i)ſelect`,
+	`(?i)(?:wp-admin|wp-login\.php|xmlrpc\.php)`,
+	`(?i)on(error|load|mouseover)\s*=`,
+	`[<>]`,
+	`[a-c]x[0-9]`,
+	`['"]\s*or\s*['"]`,
+	`(ab)+cd`,
+	`x{2,}y`,
+	`(?i)données`,
+	`(?i)é`,
+	`(?i)^/admin(/|$)`,
+	`\$\{jndi:`,
+	`(?i)(cmd|powershell)\.exe`,
+	`\d{4}-\d{4}-\d{4}-\d{4}`,
+	`^.{200,}$`,
+	`[a-z]{30}`,
+	`.`,
+	`(?i)(a|b|c|d|e|f|g|h|i|j|k|l|m|n|o|p|q|r|s|t|u|v|w|x|y|z|0|1|2|3|4|5|6|7|8|9)zz`,
+}
+
+// prefilterCorpus holds the values the prefilter and the expressions are
+// compared on, malicious and benign, with their case and folding variants.
+var prefilterCorpus = []string{
+	"",
+	"hello world",
+	"<SCRIPT>alert(1)</script>",
+	"<scr<script>ipt>",
+	"1 UNION ALL SELECT null",
+	"1 union/**/select 1",
+	"and sleep (5)",
+	"BENCHMARK(1000,md5(1))",
+	"../../etc/passwd",
+	"..\\..\\ETC\\SHADOW",
+	"KELVIN",
+	"Kelvin",
+	"first class",
+	"CLAſſ",
+	"ſELECT",
+	"select",
+	"SELECT",
+	"/wp-admin/",
+	"/WP-LOGIN.PHP",
+	"<img src=x OnError=alert(1)>",
+	"a < b",
+	"bx7",
+	"' OR '",
+	"\" or \"",
+	"ababcd",
+	"xxy",
+	"xy",
+	"DONNÉES",
+	"données",
+	"É",
+	"/admin",
+	"/Admin/users",
+	"/administrator",
+	"${jndi:ldap://x}",
+	"CMD.EXE /c dir",
+	"4111-1111-1111-1111",
+	strings.Repeat("a", 250),
+	strings.Repeat("abcdefghij", 4),
+	"9zz",
+	"Zz",
+	"\xff\xfe invalid utf-8 \xc0\xae",
+	"john.doe@example.com",
+	"rock and roll",
+	"price >= 100",
+}
+
+// randomValues builds values from fragments of the rules, so literals land
+// next to, inside and across each other.
+func randomValues(n int) []string {
+	fragments := []string{
+		"<", ">", "script", "SCRIPT", "union", " ", "select", "ſ", "K", "elvin",
+		"(", "sleep", "../", "etc/", "passwd", "on", "error", "=", "'", "\"", "or",
+		"ab", "cd", "x", "y", "é", "É", "/admin", "${jndi:", "a", "zz", "1", "-",
+	}
+	random := rand.New(rand.NewSource(1))
+	values := make([]string, n)
+	for i := range values {
+		var b strings.Builder
+		for range 1 + random.Intn(8) {
+			b.WriteString(fragments[random.Intn(len(fragments))])
+		}
+		values[i] = b.String()
+	}
+
+	return values
+}
+
+func compileAll(exprs []string) []*regexp.Regexp {
+	expressions := make([]*regexp.Regexp, len(exprs))
+	for i, expr := range exprs {
+		expressions[i] = regexp.MustCompile(expr)
+	}
+
+	return expressions
+}
+
+// TestPrefilterEquivalence checks the prefilter only ever skips expressions
+// that don't match: every match of an expression is among the candidates.
+func TestPrefilterEquivalence(t *testing.T) {
+	sets := map[string][]*regexp.Regexp{
+		"custom": compileAll(prefilterRules),
+	}
+	for name, patterns := range map[string][]pattern{"sqli": sqliPatterns, "xss": xssPatterns} {
+		for _, p := range patterns {
+			sets[name] = append(sets[name], p.re)
+		}
+	}
+
+	values := append(slices.Clone(prefilterCorpus), randomValues(2000)...)
+	for name, expressions := range sets {
+		t.Run(name, func(t *testing.T) {
+			filter := newPrefilter(expressions)
+			skipped := 0
+			for _, value := range values {
+				for _, variant := range []string{value, normalize(value)} {
+					candidates := filter.candidates(variant)
+					for i, re := range expressions {
+						if !candidates.has(i) {
+							skipped++
+							if re.MatchString(variant) {
+								t.Errorf("%s skipped on %q, which it matches", re, variant)
+							}
+						}
+					}
+				}
+			}
+			if skipped == 0 {
+				t.Error("the prefilter never skipped an expression")
+			}
+		})
+	}
+}
+
+// TestPrefilterVerdicts compares the hits of the detectors and of a rule
+// set with and without the prefilter on whole requests.
+func TestPrefilterVerdicts(t *testing.T) {
+	set, regexOnly := prefilterSets(t)
+	sqliRegexOnly := &patternSet{patterns: sqliPatterns}
+	xssRegexOnly := &patternSet{patterns: xssPatterns}
+
+	for _, value := range append(slices.Clone(prefilterCorpus), randomValues(500)...) {
+		r := prefilterRequest(value)
+		fields := requestFields(r, nil, DefaultMaxBodySize)
+		normalized := make([]field, len(fields))
+		for i, f := range fields {
+			normalized[i] = field{name: f.name, value: normalize(f.value)}
+		}
+
+		if got, want := sqliSet.match(fields), sqliRegexOnly.match(fields); !slices.Equal(got, want) {
+			t.Errorf("sqli on %q: %v, want %v", value, got, want)
+		}
+		if got, want := xssSet.match(normalized), xssRegexOnly.match(normalized); !slices.Equal(got, want) {
+			t.Errorf("xss on %q: %v, want %v", value, got, want)
+		}
+		if got, want := set.hits(r), regexOnly.hits(r); !slices.Equal(got, want) {
+			t.Errorf("rules on %q: %v, want %v", value, got, want)
+		}
+	}
+}
+
+// prefilterSets returns a rule set of prefilterRules and a copy of it
+// without prefilter, running every expression.
+func prefilterSets(t testing.TB) (*RuleSet, *RuleSet) {
+	set := NewRuleSet()
+	for i, expr := range prefilterRules {
+		set.Rules = append(set.Rules, &Rule{ID: fmt.Sprintf("rule-%d", i), Target: TargetURI, Regex: expr, Score: 1})
+	}
+	if err := set.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	regexOnly := *set
+	regexOnly.filter = nil
+
+	return set, &regexOnly
+}
+
+func prefilterRequest(value string) *http.Request {
+	return httptest.NewRequest(http.MethodGet, "/search?q="+url.QueryEscape(value), nil)
+}
+
+// BenchmarkInspect runs the built in patterns and a rule set over a mostly
+// benign traffic mix, with the prefilter and with every expression run.
+func BenchmarkInspect(b *testing.B) {
+	set, regexOnly := prefilterSets(b)
+
+	var requests []*http.Request
+	for _, value := range prefilterCorpus {
+		requests = append(requests, prefilterRequest(value))
+	}
+	for range 4 * len(prefilterCorpus) {
+		requests = append(requests, prefilterRequest("page=2&sort=price&lang=en&q=blue running shoes"))
+	}
+	fields := make([][]field, len(requests))
+	for i, r := range requests {
+		fields[i] = requestFields(r, nil, DefaultMaxBodySize)
+	}
+
+	benchmarks := []struct {
+		name  string
+		sqli  *patternSet
+		xss   *patternSet
+		rules *RuleSet
+	}{
+		{name: "prefilter", sqli: sqliSet, xss: xssSet, rules: set},
+		{name: "regex", sqli: &patternSet{patterns: sqliPatterns}, xss: &patternSet{patterns: xssPatterns}, rules: regexOnly},
+	}
+	for _, benchmark := range benchmarks {
+		b.Run(benchmark.name, func(b *testing.B) {
+			for i := range b.N {
+				at := i % len(requests)
+				benchmark.sqli.match(fields[at])
+				benchmark.xss.match(fields[at])
+				benchmark.rules.hits(requests[at])
+			}
+		})
+	}
+}
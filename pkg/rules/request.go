@@ -0,0 +1,146 @@
+package rules
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/jahrulnr/go-waf/pkg/canonical"
+	"github.com/jahrulnr/go-waf/pkg/graphql"
+	"github.com/jahrulnr/go-waf/pkg/upload"
+)
+
+// DefaultMaxBodySize is how much of a request body is inspected.
+const DefaultMaxBodySize int64 = 64 << 10
+
+// field is one inspected request value, named after where it came from, for
+// example path, param:jsessionid, query:id, form:comment, header:User-Agent
+// body, graphql:users.filter.name or file:avatar, the name of an uploaded
+// file.
+type field struct {
+	name  string
+	value string
+}
+
+// requestFields collects the canonical path, the path and query parameters,
+// the form or text body and the given headers of r, decoded by pkg/canonical
+// so an unusual encoding doesn't hide a payload. Only the copies inspected
+// are decoded, the upstream receives the request as sent, and the body is
+// restored for it. A GraphQL request parsed by pkg/graphql is inspected by
+// its argument values instead of its query and body, a multipart body parsed
+// by pkg/upload by its form values and file names.
+func requestFields(r *http.Request, headers []string, maxBody int64) []field {
+	arguments, isGraphQL := graphql.FromContext(r.Context())
+
+	requestPath := canonical.ParsePath(r.URL.EscapedPath())
+	fields := []field{{name: "path", value: requestPath.Clean}}
+	fields = appendValues(fields, "param:", requestPath.Params)
+	query := canonical.Query(r.URL.RawQuery)
+	if isGraphQL {
+		delete(query, "query")
+		delete(query, "variables")
+	}
+	fields = appendValues(fields, "query:", query)
+
+	for _, name := range headers {
+		for _, value := range r.Header.Values(name) {
+			fields = append(fields, field{name: "header:" + name, value: value})
+		}
+	}
+
+	if isGraphQL {
+		for _, argument := range arguments {
+			fields = append(fields, field{name: "graphql:" + argument.Name, value: argument.Value})
+		}
+		return fields
+	}
+
+	if parts, ok := upload.FromContext(r.Context()); ok {
+		for _, part := range parts {
+			prefix := "form:"
+			if part.File {
+				prefix = "file:"
+			}
+			fields = append(fields, field{name: prefix + part.Name, value: part.Value})
+		}
+		return fields
+	}
+
+	return append(fields, bodyFields(r, maxBody)...)
+}
+
+func bodyFields(r *http.Request, maxBody int64) []field {
+	mediaType, body := textBody(r, maxBody)
+	if len(body) == 0 {
+		return nil
+	}
+
+	if mediaType == "application/x-www-form-urlencoded" {
+		return appendValues(nil, "form:", canonical.Query(string(body)))
+	}
+
+	return []field{{name: "body", value: string(body)}}
+}
+
+func appendValues(fields []field, prefix string, values map[string][]string) []field {
+	for name, list := range values {
+		for _, value := range list {
+			fields = append(fields, field{name: prefix + name, value: value})
+		}
+	}
+
+	return fields
+}
+
+// textBody returns the media type and the first maxBody bytes of a textual
+// body. Binary and unreadable bodies are skipped, except for a body cut by
+// http.MaxBytesReader (pkg/limits) whose first bytes are still inspected.
+func textBody(r *http.Request, maxBody int64) (string, []byte) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return "", nil
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if !isTextual(mediaType) {
+		return mediaType, nil
+	}
+
+	body, err := peekBody(r, maxBody)
+	var tooLarge *http.MaxBytesError
+	if err != nil && !errors.As(err, &tooLarge) {
+		return mediaType, nil
+	}
+
+	return mediaType, body
+}
+
+func isTextual(mediaType string) bool {
+	return strings.HasPrefix(mediaType, "text/") ||
+		mediaType == "application/x-www-form-urlencoded" ||
+		mediaType == "application/json" ||
+		mediaType == "application/xml"
+}
+
+// peekBody reads up to maxBody bytes and puts them back in front of the rest
+// of the body.
+func peekBody(r *http.Request, maxBody int64) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBody))
+	r.Body = &replayBody{
+		Reader: io.MultiReader(bytes.NewReader(body), r.Body),
+		closer: r.Body,
+	}
+
+	return body, err
+}
+
+type replayBody struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (b *replayBody) Close() error {
+	return b.closer.Close()
+}
@@ -0,0 +1,113 @@
+package rules
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/jahrulnr/go-waf/internal/interface/repository"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+	"github.com/jahrulnr/go-waf/pkg/metrics"
+)
+
+// ResultCache keeps the matched rules of bodyless requests for a short TTL,
+// so a burst of identical requests is evaluated once. The key covers
+// everything the detectors and rules read: the method, the host, the URI as
+// sent, every header, the rule set in use and the scope, the settings of
+// the detectors. A request differing in a single byte is evaluated on its
+// own, a cached allow never covers another request.
+//
+// Only the hits are kept, the decision is taken again from the current
+// threshold and detection only mode. Requests with a body, whose inspection
+// depends on more than the key, and requests changed while evaluated, e.g.
+// by stripped headers, are never cached.
+type ResultCache struct {
+	store   repository.StateStore
+	ttl     time.Duration
+	scope   string
+	metrics metrics.RuleCacheRecorder
+}
+
+func NewResultCache(store repository.StateStore, ttl time.Duration, scope string) *ResultCache {
+	return &ResultCache{
+		store:   store,
+		ttl:     ttl,
+		scope:   scope,
+		metrics: metrics.NoopRecorder{},
+	}
+}
+
+// SetMetrics reports every lookup, hit or miss, to recorder.
+func (c *ResultCache) SetMetrics(recorder metrics.RuleCacheRecorder) {
+	c.metrics = recorder
+}
+
+// result is what is cached of an evaluation.
+type result struct {
+	Hits    []Hit `json:"hits"`
+	Blocked bool  `json:"blocked,omitempty"` // a custom rule with action block matched
+}
+
+// key returns the cache key of r, false when r can't be cached.
+func (c *ResultCache) key(r *http.Request, set *RuleSet) (string, bool) {
+	if r.ContentLength != 0 || len(r.TransferEncoding) > 0 || r.Body != nil && r.Body != http.NoBody {
+		return "", false
+	}
+
+	sum := sha256.New()
+	write(sum, c.scope)
+	if set != nil {
+		write(sum, set.version)
+	}
+	write(sum, r.Method)
+	write(sum, r.Host)
+	write(sum, r.URL.RequestURI())
+
+	names := make([]string, 0, len(r.Header))
+	for name := range r.Header {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		write(sum, name)
+		write(sum, strconv.Itoa(len(r.Header[name])))
+		for _, value := range r.Header[name] {
+			write(sum, value)
+		}
+	}
+
+	return "waf-result-" + hex.EncodeToString(sum.Sum(nil)), true
+}
+
+// write adds value to sum with its length, so no two lists of values hash
+// the same.
+func write(sum hash.Hash, value string) {
+	sum.Write([]byte(strconv.Itoa(len(value)) + ":" + value))
+}
+
+func (c *ResultCache) get(r *http.Request, key string) (result, bool) {
+	var cached result
+	value, ok := c.store.StateContext(r.Context()).Get(key)
+	if ok && json.Unmarshal(value, &cached) == nil {
+		c.metrics.RecordRuleCache("hit")
+		return cached, true
+	}
+
+	c.metrics.RecordRuleCache("miss")
+	return result{}, false
+}
+
+func (c *ResultCache) set(r *http.Request, key string, cached result) {
+	value, err := json.Marshal(cached)
+	if err != nil {
+		return
+	}
+	if err := c.store.StateContext(r.Context()).Set(key, value, c.ttl); err != nil {
+		logger.FromContext(r.Context()).Logger("[warn] fail to cache waf result ", err.Error()).Warn()
+	}
+}
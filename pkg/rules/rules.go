@@ -0,0 +1,105 @@
+package rules
+
+import (
+	"net/http"
+	"regexp"
+)
+
+// Rule severities, following the OWASP CRS anomaly scores.
+const (
+	ScoreCritical = 5
+	ScoreError    = 4
+	ScoreWarning  = 3
+	ScoreNotice   = 2
+)
+
+// Hit is one matched rule and the score it contributes.
+type Hit struct {
+	ID    string `json:"id"`
+	Score int    `json:"score"`
+	Field string `json:"field,omitempty"` // where it matched, e.g. header:Referer or query:id, empty when unknown
+}
+
+// hitter is implemented by the detectors of this package. The engine uses it
+// to drop excluded rules one by one.
+type hitter interface {
+	hits(r *http.Request) []Hit
+}
+
+// sum folds hits into the Inspect result.
+func sum(hits []Hit) (int, []string) {
+	var (
+		score int
+		ids   []string
+	)
+	for _, hit := range hits {
+		score += hit.Score
+		ids = append(ids, hit.ID)
+	}
+
+	return score, ids
+}
+
+type pattern struct {
+	id    string
+	re    *regexp.Regexp
+	score int
+}
+
+// patternSet holds patterns and the prefilter picking the ones worth running
+// on a value.
+type patternSet struct {
+	patterns []pattern
+	filter   *prefilter
+}
+
+func newPatternSet(patterns []pattern) *patternSet {
+	expressions := make([]*regexp.Regexp, len(patterns))
+	for i, p := range patterns {
+		expressions[i] = p.re
+	}
+
+	return &patternSet{patterns: patterns, filter: newPrefilter(expressions)}
+}
+
+// match runs the patterns over fields. Every pattern counts once per
+// request, on the first field it matches, no matter how many it matches.
+func (s *patternSet) match(fields []field) []Hit {
+	first := make([]int, len(s.patterns))
+	for i := range first {
+		first[i] = -1
+	}
+	for j, f := range fields {
+		candidates := s.filter.candidates(f.value)
+		for i, p := range s.patterns {
+			if first[i] < 0 && candidates.has(i) && p.re.MatchString(f.value) {
+				first[i] = j
+			}
+		}
+	}
+
+	var hits []Hit
+	for i, p := range s.patterns {
+		if first[i] >= 0 {
+			hits = append(hits, Hit{ID: p.id, Score: p.score, Field: fields[first[i]].name})
+		}
+	}
+
+	return hits
+}
+
+// inspector holds what every detector needs to collect request fields.
+type inspector struct {
+	headers []string
+	maxBody int64
+}
+
+func (i *inspector) fields(r *http.Request) []field {
+	return requestFields(r, i.headers, i.maxBody)
+}
+
+// SetMaxBodySize limits how much of the body is read, DefaultMaxBodySize
+// when unset.
+func (i *inspector) SetMaxBodySize(size int64) {
+	i.maxBody = size
+}
@@ -0,0 +1,362 @@
+package rules
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/jahrulnr/go-waf/pkg/canonical"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	PhaseRequest  = "request"
+	PhaseResponse = "response"
+
+	TargetURI    = "uri"
+	TargetHeader = "header" // every header, or header:Name for a single one
+	TargetBody   = "body"
+
+	ActionLog    = "log"
+	ActionBlock  = "block"
+	ActionRedact = "redact" // response phase only, masks the matched text
+)
+
+// Rule is a custom detection pattern loaded from YAML.
+type Rule struct {
+	ID     string `yaml:"id"`
+	Phase  string `yaml:"phase"`  // request (default) or response
+	Target string `yaml:"target"` // uri, header, header:Name or body
+	Regex  string `yaml:"regex"`
+	Score  int    `yaml:"score"`
+	Action string `yaml:"action"` // log (default), block or redact
+
+	re *regexp.Regexp
+}
+
+// Exclusion turns off rules for the paths matching Path, a glob (* stays
+// within a segment, ** crosses them) or a regular expression prefixed with
+// "regex:". No rules means every rule.
+type Exclusion struct {
+	Path  string   `yaml:"path"`
+	Rules []string `yaml:"rules"`
+
+	re *regexp.Regexp
+}
+
+// RuleSet is a validated list of rules and exclusions. Reloading builds a new
+// RuleSet instead of changing one in use.
+type RuleSet struct {
+	Rules      []*Rule      `yaml:"rules"`
+	Exclusions []*Exclusion `yaml:"exclusions"`
+
+	maxBody int64
+	filter  *prefilter // over the expressions of Rules, by index
+	version string     // hash of the rules file and the exclusions added, evaluations cached with another are ignored
+}
+
+// NewRuleSet returns an empty set, for exclusions added from code.
+func NewRuleSet() *RuleSet {
+	return &RuleSet{maxBody: DefaultMaxBodySize}
+}
+
+// LoadFromYAML reads and validates a rule file. Nothing is returned unless
+// every rule is valid.
+func LoadFromYAML(path string) (*RuleSet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	set := NewRuleSet()
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(set); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	if err := set.compile(); err != nil {
+		return nil, fmt.Errorf("load %s: %w", path, err)
+	}
+	set.version = versionOf(data)
+
+	return set, nil
+}
+
+func (s *RuleSet) compile() error {
+	ids := make(map[string]bool, len(s.Rules))
+	for i, rule := range s.Rules {
+		if rule.ID == "" {
+			return fmt.Errorf("rule %d has no id", i)
+		}
+		if ids[rule.ID] {
+			return fmt.Errorf("rule %s is defined twice", rule.ID)
+		}
+		ids[rule.ID] = true
+
+		if rule.Phase == "" {
+			rule.Phase = PhaseRequest
+		}
+		if rule.Phase != PhaseRequest && rule.Phase != PhaseResponse {
+			return fmt.Errorf("rule %s has unknown phase %q", rule.ID, rule.Phase)
+		}
+
+		kind, _, _ := strings.Cut(rule.Target, ":")
+		if kind != TargetURI && kind != TargetHeader && kind != TargetBody {
+			return fmt.Errorf("rule %s has unknown target %q", rule.ID, rule.Target)
+		}
+
+		if rule.Action == "" {
+			rule.Action = ActionLog
+		}
+		if rule.Action != ActionLog && rule.Action != ActionBlock &&
+			(rule.Action != ActionRedact || rule.Phase != PhaseResponse) {
+			return fmt.Errorf("rule %s has unknown action %q", rule.ID, rule.Action)
+		}
+
+		if rule.Score < 0 {
+			return fmt.Errorf("rule %s has a negative score", rule.ID)
+		}
+
+		re, err := regexp.Compile(rule.Regex)
+		if err != nil {
+			return fmt.Errorf("rule %s: %w", rule.ID, err)
+		}
+		rule.re = re
+	}
+
+	for _, exclusion := range s.Exclusions {
+		re, err := compileExclusion(exclusion.Path)
+		if err != nil {
+			return err
+		}
+		exclusion.re = re
+	}
+
+	expressions := make([]*regexp.Regexp, len(s.Rules))
+	for i, rule := range s.Rules {
+		expressions[i] = rule.re
+	}
+	s.filter = newPrefilter(expressions)
+
+	return nil
+}
+
+// AddExclusion suppresses ruleIDs, or every rule when ruleIDs is empty, for
+// requests whose path matches pathPattern. It must not be called on a set in
+// use, reload the YAML file instead.
+func (s *RuleSet) AddExclusion(pathPattern string, ruleIDs []string) error {
+	re, err := compileExclusion(pathPattern)
+	if err != nil {
+		return err
+	}
+
+	s.Exclusions = append(s.Exclusions, &Exclusion{Path: pathPattern, Rules: ruleIDs, re: re})
+	s.version = versionOf([]byte(s.version + "\n" + pathPattern + " " + strings.Join(ruleIDs, ",")))
+	return nil
+}
+
+func versionOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// excluded returns the rules turned off for requestPath, all is true when
+// every rule is.
+func (s *RuleSet) excluded(requestPath string) (all bool, ids map[string]bool) {
+	ids = make(map[string]bool)
+	for _, exclusion := range s.Exclusions {
+		if !exclusion.re.MatchString(requestPath) {
+			continue
+		}
+		if len(exclusion.Rules) == 0 {
+			return true, nil
+		}
+		for _, id := range exclusion.Rules {
+			if id == "*" {
+				return true, nil
+			}
+			ids[id] = true
+		}
+	}
+
+	return false, ids
+}
+
+func compileExclusion(pathPattern string) (*regexp.Regexp, error) {
+	if pathPattern == "" {
+		return nil, errors.New("exclusion has no path")
+	}
+
+	re, err := CompilePathPattern(pathPattern)
+	if err != nil {
+		return nil, fmt.Errorf("exclusion %s: %w", pathPattern, err)
+	}
+
+	return re, nil
+}
+
+// CompilePathPattern compiles a path pattern as the exclusions take it: a
+// glob where * matches within a path segment, ** across segments and ? one
+// character, or a regular expression after regex:.
+func CompilePathPattern(pathPattern string) (*regexp.Regexp, error) {
+	if expr, ok := strings.CutPrefix(pathPattern, "regex:"); ok {
+		return regexp.Compile(expr)
+	}
+
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i := 0; i < len(pathPattern); i++ {
+		switch {
+		case strings.HasPrefix(pathPattern[i:], "**"):
+			expr.WriteString(".*")
+			i++
+		case pathPattern[i] == '*':
+			expr.WriteString("[^/]*")
+		case pathPattern[i] == '?':
+			expr.WriteString("[^/]")
+		default:
+			expr.WriteString(regexp.QuoteMeta(pathPattern[i : i+1]))
+		}
+	}
+	expr.WriteString("$")
+
+	return regexp.Compile(expr.String())
+}
+
+// Match returns the request phase rules matching r.
+func (s *RuleSet) Match(r *http.Request) []*Rule {
+	var (
+		body []byte
+		read bool
+	)
+	return s.match(PhaseRequest, r, r.Header, func() []byte {
+		if !read {
+			_, body = textBody(r, s.maxBody)
+			read = true
+		}
+		return body
+	})
+}
+
+// MatchResponse returns the response phase rules matching the response to r.
+// body must already be decoded.
+func (s *RuleSet) MatchResponse(r *http.Request, header http.Header, body []byte) []*Rule {
+	return s.match(PhaseResponse, r, header, func() []byte {
+		return body
+	})
+}
+
+// HasResponseRules reports whether responses need to be buffered at all.
+func (s *RuleSet) HasResponseRules() bool {
+	for _, rule := range s.Rules {
+		if rule.Phase == PhaseResponse {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Redact masks the text matched by rule in body.
+func (rule *Rule) Redact(body []byte) []byte {
+	return rule.re.ReplaceAll(body, []byte("[REDACTED]"))
+}
+
+func (s *RuleSet) match(phase string, r *http.Request, header http.Header, body func() []byte) []*Rule {
+	// rules sharing a target share its values and their scan
+	type scanned struct {
+		values     []string
+		candidates []bitset
+	}
+	targets := make(map[string]scanned)
+
+	var matched []*Rule
+	for i, rule := range s.Rules {
+		if rule.Phase != phase {
+			continue
+		}
+
+		target, ok := targets[rule.Target]
+		if !ok {
+			target.values = targetValues(rule.Target, r, header, body)
+			for _, value := range target.values {
+				target.candidates = append(target.candidates, s.filter.candidates(value))
+			}
+			targets[rule.Target] = target
+		}
+
+		for j, value := range target.values {
+			if value != "" && target.candidates[j].has(i) && rule.re.MatchString(value) {
+				matched = append(matched, rule)
+				break
+			}
+		}
+	}
+
+	return matched
+}
+
+// targetValues returns the values a rule of target matches on.
+func targetValues(target string, r *http.Request, header http.Header, body func() []byte) []string {
+	kind, name, _ := strings.Cut(target, ":")
+	switch kind {
+	case TargetURI:
+		values := []string{r.URL.RequestURI()}
+		if decoded, err := url.PathUnescape(r.URL.RequestURI()); err == nil {
+			values = append(values, decoded)
+		}
+		return append(values, canonical.URI(r.URL))
+	case TargetHeader:
+		return headerValues(header, name)
+	case TargetBody:
+		return []string{string(body())}
+	}
+
+	return nil
+}
+
+// Inspect scores the request phase rules, like the built in detectors do.
+func (s *RuleSet) Inspect(r *http.Request) (int, []string) {
+	return sum(s.hits(r))
+}
+
+func (s *RuleSet) hits(r *http.Request) []Hit {
+	var hits []Hit
+	for _, rule := range s.Match(r) {
+		hits = append(hits, Hit{ID: rule.ID, Score: rule.Score})
+	}
+
+	return hits
+}
+
+// RuleSet returns s itself, so a fixed set can be used where a Watcher is.
+func (s *RuleSet) RuleSet() *RuleSet {
+	return s
+}
+
+// headerValues returns the values of one header, or of all headers rendered
+// as "Name: value" when name is empty.
+func headerValues(header http.Header, name string) []string {
+	if name != "" {
+		return header.Values(name)
+	}
+
+	var values []string
+	for key, list := range header {
+		for _, value := range list {
+			values = append(values, key+": "+value)
+		}
+	}
+
+	return values
+}
@@ -0,0 +1,92 @@
+package rules
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/jahrulnr/go-waf/pkg/canonical"
+)
+
+// DefaultRuleSetName names the rules of the requests no named set selects.
+const DefaultRuleSetName = "default"
+
+// ruleSelector is a RuleSetProvider picking the rules of each request, like
+// RuleSets.
+type ruleSelector interface {
+	Select(r *http.Request) (string, *RuleSet)
+}
+
+// RuleSets picks the custom rules of a request by its host and path, so the
+// apps behind one WAF are tuned apart and the exclusions of one don't weaken
+// the protection of another. A set selecting the host of a request wins over
+// the sets selecting any host, then the longest path prefix wins. The
+// requests no set selects get the default rules. Each set keeps its own
+// provider, e.g. a *Watcher reloading its own file.
+type RuleSets struct {
+	fallback RuleSetProvider
+	scopes   []scope // host first, then the longest prefix first
+}
+
+type scope struct {
+	name   string
+	host   string // lowercased without port, empty for every host
+	prefix string
+	rules  RuleSetProvider
+}
+
+// NewRuleSets evaluates the requests no set selects with fallback, nil for
+// no custom rules.
+func NewRuleSets(fallback RuleSetProvider) *RuleSets {
+	return &RuleSets{fallback: fallback}
+}
+
+// Add evaluates the requests to host, every host when empty, whose cleaned
+// path starts with prefix with rules, reported as name.
+func (s *RuleSets) Add(name string, host string, prefix string, rules RuleSetProvider) *RuleSets {
+	s.scopes = append(s.scopes, scope{
+		name:   name,
+		host:   hostname(host),
+		prefix: prefix,
+		rules:  rules,
+	})
+	sort.SliceStable(s.scopes, func(i, j int) bool {
+		if (s.scopes[i].host != "") != (s.scopes[j].host != "") {
+			return s.scopes[i].host != ""
+		}
+		return len(s.scopes[i].prefix) > len(s.scopes[j].prefix)
+	})
+
+	return s
+}
+
+// RuleSet returns the default rules.
+func (s *RuleSets) RuleSet() *RuleSet {
+	if s.fallback == nil {
+		return nil
+	}
+
+	return s.fallback.RuleSet()
+}
+
+// Select returns the name and the rules of the set evaluating r.
+func (s *RuleSets) Select(r *http.Request) (string, *RuleSet) {
+	host := hostname(r.Host)
+	path := canonical.ParsePath(r.URL.EscapedPath()).Clean
+	for _, scope := range s.scopes {
+		if (scope.host == "" || scope.host == host) && strings.HasPrefix(path, scope.prefix) {
+			return scope.name, scope.rules.RuleSet()
+		}
+	}
+
+	return DefaultRuleSetName, s.RuleSet()
+}
+
+func hostname(host string) string {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+
+	return strings.ToLower(host)
+}
@@ -0,0 +1,63 @@
+package rules
+
+import (
+	"net/http"
+	"regexp"
+)
+
+var sqliPatterns = []pattern{
+	{
+		// ' or 1=1, " and "a"="a, or true
+		id:    "sqli-tautology",
+		re:    regexp.MustCompile(`(?i)(\b(or|and)\s+['"]?\w+['"]?\s*(=|<>|!=|<|>|\blike\b)\s*['"]?\w+|['"]\s*(or|and)\s+['"]?[^'"]*['"]?\s*=|\bor\s+(true|1)\b)`),
+		score: ScoreCritical,
+	},
+	{
+		id:    "sqli-union",
+		re:    regexp.MustCompile(`(?i)\bunion\b(\s|/\*.*?\*/|\()+(all\b|distinct\b)?(\s|/\*.*?\*/|\()*select\b`),
+		score: ScoreCritical,
+	},
+	{
+		// a comment right after closing a string or bracket, or an inline one
+		id:    "sqli-comment",
+		re:    regexp.MustCompile(`(['")]\s*(--|#)|/\*!?.*?\*/)`),
+		score: ScoreWarning,
+	},
+	{
+		id:    "sqli-stacked",
+		re:    regexp.MustCompile(`(?i);\s*(select|insert|update|delete|drop|alter|create|truncate|exec|execute|shutdown|declare)\b`),
+		score: ScoreCritical,
+	},
+	{
+		id:    "sqli-function",
+		re:    regexp.MustCompile(`(?i)(\b(sleep|benchmark|pg_sleep|load_file|extractvalue|updatexml)\s*\(|\bwaitfor\s+delay\b|\binto\s+(out|dump)file\b|\binformation_schema\b|\bxp_cmdshell\b)`),
+		score: ScoreCritical,
+	},
+}
+
+var sqliSet = newPatternSet(sqliPatterns)
+
+// SQLiDetector looks for SQL injection in query strings, form bodies and the
+// configured headers.
+type SQLiDetector struct {
+	inspector
+}
+
+// NewSQLiDetector creates a detector which also inspects the given headers.
+func NewSQLiDetector(headers []string) *SQLiDetector {
+	return &SQLiDetector{
+		inspector: inspector{headers: headers, maxBody: DefaultMaxBodySize},
+	}
+}
+
+func (d *SQLiDetector) Inspect(r *http.Request) (int, []string) {
+	return sum(d.hits(r))
+}
+
+func (d *SQLiDetector) hits(r *http.Request) []Hit {
+	return sqliSet.match(d.fields(r))
+}
+
+func (d *SQLiDetector) streamHits(fields []field) []Hit {
+	return sqliSet.match(fields)
+}
@@ -0,0 +1,160 @@
+package rules_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/jahrulnr/go-waf/pkg/rules"
+)
+
+var sqliMalicious = []string{
+	"' or 1=1 --",
+	"admin' OR '1'='1",
+	"\" or \"a\"=\"a",
+	"1 or true",
+	"1 AND 1=1",
+	"1' and 'x' like 'x",
+	"1 UNION SELECT username, password FROM users",
+	"1 union all select null,null,null",
+	"1 UnIoN/**/SeLeCt 1,2,3",
+	"-1 union(select 1)",
+	"1'; DROP TABLE users; --",
+	"1; exec xp_cmdshell('dir')",
+	"1); shutdown",
+	"1 and sleep(5)",
+	"1 or benchmark(1000000,md5(1))",
+	"1'; waitfor delay '0:0:5' --",
+	"1 and pg_sleep(10)",
+	"select load_file('/etc/passwd')",
+	"1 and extractvalue(1,concat(0x7e,version()))",
+	"select * from information_schema.tables",
+	"1 into outfile '/var/www/shell.php'",
+	"1'/*!50000union*/",
+	"admin')#",
+}
+
+var sqliBenign = []string{
+	"hello world",
+	"john.doe@example.com",
+	"The quick brown fox jumps over the lazy dog",
+	"Tom & Jerry",
+	"rock and roll",
+	"either this or that",
+	"select a size",
+	"union station",
+	"O'Brien",
+	"it's a nice day, isn't it?",
+	"2024-01-31",
+	"+1 (555) 123-4567",
+	"price >= 100",
+	"C# and F# developers",
+	"drop shipping",
+	"I want to update my profile",
+	"delete my account please",
+	"sleep well",
+	"benchmarks are fun",
+	"order by price desc",
+	"50% off; today only",
+	"a/b/c",
+	"search terms: cats, dogs",
+	"1,2,3",
+	"SELECT is a keyword",
+}
+
+func sqliRequest(value string) *http.Request {
+	return httptest.NewRequest(http.MethodGet, "/search?q="+url.QueryEscape(value), nil)
+}
+
+// TestSQLiCorpus checks every malicious sample is caught, most of them
+// blocking on their own while a lone comment only warns, and measures the
+// false positives on the benign ones.
+func TestSQLiCorpus(t *testing.T) {
+	detector := rules.NewSQLiDetector(nil)
+
+	blocked := 0
+	for _, sample := range sqliMalicious {
+		score, matched := detector.Inspect(sqliRequest(sample))
+		if score == 0 {
+			t.Errorf("%q: not detected", sample)
+		}
+		if score >= rules.DefaultThreshold {
+			blocked++
+		} else {
+			t.Logf("%q: score %d %v, below the threshold", sample, score, matched)
+		}
+	}
+	if blocked < len(sqliMalicious)-2 {
+		t.Errorf("%d of %d malicious samples reach the threshold", blocked, len(sqliMalicious))
+	}
+
+	falsePositives := 0
+	for _, sample := range sqliBenign {
+		if score, matched := detector.Inspect(sqliRequest(sample)); score > 0 {
+			falsePositives++
+			t.Logf("false positive %q: score %d %v", sample, score, matched)
+		}
+	}
+	rate := float64(falsePositives) / float64(len(sqliBenign))
+	t.Logf("false positive rate %.1f%% (%d of %d)", rate*100, falsePositives, len(sqliBenign))
+	if rate > 0.05 {
+		t.Errorf("false positive rate %.1f%%, want at most 5%%", rate*100)
+	}
+}
+
+func TestSQLiFields(t *testing.T) {
+	payload := "1 union select password from users"
+	tests := []struct {
+		name    string
+		headers []string
+		request func() *http.Request
+		want    bool
+	}{
+		{
+			name: "query",
+			request: func() *http.Request {
+				return sqliRequest(payload)
+			},
+			want: true,
+		},
+		{
+			name: "form body",
+			request: func() *http.Request {
+				r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader("user="+url.QueryEscape(payload)))
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				return r
+			},
+			want: true,
+		},
+		{
+			name:    "configured header",
+			headers: []string{"X-Search"},
+			request: func() *http.Request {
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				r.Header.Set("X-Search", payload)
+				return r
+			},
+			want: true,
+		},
+		{
+			name: "header not configured",
+			request: func() *http.Request {
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				r.Header.Set("X-Search", payload)
+				return r
+			},
+			want: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			score, matched := rules.NewSQLiDetector(test.headers).Inspect(test.request())
+			if got := score > 0; got != test.want {
+				t.Errorf("score %d %v, want match %v", score, matched, test.want)
+			}
+		})
+	}
+}
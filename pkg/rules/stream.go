@@ -0,0 +1,220 @@
+package rules
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/jahrulnr/go-waf/pkg/canonical"
+	"github.com/jahrulnr/go-waf/pkg/graphql"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+	"github.com/jahrulnr/go-waf/pkg/upload"
+)
+
+// ErrBodyBlocked is returned reading a streamed body once the rules block
+// its request, failing the upstream request.
+var ErrBodyBlocked = errors.New("request body blocked by the waf")
+
+const (
+	DefaultStreamWindow   = 4 << 10
+	DefaultStreamMaxBytes = 10 << 20
+)
+
+// StreamOptions configures the body streaming. Zero values take the defaults
+// noted on each field.
+type StreamOptions struct {
+	Window   int   // bytes of the previous read scanned again with the next one, matches up to this long are caught across reads, default DefaultStreamWindow
+	MaxBytes int64 // bytes of a body scanned at most, the rest is forwarded unread, default DefaultStreamMaxBytes
+}
+
+// bodyStreamer is implemented by the detectors able to inspect a body a
+// window at a time.
+type bodyStreamer interface {
+	streamHits(fields []field) []Hit
+}
+
+// BodyScanner inspects a request body while the upstream reads it, so the
+// body is never held whole: every read is scanned with the tail of the one
+// before by the SQLi and XSS detectors and the custom body rules. Once the
+// score reaches the threshold, or a body rule with action block matches,
+// reading fails with ErrBodyBlocked and the upstream gets no more of it.
+type BodyScanner struct {
+	engine   *Engine
+	set      *RuleSet
+	body     io.ReadCloser
+	options  StreamOptions
+	form     bool
+	excluded map[string]bool
+	request  string // method and URI, for the log
+
+	mu       sync.Mutex
+	tail     []byte
+	scanned  int64
+	hits     []Hit
+	blocked  bool // a custom rule with action block matched
+	decision Decision
+}
+
+// StreamBody replaces the body of r with a BodyScanner. hits are the rules
+// the request already matched, they keep counting and aren't counted again.
+// It returns nil for bodies not worth streaming: empty, binary, parsed as
+// GraphQL or multipart, or short enough for the request phase to have read
+// them whole.
+func (e *Engine) StreamBody(r *http.Request, hits []Hit, options StreamOptions) *BodyScanner {
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength >= 0 && r.ContentLength <= DefaultMaxBodySize {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if !isTextual(mediaType) {
+		return nil
+	}
+	if _, ok := graphql.FromContext(r.Context()); ok {
+		return nil
+	}
+	if _, ok := upload.FromContext(r.Context()); ok {
+		return nil
+	}
+	if options.Window <= 0 {
+		options.Window = DefaultStreamWindow
+	}
+	if options.MaxBytes <= 0 {
+		options.MaxBytes = DefaultStreamMaxBytes
+	}
+
+	_, set := e.RuleSetFor(r)
+	_, excluded := e.excluded(set, r)
+	s := &BodyScanner{
+		engine:   e,
+		set:      set,
+		body:     r.Body,
+		options:  options,
+		form:     mediaType == "application/x-www-form-urlencoded",
+		excluded: excluded,
+		hits:     slices.Clone(hits),
+		request:  r.Method + " " + r.URL.RequestURI(),
+	}
+	r.Body = s
+
+	return s
+}
+
+func (s *BodyScanner) Read(p []byte) (int, error) {
+	if s.Blocked() {
+		return 0, ErrBodyBlocked
+	}
+
+	n, err := s.body.Read(p)
+	if n > 0 && s.scan(p[:n]) {
+		return 0, ErrBodyBlocked
+	}
+
+	return n, err
+}
+
+func (s *BodyScanner) Close() error {
+	return s.body.Close()
+}
+
+// Blocked reports whether the body was blocked.
+func (s *BodyScanner) Blocked() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.decision == DecisionBlock
+}
+
+// Result returns the score, the decision and the matched rules of the whole
+// request, what was read of the body included.
+func (s *BodyScanner) Result() (int, Decision, []Hit) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	total, _ := sum(s.hits)
+	return total, s.decision, s.hits
+}
+
+// scan inspects chunk after the tail of the previous reads and reports
+// whether the request is now blocked.
+func (s *BodyScanner) scan(chunk []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.scanned >= s.options.MaxBytes || s.decision != DecisionAllow {
+		return s.decision == DecisionBlock
+	}
+	chunk = chunk[:min(int64(len(chunk)), s.options.MaxBytes-s.scanned)]
+	s.scanned += int64(len(chunk))
+
+	window := string(s.tail) + string(chunk)
+	fields := []field{{name: "body", value: window}}
+	decoded := window
+	if s.form {
+		decoded = strings.ReplaceAll(decoded, "+", " ")
+	}
+	if decoded = canonical.Decode(decoded); decoded != window {
+		fields = append(fields, field{name: "body", value: decoded})
+	}
+	if len(window) > s.options.Window {
+		window = window[len(window)-s.options.Window:]
+	}
+	s.tail = append(s.tail[:0], window...)
+
+	var found []Hit
+	for _, detector := range s.engine.detectors {
+		if d, ok := detector.(bodyStreamer); ok {
+			found = append(found, d.streamHits(fields)...)
+		}
+	}
+	if s.set != nil {
+		for i, rule := range s.set.Rules {
+			if rule.Phase != PhaseRequest || rule.Target != TargetBody || s.excluded[rule.ID] {
+				continue
+			}
+			for _, f := range fields {
+				if s.set.filter.candidates(f.value).has(i) && rule.re.MatchString(f.value) {
+					found = append(found, Hit{ID: rule.ID, Score: rule.Score, Field: "body"})
+					s.blocked = s.blocked || rule.Action == ActionBlock
+					break
+				}
+			}
+		}
+	}
+
+	var added []string
+	for _, hit := range found {
+		if s.excluded[hit.ID] || s.has(hit.ID) {
+			continue
+		}
+		s.hits = append(s.hits, hit)
+		added = append(added, hit.ID)
+		s.engine.metrics.RecordRuleHit(hit.ID)
+	}
+	if len(added) == 0 {
+		return false
+	}
+
+	total, ids := sum(s.hits)
+	if s.blocked || int64(total) >= s.engine.threshold.Load() {
+		s.decision = DecisionBlock
+		if s.engine.detectionOnly.Load() {
+			s.decision = DecisionDetect
+		}
+	}
+	logger.Logger("[warn] waf body ", s.decision.String(), " score ", total, " ", s.request, " ", ids).Warn()
+
+	return s.decision == DecisionBlock
+}
+
+func (s *BodyScanner) has(id string) bool {
+	for _, hit := range s.hits {
+		if hit.ID == id {
+			return true
+		}
+	}
+
+	return false
+}
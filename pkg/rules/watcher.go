@@ -0,0 +1,70 @@
+package rules
+
+import (
+	"net/http"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/jahrulnr/go-waf/pkg/filewatch"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+)
+
+// Watcher keeps the RuleSet loaded from a YAML file up to date. Requests in
+// flight keep the set they started with, a reload only swaps the pointer.
+type Watcher struct {
+	path    string
+	current atomic.Pointer[RuleSet]
+	watcher *filewatch.Watcher
+}
+
+// NewWatcher loads path and reloads it whenever it changes. The initial load
+// must succeed, later invalid versions are logged and ignored.
+func NewWatcher(path string) (*Watcher, error) {
+	set, err := LoadFromYAML(path)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Watcher{path: filepath.Clean(path)}
+	w.current.Store(set)
+
+	w.watcher, err = filewatch.New(path, w.reload)
+	if err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// RuleSet returns the active rule set.
+func (w *Watcher) RuleSet() *RuleSet {
+	return w.current.Load()
+}
+
+func (w *Watcher) Inspect(r *http.Request) (int, []string) {
+	return w.RuleSet().Inspect(r)
+}
+
+func (w *Watcher) Close() error {
+	return w.watcher.Close()
+}
+
+func (w *Watcher) reload() {
+	if err := w.Reload(); err != nil {
+		logger.Logger("[error] keep previous rules, reload failed ", err.Error()).Error()
+	}
+}
+
+// Reload loads the file again right away, keeping the current rules when it
+// is invalid.
+func (w *Watcher) Reload() error {
+	set, err := LoadFromYAML(w.path)
+	if err != nil {
+		return err
+	}
+
+	w.current.Store(set)
+	logger.Logger("[info] reloaded rules from ", w.path).Info()
+
+	return nil
+}
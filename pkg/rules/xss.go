@@ -0,0 +1,100 @@
+package rules
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// xssPatterns run on normalized, lowercase values.
+var xssPatterns = []pattern{
+	{
+		id:    "xss-script-tag",
+		re:    regexp.MustCompile(`<\s*/?\s*script\b`),
+		score: ScoreCritical,
+	},
+	{
+		id:    "xss-script-uri",
+		re:    regexp.MustCompile(`\b(javascript|vbscript|livescript)\s*:|\bdata\s*:\s*text/html`),
+		score: ScoreCritical,
+	},
+	{
+		// onerror=, onload= inside a tag or after breaking out of an attribute
+		id:    "xss-event-handler",
+		re:    regexp.MustCompile(`(<[^>]*[\s/"']|["'][\s/]*)on[a-z]{3,}\s*=`),
+		score: ScoreCritical,
+	},
+	{
+		id:    "xss-dangerous-tag",
+		re:    regexp.MustCompile(`<\s*(iframe|frame|object|embed|svg|math|img|body|style|link|meta|base|form|applet)\b`),
+		score: ScoreWarning,
+	},
+	{
+		id:    "xss-dom-sink",
+		re:    regexp.MustCompile(`\b(alert|prompt|confirm|eval)\s*\(|\bdocument\s*\.\s*(cookie|domain|write)|\bwindow\s*\.\s*location|\bstring\s*\.\s*fromcharcode|\bexpression\s*\(`),
+		score: ScoreError,
+	},
+}
+
+var xssSet = newPatternSet(xssPatterns)
+
+// XSSDetector looks for script injection in query strings, text or form
+// bodies and the configured headers.
+type XSSDetector struct {
+	inspector
+	exempt map[string]bool
+}
+
+// NewXSSDetector creates a detector which also inspects the given headers.
+func NewXSSDetector(headers []string) *XSSDetector {
+	return &XSSDetector{
+		inspector: inspector{headers: headers, maxBody: DefaultMaxBodySize},
+		exempt:    make(map[string]bool),
+	}
+}
+
+// Exempt skips fields known to legitimately contain HTML. Names are query or
+// form parameter names, or header:Name for headers.
+func (d *XSSDetector) Exempt(names ...string) {
+	for _, name := range names {
+		d.exempt[name] = true
+	}
+}
+
+func (d *XSSDetector) Inspect(r *http.Request) (int, []string) {
+	return sum(d.hits(r))
+}
+
+func (d *XSSDetector) hits(r *http.Request) []Hit {
+	var fields []field
+	for _, f := range d.fields(r) {
+		if d.isExempt(f.name) {
+			continue
+		}
+		fields = append(fields, field{name: f.name, value: normalize(f.value)})
+	}
+
+	return xssSet.match(fields)
+}
+
+func (d *XSSDetector) streamHits(fields []field) []Hit {
+	if d.isExempt("body") {
+		return nil
+	}
+
+	normalized := make([]field, len(fields))
+	for i, f := range fields {
+		normalized[i] = field{name: f.name, value: normalize(f.value)}
+	}
+
+	return xssSet.match(normalized)
+}
+
+func (d *XSSDetector) isExempt(name string) bool {
+	if d.exempt[name] {
+		return true
+	}
+
+	kind, param, _ := strings.Cut(name, ":")
+	return kind != "header" && d.exempt[param]
+}
@@ -0,0 +1,233 @@
+package scan
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jahrulnr/go-waf/internal/interface/repository"
+	"github.com/jahrulnr/go-waf/internal/interface/service"
+	"github.com/jahrulnr/go-waf/pkg/audit"
+	"github.com/jahrulnr/go-waf/pkg/block"
+	"github.com/jahrulnr/go-waf/pkg/bot"
+	"github.com/jahrulnr/go-waf/pkg/clientip"
+	"github.com/jahrulnr/go-waf/pkg/dryrun"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Actions taken on clients found scanning.
+const (
+	ActionLog       = "log"
+	ActionRateLimit = "ratelimit"
+	ActionChallenge = "challenge"
+	ActionBan       = "ban"
+)
+
+// ScanningKey is the gin context key set to true for scanning clients.
+const ScanningKey = "scan.scanning"
+
+// DefaultStatuses are the responses a directory or parameter fuzzer mostly
+// gets.
+var DefaultStatuses = []int{http.StatusForbidden, http.StatusNotFound}
+
+// Options configures the detection. Zero values take the defaults noted on
+// each field.
+type Options struct {
+	Window      time.Duration // default 1m
+	Threshold   int64         // error responses per window a scan takes at least, default 20
+	Ratio       float64       // share of error responses from 0 to 1 a scan takes at least, default 0.5
+	Statuses    []int         // responses counted as errors, default DefaultStatuses
+	Action      string        // log, ratelimit, challenge or ban, default log
+	Limit       int64         // requests per window left to scanners by the ratelimit action, default 10
+	BanDuration time.Duration // default 1h
+}
+
+// Detector tells an active scan from a few broken links by the error
+// responses a client gets: a scan makes many requests in a short time, most
+// of them for paths and parameters the app doesn't have. Counters are kept in
+// the cache, so instances sharing it see the same rates.
+type Detector struct {
+	options Options
+	cache   repository.StateStore
+	autoBan service.AutoBanInterface
+	audit   *audit.Logger
+	dryRun  *dryrun.DryRun
+}
+
+func NewDetector(cache repository.StateStore, options Options) *Detector {
+	if options.Window <= 0 {
+		options.Window = time.Minute
+	}
+	if options.Threshold <= 0 {
+		options.Threshold = 20
+	}
+	if options.Ratio <= 0 || options.Ratio > 1 {
+		options.Ratio = 0.5
+	}
+	if len(options.Statuses) == 0 {
+		options.Statuses = DefaultStatuses
+	}
+	switch options.Action {
+	case ActionRateLimit, ActionChallenge, ActionBan:
+	default:
+		options.Action = ActionLog
+	}
+	if options.Limit <= 0 {
+		options.Limit = 10
+	}
+	if options.BanDuration <= 0 {
+		options.BanDuration = time.Hour
+	}
+
+	return &Detector{options: options, cache: cache}
+}
+
+// SetAutoBan sets where the ban action bans scanners, without it they are
+// only logged.
+func (d *Detector) SetAutoBan(autoBan service.AutoBanInterface) {
+	d.autoBan = autoBan
+}
+
+// SetAudit writes every escalation to the audit log.
+func (d *Detector) SetAudit(audit *audit.Logger) {
+	d.audit = audit
+}
+
+// SetDryRun forwards the scanners the action would stop, only reporting them.
+func (d *Detector) SetDryRun(dryRun *dryrun.DryRun) {
+	d.dryRun = dryRun
+}
+
+// Scanning reports whether errors out of total requests in the window make a
+// scan, both the count and the share have to be reached.
+func (d *Detector) Scanning(errors, total int64) bool {
+	if errors < d.options.Threshold || total <= 0 {
+		return false
+	}
+
+	return float64(errors)/float64(total) >= d.options.Ratio
+}
+
+// count adds the request to the counters of ip, returning the requests and
+// the error responses of the window so far.
+func (d *Detector) count(r *http.Request, ip string) (total int64, errors int64) {
+	cache := d.cache.StateContext(r.Context())
+	total, err := cache.Increment("gowaf-scan-total-"+ip, 1, d.options.Window)
+	if err != nil {
+		logger.FromContext(r.Context()).Logger("[warn] fail to count scan requests ", ip, err.Error()).Warn()
+		return 0, 0
+	}
+	// an Increment by 0 reads the counter, missing ones start at 0
+	errors, err = cache.Increment("gowaf-scan-errors-"+ip, 0, d.options.Window)
+	if err != nil {
+		logger.FromContext(r.Context()).Logger("[warn] fail to count scan errors ", ip, err.Error()).Warn()
+		return total, 0
+	}
+
+	return total, errors
+}
+
+// countError adds an error response to the counter of ip.
+func (d *Detector) countError(r *http.Request, ip string) {
+	if _, err := d.cache.StateContext(r.Context()).Increment("gowaf-scan-errors-"+ip, 1, d.options.Window); err != nil {
+		logger.FromContext(r.Context()).Logger("[warn] fail to count scan errors ", ip, err.Error()).Warn()
+	}
+}
+
+// Middleware counts the responses of every client and escalates once it is
+// found scanning. The ratelimit action answers 429 past Limit requests in the
+// window, the challenge action raises the bot score to bot.MaxScore so the
+// challenge middleware after it asks for a proof of work, and the ban action
+// bans the client for BanDuration. Verified good bots are never escalated,
+// they follow whatever stale links they find.
+func (d *Detector) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ip := clientip.FromContext(c)
+		_, reason, _ := bot.FromContext(c)
+		if d.cache == nil || ip == "" || strings.HasPrefix(reason, "verified ") {
+			c.Next()
+			return
+		}
+
+		total, errors := d.count(c.Request, ip)
+		if d.Scanning(errors, total) && !d.escalate(c, ip, reason, total, errors) {
+			// refused requests keep the share of errors up
+			d.countError(c.Request, ip)
+			c.Abort()
+			return
+		}
+
+		c.Next()
+
+		if slices.Contains(d.options.Statuses, c.Writer.Status()) {
+			d.countError(c.Request, ip)
+		}
+	}
+}
+
+// escalate applies the action to a scanning client and reports whether the
+// request goes on.
+func (d *Detector) escalate(c *gin.Context, ip string, reason string, total int64, errors int64) bool {
+	c.Set(ScanningKey, true)
+
+	switch d.options.Action {
+	case ActionLog:
+		logger.FromContext(c.Request.Context()).Logger("[warn] scan detected ", ip, " ", errors, " errors in ", total, " requests").Warn()
+	case ActionRateLimit:
+		if total <= d.options.Limit {
+			return true
+		}
+		record := audit.Record{
+			Source: "scan",
+			Action: "rate_limit",
+			Status: http.StatusTooManyRequests,
+		}
+		if d.dryRun.Forward(c, record) {
+			return true
+		}
+
+		logger.FromContext(c.Request.Context()).Logger("[warn] scanner rate limited ", ip, " ", errors, " errors in ", total, " requests").Warn()
+		d.audit.Log(c.Request, ip, record)
+		if block.Respond(c, block.FromRecord(record)) {
+			return false
+		}
+		c.String(http.StatusTooManyRequests, "429 | Too many request.")
+		return false
+	case ActionChallenge:
+		if reason != "" {
+			reason += ","
+		}
+		c.Set(bot.ScoreKey, bot.MaxScore)
+		c.Set(bot.ReasonKey, reason+"scan")
+	case ActionBan:
+		record := audit.Record{
+			Source: "scan",
+			Action: "ban",
+			Status: http.StatusForbidden,
+		}
+		if d.dryRun.Forward(c, record) {
+			return true
+		}
+		if d.autoBan == nil {
+			logger.FromContext(c.Request.Context()).Logger("[warn] scan detected ", ip, " ", errors, " errors in ", total, " requests").Warn()
+			return true
+		}
+
+		if err := d.autoBan.Ban(clientip.KeyFromContext(c), d.options.BanDuration); err != nil {
+			logger.FromContext(c.Request.Context()).Logger("[warn] fail to ban scanner ", ip, err.Error()).Warn()
+		} else {
+			logger.FromContext(c.Request.Context()).Logger("[warn] scanner banned ", ip, " for ", d.options.BanDuration.String(), " ", errors, " errors in ", total, " requests").Warn()
+		}
+		d.audit.Log(c.Request, ip, record)
+		if block.Respond(c, block.FromRecord(record)) {
+			return false
+		}
+		c.String(http.StatusForbidden, "403 | Forbidden.")
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,222 @@
+package secheaders
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/jahrulnr/go-waf/pkg/filewatch"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Modes of a policy.
+const (
+	ModeOverride = "override" // the policy's value replaces the upstream's
+	ModeAdd      = "add"      // only headers the upstream didn't send are added
+)
+
+// Policy is the set of response headers the WAF sends, so the upstreams
+// don't each have to. A route overrides it for the paths below its Path, the
+// longest matching route wins.
+type Policy struct {
+	Mode    string            `yaml:"mode"`    // ModeOverride or ModeAdd, default ModeOverride
+	Headers map[string]string `yaml:"headers"` // an empty value sends none
+	Remove  []string          `yaml:"remove"`  // headers dropped from every response, e.g. Server
+	Routes  []Route           `yaml:"routes"`
+
+	rules []rule // longest prefix first, the policy itself last
+}
+
+// Route changes the policy below Path, /admin covers /admin/users but not
+// /administrator. Headers are merged into the policy's, an empty value turns
+// one off, Remove adds to the policy's and an empty Mode keeps the policy's.
+type Route struct {
+	Path    string            `yaml:"path"`
+	Mode    string            `yaml:"mode"`
+	Headers map[string]string `yaml:"headers"`
+	Remove  []string          `yaml:"remove"`
+}
+
+// rule is the policy a route ends up with.
+type rule struct {
+	prefix string
+	add    bool
+	set    []header
+	remove []string
+}
+
+type header struct {
+	name  string
+	value string
+}
+
+// LoadFromYAML reads a policy like
+//
+//	mode: override
+//	headers:
+//	  Strict-Transport-Security: max-age=31536000; includeSubDomains
+//	  X-Frame-Options: DENY
+//	remove: [Server, X-Powered-By]
+//	routes:
+//	  - path: /embed
+//	    headers:
+//	      X-Frame-Options: ""
+//	      Content-Security-Policy: frame-ancestors https://partner.example.com
+func LoadFromYAML(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := &Policy{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(policy); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if err := policy.Prepare(); err != nil {
+		return nil, fmt.Errorf("load %s: %w", path, err)
+	}
+
+	return policy, nil
+}
+
+// Prepare checks the policy and resolves its routes, it must be called once
+// the policy is filled in and before it is used.
+func (p *Policy) Prepare() error {
+	base, err := resolve("/", rule{}, p.Mode, p.Headers, p.Remove)
+	if err != nil {
+		return err
+	}
+
+	var rules []rule
+	for _, route := range p.Routes {
+		if !strings.HasPrefix(route.Path, "/") {
+			return fmt.Errorf("route %q must start with /", route.Path)
+		}
+		resolved, err := resolve(path.Clean(route.Path), base, route.Mode, route.Headers, route.Remove)
+		if err != nil {
+			return fmt.Errorf("route %s: %w", route.Path, err)
+		}
+		rules = append(rules, resolved)
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		return len(rules[i].prefix) > len(rules[j].prefix)
+	})
+	p.rules = append(rules, base)
+
+	return nil
+}
+
+// resolve merges mode, headers and remove into parent.
+func resolve(prefix string, parent rule, mode string, headers map[string]string, remove []string) (rule, error) {
+	resolved := rule{prefix: prefix, add: parent.add}
+	switch mode {
+	case "":
+	case ModeOverride:
+		resolved.add = false
+	case ModeAdd:
+		resolved.add = true
+	default:
+		return rule{}, fmt.Errorf("mode %q must be %s or %s", mode, ModeOverride, ModeAdd)
+	}
+
+	values := make(map[string]string)
+	for _, h := range parent.set {
+		values[h.name] = h.value
+	}
+	for name, value := range headers {
+		values[http.CanonicalHeaderKey(strings.TrimSpace(name))] = strings.TrimSpace(value)
+	}
+	for name, value := range values {
+		if value != "" {
+			resolved.set = append(resolved.set, header{name: name, value: value})
+		}
+	}
+	sort.Slice(resolved.set, func(i, j int) bool {
+		return resolved.set[i].name < resolved.set[j].name
+	})
+
+	resolved.remove = append([]string(nil), parent.remove...)
+	for _, name := range remove {
+		if name = strings.TrimSpace(name); name != "" {
+			resolved.remove = append(resolved.remove, http.CanonicalHeaderKey(name))
+		}
+	}
+
+	return resolved, nil
+}
+
+// Policy returns p, so a fixed policy is a Provider too.
+func (p *Policy) Policy() *Policy {
+	return p
+}
+
+// match returns the rule of requestPath.
+func (p *Policy) match(requestPath string) *rule {
+	requestPath = path.Clean("/" + requestPath)
+	for i := range p.rules {
+		prefix := p.rules[i].prefix
+		if prefix == "/" || requestPath == prefix || strings.HasPrefix(requestPath, prefix+"/") {
+			return &p.rules[i]
+		}
+	}
+
+	return nil
+}
+
+// Watcher keeps the Policy loaded from a YAML file up to date.
+type Watcher struct {
+	path    string
+	current atomic.Pointer[Policy]
+	watcher *filewatch.Watcher
+}
+
+// NewWatcher loads path and reloads it whenever it changes. The initial load
+// must succeed, later invalid versions are logged and ignored.
+func NewWatcher(path string) (*Watcher, error) {
+	policy, err := LoadFromYAML(path)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Watcher{path: filepath.Clean(path)}
+	w.current.Store(policy)
+
+	w.watcher, err = filewatch.New(path, w.reload)
+	if err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// Policy returns the active policy.
+func (w *Watcher) Policy() *Policy {
+	return w.current.Load()
+}
+
+func (w *Watcher) Close() error {
+	return w.watcher.Close()
+}
+
+func (w *Watcher) reload() {
+	policy, err := LoadFromYAML(w.path)
+	if err != nil {
+		logger.Logger("[error] keep previous security headers, reload failed ", err.Error()).Error()
+		return
+	}
+
+	w.current.Store(policy)
+	logger.Logger("[info] reloaded security headers from ", w.path).Info()
+}
@@ -0,0 +1,85 @@
+package secheaders
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Provider returns the policy to apply, either a fixed *Policy or a
+// *Watcher.
+type Provider interface {
+	Policy() *Policy
+}
+
+// Injector sets the security headers of every response, the upstream's and
+// the WAF's own pages alike, and drops the headers leaking the upstream's
+// internals.
+type Injector struct {
+	provider Provider
+}
+
+func NewInjector(provider Provider) *Injector {
+	return &Injector{provider: provider}
+}
+
+// Middleware applies the policy of the request path once the response
+// headers are final, after the upstream headers were copied.
+func (i *Injector) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		matched := i.provider.Policy().match(c.Request.URL.Path)
+		if matched == nil {
+			c.Next()
+			return
+		}
+
+		c.Writer = &headerWriter{ResponseWriter: c.Writer, apply: matched.apply}
+		c.Next()
+	}
+}
+
+func (r *rule) apply(header http.Header) {
+	for _, name := range r.remove {
+		header.Del(name)
+	}
+	for _, h := range r.set {
+		if r.add && header.Get(h.name) != "" {
+			continue
+		}
+		header.Set(h.name, h.value)
+	}
+}
+
+// headerWriter applies the policy right before the headers are written.
+type headerWriter struct {
+	gin.ResponseWriter
+	apply   func(http.Header)
+	applied bool
+}
+
+func (w *headerWriter) before() {
+	if !w.applied {
+		w.applied = true
+		w.apply(w.ResponseWriter.Header())
+	}
+}
+
+func (w *headerWriter) WriteHeader(status int) {
+	w.before()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *headerWriter) WriteHeaderNow() {
+	w.before()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *headerWriter) Write(data []byte) (int, error) {
+	w.before()
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *headerWriter) WriteString(data string) (int, error) {
+	w.before()
+	return w.ResponseWriter.WriteString(data)
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/jahrulnr/go-waf/internal/interface/repository"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// certTTL keeps certificates past their 90 days of validity, autocert renews
+// them 30 days before and every renewal refreshes the entry.
+const certTTL = 120 * 24 * time.Hour
+
+// CertCache keeps the certificates and the ACME account key in cache, so
+// every instance sharing it, through the redis or tiered driver, serves the
+// same certificates and only one of them has to request each.
+type CertCache struct {
+	cache repository.CacheInterface
+}
+
+func NewCertCache(cache repository.CacheInterface) *CertCache {
+	return &CertCache{cache: cache}
+}
+
+func (c *CertCache) key(name string) string {
+	return "gowaf-acme-" + name
+}
+
+func (c *CertCache) Get(ctx context.Context, name string) ([]byte, error) {
+	data, found := c.cache.WithContext(ctx).Get(c.key(name))
+	if !found {
+		return nil, autocert.ErrCacheMiss
+	}
+
+	return data, nil
+}
+
+func (c *CertCache) Put(ctx context.Context, name string, data []byte) error {
+	return c.cache.WithContext(ctx).Set(c.key(name), data, certTTL)
+}
+
+func (c *CertCache) Delete(ctx context.Context, name string) error {
+	return c.cache.WithContext(ctx).Remove(c.key(name))
+}
@@ -0,0 +1,282 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jahrulnr/go-waf/internal/interface/repository"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+	"github.com/jahrulnr/go-waf/pkg/revocation"
+	"github.com/jahrulnr/go-waf/pkg/smuggling"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// DefaultCipherSuites are the TLS 1.2 suites offered by default, forward
+// secret AEAD ones only. TLS 1.3 suites are not configurable in Go.
+var DefaultCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// Options configures the server. Zero values take the defaults noted on
+// each field. Without CertFile and ACMEHosts it serves plain HTTP.
+type Options struct {
+	Addr string // listen address, default :443 with TLS and :80 without
+
+	CertFile string // static certificate, with KeyFile
+	KeyFile  string
+
+	ACMEHosts     []string                  // hosts certificates are requested for, turns ACME on
+	ACMEEmail     string                    // contact for expiry notices, optional
+	ACMEDirectory string                    // ACME directory URL, default Let's Encrypt production
+	ACMECache     repository.CacheInterface // keeps the certificates, nil requests them again after every restart
+	ACMEHTTPAddr  string                    // answers HTTP-01 challenges and redirects to https, default :80, "-" turns it off
+
+	ClientCerts bool                // asks clients for a certificate, which the mtls middleware verifies
+	Stapler     *revocation.Stapler // staples OCSP responses to the certificates, nil doesn't
+	Smuggling   bool                // scans plain HTTP/1 connections for smuggling.Guard, see smuggling.Listener
+
+	MinVersion   uint16   // default tls.VersionTLS12
+	CipherSuites []uint16 // TLS 1.2 suites, default DefaultCipherSuites
+
+	ReadHeaderTimeout time.Duration // default 10s
+	ReadBodyTimeout   time.Duration // to read a request body, 0 unlimited
+	IdleTimeout       time.Duration // keep-alive connections are closed after, default 2m
+
+	MinDataRate      int64         // bytes per second a request body has to come in at after MinDataRateGrace, 0 turns it off
+	MinDataRateGrace time.Duration // default 5s
+
+	// OnSlowClient is called for every request cut for sending its header or
+	// body too slowly, with the client IP, empty when a trusted proxy sent
+	// the header, and PhaseHeader or PhaseBody.
+	OnSlowClient func(ip string, phase string)
+	Trusted      []net.IPNet // proxies trusted to forward the client IP
+}
+
+// Server wraps an http.Server terminating TLS, with a static certificate or
+// certificates managed through ACME. With ACME a second listener answers the
+// HTTP-01 challenges and redirects everything else to https, TLS-ALPN-01
+// challenges are answered on the TLS listener itself.
+type Server struct {
+	server    *http.Server
+	challenge *http.Server
+	options   Options
+	tls       bool
+	smuggling bool
+}
+
+func NewServer(handler http.Handler, options Options) (*Server, error) {
+	acmeOn := len(options.ACMEHosts) > 0
+	staticOn := options.CertFile != "" || options.KeyFile != ""
+	if acmeOn && staticOn {
+		return nil, errors.New("server: set either a certificate or ACME hosts, not both")
+	}
+
+	if options.ReadHeaderTimeout <= 0 {
+		options.ReadHeaderTimeout = 10 * time.Second
+	}
+	if options.IdleTimeout <= 0 {
+		options.IdleTimeout = 2 * time.Minute
+	}
+	if options.MinDataRateGrace <= 0 {
+		options.MinDataRateGrace = 5 * time.Second
+	}
+	s := &Server{
+		server: &http.Server{
+			Addr:              options.Addr,
+			ReadHeaderTimeout: options.ReadHeaderTimeout,
+			IdleTimeout:       options.IdleTimeout,
+		},
+		options:   options,
+		tls:       acmeOn || staticOn,
+		smuggling: options.Smuggling && !(acmeOn || staticOn),
+	}
+	s.server.Handler = s.guard(handler)
+	s.server.ConnContext = s.connContext
+	if options.OnSlowClient != nil {
+		s.server.ConnState = s.connState
+	}
+	if !s.tls {
+		if s.server.Addr == "" {
+			s.server.Addr = ":80"
+		}
+		return s, nil
+	}
+	if s.server.Addr == "" {
+		s.server.Addr = ":443"
+	}
+
+	var config *tls.Config
+	if acmeOn {
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(options.ACMEHosts...),
+			Email:      options.ACMEEmail,
+		}
+		if options.ACMECache != nil {
+			manager.Cache = NewCertCache(options.ACMECache)
+		}
+		if options.ACMEDirectory != "" {
+			manager.Client = &acme.Client{DirectoryURL: options.ACMEDirectory}
+		}
+		config = manager.TLSConfig()
+
+		if options.ACMEHTTPAddr == "" {
+			options.ACMEHTTPAddr = ":80"
+		}
+		if options.ACMEHTTPAddr != "-" {
+			s.challenge = &http.Server{
+				Addr:              options.ACMEHTTPAddr,
+				Handler:           manager.HTTPHandler(nil),
+				ReadHeaderTimeout: options.ReadHeaderTimeout,
+			}
+		}
+	} else {
+		cert, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("server: load certificate: %w", err)
+		}
+		config = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   []string{"h2", "http/1.1"},
+		}
+	}
+
+	config.MinVersion = options.MinVersion
+	if config.MinVersion == 0 {
+		config.MinVersion = tls.VersionTLS12
+	}
+	config.CipherSuites = options.CipherSuites
+	if len(config.CipherSuites) == 0 {
+		config.CipherSuites = DefaultCipherSuites
+	}
+	config.CurvePreferences = []tls.CurveID{tls.X25519, tls.CurveP256}
+	if options.ClientCerts {
+		config.ClientAuth = tls.RequestClientCert
+	}
+	if options.Stapler != nil {
+		next := config.GetCertificate
+		if next == nil {
+			cert := &config.Certificates[0]
+			next = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return cert, nil
+			}
+		}
+		config.GetCertificate = options.Stapler.GetCertificate(next)
+	}
+	s.server.TLSConfig = config
+
+	return s, nil
+}
+
+// TLS reports whether the server terminates TLS.
+func (s *Server) TLS() bool {
+	return s.tls
+}
+
+// ListenAndServe serves until Shutdown, returning http.ErrServerClosed then,
+// or until a listener fails.
+func (s *Server) ListenAndServe() error {
+	listener, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		return err
+	}
+	if s.options.OnSlowClient != nil {
+		listener = slowListener{Listener: listener}
+	}
+
+	if !s.tls {
+		if s.smuggling {
+			listener = smuggling.Listener(listener)
+		}
+		return s.server.Serve(listener)
+	}
+
+	if s.challenge != nil {
+		go func() {
+			err := s.challenge.ListenAndServe()
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				// TLS-ALPN-01 still works, if the TLS listener is on :443
+				logger.Logger("[warn] acme http challenges are not answered ", err.Error()).Warn()
+			}
+		}()
+	}
+
+	// the certificates are in TLSConfig
+	return s.server.ServeTLS(listener, "", "")
+}
+
+// Shutdown stops both listeners, waiting for the requests in flight at most
+// until ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	var errs []error
+	if s.challenge != nil {
+		errs = append(errs, s.challenge.Shutdown(ctx))
+	}
+	errs = append(errs, s.server.Shutdown(ctx))
+
+	return errors.Join(errs...)
+}
+
+// Close closes both listeners and every connection right away.
+func (s *Server) Close() error {
+	var errs []error
+	if s.challenge != nil {
+		errs = append(errs, s.challenge.Close())
+	}
+	errs = append(errs, s.server.Close())
+
+	return errors.Join(errs...)
+}
+
+// ParseVersion reads a TLS version as "1.0" to "1.3".
+func ParseVersion(version string) (uint16, error) {
+	switch strings.TrimSpace(version) {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+
+	return 0, fmt.Errorf("unknown TLS version %q, use 1.2 or 1.3", version)
+}
+
+// ParseCipherSuites reads cipher suite names as listed by tls.CipherSuites,
+// e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Insecure suites are refused.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	var suites []uint16
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		id, found := known[name]
+		if !found {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		suites = append(suites, id)
+	}
+
+	return suites, nil
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/jahrulnr/go-waf/pkg/clientip"
+	"github.com/jahrulnr/go-waf/pkg/smuggling"
+)
+
+// Phases of a request a slow client is caught in.
+const (
+	PhaseHeader = "header"
+	PhaseBody   = "body"
+)
+
+type slowConnKey struct{}
+
+// slowListener wraps the accepted connections in a slowConn.
+type slowListener struct {
+	net.Listener
+}
+
+func (l slowListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &slowConn{Conn: c}, nil
+}
+
+// slowConn tells a request header timing out from an idle keep-alive
+// connection closing: one closed after a read deadline, with part of a
+// request received and before the request was handled, sent its header too
+// slowly.
+type slowConn struct {
+	net.Conn
+
+	received atomic.Int64 // bytes since the connection went idle
+	timedOut atomic.Bool  // a read hit its deadline since
+	served   atomic.Bool  // a request was handled since
+}
+
+func (c *slowConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.received.Add(int64(n))
+	if err != nil && errors.Is(err, os.ErrDeadlineExceeded) {
+		c.timedOut.Store(true)
+	}
+
+	return n, err
+}
+
+// SetReadDeadline starts the count over when the deadline is lifted, which
+// the server does once the TLS handshake is done, so a client connecting
+// ahead of time isn't taken for a slow one.
+func (c *slowConn) SetReadDeadline(t time.Time) error {
+	if t.IsZero() {
+		c.received.Store(0)
+	}
+
+	return c.Conn.SetReadDeadline(t)
+}
+
+// slowConnOf finds the slowConn below the wrappers of c, like tls.Conn.
+func slowConnOf(c net.Conn) *slowConn {
+	for c != nil {
+		if conn, ok := c.(*slowConn); ok {
+			return conn
+		}
+		inner, ok := c.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil
+		}
+		c = inner.NetConn()
+	}
+
+	return nil
+}
+
+// connState follows the connections for the header timeouts, for
+// http.Server.ConnState. Aborting the background read of a finished request
+// also hits a deadline, so everything starts over once the connection goes
+// idle. HTTP/2 connections never go idle through the hook.
+func (s *Server) connState(c net.Conn, state http.ConnState) {
+	conn := slowConnOf(c)
+	if conn == nil {
+		return
+	}
+
+	switch state {
+	case http.StateIdle:
+		conn.received.Store(0)
+		conn.timedOut.Store(false)
+		conn.served.Store(false)
+	case http.StateClosed:
+		if !conn.served.Load() && conn.timedOut.Load() && conn.received.Load() > 0 {
+			s.options.OnSlowClient(s.peerIP(conn), PhaseHeader)
+		}
+	}
+}
+
+// peerIP returns the address the connection comes from, empty for a trusted
+// proxy, whose clients can't be told apart before a request is read.
+func (s *Server) peerIP(c net.Conn) string {
+	host, _, err := net.SplitHostPort(c.RemoteAddr().String())
+	if err != nil {
+		return ""
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+	for _, network := range s.options.Trusted {
+		if network.Contains(ip) {
+			return ""
+		}
+	}
+
+	return ip.String()
+}
+
+// guard enforces ReadBodyTimeout and MinDataRate on the bodies of the
+// requests handler gets, and ends the header phase of their connection.
+func (s *Server) guard(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if conn, ok := r.Context().Value(slowConnKey{}).(*slowConn); ok {
+			conn.served.Store(true)
+		}
+
+		limited := s.options.ReadBodyTimeout > 0 || s.options.MinDataRate > 0
+		if limited && r.Body != nil && r.Body != http.NoBody && r.Header.Get("Upgrade") == "" {
+			body := &slowBody{
+				ReadCloser: r.Body,
+				controller: http.NewResponseController(w),
+				rate:       s.options.MinDataRate,
+				grace:      s.options.MinDataRateGrace,
+			}
+			if s.options.ReadBodyTimeout > 0 {
+				body.deadline = time.Now().Add(s.options.ReadBodyTimeout)
+			}
+			if s.options.OnSlowClient != nil {
+				body.onTimeout = func() {
+					ip := ""
+					if addr := clientip.RealIP(r, s.options.Trusted); addr != nil {
+						ip = addr.String()
+					}
+					s.options.OnSlowClient(ip, PhaseBody)
+				}
+			}
+			r.Body = body
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// connContext makes the connections known to guard and the smuggling
+// guard, for http.Server.ConnContext.
+func (s *Server) connContext(ctx context.Context, c net.Conn) context.Context {
+	if s.smuggling {
+		ctx = smuggling.ConnContext(ctx, c)
+	}
+	if conn := slowConnOf(c); conn != nil {
+		ctx = context.WithValue(ctx, slowConnKey{}, conn)
+	}
+
+	return ctx
+}
+
+// slowBody cuts a request body through read deadlines once it took longer
+// than the body timeout, or came in slower than rate bytes per second after
+// the grace period. Only the time spent waiting for the client counts
+// towards the rate, a handler reading slowly while the upstream takes its
+// time isn't the client's fault. The deadline is lifted once the body is
+// read, a body left unread keeps it, so the server gives up discarding it
+// in time.
+type slowBody struct {
+	io.ReadCloser
+	controller *http.ResponseController
+	deadline   time.Time // end of the body timeout, zero without
+	rate       int64
+	grace      time.Duration
+	onTimeout  func()
+
+	read   int64
+	waited time.Duration
+	done   bool
+}
+
+func (b *slowBody) Read(p []byte) (int, error) {
+	if b.done {
+		return b.ReadCloser.Read(p)
+	}
+
+	start := time.Now()
+	deadline := b.deadline
+	if b.rate > 0 {
+		allowed := max(b.grace, time.Duration(float64(b.read)/float64(b.rate)*float64(time.Second)))
+		if rated := start.Add(allowed - b.waited); deadline.IsZero() || rated.Before(deadline) {
+			deadline = rated
+		}
+	}
+	// not every connection supports deadlines, its bodies are then not limited
+	_ = b.controller.SetReadDeadline(deadline)
+
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	b.waited += time.Since(start)
+	switch {
+	case err == io.EOF:
+		b.done = true
+		_ = b.controller.SetReadDeadline(time.Time{})
+	case err != nil && errors.Is(err, os.ErrDeadlineExceeded):
+		b.done = true
+		if b.onTimeout != nil {
+			b.onTimeout()
+		}
+	}
+
+	return n, err
+}
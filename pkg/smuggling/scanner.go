@@ -0,0 +1,238 @@
+package smuggling
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// maxLine bounds a head or chunk line, a bit above the 1MB net/http accepts
+// for a whole head.
+const maxLine = 1<<20 + 4096
+
+// maxPending bounds the verdicts of pipelined requests not served yet.
+const maxPending = 64
+
+const (
+	stateHead = iota
+	stateBody
+	stateChunkSize
+	stateChunkData
+	stateChunkEnd
+	stateTrailer
+)
+
+// scanner follows the message boundaries of an HTTP/1 request stream on its
+// own, strictly, and judges every request head. A bad head ends the scan,
+// the middleware closes the connection after rejecting it. Once the stream
+// can't be followed, every later request on it is rejected too.
+type scanner struct {
+	state     int
+	line      []byte
+	head      []string
+	bareLF    bool
+	remaining int64
+
+	verdicts []string // one rule id per request, empty when it passed
+	lost     bool     // the stream can't be followed anymore
+}
+
+func (s *scanner) scan(data []byte) {
+	for len(data) > 0 && !s.lost {
+		switch s.state {
+		case stateBody, stateChunkData:
+			n := int64(len(data))
+			if n > s.remaining {
+				n = s.remaining
+			}
+			s.remaining -= n
+			data = data[n:]
+			if s.remaining == 0 {
+				if s.state == stateBody {
+					s.state = stateHead
+				} else {
+					s.state = stateChunkEnd
+				}
+			}
+		default:
+			i := bytes.IndexByte(data, '\n')
+			if i < 0 {
+				s.line = append(s.line, data...)
+				if len(s.line) > maxLine {
+					s.lose()
+				}
+				return
+			}
+			s.line = append(s.line, data[:i+1]...)
+			data = data[i+1:]
+			s.handle(s.line)
+			s.line = s.line[:0]
+		}
+	}
+}
+
+// lose stops the scan.
+func (s *scanner) lose() {
+	s.lost = true
+	s.line = nil
+	s.head = nil
+}
+
+func (s *scanner) handle(line []byte) {
+	bareLF := !bytes.HasSuffix(line, []byte("\r\n"))
+	text := string(bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r")))
+
+	switch s.state {
+	case stateHead:
+		if text == "" {
+			if len(s.head) > 0 {
+				s.endHead()
+			}
+			return
+		}
+		s.head = append(s.head, text)
+		s.bareLF = s.bareLF || bareLF
+
+	case stateChunkSize:
+		size, ok := chunkSize(text)
+		if bareLF || !ok {
+			s.lose()
+			return
+		}
+		if size == 0 {
+			s.state = stateTrailer
+		} else {
+			s.remaining = size
+			s.state = stateChunkData
+		}
+
+	case stateChunkEnd:
+		if bareLF || text != "" {
+			s.lose()
+			return
+		}
+		s.state = stateChunkSize
+
+	case stateTrailer:
+		if bareLF {
+			s.lose()
+			return
+		}
+		if text == "" {
+			s.state = stateHead
+		}
+	}
+}
+
+// endHead judges the finished head and sets up reading its body.
+func (s *scanner) endHead() {
+	verdict, framing := judge(s.head, s.bareLF)
+	// net/http answers OPTIONS * itself, the middleware never sees it
+	if !strings.HasPrefix(s.head[0], "OPTIONS * ") {
+		s.verdicts = append(s.verdicts, verdict)
+	}
+	if len(s.verdicts) > maxPending {
+		s.lose()
+		return
+	}
+	s.head = s.head[:0]
+	s.bareLF = false
+
+	switch {
+	case verdict != "":
+		// the middleware closes the connection
+		s.lose()
+	case framing.chunked:
+		s.state = stateChunkSize
+	case framing.length > 0:
+		s.remaining = framing.length
+		s.state = stateBody
+	}
+}
+
+// next pops the verdict of the oldest request not served yet.
+func (s *scanner) next() string {
+	if len(s.verdicts) > 0 {
+		verdict := s.verdicts[0]
+		s.verdicts = s.verdicts[1:]
+		return verdict
+	}
+	if s.lost {
+		return RuleDesync
+	}
+
+	return ""
+}
+
+type framing struct {
+	chunked bool
+	length  int64
+}
+
+// judge checks a request head, returning the broken rule or how its body is
+// framed.
+func judge(head []string, bareLF bool) (string, framing) {
+	var f framing
+	if bareLF {
+		return RuleLineEnding, f
+	}
+
+	fields := strings.Fields(head[0])
+	if len(fields) != 3 {
+		return RuleHeader, f
+	}
+	proto := fields[2]
+
+	var lengths, codings []string
+	for _, line := range head[1:] {
+		if line[0] == ' ' || line[0] == '\t' {
+			return RuleLineFolding, f
+		}
+		name, value, found := strings.Cut(line, ":")
+		if !found || strings.TrimRight(name, " \t") != name {
+			return RuleHeader, f
+		}
+
+		value = strings.Trim(value, " \t")
+		switch strings.ToLower(name) {
+		case "content-length":
+			lengths = append(lengths, value)
+		case "transfer-encoding":
+			codings = append(codings, value)
+		}
+	}
+
+	if len(codings) > 0 {
+		if len(lengths) > 0 {
+			return RuleCLTE, f
+		}
+		if proto == "HTTP/1.0" || len(codings) > 1 || !strings.EqualFold(codings[0], "chunked") {
+			return RuleTransferEncoding, f
+		}
+		f.chunked = true
+		return "", f
+	}
+
+	for _, value := range lengths {
+		if value != lengths[0] || value == "" || strings.Trim(value, "0123456789") != "" || len(value) > 18 {
+			return RuleContentLength, f
+		}
+	}
+	if len(lengths) > 0 {
+		f.length, _ = strconv.ParseInt(lengths[0], 10, 64)
+	}
+
+	return "", f
+}
+
+// chunkSize parses a chunk size line, allowing extensions after ';'.
+func chunkSize(line string) (int64, bool) {
+	size, _, _ := strings.Cut(line, ";")
+	size = strings.TrimRight(size, " \t")
+	if size == "" || len(size) > 16 || strings.Trim(size, "0123456789abcdefABCDEF") != "" {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(size, 16, 64)
+
+	return n, err == nil
+}
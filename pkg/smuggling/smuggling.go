@@ -0,0 +1,244 @@
+package smuggling
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/jahrulnr/go-waf/pkg/audit"
+	"github.com/jahrulnr/go-waf/pkg/block"
+	"github.com/jahrulnr/go-waf/pkg/clientip"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The rules a rejected request broke, as written to the audit log.
+const (
+	RuleCLTE             = "smuggling-cl-te"             // Content-Length next to Transfer-Encoding
+	RuleTransferEncoding = "smuggling-transfer-encoding" // anything but a single chunked, or chunked in HTTP/1.0
+	RuleContentLength    = "smuggling-content-length"    // several differing or malformed lengths
+	RuleChunked          = "smuggling-chunked"           // a malformed chunked body
+	RuleLineEnding       = "smuggling-line-ending"       // a head line ending in a bare LF
+	RuleLineFolding      = "smuggling-line-folding"      // an obsolete folded header line
+	RuleHeader           = "smuggling-header"            // a malformed request line, a header line without colon or whitespace before it
+	RuleDesync           = "smuggling-desync"            // a request after the connection couldn't be followed
+)
+
+// DefaultMaxBuffer is how much of a chunked body is buffered to forward it
+// with a Content-Length.
+const DefaultMaxBuffer int64 = 1 << 20
+
+type connKey struct{}
+
+// conn scans what the server reads from the connection.
+type conn struct {
+	net.Conn
+
+	mu      sync.Mutex
+	scanner scanner
+	stopped bool
+}
+
+func (c *conn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.mu.Lock()
+		if !c.stopped {
+			c.scanner.scan(p[:n])
+		}
+		c.mu.Unlock()
+	}
+
+	return n, err
+}
+
+// NetConn returns the connection being scanned.
+func (c *conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *conn) next() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stopped {
+		return ""
+	}
+	return c.scanner.next()
+}
+
+// stop ends the scan of a connection asked to switch protocols.
+func (c *conn) stop() {
+	c.mu.Lock()
+	c.stopped = true
+	c.scanner = scanner{}
+	c.mu.Unlock()
+}
+
+type listener struct {
+	net.Listener
+}
+
+func (l listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &conn{Conn: c}, nil
+}
+
+// Listener follows the raw request stream of every connection, which is
+// the only place where net/http leaves Content-Length next to
+// Transfer-Encoding, a chunked HTTP/1.0 request or a bare LF visible. It
+// needs plain HTTP/1 connections, behind TLS the Guard checks what the parsed
+// request still shows. Install ConnContext on the server as well.
+func Listener(l net.Listener) net.Listener {
+	return listener{Listener: l}
+}
+
+// ConnContext makes the connections of Listener known to the Guard, for
+// http.Server.ConnContext.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	if scanned, ok := c.(*conn); ok {
+		return context.WithValue(ctx, connKey{}, scanned)
+	}
+
+	return ctx
+}
+
+// Options configures the guard. Zero values take the defaults noted on
+// each field.
+type Options struct {
+	MaxBuffer int64 // chunked bodies up to this size are forwarded with a Content-Length, default DefaultMaxBuffer
+}
+
+// Guard rejects requests whose message boundaries front proxies and the
+// upstream may disagree on with 400 and closes their connection, then
+// forwards chunked bodies with a Content-Length, so the WAF and the upstream
+// read the same message.
+type Guard struct {
+	options Options
+	audit   *audit.Logger
+}
+
+func NewGuard(options Options) *Guard {
+	if options.MaxBuffer <= 0 {
+		options.MaxBuffer = DefaultMaxBuffer
+	}
+
+	return &Guard{options: options}
+}
+
+// SetAudit writes every rejected request to the audit log.
+func (g *Guard) SetAudit(audit *audit.Logger) {
+	g.audit = audit
+}
+
+// Check returns the rule r breaks, empty when its framing is unambiguous.
+func Check(r *http.Request) string {
+	if scanned, ok := r.Context().Value(connKey{}).(*conn); ok && r.ProtoMajor == 1 {
+		if rule := scanned.next(); rule != "" {
+			return rule
+		}
+	}
+
+	// what is left of the headers once net/http parsed the request
+	lengths := r.Header.Values("Content-Length")
+	codings := r.Header.Values("Transfer-Encoding")
+	if len(codings) == 0 {
+		codings = r.TransferEncoding
+	}
+	if len(lengths) > 0 && len(codings) > 0 {
+		return RuleCLTE
+	}
+	if len(codings) > 1 || (len(codings) == 1 && codings[0] != "chunked") {
+		return RuleTransferEncoding
+	}
+	for _, length := range lengths {
+		if length != lengths[0] || length == "" || len(length) > 18 {
+			return RuleContentLength
+		}
+		if _, err := strconv.ParseUint(length, 10, 63); err != nil {
+			return RuleContentLength
+		}
+	}
+
+	return ""
+}
+
+// normalize reads a chunked body, which net/http decodes strictly, and puts
+// it back with a Content-Length. Bodies over MaxBuffer keep streaming, the
+// proxy chunks them again on its own.
+func (g *Guard) normalize(r *http.Request) string {
+	body, err := io.ReadAll(io.LimitReader(r.Body, g.options.MaxBuffer+1))
+	if err != nil {
+		logger.FromContext(r.Context()).Logger("[debug] malformed chunked body ", err.Error()).Debug()
+		return RuleChunked
+	}
+
+	if int64(len(body)) > g.options.MaxBuffer {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return ""
+	}
+
+	r.Body.Close()
+	r.Body = http.NoBody
+	if len(body) > 0 {
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	r.ContentLength = int64(len(body))
+	r.TransferEncoding = nil
+	r.Header.Del("Transfer-Encoding")
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	return ""
+}
+
+// Middleware rejects ambiguous requests before any other middleware reads
+// them. It has to see every request of a connection, so only middlewares
+// that never abort may run before it: the connection scan pairs its
+// verdicts with the requests in order.
+func (g *Guard) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		rule := Check(c.Request)
+		if rule == "" && len(c.Request.TransferEncoding) > 0 {
+			rule = g.normalize(c.Request)
+		}
+		if rule != "" {
+			logger.FromContext(c.Request.Context()).Logger("[warn] smuggling rejected ", clientip.FromContext(c), " ", rule, " ", c.Request.Method, " ", c.Request.URL.RequestURI()).Warn()
+			record := audit.Record{
+				Source: "smuggling",
+				Rules:  []string{rule},
+				Status: http.StatusBadRequest,
+			}
+			g.audit.Log(c.Request, clientip.FromContext(c), record)
+			// whatever follows on this connection can't be trusted
+			c.Header("Connection", "close")
+			if block.Respond(c, block.FromRecord(record)) {
+				return
+			}
+			c.String(http.StatusBadRequest, "400 | Bad Request.")
+			c.Abort()
+			return
+		}
+
+		c.Next()
+
+		// a websocket or other upgrade takes the connection over, refused
+		// ones fall back to the header checks for the rest of it
+		if c.GetHeader("Upgrade") != "" {
+			if scanned, ok := c.Request.Context().Value(connKey{}).(*conn); ok {
+				scanned.stop()
+			}
+		}
+	}
+}
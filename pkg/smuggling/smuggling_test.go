@@ -0,0 +1,240 @@
+package smuggling_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jahrulnr/go-waf/pkg/smuggling"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// newServer serves the guard on a scanned listener, as pkg/server does for
+// plain HTTP. The handler echoes the body and its framing.
+func newServer(t *testing.T) *httptest.Server {
+	engine := gin.New()
+	engine.Use(smuggling.NewGuard(smuggling.Options{}).Middleware())
+	engine.Any("/*path", func(c *gin.Context) {
+		body, _ := io.ReadAll(c.Request.Body)
+		c.Header("X-Content-Length", c.Request.Header.Get("Content-Length"))
+		c.Header("X-Transfer-Encoding", strings.Join(c.Request.TransferEncoding, ","))
+		c.String(http.StatusOK, string(body))
+	})
+
+	server := httptest.NewUnstartedServer(engine)
+	server.Listener = smuggling.Listener(server.Listener)
+	server.Config.ConnContext = smuggling.ConnContext
+	server.Start()
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// send writes raw to a new connection and reads the responses to the
+// requests of it, as many as come before the connection closes.
+func send(t *testing.T, server *httptest.Server, raw string, requests int) []*http.Response {
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := io.WriteString(conn, raw); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := bufio.NewReader(conn)
+	var responses []*http.Response
+	for range requests {
+		response, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			break
+		}
+		body, _ := io.ReadAll(response.Body)
+		response.Body = io.NopCloser(strings.NewReader(string(body)))
+		responses = append(responses, response)
+		if response.Close {
+			break
+		}
+	}
+
+	return responses
+}
+
+func TestRejected(t *testing.T) {
+	tests := []struct {
+		name   string
+		raw    string
+		status int // net/http answers unknown codings itself
+	}{
+		{
+			name: "content-length and transfer-encoding",
+			raw:  "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 4\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+		},
+		{
+			name: "transfer-encoding and content-length",
+			raw:  "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nContent-Length: 3\r\n\r\n8\r\nSMUGGLED\r\n0\r\n\r\n",
+		},
+		{
+			name: "differing duplicate content-length",
+			raw:  "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 0\r\nContent-Length: 5\r\n\r\nGET /",
+		},
+		{
+			name: "malformed content-length",
+			raw:  "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: +5\r\n\r\nhello",
+		},
+		{
+			name:   "obfuscated transfer-encoding",
+			raw:    "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: xchunked\r\n\r\n0\r\n\r\n",
+			status: http.StatusNotImplemented,
+		},
+		{
+			name:   "transfer-encoding twice",
+			raw:    "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nTransfer-Encoding: identity\r\n\r\n0\r\n\r\n",
+			status: http.StatusNotImplemented,
+		},
+		{
+			name: "space before the colon",
+			raw:  "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding : chunked\r\nContent-Length: 4\r\n\r\n0\r\n\r\n",
+		},
+		{
+			name: "folded transfer-encoding",
+			raw:  "POST / HTTP/1.1\r\nHost: a\r\nX-Padding: a\r\n Transfer-Encoding: chunked\r\nContent-Length: 0\r\n\r\n",
+		},
+		{
+			name: "chunked in http/1.0",
+			raw:  "POST / HTTP/1.0\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+		},
+		{
+			name: "bare line feed",
+			raw:  "GET / HTTP/1.1\nHost: a\r\n\r\n",
+		},
+		{
+			name: "malformed chunk size",
+			raw:  "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\nhello\r\n0\r\n\r\n",
+		},
+	}
+
+	server := newServer(t)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			responses := send(t, server, test.raw, 1)
+			if len(responses) == 0 {
+				t.Fatal("no response")
+			}
+			status := test.status
+			if status == 0 {
+				status = http.StatusBadRequest
+			}
+			if responses[0].StatusCode != status {
+				t.Errorf("status %d, want %d", responses[0].StatusCode, status)
+			}
+			if !responses[0].Close {
+				t.Error("connection kept open after a rejected request")
+			}
+		})
+	}
+}
+
+// TestSmuggledRequest checks the request hidden in the body of a CL.TE
+// payload never reaches the handler.
+func TestSmuggledRequest(t *testing.T) {
+	server := newServer(t)
+	raw := "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 35\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\nGET /admin HTTP/1.1\r\nHost: a\r\n\r\n"
+
+	responses := send(t, server, raw, 2)
+	if len(responses) != 1 {
+		t.Fatalf("%d responses, want the rejection only", len(responses))
+	}
+	if responses[0].StatusCode != http.StatusBadRequest {
+		t.Errorf("status %d, want 400", responses[0].StatusCode)
+	}
+}
+
+func TestBenign(t *testing.T) {
+	server := newServer(t)
+
+	t.Run("content-length", func(t *testing.T) {
+		raw := "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\n\r\nhello" +
+			"GET /next HTTP/1.1\r\nHost: a\r\n\r\n"
+		responses := send(t, server, raw, 2)
+		if len(responses) != 2 {
+			t.Fatalf("%d responses, want 2", len(responses))
+		}
+		for _, response := range responses {
+			if response.StatusCode != http.StatusOK {
+				t.Errorf("status %d, want 200", response.StatusCode)
+			}
+		}
+		if body, _ := io.ReadAll(responses[0].Body); string(body) != "hello" {
+			t.Errorf("body %q, want hello", body)
+		}
+	})
+
+	t.Run("chunked is forwarded with a content-length", func(t *testing.T) {
+		raw := "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n"
+		responses := send(t, server, raw, 1)
+		if len(responses) != 1 || responses[0].StatusCode != http.StatusOK {
+			t.Fatalf("responses %v, want a 200", responses)
+		}
+		response := responses[0]
+		if body, _ := io.ReadAll(response.Body); string(body) != "hello world" {
+			t.Errorf("body %q, want hello world", body)
+		}
+		if got := response.Header.Get("X-Content-Length"); got != "11" {
+			t.Errorf("upstream Content-Length %q, want 11", got)
+		}
+		if got := response.Header.Get("X-Transfer-Encoding"); got != "" {
+			t.Errorf("upstream Transfer-Encoding %q, want none", got)
+		}
+	})
+}
+
+// TestCheck covers the header checks the guard falls back on when the
+// connection isn't scanned, e.g. behind TLS.
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string][]string
+		chunked bool
+		want    string
+	}{
+		{name: "plain", headers: map[string][]string{"Content-Length": {"5"}}},
+		{name: "identical duplicate lengths", headers: map[string][]string{"Content-Length": {"5", "5"}}},
+		{name: "chunked", chunked: true},
+		{name: "content-length and transfer-encoding", headers: map[string][]string{"Content-Length": {"5"}, "Transfer-Encoding": {"chunked"}}, want: smuggling.RuleCLTE},
+		{name: "content-length next to parsed chunked", headers: map[string][]string{"Content-Length": {"5"}}, chunked: true, want: smuggling.RuleCLTE},
+		{name: "differing lengths", headers: map[string][]string{"Content-Length": {"5", "6"}}, want: smuggling.RuleContentLength},
+		{name: "signed length", headers: map[string][]string{"Content-Length": {"-1"}}, want: smuggling.RuleContentLength},
+		{name: "oversized length", headers: map[string][]string{"Content-Length": {"9999999999999999999"}}, want: smuggling.RuleContentLength},
+		{name: "gzip coding", headers: map[string][]string{"Transfer-Encoding": {"gzip"}}, want: smuggling.RuleTransferEncoding},
+		{name: "two codings", headers: map[string][]string{"Transfer-Encoding": {"chunked", "chunked"}}, want: smuggling.RuleTransferEncoding},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", nil)
+			for name, values := range test.headers {
+				r.Header[name] = values
+			}
+			if test.chunked {
+				r.TransferEncoding = []string{"chunked"}
+			}
+
+			if got := smuggling.Check(r); got != test.want {
+				t.Errorf("Check = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package upload
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// sniffLength is how much of a file its type is detected from, as
+// http.DetectContentType reads.
+const sniffLength = 512
+
+// signatures are the executables and scripts http.DetectContentType doesn't
+// know, the ones an upload filter cares most about.
+var signatures = []struct {
+	prefix    string
+	mediaType string
+}{
+	{"MZ", "application/x-msdownload"},
+	{"\x7fELF", "application/x-executable"},
+	{"#!", "text/x-shellscript"},
+	{"<?php", "application/x-httpd-php"},
+	{"<?=", "application/x-httpd-php"},
+	{"<%", "application/x-asp"},
+}
+
+// Detect returns the media type of a file from its first bytes, without
+// parameters. Unknown binary content is application/octet-stream.
+func Detect(head []byte) string {
+	trimmed := bytes.TrimLeft(head, " \t\r\n")
+	for _, signature := range signatures {
+		if len(trimmed) >= len(signature.prefix) && strings.EqualFold(string(trimmed[:len(signature.prefix)]), signature.prefix) {
+			return signature.mediaType
+		}
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	return mediaType
+}
+
+// compatible reports whether a file declared as declared may hold detected,
+// the sniffer only tells some types apart: text and XML formats look like
+// plain text or XML, office documents and archives like zip.
+func compatible(declared string, detected string) bool {
+	declared = normalize(declared)
+	switch {
+	case declared == "" || declared == "application/octet-stream":
+		return true
+	case detected == "application/octet-stream" || declared == detected:
+		return true
+	case detected == "text/plain":
+		return textual(declared)
+	case detected == "text/xml":
+		return declared == "application/xml" || strings.HasSuffix(declared, "+xml")
+	case detected == "application/zip":
+		return declared == "application/x-zip-compressed" || declared == "application/java-archive" ||
+			strings.HasPrefix(declared, "application/vnd.") || strings.HasSuffix(declared, "+zip")
+	}
+
+	return false
+}
+
+func normalize(mediaType string) string {
+	switch mediaType {
+	case "image/jpg", "image/pjpeg":
+		return "image/jpeg"
+	case "image/x-png":
+		return "image/png"
+	}
+
+	return mediaType
+}
+
+func textual(mediaType string) bool {
+	return strings.HasPrefix(mediaType, "text/") ||
+		mediaType == "application/json" ||
+		mediaType == "application/xml" ||
+		mediaType == "application/javascript" ||
+		strings.HasSuffix(mediaType, "+json") ||
+		strings.HasSuffix(mediaType, "+xml")
+}
+
+// matches reports whether mediaType is one of patterns, where image/* is any
+// image.
+func matches(mediaType string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if strings.HasPrefix(mediaType, prefix+"/") {
+				return true
+			}
+		} else if mediaType == pattern {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,70 @@
+package upload
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// spool keeps what the parser read of a body to replay it to the upstream,
+// the first bytes in memory and the rest in a temporary file, so a large
+// upload never sits in memory whole.
+type spool struct {
+	memory bytes.Buffer
+	limit  int64
+	dir    string
+	file   *os.File
+	size   int64 // written to file
+	err    error
+}
+
+func (s *spool) Write(p []byte) (int, error) {
+	if s.file == nil {
+		if int64(s.memory.Len()+len(p)) <= s.limit {
+			return s.memory.Write(p)
+		}
+		file, err := os.CreateTemp(s.dir, "gowaf-upload-*")
+		if err != nil {
+			s.err = err
+			return 0, err
+		}
+		s.file = file
+	}
+
+	n, err := s.file.Write(p)
+	s.size += int64(n)
+	if err != nil {
+		s.err = err
+	}
+
+	return n, err
+}
+
+// reader replays everything written.
+func (s *spool) reader() io.Reader {
+	memory := bytes.NewReader(s.memory.Bytes())
+	if s.file == nil {
+		return memory
+	}
+
+	return io.MultiReader(memory, io.NewSectionReader(s.file, 0, s.size))
+}
+
+// discard closes and deletes the temporary file, once the request is
+// served.
+func (s *spool) discard() {
+	if s.file != nil {
+		s.file.Close()
+		os.Remove(s.file.Name())
+	}
+}
+
+// replayBody reads the spool, then the rest of the body the parser left.
+type replayBody struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (b *replayBody) Close() error {
+	return b.closer.Close()
+}
@@ -0,0 +1,318 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/jahrulnr/go-waf/pkg/audit"
+	"github.com/jahrulnr/go-waf/pkg/block"
+	"github.com/jahrulnr/go-waf/pkg/clientip"
+	"github.com/jahrulnr/go-waf/pkg/dryrun"
+	"github.com/jahrulnr/go-waf/pkg/limits"
+	"github.com/jahrulnr/go-waf/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+type fieldsKey struct{}
+
+// Options configures the inspection. Zero values take the defaults noted on
+// each field.
+type Options struct {
+	MaxFileSize int64    // bytes of a file, 0 is unlimited
+	MaxFiles    int      // files per request, 0 is unlimited
+	Extensions  []string // allowed file name extensions, e.g. .jpg, empty allows any
+	Types       []string // allowed media types detected from the content, image/* matches any image, empty allows any
+	MaxValues   int64    // bytes of form values kept for the rules, later values are skipped, default 64KiB
+	Memory      int64    // bytes of a body kept in memory, the rest is spooled to a temporary file, default 1MiB
+	TempDir     string   // of the spooled bodies, default os.TempDir
+}
+
+// Field is a form value or a file of a multipart body.
+type Field struct {
+	Name  string
+	Value string // the file name of a file
+	File  bool
+}
+
+// Violation is a file breaking a policy, or a malformed body.
+type Violation struct {
+	Rule    string // upload-extension, upload-type, upload-type-mismatch, upload-size, upload-count or upload-parse
+	Field   string
+	Message string
+}
+
+func (v Violation) status() int {
+	switch v.Rule {
+	case "upload-size", "upload-count":
+		return http.StatusRequestEntityTooLarge
+	case "upload-parse":
+		return http.StatusBadRequest
+	}
+
+	return http.StatusUnsupportedMediaType
+}
+
+// Inspector parses multipart/form-data bodies as they stream in, checks
+// every file against the upload policies and keeps the form values in the
+// request context, so the rule engine inspects them one by one instead of
+// the raw multipart blob, see FromContext.
+//
+// A file's type is detected from its first bytes, never taken from its name
+// or the Content-Type it was sent with, and a declared type the content
+// doesn't match is a violation of its own. Files are read once and only
+// counted, the body is spooled for the upstream, past Memory bytes to a
+// temporary file deleted once the request is served.
+type Inspector struct {
+	options    Options
+	extensions []string
+	audit      *audit.Logger
+	dryRun     *dryrun.DryRun
+}
+
+func NewInspector(options Options) *Inspector {
+	if options.MaxValues <= 0 {
+		options.MaxValues = 64 << 10
+	}
+	if options.Memory <= 0 {
+		options.Memory = 1 << 20
+	}
+
+	var extensions []string
+	for _, extension := range options.Extensions {
+		extension = strings.ToLower(strings.TrimSpace(extension))
+		if extension == "" {
+			continue
+		}
+		if !strings.HasPrefix(extension, ".") {
+			extension = "." + extension
+		}
+		extensions = append(extensions, extension)
+	}
+
+	return &Inspector{
+		options:    options,
+		extensions: extensions,
+	}
+}
+
+// SetAudit writes every refused upload to the audit log.
+func (i *Inspector) SetAudit(audit *audit.Logger) {
+	i.audit = audit
+}
+
+// SetDryRun forwards the uploads breaking a policy, only reporting them.
+func (i *Inspector) SetDryRun(dryRun *dryrun.DryRun) {
+	i.dryRun = dryRun
+}
+
+// FromContext returns the fields of a multipart request, ok is false when
+// the inspector didn't parse its body.
+func FromContext(ctx context.Context) ([]Field, bool) {
+	fields, ok := ctx.Value(fieldsKey{}).([]Field)
+	return fields, ok
+}
+
+// Middleware inspects the multipart requests. It must run after the body
+// limits, which bound what is spooled, and before the rule engine.
+func (i *Inspector) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		mediaType, params, _ := mime.ParseMediaType(c.Request.Header.Get("Content-Type"))
+		if mediaType != "multipart/form-data" || c.Request.Body == nil || c.Request.Body == http.NoBody {
+			c.Next()
+			return
+		}
+
+		spool := &spool{limit: i.options.Memory, dir: i.options.TempDir}
+		defer spool.discard()
+
+		fields, violations, err := i.inspect(c.Request, params["boundary"], spool)
+		c.Request.Body = &replayBody{
+			Reader: io.MultiReader(spool.reader(), c.Request.Body),
+			closer: c.Request.Body,
+		}
+		switch {
+		case spool.err != nil:
+			logger.FromContext(c.Request.Context()).Logger("[error] fail to spool upload ", spool.err.Error()).Error()
+			c.AbortWithStatusJSON(http.StatusInternalServerError, map[string]interface{}{
+				"status": "Internal Server Error",
+			})
+			return
+		case limits.IsTooLarge(err):
+			limits.Reject(c)
+			return
+		case err != nil:
+			violations = append(violations, Violation{Rule: "upload-parse", Message: "malformed multipart body: " + err.Error()})
+		}
+
+		for _, violation := range violations {
+			if !i.reject(c, violation) {
+				return
+			}
+		}
+
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), fieldsKey{}, fields))
+		c.Next()
+	}
+}
+
+// reject answers a violation, unless dry run forwards the request and
+// reject returns true.
+func (i *Inspector) reject(c *gin.Context, violation Violation) bool {
+	status := violation.status()
+	record := audit.Record{
+		Source: "upload",
+		Rules:  []string{violation.Rule},
+		Status: status,
+	}
+	if violation.Field != "" {
+		record.Fields = []string{"file:" + violation.Field}
+	}
+	if i.dryRun.Forward(c, record) {
+		return true
+	}
+
+	ip := clientip.FromContext(c)
+	logger.FromContext(c.Request.Context()).Logger("[warn] ", violation.Rule, " ", ip, " ", c.Request.Method, " ", c.Request.URL.RequestURI(), " ", violation.Message).Warn()
+	i.audit.Log(c.Request, ip, record)
+	decision := block.FromRecord(record)
+	decision.Reason = violation.Message
+	if block.Respond(c, decision) {
+		return false
+	}
+	c.JSON(status, map[string]interface{}{
+		"status": http.StatusText(status),
+		"error":  violation.Message,
+	})
+	c.Abort()
+
+	return false
+}
+
+// inspect reads the parts of the body through spool. It stops at the first
+// violation, unless dry run needs them all.
+func (i *Inspector) inspect(r *http.Request, boundary string, spool *spool) ([]Field, []Violation, error) {
+	if boundary == "" {
+		return nil, nil, errors.New("no boundary")
+	}
+
+	reader := multipart.NewReader(io.TeeReader(r.Body, spool), boundary)
+	var (
+		fields     []Field
+		violations []Violation
+		files      int
+		kept       int64
+	)
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			return fields, violations, nil
+		}
+		if err != nil {
+			return fields, violations, err
+		}
+
+		name, isFile := fileName(part)
+		if !isFile {
+			value, err := io.ReadAll(io.LimitReader(part, i.options.MaxValues-kept))
+			if err != nil {
+				return fields, violations, err
+			}
+			if _, err := io.Copy(io.Discard, part); err != nil {
+				return fields, violations, err
+			}
+			if len(value) > 0 || kept < i.options.MaxValues {
+				kept += int64(len(value))
+				fields = append(fields, Field{Name: part.FormName(), Value: string(value)})
+			}
+			continue
+		}
+
+		files++
+		fields = append(fields, Field{Name: part.FormName(), Value: name, File: true})
+		if i.options.MaxFiles > 0 && files > i.options.MaxFiles {
+			violations = append(violations, Violation{
+				Rule:    "upload-count",
+				Message: fmt.Sprintf("more than %d files", i.options.MaxFiles),
+			})
+		} else {
+			violation, err := i.file(part, name)
+			if err != nil {
+				return fields, violations, err
+			}
+			if violation != nil {
+				violations = append(violations, *violation)
+			}
+		}
+		if len(violations) > 0 && !i.dryRun.Enabled() {
+			return fields, violations, nil
+		}
+	}
+}
+
+// file checks one file, reading it to the end or until it is too large.
+func (i *Inspector) file(part *multipart.Part, name string) (*Violation, error) {
+	violation := func(rule string, format string, args ...interface{}) *Violation {
+		return &Violation{
+			Rule:    rule,
+			Field:   part.FormName(),
+			Message: fmt.Sprintf("file %s: ", name) + fmt.Sprintf(format, args...),
+		}
+	}
+
+	extension := strings.ToLower(filepath.Ext(name))
+	if len(i.extensions) > 0 && !slices.Contains(i.extensions, extension) {
+		return violation("upload-extension", "extension %q is not allowed", extension), nil
+	}
+
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(part, head)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, err
+	}
+	head = head[:n]
+
+	detected := Detect(head)
+	if len(i.options.Types) > 0 && !matches(detected, i.options.Types) {
+		return violation("upload-type", "type %s is not allowed", detected), nil
+	}
+	declared, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+	if !compatible(declared, detected) {
+		return violation("upload-type-mismatch", "declared %s but the content is %s", declared, detected), nil
+	}
+
+	// the rest is only counted
+	rest := io.Reader(part)
+	if i.options.MaxFileSize > 0 {
+		rest = io.LimitReader(part, i.options.MaxFileSize-int64(n)+1)
+	}
+	size, err := io.Copy(io.Discard, rest)
+	if err != nil {
+		return nil, err
+	}
+	if i.options.MaxFileSize > 0 && int64(n)+size > i.options.MaxFileSize {
+		return violation("upload-size", "larger than %d bytes", i.options.MaxFileSize), nil
+	}
+
+	return nil, nil
+}
+
+// fileName returns the file name a part was sent with. Part.FileName drops
+// the directories, which the rules should see.
+func fileName(part *multipart.Part) (string, bool) {
+	_, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	if err != nil {
+		return "", false
+	}
+	name, ok := params["filename"]
+
+	return name, ok
+}